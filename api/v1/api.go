@@ -1,69 +1,475 @@
 package v1
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
+	"sort"
+	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/bufpool"
+	"github.com/imrenagi/go-http-upload/metrics"
+	"github.com/imrenagi/go-http-upload/sniff"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
 )
 
-func FormUpload() http.HandlerFunc {
+// diskRecorder and gcsRecorder record the traffic of the v1 handlers,
+// whose uploads are made of a single chunk, by backend.
+var (
+	diskRecorder = metrics.New(otel.GetMeterProvider(), "v1", "disk")
+	gcsRecorder  = metrics.New(otel.GetMeterProvider(), "v1", "gcs")
+)
+
+// record records an upload of n bytes received in d, or its failure.
+func (o *Options) record(ctx context.Context, n int64, d time.Duration, err error) {
+	o.recorder.Created(ctx)
+	o.recorder.Received(ctx, n)
+	o.recorder.Chunk(ctx, n, d)
+	if err == nil {
+		o.recorder.Completed(ctx, uint64(n), d)
+		return
+	}
+	var netErr net.Error
+	if errors.Is(err, ErrChecksumMismatch) {
+		o.recorder.Failed(ctx, metrics.ReasonChecksumMismatch)
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		o.recorder.Failed(ctx, metrics.ReasonTimeout)
+	} else {
+		o.recorder.Failed(ctx, metrics.ReasonStorageError)
+	}
+}
+
+type cError struct {
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	b, _ := json.Marshal(cError{Message: err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+const (
+	defaultMaxSize   = 10 << 20
+	defaultMaxMemory = 5 << 20
+)
+
+type Options struct {
+	// Dir is the directory the uploads are kept in. They are written to
+	// /tmp and discarded once received when neither Dir nor Bucket is set.
+	Dir string
+	// Bucket, when set, is the bucket the uploads are kept in, under the
+	// v1/ prefix, instead of Dir.
+	Bucket *storage.BucketHandle
+	// MaxSize is the size of the largest request accepted, 10MB by
+	// default.
+	MaxSize int64
+	// MaxMemory is the size of the files of a form kept in memory while it
+	// is parsed, the others being written to temporary files, 5MB by
+	// default.
+	MaxMemory int64
+	// MaxFiles is the number of files of the largest form accepted,
+	// unlimited when zero.
+	MaxFiles int
+	// MaxDecodedSize is the size of the largest compressed binary upload
+	// accepted once decompressed, MaxSize by default.
+	MaxDecodedSize int64
+	// ContentType, when set, restricts the extensions and the detected
+	// content types of the files.
+	ContentType *sniff.Policy
+	// Progress, when set, tracks the progress of the uploads given an ID
+	// by their client in the UploadIDHeader.
+	Progress *Progress
+
+	backend  backend
+	recorder *metrics.Recorder
+}
+
+type Option func(*Options)
+
+// WithDir keeps the uploads in dir instead of discarding them.
+func WithDir(dir string) Option {
+	return func(o *Options) {
+		o.Dir = dir
+	}
+}
+
+// WithBucket keeps the uploads in the GCS bucket bkt, e.g. the one of the v4
+// uploads, instead of discarding them.
+func WithBucket(bkt *storage.BucketHandle) Option {
+	return func(o *Options) {
+		o.Bucket = bkt
+	}
+}
+
+// WithMaxSize rejects the requests larger than size bytes.
+func WithMaxSize(size int64) Option {
+	return func(o *Options) {
+		o.MaxSize = size
+	}
+}
+
+// WithMaxMemory keeps at most size bytes of the files of a form in memory
+// while it is parsed.
+func WithMaxMemory(size int64) Option {
+	return func(o *Options) {
+		o.MaxMemory = size
+	}
+}
+
+// WithMaxFiles rejects the forms of more than n files.
+func WithMaxFiles(n int) Option {
+	return func(o *Options) {
+		o.MaxFiles = n
+	}
+}
+
+// WithMaxDecodedSize rejects the compressed binary uploads larger than size
+// bytes once decompressed.
+func WithMaxDecodedSize(size int64) Option {
+	return func(o *Options) {
+		o.MaxDecodedSize = size
+	}
+}
+
+// WithContentTypePolicy rejects the files whose extension, or content type
+// detected from their first bytes, p doesn't allow, before they are
+// written. A nil policy enforces nothing.
+func WithContentTypePolicy(p *sniff.Policy) Option {
+	return func(o *Options) {
+		o.ContentType = p
+	}
+}
+
+// WithProgress tracks the progress of the uploads given an ID by their
+// client in p.
+func WithProgress(p *Progress) Option {
+	return func(o *Options) {
+		o.Progress = p
+	}
+}
+
+func newOptions(opts []Option) *Options {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = defaultMaxSize
+	}
+	if o.MaxMemory <= 0 {
+		o.MaxMemory = defaultMaxMemory
+	}
+	if o.MaxDecodedSize <= 0 {
+		o.MaxDecodedSize = o.MaxSize
+	}
+	switch {
+	case o.Bucket != nil:
+		o.backend, o.recorder = gcsBackend{bkt: o.Bucket}, gcsRecorder
+	case o.Dir != "":
+		o.backend, o.recorder = diskBackend{dir: o.Dir, keep: true}, diskRecorder
+	default:
+		o.backend, o.recorder = diskBackend{dir: "/tmp"}, diskRecorder
+	}
+	return o
+}
+
+// keeps reports whether the uploads are kept once received.
+func (o *Options) keeps() bool {
+	return o.Bucket != nil || o.Dir != ""
+}
+
+// tooLarge reports whether err is the failure to read a request larger
+// than MaxSize.
+func tooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// uploadedFile is the outcome of an uploaded file: its size and sha256
+// checksum once received, its ID and the URL it is downloaded from once
+// kept, or the error that prevented storing it. Field is the form field
+// of the files of a form upload.
+type uploadedFile struct {
+	Field    string `json:"field,omitempty"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	ID       string `json:"id,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// kept sets the ID of the kept file and the URL of the Download handler it
+// is served at, next to the handler of r.
+func (u *uploadedFile) kept(r *http.Request, id string) {
+	u.ID = id
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u.URL = fmt.Sprintf("%s://%s%s", scheme, r.Host, path.Join(path.Dir(r.URL.Path), "files", u.ID))
+}
+
+// newMetadata returns the metadata of the file name uploaded by r, owned by
+// the principal of r within its tenant.
+func newMetadata(r *http.Request, name string) metadata {
+	m := metadata{Name: name, Tenant: auth.TenantFromContext(r.Context())}
+	if p, ok := auth.FromContext(r.Context()); ok {
+		m.Owner = p.Subject
+	}
+	return m
+}
+
+// canUpload reports whether the principal of r, if any, may upload.
+func canUpload(r *http.Request) bool {
+	p, ok := auth.FromContext(r.Context())
+	return !ok || p.HasRole(auth.RoleUploader)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// FormUpload stores every file of a multipart form, whatever its field,
+// and responds with the outcome of each of them as a JSON array. The other
+// fields of the form are only logged.
+//
+// The checksum headers of the request are verified against its whole body
+// before any file is stored, and the ones of the parts against their file.
+func FormUpload(opts ...Option) http.HandlerFunc {
+	o := newOptions(opts)
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !canUpload(r) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
 		// log content type
 		log.Debug().Str("content_type", r.Header.Get("Content-Type")).Msg("Request Content Type")
 
+		sums, err := parseChecksums(r.Header)
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid Checksum")
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
 		// limit the size of the request body
-		r.Body = http.MaxBytesReader(w, r.Body, 10<<20) //10MB
+		r.Body = http.MaxBytesReader(w, r.Body, o.MaxSize)
+		w, finish, err := o.Progress.track(w, r)
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid Upload ID")
+			writeError(w, uploadIDStatus(err), err)
+			return
+		}
+		defer finish()
+		if len(sums) > 0 {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, sums.writer()), r.Body}
+		}
 		// parse the form
-		if err := r.ParseMultipartForm(5 << 20); err != nil {
+		if err := r.ParseMultipartForm(o.MaxMemory); err != nil {
 			log.Error().Err(err).Msg("Error Parsing the Form")
-			w.WriteHeader(http.StatusBadRequest)
+			if tooLarge(err) {
+				writeError(w, http.StatusRequestEntityTooLarge, errors.New("request exceeds the maximum size"))
+				return
+			}
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
 		defer r.MultipartForm.RemoveAll()
+		if len(sums) > 0 {
+			// the epilogue following the last part is part of the body.
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				log.Error().Err(err).Msg("Error Parsing the Form")
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := sums.verify(); err != nil {
+				log.Error().Err(err).Msg("Checksum Mismatch")
+				o.recorder.Failed(r.Context(), metrics.ReasonChecksumMismatch)
+				writeError(w, StatusChecksumMismatch, err)
+				return
+			}
+		}
 
-		// get a handle to the file
-		file, handler, err := r.FormFile("file")
-		if err != nil {
-			log.Error().Err(err).Msg("Error Retrieving the File")
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Error Retrieving the File"))
+		fields := make([]string, 0, len(r.MultipartForm.File))
+		for field := range r.MultipartForm.File {
+			fields = append(fields, field)
+		}
+		if len(fields) == 0 {
+			log.Error().Msg("Error Retrieving the File")
+			writeError(w, http.StatusBadRequest, errors.New("form has no file"))
 			return
 		}
-		defer file.Close()
-
-		// convert handler.size to KB
-		f, err := os.CreateTemp("/tmp", "sample-")
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Error Retrieving the File"))
+		sort.Strings(fields)
+		if o.MaxFiles > 0 {
+			var count int
+			for _, fhs := range r.MultipartForm.File {
+				count += len(fhs)
+			}
+			if count > o.MaxFiles {
+				log.Error().Int("files", count).Msg("Too Many Files")
+				writeError(w, http.StatusBadRequest, fmt.Errorf("form exceeds the maximum of %d files", o.MaxFiles))
+				return
+			}
+		}
+		log.Debug().Interface("fields", r.MultipartForm.Value).Msg("Form Fields")
+		if err := checkFormFiles(o, r.MultipartForm); err != nil {
+			log.Error().Err(err).Msg("File Rejected")
+			writeError(w, http.StatusUnsupportedMediaType, err)
 			return
 		}
 
-		defer f.Close()
-		defer os.Remove(f.Name())
+		var files []uploadedFile
+		for _, field := range fields {
+			for _, fh := range r.MultipartForm.File[field] {
+				files = append(files, storeFormFile(r, o, field, fh))
+			}
+		}
+		writeJSON(w, files)
+	}
+}
 
-		n, err := io.Copy(f, file)
-		if err != nil {
-			log.Error().Err(err).Msg("Error Copying the File")
+// checkFormFiles validates every file of the form against the content type
+// policy, so that the form is rejected before any of them is stored.
+func checkFormFiles(o *Options, form *multipart.Form) error {
+	if o.ContentType == nil {
+		return nil
+	}
+	for _, fhs := range form.File {
+		for _, fh := range fhs {
+			name, err := SanitizeFileName(fh.Filename)
+			if err != nil {
+				// reported with the outcome of the file.
+				continue
+			}
+			file, err := fh.Open()
+			if err != nil {
+				continue
+			}
+			_, err = o.checkContent(name, fh.Header.Get("Content-Type"), file)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %w", fh.Filename, err)
+			}
 		}
+	}
+	return nil
+}
 
-		log.Info().Str("file_name", handler.Filename).
-			Int64("file_size", handler.Size).
-			Int64("written_size", n).
-			Str("stored_file", f.Name()).
-			Msg("File Uploaded")
+// storeFormFile stores the file fh of the form field of r, and returns its
+// outcome.
+func storeFormFile(r *http.Request, o *Options, field string, fh *multipart.FileHeader) (res uploadedFile) {
+	ctx := r.Context()
+	res = uploadedFile{Field: field, Name: fh.Filename, Size: fh.Size}
+	name, err := SanitizeFileName(fh.Filename)
+	if err != nil {
+		log.Error().Err(err).Str("file_name", fh.Filename).Msg("Error Retrieving the File")
+		res.Error = err.Error()
+		return res
+	}
+	sums, err := parseChecksums(http.Header(fh.Header))
+	if err != nil {
+		log.Error().Err(err).Str("file_name", fh.Filename).Msg("Invalid Checksum")
+		res.Error = err.Error()
+		return res
+	}
+	file, err := fh.Open()
+	if err != nil {
+		log.Error().Err(err).Str("file_name", fh.Filename).Msg("Error Retrieving the File")
+		res.Error = err.Error()
+		return res
+	}
+	defer file.Close()
 
-		w.WriteHeader(http.StatusOK)
+	id := uuid.New().String()
+	dst, err := o.backend.create(ctx, id, newMetadata(r, name))
+	if err != nil {
+		o.recorder.Failed(ctx, metrics.ReasonStorageError)
+		res.Error = err.Error()
+		return res
 	}
+	defer discard(dst, &err)
+
+	h := sha256.New()
+	start := time.Now()
+	n, err := bufpool.Default.Copy(io.MultiWriter(dst, h, sums.writer()), file)
+	if err == nil {
+		err = sums.verify()
+	}
+	if err == nil {
+		err = dst.commit()
+	}
+	o.record(ctx, n, time.Since(start), err)
+	if err != nil {
+		log.Error().Err(err).Str("file_name", fh.Filename).Msg("Error Copying the File")
+		res.Error = err.Error()
+		return res
+	}
+
+	log.Info().Str("file_name", fh.Filename).
+		Int64("file_size", fh.Size).
+		Int64("written_size", n).
+		Str("file_id", id).
+		Msg("File Uploaded")
+
+	res.Size = n
+	res.Checksum = hex.EncodeToString(h.Sum(nil))
+	if o.keeps() {
+		res.kept(r, id)
+	}
+	return res
 }
 
-func BinaryUpload() http.HandlerFunc {
+// BinaryUpload stores the body of the request as the file named by the
+// X-Api-File-Name header, and responds with its outcome as a JSON document,
+// its ID being also given in the X-Api-File-Id header when kept. The file
+// is stored under a generated ID, the name, once sanitized, being only kept
+// in its metadata. An upload not matching its checksum headers is rejected
+// with StatusChecksumMismatch.
+//
+// A body of gzip Content-Encoding is decompressed before being stored, its
+// checksums being the ones of the decompressed content, of at most
+// MaxDecodedSize bytes.
+func BinaryUpload(opts ...Option) http.HandlerFunc {
+	o := newOptions(opts)
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !canUpload(r) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if r.ContentLength > o.MaxSize {
+			writeError(w, http.StatusRequestEntityTooLarge, errors.New("request exceeds the maximum size"))
+			return
+		}
 		// limit the size of the request body
-		r.Body = http.MaxBytesReader(w, r.Body, 10<<20) //10MB
+		r.Body = http.MaxBytesReader(w, r.Body, o.MaxSize)
+		w, finish, err := o.Progress.track(w, r)
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid Upload ID")
+			writeError(w, uploadIDStatus(err), err)
+			return
+		}
+		defer finish()
 
 		defer r.Body.Close()
 		contentType := r.Header.Get("Content-Type")
@@ -75,24 +481,94 @@ func BinaryUpload() http.HandlerFunc {
 			Str("file_name", fileName).
 			Msg("received binary data")
 
-		f, err := os.OpenFile(filepath.Join("/tmp", fileName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		name, err := SanitizeFileName(fileName)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Error Retrieving the File"))
+			log.Error().Err(err).Str("file_name", fileName).Msg("Invalid File Name")
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-		defer f.Close()
-		defer os.Remove(f.Name())
-		n, err := io.Copy(f, r.Body)
+		sums, err := parseChecksums(r.Header)
 		if err != nil {
+			log.Error().Err(err).Msg("Invalid Checksum")
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		body, err := o.decodedBody(r)
+		if errors.Is(err, ErrUnsupportedEncoding) {
+			log.Error().Err(err).Msg("Unsupported Content Encoding")
+			writeError(w, http.StatusUnsupportedMediaType, err)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid Content Encoding")
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		defer body.Close()
+		src, err := o.checkContent(name, contentType, body)
+		if err != nil {
+			log.Error().Err(err).Str("file_name", fileName).Msg("File Rejected")
+			writeError(w, http.StatusUnsupportedMediaType, err)
+			return
+		}
+		id := uuid.New().String()
+		dst, err := o.backend.create(r.Context(), id, newMetadata(r, name))
+		if err != nil {
+			log.Error().Err(err).Msg("Error Creating the File")
+			o.recorder.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, errors.New("unable to store the file"))
+			return
+		}
+		defer discard(dst, &err)
+		h := sha256.New()
+		start := time.Now()
+		n, err := bufpool.Default.Copy(io.MultiWriter(dst, h, sums.writer()), src)
+		if err == nil {
+			err = sums.verify()
+		}
+		var commitErr error
+		if err == nil {
+			commitErr = dst.commit()
+			err = commitErr
+		}
+		o.record(r.Context(), n, time.Since(start), err)
+		if errors.Is(err, ErrChecksumMismatch) {
+			log.Error().Err(err).Msg("Checksum Mismatch")
+			writeError(w, StatusChecksumMismatch, err)
+			return
+		}
+		if errors.Is(err, ErrDecodedTooLarge) {
+			log.Error().Err(err).Msg("Error Copying the File")
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if tooLarge(err) {
 			log.Error().Err(err).Msg("Error Copying the File")
+			writeError(w, http.StatusRequestEntityTooLarge, errors.New("request exceeds the maximum size"))
+			return
+		}
+		if commitErr != nil {
+			log.Error().Err(err).Msg("Error Storing the File")
+			writeError(w, http.StatusInternalServerError, errors.New("unable to store the file"))
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Error Copying the File")
+			writeError(w, http.StatusBadRequest, err)
+			return
 		}
 
 		log.Info().
+			Str("file_name", name).
 			Int64("written_size", n).
-			Str("stored_file", f.Name()).
+			Str("file_id", id).
 			Msg("File Uploaded")
 
-		w.WriteHeader(http.StatusOK)
+		res := uploadedFile{Name: fileName, Size: n, Checksum: hex.EncodeToString(h.Sum(nil))}
+		if o.keeps() {
+			res.kept(r, id)
+			w.Header().Set("X-Api-File-Id", res.ID)
+		}
+		writeJSON(w, res)
 	}
 }
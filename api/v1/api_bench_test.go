@@ -0,0 +1,77 @@
+package v1_test
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "github.com/imrenagi/go-http-upload/api/v1"
+	"github.com/rs/zerolog"
+)
+
+// benchmarkSizes are the payloads benchmarked, below the 10MB limit of the
+// v1 handlers.
+var benchmarkSizes = []int{1 << 20, 8 << 20}
+
+func sizeName(size int) string {
+	return fmt.Sprintf("%dMB", size>>20)
+}
+
+func BenchmarkFormUpload(b *testing.B) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	h := v1.FormUpload()
+	for _, size := range benchmarkSizes {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("file", "file.bin")
+		if err != nil {
+			b.Fatal(err)
+		}
+		fw.Write(bytes.Repeat([]byte{'a'}, size))
+		mw.Close()
+
+		b.Run(sizeName(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/form", bytes.NewReader(body.Bytes()))
+				req.Header.Set("Content-Type", mw.FormDataContentType())
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					b.Fatalf("unexpected status %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBinaryUpload(b *testing.B) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	h := v1.BinaryUpload()
+	for _, size := range benchmarkSizes {
+		data := bytes.Repeat([]byte{'a'}, size)
+
+		b.Run(sizeName(size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", bytes.NewReader(data))
+				req.Header.Set("Content-Type", "application/octet-stream")
+				req.Header.Set("X-Api-File-Name", fmt.Sprintf("bench-%d.bin", size))
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					b.Fatalf("unexpected status %d", w.Code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,727 @@
+package v1_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	v1 "github.com/imrenagi/go-http-upload/api/v1"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/stretchr/testify/assert"
+)
+
+type uploadedFile struct {
+	Field    string `json:"field"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	ID       string `json:"id"`
+	Checksum string `json:"checksum"`
+	URL      string `json:"url"`
+	Error    string `json:"error"`
+}
+
+func md5Base64(b []byte) string {
+	sum := md5.Sum(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFormUpload(t *testing.T) {
+	t.Run("every file of the form must be stored", func(t *testing.T) {
+		dir := t.TempDir()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("description", "two files")
+		for _, f := range []struct{ field, name, data string }{
+			{"file", "a.txt", "first file"},
+			{"file", "b.txt", "second"},
+			{"attachment", "c.bin", "third one"},
+		} {
+			fw, _ := mw.CreateFormFile(f.field, f.name)
+			fw.Write([]byte(f.data))
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+
+		v1.FormUpload(v1.WithDir(dir)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var files []uploadedFile
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &files))
+		if assert.Len(t, files, 3) {
+			assert.Equal(t, "attachment", files[0].Field)
+			assert.Equal(t, "c.bin", files[0].Name)
+			assert.Equal(t, "a.txt", files[1].Name)
+			assert.Equal(t, "b.txt", files[2].Name)
+			assert.Equal(t, int64(len("first file")), files[1].Size)
+			assert.Equal(t, sha256Hex([]byte("first file")), files[1].Checksum)
+			for _, f := range files {
+				assert.NotEmpty(t, f.ID)
+				assert.Empty(t, f.Error)
+			}
+			b, err := os.ReadFile(filepath.Join(dir, files[1].ID))
+			assert.NoError(t, err)
+			assert.Equal(t, "first file", string(b))
+		}
+	})
+
+	t.Run("files must be discarded without a directory", func(t *testing.T) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		fw.Write([]byte("discarded"))
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+
+		v1.FormUpload().ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var files []uploadedFile
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &files))
+		if assert.Len(t, files, 1) {
+			assert.Empty(t, files[0].ID)
+			assert.Equal(t, sha256Hex([]byte("discarded")), files[0].Checksum)
+		}
+	})
+
+	t.Run("file not matching the checksum of its part must be discarded", func(t *testing.T) {
+		dir := t.TempDir()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, f := range []struct{ name, data, sum string }{
+			{"a.txt", "intact", sha256Hex([]byte("intact"))},
+			{"b.txt", "corrupted", sha256Hex([]byte("original"))},
+		} {
+			h := textproto.MIMEHeader{}
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, f.name))
+			h.Set("X-Checksum", "sha256 "+f.sum)
+			fw, _ := mw.CreatePart(h)
+			fw.Write([]byte(f.data))
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+
+		v1.FormUpload(v1.WithDir(dir)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var files []uploadedFile
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &files))
+		if assert.Len(t, files, 2) {
+			assert.Empty(t, files[0].Error)
+			assert.Contains(t, files[1].Error, "checksum mismatch")
+			assert.Empty(t, files[1].ID)
+		}
+		entries, _ := os.ReadDir(dir)
+		assert.Len(t, entries, 2)
+	})
+
+	t.Run("form not matching the checksum of the request must be rejected", func(t *testing.T) {
+		dir := t.TempDir()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		fw.Write([]byte("content"))
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Content-MD5", md5Base64([]byte("something else")))
+		w := httptest.NewRecorder()
+
+		v1.FormUpload(v1.WithDir(dir)).ServeHTTP(w, req)
+
+		assert.Equal(t, v1.StatusChecksumMismatch, w.Code)
+		assert.Contains(t, w.Body.String(), "checksum mismatch")
+		entries, _ := os.ReadDir(dir)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("form matching the checksum of the request must be stored", func(t *testing.T) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		fw.Write([]byte("content"))
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Content-MD5", md5Base64(body.Bytes()))
+		w := httptest.NewRecorder()
+
+		v1.FormUpload().ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("form without file must be rejected", func(t *testing.T) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("description", "no file")
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+
+		v1.FormUpload().ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestBinaryUpload(t *testing.T) {
+	t.Run("upload must be kept in the directory", func(t *testing.T) {
+		dir := t.TempDir()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("binary content"))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Api-File-Name", "kept.bin")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload(v1.WithDir(dir)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		id := w.Header().Get("X-Api-File-Id")
+		assert.NotEmpty(t, id)
+		b, err := os.ReadFile(filepath.Join(dir, id))
+		assert.NoError(t, err)
+		assert.Equal(t, "binary content", string(b))
+	})
+
+	t.Run("response must describe the stored file", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "http://uploader.test/api/v1/binary", strings.NewReader("binary content"))
+		req.Header.Set("X-Api-File-Name", "kept.bin")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload(v1.WithDir(t.TempDir())).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var file uploadedFile
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+		assert.Equal(t, w.Header().Get("X-Api-File-Id"), file.ID)
+		assert.Equal(t, "kept.bin", file.Name)
+		assert.Equal(t, int64(len("binary content")), file.Size)
+		assert.Equal(t, sha256Hex([]byte("binary content")), file.Checksum)
+		assert.Equal(t, "http://uploader.test/api/v1/files/"+file.ID, file.URL)
+	})
+
+	t.Run("upload must be stored under its ID whatever its name", func(t *testing.T) {
+		dir := t.TempDir()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("payload"))
+		req.Header.Set("X-Api-File-Name", "../../etc/cron.d/x y")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload(v1.WithDir(dir)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		entries, _ := os.ReadDir(dir)
+		assert.Len(t, entries, 2)
+		b, err := os.ReadFile(filepath.Join(dir, w.Header().Get("X-Api-File-Id")+".json"))
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"name":"x_y"}`, string(b))
+	})
+
+	t.Run("concurrent uploads of the same name must not clobber each other", func(t *testing.T) {
+		dir := t.TempDir()
+		handler := v1.BinaryUpload(v1.WithDir(dir))
+		ids := make([]string, 8)
+		var wg sync.WaitGroup
+		for i := range ids {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("report "+strconv.Itoa(i)))
+				req.Header.Set("X-Api-File-Name", "report.pdf")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				ids[i] = w.Header().Get("X-Api-File-Id")
+			}()
+		}
+		wg.Wait()
+
+		for i, id := range ids {
+			b, err := os.ReadFile(filepath.Join(dir, id))
+			assert.NoError(t, err)
+			assert.Equal(t, "report "+strconv.Itoa(i), string(b))
+		}
+	})
+
+	t.Run("upload without name must be rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("payload"))
+		req.Header.Set("X-Api-File-Name", "..")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload(v1.WithDir(t.TempDir())).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestLimits(t *testing.T) {
+	form := func(files int) (*bytes.Buffer, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for i := 0; i < files; i++ {
+			fw, _ := mw.CreateFormFile("file", fmt.Sprintf("%d.txt", i))
+			fw.Write(bytes.Repeat([]byte{'a'}, 1<<10))
+		}
+		mw.Close()
+		return &body, mw.FormDataContentType()
+	}
+
+	t.Run("form larger than the maximum size must be rejected", func(t *testing.T) {
+		body, contentType := form(4)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		v1.FormUpload(v1.WithMaxSize(2<<10)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("form of more than the maximum files must be rejected", func(t *testing.T) {
+		body, contentType := form(3)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		v1.FormUpload(v1.WithMaxFiles(2)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("form larger than the default size must be accepted when allowed", func(t *testing.T) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "large.bin")
+		fw.Write(bytes.Repeat([]byte{'a'}, 12<<20))
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+
+		v1.FormUpload(v1.WithMaxSize(16<<20), v1.WithMaxMemory(1<<20)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("binary upload larger than the maximum size must be rejected", func(t *testing.T) {
+		dir := t.TempDir()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", bytes.NewReader(make([]byte, 4<<10)))
+		req.Header.Set("X-Api-File-Name", "large.bin")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload(v1.WithDir(dir), v1.WithMaxSize(2<<10)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		entries, _ := os.ReadDir(dir)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("binary upload of unknown length larger than the maximum size must be rejected", func(t *testing.T) {
+		dir := t.TempDir()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", io.MultiReader(bytes.NewReader(make([]byte, 4<<10))))
+		req.ContentLength = -1
+		req.Header.Set("X-Api-File-Name", "large.bin")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload(v1.WithDir(dir), v1.WithMaxSize(2<<10)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		entries, _ := os.ReadDir(dir)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestBinaryUploadChecksum(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		code   int
+	}{
+		{"matching Content-MD5", "Content-MD5", md5Base64([]byte("payload")), http.StatusOK},
+		{"matching X-Checksum", "X-Checksum", "sha256 " + sha256Hex([]byte("payload")), http.StatusOK},
+		{"mismatching Content-MD5", "Content-MD5", md5Base64([]byte("other")), v1.StatusChecksumMismatch},
+		{"mismatching X-Checksum", "X-Checksum", "sha256 " + sha256Hex([]byte("other")), v1.StatusChecksumMismatch},
+		{"malformed Content-MD5", "Content-MD5", "not base64", http.StatusBadRequest},
+		{"unsupported algorithm", "X-Checksum", "crc32 0000", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" must answer "+strconv.Itoa(tt.code), func(t *testing.T) {
+			dir := t.TempDir()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("payload"))
+			req.Header.Set("X-Api-File-Name", "payload.bin")
+			req.Header.Set(tt.header, tt.value)
+			w := httptest.NewRecorder()
+
+			v1.BinaryUpload(v1.WithDir(dir)).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+			entries, _ := os.ReadDir(dir)
+			if tt.code == http.StatusOK {
+				assert.Len(t, entries, 2)
+			} else {
+				assert.Empty(t, entries)
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestBinaryUploadGzip(t *testing.T) {
+	gzipped := func(b []byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return &buf
+	}
+
+	t.Run("gzip body must be stored decompressed", func(t *testing.T) {
+		dir := t.TempDir()
+		data := bytes.Repeat([]byte("compressible "), 1<<10)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", gzipped(data))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("X-Api-File-Name", "data.txt")
+		req.Header.Set("X-Checksum", "sha256 "+sha256Hex(data))
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload(v1.WithDir(dir)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		b, err := os.ReadFile(filepath.Join(dir, w.Header().Get("X-Api-File-Id")))
+		assert.NoError(t, err)
+		assert.Equal(t, data, b)
+	})
+
+	t.Run("gzip body larger than the maximum decoded size must be rejected", func(t *testing.T) {
+		dir := t.TempDir()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", gzipped(make([]byte, 1<<20)))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("X-Api-File-Name", "bomb.bin")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload(v1.WithDir(dir), v1.WithMaxDecodedSize(64<<10)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		entries, _ := os.ReadDir(dir)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("invalid gzip body must be rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("not gzip"))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("X-Api-File-Name", "data.txt")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload().ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("unsupported encoding must be rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("data"))
+		req.Header.Set("Content-Encoding", "br")
+		req.Header.Set("X-Api-File-Name", "data.txt")
+		w := httptest.NewRecorder()
+
+		v1.BinaryUpload().ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+}
+
+func TestDownload(t *testing.T) {
+	dir := t.TempDir()
+	router := mux.NewRouter()
+	router.Handle("/api/v1/binary", v1.BinaryUpload(v1.WithDir(dir)))
+	router.Handle("/api/v1/files/{file_id}", v1.Download(v1.WithDir(dir)))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("<html>page</html>"))
+	req.Header.Set("X-Api-File-Name", "page.html")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var file uploadedFile
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+
+	t.Run("kept file must be downloaded as an attachment", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, file.URL, nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "<html>page</html>", w.Body.String())
+		assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+		assert.Equal(t, "attachment; filename=page.html", w.Header().Get("Content-Disposition"))
+	})
+
+	t.Run("unknown file must not be found", func(t *testing.T) {
+		for _, id := range []string{uuid.New().String(), strings.ToUpper(file.ID), "not-an-id"} {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+id, nil)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNotFound, w.Code, id)
+		}
+	})
+}
+
+func TestDownloadAccess(t *testing.T) {
+	dir := t.TempDir()
+	router := mux.NewRouter()
+	router.Handle("/api/v1/binary", v1.BinaryUpload(v1.WithDir(dir)))
+	router.Handle("/api/v1/files/{file_id}", v1.Download(v1.WithDir(dir)))
+
+	as := func(req *http.Request, p *auth.Principal, tenant string) *httptest.ResponseRecorder {
+		ctx := auth.NewTenantContext(req.Context(), tenant)
+		if p != nil {
+			ctx = auth.NewContext(ctx, *p)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req.WithContext(ctx))
+		return w
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("hello"))
+	req.Header.Set("X-Api-File-Name", "notes.txt")
+	w := as(req, &auth.Principal{Subject: "alice"}, "acme")
+	var file uploadedFile
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	get := func(p *auth.Principal, tenant string) *httptest.ResponseRecorder {
+		return as(httptest.NewRequest(http.MethodGet, file.URL, nil), p, tenant)
+	}
+
+	t.Run("owner must download its file", func(t *testing.T) {
+		w := get(&auth.Principal{Subject: "alice"}, "acme")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello", w.Body.String())
+	})
+
+	t.Run("viewer must download the file of another owner", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, get(&auth.Principal{Subject: "bob", Roles: []auth.Role{auth.RoleViewer}}, "acme").Code)
+	})
+
+	t.Run("other principal must be forbidden", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, get(&auth.Principal{Subject: "bob"}, "acme").Code)
+		assert.Equal(t, http.StatusForbidden, get(nil, "acme").Code)
+	})
+
+	t.Run("file of another tenant must not be found", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, get(&auth.Principal{Subject: "alice"}, "other").Code)
+		assert.Equal(t, http.StatusNotFound, get(&auth.Principal{Subject: "alice"}, "").Code)
+	})
+
+	t.Run("principal without the uploader role must not upload", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("hello"))
+		req.Header.Set("X-Api-File-Name", "notes.txt")
+
+		w := as(req, &auth.Principal{Subject: "bob", Roles: []auth.Role{auth.RoleViewer}}, "acme")
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestProgress(t *testing.T) {
+	progress := v1.NewProgress()
+	router := mux.NewRouter()
+	router.Handle("/api/v1/binary", v1.BinaryUpload(v1.WithProgress(progress)))
+	router.Handle("/api/v1/progress/{upload_id}", progress.Status())
+
+	upload := func(id string, data string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader(data))
+		req.Header.Set("X-Api-File-Name", "notes.txt")
+		req.Header.Set(v1.UploadIDHeader, id)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	status := func(id string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/progress/"+id, nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("finished upload must report all its bytes received", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, upload("upload-1", "hello world").Code)
+
+		w := status("upload-1", "application/json")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"id":"upload-1","received":11,"total":11,"done":true}`, w.Body.String())
+	})
+
+	t.Run("failed upload must report its error", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("hello"))
+		req.Header.Set("X-Api-File-Name", "notes.txt")
+		req.Header.Set(v1.ChecksumHeader, "sha256 "+sha256Hex([]byte("other")))
+		req.Header.Set(v1.UploadIDHeader, "upload-2")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		w := status("upload-2", "application/json")
+
+		var resp struct {
+			Done  bool   `json:"done"`
+			Error string `json:"error"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.True(t, resp.Done)
+		assert.NotEmpty(t, resp.Error)
+	})
+
+	t.Run("stream of a finished upload must end with its last event", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, upload("upload-3", "hello").Code)
+
+		w := status("upload-3", "text/event-stream")
+
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+		assert.Equal(t, "event: progress\ndata: {\"id\":\"upload-3\",\"received\":5,\"total\":5,\"done\":true}\n\n", w.Body.String())
+	})
+
+	t.Run("invalid upload id must be rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, upload("not/valid", "hello").Code)
+	})
+
+	t.Run("unknown upload must not be found", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, status("unknown", "application/json").Code)
+	})
+
+	t.Run("upload of another principal or tenant must not be found", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", strings.NewReader("hello"))
+		req.Header.Set("X-Api-File-Name", "notes.txt")
+		req.Header.Set(v1.UploadIDHeader, "upload-4")
+		ctx := auth.NewContext(auth.NewTenantContext(req.Context(), "acme"), auth.Principal{Subject: "alice"})
+		router.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		statusAs := func(subject, tenant string) int {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/progress/upload-4", nil)
+			ctx := auth.NewContext(auth.NewTenantContext(req.Context(), tenant), auth.Principal{Subject: subject})
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req.WithContext(ctx))
+			return w.Code
+		}
+
+		assert.Equal(t, http.StatusOK, statusAs("alice", "acme"))
+		assert.Equal(t, http.StatusNotFound, statusAs("bob", "acme"))
+		assert.Equal(t, http.StatusNotFound, statusAs("alice", "other"))
+		assert.Equal(t, http.StatusNotFound, status("upload-4", "application/json").Code)
+	})
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	policy := &sniff.Policy{
+		Allow:           []string{"image/*", "text/plain"},
+		DenyExtensions:  []string{".exe"},
+		AllowExtensions: []string{".png", ".txt"},
+	}
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		name     string
+		fileName string
+		data     []byte
+		code     int
+	}{
+		{"allowed file", "photo.png", png, http.StatusOK},
+		{"denied extension", "setup.exe", png, http.StatusUnsupportedMediaType},
+		{"extension missing from the allowlist", "page.html", png, http.StatusUnsupportedMediaType},
+		{"disallowed content", "photo.png", []byte("<html><body>page</body></html>"), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" must answer "+strconv.Itoa(tt.code), func(t *testing.T) {
+			dir := t.TempDir()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/binary", bytes.NewReader(tt.data))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("X-Api-File-Name", tt.fileName)
+			w := httptest.NewRecorder()
+
+			v1.BinaryUpload(v1.WithDir(dir), v1.WithContentTypePolicy(policy)).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+			entries, _ := os.ReadDir(dir)
+			if tt.code == http.StatusOK {
+				assert.Len(t, entries, 2)
+			} else {
+				assert.Empty(t, entries)
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	t.Run("form with a disallowed file must be rejected before storing any", func(t *testing.T) {
+		dir := t.TempDir()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "photo.png")
+		fw.Write(png)
+		fw, _ = mw.CreateFormFile("file", "notes.txt")
+		fw.Write([]byte("\x7fELF\x02\x01\x01"))
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/form", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+
+		v1.FormUpload(v1.WithDir(dir), v1.WithContentTypePolicy(policy)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		assert.Contains(t, w.Body.String(), "notes.txt")
+		entries, _ := os.ReadDir(dir)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"report.pdf", "report.pdf", nil},
+		{"../../etc/cron.d/x", "x", nil},
+		{`..\..\windows\system.ini`, "system.ini", nil},
+		{".bashrc", "bashrc", nil},
+		{"my file (1).txt", "my_file__1_.txt", nil},
+		{"résumé.doc", "r_sum_.doc", nil},
+		{strings.Repeat("a", 300), strings.Repeat("a", 255), nil},
+		{"", "", v1.ErrInvalidFileName},
+		{"..", "", v1.ErrInvalidFileName},
+		{"dir/", "dir", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v1.SanitizeFileName(tt.name)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// errNotFound is returned by backend.open for an upload which isn't kept.
+var errNotFound = errors.New("file not found")
+
+// metadata is the metadata of a kept upload. Owner is the subject of the
+// principal which uploaded it, empty without authentication, and Tenant the
+// tenant it belongs to.
+type metadata struct {
+	Name   string `json:"name"`
+	Owner  string `json:"owner,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// backend is where the v1 handlers write the uploads.
+type backend interface {
+	// create starts writing the upload id, described by m.
+	create(ctx context.Context, id string, m metadata) (writer, error)
+	// open returns the content of the kept upload id and its metadata.
+	open(ctx context.Context, id string) (*content, error)
+}
+
+// writer is an upload being written to a backend.
+type writer interface {
+	io.Writer
+	// commit completes the upload.
+	commit() error
+	// abort discards the upload.
+	abort()
+}
+
+// content is a kept upload being read from a backend. Body is an
+// io.ReadSeeker when the backend serves ranges of the upload.
+type content struct {
+	Body     io.ReadCloser
+	Size     int64
+	Modified time.Time
+	metadata
+}
+
+// discard aborts the upload written to w when err is set once the handler
+// returns.
+func discard(w writer, err *error) {
+	if *err != nil {
+		w.abort()
+	}
+}
+
+// diskBackend writes the uploads to files of dir named after their ID, and
+// their metadata next to them in a file with the .json extension. The
+// uploads are removed once received unless keep is set.
+type diskBackend struct {
+	dir  string
+	keep bool
+}
+
+func (b diskBackend) create(_ context.Context, id string, m metadata) (writer, error) {
+	f, err := os.OpenFile(filepath.Join(b.dir, id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &diskWriter{File: f, keep: b.keep, m: m}, nil
+}
+
+func (b diskBackend) open(_ context.Context, id string) (*content, error) {
+	name := filepath.Join(b.dir, id)
+	var m metadata
+	buf, err := os.ReadFile(name + ".json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &content{Body: f, Size: fi.Size(), Modified: fi.ModTime(), metadata: m}, nil
+}
+
+type diskWriter struct {
+	*os.File
+	keep bool
+	m    metadata
+}
+
+func (w *diskWriter) commit() error {
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	if !w.keep {
+		os.Remove(w.Name())
+		return nil
+	}
+	b, _ := json.Marshal(w.m)
+	return os.WriteFile(w.Name()+".json", b, 0644)
+}
+
+func (w *diskWriter) abort() {
+	w.File.Close()
+	os.Remove(w.Name())
+	os.Remove(w.Name() + ".json")
+}
+
+// gcsPrefix prefixes the objects of the uploads, which may share the bucket
+// of the v4 uploads.
+const gcsPrefix = "v1/"
+
+// gcsBackend writes the uploads to objects of bkt named after their ID,
+// their metadata being the ones of the objects.
+type gcsBackend struct {
+	bkt *storage.BucketHandle
+}
+
+func (b gcsBackend) create(ctx context.Context, id string, m metadata) (writer, error) {
+	// the upload is aborted by cancelling the context of its writer.
+	ctx, cancel := context.WithCancel(ctx)
+	w := b.bkt.Object(path.Join(gcsPrefix, id)).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	w.Metadata = map[string]string{"name": m.Name, "owner": m.Owner, "tenant": m.Tenant}
+	if m.Name != "" {
+		w.ContentDisposition = mime.FormatMediaType("attachment", map[string]string{"filename": m.Name})
+	}
+	return &gcsWriter{Writer: w, cancel: cancel}, nil
+}
+
+func (b gcsBackend) open(ctx context.Context, id string) (*content, error) {
+	obj := b.bkt.Object(path.Join(gcsPrefix, id))
+	attrs, err := obj.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	r, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &content{
+		Body:     r,
+		Size:     attrs.Size,
+		Modified: attrs.Updated,
+		metadata: metadata{
+			Name:   attrs.Metadata["name"],
+			Owner:  attrs.Metadata["owner"],
+			Tenant: attrs.Metadata["tenant"],
+		},
+	}, nil
+}
+
+type gcsWriter struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+func (w *gcsWriter) commit() error {
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+func (w *gcsWriter) abort() {
+	w.cancel()
+	w.Writer.Close()
+}
@@ -0,0 +1,106 @@
+package v1
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ContentMD5Header carries the base64 encoded MD5 digest of an upload,
+	// as defined by RFC 1864.
+	ContentMD5Header = "Content-MD5"
+	// ChecksumHeader carries the algorithm and the hex encoded digest of an
+	// upload, separated by a space, e.g. "sha256 9f86d0...".
+	ChecksumHeader = "X-Checksum"
+)
+
+// StatusChecksumMismatch is the status of the uploads not matching their
+// checksum, as in the checksum extension of tus.
+const StatusChecksumMismatch = 460
+
+var (
+	// ErrInvalidChecksum is returned for a checksum header which can't be
+	// parsed, or of an unsupported algorithm.
+	ErrInvalidChecksum = errors.New("invalid checksum")
+	// ErrChecksumMismatch is returned for an upload whose content doesn't
+	// match its checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// checksumAlgorithms are the algorithms accepted by ChecksumHeader.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// checksum is a digest expected of an upload, computed by h while the
+// upload is written.
+type checksum struct {
+	algorithm string
+	want      []byte
+	h         hash.Hash
+}
+
+// checksums are the digests expected of an upload.
+type checksums []checksum
+
+// parseChecksums returns the checksums given by the ContentMD5Header and
+// ChecksumHeader of h, none when neither is set.
+func parseChecksums(h http.Header) (checksums, error) {
+	var cs checksums
+	if v := h.Get(ContentMD5Header); v != "" {
+		want, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(want) != md5.Size {
+			return nil, fmt.Errorf("%w: %s %q", ErrInvalidChecksum, ContentMD5Header, v)
+		}
+		cs = append(cs, checksum{algorithm: "md5", want: want, h: md5.New()})
+	}
+	if v := h.Get(ChecksumHeader); v != "" {
+		algorithm, value, _ := strings.Cut(v, " ")
+		newHash, ok := checksumAlgorithms[algorithm]
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidChecksum, algorithm)
+		}
+		want, err := hex.DecodeString(value)
+		if err != nil || len(want) != newHash().Size() {
+			return nil, fmt.Errorf("%w: %s %q", ErrInvalidChecksum, ChecksumHeader, v)
+		}
+		cs = append(cs, checksum{algorithm: algorithm, want: want, h: newHash()})
+	}
+	return cs, nil
+}
+
+// writer returns the writer of the content of the upload, io.Discard when
+// there is no checksum to verify.
+func (cs checksums) writer() io.Writer {
+	if len(cs) == 0 {
+		return io.Discard
+	}
+	ws := make([]io.Writer, len(cs))
+	for i, c := range cs {
+		ws[i] = c.h
+	}
+	return io.MultiWriter(ws...)
+}
+
+// verify returns ErrChecksumMismatch when the content written doesn't
+// match one of the checksums.
+func (cs checksums) verify() error {
+	for _, c := range cs {
+		if got := c.h.Sum(nil); !bytes.Equal(got, c.want) {
+			return fmt.Errorf("%w: %s is %x, expected %x", ErrChecksumMismatch, c.algorithm, got, c.want)
+		}
+	}
+	return nil
+}
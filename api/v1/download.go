@@ -0,0 +1,80 @@
+package v1
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/rs/zerolog/log"
+)
+
+// Download serves the kept upload whose ID is the file_id route variable,
+// as an attachment named after the name it was uploaded with. Uploads are
+// only found within their tenant, and served to their owner and to the
+// viewers.
+func Download(opts ...Option) http.HandlerFunc {
+	o := newOptions(opts)
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["file_id"]
+		// the IDs are generated, so anything else can't name a kept upload,
+		// and mustn't reach the backend.
+		if parsed, err := uuid.Parse(id); !o.keeps() || err != nil || parsed.String() != id {
+			writeError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		c, err := o.backend.open(r.Context(), id)
+		if errors.Is(err, errNotFound) {
+			writeError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("file_id", id).Msg("Error Opening the File")
+			writeError(w, http.StatusInternalServerError, errors.New("unable to read the file"))
+			return
+		}
+		defer c.Body.Close()
+		if c.Tenant != auth.TenantFromContext(r.Context()) {
+			writeError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		if !canDownload(r, c.Owner) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		// files are served as attachments of an opaque type, so that an
+		// uploaded page can't run in the origin of the server.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		disposition := "attachment"
+		if d := mime.FormatMediaType("attachment", map[string]string{"filename": c.Name}); c.Name != "" && d != "" {
+			disposition = d
+		}
+		w.Header().Set("Content-Disposition", disposition)
+		if rs, ok := c.Body.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, "", c.Modified, rs)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(c.Size, 10))
+		w.Header().Set("Last-Modified", c.Modified.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			io.Copy(w, c.Body)
+		}
+	}
+}
+
+// canDownload reports whether the principal of r may download an upload of
+// owner: its owner and the viewers may.
+func canDownload(r *http.Request, owner string) bool {
+	if auth.CanAccess(r.Context(), owner) {
+		return true
+	}
+	p, ok := auth.FromContext(r.Context())
+	return ok && p.HasRole(auth.RoleViewer)
+}
@@ -0,0 +1,60 @@
+package v1
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var (
+	// ErrUnsupportedEncoding is returned for a body of a content coding
+	// other than gzip.
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	// ErrDecodedTooLarge is returned when reading a body larger than
+	// MaxDecodedSize once decoded.
+	ErrDecodedTooLarge = errors.New("decoded request exceeds the maximum size")
+)
+
+// decodedBody returns the body of r decoded following its Content-Encoding,
+// of at most MaxDecodedSize bytes.
+func (o *Options) decodedBody(r *http.Request) (io.ReadCloser, error) {
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &decodedReader{r: zr, n: o.MaxDecodedSize}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, enc)
+	}
+}
+
+// decodedReader reads at most n bytes of the decoded body r, failing with
+// ErrDecodedTooLarge past them, as http.MaxBytesReader does.
+type decodedReader struct {
+	r *gzip.Reader
+	n int64
+}
+
+func (d *decodedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > d.n+1 {
+		p = p[:d.n+1]
+	}
+	n, err := d.r.Read(p)
+	if int64(n) <= d.n {
+		d.n -= int64(n)
+		return n, err
+	}
+	n = int(d.n)
+	d.n = 0
+	return n, ErrDecodedTooLarge
+}
+
+func (d *decodedReader) Close() error {
+	return d.r.Close()
+}
@@ -0,0 +1,38 @@
+package v1
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// maxFileNameLength is the length of the longest file name kept, in bytes.
+const maxFileNameLength = 255
+
+// ErrInvalidFileName is returned by SanitizeFileName when nothing is left
+// of the name once sanitized.
+var ErrInvalidFileName = errors.New("invalid file name")
+
+// SanitizeFileName returns the last element of the path name, with the
+// characters other than ASCII letters, digits, dots, dashes and underscores
+// replaced by underscores, its leading dots removed, and truncated to
+// maxFileNameLength bytes.
+func SanitizeFileName(name string) (string, error) {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+			r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if len(name) > maxFileNameLength {
+		name = name[:maxFileNameLength]
+	}
+	if name == "" {
+		return "", ErrInvalidFileName
+	}
+	return name, nil
+}
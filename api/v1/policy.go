@@ -0,0 +1,44 @@
+package v1
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/rs/zerolog/log"
+)
+
+// checkContent validates the file name declared as declared, whose content
+// is read from r, against the content type policy, and returns the reader
+// of its content, or the error of the policy rejecting it. The content type
+// is detected from the first bytes of the content, which are buffered so
+// that nothing is written before the file is accepted.
+func (o *Options) checkContent(name, declared string, r io.Reader) (io.Reader, error) {
+	if o.ContentType == nil {
+		return r, nil
+	}
+	if !o.ContentType.ExtensionAllowed(name) {
+		return nil, fmt.Errorf("%w: %q", sniff.ErrExtensionNotAllowed, path.Ext(name))
+	}
+	br := bufio.NewReaderSize(r, sniff.Len)
+	// a failure to read is left to the copy of the content.
+	head, _ := br.Peek(sniff.Len)
+	sniffed := sniff.Detect(head)
+	// clients declare the generic type when they don't know better, which
+	// isn't a claim about the content.
+	if t, _, _ := strings.Cut(declared, ";"); strings.TrimSpace(t) == "application/octet-stream" {
+		declared = ""
+	}
+	mismatch, err := o.ContentType.Check(declared, sniffed)
+	if err != nil {
+		return nil, err
+	}
+	if mismatch {
+		log.Warn().Str("file_name", name).Str("content_type", declared).Str("sniffed_content_type", sniffed).
+			Msg("content does not match the declared content type")
+	}
+	return br, nil
+}
@@ -0,0 +1,231 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrenagi/go-http-upload/auth"
+)
+
+// UploadIDHeader carries the ID a client gives to its v1 upload, under which
+// its progress is tracked.
+const UploadIDHeader = "X-Upload-Id"
+
+const (
+	// maxUploadIDLength is the length of the longest upload ID accepted.
+	maxUploadIDLength = 128
+	// progressRetention is how long the progress of a finished upload can
+	// still be queried.
+	progressRetention = time.Minute
+	// progressInterval is the interval between the events of a progress
+	// stream.
+	progressInterval = 250 * time.Millisecond
+)
+
+var (
+	// ErrInvalidUploadID is returned for an UploadIDHeader which isn't made
+	// of 1 to 128 ASCII letters, digits, dots, dashes or underscores.
+	ErrInvalidUploadID = errors.New("invalid upload id")
+	// ErrUploadIDInUse is returned for an UploadIDHeader of an upload still
+	// in progress.
+	ErrUploadIDInUse = errors.New("upload id in use")
+)
+
+// Progress is a registry of the bytes received by the v1 uploads given an
+// ID by their client, shared by the handlers receiving them and the one
+// reporting their progress.
+type Progress struct {
+	mu      sync.Mutex
+	uploads map[string]*progress
+}
+
+// NewProgress returns an empty progress registry.
+func NewProgress() *Progress {
+	return &Progress{uploads: make(map[string]*progress)}
+}
+
+// progress is the progress of an upload. Total is the length of its request,
+// or -1 when unknown. Its owner and tenant are the ones of the request.
+type progress struct {
+	received atomic.Int64
+	total    int64
+	owner    string
+	tenant   string
+	done     atomic.Bool
+	err      atomic.Pointer[string]
+}
+
+// progressResponse is the progress of an upload reported to clients.
+type progressResponse struct {
+	ID       string `json:"id"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`
+	Done     bool   `json:"done"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (p *progress) response(id string) progressResponse {
+	resp := progressResponse{ID: id, Received: p.received.Load(), Total: p.total, Done: p.done.Load()}
+	if err := p.err.Load(); err != nil {
+		resp.Error = *err
+	}
+	return resp
+}
+
+// track starts tracking the upload r, when it carries an UploadIDHeader,
+// by counting the bytes read from its body. It returns the writer the
+// response must be written to, and the function recording the outcome of
+// the upload once it is answered.
+func (p *Progress) track(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), error) {
+	id := r.Header.Get(UploadIDHeader)
+	if p == nil || id == "" {
+		return w, func() {}, nil
+	}
+	if !validUploadID(id) {
+		return w, nil, fmt.Errorf("%w: %q", ErrInvalidUploadID, id)
+	}
+
+	m := newMetadata(r, "")
+	pr := &progress{total: r.ContentLength, owner: m.Owner, tenant: m.Tenant}
+	p.mu.Lock()
+	if prev, ok := p.uploads[id]; ok && !prev.done.Load() {
+		p.mu.Unlock()
+		return w, nil, fmt.Errorf("%w: %q", ErrUploadIDInUse, id)
+	}
+	p.uploads[id] = pr
+	p.mu.Unlock()
+
+	r.Body = &countingReader{ReadCloser: r.Body, n: &pr.received}
+	sw := &statusWriter{ResponseWriter: w}
+	return sw, func() {
+		if sw.status >= http.StatusBadRequest {
+			msg := fmt.Sprintf("upload failed with status %d", sw.status)
+			pr.err.Store(&msg)
+		}
+		pr.done.Store(true)
+		time.AfterFunc(progressRetention, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.uploads[id] == pr {
+				delete(p.uploads, id)
+			}
+		})
+	}, nil
+}
+
+func (p *Progress) find(id string) (*progress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr, ok := p.uploads[id]
+	return pr, ok
+}
+
+// Status reports the progress of the upload whose ID is the upload_id route
+// variable as a JSON document, or as a stream of server-sent events until
+// it is done when the request accepts text/event-stream. Only the principal
+// making the upload, within its tenant, sees its progress.
+func (p *Progress) Status() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["upload_id"]
+		pr, ok := p.find(id)
+		if ok && (pr.tenant != auth.TenantFromContext(r.Context()) || !auth.CanAccess(r.Context(), pr.owner)) {
+			ok = false
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("upload not found"))
+			return
+		}
+		if r.Header.Get("Accept") != "text/event-stream" {
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, pr.response(id))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		last := int64(-1)
+		for {
+			resp := pr.response(id)
+			if resp.Received != last || resp.Done {
+				last = resp.Received
+				b, _ := json.Marshal(resp)
+				fmt.Fprintf(w, "event: progress\ndata: %s\n\n", b)
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+			if resp.Done {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+func validUploadID(id string) bool {
+	if len(id) == 0 || len(id) > maxUploadIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+			r == '.', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// countingReader adds the bytes read from the body of a request to n.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// uploadIDStatus returns the status of the response to a request whose
+// upload ID can't be tracked for err.
+func uploadIDStatus(err error) int {
+	if errors.Is(err, ErrUploadIDInUse) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
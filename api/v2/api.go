@@ -0,0 +1,677 @@
+package v2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/metrics"
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	// UploadContentLengthHeader and UploadContentTypeHeader describe the
+	// upload in the request creating its session.
+	UploadContentLengthHeader = "X-Upload-Content-Length"
+	UploadContentTypeHeader   = "X-Upload-Content-Type"
+	ContentRangeHeader        = "Content-Range"
+	RangeHeader               = "Range"
+
+	// StatusResumeIncomplete answers the requests leaving the upload
+	// incomplete, reporting the bytes received in the Range header.
+	StatusResumeIncomplete = http.StatusPermanentRedirect
+
+	// SessionMaxDuration is how long a session URI stays valid.
+	SessionMaxDuration = 7 * 24 * time.Hour
+
+	defaultUploadDir = "/tmp"
+	// maxMetadataSize limits the JSON body of the request creating a
+	// session.
+	maxMetadataSize = 1 << 20
+)
+
+var errTooLarge = errors.New("upload length exceeds the maximum size")
+
+type Options struct {
+	// MaxSize is the largest upload accepted, in bytes. Zero means
+	// unlimited.
+	MaxSize     int64
+	UploadDir   string
+	Logger      *zerolog.Logger
+	TenantQuota uint64
+	UserQuota   uint64
+	ContentType *sniff.Policy
+	Hooks       hooks.Hooks
+}
+
+type Option func(*Options)
+
+func WithMaxSize(size int64) Option {
+	return func(o *Options) {
+		o.MaxSize = size
+	}
+}
+
+func WithUploadDir(dir string) Option {
+	return func(o *Options) {
+		o.UploadDir = dir
+	}
+}
+
+// WithTenantQuota limits the total size, in bytes, of the uploads a tenant
+// may keep at the same time. Zero means unlimited.
+func WithTenantQuota(size uint64) Option {
+	return func(o *Options) {
+		o.TenantQuota = size
+	}
+}
+
+// WithUserQuota limits the total size, in bytes, of the uploads an
+// authenticated principal may keep at the same time. Zero means unlimited.
+func WithUserQuota(size uint64) Option {
+	return func(o *Options) {
+		o.UserQuota = size
+	}
+}
+
+// WithContentTypePolicy rejects the uploads declaring, or starting with the
+// bytes of, a content type p doesn't accept. A nil policy accepts every
+// upload.
+func WithContentTypePolicy(p *sniff.Policy) Option {
+	return func(o *Options) {
+		o.ContentType = p
+	}
+}
+
+// WithHooks calls h at every step of the lifecycle of the uploads. A nil h
+// keeps the no-op hooks.
+func WithHooks(h hooks.Hooks) Option {
+	return func(o *Options) {
+		if h != nil {
+			o.Hooks = h
+		}
+	}
+}
+
+// WithLogger sets the logger used for requests not carrying one, e.g. in
+// tests. A nil logger keeps the global one.
+func WithLogger(l *zerolog.Logger) Option {
+	return func(o *Options) {
+		if l != nil {
+			o.Logger = l
+		}
+	}
+}
+
+// Controller implements the resumable upload protocol of the Google APIs: a
+// POST creates an upload session, whose URI is returned in the Location
+// header, and PUT requests to the session URI send the bytes of the upload
+// in order, each declaring their position with a Content-Range header.
+// Requests leaving the upload incomplete are answered with
+// StatusResumeIncomplete and the range received so far, which a PUT with a
+// "bytes */total" Content-Range and no body also asks for.
+type Controller struct {
+	store     *Store
+	maxSize   int64
+	uploadDir string
+	// writing holds the IDs of the uploads a PUT is writing to.
+	writing     map[string]bool
+	mu          *sync.Mutex
+	metrics     *metrics.Recorder
+	log         *zerolog.Logger
+	quota       Quota
+	contentType *sniff.Policy
+	hooks       hooks.Hooks
+}
+
+func NewController(s *Store, opts ...Option) Controller {
+	o := Options{
+		UploadDir: defaultUploadDir,
+		Logger:    &log.Logger,
+		Hooks:     hooks.Nop{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return Controller{
+		store:       s,
+		maxSize:     o.MaxSize,
+		uploadDir:   o.UploadDir,
+		writing:     make(map[string]bool),
+		mu:          &sync.Mutex{},
+		metrics:     metrics.New(otel.GetMeterProvider(), "v2", "disk"),
+		log:         o.Logger,
+		quota:       Quota{Tenant: o.TenantQuota, User: o.UserQuota},
+		contentType: o.ContentType,
+		hooks:       o.Hooks,
+	}
+}
+
+// logger returns the logger of the request handled with ctx, which carries
+// its request id, or the logger of the controller.
+func (c *Controller) logger(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return c.log
+}
+
+// find looks up an upload on behalf of the tenant of the request. Uploads of
+// other tenants are reported as not found so their ids can't be probed.
+func (c *Controller) find(ctx context.Context, id string) (File, bool) {
+	f, ok := c.store.Find(id)
+	if !ok || f.Tenant != auth.TenantFromContext(ctx) {
+		return File{}, false
+	}
+	return f, true
+}
+
+// tooLarge reports whether size exceeds the maximum size of the uploads.
+func (c *Controller) tooLarge(size int64) bool {
+	return c.maxSize > 0 && size > c.maxSize
+}
+
+// checkTotal reports why total can't be the length of the upload f, an
+// error wrapping errTooLarge when it exceeds the maximum size.
+func (c *Controller) checkTotal(f File, total int64) error {
+	switch {
+	case f.TotalSize >= 0 && total != f.TotalSize:
+		return errors.New("upload length doesn't match the one declared")
+	case total < f.Received:
+		return errors.New("upload length is smaller than the bytes received")
+	case c.tooLarge(total):
+		return errTooLarge
+	}
+	return nil
+}
+
+// checkContentType rejects the uploads declaring a content type the policy
+// doesn't accept.
+func (c *Controller) checkContentType(contentType string) error {
+	if contentType != "" && c.contentType != nil && !c.contentType.Allowed(contentType) {
+		return fmt.Errorf("%w: %s", sniff.ErrNotAllowed, contentType)
+	}
+	return nil
+}
+
+// create creates the file of the upload f on behalf of the principal and
+// tenant of ctx, and saves it within the quotas. The error of a rejection
+// by the PreCreate hook or by the quotas is returned as is.
+func (c *Controller) create(ctx context.Context, f File) (File, error) {
+	if p, ok := auth.FromContext(ctx); ok {
+		f.Owner = p.Subject
+	}
+	f.Tenant = auth.TenantFromContext(ctx)
+	if err := c.hooks.PreCreate(ctx, f.hookUpload()); err != nil {
+		return f, &rejectError{err: err, code: hooks.StatusCode(err)}
+	}
+
+	dst, err := os.OpenFile(f.Path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return f, err
+	}
+	dst.Close()
+	if err := c.store.Create(f, c.quota); err != nil {
+		os.Remove(f.Path)
+		return f, &rejectError{err: err, code: quotaStatus(err)}
+	}
+	c.hooks.PostCreate(ctx, f.hookUpload())
+	c.metrics.Created(ctx)
+	c.logger(ctx).Debug().Str("file_id", f.ID).Msg("upload session created")
+	return f, nil
+}
+
+// rejectError is returned by create for an upload it refuses, with the
+// status of the response.
+type rejectError struct {
+	err  error
+	code int
+}
+
+func (e *rejectError) Error() string { return e.err.Error() }
+func (e *rejectError) Unwrap() error { return e.err }
+
+// quotaStatus returns the status of the response to a request failing to
+// reserve storage with err.
+func quotaStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTenantQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUserQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// received records the n bytes written to the upload f in d, which err
+// interrupted, if not nil. The bytes are reserved in the quotas while the
+// length of the upload is unknown: those which don't fit are discarded, and
+// the error of the quota returned.
+func (c *Controller) received(ctx context.Context, f File, n int64, d time.Duration, err error) error {
+	if rerr := c.store.Reserve(f, c.quota); rerr != nil {
+		os.Truncate(f.Path, f.Received-n)
+		c.logger(ctx).Debug().Err(rerr).Str("file_id", f.ID).Msg("bytes received not recorded")
+		return rerr
+	}
+	c.metrics.Received(ctx, n)
+	c.metrics.Chunk(ctx, n, d)
+	if isContentTypeError(err) {
+		return nil
+	}
+	if err != nil {
+		c.logger(ctx).Error().Err(err).Str("file_id", f.ID).Int64("written_size", n).Msg("error writing the file")
+		c.metrics.Failed(ctx, metrics.ReasonStorageError)
+		return nil
+	}
+	if n > 0 {
+		c.hooks.PostReceiveChunk(ctx, f.hookUpload())
+	}
+	if n > 0 && f.IsComplete() {
+		c.metrics.Completed(ctx, uint64(f.TotalSize), time.Since(f.CreatedAt))
+		c.logger(ctx).Info().Str("file_id", f.ID).Int64("size", f.TotalSize).Msg("upload complete")
+		c.hooks.PostFinish(ctx, f.hookUpload())
+	}
+	return nil
+}
+
+// remove deletes the upload f and its file.
+func (c *Controller) remove(ctx context.Context, f File) error {
+	if err := os.Remove(f.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	c.store.Delete(f.ID)
+	c.hooks.PostTerminate(ctx, f.hookUpload())
+	c.logger(ctx).Debug().Str("file_id", f.ID).Msg("upload cancelled")
+	return nil
+}
+
+// Sweep removes the uploads whose session expired every interval, until
+// ctx is done, so that the bytes of abandoned sessions don't stay on the
+// disk and in the quotas. Uploads being written are left for the next
+// sweep.
+func (c *Controller) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, f := range c.store.Expired() {
+			if !c.lock(f.ID) {
+				continue
+			}
+			if err := os.Remove(f.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				c.log.Warn().Err(err).Str("file_id", f.ID).Msg("error removing the expired upload")
+			} else {
+				c.store.Delete(f.ID)
+				c.log.Debug().Str("file_id", f.ID).Msg("expired upload removed")
+			}
+			c.unlock(f.ID)
+		}
+	}
+}
+
+type createRequest struct {
+	Name string `json:"name"`
+}
+
+// CreateUpload starts the session of an upload, described by the optional
+// X-Upload-Content-Length and X-Upload-Content-Type headers and the name
+// given in an optional JSON body, and returns its URI in the Location
+// header.
+func (c *Controller) CreateUpload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		f := NewFile(c.uploadDir)
+
+		if v := r.Header.Get(UploadContentLengthHeader); v != "" {
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || size < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s header", UploadContentLengthHeader))
+				return
+			}
+			if c.tooLarge(size) {
+				writeError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+				return
+			}
+			f.TotalSize = size
+		}
+		if v := r.Header.Get(UploadContentTypeHeader); v != "" {
+			if _, _, err := mime.ParseMediaType(v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s header", UploadContentTypeHeader))
+				return
+			}
+			if err := c.checkContentType(v); err != nil {
+				writeError(w, http.StatusUnsupportedMediaType, err)
+				return
+			}
+			f.ContentType = v
+		}
+		if r.ContentLength != 0 {
+			var req createRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataSize)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, errors.New("invalid upload metadata"))
+				return
+			}
+			f.Name = req.Name
+		}
+
+		f, err := c.create(r.Context(), f)
+		var rejectErr *rejectError
+		if errors.As(err, &rejectErr) {
+			log.Debug().Err(err).Msg("upload rejected")
+			writeError(w, rejectErr.code, err)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("file_id", f.ID).Msg("error creating the file")
+			writeError(w, http.StatusInternalServerError, errors.New("error creating the file"))
+			return
+		}
+		w.Header().Set("Location", sessionURI(r, f.ID))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// sessionURI returns the absolute URI of the session id, created by r.
+func sessionURI(r *http.Request, id string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path.Join(r.URL.Path, id)
+}
+
+// ResumeUpload writes the body of the request to the upload at the position
+// given by its Content-Range header, or by its length when it has none, and
+// answers StatusResumeIncomplete until every byte was received. Bytes the
+// upload already received are skipped, so that a client can resend a
+// request it didn't get the answer of.
+func (c *Controller) ResumeUpload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		id := mux.Vars(r)["upload_id"]
+		f, ok := c.find(r.Context(), id)
+		if !ok || f.IsExpired() {
+			if ok {
+				c.metrics.Failed(r.Context(), metrics.ReasonExpired)
+			}
+			writeError(w, http.StatusNotFound, errors.New("upload session not found"))
+			return
+		}
+		if !auth.CanAccess(r.Context(), f.Owner) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		var cr contentRange
+		if v := r.Header.Get(ContentRangeHeader); v != "" {
+			var err error
+			if cr, err = parseContentRange(v); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		} else {
+			if r.ContentLength < 0 {
+				writeError(w, http.StatusLengthRequired, errors.New("Content-Length or Content-Range is required"))
+				return
+			}
+			cr = contentRange{Start: 0, End: r.ContentLength - 1, Total: r.ContentLength}
+			if r.ContentLength == 0 {
+				cr.Start, cr.End = -1, -1
+			}
+		}
+		if !cr.isQuery() && r.ContentLength >= 0 && r.ContentLength != cr.End-cr.Start+1 {
+			writeError(w, http.StatusBadRequest, errors.New("Content-Length doesn't match the Content-Range header"))
+			return
+		}
+
+		if !c.lock(id) {
+			writeError(w, http.StatusConflict, errors.New("upload is being written by another request"))
+			return
+		}
+		defer c.unlock(id)
+		// the upload may have progressed, or been cancelled, while the lock
+		// was awaited.
+		if f, ok = c.store.Find(id); !ok {
+			writeError(w, http.StatusNotFound, errors.New("upload not found"))
+			return
+		}
+
+		if cr.Total >= 0 {
+			if err := c.checkTotal(f, cr.Total); err != nil {
+				code := http.StatusBadRequest
+				if errors.Is(err, errTooLarge) {
+					code = http.StatusRequestEntityTooLarge
+				}
+				writeError(w, code, err)
+				return
+			}
+			f.TotalSize = cr.Total
+		}
+		if f.IsComplete() || cr.isQuery() {
+			if err := c.store.Reserve(f, c.quota); err != nil {
+				writeError(w, quotaStatus(err), err)
+				return
+			}
+			c.respond(w, r, f)
+			return
+		}
+
+		if cr.Start > f.Received {
+			log.Debug().Str("file_id", f.ID).Int64("start", cr.Start).Int64("received", f.Received).Msg("range starts after the bytes received")
+			c.metrics.Failed(r.Context(), metrics.ReasonOffsetConflict)
+			setRange(w, f)
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, errors.New("range starts after the bytes received"))
+			return
+		}
+		if c.tooLarge(cr.End + 1) {
+			writeError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+			return
+		}
+
+		start := time.Now()
+		n, err := c.write(&f, cr, r.Body)
+		f.Received += n
+		if qerr := c.received(r.Context(), f, n, time.Since(start), err); qerr != nil {
+			writeError(w, quotaStatus(qerr), qerr)
+			return
+		}
+		if isContentTypeError(err) {
+			log.Debug().Err(err).Str("file_id", f.ID).Msg("content type rejected")
+			writeError(w, http.StatusUnsupportedMediaType, err)
+			return
+		}
+		if err != nil {
+			setRange(w, f)
+			writeError(w, http.StatusBadRequest, errors.New("error receiving the bytes of the range"))
+			return
+		}
+		c.respond(w, r, f)
+	}
+}
+
+// write writes the bytes of body, whose position in the upload is given by
+// cr, from the first one the upload f didn't receive, and returns how many
+// were written. The content type of f is detected from its first bytes
+// before the range completing them is written.
+func (c *Controller) write(f *File, cr contentRange, body io.Reader) (int64, error) {
+	if f.Received > cr.End {
+		return 0, nil
+	}
+	if skip := f.Received - cr.Start; skip > 0 {
+		if _, err := io.CopyN(io.Discard, body, skip); err != nil {
+			return 0, err
+		}
+	}
+	want := cr.End + 1 - f.Received
+	if c.contentType != nil && f.Received < sniff.Len {
+		br := bufio.NewReaderSize(body, sniff.Len)
+		chunk, _ := br.Peek(int(min(want, sniff.Len-f.Received)))
+		body = br
+		if err := c.sniff(f, chunk); err != nil {
+			return 0, err
+		}
+	}
+
+	dst, err := os.OpenFile(f.Path, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	if _, err := dst.Seek(f.Received, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.CopyN(dst, body, want)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// sniff detects the content type of f from the bytes it received followed
+// by chunk, once they hold sniff.Len bytes or the whole upload, and checks
+// it against the policy.
+func (c *Controller) sniff(f *File, chunk []byte) error {
+	head := make([]byte, f.Received, sniff.Len)
+	if len(head) > 0 {
+		src, err := os.Open(f.Path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if _, err := io.ReadFull(src, head); err != nil {
+			return err
+		}
+	}
+	head = append(head, chunk...)
+	if len(head) < sniff.Len && (f.TotalSize < 0 || int64(len(head)) < f.TotalSize) {
+		return nil
+	}
+	f.SniffedContentType = sniff.Detect(head)
+	mismatch, err := c.contentType.Check(f.ContentType, f.SniffedContentType)
+	if err != nil {
+		return err
+	}
+	f.ContentTypeMismatch = mismatch
+	return nil
+}
+
+// isContentTypeError reports whether err rejected the content of an upload.
+func isContentTypeError(err error) bool {
+	return errors.Is(err, sniff.ErrNotAllowed) || errors.Is(err, sniff.ErrMismatch)
+}
+
+func (c *Controller) lock(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writing[id] {
+		return false
+	}
+	c.writing[id] = true
+	return true
+}
+
+func (c *Controller) unlock(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.writing, id)
+}
+
+type fileResponse struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// respond answers with the description of f once complete, and with
+// StatusResumeIncomplete and the range received otherwise.
+func (c *Controller) respond(w http.ResponseWriter, r *http.Request, f File) {
+	if !f.IsComplete() {
+		setRange(w, f)
+		w.WriteHeader(StatusResumeIncomplete)
+		return
+	}
+	b, _ := json.Marshal(fileResponse{
+		ID:          f.ID,
+		Name:        f.Name,
+		ContentType: f.ContentType,
+		Size:        f.TotalSize,
+		CreatedAt:   f.CreatedAt.UTC(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// setRange sets the Range header reporting the bytes f received, which is
+// left unset when it received none.
+func setRange(w http.ResponseWriter, f File) {
+	if f.Received > 0 {
+		w.Header().Set(RangeHeader, fmt.Sprintf("bytes=0-%d", f.Received-1))
+	}
+}
+
+// CancelUpload deletes the upload and ends its session.
+func (c *Controller) CancelUpload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		id := mux.Vars(r)["upload_id"]
+		f, ok := c.find(r.Context(), id)
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("upload session not found"))
+			return
+		}
+		if !auth.CanAccess(r.Context(), f.Owner) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if !c.lock(id) {
+			writeError(w, http.StatusConflict, errors.New("upload is being written by another request"))
+			return
+		}
+		defer c.unlock(id)
+
+		if err := c.remove(r.Context(), f); err != nil {
+			log.Error().Err(err).Str("file_id", f.ID).Msg("error removing the file")
+			writeError(w, http.StatusInternalServerError, errors.New("error removing the file"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type cError struct {
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	b, _ := json.Marshal(cError{Message: err.Error()})
+	w.Write(b)
+}
@@ -0,0 +1,368 @@
+package v2_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	v2 "github.com/imrenagi/go-http-upload/api/v2"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRouter(dir string, opts ...v2.Option) *mux.Router {
+	return newRouterWith(v2.NewController(v2.NewStore(), append([]v2.Option{v2.WithUploadDir(dir)}, opts...)...))
+}
+
+func newRouterWith(c v2.Controller) *mux.Router {
+	router := mux.NewRouter()
+	router.Handle("/api/v2/files", c.CreateUpload()).Methods(http.MethodPost)
+	router.Handle("/api/v2/files/{upload_id}", c.ResumeUpload()).Methods(http.MethodPut)
+	router.Handle("/api/v2/files/{upload_id}", c.CancelUpload()).Methods(http.MethodDelete)
+	return router
+}
+
+func create(t *testing.T, router http.Handler, length string) string {
+	req := httptest.NewRequest(http.MethodPost, "http://uploader.test/api/v2/files", strings.NewReader(`{"name":"notes.txt"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if length != "" {
+		req.Header.Set(v2.UploadContentLengthHeader, length)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	return w.Header().Get("Location")
+}
+
+func put(router http.Handler, uri, contentRange, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, uri, strings.NewReader(body))
+	if contentRange != "" {
+		req.Header.Set(v2.ContentRangeHeader, contentRange)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCreateUpload(t *testing.T) {
+	t.Run("session URI must be returned in the Location header", func(t *testing.T) {
+		uri := create(t, newRouter(t.TempDir()), "11")
+
+		assert.Regexp(t, `^http://uploader\.test/api/v2/files/[0-9a-f-]{36}$`, uri)
+	})
+
+	t.Run("upload larger than the maximum size must be rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/files", nil)
+		req.Header.Set(v2.UploadContentLengthHeader, "11")
+		w := httptest.NewRecorder()
+
+		newRouter(t.TempDir(), v2.WithMaxSize(10)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("invalid length must be rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/files", nil)
+		req.Header.Set(v2.UploadContentLengthHeader, "-1")
+		w := httptest.NewRecorder()
+
+		newRouter(t.TempDir()).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestResumeUpload(t *testing.T) {
+	t.Run("ranges must be appended until the upload is complete", func(t *testing.T) {
+		dir := t.TempDir()
+		router := newRouter(dir)
+		uri := create(t, router, "11")
+
+		w := put(router, uri, "bytes 0-5/11", "hello ")
+		assert.Equal(t, v2.StatusResumeIncomplete, w.Code)
+		assert.Equal(t, "bytes=0-5", w.Header().Get("Range"))
+
+		w = put(router, uri, "bytes 6-10/11", "world")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var file struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+		assert.Equal(t, "notes.txt", file.Name)
+		assert.Equal(t, int64(11), file.Size)
+		b, err := os.ReadFile(filepath.Join(dir, "v2-upload-"+file.ID))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", string(b))
+	})
+
+	t.Run("status query must report the range received", func(t *testing.T) {
+		router := newRouter(t.TempDir())
+		uri := create(t, router, "")
+
+		w := put(router, uri, "bytes */*", "")
+		assert.Equal(t, v2.StatusResumeIncomplete, w.Code)
+		assert.Empty(t, w.Header().Get("Range"))
+
+		put(router, uri, "bytes 0-4/*", "hello")
+		w = put(router, uri, "bytes */*", "")
+		assert.Equal(t, v2.StatusResumeIncomplete, w.Code)
+		assert.Equal(t, "bytes=0-4", w.Header().Get("Range"))
+
+		w = put(router, uri, "bytes */5", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("bytes already received must be skipped", func(t *testing.T) {
+		dir := t.TempDir()
+		router := newRouter(dir)
+		uri := create(t, router, "11")
+		put(router, uri, "bytes 0-7/11", "hello wo")
+
+		w := put(router, uri, "bytes 6-10/11", "world")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		b, _ := os.ReadFile(filepath.Join(dir, "v2-upload-"+filepath.Base(uri)))
+		assert.Equal(t, "hello world", string(b))
+	})
+
+	t.Run("range starting after the bytes received must not be satisfiable", func(t *testing.T) {
+		router := newRouter(t.TempDir())
+		uri := create(t, router, "11")
+		put(router, uri, "bytes 0-4/11", "hello")
+
+		w := put(router, uri, "bytes 6-10/11", "world")
+
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+		assert.Equal(t, "bytes=0-4", w.Header().Get("Range"))
+	})
+
+	t.Run("whole upload must be accepted without Content-Range", func(t *testing.T) {
+		router := newRouter(t.TempDir())
+		uri := create(t, router, "")
+
+		w := put(router, uri, "", "hello world")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("invalid ranges must be rejected", func(t *testing.T) {
+		router := newRouter(t.TempDir())
+		uri := create(t, router, "11")
+		for _, cr := range []string{"bytes 0-4/12", "bytes 4-0/11", "bytes 0-11/11", "items 0-4/11", "bytes 0-3/11"} {
+			w := put(router, uri, cr, "hello")
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, cr)
+		}
+	})
+
+	t.Run("unknown session must not be found", func(t *testing.T) {
+		w := put(newRouter(t.TempDir()), "/api/v2/files/unknown", "bytes */*", "")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestCancelUpload(t *testing.T) {
+	dir := t.TempDir()
+	router := newRouter(dir)
+	uri := create(t, router, "11")
+
+	req := httptest.NewRequest(http.MethodDelete, uri, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries)
+	assert.Equal(t, http.StatusNotFound, put(router, uri, "bytes */*", "").Code)
+}
+
+// as serves the requests of router on behalf of the principal subject of
+// tenant.
+func as(router http.Handler, subject, tenant string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := auth.NewContext(r.Context(), auth.Principal{Subject: subject})
+		router.ServeHTTP(w, r.WithContext(auth.NewTenantContext(ctx, tenant)))
+	})
+}
+
+func TestQuota(t *testing.T) {
+	t.Run("upload of an owner out of quota must be rejected with 507", func(t *testing.T) {
+		router := newRouter(t.TempDir(), v2.WithUserQuota(15))
+		create(t, as(router, "alice", ""), "10")
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/files", nil)
+		req.Header.Set(v2.UploadContentLengthHeader, "10")
+		w := httptest.NewRecorder()
+		as(router, "alice", "").ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+		create(t, as(router, "bob", ""), "10")
+	})
+
+	t.Run("upload of a tenant out of quota must be rejected with 413", func(t *testing.T) {
+		router := newRouter(t.TempDir(), v2.WithTenantQuota(15))
+		create(t, as(router, "alice", "acme"), "10")
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/files", nil)
+		req.Header.Set(v2.UploadContentLengthHeader, "10")
+		w := httptest.NewRecorder()
+		as(router, "bob", "acme").ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("bytes of unknown length beyond the quota must be discarded", func(t *testing.T) {
+		dir := t.TempDir()
+		router := as(newRouter(dir, v2.WithUserQuota(8)), "alice", "")
+		uri := create(t, router, "")
+		put(router, uri, "bytes 0-4/*", "hello")
+
+		w := put(router, uri, "bytes 5-9/*", "world")
+
+		assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+		w = put(router, uri, "bytes */*", "")
+		assert.Equal(t, "bytes=0-4", w.Header().Get("Range"))
+		b, _ := os.ReadFile(filepath.Join(dir, "v2-upload-"+filepath.Base(uri)))
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("bytes of unknown length beyond the maximum size must be rejected", func(t *testing.T) {
+		router := newRouter(t.TempDir(), v2.WithMaxSize(8))
+		uri := create(t, router, "")
+		put(router, uri, "bytes 0-4/*", "hello")
+
+		w := put(router, uri, "bytes 5-9/*", "world")
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	policy := &sniff.Policy{Deny: []string{"text/html"}, Mismatch: sniff.MismatchReject}
+	createTyped := func(t *testing.T, router http.Handler, contentType, length string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/files", nil)
+		req.Header.Set(v2.UploadContentTypeHeader, contentType)
+		req.Header.Set(v2.UploadContentLengthHeader, length)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("upload declaring a denied content type must be rejected", func(t *testing.T) {
+		w := createTyped(t, newRouter(t.TempDir(), v2.WithContentTypePolicy(policy)), "text/html", "11")
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+
+	t.Run("content contradicting the declared type must be rejected once its first bytes are received", func(t *testing.T) {
+		router := newRouter(t.TempDir(), v2.WithContentTypePolicy(policy))
+		w := createTyped(t, router, "image/png", "11")
+		assert.Equal(t, http.StatusOK, w.Code)
+		uri := w.Header().Get("Location")
+
+		w = put(router, uri, "bytes 0-5/11", "hello ")
+		assert.Equal(t, v2.StatusResumeIncomplete, w.Code)
+
+		w = put(router, uri, "bytes 6-10/11", "world")
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		w = put(router, uri, "bytes */11", "")
+		assert.Equal(t, "bytes=0-5", w.Header().Get("Range"))
+	})
+}
+
+type recordingHooks struct {
+	hooks.Nop
+	events []string
+	reject error
+}
+
+func (h *recordingHooks) PreCreate(ctx context.Context, u hooks.Upload) error {
+	h.events = append(h.events, "pre-create "+u.Metadata["filename"])
+	return h.reject
+}
+
+func (h *recordingHooks) PostCreate(ctx context.Context, u hooks.Upload) {
+	h.events = append(h.events, "post-create")
+}
+
+func (h *recordingHooks) PostReceiveChunk(ctx context.Context, u hooks.Upload) {
+	h.events = append(h.events, fmt.Sprintf("post-receive-chunk %d", u.Offset))
+}
+
+func (h *recordingHooks) PostFinish(ctx context.Context, u hooks.Upload) {
+	h.events = append(h.events, "post-finish")
+}
+
+func (h *recordingHooks) PostTerminate(ctx context.Context, u hooks.Upload) {
+	h.events = append(h.events, "post-terminate")
+}
+
+func TestHooks(t *testing.T) {
+	t.Run("hooks must be called at every step of the upload", func(t *testing.T) {
+		h := &recordingHooks{}
+		router := newRouter(t.TempDir(), v2.WithHooks(h))
+		uri := create(t, router, "11")
+		put(router, uri, "bytes 0-5/11", "hello ")
+		put(router, uri, "bytes 6-10/11", "world")
+
+		assert.Equal(t, []string{
+			"pre-create notes.txt",
+			"post-create",
+			"post-receive-chunk 6",
+			"post-receive-chunk 11",
+			"post-finish",
+		}, h.events)
+	})
+
+	t.Run("upload rejected by the PreCreate hook must not be created", func(t *testing.T) {
+		dir := t.TempDir()
+		h := &recordingHooks{reject: hooks.Reject(http.StatusUnprocessableEntity, "text files are not accepted")}
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/files", nil)
+		w := httptest.NewRecorder()
+
+		newRouter(dir, v2.WithHooks(h)).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		entries, _ := os.ReadDir(dir)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestSweep(t *testing.T) {
+	dir := t.TempDir()
+	store := v2.NewStore()
+	expired := v2.NewFile(dir)
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	active := v2.NewFile(dir)
+	for _, f := range []v2.File{expired, active} {
+		assert.NoError(t, os.WriteFile(f.Path, nil, 0644))
+		store.Save(f.ID, f)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := v2.NewController(store, v2.WithUploadDir(dir))
+	go c.Sweep(ctx, time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		_, ok := store.Find(expired.ID)
+		return !ok
+	}, time.Second, time.Millisecond)
+	_, err := os.Stat(expired.Path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, ok := store.Find(active.ID)
+	assert.True(t, ok)
+}
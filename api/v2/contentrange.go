@@ -0,0 +1,66 @@
+package v2
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidContentRange = errors.New("invalid Content-Range header")
+
+// contentRange is a Content-Range header of a PUT request. Start and End are
+// the first and last bytes of the request body, or -1 for a request
+// querying the status of the upload. Total is the length of the upload, or
+// -1 when the client doesn't know it yet.
+type contentRange struct {
+	Start int64
+	End   int64
+	Total int64
+}
+
+// isQuery reports whether the request carries no bytes, only asking for
+// the range received.
+func (c contentRange) isQuery() bool {
+	return c.Start < 0
+}
+
+// parseContentRange parses the "bytes start-end/total", "bytes start-end/*",
+// "bytes */total" and "bytes */*" forms of a Content-Range header.
+func parseContentRange(v string) (contentRange, error) {
+	spec, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return contentRange{}, ErrInvalidContentRange
+	}
+	rng, total, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return contentRange{}, ErrInvalidContentRange
+	}
+
+	c := contentRange{Start: -1, End: -1, Total: -1}
+	if total != "*" {
+		n, err := strconv.ParseInt(total, 10, 64)
+		if err != nil || n < 0 {
+			return contentRange{}, ErrInvalidContentRange
+		}
+		c.Total = n
+	}
+	if rng == "*" {
+		return c, nil
+	}
+
+	start, end, ok := strings.Cut(rng, "-")
+	if !ok {
+		return contentRange{}, ErrInvalidContentRange
+	}
+	var err error
+	if c.Start, err = strconv.ParseInt(start, 10, 64); err != nil || c.Start < 0 {
+		return contentRange{}, ErrInvalidContentRange
+	}
+	if c.End, err = strconv.ParseInt(end, 10, 64); err != nil || c.End < c.Start {
+		return contentRange{}, ErrInvalidContentRange
+	}
+	if c.Total >= 0 && c.End >= c.Total {
+		return contentRange{}, ErrInvalidContentRange
+	}
+	return c, nil
+}
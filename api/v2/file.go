@@ -0,0 +1,79 @@
+package v2
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/imrenagi/go-http-upload/hooks"
+)
+
+// File is a resumable upload, identified by the session URI it is created
+// with.
+type File struct {
+	ID          string
+	Name        string
+	ContentType string
+	// TotalSize is the length of the upload, or -1 until a request gives it.
+	TotalSize int64
+	// Received is the number of bytes received, all of them from the
+	// first one.
+	Received  int64
+	Path      string
+	Owner     string
+	Tenant    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// SniffedContentType is the content type detected from the first bytes
+	// of the upload, and ContentTypeMismatch set when it contradicts the
+	// declared one.
+	SniffedContentType  string
+	ContentTypeMismatch bool
+}
+
+func NewFile(dir string) File {
+	id := uuid.New().String()
+	now := time.Now()
+	return File{
+		ID:        id,
+		TotalSize: -1,
+		Path:      filepath.Join(dir, "v2-upload-"+id),
+		CreatedAt: now,
+		ExpiresAt: now.Add(SessionMaxDuration),
+	}
+}
+
+// IsComplete reports whether every byte of the upload was received.
+func (f File) IsComplete() bool {
+	return f.TotalSize >= 0 && f.Received == f.TotalSize
+}
+
+// IsExpired reports whether the session of the upload expired before it
+// was complete.
+func (f File) IsExpired() bool {
+	return !f.IsComplete() && time.Now().After(f.ExpiresAt)
+}
+
+// StoredSize is the number of bytes the upload takes in the quotas: its
+// length, or the bytes received while it is unknown.
+func (f File) StoredSize() uint64 {
+	return uint64(max(f.TotalSize, f.Received))
+}
+
+func (f File) hookUpload() hooks.Upload {
+	u := hooks.Upload{
+		ID:            f.ID,
+		Tenant:        f.Tenant,
+		Owner:         f.Owner,
+		IsDeferLength: f.TotalSize < 0,
+		Offset:        uint64(f.Received),
+		ExpiresAt:     f.ExpiresAt,
+	}
+	if f.TotalSize >= 0 {
+		u.Size = uint64(f.TotalSize)
+	}
+	if f.Name != "" || f.ContentType != "" {
+		u.Metadata = map[string]string{"filename": f.Name, "content-type": f.ContentType}
+	}
+	return u
+}
@@ -0,0 +1,282 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/api/v2/uploadpb"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCServer serves the uploads of a Controller over gRPC, so that an upload
+// created with either API can be resumed with the other. A client streams
+// the chunks of an upload with UploadChunk, and asks GetUpload for its
+// offset to resume it after the stream broke.
+type GRPCServer struct {
+	uploadpb.UnimplementedUploadServiceServer
+	c Controller
+}
+
+func NewGRPCServer(c Controller) *GRPCServer {
+	return &GRPCServer{c: c}
+}
+
+func (s *GRPCServer) CreateUpload(ctx context.Context, req *uploadpb.CreateUploadRequest) (*uploadpb.Upload, error) {
+	f := NewFile(s.c.uploadDir)
+	f.Name = req.GetName()
+	if req.Size != nil {
+		if req.GetSize() < 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid size")
+		}
+		if s.c.tooLarge(req.GetSize()) {
+			return nil, status.Error(codes.InvalidArgument, errTooLarge.Error())
+		}
+		f.TotalSize = req.GetSize()
+	}
+	if v := req.GetContentType(); v != "" {
+		if _, _, err := mime.ParseMediaType(v); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid content type")
+		}
+		if err := s.c.checkContentType(v); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		f.ContentType = v
+	}
+	if p, ok := auth.FromContext(ctx); ok {
+		if p.MaxUploadSize > 0 && req.Size == nil {
+			return nil, status.Error(codes.FailedPrecondition, "the upload length can't be deferred")
+		}
+		if err := checkPrincipalSize(p, f.TotalSize); err != nil {
+			return nil, err
+		}
+		if p.ContentType != "" && f.ContentType != p.ContentType {
+			return nil, status.Error(codes.InvalidArgument, auth.ErrContentTypeNotAllowed.Error())
+		}
+	}
+
+	f, err := s.c.create(ctx, f)
+	var rejectErr *rejectError
+	if errors.As(err, &rejectErr) {
+		return nil, status.Error(rejectCode(rejectErr.code), err.Error())
+	}
+	if err != nil {
+		s.c.logger(ctx).Error().Err(err).Str("file_id", f.ID).Msg("error creating the file")
+		return nil, status.Error(codes.Internal, "error creating the file")
+	}
+	return toProto(f), nil
+}
+
+// UploadChunk writes the chunks of the stream, which must all belong to
+// the same upload, and answers with the upload once the client closed the
+// stream. The upload is locked until then.
+func (s *GRPCServer) UploadChunk(stream grpc.ClientStreamingServer[uploadpb.UploadChunkRequest, uploadpb.Upload]) error {
+	ctx := stream.Context()
+	var f File
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if f.ID == "" {
+			if f, err = s.open(ctx, chunk.GetId()); err != nil {
+				return err
+			}
+			defer s.c.unlock(f.ID)
+		} else if chunk.GetId() != f.ID {
+			return status.Error(codes.InvalidArgument, "chunks of a stream must belong to the same upload")
+		}
+
+		if f, err = s.write(ctx, f, chunk); err != nil {
+			return err
+		}
+	}
+	if f.ID == "" {
+		return status.Error(codes.InvalidArgument, "no chunk received")
+	}
+	return stream.SendAndClose(toProto(f))
+}
+
+// open finds and locks the upload id for a stream of its chunks.
+func (s *GRPCServer) open(ctx context.Context, id string) (File, error) {
+	f, err := s.find(ctx, id)
+	if err != nil {
+		return File{}, err
+	}
+	if !s.c.lock(id) {
+		return File{}, status.Error(codes.Aborted, "upload is being written by another request")
+	}
+	// the upload may have progressed, or been cancelled, while the lock was
+	// awaited.
+	f, ok := s.c.store.Find(id)
+	if !ok {
+		s.c.unlock(id)
+		return File{}, status.Error(codes.NotFound, "upload not found")
+	}
+	return f, nil
+}
+
+// write writes the data of chunk to the upload f, skipping the bytes it
+// already received, and returns the upload updated.
+func (s *GRPCServer) write(ctx context.Context, f File, chunk *uploadpb.UploadChunkRequest) (File, error) {
+	p, _ := auth.FromContext(ctx)
+	if chunk.Size != nil {
+		if err := s.c.checkTotal(f, chunk.GetSize()); err != nil {
+			return f, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := checkPrincipalSize(p, chunk.GetSize()); err != nil {
+			return f, err
+		}
+		f.TotalSize = chunk.GetSize()
+		if err := s.c.store.Reserve(f, s.c.quota); err != nil {
+			return f, status.Error(rejectCode(quotaStatus(err)), err.Error())
+		}
+	}
+	if len(chunk.GetData()) == 0 {
+		return f, nil
+	}
+
+	cr := contentRange{
+		Start: chunk.GetOffset(),
+		End:   chunk.GetOffset() + int64(len(chunk.GetData())) - 1,
+		Total: f.TotalSize,
+	}
+	switch {
+	case cr.Start < 0:
+		return f, status.Error(codes.InvalidArgument, "invalid offset")
+	case cr.Start > f.Received:
+		s.c.metrics.Failed(ctx, metrics.ReasonOffsetConflict)
+		return f, status.Errorf(codes.FailedPrecondition, "offset %d is after the %d bytes received", cr.Start, f.Received)
+	case f.TotalSize >= 0 && cr.End >= f.TotalSize:
+		return f, status.Error(codes.InvalidArgument, "chunk exceeds the upload length")
+	case s.c.tooLarge(cr.End + 1):
+		return f, status.Error(codes.InvalidArgument, errTooLarge.Error())
+	}
+	if err := checkPrincipalSize(p, cr.End+1); err != nil {
+		return f, err
+	}
+	// only the bytes which weren't received yet are written, and charged.
+	if n := cr.End + 1 - max(cr.Start, f.Received); n > 0 && p.Meter != nil {
+		if err := p.Meter.Charge(uint64(n)); err != nil {
+			return f, status.Error(codes.ResourceExhausted, err.Error())
+		}
+	}
+
+	start := time.Now()
+	n, err := s.c.write(&f, cr, bytes.NewReader(chunk.GetData()))
+	f.Received += n
+	if qerr := s.c.received(ctx, f, n, time.Since(start), err); qerr != nil {
+		f.Received -= n
+		return f, status.Error(rejectCode(quotaStatus(qerr)), qerr.Error())
+	}
+	if isContentTypeError(err) {
+		return f, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return f, status.Error(codes.Internal, "error writing the chunk")
+	}
+	return f, nil
+}
+
+// rejectCode returns the code of the status answering a call rejected with
+// the HTTP status code.
+func rejectCode(code int) codes.Code {
+	switch code {
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	}
+	if code >= 400 && code < 500 {
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
+}
+
+// checkPrincipalSize rejects the uploads of size bytes larger than the
+// maximum size of p, the principal of the call. The authenticators can't
+// check it, since the sizes aren't part of the metadata of the calls.
+func checkPrincipalSize(p auth.Principal, size int64) error {
+	if p.MaxUploadSize > 0 && size > 0 && uint64(size) > p.MaxUploadSize {
+		return status.Error(codes.InvalidArgument, auth.ErrUploadTooLarge.Error())
+	}
+	return nil
+}
+
+func (s *GRPCServer) GetUpload(ctx context.Context, req *uploadpb.GetUploadRequest) (*uploadpb.Upload, error) {
+	f, err := s.find(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return toProto(f), nil
+}
+
+func (s *GRPCServer) CancelUpload(ctx context.Context, req *uploadpb.CancelUploadRequest) (*uploadpb.CancelUploadResponse, error) {
+	f, err := s.find(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if !s.c.lock(f.ID) {
+		return nil, status.Error(codes.Aborted, "upload is being written by another request")
+	}
+	defer s.c.unlock(f.ID)
+
+	if err := s.c.remove(ctx, f); err != nil {
+		s.c.logger(ctx).Error().Err(err).Str("file_id", f.ID).Msg("error removing the file")
+		return nil, status.Error(codes.Internal, "error removing the file")
+	}
+	return &uploadpb.CancelUploadResponse{}, nil
+}
+
+// find looks up the upload id like Controller.find, and checks the caller
+// may operate on it.
+func (s *GRPCServer) find(ctx context.Context, id string) (File, error) {
+	f, ok := s.c.find(ctx, id)
+	if !ok || f.IsExpired() {
+		if ok {
+			s.c.metrics.Failed(ctx, metrics.ReasonExpired)
+		}
+		return File{}, status.Error(codes.NotFound, "upload not found")
+	}
+	if !auth.CanAccess(ctx, f.Owner) {
+		return File{}, status.Error(codes.PermissionDenied, auth.ErrForbidden.Error())
+	}
+	return f, nil
+}
+
+func toProto(f File) *uploadpb.Upload {
+	u := &uploadpb.Upload{
+		Id:          f.ID,
+		Name:        f.Name,
+		ContentType: f.ContentType,
+		Offset:      f.Received,
+		Complete:    f.IsComplete(),
+		CreatedAt:   timestamppb.New(f.CreatedAt),
+		ExpiresAt:   timestamppb.New(f.ExpiresAt),
+	}
+	if f.TotalSize >= 0 {
+		u.Size = &f.TotalSize
+	}
+	return u
+}
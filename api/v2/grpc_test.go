@@ -0,0 +1,215 @@
+package v2_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v2 "github.com/imrenagi/go-http-upload/api/v2"
+	"github.com/imrenagi/go-http-upload/api/v2/uploadpb"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func newClient(t *testing.T, c v2.Controller, opts ...grpc.ServerOption) uploadpb.UploadServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(opts...)
+	uploadpb.RegisterUploadServiceServer(s, v2.NewGRPCServer(c))
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return uploadpb.NewUploadServiceClient(conn)
+}
+
+func send(t *testing.T, client uploadpb.UploadServiceClient, chunks ...*uploadpb.UploadChunkRequest) (*uploadpb.Upload, error) {
+	stream, err := client.UploadChunk(context.Background())
+	assert.NoError(t, err)
+	for _, chunk := range chunks {
+		if err := stream.Send(chunk); err != nil {
+			break
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+// newClientAs returns a client whose calls are authenticated as p.
+func newClientAs(t *testing.T, c v2.Controller, p auth.Principal) uploadpb.UploadServiceClient {
+	a := auth.AuthenticatorFunc(func(r *http.Request) (auth.Principal, error) { return p, nil })
+	return newClient(t, c,
+		grpc.UnaryInterceptor(auth.UnaryServerInterceptor(a, auth.RoleUploader, "")),
+		grpc.StreamInterceptor(auth.StreamServerInterceptor(a, auth.RoleUploader, "")))
+}
+
+type fakeMeter struct {
+	limit   uint64
+	charged uint64
+}
+
+func (m *fakeMeter) Charge(n uint64) error {
+	if m.charged+n > m.limit {
+		return auth.ErrQuotaExceeded
+	}
+	m.charged += n
+	return nil
+}
+
+func TestGRPCPrincipalLimits(t *testing.T) {
+	t.Run("upload larger than the maximum size of the principal must be rejected", func(t *testing.T) {
+		client := newClientAs(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(t.TempDir())), auth.Principal{Subject: "alice", MaxUploadSize: 10})
+
+		_, err := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{Size: proto.Int64(11)})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("upload of another content type than the one of the principal must be rejected", func(t *testing.T) {
+		client := newClientAs(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(t.TempDir())), auth.Principal{Subject: "alice", ContentType: "image/png"})
+
+		_, err := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{ContentType: "text/plain"})
+
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("bytes received must be charged to the meter of the principal", func(t *testing.T) {
+		m := &fakeMeter{limit: 8}
+		client := newClientAs(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(t.TempDir())), auth.Principal{Subject: "alice", Meter: m})
+		u, err := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{Size: proto.Int64(11)})
+		assert.NoError(t, err)
+
+		_, err = send(t, client, &uploadpb.UploadChunkRequest{Id: u.GetId(), Data: []byte("hello ")})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(6), m.charged)
+
+		_, err = send(t, client, &uploadpb.UploadChunkRequest{Id: u.GetId(), Offset: 3, Data: []byte("lo wo")})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(8), m.charged)
+
+		_, err = send(t, client, &uploadpb.UploadChunkRequest{Id: u.GetId(), Offset: 8, Data: []byte("rld")})
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Equal(t, uint64(8), m.charged)
+	})
+}
+
+func TestGRPCUploadChunk(t *testing.T) {
+	t.Run("streamed chunks must be appended until the upload is complete", func(t *testing.T) {
+		dir := t.TempDir()
+		client := newClient(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(dir)))
+		u, err := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{Name: "notes.txt"})
+		assert.NoError(t, err)
+
+		u, err = send(t, client,
+			&uploadpb.UploadChunkRequest{Id: u.GetId(), Offset: 0, Data: []byte("hello ")},
+			&uploadpb.UploadChunkRequest{Id: u.GetId(), Offset: 6, Data: []byte("world"), Size: proto.Int64(11)})
+
+		assert.NoError(t, err)
+		assert.True(t, u.GetComplete())
+		assert.Equal(t, int64(11), u.GetOffset())
+		b, err := os.ReadFile(filepath.Join(dir, "v2-upload-"+u.GetId()))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", string(b))
+	})
+
+	t.Run("upload must be resumed from the offset received", func(t *testing.T) {
+		dir := t.TempDir()
+		client := newClient(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(dir)))
+		u, _ := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{Size: proto.Int64(11)})
+		send(t, client, &uploadpb.UploadChunkRequest{Id: u.GetId(), Offset: 0, Data: []byte("hello wo")})
+
+		u, err := client.GetUpload(context.Background(), &uploadpb.GetUploadRequest{Id: u.GetId()})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(8), u.GetOffset())
+		assert.False(t, u.GetComplete())
+
+		u, err = send(t, client, &uploadpb.UploadChunkRequest{Id: u.GetId(), Offset: 6, Data: []byte("world")})
+		assert.NoError(t, err)
+		assert.True(t, u.GetComplete())
+		b, _ := os.ReadFile(filepath.Join(dir, "v2-upload-"+u.GetId()))
+		assert.Equal(t, "hello world", string(b))
+	})
+
+	t.Run("chunk starting after the bytes received must be rejected", func(t *testing.T) {
+		client := newClient(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(t.TempDir())))
+		u, _ := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{Size: proto.Int64(11)})
+
+		_, err := send(t, client, &uploadpb.UploadChunkRequest{Id: u.GetId(), Offset: 6, Data: []byte("world")})
+
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("chunks of another upload must be rejected", func(t *testing.T) {
+		client := newClient(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(t.TempDir())))
+		first, _ := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{})
+		second, _ := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{})
+
+		_, err := send(t, client,
+			&uploadpb.UploadChunkRequest{Id: first.GetId(), Data: []byte("hello")},
+			&uploadpb.UploadChunkRequest{Id: second.GetId(), Data: []byte("world")})
+
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("unknown upload must not be found", func(t *testing.T) {
+		client := newClient(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(t.TempDir())))
+
+		_, err := send(t, client, &uploadpb.UploadChunkRequest{Id: "unknown", Data: []byte("hello")})
+
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+func TestGRPCCreateUpload(t *testing.T) {
+	t.Run("upload larger than the maximum size must be rejected", func(t *testing.T) {
+		client := newClient(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(t.TempDir()), v2.WithMaxSize(10)))
+
+		_, err := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{Size: proto.Int64(11)})
+
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("upload must be resumable with the HTTP API", func(t *testing.T) {
+		dir := t.TempDir()
+		c := v2.NewController(v2.NewStore(), v2.WithUploadDir(dir))
+		client := newClient(t, c)
+		u, _ := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{Size: proto.Int64(11)})
+		send(t, client, &uploadpb.UploadChunkRequest{Id: u.GetId(), Data: []byte("hello ")})
+
+		router := newRouterWith(c)
+		w := put(router, "/api/v2/files/"+u.GetId(), "bytes 6-10/11", "world")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		b, _ := os.ReadFile(filepath.Join(dir, "v2-upload-"+u.GetId()))
+		assert.Equal(t, "hello world", string(b))
+	})
+}
+
+func TestGRPCCancelUpload(t *testing.T) {
+	dir := t.TempDir()
+	client := newClient(t, v2.NewController(v2.NewStore(), v2.WithUploadDir(dir)))
+	u, _ := client.CreateUpload(context.Background(), &uploadpb.CreateUploadRequest{})
+
+	_, err := client.CancelUpload(context.Background(), &uploadpb.CancelUploadRequest{Id: u.GetId()})
+
+	assert.NoError(t, err)
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries)
+	_, err = client.GetUpload(context.Background(), &uploadpb.GetUploadRequest{Id: u.GetId()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
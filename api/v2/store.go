@@ -0,0 +1,129 @@
+package v2
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrNotFound is returned by Store.Reserve for an upload which was
+	// removed.
+	ErrNotFound = errors.New("upload not found")
+	// ErrTenantQuotaExceeded is returned by Store.Create and Store.Reserve
+	// when the uploads of the tenant would take more than its quota.
+	ErrTenantQuotaExceeded = errors.New("tenant storage quota exceeded")
+	// ErrUserQuotaExceeded is returned by Store.Create and Store.Reserve
+	// when the uploads of the owner would take more than its quota.
+	ErrUserQuotaExceeded = errors.New("user storage quota exceeded")
+)
+
+// Quota limits the total size, in bytes, of the uploads a tenant and an
+// owner may keep at the same time. Zero means unlimited.
+type Quota struct {
+	Tenant uint64
+	User   uint64
+}
+
+type Store struct {
+	sync.RWMutex
+	files map[string]File
+}
+
+func NewStore() *Store {
+	return &Store{
+		files: make(map[string]File),
+	}
+}
+
+func (s *Store) Find(id string) (File, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	f, exists := s.files[id]
+	return f, exists
+}
+
+func (s *Store) Save(id string, f File) {
+	s.Lock()
+	defer s.Unlock()
+	s.files[id] = f
+}
+
+// Create saves the new upload f if it fits in q.
+func (s *Store) Create(f File, q Quota) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkQuota(f, q); err != nil {
+		return err
+	}
+	s.files[f.ID] = f
+	return nil
+}
+
+// Reserve saves the upload f, which must exist, if it fits in q. Uploads
+// already stored stay within a quota lowered since, as long as they don't
+// grow.
+func (s *Store) Reserve(f File, q Quota) error {
+	s.Lock()
+	defer s.Unlock()
+	prev, exists := s.files[f.ID]
+	if !exists {
+		return ErrNotFound
+	}
+	if f.StoredSize() > prev.StoredSize() {
+		if err := s.checkQuota(f, q); err != nil {
+			return err
+		}
+	}
+	s.files[f.ID] = f
+	return nil
+}
+
+// checkQuota checks f against q, counting the other uploads of its tenant
+// and of its owner. An upload whose length is unknown is refused once the
+// quota is exhausted, since its bytes are only counted as they are
+// received. The store must be locked.
+func (s *Store) checkQuota(f File, q Quota) error {
+	var tenantUsage, ownerUsage uint64
+	for _, other := range s.files {
+		if other.ID == f.ID {
+			continue
+		}
+		if other.Tenant == f.Tenant {
+			tenantUsage += other.StoredSize()
+		}
+		if other.Owner == f.Owner {
+			ownerUsage += other.StoredSize()
+		}
+	}
+	size := f.StoredSize()
+	if f.TotalSize < 0 {
+		size = max(size, 1)
+	}
+	if q.Tenant > 0 && tenantUsage+size > q.Tenant {
+		return ErrTenantQuotaExceeded
+	}
+	if q.User > 0 && f.Owner != "" && ownerUsage+size > q.User {
+		return ErrUserQuotaExceeded
+	}
+	return nil
+}
+
+// Expired returns the uploads whose session expired before they were
+// complete.
+func (s *Store) Expired() []File {
+	s.RLock()
+	defer s.RUnlock()
+	var files []File
+	for _, f := range s.files {
+		if f.IsExpired() {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (s *Store) Delete(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.files, id)
+}
@@ -1,23 +1,50 @@
 package v3
 
 import (
+	"archive/zip"
+	"bufio"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"maps"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/bufpool"
+	"github.com/imrenagi/go-http-upload/cdn"
+	"github.com/imrenagi/go-http-upload/directio"
+	"github.com/imrenagi/go-http-upload/diskusage"
+	"github.com/imrenagi/go-http-upload/finalize"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/metrics"
+	"github.com/imrenagi/go-http-upload/minrate"
+	"github.com/imrenagi/go-http-upload/netguard"
+	"github.com/imrenagi/go-http-upload/pipeline"
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/imrenagi/go-http-upload/thumbnail"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
 )
 
 const (
@@ -35,8 +62,19 @@ const (
 	UploadExpiresHeader     = "Upload-Expires"
 	UploadChecksumHeader    = "Upload-Checksum"
 	ContentTypeHeader       = "Content-Type"
+	// CDNURLHeader carries the CDN signed URL of an upload in the response
+	// of the request completing it.
+	CDNURLHeader = "CDN-URL"
+	// UploadFinalizationHeader carries the status of the finalization of
+	// an upload finalized in the background.
+	UploadFinalizationHeader = "Upload-Finalization"
+	// IdempotencyKeyHeader identifies a creation request, so that its
+	// retries answer the upload it created instead of creating another.
+	IdempotencyKeyHeader = "Idempotency-Key"
 
 	UploadMaxDuration = 10 * time.Minute
+
+	defaultCDNURLTTL = time.Hour
 )
 
 type Extension string
@@ -47,6 +85,9 @@ const (
 	ChecksumExtension      Extension = "checksum"
 	TerminationExtension   Extension = "termination"
 	ConcatenationExtension Extension = "concatenation"
+	// SparseExtension lets clients send the chunks of an upload in any
+	// order, see Controller.UploadChunk. It isn't part of the tus protocol.
+	SparseExtension Extension = "sparse"
 )
 
 type Extensions []Extension
@@ -69,11 +110,14 @@ func (e Extensions) String() string {
 }
 
 var (
-	defaultMaxSize             = uint64(0)
-	defaultSupportedExtensions = Extensions{
+	defaultMaxSize               = uint64(0)
+	defaultMinTransferRateWindow = 10 * time.Second
+	defaultUploadDir             = "/tmp"
+	defaultSupportedExtensions   = Extensions{
 		CreationExtension,
 		ExpirationExtension,
 		ChecksumExtension,
+		TerminationExtension,
 	}
 	SupportedTusVersion = []string{
 		"0.2.0",
@@ -86,8 +130,40 @@ var (
 )
 
 type Options struct {
-	Extensions Extensions
-	MaxSize    uint64
+	Extensions  Extensions
+	MaxSize     uint64
+	UploadDir   string
+	TenantQuota uint64
+	UserQuota   uint64
+	URLSigner   *auth.URLSigner
+	Thumbnails  *thumbnail.Worker
+	CDN         cdn.Signer
+	CDNURLTTL   time.Duration
+	Hooks       hooks.Hooks
+	Pipeline    *pipeline.Worker
+	ContentType *sniff.Policy
+	Dedup       bool
+	Importer    *http.Client
+	// ImportMaxSize limits the size of the uploads imported by Importer.
+	ImportMaxSize uint64
+	// ImportPrivate lets Importer fetch URLs of the private network.
+	ImportPrivate bool
+	DiskMonitor   *diskusage.Monitor
+	Finalizer     *finalize.Worker
+	// FinalizeMinSize is the size from which uploads are finalized by the
+	// Finalizer.
+	FinalizeMinSize uint64
+	// MinTransferRate, unless zero, is the rate in bytes per second below
+	// which the PATCH requests are aborted, measured every
+	// MinTransferRateWindow.
+	MinTransferRate       uint64
+	MinTransferRateWindow time.Duration
+	DirectIO              bool
+	Multipart             bool
+	MinPartSize           uint64
+	WebSocket             bool
+	WebSocketOrigins      []string
+	Logger                *zerolog.Logger
 }
 
 type Option func(*Options)
@@ -104,30 +180,395 @@ func WithMaxSize(size uint64) Option {
 	}
 }
 
+// WithUploadDir sets the directory the uploaded files are written to. The
+// files of each tenant are kept in their own sub directory.
+func WithUploadDir(dir string) Option {
+	return func(o *Options) {
+		o.UploadDir = dir
+	}
+}
+
+// WithTenantQuota limits the total size, in bytes, of the uploads a tenant
+// may keep at the same time. Zero means unlimited.
+func WithTenantQuota(size uint64) Option {
+	return func(o *Options) {
+		o.TenantQuota = size
+	}
+}
+
+// WithUserQuota limits the total size, in bytes, of the uploads an
+// authenticated principal may keep at the same time. Zero means unlimited.
+func WithUserQuota(size uint64) Option {
+	return func(o *Options) {
+		o.UserQuota = size
+	}
+}
+
+// WithURLSigner enables the issuance of signed download URLs. The signer
+// must also authenticate the requests made to the download endpoint.
+func WithURLSigner(signer *auth.URLSigner) Option {
+	return func(o *Options) {
+		o.URLSigner = signer
+	}
+}
+
+// WithThumbnails generates thumbnails of completed image uploads with the
+// given worker.
+func WithThumbnails(w *thumbnail.Worker) Option {
+	return func(o *Options) {
+		o.Thumbnails = w
+	}
+}
+
+// WithCDN signs a URL of every completed upload with signer, valid for ttl
+// or an hour when zero, so that clients can download it from the CDN whose
+// origin serves the upload directory.
+func WithCDN(signer cdn.Signer, ttl time.Duration) Option {
+	return func(o *Options) {
+		o.CDN = signer
+		if ttl > 0 {
+			o.CDNURLTTL = ttl
+		}
+	}
+}
+
+// WithLogger logs with l instead of the global logger. Use
+// logging.FromSlog to log with a *slog.Logger.
+func WithLogger(l *zerolog.Logger) Option {
+	return func(o *Options) {
+		if l != nil {
+			o.Logger = l
+		}
+	}
+}
+
+// WithHooks calls h at every step of the lifecycle of the uploads.
+func WithHooks(h hooks.Hooks) Option {
+	return func(o *Options) {
+		if h != nil {
+			o.Hooks = h
+		}
+	}
+}
+
+// WithPipeline post-processes completed uploads with the given worker. The
+// status of every step is recorded in the upload.
+func WithPipeline(w *pipeline.Worker) Option {
+	return func(o *Options) {
+		o.Pipeline = w
+	}
+}
+
+// WithContentTypePolicy restricts the content types of the uploads. The
+// declared content type is checked on creation, and the one detected from
+// the first bytes before they are written. A nil policy enforces nothing.
+func WithContentTypePolicy(p *sniff.Policy) Option {
+	return func(o *Options) {
+		o.ContentType = p
+	}
+}
+
+// WithDedup answers creation requests whose checksum metadata gives the
+// sha256 of a completed upload of the same owner with that upload, so that
+// the same content isn't sent twice.
+func WithDedup(enabled bool) Option {
+	return func(o *Options) {
+		o.Dedup = enabled
+	}
+}
+
+// WithURLImport enables the import of uploads from URLs, fetched with
+// client, up to maxSize bytes, which is required. The URLs and their
+// redirects to the private network are refused, which netguard.NewClient
+// also checks on every connection, and the client must bound the duration
+// of the imports.
+func WithURLImport(client *http.Client, maxSize uint64) Option {
+	return func(o *Options) {
+		o.Importer = client
+		o.ImportMaxSize = maxSize
+	}
+}
+
+// WithPrivateImports lets the URLs imported resolve to the private network,
+// e.g. for sources of an intranet.
+func WithPrivateImports(allowed bool) Option {
+	return func(o *Options) {
+		o.ImportPrivate = allowed
+	}
+}
+
+// WithDiskMonitor refuses the creation of uploads with a 507 while m
+// reports the upload directory is past its threshold.
+func WithDiskMonitor(m *diskusage.Monitor) Option {
+	return func(o *Options) {
+		o.DiskMonitor = m
+	}
+}
+
+// WithFinalizer finalizes the uploads of at least minSize bytes with w, so
+// that the request completing them is answered once their data is stored.
+// The status of their finalization is reported by HEAD and metadata
+// requests.
+func WithFinalizer(w *finalize.Worker, minSize uint64) Option {
+	return func(o *Options) {
+		o.Finalizer = w
+		o.FinalizeMinSize = minSize
+	}
+}
+
+// WithSparseUploads enables the sparse extension, whose chunks may be sent
+// in any order.
+func WithSparseUploads(enabled bool) Option {
+	return func(o *Options) {
+		if enabled && !o.Extensions.Enabled(SparseExtension) {
+			o.Extensions = append(slices.Clone(o.Extensions), SparseExtension)
+		}
+	}
+}
+
+// WithMultipart enables the multipart upload API when enabled. Its parts
+// but the last must be at least minPartSize bytes, DefaultMinPartSize when
+// zero.
+func WithMultipart(minPartSize uint64, enabled bool) Option {
+	return func(o *Options) {
+		o.Multipart = enabled
+		o.MinPartSize = minPartSize
+		if minPartSize == 0 {
+			o.MinPartSize = DefaultMinPartSize
+		}
+	}
+}
+
+// WithWebSocket lets the clients send the chunks of their uploads over a
+// WebSocket when enabled, see Controller.UploadWebSocket.
+func WithWebSocket(enabled bool) Option {
+	return func(o *Options) {
+		o.WebSocket = enabled
+	}
+}
+
+// WithWebSocketOrigins lets the pages of the given origins, e.g.
+// https://app.example.com, upload over a WebSocket besides the pages of the
+// host of the server.
+func WithWebSocketOrigins(origins ...string) Option {
+	return func(o *Options) {
+		o.WebSocketOrigins = origins
+	}
+}
+
+// WithDirectIO writes the chunks of PATCH requests bypassing the page cache
+// when enabled, so that large uploads don't evict the cache of the host. It
+// falls back to buffered writes when the file system doesn't support direct
+// I/O, or when a chunk starts at an offset not aligned on
+// directio.BlockSize.
+func WithDirectIO(enabled bool) Option {
+	return func(o *Options) {
+		o.DirectIO = enabled
+	}
+}
+
+// WithMinTransferRate aborts with a 408 the PATCH requests whose body is
+// received slower than rate bytes per second over window, 10 seconds when
+// zero. The bytes received until then are kept, so that the client resumes
+// the upload from them.
+func WithMinTransferRate(rate uint64, window time.Duration) Option {
+	return func(o *Options) {
+		o.MinTransferRate = rate
+		o.MinTransferRateWindow = window
+		if window <= 0 {
+			o.MinTransferRateWindow = defaultMinTransferRateWindow
+		}
+	}
+}
+
 func NewController(s Storage, opts ...Option) Controller {
 	o := Options{
 		Extensions: defaultSupportedExtensions,
 		MaxSize:    defaultMaxSize,
+		UploadDir:  defaultUploadDir,
+		CDNURLTTL:  defaultCDNURLTTL,
+		Hooks:      hooks.Nop{},
+		Logger:     &log.Logger,
 	}
 	for _, opt := range opts {
 		opt(&o)
 	}
+	rec := metrics.New(otel.GetMeterProvider(), "v3", "disk")
+	if oc, ok := s.(OpenCounter); ok {
+		if err := rec.ObserveOpen(oc.OpenUploads); err != nil {
+			o.Logger.Warn().Err(err).Msg("unable to observe the open uploads")
+		}
+	}
+
 	return Controller{
-		store:      s,
-		extensions: o.Extensions,
-		maxSize:    o.MaxSize,
+		store:            s,
+		extensions:       o.Extensions,
+		maxSize:          o.MaxSize,
+		uploadDir:        o.UploadDir,
+		quota:            Quota{Tenant: o.TenantQuota, User: o.UserQuota},
+		signer:           o.URLSigner,
+		thumbnails:       o.Thumbnails,
+		cdn:              o.CDN,
+		cdnURLTTL:        o.CDNURLTTL,
+		hooks:            o.Hooks,
+		pipeline:         o.Pipeline,
+		contentType:      o.ContentType,
+		dedup:            o.Dedup,
+		importer:         o.Importer,
+		importMaxSize:    o.ImportMaxSize,
+		importPrivate:    o.ImportPrivate,
+		disk:             o.DiskMonitor,
+		finalizer:        o.Finalizer,
+		finalizeMin:      o.FinalizeMinSize,
+		minRate:          o.MinTransferRate,
+		minRateWindow:    o.MinTransferRateWindow,
+		directIO:         o.DirectIO,
+		multipart:        o.Multipart,
+		minPartSize:      o.MinPartSize,
+		webSocket:        o.WebSocket,
+		webSocketOrigins: o.WebSocketOrigins,
+		creations:        &keyLocks{locks: make(map[string]*keyLock)},
+		metrics:          rec,
+		log:              o.Logger,
 	}
 }
 
 type Storage interface {
 	Find(id string) (File, bool, error)
 	Save(id string, f File)
+	// Update applies fn to the upload id and saves it, atomically with the
+	// other updates, so that concurrent changes of different fields of the
+	// upload aren't lost. Nothing is saved when fn fails, whose error is
+	// returned, or when the upload doesn't exist, which returns ErrNotFound.
+	Update(id string, fn func(f *File) error) (File, error)
+	// Create saves the new upload f unless the uploads of its tenant or of
+	// its owner would then take more than q, which returns
+	// ErrTenantQuotaExceeded or ErrUserQuotaExceeded. The check is atomic
+	// with the other reservations.
+	Create(f File, q Quota) error
+	// Reserve applies fn to the upload id like Update, unless the uploads
+	// of its tenant or of its owner would then take more than q, as with
+	// Create.
+	Reserve(id string, q Quota, fn func(f *File) error) (File, error)
+	Delete(id string) error
+	// Usage returns the total stored size of the uploads owned by tenant.
+	Usage(tenant string) (uint64, error)
+	// OwnerUsage returns the total stored size of the uploads created by
+	// owner.
+	OwnerUsage(owner string) (uint64, error)
+	// FindByOwner returns every upload created by owner.
+	FindByOwner(owner string) ([]File, error)
+	// List returns a page of the uploads matching q ordered by id, and the
+	// cursor of the next page, empty on the last one.
+	List(q ListQuery) ([]File, string, error)
+}
+
+// OpenCounter is implemented by the storages able to count the uploads
+// neither complete nor expired, exposed as the uploader_open_uploads gauge.
+type OpenCounter interface {
+	OpenUploads() int
+}
+
+// ListQuery filters the uploads returned by Storage.List. Empty fields
+// match every upload, except Tenant which always has to match.
+type ListQuery struct {
+	Tenant string
+	Owner  string
+	Status string
+	Tag    string
+	ETag   string
+	// IdempotencyKey matches the uploads created with this key.
+	IdempotencyKey string
+	// Cursor is the id after which the page starts.
+	Cursor string
+	Limit  int
+}
+
+// Match reports whether f satisfies the filters of the query, ignoring its
+// cursor and limit.
+func (q ListQuery) Match(f File) bool {
+	if f.Tenant != q.Tenant {
+		return false
+	}
+	if q.Owner != "" && f.Owner != q.Owner {
+		return false
+	}
+	if q.Tag != "" && f.Tag != q.Tag {
+		return false
+	}
+	if q.ETag != "" && f.ETag != q.ETag {
+		return false
+	}
+	if q.IdempotencyKey != "" && f.IdempotencyKey != q.IdempotencyKey {
+		return false
+	}
+	return q.Status == "" || f.Status() == q.Status
 }
 
 type Controller struct {
-	store      Storage
-	extensions Extensions
-	maxSize    uint64
+	store            Storage
+	extensions       Extensions
+	maxSize          uint64
+	uploadDir        string
+	quota            Quota
+	signer           *auth.URLSigner
+	thumbnails       *thumbnail.Worker
+	cdn              cdn.Signer
+	cdnURLTTL        time.Duration
+	hooks            hooks.Hooks
+	pipeline         *pipeline.Worker
+	contentType      *sniff.Policy
+	dedup            bool
+	importer         *http.Client
+	importMaxSize    uint64
+	importPrivate    bool
+	disk             *diskusage.Monitor
+	finalizer        *finalize.Worker
+	finalizeMin      uint64
+	minRate          uint64
+	minRateWindow    time.Duration
+	directIO         bool
+	multipart        bool
+	minPartSize      uint64
+	webSocket        bool
+	webSocketOrigins []string
+	creations        *keyLocks
+	metrics          *metrics.Recorder
+	log              *zerolog.Logger
+}
+
+// find looks up an upload on behalf of the tenant of the request. Uploads of
+// other tenants are reported as not found so their ids can't be probed.
+func (c *Controller) find(r *http.Request, id string) (File, bool, error) {
+	fm, ok, err := c.store.Find(id)
+	if err != nil || !ok {
+		return fm, ok, err
+	}
+	if fm.Tenant != auth.TenantFromContext(r.Context()) {
+		return File{}, false, nil
+	}
+	return fm, true, nil
+}
+
+// logger returns the logger of the request handled with ctx, which carries
+// its request id, or the logger of the controller.
+func (c *Controller) logger(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return c.log
+}
+
+// withUpload adds the id, owner and tenant of fm to the fields of l, and
+// returns r carrying the new logger, so that every line logged while
+// handling r can be told apart by upload.
+func withUpload(r *http.Request, l *zerolog.Logger, fm File) (*http.Request, *zerolog.Logger) {
+	ul := l.With().
+		Str("file_id", fm.ID).
+		Str("owner", fm.Owner).
+		Str("tenant", fm.Tenant).
+		Logger()
+	return r.WithContext(ul.WithContext(r.Context())), &ul
 }
 
 func TusResumableHeaderCheck(next http.Handler) http.Handler {
@@ -181,16 +622,20 @@ func (c *Controller) GetConfig() http.HandlerFunc {
 		if c.extensions.Enabled(ChecksumExtension) {
 			w.Header().Add(TusChecksumAlgorithmHeader, strings.Join(SupportedChecksumAlgorithms, ","))
 		}
+		if c.extensions.Enabled(SparseExtension) {
+			w.Header().Add(UploadBlockSizeHeader, fmt.Sprint(SparseBlockSize))
+		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 func (c *Controller) GetOffset() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
 		vars := mux.Vars(r)
 		fileID := vars["file_id"]
 		log.Debug().Str("file_id", fileID).Msg("Check request path and query")
-		fm, ok, err := c.store.Find(fileID)
+		fm, ok, err := c.find(r, fileID)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			w.Write([]byte("File not found"))
@@ -200,19 +645,37 @@ func (c *Controller) GetOffset() http.HandlerFunc {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		r, log = withUpload(r, log, fm)
+		if !auth.CanAccess(r.Context(), fm.Owner) {
+			log.Debug().Msg("principal is not the owner of the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
 
-		w.Header().Add(UploadOffsetHeader, fmt.Sprint(fm.UploadedSize))
+		w.Header().Add(UploadOffsetHeader, strconv.FormatUint(fm.UploadedSize, 10))
 		if !fm.IsDeferLength {
-			w.Header().Add(UploadLengthHeader, fmt.Sprint(fm.TotalSize))
+			w.Header().Add(UploadLengthHeader, strconv.FormatUint(fm.TotalSize, 10))
 		}
 
+		if fm.Received != nil {
+			w.Header().Set(UploadReceivedRangesHeader, fm.Received.ranges(fm.TotalSize))
+		}
+		if fm.Finalization != "" {
+			w.Header().Set(UploadFinalizationHeader, string(fm.Finalization))
+		}
+		// the content of a complete upload can be verified by the client.
+		if fm.ETag != "" {
+			w.Header().Set("ETag", fm.ETag)
+		}
 		w.Header().Add("Cache-Control", "no-store")
 		if !fm.ExpiresAt.IsZero() {
 			w.Header().Add(UploadExpiresHeader, uploadExpiresAt(fm.ExpiresAt))
 		}
 
 		if !fm.ExpiresAt.IsZero() && fm.ExpiresAt.Before(time.Now()) {
-			log.Debug().Str("file_id", fileID).Msg("file expired")
+			log.Debug().Msg("file expired")
+			c.hooks.PostExpire(r.Context(), fm.hookUpload())
+			c.metrics.Failed(r.Context(), metrics.ReasonExpired)
 			writeError(w, http.StatusGone, errors.New("file expired"))
 			return
 		}
@@ -243,23 +706,46 @@ type checksum struct {
 	Value     string
 }
 
+// matches reports whether the hex encoded sum of h is the value of the
+// checksum, without allocating.
+func (c checksum) matches(h hash.Hash) bool {
+	var sum [sha1.Size]byte
+	var encoded [2 * sha1.Size]byte
+	b := h.Sum(sum[:0])
+	return hex.Encode(encoded[:], b) == len(c.Value) && string(encoded[:len(c.Value)]) == c.Value
+}
+
+// hashers pools the hashes of the checksum algorithms, so that every chunk
+// doesn't allocate its own.
+var hashers = map[string]*sync.Pool{
+	"md5":  {New: func() any { return md5.New() }},
+	"sha1": {New: func() any { return sha1.New() }},
+}
+
+// getHash returns a hash of algorithm from the pool, nil when the algorithm
+// isn't supported.
+func getHash(algorithm string) hash.Hash {
+	p, ok := hashers[algorithm]
+	if !ok {
+		return nil
+	}
+	return p.Get().(hash.Hash)
+}
+
+// putHash resets h and puts it back in the pool of algorithm.
+func putHash(algorithm string, h hash.Hash) {
+	h.Reset()
+	hashers[algorithm].Put(h)
+}
+
+// errChunkTooLarge rejects the chunks exceeding the length of their upload.
+var errChunkTooLarge = errors.New("chunk exceeds the upload length")
+
 func (c *Controller) ResumeUpload() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		defer c.metrics.InFlight(r.Context())()
 		r.Body = http.MaxBytesReader(w, r.Body, 64<<20) //64MB
-		doneCh := make(chan struct{})
-		defer close(doneCh)
-
-		go func() {
-			select {
-			case <-doneCh:
-				log.Info().Msg("Upload completed")
-				return
-			case <-r.Context().Done():
-				log.Warn().Err(r.Context().Err()).Msg("Upload canceled")
-				return
-			}
-		}()
-
 		// r.Body = http.MaxBytesReader(w, r.Body, 10<<20) //10MB
 		vars := mux.Vars(r)
 		fileID := vars["file_id"]
@@ -267,7 +753,7 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 		contentType := r.Header.Get(ContentTypeHeader)
 		if contentType != "application/offset+octet-stream" {
 			log.Debug().Str("content_type", contentType).Msg("Invalid Content-Type")
-			writeError(w, http.StatusUnsupportedMediaType, errors.New("invalid Content-Type header: expected application/offset+octet-stream"))
+			rejectChunk(w, r, http.StatusUnsupportedMediaType, errors.New("invalid Content-Type header: expected application/offset+octet-stream"))
 			return
 		}
 
@@ -277,25 +763,55 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 			checksum, err = newChecksum(r.Header.Get(UploadChecksumHeader))
 			if err != nil {
 				log.Debug().Err(err).Msg("Invalid checksum header")
-				writeError(w, http.StatusBadRequest, err)
+				rejectChunk(w, r, http.StatusBadRequest, err)
 				return
 			}
 		}
 
-		fm, ok, err := c.store.Find(fileID)
+		fm, ok, err := c.find(r, fileID)
 		if !ok {
 			log.Debug().Str("file_id", fileID).Msg("file not found")
-			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			rejectChunk(w, r, http.StatusNotFound, errors.New("file not found"))
 			return
 		}
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			rejectChunk(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		// the request context and the logger are passed once final, the
+		// handler reassigns r and log.
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		go func(ctx context.Context, log *zerolog.Logger) {
+			select {
+			case <-doneCh:
+				log.Info().Msg("Upload completed")
+			case <-ctx.Done():
+				log.Warn().Err(ctx.Err()).Msg("Upload canceled")
+			}
+		}(r.Context(), log)
+		if !auth.CanAccess(r.Context(), fm.Owner) {
+			log.Debug().Msg("principal is not the owner of the file")
+			rejectChunk(w, r, http.StatusForbidden, auth.ErrForbidden)
 			return
 		}
 
 		if c.extensions.Enabled(ExpirationExtension) && fm.ExpiresAt.Before(time.Now()) {
-			log.Debug().Str("file_id", fileID).Msg("file expired")
-			writeError(w, http.StatusGone, errors.New("file expired"))
+			log.Debug().Msg("file expired")
+			c.hooks.PostExpire(r.Context(), fm.hookUpload())
+			c.metrics.Failed(r.Context(), metrics.ReasonExpired)
+			rejectChunk(w, r, http.StatusGone, errors.New("file expired"))
+			return
+		}
+
+		if fm.Received != nil {
+			rejectChunk(w, r, http.StatusConflict, errors.New("the upload was started with sparse chunks"))
+			return
+		}
+		if fm.Parts != nil {
+			rejectChunk(w, r, http.StatusConflict, errors.New("the upload is a multipart upload"))
 			return
 		}
 
@@ -305,7 +821,7 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 			log.Debug().Err(err).
 				Str("upload_offset", uploadOffset).
 				Msg("Invalid Upload-Offset header: not a number")
-			writeError(w, http.StatusBadRequest, errors.New("invalid Upload-Offset header: not a number"))
+			rejectChunk(w, r, http.StatusBadRequest, errors.New("invalid Upload-Offset header: not a number"))
 			return
 		}
 
@@ -315,13 +831,54 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 
 		if offset != fm.UploadedSize {
 			log.Warn().Msg("upload-Offset header does not match the current offset")
-			writeError(w, http.StatusConflict, errors.New("upload-Offset header does not match the current offset"))
+			c.metrics.Failed(r.Context(), metrics.ReasonOffsetConflict)
+			rejectChunk(w, r, http.StatusConflict, errors.New("upload-Offset header does not match the current offset"))
 			return
 		}
+		if !fm.IsDeferLength {
+			// a chunk can't write past the length of the upload, which the
+			// limits of the credentials were checked against.
+			remaining := int64(fm.TotalSize - offset)
+			if r.ContentLength > remaining {
+				rejectChunk(w, r, http.StatusRequestEntityTooLarge, errChunkTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, remaining)
+		}
+		defer c.limitRate(w, r)()
+
+		if c.contentType != nil && fm.UploadedSize < sniff.Len {
+			// sniff the first bytes of the upload before the chunk which
+			// completes them is written.
+			br := bufio.NewReaderSize(r.Body, sniff.Len)
+			chunk, _ := br.Peek(sniff.Len - int(fm.UploadedSize))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{br, r.Body}
+			head, complete, err := uploadHead(fm, chunk)
+			if err != nil {
+				log.Error().Err(err).Msg("error reading the head of the file")
+				c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+				rejectChunk(w, r, http.StatusInternalServerError, errors.New("error reading the file"))
+				return
+			}
+			if complete {
+				fm.SniffedContentType = sniff.Detect(head)
+				mismatch, err := c.contentType.Check(fm.ContentType, fm.SniffedContentType)
+				if err != nil {
+					log.Debug().Err(err).Msg("content type rejected")
+					rejectChunk(w, r, http.StatusUnsupportedMediaType, err)
+					return
+				}
+				fm.ContentTypeMismatch = mismatch
+			}
+		}
 
-		f, err := os.OpenFile(fm.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		f, err := os.OpenFile(fm.FilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			log.Error().Err(err).Msg("error opening the file")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
 			writeError(w, http.StatusBadRequest, errors.New("error opening the file"))
 			return
 		}
@@ -332,33 +889,49 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 		originalPos, err := f.Seek(0, io.SeekEnd)
 		if err != nil {
 			log.Error().Err(err).Msg("error getting file position")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
 			writeError(w, http.StatusInternalServerError, errors.New("error preparing file"))
 			return
 		}
 
+		start := time.Now()
 		var n int64
 		if c.extensions.Enabled(ChecksumExtension) && checksum.Algorithm != "" {
-			var hash hash.Hash
-			switch checksum.Algorithm {
-			case "md5":
-				hash = md5.New()
-			case "sha1":
-				hash = sha1.New()
-			default:
+			hash := getHash(checksum.Algorithm)
+			if hash == nil {
 				writeError(w, http.StatusBadRequest, errors.New("unsupported checksum algorithm"))
 				return
 			}
+			defer putHash(checksum.Algorithm, hash)
 
 			log.Debug().Msg("write the data to the file")
 
+			// the chunk is hashed as it is written, so that verifying its
+			// checksum doesn't keep a copy of it in memory.
 			reader := io.TeeReader(r.Body, hash)
-			n, err = io.Copy(f, reader)
+			n, err = c.writeChunk(r.Context(), fm.ID, offset, f, originalPos, reader)
 			if err != nil {
 				// Revert to original position on error
 				f.Seek(originalPos, io.SeekStart)
 				f.Truncate(originalPos) // Ensure file is truncated to original size
 
+				// the checksum covers the whole chunk, the client sends it
+				// again from the offset it was sent at.
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) && !fm.IsDeferLength {
+					writeError(w, http.StatusRequestEntityTooLarge, errChunkTooLarge)
+					return
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					log.Warn().Err(err).Msg("network timeout while writing file")
+					c.metrics.Failed(r.Context(), metrics.ReasonTimeout)
+					writeError(w, http.StatusRequestTimeout, fmt.Errorf("network timeout: %w", err))
+					return
+				}
+
 				log.Error().Err(err).Msg("error writing file")
+				c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
 				writeError(w, http.StatusInternalServerError, errors.New("error writing file"))
 				return
 			}
@@ -372,24 +945,42 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 
 			log.Debug().Msg("validate the checksum")
 
-			calculatedHash := hex.EncodeToString(hash.Sum(nil))
-			if calculatedHash != checksum.Value {
+			if !checksum.matches(hash) {
 				// Revert to original position if checksum fails
 				f.Seek(originalPos, io.SeekStart)
 				f.Truncate(originalPos) // Ensure file is truncated to original size
 				log.Debug().Msg("Checksum mismatch")
+				c.metrics.Failed(r.Context(), metrics.ReasonChecksumMismatch)
 				writeError(w, 460, errors.New("checksum mismatch"))
 				return
 			}
 
 			fm.UploadedSize += uint64(n)
-			c.store.Save(fm.ID, fm)
+			c.metrics.Received(r.Context(), n)
+			err = c.saveReceived(fm)
 		} else {
-			n, err = io.Copy(f, r.Body)
+			if sc := c.spliceChunk(w, r, fm.ID, offset, f, originalPos); sc != nil {
+				defer sc.done()
+				w = sc.w
+				n, err = sc.n, sc.err
+			} else {
+				n, err = c.writeChunk(r.Context(), fm.ID, offset, f, originalPos, r.Body)
+			}
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) && !fm.IsDeferLength {
+				// the chunk is rejected whole rather than cut at the length
+				// of the upload.
+				f.Truncate(originalPos)
+				writeError(w, http.StatusRequestEntityTooLarge, errChunkTooLarge)
+				return
+			}
 			if err != nil {
 
 				fm.UploadedSize += uint64(n)
-				c.store.Save(fm.ID, fm)
+				c.metrics.Received(r.Context(), n)
+				if c.saveReceived(fm) != nil {
+					f.Truncate(originalPos)
+				}
 
 				log.Info().
 					Int64("written_size", n).
@@ -398,16 +989,33 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 				var netErr net.Error
 				if errors.As(err, &netErr) && netErr.Timeout() {
 					log.Warn().Err(err).Msg("network timeout while writing file")
+					c.metrics.Failed(r.Context(), metrics.ReasonTimeout)
 					writeError(w, http.StatusRequestTimeout, fmt.Errorf("network timeout: %w", err))
 					return
 				}
 
 				log.Error().Err(err).Msg("error writing the file")
+				c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
 				writeError(w, http.StatusInternalServerError, fmt.Errorf("error writing the file: %w", err))
 				return
 			}
 			fm.UploadedSize += uint64(n)
-			c.store.Save(fm.ID, fm)
+			c.metrics.Received(r.Context(), n)
+			err = c.saveReceived(fm)
+		}
+		if err != nil {
+			// the chunk isn't recorded, e.g. the upload was terminated
+			// meanwhile or its length is deferred and the quota exceeded.
+			f.Truncate(originalPos)
+			log.Debug().Err(err).Msg("chunk not recorded")
+			writeError(w, quotaStatus(err), err)
+			return
+		}
+		c.metrics.Chunk(r.Context(), n, time.Since(start))
+		c.hooks.PostReceiveChunk(r.Context(), fm.hookUpload())
+
+		if fm.IsComplete() {
+			c.finish(r.Context(), &fm)
 		}
 
 		log.Debug().
@@ -416,16 +1024,20 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 			Msg("File Uploaded")
 
 		log.Debug().Msg("prepare the response header")
-		w.Header().Add(UploadOffsetHeader, fmt.Sprint(fm.UploadedSize))
+		w.Header().Add(UploadOffsetHeader, strconv.FormatUint(fm.UploadedSize, 10))
 		if !fm.ExpiresAt.IsZero() {
 			w.Header().Add(UploadExpiresHeader, uploadExpiresAt(fm.ExpiresAt))
 		}
+		if fm.CDNURL != "" {
+			w.Header().Set(CDNURLHeader, fm.CDNURL)
+		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 func (c *Controller) CreateUpload() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
 		uploadDeferLength := r.Header.Get(UploadDeferLengthHeader)
 		if uploadDeferLength != "" && uploadDeferLength != "1" {
 			writeError(w, http.StatusBadRequest, errors.New("invalid Upload-Defer-Length header"))
@@ -452,16 +1064,100 @@ func (c *Controller) CreateUpload() http.HandlerFunc {
 			return
 		}
 
-		uploadMetadata := r.Header.Get(UploadMetadataHeader)
-		log.Debug().Str("upload_metadata", uploadMetadata).Msg("Check request header")
-
-		err := fm.ParseMetadata(uploadMetadata)
+		// the values of the metadata aren't logged, the logs would keep the
+		// filenames of the owners erased.
+		err := fm.ParseMetadata(r.Header.Get(UploadMetadataHeader))
 		if err != nil {
 			writeError(w, http.StatusBadRequest, err)
 			return
 		}
+		log.Debug().Strs("metadata_keys", slices.Sorted(maps.Keys(fm.Metadata))).Msg("Check request header")
+
+		if c.contentType != nil && !c.contentType.Allowed(fm.ContentType) {
+			log.Debug().Str("content_type", fm.ContentType).Msg("content type rejected")
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", sniff.ErrNotAllowed, fm.ContentType))
+			return
+		}
+
+		if p, ok := auth.FromContext(r.Context()); ok {
+			fm.Owner = p.Subject
+		}
+
+		fm.Tenant = auth.TenantFromContext(r.Context())
+		r, log = withUpload(r, log, fm)
+		if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+			// concurrent retries mustn't create an upload each, while the
+			// creations of other keys go on.
+			defer c.creations.lock(fm.Tenant, fm.Owner, key)()
+			prev, ok, err := c.findIdempotent(fm, key)
+			if err != nil {
+				log.Error().Err(err).Msg("error looking up the upload of the idempotency key")
+				writeError(w, http.StatusInternalServerError, errors.New("error looking up the upload of the idempotency key"))
+				return
+			}
+			if ok {
+				if prev.TotalSize != fm.TotalSize || prev.IsDeferLength != fm.IsDeferLength || !maps.Equal(prev.Metadata, fm.Metadata) {
+					log.Debug().Str("file_id", prev.ID).Msg("idempotency key reused for another upload")
+					writeError(w, http.StatusUnprocessableEntity, errors.New("idempotency key reused for another upload"))
+					return
+				}
+				log.Debug().Str("file_id", prev.ID).Msg("creation replayed")
+				w.Header().Add("Location", fmt.Sprintf("http://127.0.0.1:8080/files/%s", prev.ID))
+				w.Header().Add(UploadOffsetHeader, fmt.Sprint(prev.UploadedSize))
+				if !prev.ExpiresAt.IsZero() {
+					w.Header().Add(UploadExpiresHeader, uploadExpiresAt(prev.ExpiresAt))
+				}
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			fm.IdempotencyKey = key
+		}
+		if dup, ok := c.findDuplicate(fm); ok {
+			log.Debug().Str("file_id", dup.ID).Msg("upload deduplicated")
+			w.Header().Add("Location", fmt.Sprintf("http://127.0.0.1:8080/files/%s", dup.ID))
+			w.Header().Add(UploadOffsetHeader, fmt.Sprint(dup.UploadedSize))
+			w.Header().Add(UploadLengthHeader, fmt.Sprint(dup.TotalSize))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		if err := c.disk.CheckCreate(); err != nil {
+			log.Warn().Msg("upload rejected, the upload directory is past its disk usage threshold")
+			writeError(w, http.StatusInsufficientStorage, err)
+			return
+		}
+
+		if err := c.hooks.PreCreate(r.Context(), fm.hookUpload()); err != nil {
+			log.Debug().Err(err).Msg("upload rejected by the pre-create hook")
+			writeError(w, hooks.StatusCode(err), err)
+			return
+		}
+
+		dir := filepath.Join(c.uploadDir, fm.Tenant)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("error creating the upload directory")
+			writeError(w, http.StatusInternalServerError, errors.New("error creating the upload directory"))
+			return
+		}
+		fm.Path = filepath.Join(dir, "file-upload-"+fm.ID)
+		if !fm.IsDeferLength && fm.TotalSize == 0 {
+			fm.ETag = emptyETag
+			fm.Completion = fm.completion(emptyChecksums())
+		}
 
-		c.store.Save(fm.ID, fm)
+		// the quota is checked as the upload is stored, so that concurrent
+		// creations can't exceed it together.
+		if err := c.store.Create(fm, c.quota); err != nil {
+			log.Debug().Err(err).Msg("upload rejected by the quota")
+			writeError(w, quotaStatus(err), err)
+			return
+		}
+		c.hooks.PostCreate(r.Context(), fm.hookUpload())
+		c.metrics.Created(r.Context())
+		if fm.IsComplete() {
+			c.hooks.PostFinish(r.Context(), fm.hookUpload())
+			c.metrics.Completed(r.Context(), 0, time.Since(fm.CreatedAt))
+		}
 
 		w.Header().Add("Location", fmt.Sprintf("http://127.0.0.1:8080/files/%s", fm.ID))
 		if !fm.ExpiresAt.IsZero() {
@@ -471,12 +1167,1505 @@ func (c *Controller) CreateUpload() http.HandlerFunc {
 	}
 }
 
-func uploadExpiresAt(t time.Time) string {
-	return t.Format("Mon, 02 Jan 2006 15:04:05 GMT")
+func (c *Controller) Terminate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		if !c.extensions.Enabled(TerminationExtension) {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("termination extension is not enabled"))
+			return
+		}
+
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok, err := c.find(r, fileID)
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !auth.CanAccess(r.Context(), fm.Owner) {
+			log.Debug().Msg("principal is not the owner of the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		if err := os.Remove(fm.FilePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error().Err(err).Msg("error removing the file")
+			writeError(w, http.StatusInternalServerError, errors.New("error removing the file"))
+			return
+		}
+		c.removeThumbnails(fm)
+		removeParts(fm)
+		if err := c.store.Delete(fileID); err != nil {
+			log.Error().Err(err).Msg("error deleting the file metadata")
+			writeError(w, http.StatusInternalServerError, errors.New("error deleting the file metadata"))
+			return
+		}
+		c.hooks.PostTerminate(r.Context(), fm.hookUpload())
+
+		log.Debug().Msg("upload terminated")
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
 
-type cError struct {
-	Message string `json:"message"`
+// Download serves the data of a completed upload. Range requests are
+// supported so that clients can fetch large files in parts. Owners may
+// download their uploads; viewers may download every upload of their
+// tenant.
+//
+// The file is handed to http.ServeContent as is: net/http then copies it to
+// plain TCP connections with sendfile(2), so the data never goes through
+// userspace buffers. Wrapping the file, or the ResponseWriter without
+// keeping io.ReaderFrom, falls back to a buffered copy.
+func (c *Controller) Download() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok, err := c.find(r, fileID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !canDownload(r, fm.Owner) {
+			log.Debug().Msg("principal is not allowed to download the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if !fm.IsComplete() {
+			log.Debug().Msg("upload is not complete")
+			writeError(w, http.StatusConflict, errors.New("upload is not complete"))
+			return
+		}
+		if code, err := unservable(fm); err != nil {
+			log.Debug().Err(err).Msg("file can't be served")
+			writeError(w, code, err)
+			return
+		}
+
+		// empty uploads complete on creation, before any data is written.
+		var content io.ReadSeeker = strings.NewReader("")
+		var modTime time.Time
+		f, err := os.Open(fm.FilePath())
+		switch {
+		case err == nil:
+			defer f.Close()
+			content = f
+			if fi, err := f.Stat(); err == nil {
+				modTime = fi.ModTime()
+			}
+		case !errors.Is(err, os.ErrNotExist) || fm.TotalSize != 0:
+			log.Error().Err(err).Msg("error opening the file")
+			writeError(w, http.StatusInternalServerError, errors.New("error opening the file"))
+			return
+		}
+
+		if fm.ETag != "" {
+			w.Header().Set("ETag", fm.ETag)
+		}
+		setContentHeaders(w, fm.Name, fm.ContentType)
+		http.ServeContent(w, r, "", modTime, content)
+	}
+}
+
+type downloadURLRequest struct {
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type downloadURLResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssueDownloadURL returns a URL which lets anyone holding it download a
+// completed upload without credentials until it expires. It must be mounted
+// at the download path followed by /download-url.
+func (c *Controller) IssueDownloadURL() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		if c.signer == nil {
+			writeError(w, http.StatusNotImplemented, errors.New("signed download urls are not enabled"))
+			return
+		}
+
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok, err := c.find(r, fileID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !canDownload(r, fm.Owner) {
+			log.Debug().Msg("principal is not allowed to download the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if !fm.IsComplete() {
+			log.Debug().Msg("upload is not complete")
+			writeError(w, http.StatusConflict, errors.New("upload is not complete"))
+			return
+		}
+		if code, err := unservable(fm); err != nil {
+			log.Debug().Err(err).Msg("file can't be served")
+			writeError(w, code, err)
+			return
+		}
+
+		ttl, err := downloadURLTTL(w, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// the url acts on behalf of the owner so that it passes the same
+		// access checks as the owner downloading the file.
+		subject := fm.Owner
+		if subject == "" {
+			subject = "anonymous"
+		}
+		expiresAt := time.Now().Add(ttl)
+		signed, err := c.signer.Sign(downloadURL(r), auth.SignedURLClaims{
+			Subject:   subject,
+			Tenant:    fm.Tenant,
+			Methods:   []string{http.MethodGet},
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("unable to sign download url")
+			writeError(w, http.StatusInternalServerError, errors.New("unable to sign download url"))
+			return
+		}
+
+		b, _ := json.Marshal(downloadURLResponse{URL: signed, ExpiresAt: expiresAt.UTC()})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+const (
+	defaultDownloadURLTTL = 15 * time.Minute
+	maxDownloadURLTTL     = 24 * time.Hour
+)
+
+// downloadURLTTL returns the lifetime requested in the optional JSON body.
+func downloadURLTTL(w http.ResponseWriter, r *http.Request) (time.Duration, error) {
+	var req downloadURLRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, errors.New("invalid request body")
+	}
+	ttl := defaultDownloadURLTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > maxDownloadURLTTL {
+		return 0, fmt.Errorf("expires_in must not exceed %d seconds", int64(maxDownloadURLTTL.Seconds()))
+	}
+	return ttl, nil
+}
+
+// downloadURL returns the absolute URL of the download endpoint the
+// download-url request was made for.
+func downloadURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, strings.TrimSuffix(r.URL.Path, "/download-url"))
+}
+
+// emptyETag is the entity tag of empty uploads, which complete on creation.
+var emptyETag = `"` + hex.EncodeToString(sha256.New().Sum(nil)) + `"`
+
+// emptyChecksums returns the checksums of empty uploads.
+func emptyChecksums() map[string]string {
+	sums := make(map[string]string, len(checksumAlgorithms))
+	for algorithm, newHash := range checksumAlgorithms {
+		sums[algorithm] = base64.StdEncoding.EncodeToString(newHash().Sum(nil))
+	}
+	return sums
+}
+
+// checksumAlgorithms are the algorithms of the checksums recorded in the
+// completion of the uploads.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// fileChecksums returns the base64 encoded digests of the content of the
+// file at path for every checksumAlgorithms, reading it once.
+func fileChecksums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hs := make(map[string]hash.Hash, len(checksumAlgorithms))
+	ws := make([]io.Writer, 0, len(checksumAlgorithms))
+	for algorithm, newHash := range checksumAlgorithms {
+		h := newHash()
+		hs[algorithm] = h
+		ws = append(ws, h)
+	}
+	if _, err := io.Copy(io.MultiWriter(ws...), f); err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string, len(hs))
+	for algorithm, h := range hs {
+		sums[algorithm] = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// checksumsETag returns a strong entity tag derived from the SHA-256
+// checksum in sums.
+func checksumsETag(sums map[string]string) string {
+	sum, _ := base64.StdEncoding.DecodeString(sums["sha256"])
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+type importRequest struct {
+	URL         string            `json:"url"`
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// ImportUpload creates an upload whose data the server fetches from the URL
+// given in the request, so that files hosted elsewhere don't go through the
+// client. It answers 202 once the upload is created; the fetch then runs in
+// the background and its progress is the offset of the upload, as if the
+// data was sent with PATCH requests. A failed fetch is recorded in the
+// upload.
+func (c *Controller) ImportUpload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		if c.importer == nil || c.importMaxSize == 0 {
+			writeError(w, http.StatusNotImplemented, errors.New("url imports are not enabled"))
+			return
+		}
+		if p, ok := auth.FromContext(r.Context()); ok && !p.HasRole(auth.RoleUploader) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		var req importRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+		src, err := url.Parse(req.URL)
+		if err != nil || (src.Scheme != "http" && src.Scheme != "https") || src.Host == "" {
+			writeError(w, http.StatusBadRequest, errors.New("url must be an absolute http or https url"))
+			return
+		}
+		if !c.importPrivate {
+			if err := netguard.CheckHost(r.Context(), src.Hostname()); err != nil {
+				log.Debug().Err(err).Str("host", src.Hostname()).Msg("import url rejected")
+				writeError(w, http.StatusBadRequest, errors.New("url must resolve to public addresses"))
+				return
+			}
+		}
+
+		fm := NewFile()
+		fm.ExpiresAt = time.Now().Add(UploadMaxDuration)
+		// the length is known once the source answers.
+		fm.IsDeferLength = true
+		fm.SourceURL = src.String()
+		fm.Name = req.Filename
+		if fm.Name == "" {
+			fm.Name = path.Base(src.Path)
+		}
+		fm.ContentType = req.ContentType
+		fm.Metadata = make(map[string]string, len(req.Metadata)+2)
+		for k, v := range req.Metadata {
+			fm.Metadata[k] = v
+		}
+		fm.Metadata["filename"] = fm.Name
+		fm.Metadata["content-type"] = fm.ContentType
+		fm.Checksum = fm.Metadata["checksum"]
+		fm.Tag = fm.Metadata["tag"]
+		if fm.ContentType != "" && c.contentType != nil && !c.contentType.Allowed(fm.ContentType) {
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", sniff.ErrNotAllowed, fm.ContentType))
+			return
+		}
+		if p, ok := auth.FromContext(r.Context()); ok {
+			fm.Owner = p.Subject
+			// the limits of the credentials are enforced by the fetch, the
+			// content type is the one they were issued for.
+			if p.ContentType != "" && fm.ContentType != p.ContentType {
+				writeError(w, http.StatusUnsupportedMediaType, auth.ErrContentTypeNotAllowed)
+				return
+			}
+		}
+		fm.Tenant = auth.TenantFromContext(r.Context())
+		r, log = withUpload(r, log, fm)
+		if err := c.disk.CheckCreate(); err != nil {
+			log.Warn().Msg("import rejected, the upload directory is past its disk usage threshold")
+			writeError(w, http.StatusInsufficientStorage, err)
+			return
+		}
+
+		if err := c.hooks.PreCreate(r.Context(), fm.hookUpload()); err != nil {
+			log.Debug().Err(err).Msg("upload rejected by the pre-create hook")
+			writeError(w, hooks.StatusCode(err), err)
+			return
+		}
+		dir := filepath.Join(c.uploadDir, fm.Tenant)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("error creating the upload directory")
+			writeError(w, http.StatusInternalServerError, errors.New("error creating the upload directory"))
+			return
+		}
+		fm.Path = filepath.Join(dir, "file-upload-"+fm.ID)
+
+		// the length isn't known yet, the import is refused once the quota
+		// is exhausted and stopped when it is exceeded.
+		if err := c.store.Create(fm, c.quota); err != nil {
+			log.Debug().Err(err).Msg("import rejected by the quota")
+			writeError(w, quotaStatus(err), err)
+			return
+		}
+		c.hooks.PostCreate(r.Context(), fm.hookUpload())
+		c.metrics.Created(r.Context())
+		// the import outlives the request.
+		go c.importURL(context.WithoutCancel(r.Context()), fm)
+
+		w.Header().Set("Location", fmt.Sprintf("http://127.0.0.1:8080/files/%s", fm.ID))
+		w.Header().Set(ContentTypeHeader, "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(newFileMetadataResponse(fm))
+	}
+}
+
+// importURL fetches the data of an imported upload, recording its progress
+// in the offset of the upload.
+func (c *Controller) importURL(ctx context.Context, fm File) {
+	log := c.logger(ctx)
+	if err := c.fetch(ctx, &fm); err != nil {
+		// the url, which may name the file, isn't logged.
+		logged := err
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			logged = uerr.Err
+		}
+		log.Warn().Err(logged).Str("file_id", fm.ID).Msg("error importing the upload")
+		c.store.Update(fm.ID, func(f *File) error {
+			f.ImportError = err.Error()
+			return nil
+		})
+		return
+	}
+	log.Debug().Str("file_id", fm.ID).Uint64("size", fm.UploadedSize).Msg("upload imported")
+	c.complete(ctx, &fm)
+}
+
+// fetch stores the data of the source of fm, within the maximum sizes of
+// the server and of the credentials of the principal importing it, whose
+// quota is charged with the data fetched.
+func (c *Controller) fetch(ctx context.Context, fm *File) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fm.SourceURL, nil)
+	if err != nil {
+		return err
+	}
+	client := *c.importer
+	if !c.importPrivate {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if err := netguard.CheckRedirect(req); err != nil {
+				return err
+			}
+			if c.importer.CheckRedirect != nil {
+				return c.importer.CheckRedirect(req, via)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("source responded with %d", resp.StatusCode)
+	}
+
+	maxSize := c.importMaxSize
+	if c.maxSize > 0 {
+		maxSize = min(maxSize, c.maxSize)
+	}
+	p, _ := auth.FromContext(ctx)
+	if p.MaxUploadSize > 0 {
+		maxSize = min(maxSize, p.MaxUploadSize)
+	}
+	if resp.ContentLength >= 0 {
+		if uint64(resp.ContentLength) > maxSize {
+			return errors.New("upload length exceeds the maximum size")
+		}
+		fm.IsDeferLength = false
+		fm.TotalSize = uint64(resp.ContentLength)
+	}
+	if fm.ContentType == "" {
+		fm.ContentType = resp.Header.Get(ContentTypeHeader)
+		if fm.ContentType != "" && c.contentType != nil && !c.contentType.Allowed(fm.ContentType) {
+			return fmt.Errorf("%w: %s", sniff.ErrNotAllowed, fm.ContentType)
+		}
+		fm.Metadata["content-type"] = fm.ContentType
+	}
+
+	var body io.Reader = io.LimitReader(resp.Body, int64(maxSize)+1)
+	if c.contentType != nil {
+		// sniff the first bytes before any of them is written.
+		br := bufio.NewReaderSize(body, sniff.Len)
+		head, _ := br.Peek(sniff.Len)
+		body = br
+		if len(head) > 0 {
+			fm.SniffedContentType = sniff.Detect(head)
+			mismatch, err := c.contentType.Check(fm.ContentType, fm.SniffedContentType)
+			if err != nil {
+				return err
+			}
+			fm.ContentTypeMismatch = mismatch
+		}
+	}
+	if err := c.saveFetched(*fm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fm.FilePath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := bufpool.Default.Get()
+	defer bufpool.Default.Put(b)
+	buf := *b
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			fm.UploadedSize += uint64(n)
+			c.metrics.Received(ctx, int64(n))
+			if fm.UploadedSize > maxSize {
+				return errors.New("upload length exceeds the maximum size")
+			}
+			if p.Meter != nil {
+				if err := p.Meter.Charge(uint64(n)); err != nil {
+					return err
+				}
+			}
+			if err := c.saveFetched(*fm); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+
+	if fm.IsDeferLength {
+		fm.IsDeferLength = false
+		fm.TotalSize = fm.UploadedSize
+		return c.saveFetched(*fm)
+	} else if fm.UploadedSize != fm.TotalSize {
+		return errors.New("source sent less data than announced")
+	}
+	return nil
+}
+
+// uploadHead returns the first bytes of the upload fm once chunk, the next
+// bytes it receives, is written: the bytes it holds followed by chunk, up to
+// sniff.Len. complete is false while they are fewer than sniff.Len and than
+// the length of the upload, since the content type can't be detected from a
+// part of its head.
+func uploadHead(fm File, chunk []byte) (head []byte, complete bool, err error) {
+	head = make([]byte, min(fm.UploadedSize, sniff.Len), sniff.Len)
+	if len(head) > 0 {
+		f, err := os.Open(fm.FilePath())
+		if err != nil {
+			return nil, false, err
+		}
+		defer f.Close()
+		if _, err := io.ReadFull(f, head); err != nil {
+			return nil, false, err
+		}
+	}
+	head = append(head, chunk[:min(len(chunk), sniff.Len-len(head))]...)
+	complete = len(head) == sniff.Len || (!fm.IsDeferLength && uint64(len(head)) >= fm.TotalSize)
+	return head, complete && len(head) > 0, nil
+}
+
+// saveFetched records the length, content types and bytes received of the
+// upload fm being imported, within the quotas. It fails with ErrNotFound
+// once the upload was terminated, which stops the import.
+func (c *Controller) saveFetched(fm File) error {
+	_, err := c.store.Reserve(fm.ID, c.quota, func(f *File) error {
+		f.IsDeferLength = fm.IsDeferLength
+		f.TotalSize = fm.TotalSize
+		f.ContentType = fm.ContentType
+		f.Metadata = fm.Metadata
+		f.UploadedSize = fm.UploadedSize
+		f.SniffedContentType = fm.SniffedContentType
+		f.ContentTypeMismatch = fm.ContentTypeMismatch
+		return nil
+	})
+	return err
+}
+
+// saveReceived records the bytes of fm received by a chunk and the content
+// type sniffed from its first bytes, leaving the fields updated in the
+// background untouched. The bytes of an upload whose length is deferred are
+// reserved in the quotas as they are received.
+func (c *Controller) saveReceived(fm File) error {
+	_, err := c.store.Reserve(fm.ID, c.quota, func(f *File) error {
+		f.UploadedSize = fm.UploadedSize
+		f.SniffedContentType = fm.SniffedContentType
+		f.ContentTypeMismatch = fm.ContentTypeMismatch
+		return nil
+	})
+	return err
+}
+
+// writeChunk appends a chunk of the upload fileID, starting at offset, to f
+// whose size is pos. The page cache is bypassed when direct I/O is enabled,
+// and the number of bytes stored in f returned.
+func (c *Controller) writeChunk(ctx context.Context, fileID string, offset uint64, f *os.File, pos int64, src io.Reader) (int64, error) {
+	if !c.directIO {
+		return copyChunk(ctx, fileID, offset, f, src)
+	}
+	w := directio.NewWriter(f, pos)
+	n, err := copyChunk(ctx, fileID, offset, w, src)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// the bytes buffered by w may not all be stored.
+		if st, serr := f.Stat(); serr == nil {
+			n = st.Size() - pos
+		}
+	}
+	return n, err
+}
+
+// limitRate makes the body of r fail with minrate.ErrTooSlow once it is
+// received below the minimum transfer rate. The read deadline of the
+// connection is expired too, so that a client sending nothing at all is
+// interrupted. The returned function stops measuring the rate.
+func (c *Controller) limitRate(w http.ResponseWriter, r *http.Request) func() {
+	if c.minRate == 0 {
+		return func() {}
+	}
+	rc := http.NewResponseController(w)
+	body := minrate.NewReader(r.Body, int64(c.minRate), c.minRateWindow, func() {
+		rc.SetReadDeadline(time.Now())
+	})
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, r.Body}
+	return func() { body.Close() }
+}
+
+// finish completes fm, in the background when it is large enough and a
+// finalizer is configured.
+func (c *Controller) finish(ctx context.Context, fm *File) {
+	if c.finalizer == nil || fm.TotalSize < c.finalizeMin {
+		c.complete(ctx, fm)
+		return
+	}
+	log := c.logger(ctx)
+	fm.Finalization = finalize.StatusPending
+	if _, err := c.store.Update(fm.ID, func(f *File) error {
+		f.Finalization = finalize.StatusPending
+		return nil
+	}); err != nil {
+		log.Debug().Err(err).Msg("upload removed before its finalization")
+		return
+	}
+	id := fm.ID
+	err := c.finalizer.Enqueue(finalize.Job{
+		ID: id,
+		Finalize: func(ctx context.Context) {
+			// the upload is finalized as stored now, unless it was
+			// terminated or erased while queued.
+			upload, err := c.store.Update(id, func(f *File) error {
+				f.Finalization = finalize.StatusRunning
+				return nil
+			})
+			if err != nil {
+				log.Debug().Err(err).Msg("upload removed before its finalization")
+				return
+			}
+			c.complete(log.WithContext(ctx), &upload)
+		},
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("finalizing the upload on the request path")
+		c.complete(ctx, fm)
+	}
+}
+
+// complete records the etag of an upload which received its last byte,
+// and hands it to the thumbnail worker and the pipeline.
+func (c *Controller) complete(ctx context.Context, fm *File) {
+	log := c.logger(ctx)
+	sums, err := fileChecksums(fm.FilePath())
+	if err != nil {
+		log.Error().Err(err).Str("file_id", fm.ID).Msg("error computing the checksums of the file")
+	} else {
+		fm.ETag = checksumsETag(sums)
+	}
+	if fm.Finalization != "" {
+		fm.Finalization = finalize.StatusSucceeded
+		if err != nil {
+			fm.Finalization = finalize.StatusFailed
+		}
+	}
+	fm.Completion = fm.completion(sums)
+	c.metrics.Completed(ctx, fm.TotalSize, fm.Completion.Duration)
+	if c.pipeline != nil {
+		// the upload is signed and announced once processed.
+		fm.Processing = c.pipeline.Steps()
+	} else {
+		c.signCDNURL(fm)
+	}
+	completed, err := c.store.Update(fm.ID, func(f *File) error {
+		f.ETag = fm.ETag
+		f.Finalization = fm.Finalization
+		f.Completion = fm.Completion
+		f.CDNURL = fm.CDNURL
+		f.CDNURLExpiresAt = fm.CDNURLExpiresAt
+		f.Processing = fm.Processing
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("file_id", fm.ID).Msg("error recording the completion of the upload")
+		return
+	}
+	*fm = completed
+	c.generateThumbnails(*fm)
+	if c.pipeline != nil {
+		// PostFinish waits for the pipeline, so that uploads which aren't
+		// served yet aren't announced.
+		c.postProcess(*fm)
+	} else {
+		c.hooks.PostFinish(ctx, fm.hookUpload())
+	}
+}
+
+// findDuplicate returns the completed upload of the owner of fm with the
+// content its checksum metadata announces. Only sha256 checksums are
+// trusted, since the etag of the uploads is their sha256.
+func (c *Controller) findDuplicate(fm File) (File, bool) {
+	if !c.dedup || fm.IsDeferLength {
+		return File{}, false
+	}
+	etag, ok := checksumETag(fm.Checksum)
+	if !ok {
+		return File{}, false
+	}
+	files, _, err := c.store.List(ListQuery{
+		Tenant: fm.Tenant,
+		Owner:  fm.Owner,
+		Status: StatusCompleted,
+		ETag:   etag,
+	})
+	if err != nil {
+		c.log.Error().Err(err).Msg("error looking up a duplicate upload")
+		return File{}, false
+	}
+	for _, f := range files {
+		// uploads of other owners aren't shared, so that their content
+		// can't be probed.
+		if _, err := unservable(f); f.Owner == fm.Owner && f.TotalSize == fm.TotalSize && err == nil {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+// keyLocks serializes the creations retried with the same idempotency key
+// by the same owner of the same tenant.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// waiters counts the creations holding or awaiting the lock, which is
+	// forgotten once there are none.
+	waiters int
+}
+
+// lock locks the key of the owner of tenant, and returns the function
+// unlocking it.
+func (l *keyLocks) lock(tenant, owner, key string) func() {
+	id := tenant + "\x00" + owner + "\x00" + key
+	l.mu.Lock()
+	kl, ok := l.locks[id]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[id] = kl
+	}
+	kl.waiters++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		kl.waiters--
+		if kl.waiters == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// findIdempotent returns the upload of the owner of fm created with the
+// idempotency key, unless it expired.
+func (c *Controller) findIdempotent(fm File, key string) (File, bool, error) {
+	files, _, err := c.store.List(ListQuery{
+		Tenant:         fm.Tenant,
+		Owner:          fm.Owner,
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		return File{}, false, err
+	}
+	for _, f := range files {
+		if f.Owner == fm.Owner && f.Status() != StatusExpired {
+			return f, true, nil
+		}
+	}
+	return File{}, false, nil
+}
+
+// checksumETag returns the etag of the content whose checksum is given as
+// "sha256 <digest>", the digest being base64 or hex encoded.
+func checksumETag(checksum string) (string, bool) {
+	algorithm, digest, ok := strings.Cut(checksum, " ")
+	if !ok || algorithm != "sha256" {
+		return "", false
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != sha256.Size {
+		sum, err = base64.StdEncoding.DecodeString(digest)
+		if err != nil || len(sum) != sha256.Size {
+			return "", false
+		}
+	}
+	return `"` + hex.EncodeToString(sum) + `"`, true
+}
+
+// setContentHeaders describes the downloaded file using the metadata given
+// at creation. Files are always served as attachments, and the declared
+// type is never sniffed, so that uploaded HTML can't run in the origin of
+// the server.
+func setContentHeaders(w http.ResponseWriter, filename, contentType string) {
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set(ContentTypeHeader, contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	disposition := "attachment"
+	if filename != "" {
+		if d := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); d != "" {
+			disposition = d
+		}
+	}
+	w.Header().Set("Content-Disposition", disposition)
+}
+
+type fileMetadataResponse struct {
+	ID        string            `json:"id"`
+	Status    string            `json:"status"`
+	Offset    uint64            `json:"offset"`
+	TotalSize *uint64           `json:"total_size,omitempty"`
+	Metadata  map[string]string `json:"metadata"`
+	Checksum  string            `json:"checksum,omitempty"`
+	ETag      string            `json:"etag,omitempty"`
+	Location  string            `json:"location"`
+	Owner     string            `json:"owner,omitempty"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	CDNURL    string            `json:"cdn_url,omitempty"`
+	// Processing is the status of the post-processing steps.
+	Processing  []pipeline.Step `json:"processing,omitempty"`
+	Quarantined bool            `json:"quarantined,omitempty"`
+	// SniffedContentType is the content type detected from the first
+	// bytes, and ContentTypeMismatch flags when it contradicts the
+	// declared one.
+	SniffedContentType  string `json:"sniffed_content_type,omitempty"`
+	ContentTypeMismatch bool   `json:"content_type_mismatch,omitempty"`
+	// SourceURL is the URL an imported upload is fetched from, and
+	// ImportError why fetching it failed.
+	SourceURL   string `json:"source_url,omitempty"`
+	ImportError string `json:"import_error,omitempty"`
+	// Completion records the outcome of the upload once it is complete.
+	Completion *hooks.Completion `json:"completion,omitempty"`
+	// Finalization is the status of the finalization of an upload
+	// finalized in the background.
+	Finalization finalize.Status `json:"finalization,omitempty"`
+}
+
+func newFileMetadataResponse(fm File) fileMetadataResponse {
+	resp := fileMetadataResponse{
+		ID:     fm.ID,
+		Status: fm.Status(),
+		Offset: fm.UploadedSize,
+		Metadata: map[string]string{
+			"filename":     fm.Name,
+			"content-type": fm.ContentType,
+			"checksum":     fm.Checksum,
+		},
+		Checksum:    fm.Checksum,
+		ETag:        fm.ETag,
+		Location:    "file://" + fm.FilePath(),
+		Owner:       fm.Owner,
+		Processing:  fm.Processing,
+		Quarantined: fm.Quarantined,
+
+		SniffedContentType:  fm.SniffedContentType,
+		ContentTypeMismatch: fm.ContentTypeMismatch,
+		SourceURL:           fm.SourceURL,
+		ImportError:         fm.ImportError,
+		Completion:          fm.Completion,
+		Finalization:        fm.Finalization,
+	}
+	if !fm.IsDeferLength {
+		resp.TotalSize = &fm.TotalSize
+	}
+	if !fm.CreatedAt.IsZero() {
+		t := fm.CreatedAt.UTC()
+		resp.CreatedAt = &t
+	}
+	if !fm.ExpiresAt.IsZero() {
+		t := fm.ExpiresAt.UTC()
+		resp.ExpiresAt = &t
+	}
+	if _, err := unservable(fm); fm.CDNURL != "" && time.Now().Before(fm.CDNURLExpiresAt) && err == nil {
+		resp.CDNURL = fm.CDNURL
+	}
+	return resp
+}
+
+// GetMetadata describes an upload as JSON, for clients preferring it over
+// the tus headers returned by HEAD.
+func (c *Controller) GetMetadata() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok, err := c.find(r, fileID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !canDownload(r, fm.Owner) {
+			log.Debug().Msg("principal is not allowed to inspect the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		b, _ := json.Marshal(newFileMetadataResponse(fm))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+type listResponse struct {
+	Files      []fileMetadataResponse `json:"files"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
+}
+
+// ListUploads returns a page of the uploads of the tenant, optionally
+// filtered by status and owner. Principals which aren't viewers can only
+// list their own uploads.
+func (c *Controller) ListUploads() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		query := r.URL.Query()
+		q := ListQuery{
+			Tenant: auth.TenantFromContext(r.Context()),
+			Owner:  query.Get("owner"),
+			Status: query.Get("status"),
+			Tag:    query.Get("tag"),
+			Cursor: query.Get("cursor"),
+			Limit:  defaultListLimit,
+		}
+		switch q.Status {
+		case "", StatusInProgress, StatusCompleted, StatusExpired:
+		default:
+			writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+			return
+		}
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit <= 0 || limit > maxListLimit {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxListLimit))
+				return
+			}
+			q.Limit = limit
+		}
+		if p, ok := auth.FromContext(r.Context()); ok && !p.HasRole(auth.RoleViewer) {
+			if q.Owner != "" && q.Owner != p.Subject {
+				writeError(w, http.StatusForbidden, auth.ErrForbidden)
+				return
+			}
+			q.Owner = p.Subject
+		}
+
+		files, next, err := c.store.List(q)
+		if err != nil {
+			log.Error().Err(err).Msg("error listing the uploads")
+			writeError(w, http.StatusInternalServerError, errors.New("error listing the uploads"))
+			return
+		}
+
+		resp := listResponse{Files: []fileMetadataResponse{}, NextCursor: next}
+		for _, fm := range files {
+			resp.Files = append(resp.Files, newFileMetadataResponse(fm))
+		}
+		b, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+const maxArchiveFiles = 1000
+
+// DownloadArchive streams a zip archive of completed uploads, selected
+// either by the comma separated ids query parameter or by tag. The archive
+// is written while the files are read, so it is never held in memory. The
+// files are checked before the archive is started; once it is, errors can
+// only be reported by aborting the response, which the client sees as a
+// broken transfer instead of a truncated archive.
+func (c *Controller) DownloadArchive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		query := r.URL.Query()
+		var files []File
+		switch {
+		case query.Get("ids") != "":
+			ids := strings.Split(query.Get("ids"), ",")
+			if len(ids) > maxArchiveFiles {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("an archive can't contain more than %d files", maxArchiveFiles))
+				return
+			}
+			for _, id := range ids {
+				fm, ok, err := c.find(r, id)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+				if !ok {
+					writeError(w, http.StatusNotFound, fmt.Errorf("file %s not found", id))
+					return
+				}
+				if !canDownload(r, fm.Owner) {
+					writeError(w, http.StatusForbidden, auth.ErrForbidden)
+					return
+				}
+				if !fm.IsComplete() {
+					writeError(w, http.StatusConflict, fmt.Errorf("upload %s is not complete", id))
+					return
+				}
+				if code, err := unservable(fm); err != nil {
+					writeError(w, code, fmt.Errorf("file %s: %w", id, err))
+					return
+				}
+				files = append(files, fm)
+			}
+		case query.Get("tag") != "":
+			q := ListQuery{
+				Tenant: auth.TenantFromContext(r.Context()),
+				Tag:    query.Get("tag"),
+				Status: StatusCompleted,
+				Limit:  maxArchiveFiles,
+			}
+			if p, ok := auth.FromContext(r.Context()); ok && !p.HasRole(auth.RoleViewer) {
+				q.Owner = p.Subject
+			}
+			var err error
+			files, _, err = c.store.List(q)
+			if err != nil {
+				log.Error().Err(err).Msg("error listing the uploads")
+				writeError(w, http.StatusInternalServerError, errors.New("error listing the uploads"))
+				return
+			}
+			files = slices.DeleteFunc(files, func(fm File) bool {
+				_, err := unservable(fm)
+				return err != nil
+			})
+		default:
+			writeError(w, http.StatusBadRequest, errors.New("either ids or tag is required"))
+			return
+		}
+
+		for _, fm := range files {
+			if err := checkArchiveEntry(fm); err != nil {
+				log.Error().Err(err).Str("file_id", fm.ID).Msg("error reading the file of the archive")
+				writeError(w, http.StatusInternalServerError, fmt.Errorf("error reading the file %s", fm.ID))
+				return
+			}
+		}
+
+		w.Header().Set(ContentTypeHeader, "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="uploads.zip"`)
+		w.WriteHeader(http.StatusOK)
+
+		zw := zip.NewWriter(w)
+		names := make(map[string]int)
+		for _, fm := range files {
+			if err := writeArchiveEntry(zw, fm, archiveName(names, fm)); err != nil {
+				log.Warn().Err(err).Str("file_id", fm.ID).Msg("archive aborted")
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			log.Warn().Err(err).Msg("archive aborted")
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// archiveName returns a name for the upload which is unique in the archive.
+func archiveName(names map[string]int, fm File) string {
+	name := filepath.Base(fm.Name)
+	if name == "." || name == "/" || name == "" {
+		name = fm.ID
+	}
+	n := names[name]
+	names[name]++
+	if n == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// checkArchiveEntry returns an error unless the file of fm can be read
+// entirely.
+func checkArchiveEntry(fm File) error {
+	info, err := os.Stat(fm.FilePath())
+	if errors.Is(err, os.ErrNotExist) && fm.TotalSize == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) < fm.TotalSize {
+		return fmt.Errorf("file has %d bytes out of %d", info.Size(), fm.TotalSize)
+	}
+	return nil
+}
+
+func writeArchiveEntry(zw *zip.Writer, fm File, name string) error {
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: fm.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fm.FilePath())
+	if errors.Is(err, os.ErrNotExist) && fm.TotalSize == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// a file shorter than the upload fails the archive rather than giving
+	// a valid archive with a truncated entry.
+	_, err = io.CopyN(entry, f, int64(fm.TotalSize))
+	return err
+}
+
+// signCDNURL records a CDN signed URL of the completed upload. The object
+// path is the location of the file relative to the upload directory, which
+// the CDN origin is expected to serve.
+func (c *Controller) signCDNURL(fm *File) {
+	if c.cdn == nil {
+		return
+	}
+	rel, err := filepath.Rel(c.uploadDir, fm.FilePath())
+	if err != nil || strings.HasPrefix(rel, "..") {
+		c.log.Error().Err(err).Str("file_id", fm.ID).Msg("file is outside of the upload directory")
+		return
+	}
+	expiresAt := time.Now().Add(c.cdnURLTTL)
+	u, err := c.cdn.Sign(filepath.ToSlash(rel), expiresAt)
+	if err != nil {
+		c.log.Error().Err(err).Str("file_id", fm.ID).Msg("error signing the cdn url")
+		return
+	}
+	fm.CDNURL = u
+	fm.CDNURLExpiresAt = expiresAt
+}
+
+// thumbnailPath returns the location of the thumbnail of the given size,
+// next to the uploaded file.
+func thumbnailPath(fm File, size int) string {
+	return fmt.Sprintf("%s.thumbnail-%d.jpg", fm.FilePath(), size)
+}
+
+// generateThumbnails queues the generation of the thumbnails of a completed
+// image upload. The sizes which were generated are recorded in the upload
+// once the worker is done.
+func (c *Controller) generateThumbnails(fm File) {
+	if c.thumbnails == nil || !thumbnail.Supported(fm.ContentType) {
+		return
+	}
+	err := c.thumbnails.Enqueue(thumbnail.Job{
+		ID: fm.ID,
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return os.Open(fm.FilePath())
+		},
+		Create: func(ctx context.Context, size int) (io.WriteCloser, error) {
+			return os.Create(thumbnailPath(fm, size))
+		},
+		Done: func(sizes []int, err error) {
+			c.store.Update(fm.ID, func(f *File) error {
+				f.Thumbnails = sizes
+				return nil
+			})
+		},
+	})
+	if err != nil {
+		c.log.Warn().Err(err).Str("file_id", fm.ID).Msg("unable to queue thumbnail generation")
+	}
+}
+
+// postProcess queues the post-processing of a completed upload. The status
+// of its steps is recorded in the upload as they run. Once they all
+// succeeded, its CDN URL is signed and PostFinish called; an upload whose
+// processing failed or couldn't be queued is never served.
+func (c *Controller) postProcess(fm File) {
+	if c.pipeline == nil {
+		return
+	}
+	err := c.pipeline.Enqueue(pipeline.Job{
+		Upload: fm.hookUpload(),
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return os.Open(fm.FilePath())
+		},
+		Update: func(steps []pipeline.Step) {
+			c.store.Update(fm.ID, func(f *File) error {
+				f.Processing = steps
+				f.Quarantined = pipeline.Quarantined(steps)
+				return nil
+			})
+		},
+		Done: func(steps []pipeline.Step) {
+			if !pipeline.Succeeded(steps) {
+				c.log.Warn().Str("file_id", fm.ID).Msg("upload not post-processed, it won't be served")
+				return
+			}
+			signed := fm
+			c.signCDNURL(&signed)
+			f, err := c.store.Update(fm.ID, func(f *File) error {
+				f.CDNURL = signed.CDNURL
+				f.CDNURLExpiresAt = signed.CDNURLExpiresAt
+				return nil
+			})
+			if err != nil {
+				return
+			}
+			c.hooks.PostFinish(context.Background(), f.hookUpload())
+		},
+	})
+	if err != nil {
+		c.log.Error().Err(err).Str("file_id", fm.ID).Msg("unable to queue post-processing, the upload won't be served")
+		c.store.Update(fm.ID, func(f *File) error {
+			steps := slices.Clone(f.Processing)
+			for i := range steps {
+				steps[i].Status = pipeline.StatusFailed
+				steps[i].Error = err.Error()
+				steps[i].UpdatedAt = time.Now().UTC()
+			}
+			f.Processing = steps
+			return nil
+		})
+	}
+}
+
+func (c *Controller) removeThumbnails(fm File) {
+	for _, size := range fm.Thumbnails {
+		if err := os.Remove(thumbnailPath(fm, size)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			c.log.Warn().Err(err).Str("file_id", fm.ID).Int("size", size).Msg("error removing the thumbnail")
+		}
+	}
+}
+
+// GetThumbnail serves a thumbnail of an image upload. The size query
+// parameter selects one of the generated sizes, the smallest by default.
+func (c *Controller) GetThumbnail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok, err := c.find(r, fileID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !canDownload(r, fm.Owner) {
+			log.Debug().Msg("principal is not allowed to download the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if code, err := unservable(fm); err != nil {
+			log.Debug().Err(err).Msg("file can't be served")
+			writeError(w, code, err)
+			return
+		}
+		size, ok := thumbnailSize(r, fm.Thumbnails)
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("thumbnail not found"))
+			return
+		}
+
+		f, err := os.Open(thumbnailPath(fm, size))
+		if err != nil {
+			log.Error().Err(err).Msg("error opening the thumbnail")
+			writeError(w, http.StatusNotFound, errors.New("thumbnail not found"))
+			return
+		}
+		defer f.Close()
+		var modTime time.Time
+		if fi, err := f.Stat(); err == nil {
+			modTime = fi.ModTime()
+		}
+		w.Header().Set(ContentTypeHeader, thumbnail.ContentType)
+		http.ServeContent(w, r, "", modTime, f)
+	}
+}
+
+// thumbnailSize returns the size requested in the query if it was
+// generated, or the smallest generated size.
+func thumbnailSize(r *http.Request, sizes []int) (int, bool) {
+	if len(sizes) == 0 {
+		return 0, false
+	}
+	v := r.URL.Query().Get("size")
+	if v == "" {
+		return slices.Min(sizes), true
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || !slices.Contains(sizes, size) {
+		return 0, false
+	}
+	return size, true
+}
+
+// unservable returns the status refusing to serve the completed upload fm,
+// and why, until every step of its post-processing succeeded. Uploads whose
+// processing failed are never served, so that a scanner being unreachable
+// doesn't let unscanned content through.
+func unservable(fm File) (int, error) {
+	switch {
+	case fm.Quarantined:
+		return http.StatusForbidden, errors.New("file is quarantined")
+	case pipeline.Failed(fm.Processing):
+		return http.StatusConflict, errors.New("post-processing of the file failed")
+	case !pipeline.Succeeded(fm.Processing):
+		return http.StatusLocked, errors.New("file is being processed")
+	}
+	return 0, nil
+}
+
+// canDownload reports whether the principal of the request may download an
+// upload owned by owner.
+func canDownload(r *http.Request, owner string) bool {
+	if auth.CanAccess(r.Context(), owner) {
+		return true
+	}
+	p, ok := auth.FromContext(r.Context())
+	return ok && p.HasRole(auth.RoleViewer)
+}
+
+type erasedUpload struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Size uint64 `json:"size"`
+}
+
+type eraseResponse struct {
+	Owner   string         `json:"owner"`
+	Uploads []erasedUpload `json:"uploads"`
+}
+
+// EraseOwner deletes the data and metadata of every upload created by the
+// owner in the path, e.g. to honor a data-subject erasure request. Principals
+// may erase their own uploads; erasing those of someone else requires the
+// admin role. The response lists what was removed so that it can
+// be kept as a record of the erasure.
+func (c *Controller) EraseOwner() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		p, ok := auth.FromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, auth.ErrUnauthenticated)
+			return
+		}
+		owner := mux.Vars(r)["owner"]
+		if owner != p.Subject && !p.HasRole(auth.RoleAdmin) {
+			log.Debug().Str("owner", owner).Str("subject", p.Subject).Msg("principal is not allowed to erase the owner")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		files, err := c.store.FindByOwner(owner)
+		if err != nil {
+			log.Error().Err(err).Str("owner", owner).Msg("error listing the uploads of the owner")
+			writeError(w, http.StatusInternalServerError, errors.New("error listing the uploads of the owner"))
+			return
+		}
+
+		// the owners erase their uploads of their tenant, the admins those
+		// of every tenant.
+		tenant := auth.TenantFromContext(r.Context())
+		resp := eraseResponse{Owner: owner, Uploads: []erasedUpload{}}
+		for _, fm := range files {
+			if fm.Tenant != tenant && !p.HasRole(auth.RoleAdmin) {
+				continue
+			}
+			if err := os.Remove(fm.FilePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Error().Err(err).Str("file_id", fm.ID).Msg("error removing the file")
+				writeError(w, http.StatusInternalServerError, fmt.Errorf("error removing the file %s", fm.ID))
+				return
+			}
+			c.removeThumbnails(fm)
+			removeParts(fm)
+			if err := c.store.Delete(fm.ID); err != nil {
+				log.Error().Err(err).Str("file_id", fm.ID).Msg("error deleting the file metadata")
+				writeError(w, http.StatusInternalServerError, fmt.Errorf("error deleting the metadata of %s", fm.ID))
+				return
+			}
+			c.hooks.PostTerminate(r.Context(), fm.hookUpload())
+			resp.Uploads = append(resp.Uploads, erasedUpload{ID: fm.ID, Path: fm.FilePath(), Size: fm.UploadedSize})
+		}
+
+		log.Info().Str("owner", owner).Str("subject", p.Subject).Int("uploads", len(resp.Uploads)).Msg("owner erased")
+		b, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+type usageResponse struct {
+	Owner string `json:"owner"`
+	Used  uint64 `json:"used"`
+	Quota uint64 `json:"quota,omitempty"`
+}
+
+// GetUsage reports the storage used by the authenticated principal and the
+// quota it is subject to.
+func (c *Controller) GetUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		p, ok := auth.FromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, auth.ErrUnauthenticated)
+			return
+		}
+		usage, err := c.store.OwnerUsage(p.Subject)
+		if err != nil {
+			log.Error().Err(err).Str("owner", p.Subject).Msg("error computing the user usage")
+			writeError(w, http.StatusInternalServerError, errors.New("error computing the user usage"))
+			return
+		}
+
+		b, _ := json.Marshal(usageResponse{
+			Owner: p.Subject,
+			Used:  usage,
+			Quota: c.quota.User,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func uploadExpiresAt(t time.Time) string {
+	return t.Format("Mon, 02 Jan 2006 15:04:05 GMT")
+}
+
+type cError struct {
+	Message string `json:"message"`
+}
+
+// maxDrainSize is the number of bytes of the body of a rejected chunk read
+// so that its connection can be reused. The connections of larger bodies
+// are closed instead of reading them.
+const maxDrainSize = 64 << 10
+
+// rejectChunk writes the error of a request rejected before its body was
+// read. Small bodies are drained, so that the connection is kept; larger
+// ones, or those of unknown length, close the connection rather than
+// wasting the bandwidth of receiving them.
+func rejectChunk(w http.ResponseWriter, r *http.Request, code int, err error) {
+	if r.ContentLength < 0 || r.ContentLength > maxDrainSize {
+		w.Header().Set("Connection", "close")
+	} else if n, _ := io.CopyN(io.Discard, r.Body, maxDrainSize+1); n > maxDrainSize {
+		w.Header().Set("Connection", "close")
+	}
+	writeError(w, code, err)
 }
 
 func writeError(w http.ResponseWriter, code int, err error) {
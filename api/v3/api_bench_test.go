@@ -0,0 +1,140 @@
+package v3
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+// benchmarkChunkSize is the size of the PATCH requests of the benchmarks,
+// below the 64MB limit of a chunk.
+const benchmarkChunkSize = 16 << 20
+
+func BenchmarkResumeUpload(b *testing.B) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	for _, size := range []int{1 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30} {
+		chunk := bytes.Repeat([]byte{'a'}, min(size, benchmarkChunkSize))
+		sum := sha1.Sum(chunk)
+		checksum := "sha1 " + hex.EncodeToString(sum[:])
+
+		for _, withChecksum := range []bool{false, true} {
+			name := fmt.Sprintf("%dMB", size>>20)
+			if withChecksum {
+				name += "/checksum"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkResumeUpload(b, size, chunk, withChecksum, checksum)
+			})
+		}
+	}
+}
+
+// benchmarkResumeUpload uploads size bytes, made of copies of chunk, to
+// the in-memory store at every iteration.
+func benchmarkResumeUpload(b *testing.B, size int, chunk []byte, withChecksum bool, checksum string) {
+	dir := b.TempDir()
+	store := NewStore()
+	logger := zerolog.Nop()
+	ctrl := NewController(store, WithMaxSize(uint64(size)), WithUploadDir(dir), WithLogger(&logger))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v3/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fm := NewFile()
+		fm.IsDeferLength = false
+		fm.TotalSize = uint64(size)
+		fm.ExpiresAt = time.Now().Add(time.Hour)
+		fm.Path = filepath.Join(dir, "file-upload-"+fm.ID)
+		store.Save(fm.ID, fm)
+		b.StartTimer()
+
+		for offset := 0; offset < size; offset += len(chunk) {
+			req := httptest.NewRequest(http.MethodPatch, "/api/v3/files/"+fm.ID, bytes.NewReader(chunk))
+			req.Header.Set(ContentTypeHeader, "application/offset+octet-stream")
+			req.Header.Set(UploadOffsetHeader, fmt.Sprint(offset))
+			if withChecksum {
+				req.Header.Set(UploadChecksumHeader, checksum)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				b.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+			}
+		}
+
+		b.StopTimer()
+		os.Remove(fm.Path)
+		store.Delete(fm.ID)
+		b.StartTimer()
+	}
+}
+
+// BenchmarkResumeUploadChunk measures the overhead of a PATCH request of a
+// small chunk, dominated by the allocations of the handler rather than the
+// copy of the data.
+func BenchmarkResumeUploadChunk(b *testing.B) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	chunk := bytes.Repeat([]byte{'a'}, 4<<10)
+	sum := sha1.Sum(chunk)
+	checksum := "sha1 " + hex.EncodeToString(sum[:])
+
+	for _, withChecksum := range []bool{false, true} {
+		name := "plain"
+		if withChecksum {
+			name = "checksum"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			store := NewStore()
+			logger := zerolog.Nop()
+			ctrl := NewController(store, WithUploadDir(dir), WithLogger(&logger))
+			router := mux.NewRouter()
+			router.HandleFunc("/api/v3/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+
+			fm := NewFile()
+			fm.IsDeferLength = false
+			fm.TotalSize = uint64(len(chunk)) * uint64(b.N)
+			fm.ExpiresAt = time.Now().Add(time.Hour)
+			fm.Path = filepath.Join(dir, "file-upload-"+fm.ID)
+			store.Save(fm.ID, fm)
+			body := bytes.NewReader(chunk)
+
+			b.SetBytes(int64(len(chunk)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				body.Reset(chunk)
+				req := httptest.NewRequest(http.MethodPatch, "/api/v3/files/"+fm.ID, body)
+				req.Header.Set(ContentTypeHeader, "application/offset+octet-stream")
+				req.Header.Set(UploadOffsetHeader, strconv.Itoa(i*len(chunk)))
+				if withChecksum {
+					req.Header.Set(UploadChecksumHeader, checksum)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					b.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
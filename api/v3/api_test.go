@@ -1,15 +1,49 @@
 package v3_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	. "github.com/imrenagi/go-http-upload/api/v3"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/diskusage"
+	"github.com/imrenagi/go-http-upload/finalize"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/netguard"
+	"github.com/imrenagi/go-http-upload/pipeline"
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/imrenagi/go-http-upload/thumbnail"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func newFakeStore(m map[string]File) *fakeStore {
@@ -19,18 +53,136 @@ func newFakeStore(m map[string]File) *fakeStore {
 }
 
 type fakeStore struct {
+	sync.Mutex
 	files map[string]File
 }
 
 func (s *fakeStore) Find(id string) (File, bool, error) {
+	s.Lock()
+	defer s.Unlock()
 	metadata, exists := s.files[id]
 	return metadata, exists, nil
 }
 
 func (s *fakeStore) Save(id string, metadata File) {
+	s.Lock()
+	defer s.Unlock()
 	s.files[id] = metadata
 }
 
+func (s *fakeStore) Update(id string, fn func(f *File) error) (File, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, exists := s.files[id]
+	if !exists {
+		return File{}, ErrNotFound
+	}
+	if err := fn(&f); err != nil {
+		return File{}, err
+	}
+	s.files[id] = f
+	return f, nil
+}
+
+func (s *fakeStore) Create(f File, q Quota) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkQuota(f, q); err != nil {
+		return err
+	}
+	s.files[f.ID] = f
+	return nil
+}
+
+func (s *fakeStore) Reserve(id string, q Quota, fn func(f *File) error) (File, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, exists := s.files[id]
+	if !exists {
+		return File{}, ErrNotFound
+	}
+	size := f.StoredSize()
+	if err := fn(&f); err != nil {
+		return File{}, err
+	}
+	if f.StoredSize() > size {
+		if err := s.checkQuota(f, q); err != nil {
+			return File{}, err
+		}
+	}
+	s.files[id] = f
+	return f, nil
+}
+
+func (s *fakeStore) checkQuota(f File, q Quota) error {
+	var tenantUsage, ownerUsage uint64
+	for _, other := range s.files {
+		if other.ID == f.ID {
+			continue
+		}
+		if other.Tenant == f.Tenant {
+			tenantUsage += other.StoredSize()
+		}
+		if other.Owner == f.Owner {
+			ownerUsage += other.StoredSize()
+		}
+	}
+	return q.Check(f, tenantUsage, ownerUsage)
+}
+
+func (s *fakeStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.files, id)
+	return nil
+}
+
+func (s *fakeStore) List(q ListQuery) ([]File, string, error) {
+	var files []File
+	for _, f := range s.files {
+		if f.ID > q.Cursor && q.Match(f) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ID < files[j].ID
+	})
+	if q.Limit <= 0 || len(files) <= q.Limit {
+		return files, "", nil
+	}
+	return files[:q.Limit], files[q.Limit-1].ID, nil
+}
+
+func (s *fakeStore) FindByOwner(owner string) ([]File, error) {
+	var files []File
+	for _, f := range s.files {
+		if f.Owner == owner {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (s *fakeStore) OwnerUsage(owner string) (uint64, error) {
+	var total uint64
+	for _, f := range s.files {
+		if f.Owner == owner {
+			total += f.StoredSize()
+		}
+	}
+	return total, nil
+}
+
+func (s *fakeStore) Usage(tenant string) (uint64, error) {
+	var total uint64
+	for _, f := range s.files {
+		if f.Tenant == tenant {
+			total += f.StoredSize()
+		}
+	}
+	return total, nil
+}
+
 func TestGetOffset(t *testing.T) {
 	t.Run("The Server MUST always include the Upload-Offset header in the response for a HEAD request. The Server SHOULD acknowledge successful HEAD requests with a 200 OK or 204 No Content status.",
 		func(t *testing.T) {
@@ -367,6 +519,34 @@ func TestResumeUpload(t *testing.T) {
 		assert.Equal(t, http.StatusNoContent, w.Code)
 		assert.Equal(t, "3", w.Header().Get(UploadOffsetHeader))
 	})
+
+	t.Run("chunk exceeding the length of the upload must be rejected with 413 without being written", func(t *testing.T) {
+		for name, contentLength := range map[string]int64{"declared": 6, "chunked": -1} {
+			m := map[string]File{
+				"a": {
+					ID:        "a",
+					Path:      filepath.Join(t.TempDir(), "a"),
+					TotalSize: 5,
+				},
+			}
+			ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}))
+
+			req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString("cccccc"))
+			req.ContentLength = contentLength
+			req.Header.Set("Content-Type", "application/offset+octet-stream")
+			req.Header.Set("Upload-Offset", "0")
+			w := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, name)
+			assert.Zero(t, m["a"].UploadedSize, name)
+			b, _ := os.ReadFile(m["a"].Path)
+			assert.Empty(t, b, name)
+		}
+	})
 }
 
 func TestExpiration(t *testing.T) {
@@ -608,3 +788,3047 @@ func TestChecksum(t *testing.T) {
 		assert.Equal(t, `{"message":"checksum mismatch"}`, w.Body.String())
 	})
 }
+
+func TestOwnership(t *testing.T) {
+	withPrincipal := func(req *http.Request, subject string) *http.Request {
+		return req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: subject}))
+	}
+
+	t.Run("HEAD request from a principal other than the owner must be rejected with 403", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:           "a",
+				UploadedSize: 19,
+				TotalSize:    100,
+				Owner:        "alice",
+			},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		req := withPrincipal(httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil), "bob")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset())
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Header().Get(UploadOffsetHeader))
+	})
+
+	t.Run("HEAD request from the owner must be accepted", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:           "a",
+				UploadedSize: 19,
+				TotalSize:    100,
+				Owner:        "alice",
+			},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		req := withPrincipal(httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil), "alice")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset())
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "19", w.Header().Get(UploadOffsetHeader))
+	})
+
+	t.Run("PATCH request from a principal other than the owner must be rejected with 403 without modifying the upload", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:           "a",
+				UploadedSize: 0,
+				TotalSize:    5,
+				Owner:        "alice",
+			},
+		}
+		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}))
+
+		buf := bytes.NewBufferString("ccc")
+		req := withPrincipal(httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf), "bob")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, `{"message":"forbidden"}`, w.Body.String())
+		assert.Equal(t, uint64(0), m["a"].UploadedSize)
+	})
+
+	t.Run("DELETE request from a principal other than the owner must be rejected with 403", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:    "a",
+				Owner: "alice",
+			},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		req := withPrincipal(httptest.NewRequest(http.MethodDelete, "/api/v1/files/a", nil), "bob")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.Terminate()).Methods(http.MethodDelete)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, m, "a")
+	})
+}
+
+func TestTermination(t *testing.T) {
+	t.Run("The Server SHOULD free up all resources and respond with 204 No Content when the upload was terminated", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:   "a",
+				Path: t.TempDir() + "/a",
+			},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/files/a", nil)
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.Terminate()).Methods(http.MethodDelete)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.NotContains(t, m, "a")
+	})
+
+	t.Run("DELETE request against a non-existent upload must return 404", func(t *testing.T) {
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m))
+
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/files/a", nil)
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.Terminate()).Methods(http.MethodDelete)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestTenancy(t *testing.T) {
+	withTenant := func(req *http.Request, tenant string) *http.Request {
+		return req.WithContext(auth.NewTenantContext(req.Context(), tenant))
+	}
+	metadata := "filename ZmlsZS50eHQ=,content-type dGV4dC9wbGFpbg==,checksum YWJj"
+
+	t.Run("HEAD request for an upload of another tenant must be rejected with 404", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:           "a",
+				UploadedSize: 19,
+				TotalSize:    100,
+				Tenant:       "acme",
+			},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		req := withTenant(httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil), "globex")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset())
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Empty(t, w.Header().Get(UploadOffsetHeader))
+	})
+
+	t.Run("HEAD request for an upload of the same tenant must be accepted", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:           "a",
+				UploadedSize: 19,
+				TotalSize:    100,
+				Tenant:       "acme",
+			},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		req := withTenant(httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil), "acme")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset())
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "19", w.Header().Get(UploadOffsetHeader))
+	})
+
+	t.Run("POST request must store the upload in the directory of the tenant", func(t *testing.T) {
+		dir := t.TempDir()
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(dir))
+
+		req := withTenant(httptest.NewRequest(http.MethodPost, "/api/v1/files", nil), "acme")
+		req.Header.Set(UploadLengthHeader, "100")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, m, 1)
+		for id, f := range m {
+			assert.Equal(t, "acme", f.Tenant)
+			assert.Equal(t, filepath.Join(dir, "acme", "file-upload-"+id), f.FilePath())
+		}
+		assert.DirExists(t, filepath.Join(dir, "acme"))
+	})
+
+	t.Run("POST request exceeding the quota of the tenant must be rejected with 413", func(t *testing.T) {
+		m := map[string]File{
+			"a": {ID: "a", TotalSize: 60, Tenant: "acme"},
+			"b": {ID: "b", TotalSize: 60, Tenant: "globex"},
+		}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithTenantQuota(100))
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+
+		req := withTenant(httptest.NewRequest(http.MethodPost, "/api/v1/files", nil), "acme")
+		req.Header.Set(UploadLengthHeader, "50")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Len(t, m, 2)
+
+		req = withTenant(httptest.NewRequest(http.MethodPost, "/api/v1/files", nil), "initech")
+		req.Header.Set(UploadLengthHeader, "50")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, m, 3)
+	})
+
+	t.Run("concurrent POST requests must not exceed the quota of the tenant together", func(t *testing.T) {
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithTenantQuota(100))
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 10)
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := withTenant(httptest.NewRequest(http.MethodPost, "/api/v1/files", nil), "acme")
+				req.Header.Set(UploadLengthHeader, "50")
+				req.Header.Set(UploadMetadataHeader, metadata)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				codes <- w.Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		created := 0
+		for code := range codes {
+			if code == http.StatusCreated {
+				created++
+			}
+		}
+		assert.Equal(t, 2, created)
+		assert.Len(t, m, 2)
+	})
+
+	t.Run("POST request deferring the length must be rejected with 413 once the quota of the tenant is exhausted", func(t *testing.T) {
+		m := map[string]File{
+			"a": {ID: "a", TotalSize: 100, Tenant: "acme"},
+		}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithTenantQuota(100))
+
+		req := withTenant(httptest.NewRequest(http.MethodPost, "/api/v1/files", nil), "acme")
+		req.Header.Set(UploadDeferLengthHeader, "1")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Len(t, m, 1)
+	})
+
+	t.Run("PATCH request of an upload deferring its length beyond the quota of the tenant must be rejected with 413", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "b")
+		m := map[string]File{
+			"a": {ID: "a", TotalSize: 90, Tenant: "acme"},
+			"b": {ID: "b", Path: path, IsDeferLength: true, Tenant: "acme", ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}), WithTenantQuota(100))
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+
+		req := withTenant(httptest.NewRequest(http.MethodPatch, "/api/v1/files/b", bytes.NewBufferString("hello")), "acme")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "5", w.Header().Get(UploadOffsetHeader))
+
+		req = withTenant(httptest.NewRequest(http.MethodPatch, "/api/v1/files/b", bytes.NewBufferString("world!")), "acme")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, "5")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Equal(t, uint64(5), m["b"].UploadedSize)
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(content))
+	})
+}
+
+func TestUserQuota(t *testing.T) {
+	withPrincipal := func(req *http.Request, subject string) *http.Request {
+		return req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: subject}))
+	}
+	metadata := "filename ZmlsZS50eHQ=,content-type dGV4dC9wbGFpbg==,checksum YWJj"
+
+	t.Run("POST request exceeding the quota of the user must be rejected with 507", func(t *testing.T) {
+		m := map[string]File{
+			"a": {ID: "a", TotalSize: 60, Owner: "alice"},
+			"b": {ID: "b", TotalSize: 60, Owner: "bob"},
+		}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithUserQuota(100))
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+
+		req := withPrincipal(httptest.NewRequest(http.MethodPost, "/api/v1/files", nil), "alice")
+		req.Header.Set(UploadLengthHeader, "50")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+		assert.Len(t, m, 2)
+
+		req = withPrincipal(httptest.NewRequest(http.MethodPost, "/api/v1/files", nil), "alice")
+		req.Header.Set(UploadLengthHeader, "40")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, m, 3)
+	})
+
+	t.Run("GET usage must report the bytes stored by the principal", func(t *testing.T) {
+		m := map[string]File{
+			"a": {ID: "a", TotalSize: 60, Owner: "alice"},
+			"b": {ID: "b", TotalSize: 30, Owner: "alice"},
+			"c": {ID: "c", TotalSize: 60, Owner: "bob"},
+		}
+		ctrl := NewController(newFakeStore(m), WithUserQuota(100))
+
+		req := withPrincipal(httptest.NewRequest(http.MethodGet, "/api/v1/usage", nil), "alice")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/usage", ctrl.GetUsage()).Methods(http.MethodGet)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"owner":"alice","used":90,"quota":100}`, w.Body.String())
+	})
+
+	t.Run("GET usage without principal must be rejected with 401", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}))
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/usage", nil)
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/usage", ctrl.GetUsage()).Methods(http.MethodGet)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestEraseOwner(t *testing.T) {
+	withPrincipal := func(req *http.Request, subject string) *http.Request {
+		return req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: subject}))
+	}
+
+	t.Run("DELETE request must remove the data and metadata of every upload of the owner", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "file-upload-a")
+		assert.NoError(t, os.WriteFile(path, []byte("hello"), 0644))
+		m := map[string]File{
+			"a": {ID: "a", Path: path, UploadedSize: 5, Owner: "alice"},
+			"b": {ID: "b", Path: filepath.Join(dir, "file-upload-b"), Owner: "alice"},
+			"c": {ID: "c", Path: filepath.Join(dir, "file-upload-c"), Owner: "bob"},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		req := withPrincipal(httptest.NewRequest(http.MethodDelete, "/api/v1/owners/alice", nil), "alice")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/owners/{owner}", ctrl.EraseOwner()).Methods(http.MethodDelete)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `{"id":"a","path":"`+path+`","size":5}`)
+		assert.NoFileExists(t, path)
+		assert.Len(t, m, 1)
+		assert.Contains(t, m, "c")
+	})
+
+	t.Run("DELETE request for another owner must be rejected with 403 unless the principal has the admin role", func(t *testing.T) {
+		m := map[string]File{
+			"a": {ID: "a", Path: filepath.Join(t.TempDir(), "file-upload-a"), Owner: "alice"},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/owners/{owner}", ctrl.EraseOwner()).Methods(http.MethodDelete)
+
+		req := withPrincipal(httptest.NewRequest(http.MethodDelete, "/api/v1/owners/alice", nil), "bob")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Len(t, m, 1)
+
+		req = httptest.NewRequest(http.MethodDelete, "/api/v1/owners/alice", nil)
+		req = req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: "dpo", Roles: []auth.Role{auth.RoleAdmin}}))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, m)
+	})
+
+	t.Run("DELETE request must erase the uploads of every tenant only for the admins", func(t *testing.T) {
+		dir := t.TempDir()
+		m := map[string]File{
+			"a": {ID: "a", Path: filepath.Join(dir, "file-upload-a"), Owner: "alice", Tenant: "acme"},
+			"b": {ID: "b", Path: filepath.Join(dir, "file-upload-b"), Owner: "alice", Tenant: "globex"},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/owners/{owner}", ctrl.EraseOwner()).Methods(http.MethodDelete)
+
+		req := withPrincipal(httptest.NewRequest(http.MethodDelete, "/api/v1/owners/alice", nil), "alice")
+		req = req.WithContext(auth.NewTenantContext(req.Context(), "acme"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, m, "a")
+		assert.Contains(t, m, "b")
+
+		req = httptest.NewRequest(http.MethodDelete, "/api/v1/owners/alice", nil)
+		ctx := auth.NewContext(req.Context(), auth.Principal{Subject: "dpo", Roles: []auth.Role{auth.RoleAdmin}})
+		req = req.WithContext(auth.NewTenantContext(ctx, "acme"))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"id":"b"`)
+		assert.Empty(t, m)
+	})
+
+	t.Run("the logs must not keep the filename nor the metadata of the uploads", func(t *testing.T) {
+		var logs bytes.Buffer
+		logger := zerolog.New(&logs)
+		ctrl := NewController(newFakeStore(map[string]File{}), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithLogger(&logger))
+
+		req := withPrincipal(httptest.NewRequest(http.MethodPost, "/api/v1/files", nil), "alice")
+		req.Header.Set(UploadLengthHeader, "10")
+		// filename secret.txt, note confidential
+		req.Header.Set(UploadMetadataHeader, "filename c2VjcmV0LnR4dA==,content-type dGV4dC9wbGFpbg==,checksum YWJj,note Y29uZmlkZW50aWFs")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Contains(t, logs.String(), "metadata_keys")
+		for _, value := range []string{"secret.txt", "c2VjcmV0LnR4dA==", "confidential", "Y29uZmlkZW50aWFs"} {
+			assert.NotContains(t, logs.String(), value)
+		}
+	})
+}
+
+func TestDownload(t *testing.T) {
+	newFile := func(t *testing.T, content string) File {
+		path := filepath.Join(t.TempDir(), "file-upload-a")
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return File{
+			ID:           "a",
+			Path:         path,
+			TotalSize:    uint64(len(content)),
+			UploadedSize: uint64(len(content)),
+		}
+	}
+	serve := func(ctrl Controller, req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.Download()).Methods(http.MethodGet)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("GET request must return the content of a completed upload", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{"a": newFile(t, "hello world")}))
+
+		w := serve(ctrl, httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+		assert.Equal(t, "hello world", w.Body.String())
+	})
+
+	t.Run("GET request must describe the file with the metadata given at creation", func(t *testing.T) {
+		f := newFile(t, "hello world")
+		f.Name = "résumé.txt"
+		f.ContentType = "text/plain"
+		ctrl := NewController(newFakeStore(map[string]File{"a": f}))
+
+		w := serve(ctrl, httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		assert.Equal(t, "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.txt", w.Header().Get("Content-Disposition"))
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	})
+
+	t.Run("GET request must fall back to octet-stream when the content type is invalid", func(t *testing.T) {
+		f := newFile(t, "hello world")
+		f.ContentType = "not a type"
+		ctrl := NewController(newFakeStore(map[string]File{"a": f}))
+
+		w := serve(ctrl, httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+		assert.Equal(t, "attachment", w.Header().Get("Content-Disposition"))
+	})
+
+	t.Run("GET request with Range header must return the requested part only", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{"a": newFile(t, "hello world")}))
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil)
+		req.Header.Set("Range", "bytes=6-")
+		w := serve(ctrl, req)
+
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "bytes 6-10/11", w.Header().Get("Content-Range"))
+		assert.Equal(t, "world", w.Body.String())
+	})
+
+	t.Run("GET request for an incomplete upload must be rejected with 409", func(t *testing.T) {
+		f := newFile(t, "hello")
+		f.TotalSize = 11
+		ctrl := NewController(newFakeStore(map[string]File{"a": f}))
+
+		w := serve(ctrl, httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil))
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("GET request for an unknown upload must be rejected with 404", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}))
+
+		w := serve(ctrl, httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("GET request from a viewer must be accepted even though it doesn't own the upload", func(t *testing.T) {
+		f := newFile(t, "hello world")
+		f.Owner = "alice"
+		ctrl := NewController(newFakeStore(map[string]File{"a": f}))
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil)
+		w := serve(ctrl, req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: "bob"})))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil)
+		w = serve(ctrl, req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: "bob", Roles: []auth.Role{auth.RoleViewer}})))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestIssueDownloadURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file-upload-a")
+	assert.NoError(t, os.WriteFile(path, []byte("hello world"), 0644))
+	m := map[string]File{
+		"a": {ID: "a", Path: path, TotalSize: 11, UploadedSize: 11, Owner: "alice"},
+		"b": {ID: "b", TotalSize: 11, UploadedSize: 5, Owner: "alice"},
+	}
+	signer := auth.NewURLSigner([]byte("secret"))
+	ctrl := NewController(newFakeStore(m), WithURLSigner(signer))
+
+	router := mux.NewRouter()
+	router.Handle("/api/v1/files/{file_id}", auth.Middleware(signer)(ctrl.Download())).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/files/{file_id}/download-url", ctrl.IssueDownloadURL()).Methods(http.MethodPost)
+
+	withPrincipal := func(req *http.Request, subject string) *http.Request {
+		return req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: subject}))
+	}
+
+	t.Run("The issued URL must allow downloading the upload without credentials", func(t *testing.T) {
+		req := withPrincipal(httptest.NewRequest(http.MethodPost, "/api/v1/files/a/download-url", nil), "alice")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var resp struct {
+			URL string `json:"url"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, resp.URL, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello world", w.Body.String())
+	})
+
+	t.Run("Requests from a principal other than the owner must be rejected with 403", func(t *testing.T) {
+		req := withPrincipal(httptest.NewRequest(http.MethodPost, "/api/v1/files/a/download-url", nil), "bob")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Requests for an incomplete upload must be rejected with 409", func(t *testing.T) {
+		req := withPrincipal(httptest.NewRequest(http.MethodPost, "/api/v1/files/b/download-url", nil), "alice")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+}
+
+func TestETag(t *testing.T) {
+	t.Run("PATCH request completing the upload must compute its etag", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:        "a",
+				Path:      filepath.Join(t.TempDir(), "file-upload-a"),
+				TotalSize: 5,
+				ExpiresAt: time.Now().Add(time.Minute),
+			},
+		}
+		ctrl := NewController(newFakeStore(m))
+
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString("hello"))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		// sha256("hello")
+		assert.Equal(t, `"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`, m["a"].ETag)
+	})
+
+	path := filepath.Join(t.TempDir(), "file-upload-a")
+	assert.NoError(t, os.WriteFile(path, []byte("hello world"), 0644))
+	m := map[string]File{
+		"a": {ID: "a", Path: path, TotalSize: 11, UploadedSize: 11, ETag: `"v1"`},
+	}
+	ctrl := NewController(newFakeStore(m))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.Download()).Methods(http.MethodGet)
+
+	t.Run("GET request must return the etag of the upload", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"v1"`, w.Header().Get("ETag"))
+	})
+
+	t.Run("GET request with matching If-None-Match must return 304", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil)
+		req.Header.Set("If-None-Match", `"v1"`)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("GET request with Range must only be partial when If-Range matches", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil)
+		req.Header.Set("Range", "bytes=6-")
+		req.Header.Set("If-Range", `"v1"`)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "world", w.Body.String())
+
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil)
+		req.Header.Set("Range", "bytes=6-")
+		req.Header.Set("If-Range", `"v0"`)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello world", w.Body.String())
+	})
+}
+
+func TestGetMetadata(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := map[string]File{
+		"a": {
+			ID:           "a",
+			Name:         "file.txt",
+			ContentType:  "text/plain",
+			Checksum:     "abc",
+			Path:         "/data/file-upload-a",
+			TotalSize:    100,
+			UploadedSize: 19,
+			CreatedAt:    createdAt,
+			ExpiresAt:    time.Now().Add(time.Hour),
+		},
+		"b": {ID: "b", IsDeferLength: true, ExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	ctrl := NewController(newFakeStore(m))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files/{file_id}/meta", ctrl.GetMetadata()).Methods(http.MethodGet)
+
+	t.Run("GET request must describe the upload as JSON", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a/meta", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var resp map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, StatusInProgress, resp["status"])
+		assert.Equal(t, float64(19), resp["offset"])
+		assert.Equal(t, float64(100), resp["total_size"])
+		assert.Equal(t, "file:///data/file-upload-a", resp["location"])
+		assert.Equal(t, "2024-01-02T03:04:05Z", resp["created_at"])
+		assert.Equal(t, map[string]interface{}{"filename": "file.txt", "content-type": "text/plain", "checksum": "abc"}, resp["metadata"])
+	})
+
+	t.Run("Deferred length uploads must not report a total size", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/b/meta", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, StatusExpired, resp["status"])
+		assert.NotContains(t, resp, "total_size")
+	})
+
+	t.Run("GET request for an unknown upload must be rejected with 404", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/c/meta", nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestListUploads(t *testing.T) {
+	m := map[string]File{
+		"a": {ID: "a", TotalSize: 10, UploadedSize: 10, Owner: "alice"},
+		"b": {ID: "b", TotalSize: 10, UploadedSize: 5, Owner: "alice", ExpiresAt: time.Now().Add(time.Hour)},
+		"c": {ID: "c", TotalSize: 10, UploadedSize: 10, Owner: "bob"},
+		"d": {ID: "d", TotalSize: 10, UploadedSize: 10, Owner: "alice", Tenant: "acme"},
+	}
+	ctrl := NewController(newFakeStore(m))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files", ctrl.ListUploads()).Methods(http.MethodGet)
+
+	list := func(t *testing.T, req *http.Request) ([]string, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Files []struct {
+				ID string `json:"id"`
+			} `json:"files"`
+			NextCursor string `json:"next_cursor"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		var ids []string
+		for _, f := range resp.Files {
+			ids = append(ids, f.ID)
+		}
+		return ids, resp.NextCursor
+	}
+
+	t.Run("GET request must list the uploads of the tenant page by page", func(t *testing.T) {
+		ids, next := list(t, httptest.NewRequest(http.MethodGet, "/api/v1/files?limit=2", nil))
+		assert.Equal(t, []string{"a", "b"}, ids)
+		assert.Equal(t, "b", next)
+
+		ids, next = list(t, httptest.NewRequest(http.MethodGet, "/api/v1/files?limit=2&cursor="+next, nil))
+		assert.Equal(t, []string{"c"}, ids)
+		assert.Empty(t, next)
+	})
+
+	t.Run("GET request must filter the uploads by status and owner", func(t *testing.T) {
+		ids, _ := list(t, httptest.NewRequest(http.MethodGet, "/api/v1/files?status=completed&owner=alice", nil))
+		assert.Equal(t, []string{"a"}, ids)
+	})
+
+	t.Run("Principals which aren't viewers must only list their own uploads", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files", nil)
+		ids, _ := list(t, req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: "bob"})))
+		assert.Equal(t, []string{"c"}, ids)
+
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/files?owner=alice", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: "bob"})))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("GET request with an unknown status must be rejected with 400", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files?status=done", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestDownloadArchive(t *testing.T) {
+	dir := t.TempDir()
+	newFile := func(id, name, content, tag string) File {
+		path := filepath.Join(dir, "file-upload-"+id)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return File{ID: id, Name: name, Path: path, Tag: tag, TotalSize: uint64(len(content)), UploadedSize: uint64(len(content))}
+	}
+	m := map[string]File{
+		"a": newFile("a", "a.txt", "hello", "reports"),
+		"b": newFile("b", "a.txt", "world", "reports"),
+		"c": newFile("c", "c.txt", "other", ""),
+		"d": {ID: "d", Name: "d.txt", TotalSize: 10, UploadedSize: 5, Tag: "reports"},
+	}
+	ctrl := NewController(newFakeStore(m))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/archive", ctrl.DownloadArchive()).Methods(http.MethodGet)
+
+	unzip := func(t *testing.T, w *httptest.ResponseRecorder) map[string]string {
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		assert.NoError(t, err)
+		files := make(map[string]string)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			assert.NoError(t, err)
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			files[f.Name] = string(b)
+		}
+		return files
+	}
+
+	t.Run("GET request with ids must return an archive of the uploads", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/archive?ids=a,b,c", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+		assert.Equal(t, map[string]string{"a.txt": "hello", "a (1).txt": "world", "c.txt": "other"}, unzip(t, w))
+	})
+
+	t.Run("GET request with tag must return an archive of the completed uploads with the tag", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/archive?tag=reports", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string]string{"a.txt": "hello", "a (1).txt": "world"}, unzip(t, w))
+	})
+
+	t.Run("GET request including an incomplete upload must be rejected with 409", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/archive?ids=a,d", nil))
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("GET request without ids nor tag must be rejected with 400", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/archive", nil))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("GET request including a file which can't be read must fail with 500 before the archive is started", func(t *testing.T) {
+		m := map[string]File{
+			"a": newFile("a", "a.txt", "hello", ""),
+			"e": {ID: "e", Name: "e.txt", Path: filepath.Join(dir, "file-upload-e"), TotalSize: 5, UploadedSize: 5},
+		}
+		ctrl := NewController(newFakeStore(m))
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/archive", ctrl.DownloadArchive()).Methods(http.MethodGet)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/archive?ids=a,e", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.NotEqual(t, "application/zip", w.Header().Get("Content-Type"))
+	})
+}
+
+func TestThumbnail(t *testing.T) {
+	var img bytes.Buffer
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	src.Set(0, 0, color.Black)
+	assert.NoError(t, png.Encode(&img, src))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	worker := thumbnail.NewWorker([]int{64, 128}, 1, 10)
+	go worker.Run(ctx)
+
+	store := newFakeStore(map[string]File{
+		"a": {
+			ID:          "a",
+			Path:        filepath.Join(t.TempDir(), "file-upload-a"),
+			ContentType: "image/png",
+			TotalSize:   uint64(img.Len()),
+			ExpiresAt:   time.Now().Add(time.Minute),
+		},
+		"b": {ID: "b", TotalSize: 5, UploadedSize: 5, ContentType: "text/plain"},
+	})
+	ctrl := NewController(store, WithThumbnails(worker))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+	router.HandleFunc("/api/v1/files/{file_id}/thumbnail", ctrl.GetThumbnail()).Methods(http.MethodGet)
+
+	t.Run("PATCH request completing an image upload must generate its thumbnails", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewReader(img.Bytes()))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Eventually(t, func() bool {
+			f, _, _ := store.Find("a")
+			return len(f.Thumbnails) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("GET request must return the smallest thumbnail by default", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a/thumbnail", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+		thumb, err := jpeg.Decode(w.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 64, 32), thumb.Bounds())
+	})
+
+	t.Run("GET request must return the thumbnail of the requested size", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a/thumbnail?size=128", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		thumb, err := jpeg.Decode(w.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 128, 64), thumb.Bounds())
+	})
+
+	t.Run("GET request with a size which wasn't generated must return 404", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a/thumbnail?size=32", nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("GET request for an upload which isn't an image must return 404", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/b/thumbnail", nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+var downloadSize = flag.Int64("download-size", 256<<20, "size in bytes of the file served by BenchmarkDownload")
+
+// BenchmarkDownload compares serving a completed upload with the Download
+// handler, which lets net/http use sendfile, to copying it through a
+// userspace buffer. Run it with e.g. -download-size=4294967296 to measure
+// multi-GB files; the file is sparse so it doesn't need the disk space.
+func BenchmarkDownload(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "file-upload-a")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Truncate(*downloadSize); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+
+	ctrl := NewController(newFakeStore(map[string]File{
+		"a": {ID: "a", Path: path, TotalSize: uint64(*downloadSize), UploadedSize: uint64(*downloadSize)},
+	}))
+
+	bench := func(b *testing.B, h http.HandlerFunc) {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", h).Methods(http.MethodGet)
+		srv := httptest.NewServer(router)
+		defer srv.Close()
+
+		b.SetBytes(*downloadSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp, err := http.Get(srv.URL + "/api/v1/files/a")
+			if err != nil {
+				b.Fatal(err)
+			}
+			n, err := io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if err != nil || n != *downloadSize {
+				b.Fatalf("read %d bytes: %v", n, err)
+			}
+		}
+	}
+
+	b.Run("sendfile", func(b *testing.B) {
+		bench(b, ctrl.Download())
+	})
+
+	b.Run("buffered copy", func(b *testing.B) {
+		bench(b, func(w http.ResponseWriter, r *http.Request) {
+			f, err := os.Open(path)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			w.Header().Set("Content-Length", strconv.FormatInt(*downloadSize, 10))
+			// hiding *os.File and io.ReaderFrom from each other forces a
+			// copy through the buffer.
+			io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{f}, make([]byte, 32<<10))
+		})
+	})
+}
+
+type fakeCDN struct{}
+
+func (fakeCDN) Sign(path string, expiresAt time.Time) (string, error) {
+	return "https://cdn.example.com/" + path + "?Expires=" + strconv.FormatInt(expiresAt.Unix(), 10), nil
+}
+
+func TestCDN(t *testing.T) {
+	dir := t.TempDir()
+	m := map[string]File{
+		"a": {
+			ID:        "a",
+			Path:      filepath.Join(dir, "acme", "file-upload-a"),
+			TotalSize: 5,
+			ExpiresAt: time.Now().Add(time.Minute),
+		},
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "acme"), 0755))
+	ctrl := NewController(newFakeStore(m), WithUploadDir(dir), WithCDN(fakeCDN{}, time.Hour))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+	router.HandleFunc("/api/v1/files/{file_id}/meta", ctrl.GetMetadata()).Methods(http.MethodGet)
+
+	t.Run("PATCH request completing the upload must return its cdn url", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString("hello"))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		expected := fmt.Sprintf("https://cdn.example.com/acme/file-upload-a?Expires=%d", m["a"].CDNURLExpiresAt.Unix())
+		assert.Equal(t, expected, w.Header().Get(CDNURLHeader))
+		assert.Equal(t, expected, m["a"].CDNURL)
+	})
+
+	t.Run("GET metadata request must return the cdn url until it expires", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a/meta", nil))
+
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.Equal(t, m["a"].CDNURL, body["cdn_url"])
+
+		f := m["a"]
+		f.CDNURLExpiresAt = time.Now().Add(-time.Second)
+		m["a"] = f
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a/meta", nil))
+
+		body = nil
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.NotContains(t, body, "cdn_url")
+	})
+}
+
+type recordingHooks struct {
+	hooks.Nop
+	events   []string
+	reject   error
+	finished hooks.Upload
+}
+
+func (h *recordingHooks) PreCreate(ctx context.Context, u hooks.Upload) error {
+	h.events = append(h.events, "pre-create "+u.Metadata["filename"])
+	return h.reject
+}
+
+func (h *recordingHooks) PostCreate(ctx context.Context, u hooks.Upload) {
+	h.events = append(h.events, "post-create")
+}
+
+func (h *recordingHooks) PostReceiveChunk(ctx context.Context, u hooks.Upload) {
+	h.events = append(h.events, fmt.Sprintf("post-receive-chunk %d", u.Offset))
+}
+
+func (h *recordingHooks) PostFinish(ctx context.Context, u hooks.Upload) {
+	h.events = append(h.events, "post-finish")
+	h.finished = u
+}
+
+func (h *recordingHooks) PostTerminate(ctx context.Context, u hooks.Upload) {
+	h.events = append(h.events, "post-terminate")
+}
+
+func TestHooks(t *testing.T) {
+	metadata := "filename ZmlsZS50eHQ=,content-type dGV4dC9wbGFpbg==,checksum YWJj"
+	newRouter := func(ctrl Controller) *mux.Router {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.Terminate()).Methods(http.MethodDelete)
+		return router
+	}
+
+	t.Run("hooks must be called at every step of the lifecycle of an upload", func(t *testing.T) {
+		h := &recordingHooks{}
+		m := map[string]File{}
+		router := newRouter(NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithHooks(h)))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+		req.Header.Set(UploadLengthHeader, "10")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		id := filepath.Base(w.Header().Get("Location"))
+
+		for i, chunk := range []string{"hello", "world"} {
+			req = httptest.NewRequest(http.MethodPatch, "/api/v1/files/"+id, bytes.NewBufferString(chunk))
+			req.Header.Set("Content-Type", "application/offset+octet-stream")
+			req.Header.Set(UploadOffsetHeader, strconv.Itoa(i*5))
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusNoContent, w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+id, nil))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		assert.Equal(t, []string{
+			"pre-create file.txt",
+			"post-create",
+			"post-receive-chunk 5",
+			"post-receive-chunk 10",
+			"post-finish",
+			"post-terminate",
+		}, h.events)
+	})
+
+	t.Run("post-finish hook and metadata must describe the completion of the upload", func(t *testing.T) {
+		h := &recordingHooks{}
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithHooks(h))
+		router := newRouter(ctrl)
+		router.HandleFunc("/api/v1/files/{file_id}/meta", ctrl.GetMetadata()).Methods(http.MethodGet)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+		req.Header.Set(UploadLengthHeader, "5")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		id := filepath.Base(w.Header().Get("Location"))
+
+		req = httptest.NewRequest(http.MethodPatch, "/api/v1/files/"+id, bytes.NewBufferString("hello"))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, "0")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		completion := h.finished.Completion
+		if assert.NotNil(t, completion) {
+			assert.Equal(t, uint64(5), completion.Size)
+			assert.Equal(t, map[string]string{
+				"md5":    "XUFAKrxLKna5cZ2REBfFkg==",
+				"sha1":   "qvTGHdzF6KLavt4PO0gs2a6pQ00=",
+				"sha256": "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+			}, completion.Checksums)
+			assert.Equal(t, "file.txt", completion.Metadata["filename"])
+			assert.Equal(t, "file://"+m[id].FilePath(), completion.StorageURI)
+			assert.False(t, completion.CompletedAt.Before(completion.StartedAt))
+		}
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/"+id+"/meta", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Completion hooks.Completion `json:"completion"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, completion.Checksums, resp.Completion.Checksums)
+		assert.Equal(t, completion.StorageURI, resp.Completion.StorageURI)
+	})
+
+	t.Run("POST request rejected by the pre-create hook must not create the upload", func(t *testing.T) {
+		h := &recordingHooks{reject: hooks.Reject(http.StatusUnprocessableEntity, "text files are not accepted")}
+		m := map[string]File{}
+		router := newRouter(NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithHooks(h)))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+		req.Header.Set(UploadLengthHeader, "10")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "text files are not accepted")
+		assert.Empty(t, m)
+		assert.Equal(t, []string{"pre-create file.txt"}, h.events)
+	})
+}
+
+func TestPipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scanned := make(chan string, 1)
+	worker := pipeline.NewWorker([]pipeline.Processor{
+		pipeline.Func("scan", func(ctx context.Context, job pipeline.Job) error {
+			r, err := job.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			scanned <- string(b)
+			if bytes.Contains(b, []byte("EICAR")) {
+				return pipeline.Quarantine("Eicar-Signature")
+			}
+			return nil
+		}),
+	})
+	go worker.Run(ctx)
+
+	store := newFakeStore(map[string]File{
+		"a": {
+			ID:          "a",
+			Path:        filepath.Join(t.TempDir(), "file-upload-a"),
+			ContentType: "text/plain",
+			TotalSize:   5,
+			ExpiresAt:   time.Now().Add(time.Minute),
+		},
+		"b": {
+			ID:          "b",
+			Path:        filepath.Join(t.TempDir(), "file-upload-b"),
+			ContentType: "text/plain",
+			TotalSize:   5,
+			ExpiresAt:   time.Now().Add(time.Minute),
+		},
+	})
+	finished := make(chan string, 2)
+	ctrl := NewController(store, WithPipeline(worker), WithHooks(hooks.Events(func(ctx context.Context, e hooks.Event) {
+		if e.Type == hooks.EventCompleted {
+			finished <- e.Upload.ID
+		}
+	})))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.Download()).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/files/{file_id}/meta", ctrl.GetMetadata()).Methods(http.MethodGet)
+
+	t.Run("PATCH request completing an upload must post-process it", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewReader([]byte("hello")))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		select {
+		case content := <-scanned:
+			assert.Equal(t, "hello", content)
+		case <-time.After(5 * time.Second):
+			t.Fatal("upload was not post-processed")
+		}
+	})
+
+	t.Run("GET request must return the status of the post-processing steps", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			f, _, _ := store.Find("a")
+			return len(f.Processing) == 1 && f.Processing[0].Status == pipeline.StatusSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a/meta", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Processing []pipeline.Step `json:"processing"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Len(t, resp.Processing, 1)
+		assert.Equal(t, "scan", resp.Processing[0].Name)
+		assert.Equal(t, pipeline.StatusSucceeded, resp.Processing[0].Status)
+	})
+	t.Run("completion of a clean upload must be announced once post-processed", func(t *testing.T) {
+		select {
+		case id := <-finished:
+			assert.Equal(t, "a", id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("completion was not announced")
+		}
+	})
+
+	t.Run("infected upload must be quarantined", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/b", bytes.NewReader([]byte("EICAR")))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Eventually(t, func() bool {
+			f, _, _ := store.Find("b")
+			return f.Quarantined
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("GET request downloading a quarantined upload must return 403", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/b", nil))
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("completion of a quarantined upload must not be announced", func(t *testing.T) {
+		select {
+		case id := <-finished:
+			t.Fatalf("completion of %s was announced", id)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestUnprocessedUpload(t *testing.T) {
+	newRouter := func(t *testing.T, step pipeline.Processor, finished chan<- string) (*mux.Router, *fakeStore) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		worker := pipeline.NewWorker([]pipeline.Processor{step}, pipeline.WithRetries(2, time.Millisecond))
+		go worker.Run(ctx)
+
+		dir := t.TempDir()
+		store := newFakeStore(map[string]File{
+			"a": {
+				ID:        "a",
+				Path:      filepath.Join(dir, "file-upload-a"),
+				TotalSize: 5,
+				ExpiresAt: time.Now().Add(time.Minute),
+			},
+		})
+		ctrl := NewController(store, WithUploadDir(dir), WithPipeline(worker), WithCDN(fakeCDN{}, time.Hour),
+			WithHooks(hooks.Events(func(ctx context.Context, e hooks.Event) {
+				if e.Type == hooks.EventCompleted {
+					finished <- e.Upload.ID
+				}
+			})))
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.Download()).Methods(http.MethodGet)
+		return router, store
+	}
+	patch := func(router *mux.Router) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString("hello"))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	download := func(router *mux.Router) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil))
+		return w.Code
+	}
+
+	t.Run("upload must be neither served nor signed until it is processed", func(t *testing.T) {
+		release := make(chan struct{})
+		finished := make(chan string, 1)
+		router, store := newRouter(t, pipeline.Func("scan", func(ctx context.Context, job pipeline.Job) error {
+			<-release
+			return nil
+		}), finished)
+
+		w := patch(router)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, w.Header().Get(CDNURLHeader))
+		assert.Equal(t, http.StatusLocked, download(router))
+
+		close(release)
+		select {
+		case id := <-finished:
+			assert.Equal(t, "a", id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("completion was not announced")
+		}
+		assert.Equal(t, http.StatusOK, download(router))
+		f, _, _ := store.Find("a")
+		assert.NotEmpty(t, f.CDNURL)
+	})
+
+	t.Run("upload whose processing failed must never be served", func(t *testing.T) {
+		finished := make(chan string, 1)
+		router, store := newRouter(t, pipeline.Func("scan", func(ctx context.Context, job pipeline.Job) error {
+			return errors.New("clamd unreachable")
+		}), finished)
+
+		patch(router)
+
+		assert.Eventually(t, func() bool {
+			f, _, _ := store.Find("a")
+			return pipeline.Failed(f.Processing)
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, http.StatusConflict, download(router))
+		f, _, _ := store.Find("a")
+		assert.Empty(t, f.CDNURL)
+		select {
+		case id := <-finished:
+			t.Fatalf("completion of %s was announced", id)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	pngHeader := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	newRouter := func(store *fakeStore, policy sniff.Policy) *mux.Router {
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithContentTypePolicy(&policy))
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		return router
+	}
+	patchAt := func(router *mux.Router, offset int, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	patch := func(router *mux.Router, body []byte) *httptest.ResponseRecorder {
+		return patchAt(router, 0, body)
+	}
+	// the uploads are as long as the bodies sent, so that their first
+	// chunks hold the whole bytes the detection looks at.
+	newStore := func(contentType string, size int) *fakeStore {
+		return newFakeStore(map[string]File{
+			"a": {
+				ID:          "a",
+				Path:        filepath.Join(t.TempDir(), "file-upload-a"),
+				ContentType: contentType,
+				TotalSize:   uint64(size),
+				ExpiresAt:   time.Now().Add(time.Minute),
+			},
+		})
+	}
+
+	t.Run("POST request declaring a content type which isn't allowed must be rejected with 415", func(t *testing.T) {
+		m := map[string]File{}
+		router := newRouter(newFakeStore(m), sniff.Policy{Allow: []string{"image/*"}})
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+		req.Header.Set(UploadLengthHeader, "100")
+		// content-type application/pdf
+		req.Header.Set(UploadMetadataHeader, "filename ZmlsZS5wZGY=,content-type YXBwbGljYXRpb24vcGRm,checksum YWJj")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		assert.Empty(t, m)
+	})
+
+	t.Run("PATCH request whose content isn't allowed must be rejected with 415", func(t *testing.T) {
+		html := []byte("<html><script>alert(1)</script></html>")
+		store := newStore("image/png", len(html))
+		router := newRouter(store, sniff.Policy{Deny: []string{"text/html"}})
+
+		w := patch(router, html)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		f, _, _ := store.Find("a")
+		assert.Zero(t, f.UploadedSize)
+		assert.NoFileExists(t, f.FilePath())
+	})
+
+	t.Run("PATCH request whose content contradicts the declared type must be rejected with 415", func(t *testing.T) {
+		router := newRouter(newStore("image/jpeg", len(pngHeader)), sniff.Policy{Mismatch: sniff.MismatchReject})
+
+		w := patch(router, pngHeader)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+
+	t.Run("PATCH request whose content contradicts the declared type must be flagged", func(t *testing.T) {
+		store := newStore("image/jpeg", len(pngHeader))
+		router := newRouter(store, sniff.Policy{Mismatch: sniff.MismatchFlag})
+
+		w := patch(router, pngHeader)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		f, _, _ := store.Find("a")
+		assert.Equal(t, uint64(len(pngHeader)), f.UploadedSize)
+		assert.Equal(t, "image/png", f.SniffedContentType)
+		assert.True(t, f.ContentTypeMismatch)
+	})
+
+	t.Run("PATCH request whose content matches the declared type must be written", func(t *testing.T) {
+		store := newStore("image/png", len(pngHeader))
+		router := newRouter(store, sniff.Policy{Allow: []string{"image/*"}, Mismatch: sniff.MismatchReject})
+
+		w := patch(router, pngHeader)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		f, _, _ := store.Find("a")
+		assert.False(t, f.ContentTypeMismatch)
+		b, err := os.ReadFile(f.FilePath())
+		assert.NoError(t, err)
+		assert.Equal(t, pngHeader, b)
+	})
+
+	t.Run("PATCH requests sending the first bytes in small chunks must be checked once they hold them", func(t *testing.T) {
+		html := []byte("<html><script>alert(1)</script></html>" + strings.Repeat(" ", 600))
+		store := newStore("image/png", len(html))
+		router := newRouter(store, sniff.Policy{Deny: []string{"text/html"}})
+
+		assert.Equal(t, http.StatusNoContent, patch(router, html[:6]).Code)
+		assert.Equal(t, http.StatusNoContent, patchAt(router, 6, html[6:100]).Code)
+		w := patchAt(router, 100, html[100:])
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		f, _, _ := store.Find("a")
+		assert.Equal(t, uint64(100), f.UploadedSize)
+	})
+
+	t.Run("PATCH request completing an upload shorter than the detected bytes must be checked", func(t *testing.T) {
+		store := newStore("image/jpeg", len(pngHeader))
+		router := newRouter(store, sniff.Policy{Mismatch: sniff.MismatchReject})
+		assert.Equal(t, http.StatusNoContent, patch(router, pngHeader[:4]).Code)
+
+		w := patchAt(router, 4, pngHeader[4:])
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		f, _, _ := store.Find("a")
+		assert.False(t, f.IsComplete())
+	})
+}
+
+func TestDedup(t *testing.T) {
+	// sha256 of "hello"
+	etag := `"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`
+	// sha256 LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=
+	checksum := "c2hhMjU2IExQSk51bCt3b3c0bTZEc3F4Ym5pbmhzV0hsd2ZwMEplY3dRellwT0xtQ1E9"
+	metadata := "filename ZmlsZS50eHQ=,content-type dGV4dC9wbGFpbg==,checksum " + checksum
+	newStore := func() map[string]File {
+		return map[string]File{
+			"a": {ID: "a", Owner: "alice", TotalSize: 5, UploadedSize: 5, ETag: etag},
+		}
+	}
+	create := func(ctrl Controller, owner, length string) *httptest.ResponseRecorder {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+		req = req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: owner}))
+		req.Header.Set(UploadLengthHeader, length)
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("POST request with the checksum of a completed upload must return it as completed", func(t *testing.T) {
+		m := newStore()
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithDedup(true))
+
+		w := create(ctrl, "alice", "5")
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "http://127.0.0.1:8080/files/a", w.Header().Get("Location"))
+		assert.Equal(t, "5", w.Header().Get(UploadOffsetHeader))
+		assert.Equal(t, "5", w.Header().Get(UploadLengthHeader))
+		assert.Len(t, m, 1)
+	})
+
+	t.Run("POST request with the checksum of an upload of another owner must create an upload", func(t *testing.T) {
+		m := newStore()
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithDedup(true))
+
+		w := create(ctrl, "bob", "5")
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.NotEqual(t, "http://127.0.0.1:8080/files/a", w.Header().Get("Location"))
+		assert.Len(t, m, 2)
+	})
+
+	t.Run("POST request with another length must create an upload", func(t *testing.T) {
+		m := newStore()
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithDedup(true))
+
+		w := create(ctrl, "alice", "6")
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, m, 2)
+	})
+
+	t.Run("POST request must create an upload when dedup is disabled", func(t *testing.T) {
+		m := newStore()
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()))
+
+		w := create(ctrl, "alice", "5")
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, m, 2)
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	create := func(ctrl Controller, owner, length, key string) *httptest.ResponseRecorder {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+		req = req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: owner}))
+		req.Header.Set(UploadLengthHeader, length)
+		req.Header.Set(UploadMetadataHeader, "filename ZmlsZS50eHQ=,content-type dGV4dC9wbGFpbg==,checksum bm9uZQ==")
+		req.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("POST request retried with the same key must return the upload created", func(t *testing.T) {
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()))
+
+		first := create(ctrl, "alice", "5", "key")
+		retry := create(ctrl, "alice", "5", "key")
+
+		assert.Equal(t, http.StatusCreated, first.Code)
+		assert.Equal(t, http.StatusCreated, retry.Code)
+		assert.Equal(t, first.Header().Get("Location"), retry.Header().Get("Location"))
+		assert.Equal(t, "0", retry.Header().Get(UploadOffsetHeader))
+		assert.Len(t, m, 1)
+	})
+
+	t.Run("POST request reusing a key for another upload must be rejected", func(t *testing.T) {
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()))
+
+		create(ctrl, "alice", "5", "key")
+		w := create(ctrl, "alice", "6", "key")
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Len(t, m, 1)
+	})
+
+	t.Run("POST request with the key of another owner must create an upload", func(t *testing.T) {
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()))
+
+		first := create(ctrl, "alice", "5", "key")
+		w := create(ctrl, "bob", "5", "key")
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.NotEqual(t, first.Header().Get("Location"), w.Header().Get("Location"))
+		assert.Len(t, m, 2)
+	})
+
+	t.Run("POST request with the key of an expired upload must create an upload", func(t *testing.T) {
+		m := map[string]File{
+			"a": {ID: "a", Owner: "alice", TotalSize: 5, IdempotencyKey: "key", ExpiresAt: time.Now().Add(-time.Minute)},
+		}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()))
+
+		w := create(ctrl, "alice", "5", "key")
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.NotEqual(t, "http://127.0.0.1:8080/files/a", w.Header().Get("Location"))
+		assert.Len(t, m, 2)
+	})
+
+	t.Run("concurrent POST requests retried with the same key must create one upload", func(t *testing.T) {
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()))
+
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				create(ctrl, "alice", "5", "key")
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, m, 1)
+	})
+
+	t.Run("POST request with another key must not wait for a pending creation", func(t *testing.T) {
+		m := map[string]File{}
+		h := &blockingHooks{owner: "alice", entered: make(chan struct{}), release: make(chan struct{})}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithHooks(h))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			create(ctrl, "alice", "5", "key")
+		}()
+		<-h.entered
+
+		w := create(ctrl, "bob", "5", "key")
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		close(h.release)
+		<-done
+		assert.Len(t, m, 2)
+	})
+}
+
+// blockingHooks blocks the creations of owner in PreCreate until release is
+// closed.
+type blockingHooks struct {
+	hooks.Nop
+	owner   string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHooks) PreCreate(ctx context.Context, u hooks.Upload) error {
+	if u.Owner == h.owner {
+		close(h.entered)
+		<-h.release
+	}
+	return nil
+}
+
+func TestImportUpload(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hello.txt":
+			w.Header().Set(ContentTypeHeader, "text/plain")
+			w.Write([]byte("hello"))
+		case "/large.bin":
+			w.Write(bytes.Repeat([]byte("a"), 100))
+		case "/tool.exe":
+			w.Header().Set(ContentTypeHeader, "application/x-msdownload")
+			w.Write([]byte("MZ\x90\x00\x03"))
+		case "/image.png":
+			w.Header().Set(ContentTypeHeader, "image/png")
+			w.Write([]byte("MZ\x90\x00\x03"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer source.Close()
+
+	importAs := func(ctrl Controller, p auth.Principal, body string) *httptest.ResponseRecorder {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v3/imports", ctrl.ImportUpload()).Methods(http.MethodPost)
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/imports", bytes.NewReader([]byte(body)))
+		req = req.WithContext(auth.NewContext(req.Context(), p))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	importURL := func(ctrl Controller, body string) *httptest.ResponseRecorder {
+		return importAs(ctrl, auth.Principal{Subject: "alice", Roles: []auth.Role{auth.RoleUploader}}, body)
+	}
+	imported := func(store *fakeStore) (File, bool) {
+		store.Lock()
+		defer store.Unlock()
+		for _, f := range store.files {
+			return f, true
+		}
+		return File{}, false
+	}
+
+	t.Run("POST request must fetch the url into a completed upload", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true))
+
+		w := importURL(ctrl, fmt.Sprintf(`{"url":"%s/hello.txt"}`, source.URL))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Location"))
+		assert.Eventually(t, func() bool {
+			f, ok := imported(store)
+			return ok && f.UploadedSize == 5 && f.ETag != ""
+		}, time.Second, 10*time.Millisecond)
+		f, _ := imported(store)
+		assert.Equal(t, uint64(5), f.TotalSize)
+		assert.Equal(t, "hello.txt", f.Name)
+		assert.Equal(t, "text/plain", f.ContentType)
+		assert.Equal(t, "alice", f.Owner)
+		data, err := os.ReadFile(f.FilePath())
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	})
+
+	t.Run("POST request must record the failure of the fetch", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true))
+
+		w := importURL(ctrl, fmt.Sprintf(`{"url":"%s/missing"}`, source.URL))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Eventually(t, func() bool {
+			f, ok := imported(store)
+			return ok && f.ImportError != ""
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("POST request must fail the import of a source larger than the maximum size", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(10), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true))
+
+		w := importURL(ctrl, fmt.Sprintf(`{"url":"%s/large.bin"}`, source.URL))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Eventually(t, func() bool {
+			f, ok := imported(store)
+			return ok && f.ImportError != ""
+		}, time.Second, 10*time.Millisecond)
+		f, _ := imported(store)
+		assert.Zero(t, f.UploadedSize)
+	})
+
+	t.Run("POST request with an url which isn't http must return 400", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true))
+
+		w := importURL(ctrl, `{"url":"file:///etc/passwd"}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("POST request must return 501 when url imports are disabled", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithMaxSize(1000), WithUploadDir(t.TempDir()))
+
+		w := importURL(ctrl, fmt.Sprintf(`{"url":"%s/hello.txt"}`, source.URL))
+
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+
+	t.Run("POST request must return 501 when url imports have no maximum size", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 0), WithPrivateImports(true))
+
+		w := importURL(ctrl, fmt.Sprintf(`{"url":"%s/hello.txt"}`, source.URL))
+
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+
+	t.Run("POST request with an url of the private network must return 400", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000))
+
+		for _, target := range []string{source.URL + "/hello.txt", "http://169.254.169.254/latest/meta-data", "http://[::1]/"} {
+			w := importURL(ctrl, fmt.Sprintf(`{"url":"%s"}`, target))
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		}
+		_, ok := imported(store)
+		assert.False(t, ok)
+	})
+
+	t.Run("POST request must fail the import redirected to the private network", func(t *testing.T) {
+		fetched := make(chan string, 2)
+		client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			fetched <- req.URL.String()
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{"Location": []string{source.URL + "/hello.txt"}},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		})}
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(client, 1000))
+
+		w := importURL(ctrl, `{"url":"http://8.8.8.8/hello.txt"}`)
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Eventually(t, func() bool {
+			f, ok := imported(store)
+			return ok && f.ImportError != ""
+		}, time.Second, 10*time.Millisecond)
+		f, _ := imported(store)
+		assert.Contains(t, f.ImportError, netguard.ErrForbiddenAddress.Error())
+		assert.Len(t, fetched, 1)
+	})
+
+	t.Run("POST request must return 413 when the quota of the tenant is exhausted", func(t *testing.T) {
+		m := map[string]File{
+			"a": {ID: "a", TotalSize: 1000},
+		}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(t.TempDir()), WithTenantQuota(1000), WithURLImport(source.Client(), 1000), WithPrivateImports(true))
+
+		w := importURL(ctrl, fmt.Sprintf(`{"url":"%s/hello.txt"}`, source.URL))
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Len(t, m, 1)
+	})
+
+	t.Run("POST request must fail the import of a source larger than the maximum size of the credentials", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true))
+
+		w := importAs(ctrl, auth.Principal{Subject: "upload-token:a", MaxUploadSize: 10}, fmt.Sprintf(`{"url":"%s/large.bin"}`, source.URL))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Eventually(t, func() bool {
+			f, ok := imported(store)
+			return ok && f.ImportError != ""
+		}, time.Second, 10*time.Millisecond)
+		f, _ := imported(store)
+		assert.Zero(t, f.UploadedSize)
+	})
+
+	t.Run("POST request must return 415 for a content type other than the one of the credentials", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true))
+		p := auth.Principal{Subject: "upload-token:a", ContentType: "image/png"}
+
+		for _, body := range []string{
+			fmt.Sprintf(`{"url":"%s/tool.exe"}`, source.URL),
+			fmt.Sprintf(`{"url":"%s/tool.exe","content_type":"application/x-msdownload"}`, source.URL),
+		} {
+			w := importAs(ctrl, p, body)
+
+			assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, body)
+		}
+		_, ok := imported(store)
+		assert.False(t, ok)
+	})
+
+	t.Run("POST request must charge the quota of the credentials with the data fetched", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true))
+		meter := &fakeMeter{quota: 50}
+
+		w := importAs(ctrl, auth.Principal{Subject: "alice", Meter: meter}, fmt.Sprintf(`{"url":"%s/large.bin"}`, source.URL))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Eventually(t, func() bool {
+			f, ok := imported(store)
+			return ok && f.ImportError != ""
+		}, time.Second, 10*time.Millisecond)
+		f, _ := imported(store)
+		assert.Contains(t, f.ImportError, auth.ErrQuotaExceeded.Error())
+	})
+
+	t.Run("POST request must fail the import of a source whose content type isn't allowed", func(t *testing.T) {
+		policy := sniff.Policy{Deny: []string{"application/x-msdownload"}}
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true), WithContentTypePolicy(&policy))
+
+		w := importURL(ctrl, fmt.Sprintf(`{"url":"%s/tool.exe"}`, source.URL))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Eventually(t, func() bool {
+			f, ok := imported(store)
+			return ok && f.ImportError != ""
+		}, time.Second, 10*time.Millisecond)
+		f, _ := imported(store)
+		assert.Zero(t, f.UploadedSize)
+	})
+
+	t.Run("POST request must fail the import of a source whose content isn't allowed", func(t *testing.T) {
+		policy := sniff.Policy{Allow: []string{"image/*"}}
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithMaxSize(1000), WithUploadDir(t.TempDir()), WithURLImport(source.Client(), 1000), WithPrivateImports(true), WithContentTypePolicy(&policy))
+
+		w := importURL(ctrl, fmt.Sprintf(`{"url":"%s/image.png"}`, source.URL))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Eventually(t, func() bool {
+			f, ok := imported(store)
+			return ok && f.ImportError != ""
+		}, time.Second, 10*time.Millisecond)
+		f, _ := imported(store)
+		assert.Contains(t, f.ImportError, sniff.ErrNotAllowed.Error())
+		assert.Zero(t, f.UploadedSize)
+	})
+}
+
+// fakeMeter is a quota of quota bytes.
+type fakeMeter struct {
+	sync.Mutex
+	quota, used uint64
+}
+
+func (m *fakeMeter) Charge(n uint64) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.used+n > m.quota {
+		return auth.ErrQuotaExceeded
+	}
+	m.used += n
+	return nil
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCopySpan(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+
+	m := map[string]File{
+		"a": {ID: "a", TotalSize: 3 << 20, UploadedSize: 1, Path: filepath.Join(t.TempDir(), "a"), ExpiresAt: time.Now().Add(time.Hour)},
+	}
+	ctrl := NewController(newFakeStore(m), WithMaxSize(3<<20))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewReader(make([]byte, 2<<20+10)))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set(UploadOffsetHeader, "1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	var copySpan sdktrace.ReadOnlySpan
+	for _, s := range spans.Ended() {
+		if s.Name() == "upload.copy" {
+			copySpan = s
+		}
+	}
+	if assert.NotNil(t, copySpan) {
+		assert.ElementsMatch(t, []attribute.KeyValue{
+			attribute.String("file_id", "a"),
+			attribute.Int64("offset", 1),
+			attribute.Int64("bytes_written", 2<<20+10),
+		}, copySpan.Attributes())
+		assert.Len(t, copySpan.Events(), 2)
+	}
+}
+
+// syncBuffer is a buffer safe for concurrent use, for the logs written
+// while the request is watched by a goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+	newRouter := func(opts ...Option) *mux.Router {
+		m := map[string]File{
+			"a": {ID: "a", Owner: "alice", TotalSize: 10, UploadedSize: 5, ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		ctrl := NewController(newFakeStore(m), opts...)
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		return router
+	}
+	patch := func(ctx context.Context) *http.Request {
+		ctx = auth.NewContext(ctx, auth.Principal{Subject: "alice"})
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString("hello")).WithContext(ctx)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, "0")
+		return req
+	}
+
+	t.Run("PATCH request must log with the logger of the controller and the upload fields", func(t *testing.T) {
+		var buf syncBuffer
+		logger := zerolog.New(&buf)
+		w := httptest.NewRecorder()
+		newRouter(WithLogger(&logger)).ServeHTTP(w, patch(context.Background()))
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, buf.String(), "upload-Offset header does not match the current offset")
+		assert.Contains(t, buf.String(), `"file_id":"a","owner":"alice"`)
+	})
+
+	t.Run("PATCH request must log with the logger of the request when there is one", func(t *testing.T) {
+		var ctrlBuf, reqBuf syncBuffer
+		ctrlLogger := zerolog.New(&ctrlBuf)
+		reqLogger := zerolog.New(&reqBuf).With().Str("request_id", "r1").Logger()
+		w := httptest.NewRecorder()
+		newRouter(WithLogger(&ctrlLogger)).ServeHTTP(w, patch(reqLogger.WithContext(context.Background())))
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Empty(t, ctrlBuf.String())
+		assert.Contains(t, reqBuf.String(), `"request_id":"r1","file_id":"a"`)
+	})
+}
+
+func TestDiskMonitor(t *testing.T) {
+	metadata := "filename ZmlsZS50eHQ=,content-type dGV4dC9wbGFpbg==,checksum YWJj"
+	create := func(ctrl Controller) *httptest.ResponseRecorder {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+		req.Header.Set(UploadLengthHeader, "10")
+		req.Header.Set(UploadMetadataHeader, metadata)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("POST request past the disk usage threshold must be rejected with 507", func(t *testing.T) {
+		dir := t.TempDir()
+		// any used byte is past the threshold.
+		disk, err := diskusage.NewMonitor(dir, diskusage.WithThreshold(1e-12, true))
+		assert.NoError(t, err)
+		assert.NoError(t, disk.Measure())
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(dir), WithDiskMonitor(disk))
+
+		w := create(ctrl)
+
+		assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+		assert.Empty(t, m)
+	})
+
+	t.Run("POST request past the threshold of a monitor only warning must be accepted", func(t *testing.T) {
+		dir := t.TempDir()
+		disk, err := diskusage.NewMonitor(dir, diskusage.WithThreshold(1e-12, false))
+		assert.NoError(t, err)
+		assert.NoError(t, disk.Measure())
+		m := map[string]File{}
+		ctrl := NewController(newFakeStore(m), WithMaxSize(1000), WithUploadDir(dir), WithDiskMonitor(disk))
+
+		w := create(ctrl)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, m, 1)
+	})
+}
+
+func TestFinalizer(t *testing.T) {
+	newUpload := func(t *testing.T, size uint64) map[string]File {
+		return map[string]File{
+			"a": {
+				ID:        "a",
+				Path:      filepath.Join(t.TempDir(), "file-upload-a"),
+				TotalSize: size,
+				ExpiresAt: time.Now().Add(time.Minute),
+			},
+		}
+	}
+	newRouter := func(ctrl *Controller) *mux.Router {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset()).Methods(http.MethodHead)
+		return router
+	}
+	patch := func(router *mux.Router, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	head := func(router *mux.Router) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil))
+		return w
+	}
+
+	t.Run("PATCH request completing a large upload must be answered before it is finalized", func(t *testing.T) {
+		m := newUpload(t, 5)
+		finalizer := finalize.NewWorker(1, 1)
+		ctrl := NewController(newFakeStore(m), WithFinalizer(finalizer, 5))
+		router := newRouter(&ctrl)
+
+		w := patch(router, "hello")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "5", w.Header().Get(UploadOffsetHeader))
+		w = head(router)
+		assert.Equal(t, string(finalize.StatusPending), w.Header().Get(UploadFinalizationHeader))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go finalizer.Run(ctx)
+
+		assert.Eventually(t, func() bool {
+			return head(router).Header().Get(UploadFinalizationHeader) == string(finalize.StatusSucceeded)
+		}, time.Second, 10*time.Millisecond)
+		cancel()
+		// sha256("hello")
+		assert.Equal(t, `"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`, m["a"].ETag)
+		assert.NotNil(t, m["a"].Completion)
+	})
+
+	t.Run("upload terminated while queued for finalization must not be recreated", func(t *testing.T) {
+		m := newUpload(t, 5)
+		store := newFakeStore(m)
+		finalizer := finalize.NewWorker(1, 2)
+		ctrl := NewController(store, WithFinalizer(finalizer, 5))
+		router := newRouter(&ctrl)
+
+		w := patch(router, "hello")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		store.Delete("a")
+		done := make(chan struct{})
+		assert.NoError(t, finalizer.Enqueue(finalize.Job{ID: "b", Finalize: func(context.Context) { close(done) }}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go finalizer.Run(ctx)
+		<-done
+
+		_, ok, _ := store.Find("a")
+		assert.False(t, ok)
+	})
+
+	t.Run("PATCH request completing a small upload must finalize it right away", func(t *testing.T) {
+		m := newUpload(t, 5)
+		ctrl := NewController(newFakeStore(m), WithFinalizer(finalize.NewWorker(1, 1), 6))
+		router := newRouter(&ctrl)
+
+		w := patch(router, "hello")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, head(router).Header().Get(UploadFinalizationHeader))
+		assert.NotEmpty(t, m["a"].ETag)
+	})
+
+	t.Run("PATCH request must finalize the upload itself when the queue is full", func(t *testing.T) {
+		m := newUpload(t, 5)
+		finalizer := finalize.NewWorker(1, 1)
+		assert.NoError(t, finalizer.Enqueue(finalize.Job{ID: "b", Finalize: func(context.Context) {}}))
+		ctrl := NewController(newFakeStore(m), WithFinalizer(finalizer, 1))
+		router := newRouter(&ctrl)
+
+		w := patch(router, "hello")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, string(finalize.StatusSucceeded), head(router).Header().Get(UploadFinalizationHeader))
+		assert.NotEmpty(t, m["a"].ETag)
+	})
+}
+
+func TestSparseUpload(t *testing.T) {
+	const size = 2*SparseBlockSize + 100
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	newUpload := func(t *testing.T) map[string]File {
+		return map[string]File{
+			"a": {
+				ID:        "a",
+				Path:      filepath.Join(t.TempDir(), "file-upload-a"),
+				TotalSize: size,
+				ExpiresAt: time.Now().Add(time.Minute),
+			},
+		}
+	}
+	newRouter := func(ctrl *Controller) *mux.Router {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}/chunks", ctrl.UploadChunk()).Methods(http.MethodPut)
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset()).Methods(http.MethodHead)
+		return router
+	}
+	put := func(router *mux.Router, offset int, chunk []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/files/a/chunks", bytes.NewReader(chunk))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, fmt.Sprint(offset))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("chunks sent concurrently in any order must complete the upload", func(t *testing.T) {
+		m := newUpload(t)
+		store := newFakeStore(m)
+		ctrl := NewController(store, WithMaxSize(size), WithSparseUploads(true))
+		router := newRouter(&ctrl)
+
+		w := put(router, SparseBlockSize, data[SparseBlockSize:2*SparseBlockSize])
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, fmt.Sprint(SparseBlockSize), w.Header().Get(UploadOffsetHeader))
+		assert.Equal(t, fmt.Sprintf("%d-%d", SparseBlockSize, 2*SparseBlockSize-1), w.Header().Get(UploadReceivedRangesHeader))
+
+		var wg sync.WaitGroup
+		codes := make([]int, 2)
+		for i, offset := range []int{2 * SparseBlockSize, 0} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes[i] = put(router, offset, data[offset:min(offset+SparseBlockSize, size)]).Code
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, []int{http.StatusNoContent, http.StatusNoContent}, codes)
+		fm, _, _ := store.Find("a")
+		assert.True(t, fm.IsComplete())
+		assert.NotEmpty(t, fm.ETag)
+		content, err := os.ReadFile(fm.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, data, content)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil))
+		assert.Equal(t, fmt.Sprintf("0-%d", size-1), w.Header().Get(UploadReceivedRangesHeader))
+	})
+
+	t.Run("blocks must not be lost by the updates of the upload made meanwhile", func(t *testing.T) {
+		store := newFakeStore(newUpload(t))
+		ctrl := NewController(store, WithSparseUploads(true))
+		router := newRouter(&ctrl)
+
+		var wg sync.WaitGroup
+		for _, offset := range []int{0, SparseBlockSize, 2 * SparseBlockSize} {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				put(router, offset, data[offset:min(offset+SparseBlockSize, size)])
+			}()
+			go func() {
+				defer wg.Done()
+				store.Update("a", func(f *File) error {
+					f.Tag = "tagged"
+					return nil
+				})
+			}()
+		}
+		wg.Wait()
+
+		fm, _, _ := store.Find("a")
+		assert.True(t, fm.IsComplete())
+		assert.Equal(t, "tagged", fm.Tag)
+	})
+
+	t.Run("PUT request with an offset not aligned on a block must be rejected with 400", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)), WithSparseUploads(true))
+
+		w := put(newRouter(&ctrl), 10, data[10:SparseBlockSize+10])
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("PUT request with a partial block not ending the upload must be rejected with 400", func(t *testing.T) {
+		m := newUpload(t)
+		ctrl := NewController(newFakeStore(m), WithSparseUploads(true))
+
+		w := put(newRouter(&ctrl), 0, data[:100])
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Zero(t, m["a"].UploadedSize)
+	})
+
+	t.Run("PUT request at offset 0 not holding the bytes the detection looks at must be rejected with 400", func(t *testing.T) {
+		m := newUpload(t)
+		policy := sniff.Policy{Deny: []string{"text/html"}}
+		ctrl := NewController(newFakeStore(m), WithSparseUploads(true), WithContentTypePolicy(&policy))
+
+		w := put(newRouter(&ctrl), 0, []byte("<html>"))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoFileExists(t, m["a"].Path)
+	})
+
+	t.Run("PUT request past the upload length must be rejected with 413", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)), WithSparseUploads(true))
+
+		w := put(newRouter(&ctrl), 2*SparseBlockSize, make([]byte, 101))
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("PATCH request to a sparse upload must be rejected with 409", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)), WithSparseUploads(true))
+		router := newRouter(&ctrl)
+		assert.Equal(t, http.StatusNoContent, put(router, 0, data[:SparseBlockSize]).Code)
+
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewReader(data[SparseBlockSize:]))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, fmt.Sprint(SparseBlockSize))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("PUT request to an upload resumed with PATCH must be rejected with 409", func(t *testing.T) {
+		m := newUpload(t)
+		fm := m["a"]
+		fm.UploadedSize = 10
+		m["a"] = fm
+		ctrl := NewController(newFakeStore(m), WithSparseUploads(true))
+
+		w := put(newRouter(&ctrl), SparseBlockSize, data[SparseBlockSize:2*SparseBlockSize])
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("PUT request must be rejected with 501 when sparse uploads are disabled", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)))
+
+		w := put(newRouter(&ctrl), 0, data[:SparseBlockSize])
+
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+}
+
+func TestMultipartUpload(t *testing.T) {
+	const minPartSize = 1024
+	data := make([]byte, 2*minPartSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	parts := [][]byte{data[:minPartSize], data[minPartSize : 2*minPartSize], data[2*minPartSize:]}
+	newRouter := func(ctrl *Controller) *mux.Router {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v3/multipart", ctrl.InitiateMultipart()).Methods(http.MethodPost)
+		router.HandleFunc("/api/v3/multipart/{file_id}/parts/{part_number}", ctrl.UploadPart()).Methods(http.MethodPut)
+		router.HandleFunc("/api/v3/multipart/{file_id}/complete", ctrl.CompleteMultipart()).Methods(http.MethodPost)
+		router.HandleFunc("/api/v3/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		return router
+	}
+	initiate := func(t *testing.T, router *mux.Router) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v3/multipart", strings.NewReader(`{"filename":"data.bin"}`)))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var resp struct {
+			UploadID string `json:"upload_id"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp.UploadID
+	}
+	put := func(router *mux.Router, id string, number int, part []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/v3/multipart/%s/parts/%d", id, number), bytes.NewReader(part)))
+		return w
+	}
+	type completedPart struct {
+		PartNumber int    `json:"part_number"`
+		ETag       string `json:"etag"`
+	}
+	complete := func(router *mux.Router, id string, parts []completedPart) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"parts": parts})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v3/multipart/"+id+"/complete", bytes.NewReader(body)))
+		return w
+	}
+
+	t.Run("parts uploaded concurrently must be assembled by the complete request", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true))
+		router := newRouter(&ctrl)
+		id := initiate(t, router)
+
+		var wg sync.WaitGroup
+		etags := make([]string, len(parts))
+		codes := make([]int, len(parts))
+		for i := range parts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := put(router, id, i+1, parts[i])
+				codes[i] = w.Code
+				etags[i] = w.Header().Get("ETag")
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusOK}, codes)
+		sum := md5.Sum(parts[0])
+		assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, etags[0])
+
+		w := complete(router, id, []completedPart{{1, etags[0]}, {2, etags[1]}, {3, etags[2]}})
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		fm, _, _ := store.Find(id)
+		assert.True(t, fm.IsComplete())
+		assert.Equal(t, uint64(len(data)), fm.TotalSize)
+		content, err := os.ReadFile(fm.FilePath())
+		assert.NoError(t, err)
+		assert.Equal(t, data, content)
+		leftovers, _ := filepath.Glob(fm.FilePath() + ".part-*")
+		assert.Empty(t, leftovers)
+	})
+
+	t.Run("complete request with a wrong etag must be rejected with 400", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true))
+		router := newRouter(&ctrl)
+		id := initiate(t, router)
+		put(router, id, 1, parts[0])
+
+		w := complete(router, id, []completedPart{{1, `"0"`}})
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, http.StatusOK, put(router, id, 1, parts[0]).Code)
+	})
+
+	t.Run("part uploaded while the upload is completed must be rejected with 409", func(t *testing.T) {
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true))
+		router := newRouter(&ctrl)
+		id := initiate(t, router)
+		store.Update(id, func(f *File) error {
+			f.Completing = true
+			return nil
+		})
+
+		assert.Equal(t, http.StatusConflict, put(router, id, 1, parts[0]).Code)
+		assert.Equal(t, http.StatusConflict, complete(router, id, []completedPart{{1, `"0"`}}).Code)
+	})
+
+	t.Run("complete request whose assembled content isn't allowed must be rejected with 415", func(t *testing.T) {
+		policy := sniff.Policy{Deny: []string{"text/html"}}
+		store := newFakeStore(map[string]File{})
+		ctrl := NewController(store, WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true), WithContentTypePolicy(&policy))
+		router := newRouter(&ctrl)
+		id := initiate(t, router)
+		html := []byte("<html><script>alert(1)</script></html>" + strings.Repeat(" ", minPartSize))
+		// the first part listed isn't part 1, and part 1 is too short to be
+		// checked on its own.
+		first := put(router, id, 1, []byte("<html>"))
+		second := put(router, id, 2, html)
+		third := put(router, id, 3, parts[2])
+		assert.Equal(t, http.StatusOK, first.Code)
+
+		w := complete(router, id, []completedPart{{2, second.Header().Get("ETag")}, {3, third.Header().Get("ETag")}})
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		w = complete(router, id, []completedPart{{1, first.Header().Get("ETag")}})
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+		fm, _, _ := store.Find(id)
+		assert.False(t, fm.IsComplete())
+		assert.False(t, fm.Completing)
+	})
+
+	t.Run("complete request with a part smaller than the minimum part size must be rejected with 400", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true))
+		router := newRouter(&ctrl)
+		id := initiate(t, router)
+		first := put(router, id, 1, parts[2]).Header().Get("ETag")
+		second := put(router, id, 2, parts[0]).Header().Get("ETag")
+
+		w := complete(router, id, []completedPart{{1, first}, {2, second}})
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("complete request with parts out of order must be rejected with 400", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true))
+		router := newRouter(&ctrl)
+		id := initiate(t, router)
+		first := put(router, id, 1, parts[0]).Header().Get("ETag")
+		second := put(router, id, 2, parts[1]).Header().Get("ETag")
+
+		w := complete(router, id, []completedPart{{2, second}, {1, first}})
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("part number out of range must be rejected with 400", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true))
+		router := newRouter(&ctrl)
+		id := initiate(t, router)
+
+		assert.Equal(t, http.StatusBadRequest, put(router, id, 0, parts[0]).Code)
+		assert.Equal(t, http.StatusBadRequest, put(router, id, MaxPartNumber+1, parts[0]).Code)
+	})
+
+	t.Run("PATCH request to a multipart upload must be rejected with 409", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true))
+		router := newRouter(&ctrl)
+		id := initiate(t, router)
+
+		req := httptest.NewRequest(http.MethodPatch, "/api/v3/files/"+id, bytes.NewReader(parts[0]))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("initiate request of an owner out of quota must be rejected with 507", func(t *testing.T) {
+		m := map[string]File{"a": {ID: "a", TotalSize: 100, Owner: "alice"}}
+		ctrl := NewController(newFakeStore(m), WithUploadDir(t.TempDir()), WithMultipart(minPartSize, true), WithUserQuota(100))
+		router := newRouter(&ctrl)
+		initiateAs := func(owner string) int {
+			req := httptest.NewRequest(http.MethodPost, "/api/v3/multipart", strings.NewReader(`{"filename":"data.bin"}`))
+			req = req.WithContext(auth.NewContext(req.Context(), auth.Principal{Subject: owner}))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		assert.Equal(t, http.StatusInsufficientStorage, initiateAs("alice"))
+		assert.Len(t, m, 1)
+		assert.Equal(t, http.StatusCreated, initiateAs("bob"))
+		assert.Len(t, m, 2)
+	})
+
+	t.Run("initiate request must be rejected with 501 when multipart uploads are disabled", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}))
+
+		w := httptest.NewRecorder()
+		newRouter(&ctrl).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v3/multipart", strings.NewReader(`{"filename":"data.bin"}`)))
+
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+}
+
+func TestWebSocketUpload(t *testing.T) {
+	data := []byte("hello websocket world")
+	newUpload := func(t *testing.T) map[string]File {
+		return map[string]File{
+			"a": {
+				ID:        "a",
+				Path:      filepath.Join(t.TempDir(), "file-upload-a"),
+				TotalSize: uint64(len(data)),
+				ExpiresAt: time.Now().Add(time.Minute),
+			},
+		}
+	}
+	dialFrom := func(t *testing.T, ctrl *Controller, origin func(srvURL string) string) (*websocket.Conn, *http.Response, error) {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}/ws", ctrl.UploadWebSocket()).Methods(http.MethodGet)
+		srv := httptest.NewServer(router)
+		t.Cleanup(srv.Close)
+		header := http.Header{}
+		if o := origin(srv.URL); o != "" {
+			header.Set("Origin", o)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/files/a/ws", header)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+		return conn, resp, err
+	}
+	dial := func(t *testing.T, ctrl *Controller) (*websocket.Conn, *http.Response, error) {
+		return dialFrom(t, ctrl, func(srvURL string) string { return srvURL })
+	}
+	type ack struct {
+		Offset   uint64 `json:"offset"`
+		Complete bool   `json:"complete"`
+		Error    string `json:"error"`
+	}
+	send := func(t *testing.T, conn *websocket.Conn, offset uint64, chunk []byte) ack {
+		msg := binary.BigEndian.AppendUint64(nil, offset)
+		assert.NoError(t, conn.WriteMessage(websocket.BinaryMessage, append(msg, chunk...)))
+		var a ack
+		assert.NoError(t, conn.ReadJSON(&a))
+		return a
+	}
+
+	t.Run("offset-tagged chunks must complete the upload", func(t *testing.T) {
+		m := newUpload(t)
+		ctrl := NewController(newFakeStore(m), WithWebSocket(true))
+		conn, _, err := dial(t, &ctrl)
+		assert.NoError(t, err)
+
+		var a ack
+		assert.NoError(t, conn.ReadJSON(&a))
+		assert.Equal(t, uint64(0), a.Offset)
+
+		a = send(t, conn, 0, data[:6])
+		assert.Equal(t, ack{Offset: 6}, a)
+		a = send(t, conn, 6, data[6:])
+		assert.Equal(t, ack{Offset: uint64(len(data)), Complete: true}, a)
+
+		b, err := os.ReadFile(m["a"].Path)
+		assert.NoError(t, err)
+		assert.Equal(t, data, b)
+	})
+
+	t.Run("chunk with a wrong offset must be rejected without closing the connection", func(t *testing.T) {
+		m := newUpload(t)
+		ctrl := NewController(newFakeStore(m), WithWebSocket(true))
+		conn, _, err := dial(t, &ctrl)
+		assert.NoError(t, err)
+		conn.ReadJSON(&ack{})
+
+		a := send(t, conn, 6, data[6:])
+		assert.Equal(t, uint64(0), a.Offset)
+		assert.NotEmpty(t, a.Error)
+
+		a = send(t, conn, 0, data)
+		assert.Equal(t, ack{Offset: uint64(len(data)), Complete: true}, a)
+	})
+
+	t.Run("text message must close the connection", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)), WithWebSocket(true))
+		conn, _, err := dial(t, &ctrl)
+		assert.NoError(t, err)
+		conn.ReadJSON(&ack{})
+
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseUnsupportedData))
+	})
+
+	t.Run("chunk exceeding the upload length must be rejected before being written", func(t *testing.T) {
+		m := newUpload(t)
+		ctrl := NewController(newFakeStore(m), WithWebSocket(true))
+		conn, _, err := dial(t, &ctrl)
+		assert.NoError(t, err)
+		conn.ReadJSON(&ack{})
+
+		a := send(t, conn, 0, append(data, '!'))
+		assert.Equal(t, uint64(0), a.Offset)
+		assert.False(t, a.Complete)
+		assert.NotEmpty(t, a.Error)
+		_, err = os.Stat(m["a"].Path)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		a = send(t, conn, 0, data)
+		assert.Equal(t, ack{Offset: uint64(len(data)), Complete: true}, a)
+	})
+
+	t.Run("chunks sending the first bytes must be checked once they hold them", func(t *testing.T) {
+		html := []byte("<html><script>alert(1)</script></html>")
+		m := newUpload(t)
+		f := m["a"]
+		f.TotalSize = uint64(len(html))
+		m["a"] = f
+		policy := sniff.Policy{Deny: []string{"text/html"}}
+		ctrl := NewController(newFakeStore(m), WithWebSocket(true), WithContentTypePolicy(&policy))
+		conn, _, err := dial(t, &ctrl)
+		assert.NoError(t, err)
+		conn.ReadJSON(&ack{})
+
+		a := send(t, conn, 0, html[:6])
+		assert.Equal(t, ack{Offset: 6}, a)
+		a = send(t, conn, 6, html[6:])
+		assert.Equal(t, uint64(6), a.Offset)
+		assert.False(t, a.Complete)
+		assert.Contains(t, a.Error, sniff.ErrNotAllowed.Error())
+	})
+
+	t.Run("chunk resent once the upload is complete must be acknowledged without error", func(t *testing.T) {
+		m := newUpload(t)
+		ctrl := NewController(newFakeStore(m), WithWebSocket(true))
+		conn, _, err := dial(t, &ctrl)
+		assert.NoError(t, err)
+		conn.ReadJSON(&ack{})
+
+		send(t, conn, 0, data)
+		a := send(t, conn, 0, data)
+		assert.Equal(t, ack{Offset: uint64(len(data)), Complete: true}, a)
+
+		b, err := os.ReadFile(m["a"].Path)
+		assert.NoError(t, err)
+		assert.Equal(t, data, b)
+	})
+
+	t.Run("handshake without an origin must be forbidden", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)), WithWebSocket(true))
+		_, resp, err := dialFrom(t, &ctrl, func(string) string { return "" })
+		assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("handshake from another site must be forbidden", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)), WithWebSocket(true))
+		_, resp, err := dialFrom(t, &ctrl, func(string) string { return "https://evil.example.com" })
+		assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("handshake from an allowed origin must be accepted", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)), WithWebSocket(true), WithWebSocketOrigins("https://app.example.com"))
+		conn, _, err := dialFrom(t, &ctrl, func(string) string { return "https://app.example.com" })
+		assert.NoError(t, err)
+
+		var a ack
+		assert.NoError(t, conn.ReadJSON(&a))
+		assert.Equal(t, uint64(0), a.Offset)
+	})
+
+	t.Run("disabled websocket uploads must not be implemented", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(newUpload(t)))
+		_, resp, err := dial(t, &ctrl)
+		assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	})
+
+	t.Run("unknown upload must not be found", func(t *testing.T) {
+		ctrl := NewController(newFakeStore(map[string]File{}), WithWebSocket(true))
+		_, resp, err := dial(t, &ctrl)
+		assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestMinTransferRate(t *testing.T) {
+	newRouter := func(ctrl *Controller) *mux.Router {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		return router
+	}
+	newUpload := func(t *testing.T) map[string]File {
+		return map[string]File{
+			"a": {
+				ID:        "a",
+				Path:      filepath.Join(t.TempDir(), "file-upload-a"),
+				TotalSize: 1 << 20,
+				ExpiresAt: time.Now().Add(time.Minute),
+			},
+		}
+	}
+
+	t.Run("PATCH request trickling below the minimum rate must be aborted with 408 keeping its offset", func(t *testing.T) {
+		m := newUpload(t)
+		store := newFakeStore(m)
+		ctrl := NewController(store, WithMinTransferRate(1<<20, 20*time.Millisecond))
+
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("hello"))
+			for {
+				time.Sleep(5 * time.Millisecond)
+				if _, err := pw.Write([]byte("a")); err != nil {
+					return
+				}
+			}
+		}()
+		defer pr.Close()
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", pr)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, "0")
+		w := httptest.NewRecorder()
+		newRouter(&ctrl).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestTimeout, w.Code)
+		fm, _, _ := store.Find("a")
+		assert.GreaterOrEqual(t, fm.UploadedSize, uint64(5))
+		content, err := os.ReadFile(fm.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, fm.UploadedSize, uint64(len(content)))
+	})
+
+	t.Run("PATCH request above the minimum rate must be accepted", func(t *testing.T) {
+		m := newUpload(t)
+		store := newFakeStore(m)
+		ctrl := NewController(store, WithMinTransferRate(1024, 20*time.Millisecond))
+
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewReader(make([]byte, 1<<20)))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, "0")
+		w := httptest.NewRecorder()
+		newRouter(&ctrl).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		fm, _, _ := store.Find("a")
+		assert.True(t, fm.IsComplete())
+	})
+}
+
+func TestDirectIO(t *testing.T) {
+	data := make([]byte, 2<<20+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	t.Run("chunks written with direct I/O must be stored whatever their alignment", func(t *testing.T) {
+		m := map[string]File{
+			"a": {
+				ID:        "a",
+				Path:      filepath.Join(t.TempDir(), "file-upload-a"),
+				TotalSize: uint64(len(data)),
+				ExpiresAt: time.Now().Add(time.Minute),
+			},
+		}
+		store := newFakeStore(m)
+		ctrl := NewController(store, WithDirectIO(true))
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+
+		for _, chunk := range [][2]int{{0, 1 << 20}, {1 << 20, 1<<20 + 100}, {1<<20 + 100, len(data)}} {
+			req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewReader(data[chunk[0]:chunk[1]]))
+			req.Header.Set("Content-Type", "application/offset+octet-stream")
+			req.Header.Set(UploadOffsetHeader, fmt.Sprint(chunk[0]))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusNoContent, w.Code)
+			assert.Equal(t, fmt.Sprint(chunk[1]), w.Header().Get(UploadOffsetHeader))
+		}
+
+		fm, _, _ := store.Find("a")
+		assert.True(t, fm.IsComplete())
+		content, err := os.ReadFile(fm.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, data, content)
+	})
+}
+
+func TestRejectedChunk(t *testing.T) {
+	newRouter := func() *mux.Router {
+		ctrl := NewController(newFakeStore(map[string]File{
+			"a": {
+				ID:           "a",
+				Path:         filepath.Join(t.TempDir(), "file-upload-a"),
+				TotalSize:    1 << 20,
+				UploadedSize: 10,
+				ExpiresAt:    time.Now().Add(time.Minute),
+			},
+		}))
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		return router
+	}
+	patch := func(body io.Reader, contentLength int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", body)
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set(UploadOffsetHeader, "0")
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("rejected request with a large body must close the connection without reading it", func(t *testing.T) {
+		body := bytes.NewReader(make([]byte, 1<<20))
+
+		w := patch(body, 1<<20)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, "close", w.Header().Get("Connection"))
+		assert.Equal(t, 1<<20, body.Len())
+	})
+
+	t.Run("rejected request with a body of unknown length must close the connection", func(t *testing.T) {
+		w := patch(bytes.NewReader(make([]byte, 100)), -1)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, "close", w.Header().Get("Connection"))
+	})
+
+	t.Run("rejected request with a small body must drain it and keep the connection", func(t *testing.T) {
+		body := bytes.NewReader(make([]byte, 100))
+
+		w := patch(body, 100)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Empty(t, w.Header().Get("Connection"))
+		assert.Zero(t, body.Len())
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	t.Run("concurrent updates must all be applied", func(t *testing.T) {
+		s := NewStore()
+		s.Save("a", File{ID: "a"})
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Update("a", func(f *File) error {
+					f.UploadedSize++
+					return nil
+				})
+			}()
+		}
+		wg.Wait()
+
+		f, _, _ := s.Find("a")
+		assert.Equal(t, uint64(100), f.UploadedSize)
+	})
+
+	t.Run("failed update must not be saved", func(t *testing.T) {
+		s := NewStore()
+		s.Save("a", File{ID: "a"})
+
+		_, err := s.Update("a", func(f *File) error {
+			f.UploadedSize = 10
+			return assert.AnError
+		})
+
+		assert.ErrorIs(t, err, assert.AnError)
+		f, _, _ := s.Find("a")
+		assert.Equal(t, uint64(0), f.UploadedSize)
+	})
+
+	t.Run("update of a removed upload must not recreate it", func(t *testing.T) {
+		s := NewStore()
+
+		_, err := s.Update("a", func(f *File) error { return nil })
+
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, ok, _ := s.Find("a")
+		assert.False(t, ok)
+	})
+}
@@ -7,6 +7,9 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/imrenagi/go-http-upload/finalize"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/pipeline"
 )
 
 func NewFile() File {
@@ -15,10 +18,18 @@ func NewFile() File {
 		ID:            id,
 		IsDeferLength: true,
 		Path:          "/tmp/file-upload-" + id,
+		CreatedAt:     time.Now(),
 	}
 	return f
 }
 
+// Status of an upload as reported by the JSON endpoints.
+const (
+	StatusInProgress = "in_progress"
+	StatusCompleted  = "completed"
+	StatusExpired    = "expired"
+)
+
 type File struct {
 	ID            string
 	Name          string
@@ -29,11 +40,88 @@ type File struct {
 	ExpiresAt     time.Time
 	Path          string
 	IsDeferLength bool
+	Owner         string
+	Tenant        string
+	// ETag identifies the content of the upload once it is complete.
+	ETag      string
+	CreatedAt time.Time
+	// Tag is an optional label given in the metadata, used to group uploads.
+	Tag string
+	// IdempotencyKey is the key the upload was created with, if any.
+	IdempotencyKey string
+	// Thumbnails are the sizes of the thumbnails generated for the upload.
+	Thumbnails []int
+	// CDNURL is a CDN signed URL of the completed upload, valid until
+	// CDNURLExpiresAt.
+	CDNURL          string
+	CDNURLExpiresAt time.Time
+	// Metadata holds every key-value pair given in the Upload-Metadata
+	// header.
+	Metadata map[string]string
+	// Processing is the status of the post-processing steps of the
+	// completed upload.
+	Processing []pipeline.Step
+	// Quarantined is set when post-processing found the upload harmful. It
+	// is then never served.
+	Quarantined bool
+	// SniffedContentType is the content type detected from the first bytes
+	// of the upload, when a content type policy is enforced.
+	// ContentTypeMismatch flags when it contradicts ContentType.
+	SniffedContentType  string
+	ContentTypeMismatch bool
+	// SourceURL is the URL an imported upload is fetched from, and
+	// ImportError why fetching it failed.
+	SourceURL   string
+	ImportError string
+	// Completion records the outcome of the upload once it is complete.
+	Completion *hooks.Completion
+	// Finalization is the status of the finalization of an upload
+	// finalized in the background.
+	Finalization finalize.Status
+	// Received records the blocks received of a sparse upload.
+	Received blockBitmap
+	// Parts are the parts of a multipart upload not completed yet, by part
+	// number. It is nil for the other uploads.
+	Parts map[int]Part
+	// Completing is set while the parts of a multipart upload are
+	// assembled, no part may be uploaded then.
+	Completing bool
+}
+
+// IsComplete reports whether every byte of the upload has been received.
+func (f File) IsComplete() bool {
+	return !f.IsDeferLength && f.UploadedSize == f.TotalSize
+}
+
+// StoredSize returns the bytes the upload takes in the quotas: its length,
+// or the bytes received so far when they are more, e.g. while its length is
+// deferred.
+func (f File) StoredSize() uint64 {
+	return max(f.TotalSize, f.UploadedSize)
+}
+
+func (f File) Status() string {
+	switch {
+	case f.IsComplete():
+		return StatusCompleted
+	case !f.ExpiresAt.IsZero() && f.ExpiresAt.Before(time.Now()):
+		return StatusExpired
+	default:
+		return StatusInProgress
+	}
+}
+
+// FilePath returns the location of the uploaded data on disk.
+func (f File) FilePath() string {
+	if f.Path != "" {
+		return f.Path
+	}
+	return "/tmp/file-upload-" + f.ID
 }
 
 func (f *File) ParseMetadata(m string) error {
-	md := make(map[string]string)
 	kvs := strings.Split(m, ",")
+	md := make(map[string]string, len(kvs))
 	for _, kv := range kvs {
 		if kv == "" {
 			continue
@@ -63,5 +151,36 @@ func (f *File) ParseMetadata(m string) error {
 	f.Name = name
 	f.ContentType = contentType
 	f.Checksum = checksum
+	f.Tag = md["tag"]
+	f.Metadata = md
 	return nil
 }
+
+func (f File) hookUpload() hooks.Upload {
+	return hooks.Upload{
+		ID:            f.ID,
+		Tenant:        f.Tenant,
+		Owner:         f.Owner,
+		Size:          f.TotalSize,
+		IsDeferLength: f.IsDeferLength,
+		Offset:        f.UploadedSize,
+		Metadata:      f.Metadata,
+		ExpiresAt:     f.ExpiresAt,
+		Completion:    f.Completion,
+	}
+}
+
+// completion returns the completion record of the upload, completed now,
+// with the checksums of its content.
+func (f File) completion(checksums map[string]string) *hooks.Completion {
+	now := time.Now().UTC()
+	return &hooks.Completion{
+		Size:        f.TotalSize,
+		Checksums:   checksums,
+		Metadata:    f.Metadata,
+		StorageURI:  "file://" + f.FilePath(),
+		StartedAt:   f.CreatedAt.UTC(),
+		CompletedAt: now,
+		Duration:    now.Sub(f.CreatedAt),
+	}
+}
@@ -0,0 +1,503 @@
+package v3
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/bufpool"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/metrics"
+	"github.com/imrenagi/go-http-upload/sniff"
+)
+
+const (
+	// MaxPartNumber is the highest part number of a multipart upload.
+	MaxPartNumber = 10000
+	// DefaultMinPartSize is the minimum size of every part of a multipart
+	// upload but the last, as in S3.
+	DefaultMinPartSize = 5 << 20
+)
+
+var (
+	errCompleting    = errors.New("the upload is being completed")
+	errPartsTooLarge = errors.New("upload length exceeds the maximum size")
+)
+
+// Part is a part of a multipart upload, stored on its own until the upload
+// is completed.
+type Part struct {
+	Size uint64
+	// ETag is the quoted hex md5 of the content of the part.
+	ETag string
+	// Path is the location of the content of the part on disk.
+	Path string
+}
+
+// partPath returns the location of the parts of fm on disk, suffixed by
+// each attempt to send them.
+func partPath(fm File, number int) string {
+	return fmt.Sprintf("%s.part-%d", fm.FilePath(), number)
+}
+
+type initiateMultipartRequest struct {
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+type initiateMultipartResponse struct {
+	UploadID string `json:"upload_id"`
+}
+
+// InitiateMultipart creates an upload whose parts are sent with UploadPart,
+// in any order and concurrently, then assembled by CompleteMultipart.
+func (c *Controller) InitiateMultipart() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		if !c.multipart {
+			writeError(w, http.StatusNotImplemented, errors.New("multipart uploads are not enabled"))
+			return
+		}
+		if p, ok := auth.FromContext(r.Context()); ok && !p.HasRole(auth.RoleUploader) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		var req initiateMultipartRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+		if req.Filename == "" {
+			writeError(w, http.StatusBadRequest, errors.New("missing filename"))
+			return
+		}
+
+		fm := NewFile()
+		fm.ExpiresAt = time.Now().Add(UploadMaxDuration)
+		// the length is known once the parts are assembled.
+		fm.IsDeferLength = true
+		fm.Parts = map[int]Part{}
+		fm.Name = req.Filename
+		fm.ContentType = req.ContentType
+		fm.Metadata = make(map[string]string, len(req.Metadata)+2)
+		for k, v := range req.Metadata {
+			fm.Metadata[k] = v
+		}
+		fm.Metadata["filename"] = fm.Name
+		fm.Metadata["content-type"] = fm.ContentType
+		fm.Checksum = fm.Metadata["checksum"]
+		fm.Tag = fm.Metadata["tag"]
+		if fm.ContentType != "" && c.contentType != nil && !c.contentType.Allowed(fm.ContentType) {
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", sniff.ErrNotAllowed, fm.ContentType))
+			return
+		}
+		if p, ok := auth.FromContext(r.Context()); ok {
+			fm.Owner = p.Subject
+		}
+		fm.Tenant = auth.TenantFromContext(r.Context())
+		r, log = withUpload(r, log, fm)
+		if err := c.disk.CheckCreate(); err != nil {
+			log.Warn().Msg("multipart upload rejected, the upload directory is past its disk usage threshold")
+			writeError(w, http.StatusInsufficientStorage, err)
+			return
+		}
+
+		if err := c.hooks.PreCreate(r.Context(), fm.hookUpload()); err != nil {
+			log.Debug().Err(err).Msg("upload rejected by the pre-create hook")
+			writeError(w, hooks.StatusCode(err), err)
+			return
+		}
+		dir := filepath.Join(c.uploadDir, fm.Tenant)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("error creating the upload directory")
+			writeError(w, http.StatusInternalServerError, errors.New("error creating the upload directory"))
+			return
+		}
+		fm.Path = filepath.Join(dir, "file-upload-"+fm.ID)
+
+		// the parts are reserved in the quotas as they are received; an
+		// owner or a tenant already out of quota can't start one.
+		if err := c.store.Create(fm, c.quota); err != nil {
+			log.Debug().Err(err).Msg("multipart upload rejected by the quota")
+			writeError(w, quotaStatus(err), err)
+			return
+		}
+		c.hooks.PostCreate(r.Context(), fm.hookUpload())
+		c.metrics.Created(r.Context())
+
+		w.Header().Set("Location", fmt.Sprintf("http://127.0.0.1:8080/files/%s", fm.ID))
+		w.Header().Set(ContentTypeHeader, "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(initiateMultipartResponse{UploadID: fm.ID})
+	}
+}
+
+// findMultipart looks up the multipart upload of the request, writing the
+// error response when it can't receive parts.
+func (c *Controller) findMultipart(w http.ResponseWriter, r *http.Request) (File, bool) {
+	if !c.multipart {
+		writeError(w, http.StatusNotImplemented, errors.New("multipart uploads are not enabled"))
+		return File{}, false
+	}
+	fm, ok, err := c.find(r, mux.Vars(r)["file_id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("file not found"))
+		return File{}, false
+	}
+	if err != nil {
+		c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+		writeError(w, http.StatusInternalServerError, err)
+		return File{}, false
+	}
+	if !auth.CanAccess(r.Context(), fm.Owner) {
+		writeError(w, http.StatusForbidden, auth.ErrForbidden)
+		return File{}, false
+	}
+	if fm.Parts == nil {
+		writeError(w, http.StatusConflict, errors.New("the upload isn't a multipart upload"))
+		return File{}, false
+	}
+	if fm.IsComplete() {
+		writeError(w, http.StatusConflict, errors.New("the upload is complete"))
+		return File{}, false
+	}
+	if fm.ExpiresAt.Before(time.Now()) {
+		c.hooks.PostExpire(r.Context(), fm.hookUpload())
+		c.metrics.Failed(r.Context(), metrics.ReasonExpired)
+		writeError(w, http.StatusGone, errors.New("file expired"))
+		return File{}, false
+	}
+	return fm, true
+}
+
+// UploadPart stores the part whose number is in the path, replacing the
+// part sent before with the same number, and answers its etag.
+func (c *Controller) UploadPart() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		r.Body = http.MaxBytesReader(w, r.Body, 64<<20) //64MB
+		fm, ok := c.findMultipart(w, r)
+		if !ok {
+			return
+		}
+		r, log = withUpload(r, log, fm)
+
+		number, err := strconv.Atoi(mux.Vars(r)["part_number"])
+		if err != nil || number < 1 || number > MaxPartNumber {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("part number must be between 1 and %d", MaxPartNumber))
+			return
+		}
+
+		body := io.Reader(r.Body)
+		if c.contentType != nil && number == 1 {
+			// sniff the first bytes before any of them is written. A
+			// shorter part is checked once the parts are assembled.
+			br := bufio.NewReaderSize(r.Body, sniff.Len)
+			head, _ := br.Peek(sniff.Len)
+			body = br
+			if len(head) == sniff.Len {
+				if _, err := c.contentType.Check(fm.ContentType, sniff.Detect(head)); err != nil {
+					log.Debug().Err(err).Msg("content type rejected")
+					writeError(w, http.StatusUnsupportedMediaType, err)
+					return
+				}
+			}
+		}
+
+		// each attempt is written in its own file, so that a failed one
+		// doesn't replace the part sent before.
+		path := partPath(fm, number)
+		f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*")
+		if err != nil {
+			log.Error().Err(err).Msg("error creating the part")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, errors.New("error creating the part"))
+			return
+		}
+		recorded := false
+		defer func() {
+			if !recorded {
+				os.Remove(f.Name())
+			}
+		}()
+		defer f.Close()
+
+		start := time.Now()
+		sum := md5.New()
+		n, err := bufpool.Default.Copy(f, io.TeeReader(body, sum))
+		if err != nil {
+			log.Error().Err(err).Msg("error writing the part")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error writing the part: %w", err))
+			return
+		}
+		if err := f.Close(); err != nil {
+			log.Error().Err(err).Msg("error writing the part")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error writing the part: %w", err))
+			return
+		}
+		part := Part{Size: uint64(n), ETag: `"` + hex.EncodeToString(sum.Sum(nil)) + `"`, Path: f.Name()}
+
+		// the part is recorded under the lock of the store, within the
+		// quotas, so that none of them is lost by concurrent requests nor
+		// replaced while the upload is assembled.
+		var replaced Part
+		fm, err = c.store.Reserve(fm.ID, c.quota, func(stored *File) error {
+			if stored.Parts == nil {
+				return ErrNotFound
+			}
+			if stored.Completing {
+				return errCompleting
+			}
+			var total uint64
+			for other, p := range stored.Parts {
+				if other != number {
+					total += p.Size
+				}
+			}
+			if c.maxSize > 0 && total+part.Size > c.maxSize {
+				return errPartsTooLarge
+			}
+			replaced = stored.Parts[number]
+			// the stored map may be read concurrently, it is updated in a
+			// copy.
+			stored.Parts = maps.Clone(stored.Parts)
+			stored.Parts[number] = part
+			stored.UploadedSize = total + part.Size
+			return nil
+		})
+		switch {
+		case errors.Is(err, ErrNotFound):
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		case errors.Is(err, errCompleting):
+			writeError(w, http.StatusConflict, err)
+			return
+		case errors.Is(err, errPartsTooLarge):
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		case err != nil:
+			log.Debug().Err(err).Msg("part rejected by the quota")
+			writeError(w, quotaStatus(err), err)
+			return
+		}
+		recorded = true
+		if replaced.Path != "" {
+			os.Remove(replaced.Path)
+		}
+		c.metrics.Received(r.Context(), n)
+		c.metrics.Chunk(r.Context(), n, time.Since(start))
+		c.hooks.PostReceiveChunk(r.Context(), fm.hookUpload())
+
+		log.Debug().Int("part_number", number).Int64("written_size", n).Msg("part written")
+		w.Header().Set("ETag", part.ETag)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type completedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+type completeMultipartRequest struct {
+	Parts []completedPart `json:"parts"`
+}
+
+// CompleteMultipart assembles the parts listed in the request, in
+// ascending part numbers, into the content of the upload. Their etags must
+// be the ones answered by UploadPart, and every part but the last at least
+// the minimum part size. Parts which aren't listed are discarded.
+func (c *Controller) CompleteMultipart() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		fm, ok := c.findMultipart(w, r)
+		if !ok {
+			return
+		}
+		r, log = withUpload(r, log, fm)
+
+		var req completeMultipartRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+		if len(req.Parts) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("missing parts"))
+			return
+		}
+
+		// the upload is marked as completing, so that no part is replaced
+		// while it is assembled, without blocking the other uploads.
+		fm, err := c.store.Update(fm.ID, func(f *File) error {
+			if f.Parts == nil || f.IsComplete() {
+				return ErrNotFound
+			}
+			if f.Completing {
+				return errCompleting
+			}
+			f.Completing = true
+			return nil
+		})
+		switch {
+		case errors.Is(err, errCompleting):
+			writeError(w, http.StatusConflict, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		completed := false
+		defer func() {
+			if !completed {
+				c.store.Update(fm.ID, func(f *File) error {
+					f.Completing = false
+					return nil
+				})
+			}
+		}()
+
+		var size uint64
+		for i, cp := range req.Parts {
+			if i > 0 && cp.PartNumber <= req.Parts[i-1].PartNumber {
+				writeError(w, http.StatusBadRequest, errors.New("parts must be listed in ascending part numbers"))
+				return
+			}
+			part, ok := fm.Parts[cp.PartNumber]
+			if !ok || part.ETag != cp.ETag {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("part %d was not uploaded with etag %s", cp.PartNumber, cp.ETag))
+				return
+			}
+			if i < len(req.Parts)-1 && part.Size < c.minPartSize {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("part %d is smaller than %d bytes", cp.PartNumber, c.minPartSize))
+				return
+			}
+			size += part.Size
+		}
+
+		if c.contentType != nil {
+			// the first part listed may not be the first part sent, and
+			// may be shorter than the bytes the detection looks at.
+			head, err := partsHead(fm, req.Parts)
+			if err != nil {
+				log.Error().Err(err).Msg("error reading the parts")
+				c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+				writeError(w, http.StatusInternalServerError, errors.New("error reading the parts"))
+				return
+			}
+			if len(head) > 0 {
+				fm.SniffedContentType = sniff.Detect(head)
+				mismatch, err := c.contentType.Check(fm.ContentType, fm.SniffedContentType)
+				if err != nil {
+					log.Debug().Err(err).Msg("content type rejected")
+					writeError(w, http.StatusUnsupportedMediaType, err)
+					return
+				}
+				fm.ContentTypeMismatch = mismatch
+			}
+		}
+
+		// the parts were reserved in the quotas as they were received.
+		fm.TotalSize = size
+		if err := assembleParts(fm, req.Parts); err != nil {
+			log.Error().Err(err).Msg("error assembling the parts")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, errors.New("error assembling the parts"))
+			return
+		}
+		removeParts(fm)
+
+		fm.IsDeferLength = false
+		fm.UploadedSize = size
+		fm.Parts = map[int]Part{}
+		fm.Completing = false
+		if _, err := c.store.Update(fm.ID, func(f *File) error {
+			f.TotalSize = fm.TotalSize
+			f.IsDeferLength = false
+			f.UploadedSize = fm.UploadedSize
+			f.Parts = fm.Parts
+			f.Completing = false
+			f.SniffedContentType = fm.SniffedContentType
+			f.ContentTypeMismatch = fm.ContentTypeMismatch
+			return nil
+		}); err != nil {
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		completed = true
+		c.finish(r.Context(), &fm)
+
+		w.Header().Set(ContentTypeHeader, "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(newFileMetadataResponse(fm))
+	}
+}
+
+// removeParts removes the parts of fm from the disk.
+func removeParts(fm File) {
+	for _, part := range fm.Parts {
+		os.Remove(part.Path)
+	}
+}
+
+// assembleParts concatenates the parts into the file of the upload.
+func assembleParts(fm File, parts []completedPart) error {
+	f, err := os.OpenFile(fm.FilePath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, cp := range parts {
+		if err := appendPart(f, fm.Parts[cp.PartNumber].Path); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// partsHead returns the first sniff.Len bytes of the content the parts
+// assemble.
+func partsHead(fm File, parts []completedPart) ([]byte, error) {
+	head := make([]byte, 0, sniff.Len)
+	for _, cp := range parts {
+		if len(head) == sniff.Len {
+			break
+		}
+		f, err := os.Open(fm.Parts[cp.PartNumber].Path)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(f, head[len(head):sniff.Len])
+		f.Close()
+		head = head[:len(head)+n]
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+	}
+	return head, nil
+}
+
+func appendPart(dst io.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = bufpool.Default.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,57 @@
+package v3
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrTenantQuotaExceeded is returned by Storage.Create and
+	// Storage.Reserve when the uploads of the tenant would take more than
+	// its quota.
+	ErrTenantQuotaExceeded = errors.New("tenant storage quota exceeded")
+	// ErrUserQuotaExceeded is returned by Storage.Create and
+	// Storage.Reserve when the uploads of the owner would take more than
+	// its quota.
+	ErrUserQuotaExceeded = errors.New("user storage quota exceeded")
+)
+
+// Quota limits the total size, in bytes, of the uploads a tenant and an
+// owner may keep at the same time. Zero means unlimited.
+type Quota struct {
+	Tenant uint64
+	User   uint64
+}
+
+// Check returns the error of the quota exceeded by storing f, given the
+// size of the other uploads of its tenant and of its owner. An upload whose
+// length is deferred is refused once the quota is exhausted, since its
+// bytes are only counted as they are received.
+func (q Quota) Check(f File, tenantUsage, ownerUsage uint64) error {
+	size := f.StoredSize()
+	if f.IsDeferLength {
+		size = max(size, 1)
+	}
+	if q.Tenant > 0 && tenantUsage+size > q.Tenant {
+		return ErrTenantQuotaExceeded
+	}
+	if q.User > 0 && f.Owner != "" && ownerUsage+size > q.User {
+		return ErrUserQuotaExceeded
+	}
+	return nil
+}
+
+// quotaStatus returns the status of the response to a request failing to
+// reserve storage with err.
+func quotaStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTenantQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUserQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,277 @@
+package v3
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/bufpool"
+	"github.com/imrenagi/go-http-upload/metrics"
+	"github.com/imrenagi/go-http-upload/sniff"
+)
+
+const (
+	// SparseBlockSize is the granularity of the chunks of sparse uploads.
+	// Their offset must be a multiple of it, and so must be their length
+	// unless they end the upload.
+	SparseBlockSize = 64 << 10
+
+	// UploadBlockSizeHeader advertises SparseBlockSize.
+	UploadBlockSizeHeader = "Upload-Block-Size"
+	// UploadReceivedRangesHeader lists the byte ranges of a sparse upload
+	// received so far, e.g. "0-65535,131072-196607".
+	UploadReceivedRangesHeader = "Upload-Received-Ranges"
+)
+
+var errStartedWithPatch = errors.New("the upload was started with PATCH requests")
+
+// blockBitmap records the blocks of SparseBlockSize bytes received of a
+// sparse upload.
+type blockBitmap []byte
+
+func newBlockBitmap(size uint64) blockBitmap {
+	return make(blockBitmap, (blockCount(size)+7)/8)
+}
+
+func blockCount(size uint64) uint64 {
+	return (size + SparseBlockSize - 1) / SparseBlockSize
+}
+
+func (b blockBitmap) set(block uint64) {
+	b[block/8] |= 1 << (block % 8)
+}
+
+func (b blockBitmap) has(block uint64) bool {
+	return b[block/8]&(1<<(block%8)) != 0
+}
+
+// received returns the number of bytes of an upload of size bytes covered
+// by the received blocks.
+func (b blockBitmap) received(size uint64) uint64 {
+	var n uint64
+	for block := uint64(0); block < blockCount(size); block++ {
+		if b.has(block) {
+			n += min(SparseBlockSize, size-block*SparseBlockSize)
+		}
+	}
+	return n
+}
+
+// ranges formats the received byte ranges of an upload of size bytes.
+func (b blockBitmap) ranges(size uint64) string {
+	var ranges []string
+	count := blockCount(size)
+	for block := uint64(0); block < count; block++ {
+		if !b.has(block) {
+			continue
+		}
+		start := block
+		for block+1 < count && b.has(block+1) {
+			block++
+		}
+		end := min((block+1)*SparseBlockSize, size) - 1
+		ranges = append(ranges, fmt.Sprintf("%d-%d", start*SparseBlockSize, end))
+	}
+	return strings.Join(ranges, ",")
+}
+
+// UploadChunk writes a chunk of a sparse upload at the offset given by its
+// Upload-Offset header. Chunks may be sent in any order and concurrently;
+// the upload completes once every byte of its length was received. An
+// upload resumed with PATCH can't be continued sparsely, and conversely.
+func (c *Controller) UploadChunk() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		if !c.extensions.Enabled(SparseExtension) {
+			rejectChunk(w, r, http.StatusNotImplemented, errors.New("sparse uploads are not enabled"))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 64<<20) //64MB
+
+		contentType := r.Header.Get(ContentTypeHeader)
+		if contentType != "application/offset+octet-stream" {
+			rejectChunk(w, r, http.StatusUnsupportedMediaType, errors.New("invalid Content-Type header: expected application/offset+octet-stream"))
+			return
+		}
+		var checksum checksum
+		if c.extensions.Enabled(ChecksumExtension) {
+			var err error
+			checksum, err = newChecksum(r.Header.Get(UploadChecksumHeader))
+			if err != nil {
+				rejectChunk(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		fm, ok, err := c.find(r, mux.Vars(r)["file_id"])
+		if !ok {
+			rejectChunk(w, r, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		if err != nil {
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			rejectChunk(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !auth.CanAccess(r.Context(), fm.Owner) {
+			rejectChunk(w, r, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if c.extensions.Enabled(ExpirationExtension) && fm.ExpiresAt.Before(time.Now()) {
+			c.hooks.PostExpire(r.Context(), fm.hookUpload())
+			c.metrics.Failed(r.Context(), metrics.ReasonExpired)
+			rejectChunk(w, r, http.StatusGone, errors.New("file expired"))
+			return
+		}
+		if fm.IsDeferLength {
+			rejectChunk(w, r, http.StatusConflict, errors.New("sparse uploads require an upload length"))
+			return
+		}
+		if fm.Received == nil && fm.UploadedSize > 0 {
+			rejectChunk(w, r, http.StatusConflict, errStartedWithPatch)
+			return
+		}
+		if fm.IsComplete() {
+			rejectChunk(w, r, http.StatusConflict, errors.New("the upload is complete"))
+			return
+		}
+
+		offset, err := strconv.ParseUint(r.Header.Get(UploadOffsetHeader), 10, 64)
+		if err != nil {
+			rejectChunk(w, r, http.StatusBadRequest, errors.New("invalid Upload-Offset header: not a number"))
+			return
+		}
+		if offset%SparseBlockSize != 0 || offset >= fm.TotalSize {
+			rejectChunk(w, r, http.StatusBadRequest, fmt.Errorf("upload-Offset must be a multiple of %d below the upload length", SparseBlockSize))
+			return
+		}
+
+		if c.contentType != nil && offset == 0 {
+			// sniff the first bytes before any of them is written. They
+			// must all be sent in the first chunk, since the next chunks
+			// are written wherever they belong.
+			br := bufio.NewReaderSize(r.Body, sniff.Len)
+			head, _ := br.Peek(sniff.Len)
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{br, r.Body}
+			if need := min(sniff.Len, int(fm.TotalSize)); len(head) < need {
+				rejectChunk(w, r, http.StatusBadRequest, fmt.Errorf("the chunk at offset 0 must hold the first %d bytes of the upload", need))
+				return
+			}
+			if _, err := c.contentType.Check(fm.ContentType, sniff.Detect(head)); err != nil {
+				log.Debug().Err(err).Msg("content type rejected")
+				rejectChunk(w, r, http.StatusUnsupportedMediaType, err)
+				return
+			}
+		}
+
+		var body io.Reader = r.Body
+		sum := getHash(checksum.Algorithm)
+		if sum != nil {
+			defer putHash(checksum.Algorithm, sum)
+			body = io.TeeReader(body, sum)
+		}
+
+		f, err := os.OpenFile(fm.FilePath(), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Error().Err(err).Msg("error opening the file")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, errors.New("error opening the file"))
+			return
+		}
+		defer f.Close()
+		// preallocate the file, so that the chunks are written in place.
+		if st, err := f.Stat(); err == nil && uint64(st.Size()) < fm.TotalSize {
+			if err := f.Truncate(int64(fm.TotalSize)); err != nil {
+				log.Error().Err(err).Msg("error preallocating the file")
+				c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+				writeError(w, http.StatusInternalServerError, errors.New("error preallocating the file"))
+				return
+			}
+		}
+
+		start := time.Now()
+		n, err := bufpool.Default.Copy(io.NewOffsetWriter(f, int64(offset)), io.LimitReader(body, int64(fm.TotalSize-offset)))
+		if err != nil {
+			log.Error().Err(err).Msg("error writing the chunk")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error writing the chunk: %w", err))
+			return
+		}
+		if extra, _ := body.Read(make([]byte, 1)); extra > 0 {
+			writeError(w, http.StatusRequestEntityTooLarge, errors.New("chunk exceeds the upload length"))
+			return
+		}
+		end := offset + uint64(n)
+		if n == 0 || (end != fm.TotalSize && n%SparseBlockSize != 0) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("chunk length must be a multiple of %d unless it ends the upload", SparseBlockSize))
+			return
+		}
+		if sum != nil && !checksum.matches(sum) {
+			// the blocks aren't recorded, they are written again by the
+			// next attempt.
+			c.metrics.Failed(r.Context(), metrics.ReasonChecksumMismatch)
+			writeError(w, 460, errors.New("checksum mismatch"))
+			return
+		}
+		c.metrics.Received(r.Context(), n)
+		c.metrics.Chunk(r.Context(), n, time.Since(start))
+
+		// the blocks are recorded under the lock of the store, so that
+		// none of them is lost by concurrent requests.
+		var wasComplete bool
+		fm, err = c.store.Update(fm.ID, func(f *File) error {
+			if f.Received == nil && f.UploadedSize > 0 {
+				return errStartedWithPatch
+			}
+			// the stored bitmap may be read concurrently, it is updated
+			// in a copy.
+			received := newBlockBitmap(f.TotalSize)
+			copy(received, f.Received)
+			for block := offset / SparseBlockSize; block < blockCount(end); block++ {
+				received.set(block)
+			}
+			wasComplete = f.IsComplete()
+			f.Received = received
+			f.UploadedSize = received.received(f.TotalSize)
+			return nil
+		})
+		switch {
+		case errors.Is(err, errStartedWithPatch):
+			writeError(w, http.StatusConflict, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		c.hooks.PostReceiveChunk(r.Context(), fm.hookUpload())
+
+		if fm.IsComplete() && !wasComplete {
+			c.finish(r.Context(), &fm)
+		}
+
+		log.Debug().
+			Uint64("offset", offset).
+			Int64("written_size", n).
+			Uint64("received_size", fm.UploadedSize).
+			Msg("chunk written")
+
+		w.Header().Set(UploadOffsetHeader, strconv.FormatUint(fm.UploadedSize, 10))
+		w.Header().Set(UploadReceivedRangesHeader, fm.Received.ranges(fm.TotalSize))
+		if !fm.ExpiresAt.IsZero() {
+			w.Header().Add(UploadExpiresHeader, uploadExpiresAt(fm.ExpiresAt))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,138 @@
+//go:build linux && splice
+
+package v3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxSpliceSize is the largest chunk moved by spliceChunk, the limit of the
+// body of the PATCH requests.
+const maxSpliceSize = 64 << 20
+
+// splicedChunk is a chunk moved from the connection to the file by the
+// kernel. The connection is hijacked: w must be used to answer the request,
+// and done called once it is.
+type splicedChunk struct {
+	w    http.ResponseWriter
+	done func()
+	n    int64
+	err  error
+}
+
+// spliceChunk moves the body of r to the end of f, whose size is pos,
+// without copying it through user space: os.File.ReadFrom splices the bytes
+// of a TCP connection into a file. It only applies to the plain chunks,
+// neither sniffed, rate limited nor written with direct I/O, of HTTP/1.x
+// requests with a Content-Length and no Expect header, whose connection
+// can be hijacked; it returns nil otherwise, without reading the body.
+//
+// The connection is closed once the request is answered, since it can't be
+// given back to the server.
+func (c *Controller) spliceChunk(w http.ResponseWriter, r *http.Request, fileID string, offset uint64, f *os.File, pos int64) *splicedChunk {
+	if r.ProtoMajor != 1 || r.ContentLength <= 0 || r.ContentLength > maxSpliceSize ||
+		len(r.TransferEncoding) > 0 || r.Header.Get("Expect") != "" ||
+		(c.contentType != nil && offset == 0) || c.minRate > 0 || c.directIO {
+		return nil
+	}
+	// splice can't write to a file opened with O_APPEND.
+	dst, err := os.OpenFile(f.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		return nil
+	}
+	if _, err := dst.Seek(pos, io.SeekStart); err != nil {
+		dst.Close()
+		return nil
+	}
+	header := w.Header().Clone()
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		dst.Close()
+		return nil
+	}
+
+	n, err := spliceBody(r.Context(), fileID, offset, dst, conn, brw.Reader, r.ContentLength)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	hw := &hijackedWriter{conn: conn, brw: brw, proto: r.Proto, header: header}
+	return &splicedChunk{w: hw, done: hw.flush, n: n, err: err}
+}
+
+// spliceBody writes the size bytes of a body to dst, first those already
+// buffered by br then those of conn, in a span as copyChunk does.
+func spliceBody(ctx context.Context, fileID string, offset uint64, dst *os.File, conn net.Conn, br *bufio.Reader, size int64) (int64, error) {
+	_, span := tracer.Start(ctx, "upload.copy", trace.WithAttributes(
+		attribute.String("file_id", fileID),
+		attribute.Int64("offset", int64(offset)),
+		attribute.Bool("splice", true),
+	))
+	defer span.End()
+
+	n, err := io.CopyN(dst, br, min(int64(br.Buffered()), size))
+	if err == nil {
+		var m int64
+		// the limited reader of a TCP connection is spliced by ReadFrom.
+		m, err = dst.ReadFrom(&io.LimitedReader{R: conn, N: size - n})
+		n += m
+		if err == nil && n < size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	span.SetAttributes(attribute.Int64("bytes_written", n))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error copying the chunk")
+	}
+	return n, err
+}
+
+// hijackedWriter answers a request whose connection was hijacked. The
+// response is buffered until flush writes it and closes the connection.
+type hijackedWriter struct {
+	conn   net.Conn
+	brw    *bufio.ReadWriter
+	proto  string
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *hijackedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *hijackedWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *hijackedWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (w *hijackedWriter) flush() {
+	defer w.conn.Close()
+	w.WriteHeader(http.StatusOK)
+	w.header.Set("Connection", "close")
+	w.header.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	fmt.Fprintf(w.brw, "%s %d %s\r\n", w.proto, w.code, http.StatusText(w.code))
+	w.header.Write(w.brw)
+	w.brw.WriteString("\r\n")
+	w.brw.Write(w.body.Bytes())
+	w.brw.Flush()
+}
@@ -0,0 +1,58 @@
+//go:build linux && splice
+
+package v3_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/imrenagi/go-http-upload/api/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpliceChunk(t *testing.T) {
+	data := make([]byte, 3<<20+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	store := newFakeStore(map[string]File{
+		"a": {
+			ID:        "a",
+			Path:      filepath.Join(t.TempDir(), "file-upload-a"),
+			TotalSize: uint64(len(data)),
+			ExpiresAt: time.Now().Add(time.Minute),
+		},
+	})
+	ctrl := NewController(store)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	t.Run("chunks spliced from the connection must be stored", func(t *testing.T) {
+		for _, chunk := range [][2]int{{0, 1 << 20}, {1 << 20, len(data)}} {
+			req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/api/v1/files/a", bytes.NewReader(data[chunk[0]:chunk[1]]))
+			req.Header.Set("Content-Type", "application/offset+octet-stream")
+			req.Header.Set(UploadOffsetHeader, fmt.Sprint(chunk[0]))
+			resp, err := srv.Client().Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+			assert.Equal(t, fmt.Sprint(chunk[1]), resp.Header.Get(UploadOffsetHeader))
+			assert.True(t, resp.Close)
+		}
+
+		fm, _, _ := store.Find("a")
+		assert.True(t, fm.IsComplete())
+		content, err := os.ReadFile(fm.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, data, content)
+	})
+}
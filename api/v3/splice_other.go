@@ -0,0 +1,21 @@
+//go:build !linux || !splice
+
+package v3
+
+import (
+	"net/http"
+	"os"
+)
+
+// splicedChunk is only moved by the kernel on Linux, when built with the
+// splice tag.
+type splicedChunk struct {
+	w    http.ResponseWriter
+	done func()
+	n    int64
+	err  error
+}
+
+func (c *Controller) spliceChunk(w http.ResponseWriter, r *http.Request, fileID string, offset uint64, f *os.File, pos int64) *splicedChunk {
+	return nil
+}
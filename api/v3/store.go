@@ -1,6 +1,14 @@
 package v3
 
-import "sync"
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned by Storage.Update when the upload doesn't exist,
+// e.g. it was terminated.
+var ErrNotFound = errors.New("upload not found")
 
 type Store struct {
 	sync.RWMutex
@@ -25,3 +33,157 @@ func (s *Store) Save(id string, metadata File) {
 	defer s.Unlock()
 	s.files[id] = metadata
 }
+
+func (s *Store) Update(id string, fn func(f *File) error) (File, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, exists := s.files[id]
+	if !exists {
+		return File{}, ErrNotFound
+	}
+	if err := fn(&f); err != nil {
+		return File{}, err
+	}
+	s.files[id] = f
+	return f, nil
+}
+
+func (s *Store) Create(f File, q Quota) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkQuota(f, q); err != nil {
+		return err
+	}
+	s.files[f.ID] = f
+	return nil
+}
+
+func (s *Store) Reserve(id string, q Quota, fn func(f *File) error) (File, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, exists := s.files[id]
+	if !exists {
+		return File{}, ErrNotFound
+	}
+	size := f.StoredSize()
+	if err := fn(&f); err != nil {
+		return File{}, err
+	}
+	// uploads already stored stay within a quota lowered since, as long
+	// as they don't grow.
+	if f.StoredSize() > size {
+		if err := s.checkQuota(f, q); err != nil {
+			return File{}, err
+		}
+	}
+	s.files[id] = f
+	return f, nil
+}
+
+// checkQuota checks f against q, counting the other uploads of its tenant
+// and of its owner. The store must be locked.
+func (s *Store) checkQuota(f File, q Quota) error {
+	var tenantUsage, ownerUsage uint64
+	for _, other := range s.files {
+		if other.ID == f.ID {
+			continue
+		}
+		if other.Tenant == f.Tenant {
+			tenantUsage += other.StoredSize()
+		}
+		if other.Owner == f.Owner {
+			ownerUsage += other.StoredSize()
+		}
+	}
+	return q.Check(f, tenantUsage, ownerUsage)
+}
+
+func (s *Store) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.files, id)
+	return nil
+}
+
+func (s *Store) Usage(tenant string) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var total uint64
+	for _, f := range s.files {
+		if f.Tenant == tenant {
+			total += f.StoredSize()
+		}
+	}
+	return total, nil
+}
+
+func (s *Store) OwnerUsage(owner string) (uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var total uint64
+	for _, f := range s.files {
+		if f.Owner == owner {
+			total += f.StoredSize()
+		}
+	}
+	return total, nil
+}
+
+func (s *Store) FindByOwner(owner string) ([]File, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var files []File
+	for _, f := range s.files {
+		if f.Owner == owner {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (s *Store) List(q ListQuery) ([]File, string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	var files []File
+	for _, f := range s.files {
+		if f.ID <= q.Cursor || !q.Match(f) {
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ID < files[j].ID
+	})
+	if q.Limit <= 0 || len(files) <= q.Limit {
+		return files, "", nil
+	}
+	files = files[:q.Limit]
+	return files, files[len(files)-1].ID, nil
+}
+
+// OpenUploads returns the number of uploads neither complete nor expired.
+func (s *Store) OpenUploads() int {
+	s.RLock()
+	defer s.RUnlock()
+	var n int
+	for _, f := range s.files {
+		if f.Status() == StatusInProgress {
+			n++
+		}
+	}
+	return n
+}
+
+// PartialBytes returns the number of bytes written by the uploads neither
+// complete nor expired.
+func (s *Store) PartialBytes() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	var n uint64
+	for _, f := range s.files {
+		if f.Status() == StatusInProgress {
+			n += f.UploadedSize
+		}
+	}
+	return n
+}
@@ -0,0 +1,56 @@
+package v3
+
+import (
+	"context"
+	"io"
+
+	"github.com/imrenagi/go-http-upload/bufpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/imrenagi/go-http-upload/api/v3")
+
+// progressEventInterval is the number of bytes between the progress events
+// of the copy spans.
+const progressEventInterval = 1 << 20
+
+// copyChunk copies a chunk of the upload fileID, starting at offset, from
+// src to dst through a pooled buffer, in a span. An event is added to the span every
+// progressEventInterval bytes, so that slow chunks can be told apart from
+// slow storage in traces.
+func copyChunk(ctx context.Context, fileID string, offset uint64, dst io.Writer, src io.Reader) (int64, error) {
+	_, span := tracer.Start(ctx, "upload.copy", trace.WithAttributes(
+		attribute.String("file_id", fileID),
+		attribute.Int64("offset", int64(offset)),
+	))
+	defer span.End()
+
+	n, err := bufpool.Default.Copy(&progressWriter{w: dst, span: span}, src)
+	span.SetAttributes(attribute.Int64("bytes_written", n))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "error copying the chunk")
+	}
+	return n, err
+}
+
+// progressWriter adds an event to span every progressEventInterval bytes
+// written to w.
+type progressWriter struct {
+	w    io.Writer
+	span trace.Span
+	n    int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	before := p.n
+	p.n += int64(n)
+	if p.n/progressEventInterval > before/progressEventInterval {
+		p.span.AddEvent("progress", trace.WithAttributes(attribute.Int64("bytes_written", p.n)))
+	}
+	return n, err
+}
@@ -0,0 +1,303 @@
+package v3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/metrics"
+	"github.com/imrenagi/go-http-upload/sniff"
+)
+
+const (
+	// WebSocketOffsetSize is the size of the big-endian offset starting
+	// every chunk sent over a WebSocket.
+	WebSocketOffsetSize = 8
+	// MaxWebSocketChunkSize limits the data of a chunk sent over a
+	// WebSocket, like the body of a PATCH request.
+	MaxWebSocketChunkSize = 64 << 20
+
+	webSocketWriteTimeout = 10 * time.Second
+	// webSocketReadTimeout bounds the wait for a chunk and its reading,
+	// like the ReadTimeout of the server bounds a PATCH request.
+	webSocketReadTimeout = 30 * time.Second
+)
+
+// webSocketAck opens a WebSocket upload and answers each of its chunks.
+type webSocketAck struct {
+	Offset    uint64 `json:"offset"`
+	Complete  bool   `json:"complete"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	CDNURL    string `json:"cdn_url,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// UploadWebSocket receives the chunks of an upload created with POST over
+// a WebSocket, for browsers behind proxies which mishandle PATCH requests
+// or long request bodies. Every binary message is a chunk: its offset in
+// WebSocketOffsetSize big-endian bytes, which must be the offset of the
+// upload like Upload-Offset, followed by its data. The server sends a JSON
+// text message with the offset of the upload once connected, then after
+// every chunk, carrying the error of the chunks it rejected so that the
+// client resends from that offset. The connection is closed once the
+// upload can't receive chunks anymore, e.g. when it expired.
+func (c *Controller) UploadWebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		if !c.webSocket {
+			writeError(w, http.StatusNotImplemented, errors.New("websocket uploads are not enabled"))
+			return
+		}
+		if p, ok := auth.FromContext(r.Context()); ok && !p.HasRole(auth.RoleUploader) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		fm, ok, err := c.find(r, mux.Vars(r)["file_id"])
+		if err != nil {
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !auth.CanAccess(r.Context(), fm.Owner) {
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if c.expired(r.Context(), fm) {
+			writeError(w, http.StatusGone, errors.New("file expired"))
+			return
+		}
+		if fm.IsDeferLength {
+			writeError(w, http.StatusConflict, errors.New("websocket uploads require an upload length"))
+			return
+		}
+		if fm.Received != nil {
+			writeError(w, http.StatusConflict, errors.New("the upload was started with sparse chunks"))
+			return
+		}
+		if fm.Parts != nil {
+			writeError(w, http.StatusConflict, errors.New("the upload is a multipart upload"))
+			return
+		}
+
+		upgrader := websocket.Upgrader{
+			ReadBufferSize:  32 << 10,
+			WriteBufferSize: 4 << 10,
+			CheckOrigin:     c.checkOrigin,
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader answered the handshake with the error.
+			log.Debug().Err(err).Msg("websocket handshake failed")
+			return
+		}
+		defer conn.Close()
+		defer c.metrics.InFlight(r.Context())()
+		conn.SetReadLimit(WebSocketOffsetSize + MaxWebSocketChunkSize)
+		log.Debug().Msg("websocket upload connected")
+
+		if err := writeAck(conn, fm, nil); err != nil {
+			return
+		}
+		for {
+			conn.SetReadDeadline(time.Now().Add(webSocketReadTimeout))
+			kind, frame, err := conn.NextReader()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.Debug().Err(err).Msg("websocket upload interrupted")
+				}
+				return
+			}
+			if kind != websocket.BinaryMessage {
+				closeWebSocket(conn, websocket.CloseUnsupportedData, "chunks must be sent in binary messages")
+				return
+			}
+
+			// the upload may have been written or terminated by another
+			// request since the previous chunk.
+			fm, ok, err = c.store.Find(fm.ID)
+			if err != nil || !ok {
+				closeWebSocket(conn, websocket.ClosePolicyViolation, "file not found")
+				return
+			}
+			var code int
+			fm, code, err = c.receiveFrame(r.Context(), fm, frame)
+			if ackErr := writeAck(conn, fm, err); ackErr != nil {
+				return
+			}
+			if code != 0 {
+				closeWebSocket(conn, code, err.Error())
+				return
+			}
+		}
+	}
+}
+
+// checkOrigin accepts the handshakes from pages of the host of the server or
+// of the origins of WithWebSocketOrigins, so that pages of other sites can't
+// upload with the session cookie of a browser. A handshake without Origin is
+// rejected too: the other clients must send one.
+func (c *Controller) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.ContainsFunc(c.webSocketOrigins, func(o string) bool {
+		return strings.EqualFold(o, origin)
+	})
+}
+
+// expired reports whether fm expired, running the hook and recording the
+// failure when it did.
+func (c *Controller) expired(ctx context.Context, fm File) bool {
+	if !c.extensions.Enabled(ExpirationExtension) || !fm.ExpiresAt.Before(time.Now()) {
+		return false
+	}
+	c.hooks.PostExpire(ctx, fm.hookUpload())
+	c.metrics.Failed(ctx, metrics.ReasonExpired)
+	return true
+}
+
+// receiveFrame appends the chunk read from frame to fm, and returns the
+// upload updated. The error of a rejected chunk comes with the close code
+// of the connection when the upload can't receive chunks anymore, zero
+// when the client may send the chunk again.
+func (c *Controller) receiveFrame(ctx context.Context, fm File, frame io.Reader) (File, int, error) {
+	log := c.logger(ctx)
+	var header [WebSocketOffsetSize]byte
+	if _, err := io.ReadFull(frame, header[:]); err != nil {
+		return fm, 0, errors.New("chunk doesn't start with its offset")
+	}
+	offset := binary.BigEndian.Uint64(header[:])
+
+	if c.expired(ctx, fm) {
+		return fm, websocket.ClosePolicyViolation, errors.New("file expired")
+	}
+	if fm.IsComplete() {
+		// the chunks resent once the upload is complete, e.g. after a
+		// lost ack, are answered with the complete upload.
+		return fm, 0, nil
+	}
+	if offset != fm.UploadedSize {
+		c.metrics.Failed(ctx, metrics.ReasonOffsetConflict)
+		return fm, 0, errors.New("chunk offset does not match the current offset")
+	}
+
+	// the chunk is read before any of it is written, so that a chunk
+	// exceeding the upload length is rejected whole. The read limit of the
+	// connection bounds it.
+	data, err := io.ReadAll(io.LimitReader(frame, int64(fm.TotalSize-offset)+1))
+	if err != nil {
+		return fm, 0, errors.New("error reading the chunk")
+	}
+	if uint64(len(data)) > fm.TotalSize-offset {
+		return fm, 0, errors.New("chunk exceeds the upload length")
+	}
+	if c.contentType != nil && fm.UploadedSize < sniff.Len {
+		// sniff the first bytes of the upload before the chunk which
+		// completes them is written.
+		head, complete, err := uploadHead(fm, data)
+		if err != nil {
+			log.Error().Err(err).Msg("error reading the head of the file")
+			c.metrics.Failed(ctx, metrics.ReasonStorageError)
+			return fm, websocket.CloseInternalServerErr, errors.New("error reading the file")
+		}
+		if complete {
+			fm.SniffedContentType = sniff.Detect(head)
+			mismatch, err := c.contentType.Check(fm.ContentType, fm.SniffedContentType)
+			if err != nil {
+				log.Debug().Err(err).Msg("content type rejected")
+				return fm, websocket.ClosePolicyViolation, err
+			}
+			fm.ContentTypeMismatch = mismatch
+		}
+	}
+
+	f, err := os.OpenFile(fm.FilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Error().Err(err).Msg("error opening the file")
+		c.metrics.Failed(ctx, metrics.ReasonStorageError)
+		return fm, websocket.CloseInternalServerErr, errors.New("error opening the file")
+	}
+	defer f.Close()
+	pos, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		log.Error().Err(err).Msg("error getting file position")
+		c.metrics.Failed(ctx, metrics.ReasonStorageError)
+		return fm, websocket.CloseInternalServerErr, errors.New("error preparing file")
+	}
+
+	start := time.Now()
+	n, err := c.writeChunk(ctx, fm.ID, offset, f, pos, bytes.NewReader(data))
+	fm.UploadedSize += uint64(n)
+	c.metrics.Received(ctx, n)
+	if serr := c.saveReceived(fm); serr != nil {
+		// the chunk isn't recorded, e.g. the upload was terminated
+		// meanwhile or its length is deferred and the quota exceeded.
+		f.Truncate(pos)
+		fm.UploadedSize -= uint64(n)
+		log.Debug().Err(serr).Msg("chunk not recorded")
+		return fm, websocket.ClosePolicyViolation, serr
+	}
+	if err != nil {
+		log.Error().Err(err).Int64("written_size", n).Msg("error writing the file")
+		c.metrics.Failed(ctx, metrics.ReasonStorageError)
+		return fm, websocket.CloseInternalServerErr, errors.New("error writing the file")
+	}
+	c.metrics.Chunk(ctx, n, time.Since(start))
+	c.hooks.PostReceiveChunk(ctx, fm.hookUpload())
+
+	if fm.IsComplete() {
+		c.finish(ctx, &fm)
+	}
+	log.Debug().
+		Uint64("offset", offset).
+		Int64("written_size", n).
+		Msg("websocket chunk written")
+	return fm, 0, nil
+}
+
+func writeAck(conn *websocket.Conn, fm File, err error) error {
+	ack := webSocketAck{
+		Offset:   fm.UploadedSize,
+		Complete: fm.IsComplete(),
+		CDNURL:   fm.CDNURL,
+	}
+	if !fm.ExpiresAt.IsZero() {
+		ack.ExpiresAt = uploadExpiresAt(fm.ExpiresAt)
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	return conn.WriteJSON(ack)
+}
+
+// closeWebSocket starts the closing handshake of conn with code and reason.
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(webSocketWriteTimeout))
+}
@@ -1,13 +1,22 @@
 package v3
 
 import (
+	"bufio"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"maps"
+	"mime"
 	"net"
 	"net/http"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -15,7 +24,19 @@ import (
 	"cloud.google.com/go/storage"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/cdn"
+	"github.com/imrenagi/go-http-upload/finalize"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/metrics"
+	"github.com/imrenagi/go-http-upload/minrate"
+	"github.com/imrenagi/go-http-upload/pipeline"
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/imrenagi/go-http-upload/thumbnail"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/api/iterator"
 )
 
 const (
@@ -33,8 +54,16 @@ const (
 	UploadExpiresHeader     = "Upload-Expires"
 	UploadChecksumHeader    = "Upload-Checksum"
 	ContentTypeHeader       = "Content-Type"
+	// CDNURLHeader carries the CDN signed URL of an upload in the response
+	// of the request completing it.
+	CDNURLHeader = "CDN-URL"
+	// UploadFinalizationHeader carries the status of the finalization of
+	// an upload finalized in the background.
+	UploadFinalizationHeader = "Upload-Finalization"
 
 	UploadMaxDuration = 10 * time.Minute
+
+	defaultCDNURLTTL = time.Hour
 )
 
 type Extension string
@@ -67,11 +96,14 @@ func (e Extensions) String() string {
 }
 
 var (
-	defaultMaxSize             = uint64(0)
-	defaultSupportedExtensions = Extensions{
+	defaultMaxSize               = uint64(0)
+	defaultMinTransferRateWindow = 10 * time.Second
+	defaultBucket                = "go-http-upload-gcs-test"
+	defaultSupportedExtensions   = Extensions{
 		CreationExtension,
 		ExpirationExtension,
 		ChecksumExtension,
+		TerminationExtension,
 	}
 	SupportedTusVersion = []string{
 		"0.2.0",
@@ -84,8 +116,35 @@ var (
 )
 
 type Options struct {
-	Extensions Extensions
-	MaxSize    uint64
+	Extensions    Extensions
+	MaxSize       uint64
+	Bucket        string
+	TenantBuckets map[string]string
+	TenantQuota   uint64
+	UserQuota     uint64
+	URLSigner     *auth.URLSigner
+	Thumbnails    *thumbnail.Worker
+	CDN           cdn.Signer
+	CDNURLTTL     time.Duration
+	Hooks         hooks.Hooks
+	Pipeline      *pipeline.Worker
+	ContentType   *sniff.Policy
+	Finalizer     *finalize.Worker
+	// FinalizeMinSize is the size from which uploads are finalized by the
+	// Finalizer.
+	FinalizeMinSize uint64
+	// MinTransferRate, unless zero, is the rate in bytes per second below
+	// which the PATCH requests are aborted, measured every
+	// MinTransferRateWindow.
+	MinTransferRate       uint64
+	MinTransferRateWindow time.Duration
+	// ComposeChunks composes the chunks of the completed uploads into a
+	// single object.
+	ComposeChunks bool
+	// Client accesses the buckets, created from the default credentials
+	// when nil.
+	Client *storage.Client
+	Logger *zerolog.Logger
 }
 
 type Option func(*Options)
@@ -102,43 +161,295 @@ func WithMaxSize(size uint64) Option {
 	}
 }
 
+// WithBucket sets the bucket the uploaded chunks are written to.
+func WithBucket(name string) Option {
+	return func(o *Options) {
+		o.Bucket = name
+	}
+}
+
+// WithStorageClient sets the client the buckets are accessed with, instead
+// of one created from the default credentials.
+func WithStorageClient(client *storage.Client) Option {
+	return func(o *Options) {
+		o.Client = client
+	}
+}
+
+// WithTenantBuckets gives tenants their own bucket. Tenants without an entry
+// share the default bucket, where their chunks are prefixed by the tenant.
+func WithTenantBuckets(buckets map[string]string) Option {
+	return func(o *Options) {
+		o.TenantBuckets = buckets
+	}
+}
+
+// WithTenantQuota limits the total size, in bytes, of the uploads a tenant
+// may keep at the same time. Zero means unlimited.
+func WithTenantQuota(size uint64) Option {
+	return func(o *Options) {
+		o.TenantQuota = size
+	}
+}
+
+// WithUserQuota limits the total size, in bytes, of the uploads an
+// authenticated principal may keep at the same time. Zero means unlimited.
+func WithUserQuota(size uint64) Option {
+	return func(o *Options) {
+		o.UserQuota = size
+	}
+}
+
+// WithURLSigner enables signed download URLs for uploads which can't be
+// served by a GCS signed URL. The signer must also authenticate the
+// requests made to the download endpoint.
+func WithURLSigner(signer *auth.URLSigner) Option {
+	return func(o *Options) {
+		o.URLSigner = signer
+	}
+}
+
+// WithThumbnails generates thumbnails of completed image uploads with the
+// given worker.
+func WithThumbnails(w *thumbnail.Worker) Option {
+	return func(o *Options) {
+		o.Thumbnails = w
+	}
+}
+
+// WithCDN signs a URL of every completed upload with signer, valid for ttl
+// or an hour when zero, so that clients can download it from the CDN whose
+// origin is the bucket. Only uploads sent in a single PATCH are stored as a
+// single object the CDN can serve.
+func WithCDN(signer cdn.Signer, ttl time.Duration) Option {
+	return func(o *Options) {
+		o.CDN = signer
+		if ttl > 0 {
+			o.CDNURLTTL = ttl
+		}
+	}
+}
+
+// WithLogger logs with l instead of the global logger. Use
+// logging.FromSlog to log with a *slog.Logger.
+func WithLogger(l *zerolog.Logger) Option {
+	return func(o *Options) {
+		if l != nil {
+			o.Logger = l
+		}
+	}
+}
+
+// WithHooks calls h at every step of the lifecycle of the uploads.
+func WithHooks(h hooks.Hooks) Option {
+	return func(o *Options) {
+		if h != nil {
+			o.Hooks = h
+		}
+	}
+}
+
+// WithPipeline post-processes completed uploads with the given worker. The
+// status of every step is recorded in the upload.
+func WithPipeline(w *pipeline.Worker) Option {
+	return func(o *Options) {
+		o.Pipeline = w
+	}
+}
+
+// WithContentTypePolicy restricts the content types of the uploads. The
+// declared content type is checked on creation, and the one detected from
+// the first bytes before they are written. A nil policy enforces nothing.
+func WithContentTypePolicy(p *sniff.Policy) Option {
+	return func(o *Options) {
+		o.ContentType = p
+	}
+}
+
+// WithFinalizer finalizes the uploads of at least minSize bytes with w, so
+// that the request completing them is answered once their chunks are
+// stored. The status of their finalization is reported by HEAD requests.
+func WithFinalizer(w *finalize.Worker, minSize uint64) Option {
+	return func(o *Options) {
+		o.Finalizer = w
+		o.FinalizeMinSize = minSize
+	}
+}
+
+// WithMinTransferRate aborts with a 408 the PATCH requests whose body is
+// received slower than rate bytes per second over window, 10 seconds when
+// zero. The bytes received until then are kept, so that the client resumes
+// the upload from them.
+func WithMinTransferRate(rate uint64, window time.Duration) Option {
+	return func(o *Options) {
+		o.MinTransferRate = rate
+		o.MinTransferRateWindow = window
+		if window <= 0 {
+			o.MinTransferRateWindow = defaultMinTransferRateWindow
+		}
+	}
+}
+
+// WithComposeChunks composes the chunks of every completed upload into the
+// object of its first chunk when finalizing it, so that it is read back
+// from a single object.
+func WithComposeChunks(compose bool) Option {
+	return func(o *Options) {
+		o.ComposeChunks = compose
+	}
+}
+
 func NewController(s Storage, opts ...Option) Controller {
 	o := Options{
 		Extensions: defaultSupportedExtensions,
 		MaxSize:    defaultMaxSize,
+		Bucket:     defaultBucket,
+		CDNURLTTL:  defaultCDNURLTTL,
+		Hooks:      hooks.Nop{},
+		Logger:     &log.Logger,
 	}
 	for _, opt := range opts {
 		opt(&o)
 	}
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		log.Fatal().Err(err).Msg("error creating storage client")
+	client := o.Client
+	if client == nil {
+		var err error
+		client, err = storage.NewClient(context.Background())
+		if err != nil {
+			o.Logger.Fatal().Err(err).Msg("error creating storage client")
+		}
 	}
 
-	bkt := client.Bucket("go-http-upload-gcs-test")
+	bkt := client.Bucket(o.Bucket)
+
+	rec := metrics.New(otel.GetMeterProvider(), "v4", "gcs")
+	if oc, ok := s.(OpenCounter); ok {
+		if err := rec.ObserveOpen(oc.OpenUploads); err != nil {
+			o.Logger.Warn().Err(err).Msg("unable to observe the open uploads")
+		}
+	}
 
 	return Controller{
-		store:      s,
-		extensions: o.Extensions,
-		maxSize:    o.MaxSize,
-		storage:    client,
-		bucket:     bkt,
+		store:         s,
+		extensions:    o.Extensions,
+		maxSize:       o.MaxSize,
+		tenantQuota:   o.TenantQuota,
+		userQuota:     o.UserQuota,
+		signer:        o.URLSigner,
+		thumbnails:    o.Thumbnails,
+		cdn:           o.CDN,
+		cdnURLTTL:     o.CDNURLTTL,
+		hooks:         o.Hooks,
+		pipeline:      o.Pipeline,
+		contentType:   o.ContentType,
+		finalizer:     o.Finalizer,
+		finalizeMin:   o.FinalizeMinSize,
+		minRate:       o.MinTransferRate,
+		minRateWindow: o.MinTransferRateWindow,
+		compose:       o.ComposeChunks,
+		metrics:       rec,
+		storage:       client,
+		bucket:        bkt,
+		tenantBuckets: o.TenantBuckets,
+		log:           o.Logger,
 	}
 }
 
 type Storage interface {
 	Find(id string) (FileMetadata, bool)
 	Save(id string, metadata FileMetadata)
+	// Update applies fn to the upload id and saves it atomically, unless fn
+	// fails. It returns ErrNotFound when the upload doesn't exist.
+	Update(id string, fn func(fm *FileMetadata) error) (FileMetadata, error)
+	// Create saves the new upload fm unless the uploads of its tenant or of
+	// its owner would exceed their quota, zero meaning unlimited, checked
+	// atomically with concurrent creations.
+	Create(fm FileMetadata, tenantQuota, userQuota uint64) error
+	Delete(id string)
+	// Usage returns the total size of the uploads owned by tenant.
+	Usage(tenant string) uint64
+	// OwnerUsage returns the total size of the uploads created by owner.
+	OwnerUsage(owner string) uint64
+	// FindByOwner returns every upload created by owner.
+	FindByOwner(owner string) []FileMetadata
+}
+
+// OpenCounter is implemented by the storages able to count the uploads
+// neither complete nor expired, exposed as the uploader_open_uploads gauge.
+type OpenCounter interface {
+	OpenUploads() int
 }
 
 type Controller struct {
-	store      Storage
-	extensions Extensions
-	maxSize    uint64
-	storage    *storage.Client
-	bucket     *storage.BucketHandle
+	store         Storage
+	extensions    Extensions
+	maxSize       uint64
+	tenantQuota   uint64
+	userQuota     uint64
+	signer        *auth.URLSigner
+	thumbnails    *thumbnail.Worker
+	cdn           cdn.Signer
+	cdnURLTTL     time.Duration
+	hooks         hooks.Hooks
+	pipeline      *pipeline.Worker
+	contentType   *sniff.Policy
+	finalizer     *finalize.Worker
+	finalizeMin   uint64
+	minRate       uint64
+	minRateWindow time.Duration
+	compose       bool
+	metrics       *metrics.Recorder
+	storage       *storage.Client
+	bucket        *storage.BucketHandle
+	tenantBuckets map[string]string
+	log           *zerolog.Logger
+}
+
+// find looks up an upload on behalf of the tenant of the request. Uploads of
+// other tenants are reported as not found so their ids can't be probed.
+func (c *Controller) find(r *http.Request, id string) (FileMetadata, bool) {
+	fm, ok := c.store.Find(id)
+	if !ok || fm.Tenant != auth.TenantFromContext(r.Context()) {
+		return FileMetadata{}, false
+	}
+	return fm, true
+}
+
+// logger returns the logger of the request handled with ctx, which carries
+// its request id, or the logger of the controller.
+func (c *Controller) logger(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return c.log
+}
+
+// withUpload adds the id, owner and tenant of fm to the fields of l, and
+// returns r carrying the new logger, so that every line logged while
+// handling r can be told apart by upload.
+func withUpload(r *http.Request, l *zerolog.Logger, fm FileMetadata) (*http.Request, *zerolog.Logger) {
+	ul := l.With().
+		Str("file_id", fm.ID).
+		Str("owner", fm.Owner).
+		Str("tenant", fm.Tenant).
+		Logger()
+	return r.WithContext(ul.WithContext(r.Context())), &ul
+}
+
+// bucketFor returns the bucket holding the chunks of the tenant.
+func (c *Controller) bucketFor(tenant string) *storage.BucketHandle {
+	if name, ok := c.tenantBuckets[tenant]; ok {
+		return c.storage.Bucket(name)
+	}
+	return c.bucket
+}
+
+// chunkPrefix returns the prefix shared by the names of every chunk of the
+// upload. Chunks are prefixed by the tenant even in a dedicated bucket so
+// that moving a tenant between buckets doesn't require renaming objects.
+func chunkPrefix(fm FileMetadata) string {
+	return path.Join(fm.Tenant, fm.ID) + "-"
 }
 
 func TusResumableHeaderCheck(next http.Handler) http.Handler {
@@ -198,18 +509,28 @@ func (c *Controller) GetConfig() http.HandlerFunc {
 
 func (c *Controller) GetOffset() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
 		vars := mux.Vars(r)
 		fileID := vars["file_id"]
 		log.Debug().Str("file_id", fileID).Msg("Check request path and query")
-		fm, ok := c.store.Find(fileID)
+		fm, ok := c.find(r, fileID)
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			w.Write([]byte("File not found"))
 			return
 		}
+		r, log = withUpload(r, log, fm)
+		if !auth.CanAccess(r.Context(), fm.Owner) {
+			log.Debug().Msg("principal is not the owner of the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
 
 		w.Header().Add(UploadOffsetHeader, fmt.Sprint(fm.UploadedSize))
 		w.Header().Add(UploadLengthHeader, fmt.Sprint(fm.TotalSize))
+		if fm.Finalization != "" {
+			w.Header().Set(UploadFinalizationHeader, string(fm.Finalization))
+		}
 		w.Header().Add("Cache-Control", "no-store")
 		if fm.Metadata != "" {
 			w.Header().Add(UploadMetadataHeader, fm.Metadata)
@@ -219,7 +540,9 @@ func (c *Controller) GetOffset() http.HandlerFunc {
 		}
 
 		if !fm.ExpiresAt.IsZero() && fm.ExpiresAt.Before(time.Now()) {
-			log.Debug().Str("file_id", fileID).Msg("file expired")
+			log.Debug().Msg("file expired")
+			c.hooks.PostExpire(r.Context(), fm.hookUpload())
+			c.metrics.Failed(r.Context(), metrics.ReasonExpired)
 			writeError(w, http.StatusGone, errors.New("file expired"))
 			return
 		}
@@ -250,23 +573,26 @@ type checksum struct {
 	Value     string
 }
 
+// hash returns the hash computing the checksum, nil when the request
+// didn't carry one.
+func (c checksum) hash() hash.Hash {
+	switch c.Algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	}
+	return nil
+}
+
+// errChunkTooLarge rejects the chunks exceeding the length of their upload.
+var errChunkTooLarge = errors.New("chunk exceeds the upload length")
+
 func (c *Controller) ResumeUpload() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		defer c.metrics.InFlight(r.Context())()
 		r.Body = http.MaxBytesReader(w, r.Body, 64<<20) //64MB
-		doneCh := make(chan struct{})
-		defer close(doneCh)
-
-		go func() {
-			select {
-			case <-doneCh:
-				log.Info().Msg("Upload completed")
-				return
-			case <-r.Context().Done():
-				log.Warn().Err(r.Context().Err()).Msg("Upload canceled")
-				return
-			}
-		}()
-
 		// r.Body = http.MaxBytesReader(w, r.Body, 10<<20) //10MB
 		vars := mux.Vars(r)
 		fileID := vars["file_id"]
@@ -277,32 +603,63 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 			log.Debug().Err(err).
 				Str("upload_offset", uploadOffset).
 				Msg("Invalid Upload-Offset header: not a number")
-			writeError(w, http.StatusBadRequest, errors.New("invalid Upload-Offset header: not a number"))
+			rejectChunk(w, r, http.StatusBadRequest, errors.New("invalid Upload-Offset header: not a number"))
 			return
 		}
 		if offset < 0 {
 			log.Debug().Str("upload_offset", uploadOffset).Msg("Invalid Upload-Offset header: negative value")
-			writeError(w, http.StatusBadRequest, errors.New("invalid Upload-Offset header: negative value"))
+			rejectChunk(w, r, http.StatusBadRequest, errors.New("invalid Upload-Offset header: negative value"))
 			return
 		}
 
 		contentType := r.Header.Get(ContentTypeHeader)
 		if contentType != "application/offset+octet-stream" {
 			log.Debug().Str("content_type", contentType).Msg("Invalid Content-Type")
-			writeError(w, http.StatusUnsupportedMediaType, errors.New("invalid Content-Type header: expected application/offset+octet-stream"))
+			rejectChunk(w, r, http.StatusUnsupportedMediaType, errors.New("invalid Content-Type header: expected application/offset+octet-stream"))
 			return
 		}
 
-		fm, ok := c.store.Find(fileID)
+		var checksum checksum
+		if c.extensions.Enabled(ChecksumExtension) {
+			var err error
+			checksum, err = newChecksum(r.Header.Get(UploadChecksumHeader))
+			if err != nil {
+				log.Debug().Err(err).Msg("Invalid checksum header")
+				rejectChunk(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		fm, ok := c.find(r, fileID)
 		if !ok {
 			log.Debug().Str("file_id", fileID).Msg("file not found")
-			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			rejectChunk(w, r, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		// the request context and the logger are passed once final, the
+		// handler reassigns r and log.
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		go func(ctx context.Context, log *zerolog.Logger) {
+			select {
+			case <-doneCh:
+				log.Info().Msg("Upload completed")
+			case <-ctx.Done():
+				log.Warn().Err(ctx.Err()).Msg("Upload canceled")
+			}
+		}(r.Context(), log)
+		if !auth.CanAccess(r.Context(), fm.Owner) {
+			log.Debug().Msg("principal is not the owner of the file")
+			rejectChunk(w, r, http.StatusForbidden, auth.ErrForbidden)
 			return
 		}
 
 		if c.extensions.Enabled(ExpirationExtension) && fm.ExpiresAt.Before(time.Now()) {
-			log.Debug().Str("file_id", fileID).Msg("file expired")
-			writeError(w, http.StatusGone, errors.New("file expired"))
+			log.Debug().Msg("file expired")
+			c.hooks.PostExpire(r.Context(), fm.hookUpload())
+			c.metrics.Failed(r.Context(), metrics.ReasonExpired)
+			rejectChunk(w, r, http.StatusGone, errors.New("file expired"))
 			return
 		}
 
@@ -312,22 +669,75 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 
 		if offset != fm.UploadedSize {
 			log.Warn().Msg("upload-Offset header does not match the current offset")
-			writeError(w, http.StatusConflict, errors.New("upload-Offset header does not match the current offset"))
+			c.metrics.Failed(r.Context(), metrics.ReasonOffsetConflict)
+			rejectChunk(w, r, http.StatusConflict, errors.New("upload-Offset header does not match the current offset"))
 			return
 		}
+		// a chunk can't write past the length of the upload, which the
+		// limits of the credentials were checked against.
+		remaining := int64(fm.TotalSize) - offset
+		if r.ContentLength > remaining {
+			rejectChunk(w, r, http.StatusRequestEntityTooLarge, errChunkTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, remaining)
+		defer c.limitRate(w, r)()
+
+		if c.contentType != nil && fm.UploadedSize == 0 {
+			// sniff the first bytes before any of them is written. They
+			// must all be sent in the first chunk, since the chunks
+			// written are only read back from the bucket.
+			br := bufio.NewReaderSize(r.Body, sniff.Len)
+			head, _ := br.Peek(sniff.Len)
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{br, r.Body}
+			if need := min(sniff.Len, int(fm.TotalSize)); len(head) < need {
+				rejectChunk(w, r, http.StatusBadRequest, fmt.Errorf("the first chunk must hold the first %d bytes of the upload", need))
+				return
+			}
+			fm.SniffedContentType = sniff.Detect(head)
+			mismatch, err := c.contentType.Check(decodeMetadata(fm.Metadata)["content-type"], fm.SniffedContentType)
+			if err != nil {
+				log.Debug().Err(err).Msg("content type rejected")
+				rejectChunk(w, r, http.StatusUnsupportedMediaType, err)
+				return
+			}
+			fm.ContentTypeMismatch = mismatch
+		}
 
-		objName := fmt.Sprintf("%s-%d", fileID, offset)
-		obj := c.bucket.Object(objName)
-		objW := obj.NewWriter(r.Context())
+		bkt := c.bucketFor(fm.Tenant)
+		objName := fmt.Sprintf("%s%d", chunkPrefix(fm), offset)
+		obj := bkt.Object(objName)
+		// cancelling the context of the writer discards the chunk.
+		wctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		objW := obj.NewWriter(wctx)
 
 		// objW.CRC32C = crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
 		// objW.SendCRC32C = true
 		defer objW.Close()
 
-		n, err := io.Copy(objW, r.Body)
+		var body io.Reader = r.Body
+		h := checksum.hash()
+		if h != nil {
+			body = io.TeeReader(r.Body, h)
+		}
+		start := time.Now()
+		n, err := copyChunk(r.Context(), fm.ID, uint64(offset), objW, body)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			// the chunk is rejected whole rather than cut at the length of
+			// the upload.
+			cancel()
+			writeError(w, http.StatusRequestEntityTooLarge, errChunkTooLarge)
+			return
+		}
 		if err != nil {
 
 			fm.UploadedSize += n
+			c.metrics.Received(r.Context(), n)
 			c.store.Save(fm.ID, fm)
 
 			log.Info().
@@ -337,19 +747,45 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
 				log.Warn().Err(err).Msg("network timeout while writing file")
+				c.metrics.Failed(r.Context(), metrics.ReasonTimeout)
 				writeError(w, http.StatusRequestTimeout, fmt.Errorf("network timeout: %w", err))
 				return
 			}
 
 			log.Error().Err(err).Msg("error writing the file")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error writing the file: %w", err))
+			return
+		}
+
+		if h != nil && hex.EncodeToString(h.Sum(nil)) != checksum.Value {
+			// the chunk is discarded with the context of its writer.
+			cancel()
+			log.Debug().Msg("Checksum mismatch")
+			c.metrics.Failed(r.Context(), metrics.ReasonChecksumMismatch)
+			writeError(w, 460, errors.New("checksum mismatch"))
+			return
+		}
+
+		// the chunk only exists once the writer is closed.
+		if err := objW.Close(); err != nil {
+			log.Error().Err(err).Msg("error writing the file")
+			c.metrics.Failed(r.Context(), metrics.ReasonStorageError)
 			writeError(w, http.StatusInternalServerError, fmt.Errorf("error writing the file: %w", err))
 			return
 		}
 
 		fm.UploadedSize += n
+		c.metrics.Received(r.Context(), n)
+		c.metrics.Chunk(r.Context(), n, time.Since(start))
 		c.store.Save(fm.ID, fm)
+		c.hooks.PostReceiveChunk(r.Context(), fm.hookUpload())
+
+		if fm.UploadedSize == int64(fm.TotalSize) {
+			c.finish(r.Context(), &fm)
+		}
 
-		objPath := fmt.Sprintf("gs://%s/%s", c.bucket.BucketName(), objName)
+		objPath := fmt.Sprintf("gs://%s/%s", bkt.BucketName(), objName)
 
 		log.Debug().
 			Int64("written_size", n).
@@ -361,12 +797,125 @@ func (c *Controller) ResumeUpload() http.HandlerFunc {
 		if !fm.ExpiresAt.IsZero() {
 			w.Header().Add(UploadExpiresHeader, uploadExpiresAt(fm.ExpiresAt))
 		}
+		if fm.CDNURL != "" {
+			w.Header().Set(CDNURLHeader, fm.CDNURL)
+		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
+// limitRate makes the body of r fail with minrate.ErrTooSlow once it is
+// received below the minimum transfer rate. The read deadline of the
+// connection is expired too, so that a client sending nothing at all is
+// interrupted. The returned function stops measuring the rate.
+func (c *Controller) limitRate(w http.ResponseWriter, r *http.Request) func() {
+	if c.minRate == 0 {
+		return func() {}
+	}
+	rc := http.NewResponseController(w)
+	body := minrate.NewReader(r.Body, int64(c.minRate), c.minRateWindow, func() {
+		rc.SetReadDeadline(time.Now())
+	})
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, r.Body}
+	return func() { body.Close() }
+}
+
+// finish completes fm, in the background when it is large enough and a
+// finalizer is configured.
+func (c *Controller) finish(ctx context.Context, fm *FileMetadata) {
+	if c.finalizer == nil || fm.TotalSize < c.finalizeMin {
+		c.complete(ctx, fm)
+		return
+	}
+	log := c.logger(ctx)
+	fm.Finalization = finalize.StatusPending
+	if _, err := c.store.Update(fm.ID, func(f *FileMetadata) error {
+		f.Finalization = finalize.StatusPending
+		return nil
+	}); err != nil {
+		log.Debug().Err(err).Msg("upload removed before its finalization")
+		return
+	}
+	id := fm.ID
+	err := c.finalizer.Enqueue(finalize.Job{
+		ID: id,
+		Finalize: func(ctx context.Context) {
+			// the upload is finalized as stored now, unless it was
+			// terminated or erased while queued.
+			upload, err := c.store.Update(id, func(f *FileMetadata) error {
+				f.Finalization = finalize.StatusRunning
+				return nil
+			})
+			if err != nil {
+				log.Debug().Err(err).Msg("upload removed before its finalization")
+				return
+			}
+			c.complete(log.WithContext(ctx), &upload)
+		},
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("finalizing the upload on the request path")
+		c.complete(ctx, fm)
+	}
+}
+
+// complete computes the etag of fm from its chunks and announces it.
+func (c *Controller) complete(ctx context.Context, fm *FileMetadata) {
+	log := c.logger(ctx)
+	c.metrics.Completed(ctx, fm.TotalSize, time.Since(fm.CreatedAt))
+	chunks, _, err := c.listChunks(ctx, *fm)
+	if err == nil && c.compose {
+		chunks, err = c.composeChunks(ctx, *fm, chunks)
+	}
+	if fm.Finalization != "" {
+		fm.Finalization = finalize.StatusSucceeded
+		if err != nil {
+			fm.Finalization = finalize.StatusFailed
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("error finalizing the chunks of the file")
+	} else {
+		fm.ETag = chunksETag(chunks)
+		fm.Completion = fm.completion(c.bucketFor(fm.Tenant).BucketName())
+		if c.pipeline != nil {
+			// the upload is signed and announced once processed.
+			fm.Processing = c.pipeline.Steps()
+		} else {
+			c.signCDNURL(fm, chunks)
+		}
+	}
+	// the upload may have been terminated while its chunks were listed.
+	if _, uerr := c.store.Update(fm.ID, func(f *FileMetadata) error {
+		f.Finalization = fm.Finalization
+		f.ETag = fm.ETag
+		f.Completion = fm.Completion
+		f.Processing = fm.Processing
+		f.CDNURL = fm.CDNURL
+		f.CDNURLExpiresAt = fm.CDNURLExpiresAt
+		return nil
+	}); uerr != nil {
+		log.Debug().Err(uerr).Msg("upload removed before its completion")
+		return
+	}
+	if err == nil {
+		c.generateThumbnails(*fm, chunks)
+	}
+	if c.pipeline != nil && err == nil {
+		// PostFinish waits for the pipeline, so that uploads which aren't
+		// served yet aren't announced.
+		c.postProcess(*fm, chunks)
+	} else {
+		c.hooks.PostFinish(ctx, fm.hookUpload())
+	}
+}
+
 func (c *Controller) CreateUpload() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
 		uploadDeferLength := r.Header.Get(UploadDeferLengthHeader)
 		if uploadDeferLength != "" && uploadDeferLength != "1" {
 			w.WriteHeader(http.StatusBadRequest)
@@ -393,18 +942,48 @@ func (c *Controller) CreateUpload() http.HandlerFunc {
 		if c.maxSize > 0 && totalSize > c.maxSize {
 			w.WriteHeader(http.StatusRequestEntityTooLarge)
 			w.Write([]byte("Upload-Length exceeds the maximum size"))
+			return
 		}
 
 		uploadMetadata := r.Header.Get(UploadMetadataHeader)
-		log.Debug().Str("upload_metadata", uploadMetadata).Msg("Check request header")
+		// the values of the metadata aren't logged, the logs would keep the
+		// filenames of the owners erased.
+		log.Debug().Strs("metadata_keys", slices.Sorted(maps.Keys(decodeMetadata(uploadMetadata)))).Msg("Check request header")
 
 		fm := FileMetadata{
 			ID:        uuid.New().String(),
 			TotalSize: totalSize,
 			Metadata:  uploadMetadata,
 			ExpiresAt: time.Now().Add(UploadMaxDuration),
+			CreatedAt: time.Now(),
 		}
-		c.store.Save(fm.ID, fm)
+		if contentType := decodeMetadata(uploadMetadata)["content-type"]; c.contentType != nil && !c.contentType.Allowed(contentType) {
+			log.Debug().Str("content_type", contentType).Msg("content type rejected")
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%w: %s", sniff.ErrNotAllowed, contentType))
+			return
+		}
+		if p, ok := auth.FromContext(r.Context()); ok {
+			fm.Owner = p.Subject
+		}
+		fm.Tenant = auth.TenantFromContext(r.Context())
+		r, log = withUpload(r, log, fm)
+		if err := c.hooks.PreCreate(r.Context(), fm.hookUpload()); err != nil {
+			log.Debug().Err(err).Msg("upload rejected by the pre-create hook")
+			writeError(w, hooks.StatusCode(err), err)
+			return
+		}
+		switch err := c.store.Create(fm, c.tenantQuota, c.userQuota); {
+		case errors.Is(err, ErrTenantQuotaExceeded):
+			log.Debug().Str("tenant", fm.Tenant).Msg("tenant quota exceeded")
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		case errors.Is(err, ErrUserQuotaExceeded):
+			log.Debug().Str("owner", fm.Owner).Msg("user quota exceeded")
+			writeError(w, http.StatusInsufficientStorage, err)
+			return
+		}
+		c.hooks.PostCreate(r.Context(), fm.hookUpload())
+		c.metrics.Created(r.Context())
 
 		w.Header().Add("Location", fmt.Sprintf("/files/%s", fm.ID))
 		if !fm.ExpiresAt.IsZero() {
@@ -415,6 +994,548 @@ func (c *Controller) CreateUpload() http.HandlerFunc {
 	}
 }
 
+func (c *Controller) Terminate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		if !c.extensions.Enabled(TerminationExtension) {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("termination extension is not enabled"))
+			return
+		}
+
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok := c.find(r, fileID)
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !auth.CanAccess(r.Context(), fm.Owner) {
+			log.Debug().Msg("principal is not the owner of the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		if _, err := c.deleteChunks(r.Context(), fm); err != nil {
+			log.Error().Err(err).Msg("error deleting the file chunks")
+			writeError(w, http.StatusInternalServerError, errors.New("error removing the file"))
+			return
+		}
+		c.store.Delete(fileID)
+		c.hooks.PostTerminate(r.Context(), fm.hookUpload())
+
+		log.Debug().Msg("upload terminated")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Download streams the data of a completed upload from its chunks. Range
+// requests are supported so that clients can fetch large files in parts.
+// Owners may download their uploads; viewers may download every upload of
+// their tenant.
+func (c *Controller) Download() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok := c.find(r, fileID)
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !canDownload(r, fm.Owner) {
+			log.Debug().Msg("principal is not allowed to download the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if fm.UploadedSize != int64(fm.TotalSize) {
+			log.Debug().Msg("upload is not complete")
+			writeError(w, http.StatusConflict, errors.New("upload is not complete"))
+			return
+		}
+		if code, err := unservable(fm); err != nil {
+			log.Debug().Err(err).Msg("file can't be served")
+			writeError(w, code, err)
+			return
+		}
+
+		chunks, modTime, err := c.listChunks(r.Context(), fm)
+		if err != nil {
+			log.Error().Err(err).Msg("error listing the file chunks")
+			writeError(w, http.StatusInternalServerError, errors.New("error reading the file"))
+			return
+		}
+		content := newChunkReader(r.Context(), c.bucketFor(fm.Tenant), chunks)
+		defer content.Close()
+
+		if fm.ETag != "" {
+			w.Header().Set("ETag", fm.ETag)
+		}
+		md := decodeMetadata(fm.Metadata)
+		setContentHeaders(w, md["filename"], md["content-type"])
+		http.ServeContent(w, r, "", modTime, content)
+	}
+}
+
+// signCDNURL records a CDN signed URL of the completed upload when its data
+// is held by a single object.
+func (c *Controller) signCDNURL(fm *FileMetadata, chunks []chunk) {
+	if c.cdn == nil {
+		return
+	}
+	if len(chunks) != 1 {
+		c.log.Debug().Str("file_id", fm.ID).Int("chunks", len(chunks)).Msg("upload is not a single object, skipping cdn url")
+		return
+	}
+	expiresAt := time.Now().Add(c.cdnURLTTL)
+	u, err := c.cdn.Sign(chunks[0].name, expiresAt)
+	if err != nil {
+		c.log.Error().Err(err).Str("file_id", fm.ID).Msg("error signing the cdn url")
+		return
+	}
+	fm.CDNURL = u
+	fm.CDNURLExpiresAt = expiresAt
+}
+
+// thumbnailObject returns the name of the object holding the thumbnail of
+// the given size. It lives next to the chunks so that deleting the upload
+// removes it too.
+func thumbnailObject(fm FileMetadata, size int) string {
+	return fmt.Sprintf("%sthumbnail-%d", chunkPrefix(fm), size)
+}
+
+// generateThumbnails queues the generation of the thumbnails of a completed
+// image upload. The sizes which were generated are recorded in the upload
+// once the worker is done.
+func (c *Controller) generateThumbnails(fm FileMetadata, chunks []chunk) {
+	if c.thumbnails == nil || !thumbnail.Supported(decodeMetadata(fm.Metadata)["content-type"]) {
+		return
+	}
+	bkt := c.bucketFor(fm.Tenant)
+	err := c.thumbnails.Enqueue(thumbnail.Job{
+		ID: fm.ID,
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return newChunkReader(ctx, bkt, chunks), nil
+		},
+		Create: func(ctx context.Context, size int) (io.WriteCloser, error) {
+			objW := bkt.Object(thumbnailObject(fm, size)).NewWriter(ctx)
+			objW.ContentType = thumbnail.ContentType
+			return objW, nil
+		},
+		Done: func(sizes []int, err error) {
+			c.store.Update(fm.ID, func(f *FileMetadata) error {
+				f.Thumbnails = sizes
+				return nil
+			})
+		},
+	})
+	if err != nil {
+		c.log.Warn().Err(err).Str("file_id", fm.ID).Msg("unable to queue thumbnail generation")
+	}
+}
+
+// postProcess queues the post-processing of a completed upload. The status
+// of its steps is recorded in the upload as they run. Once they all
+// succeeded, its CDN URL is signed and PostFinish called; an upload whose
+// processing failed or couldn't be queued is never served.
+func (c *Controller) postProcess(fm FileMetadata, chunks []chunk) {
+	if c.pipeline == nil {
+		return
+	}
+	bkt := c.bucketFor(fm.Tenant)
+	err := c.pipeline.Enqueue(pipeline.Job{
+		Upload: fm.hookUpload(),
+		Open: func(ctx context.Context) (io.ReadCloser, error) {
+			return newChunkReader(ctx, bkt, chunks), nil
+		},
+		Update: func(steps []pipeline.Step) {
+			c.store.Update(fm.ID, func(f *FileMetadata) error {
+				f.Processing = steps
+				f.Quarantined = pipeline.Quarantined(steps)
+				return nil
+			})
+		},
+		Done: func(steps []pipeline.Step) {
+			if !pipeline.Succeeded(steps) {
+				c.log.Warn().Str("file_id", fm.ID).Msg("upload not post-processed, it won't be served")
+				return
+			}
+			signed := fm
+			c.signCDNURL(&signed, chunks)
+			f, err := c.store.Update(fm.ID, func(f *FileMetadata) error {
+				f.CDNURL = signed.CDNURL
+				f.CDNURLExpiresAt = signed.CDNURLExpiresAt
+				return nil
+			})
+			if err != nil {
+				return
+			}
+			c.hooks.PostFinish(context.Background(), f.hookUpload())
+		},
+	})
+	if err != nil {
+		c.log.Error().Err(err).Str("file_id", fm.ID).Msg("unable to queue post-processing, the upload won't be served")
+		c.store.Update(fm.ID, func(f *FileMetadata) error {
+			steps := slices.Clone(f.Processing)
+			for i := range steps {
+				steps[i].Status = pipeline.StatusFailed
+				steps[i].Error = err.Error()
+				steps[i].UpdatedAt = time.Now().UTC()
+			}
+			f.Processing = steps
+			return nil
+		})
+	}
+}
+
+// GetThumbnail serves a thumbnail of an image upload. The size query
+// parameter selects one of the generated sizes, the smallest by default.
+func (c *Controller) GetThumbnail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok := c.find(r, fileID)
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !canDownload(r, fm.Owner) {
+			log.Debug().Msg("principal is not allowed to download the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if code, err := unservable(fm); err != nil {
+			log.Debug().Err(err).Msg("file can't be served")
+			writeError(w, code, err)
+			return
+		}
+		size, ok := thumbnailSize(r, fm.Thumbnails)
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("thumbnail not found"))
+			return
+		}
+
+		objR, err := c.bucketFor(fm.Tenant).Object(thumbnailObject(fm, size)).NewReader(r.Context())
+		if err != nil {
+			log.Error().Err(err).Msg("error opening the thumbnail")
+			writeError(w, http.StatusNotFound, errors.New("thumbnail not found"))
+			return
+		}
+		defer objR.Close()
+		w.Header().Set("Content-Type", thumbnail.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(objR.Attrs.Size, 10))
+		if _, err := io.Copy(w, objR); err != nil {
+			log.Error().Err(err).Msg("error sending the thumbnail")
+		}
+	}
+}
+
+// thumbnailSize returns the size requested in the query if it was
+// generated, or the smallest generated size.
+func thumbnailSize(r *http.Request, sizes []int) (int, bool) {
+	if len(sizes) == 0 {
+		return 0, false
+	}
+	v := r.URL.Query().Get("size")
+	if v == "" {
+		return slices.Min(sizes), true
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || !slices.Contains(sizes, size) {
+		return 0, false
+	}
+	return size, true
+}
+
+type downloadURLRequest struct {
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type downloadURLResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssueDownloadURL returns a URL which lets anyone holding it download a
+// completed upload without credentials until it expires. Uploads sent in a
+// single PATCH are served by a GCS signed URL of their only chunk; the
+// others get a URL of the download endpoint signed with WithURLSigner. It
+// must be mounted at the download path followed by /download-url.
+func (c *Controller) IssueDownloadURL() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		fm, ok := c.find(r, fileID)
+		if !ok {
+			log.Debug().Str("file_id", fileID).Msg("file not found")
+			writeError(w, http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		r, log = withUpload(r, log, fm)
+		if !canDownload(r, fm.Owner) {
+			log.Debug().Msg("principal is not allowed to download the file")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+		if fm.UploadedSize != int64(fm.TotalSize) {
+			log.Debug().Msg("upload is not complete")
+			writeError(w, http.StatusConflict, errors.New("upload is not complete"))
+			return
+		}
+		if code, err := unservable(fm); err != nil {
+			log.Debug().Err(err).Msg("file can't be served")
+			writeError(w, code, err)
+			return
+		}
+
+		ttl, err := downloadURLTTL(w, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		expiresAt := time.Now().Add(ttl)
+
+		chunks, _, err := c.listChunks(r.Context(), fm)
+		if err != nil {
+			log.Error().Err(err).Msg("error listing the file chunks")
+			writeError(w, http.StatusInternalServerError, errors.New("error reading the file"))
+			return
+		}
+		var signed string
+		if len(chunks) == 1 {
+			signed, err = c.bucketFor(fm.Tenant).SignedURL(chunks[0].name, &storage.SignedURLOptions{
+				Method:  http.MethodGet,
+				Expires: expiresAt,
+				Scheme:  storage.SigningSchemeV4,
+			})
+			if err != nil {
+				log.Warn().Err(err).Msg("unable to sign gcs url, falling back to a signed download url")
+			}
+		}
+		if signed == "" && c.signer != nil {
+			// the url acts on behalf of the owner so that it passes the
+			// same access checks as the owner downloading the file.
+			subject := fm.Owner
+			if subject == "" {
+				subject = "anonymous"
+			}
+			signed, err = c.signer.Sign(downloadURL(r), auth.SignedURLClaims{
+				Subject:   subject,
+				Tenant:    fm.Tenant,
+				Methods:   []string{http.MethodGet},
+				ExpiresAt: expiresAt,
+			})
+			if err != nil {
+				log.Error().Err(err).Msg("unable to sign download url")
+				writeError(w, http.StatusInternalServerError, errors.New("unable to sign download url"))
+				return
+			}
+		}
+		if signed == "" {
+			writeError(w, http.StatusNotImplemented, errors.New("signed download urls are not available for this upload"))
+			return
+		}
+
+		b, _ := json.Marshal(downloadURLResponse{URL: signed, ExpiresAt: expiresAt.UTC()})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+const (
+	defaultDownloadURLTTL = 15 * time.Minute
+	maxDownloadURLTTL     = 24 * time.Hour
+)
+
+// downloadURLTTL returns the lifetime requested in the optional JSON body.
+func downloadURLTTL(w http.ResponseWriter, r *http.Request) (time.Duration, error) {
+	var req downloadURLRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, errors.New("invalid request body")
+	}
+	ttl := defaultDownloadURLTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > maxDownloadURLTTL {
+		return 0, fmt.Errorf("expires_in must not exceed %d seconds", int64(maxDownloadURLTTL.Seconds()))
+	}
+	return ttl, nil
+}
+
+// downloadURL returns the absolute URL of the download endpoint the
+// download-url request was made for.
+func downloadURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, strings.TrimSuffix(r.URL.Path, "/download-url"))
+}
+
+// setContentHeaders describes the downloaded file using the metadata given
+// at creation. Files are always served as attachments, and the declared
+// type is never sniffed, so that uploaded HTML can't run in the origin of
+// the server.
+func setContentHeaders(w http.ResponseWriter, filename, contentType string) {
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set(ContentTypeHeader, contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	disposition := "attachment"
+	if filename != "" {
+		if d := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); d != "" {
+			disposition = d
+		}
+	}
+	w.Header().Set("Content-Disposition", disposition)
+}
+
+// unservable returns the status refusing to serve the completed upload fm,
+// and why, until every step of its post-processing succeeded. Uploads whose
+// processing failed are never served, so that a scanner being unreachable
+// doesn't let unscanned content through.
+func unservable(fm FileMetadata) (int, error) {
+	switch {
+	case fm.Quarantined:
+		return http.StatusForbidden, errors.New("file is quarantined")
+	case pipeline.Failed(fm.Processing):
+		return http.StatusConflict, errors.New("post-processing of the file failed")
+	case !pipeline.Succeeded(fm.Processing):
+		return http.StatusLocked, errors.New("file is being processed")
+	}
+	return 0, nil
+}
+
+// canDownload reports whether the principal of the request may download an
+// upload owned by owner.
+func canDownload(r *http.Request, owner string) bool {
+	if auth.CanAccess(r.Context(), owner) {
+		return true
+	}
+	p, ok := auth.FromContext(r.Context())
+	return ok && p.HasRole(auth.RoleViewer)
+}
+
+// deleteChunks deletes every object written for the upload and returns
+// their names. Every PATCH is stored as its own object named after the file
+// id and the offset it starts at.
+func (c *Controller) deleteChunks(ctx context.Context, fm FileMetadata) ([]string, error) {
+	bkt := c.bucketFor(fm.Tenant)
+	it := bkt.Objects(ctx, &storage.Query{Prefix: chunkPrefix(fm)})
+	var deleted []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return deleted, nil
+		}
+		if err != nil {
+			return deleted, err
+		}
+		err = bkt.Object(attrs.Name).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return deleted, fmt.Errorf("error deleting %s: %w", attrs.Name, err)
+		}
+		deleted = append(deleted, fmt.Sprintf("gs://%s/%s", bkt.BucketName(), attrs.Name))
+	}
+}
+
+type erasedUpload struct {
+	ID      string   `json:"id"`
+	Objects []string `json:"objects"`
+	Size    int64    `json:"size"`
+}
+
+type eraseResponse struct {
+	Owner   string         `json:"owner"`
+	Uploads []erasedUpload `json:"uploads"`
+}
+
+// EraseOwner deletes the chunks and metadata of every upload created by the
+// owner in the path, e.g. to honor a data-subject erasure request. Principals
+// may erase their own uploads; erasing those of someone else requires the
+// admin role. The response lists what was removed so that it can
+// be kept as a record of the erasure.
+func (c *Controller) EraseOwner() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := c.logger(r.Context())
+		p, ok := auth.FromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, auth.ErrUnauthenticated)
+			return
+		}
+		owner := mux.Vars(r)["owner"]
+		if owner != p.Subject && !p.HasRole(auth.RoleAdmin) {
+			log.Debug().Str("owner", owner).Str("subject", p.Subject).Msg("principal is not allowed to erase the owner")
+			writeError(w, http.StatusForbidden, auth.ErrForbidden)
+			return
+		}
+
+		// the owners erase their uploads of their tenant, the admins those
+		// of every tenant.
+		tenant := auth.TenantFromContext(r.Context())
+		resp := eraseResponse{Owner: owner, Uploads: []erasedUpload{}}
+		for _, fm := range c.store.FindByOwner(owner) {
+			if fm.Tenant != tenant && !p.HasRole(auth.RoleAdmin) {
+				continue
+			}
+			objects, err := c.deleteChunks(r.Context(), fm)
+			if err != nil {
+				log.Error().Err(err).Str("file_id", fm.ID).Msg("error deleting the file chunks")
+				writeError(w, http.StatusInternalServerError, fmt.Errorf("error removing the file %s", fm.ID))
+				return
+			}
+			c.store.Delete(fm.ID)
+			c.hooks.PostTerminate(r.Context(), fm.hookUpload())
+			resp.Uploads = append(resp.Uploads, erasedUpload{ID: fm.ID, Objects: objects, Size: fm.UploadedSize})
+		}
+
+		log.Info().Str("owner", owner).Str("subject", p.Subject).Int("uploads", len(resp.Uploads)).Msg("owner erased")
+		b, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+type usageResponse struct {
+	Owner string `json:"owner"`
+	Used  uint64 `json:"used"`
+	Quota uint64 `json:"quota,omitempty"`
+}
+
+// GetUsage reports the storage used by the authenticated principal and the
+// quota it is subject to.
+func (c *Controller) GetUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := auth.FromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, auth.ErrUnauthenticated)
+			return
+		}
+
+		b, _ := json.Marshal(usageResponse{
+			Owner: p.Subject,
+			Used:  c.store.OwnerUsage(p.Subject),
+			Quota: c.userQuota,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
 func uploadExpiresAt(t time.Time) string {
 	return t.Format("Mon, 02 Jan 2006 15:04:05 GMT")
 }
@@ -423,6 +1544,24 @@ type cError struct {
 	Message string `json:"message"`
 }
 
+// maxDrainSize is the number of bytes of the body of a rejected chunk read
+// so that its connection can be reused. The connections of larger bodies
+// are closed instead of reading them.
+const maxDrainSize = 64 << 10
+
+// rejectChunk writes the error of a request rejected before its body was
+// read. Small bodies are drained, so that the connection is kept; larger
+// ones, or those of unknown length, close the connection rather than
+// wasting the bandwidth of receiving them.
+func rejectChunk(w http.ResponseWriter, r *http.Request, code int, err error) {
+	if r.ContentLength < 0 || r.ContentLength > maxDrainSize {
+		w.Header().Set("Connection", "close")
+	} else if n, _ := io.CopyN(io.Discard, r.Body, maxDrainSize+1); n > maxDrainSize {
+		w.Header().Set("Connection", "close")
+	}
+	writeError(w, code, err)
+}
+
 func writeError(w http.ResponseWriter, code int, err error) {
 	w.WriteHeader(code)
 
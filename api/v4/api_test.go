@@ -2,16 +2,105 @@ package v3_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/gorilla/mux"
-	. "github.com/imrenagi/go-http-upload/api/v3"
+	. "github.com/imrenagi/go-http-upload/api/v4"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/pipeline"
+	"github.com/imrenagi/go-http-upload/sniff"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
 )
 
+// newController builds a controller whose buckets are kept in memory by a
+// fake GCS server.
+func newController(t *testing.T, s Storage, opts ...Option) Controller {
+	gcs := &fakeGCS{objects: map[string][]byte{}}
+	srv := httptest.NewServer(gcs)
+	t.Cleanup(srv.Close)
+	client, err := storage.NewClient(context.Background(),
+		option.WithoutAuthentication(),
+		option.WithEndpoint(srv.URL+"/storage/v1/"))
+	assert.NoError(t, err)
+	return NewController(s, append([]Option{WithStorageClient(client)}, opts...)...)
+}
+
+// fakeGCS serves the subset of the GCS JSON and XML APIs the controller
+// uses, keeping the objects, keyed by bucket and name, in memory.
+type fakeGCS struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var attrs struct {
+			Name string `json:"name"`
+		}
+		part, _ := mr.NextPart()
+		json.NewDecoder(part).Decode(&attrs)
+		part, _ = mr.NextPart()
+		data, _ := io.ReadAll(part)
+		f.objects[bucket+"/"+attrs.Name] = data
+		json.NewEncoder(w).Encode(f.object(bucket, attrs.Name))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o")
+		var names []string
+		for key := range f.objects {
+			if name, ok := strings.CutPrefix(key, bucket+"/"); ok && strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		items := []map[string]any{}
+		for _, name := range names {
+			items = append(items, f.object(bucket, name))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"items": items})
+	case r.Method == http.MethodDelete:
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o/")
+		delete(f.objects, bucket+"/"+name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeGCS) object(bucket, name string) map[string]any {
+	return map[string]any{
+		"bucket": bucket,
+		"name":   name,
+		"size":   strconv.Itoa(len(f.objects[bucket+"/"+name])),
+	}
+}
+
 func newFakeStore(m map[string]FileMetadata) *fakeStore {
 	return &fakeStore{
 		files: m,
@@ -31,6 +120,63 @@ func (s *fakeStore) Save(id string, metadata FileMetadata) {
 	s.files[id] = metadata
 }
 
+func (s *fakeStore) Update(id string, fn func(fm *FileMetadata) error) (FileMetadata, error) {
+	fm, exists := s.files[id]
+	if !exists {
+		return FileMetadata{}, ErrNotFound
+	}
+	if err := fn(&fm); err != nil {
+		return FileMetadata{}, err
+	}
+	s.files[id] = fm
+	return fm, nil
+}
+
+func (s *fakeStore) Create(fm FileMetadata, tenantQuota, userQuota uint64) error {
+	if tenantQuota > 0 && s.Usage(fm.Tenant)+fm.TotalSize > tenantQuota {
+		return ErrTenantQuotaExceeded
+	}
+	if userQuota > 0 && fm.Owner != "" && s.OwnerUsage(fm.Owner)+fm.TotalSize > userQuota {
+		return ErrUserQuotaExceeded
+	}
+	s.files[fm.ID] = fm
+	return nil
+}
+
+func (s *fakeStore) Delete(id string) {
+	delete(s.files, id)
+}
+
+func (s *fakeStore) FindByOwner(owner string) []FileMetadata {
+	var files []FileMetadata
+	for _, f := range s.files {
+		if f.Owner == owner {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (s *fakeStore) OwnerUsage(owner string) uint64 {
+	var total uint64
+	for _, f := range s.files {
+		if f.Owner == owner {
+			total += f.TotalSize
+		}
+	}
+	return total
+}
+
+func (s *fakeStore) Usage(tenant string) uint64 {
+	var total uint64
+	for _, f := range s.files {
+		if f.Tenant == tenant {
+			total += f.TotalSize
+		}
+	}
+	return total
+}
+
 func TestGetOffset(t *testing.T) {
 	t.Run("The Server MUST always include the Upload-Offset header in the response for a HEAD request. The Server SHOULD acknowledge successful HEAD requests with a 200 OK or 204 No Content status.",
 		func(t *testing.T) {
@@ -40,7 +186,7 @@ func TestGetOffset(t *testing.T) {
 					UploadedSize: 0,
 				},
 			}
-			ctrl := NewController(newFakeStore(m))
+			ctrl := newController(t, newFakeStore(m))
 
 			req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
 			w := httptest.NewRecorder()
@@ -64,7 +210,7 @@ func TestGetOffset(t *testing.T) {
 				TotalSize:    100,
 			},
 		}
-		ctrl := NewController(newFakeStore(m))
+		ctrl := newController(t, newFakeStore(m))
 
 		req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
 		w := httptest.NewRecorder()
@@ -79,7 +225,7 @@ func TestGetOffset(t *testing.T) {
 
 	t.Run("If the resource is not found, the Server SHOULD return either the 404 Not Found status without the Upload-Offset header.", func(t *testing.T) {
 		m := map[string]FileMetadata{}
-		ctrl := NewController(newFakeStore(m))
+		ctrl := newController(t, newFakeStore(m))
 
 		req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
 		w := httptest.NewRecorder()
@@ -97,7 +243,7 @@ func TestGetOffset(t *testing.T) {
 func TestTusResumableHeader(t *testing.T) {
 	t.Run("Return 400 if The Tus-Resumable header is not included in HEAD request", func(t *testing.T) {
 		m := map[string]FileMetadata{}
-		ctrl := NewController(newFakeStore(m))
+		ctrl := newController(t, newFakeStore(m))
 
 		req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
 		w := httptest.NewRecorder()
@@ -115,7 +261,7 @@ func TestTusResumableHeader(t *testing.T) {
 
 	t.Run("Return 412 if The Tus-Resumable header is not supported by the server. server must not process the request", func(t *testing.T) {
 		m := map[string]FileMetadata{}
-		ctrl := NewController(newFakeStore(m))
+		ctrl := newController(t, newFakeStore(m))
 
 		req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
 		req.Header.Set(TusResumableHeader, "1.0.1")
@@ -140,7 +286,7 @@ func TestTusResumableHeader(t *testing.T) {
 				TotalSize:    100,
 			},
 		}
-		ctrl := NewController(newFakeStore(m))
+		ctrl := newController(t, newFakeStore(m))
 		router := mux.NewRouter()
 		router.Use(TusResumableHeaderCheck)
 		router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset())
@@ -166,7 +312,7 @@ func TestTusResumableHeader(t *testing.T) {
 				TotalSize:    100,
 			},
 		}
-		ctrl := NewController(newFakeStore(m))
+		ctrl := newController(t, newFakeStore(m))
 		router := mux.NewRouter()
 		router.Use(TusResumableHeaderInjections)
 		router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset())
@@ -182,7 +328,7 @@ func TestTusResumableHeader(t *testing.T) {
 func TestGetConfig(t *testing.T) {
 	t.Run("A successful response indicated by the 204 No Content or 200 OK status MUST contain the Tus-Version header", func(t *testing.T) {
 		m := map[string]FileMetadata{}
-		ctrl := NewController(newFakeStore(m))
+		ctrl := newController(t, newFakeStore(m))
 
 		req := httptest.NewRequest(http.MethodOptions, "/api/v1/files", nil)
 		w := httptest.NewRecorder()
@@ -198,7 +344,7 @@ func TestGetConfig(t *testing.T) {
 
 	t.Run("It MAY include the Tus-Extension and Tus-Max-Size headers.", func(t *testing.T) {
 		m := map[string]FileMetadata{}
-		ctrl := NewController(newFakeStore(m),
+		ctrl := newController(t, newFakeStore(m),
 			WithExtensions(Extensions{CreationExtension,
 				ExpirationExtension,
 				ChecksumExtension}),
@@ -218,7 +364,7 @@ func TestGetConfig(t *testing.T) {
 
 	t.Run("The extension header must be omitted if the server does not support any extensions", func(t *testing.T) {
 		m := map[string]FileMetadata{}
-		ctrl := NewController(newFakeStore(m),
+		ctrl := newController(t, newFakeStore(m),
 			WithExtensions(Extensions{}),
 		)
 
@@ -246,7 +392,7 @@ func TestResumeUpload(t *testing.T) {
 				TotalSize:    10,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{}))
 
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", nil)
 		w := httptest.NewRecorder()
@@ -267,7 +413,7 @@ func TestResumeUpload(t *testing.T) {
 				TotalSize:    10,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{}))
 
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", nil)
 		req.Header.Set("Upload-Offset", "-1")
@@ -289,7 +435,7 @@ func TestResumeUpload(t *testing.T) {
 				TotalSize:    10,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{}))
 
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", nil)
 		req.Header.Set("Content-Type", "application/json")
@@ -306,7 +452,7 @@ func TestResumeUpload(t *testing.T) {
 
 	t.Run("If the server receives a PATCH request against a non-existent resource it SHOULD return a 404 Not Found status.", func(t *testing.T) {
 		m := map[string]FileMetadata{}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{}))
 
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", nil)
 		req.Header.Set("Content-Type", "application/offset+octet-stream")
@@ -329,7 +475,7 @@ func TestResumeUpload(t *testing.T) {
 				TotalSize:    10,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{}))
 
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", nil)
 		req.Header.Set("Content-Type", "application/offset+octet-stream")
@@ -352,7 +498,7 @@ func TestResumeUpload(t *testing.T) {
 				TotalSize:    5,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{}))
 
 		buf := bytes.NewBufferString("ccc")
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf)
@@ -379,7 +525,7 @@ func TestExpiration(t *testing.T) {
 				ExpiresAt:    time.Now().Add(1 * time.Hour),
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ExpirationExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ExpirationExtension}))
 
 		req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
 		w := httptest.NewRecorder()
@@ -405,7 +551,7 @@ func TestExpiration(t *testing.T) {
 				ExpiresAt:    time.Now().Add(-1 * time.Hour),
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ExpirationExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ExpirationExtension}))
 
 		req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
 		w := httptest.NewRecorder()
@@ -431,7 +577,7 @@ func TestExpiration(t *testing.T) {
 				ExpiresAt:    time.Now().Add(1 * time.Hour),
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ExpirationExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ExpirationExtension}))
 
 		buf := bytes.NewBufferString("ccc")
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf)
@@ -462,7 +608,7 @@ func TestExpiration(t *testing.T) {
 				ExpiresAt:    time.Now().Add(-1 * time.Hour),
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ExpirationExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ExpirationExtension}))
 
 		buf := bytes.NewBufferString("ccc")
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf)
@@ -491,7 +637,7 @@ func TestChecksum(t *testing.T) {
 				TotalSize:    1,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
 
 		buf := bytes.NewBufferString("1")
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf)
@@ -516,7 +662,7 @@ func TestChecksum(t *testing.T) {
 				TotalSize:    1,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
 
 		buf := bytes.NewBufferString("1")
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf)
@@ -541,7 +687,7 @@ func TestChecksum(t *testing.T) {
 				TotalSize:    1,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
 
 		buf := bytes.NewBufferString("1")
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf)
@@ -566,7 +712,7 @@ func TestChecksum(t *testing.T) {
 				TotalSize:    1,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
 
 		buf := bytes.NewBufferString("1")
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf)
@@ -591,7 +737,7 @@ func TestChecksum(t *testing.T) {
 				TotalSize:    1,
 			},
 		}
-		ctrl := NewController(newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
+		ctrl := newController(t, newFakeStore(m), WithExtensions(Extensions{ChecksumExtension}))
 
 		buf := bytes.NewBufferString("1")
 		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", buf)
@@ -608,3 +754,222 @@ func TestChecksum(t *testing.T) {
 		assert.Equal(t, `{"message":"checksum mismatch"}`, w.Body.String())
 	})
 }
+
+// withPrincipal serves the requests of h on behalf of p in tenant.
+func withPrincipal(h http.Handler, p auth.Principal, tenant string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := auth.NewContext(r.Context(), p)
+		h.ServeHTTP(w, r.WithContext(auth.NewTenantContext(ctx, tenant)))
+	})
+}
+
+func TestQuota(t *testing.T) {
+	create := func(ctrl Controller, owner, tenant, length string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+		req.Header.Set(UploadLengthHeader, length)
+		w := httptest.NewRecorder()
+		withPrincipal(ctrl.CreateUpload(), auth.Principal{Subject: owner}, tenant).ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("POST request of an owner out of quota must be rejected with 507", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", Owner: "alice", TotalSize: 10},
+		}
+		ctrl := newController(t, newFakeStore(m), WithUserQuota(15))
+
+		assert.Equal(t, http.StatusInsufficientStorage, create(ctrl, "alice", "", "10").Code)
+		assert.Equal(t, http.StatusCreated, create(ctrl, "bob", "", "10").Code)
+		assert.Len(t, m, 2)
+	})
+
+	t.Run("POST request of a tenant out of quota must be rejected with 413", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", Owner: "alice", Tenant: "acme", TotalSize: 10},
+		}
+		ctrl := newController(t, newFakeStore(m), WithTenantQuota(15))
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, create(ctrl, "bob", "acme", "10").Code)
+		assert.Equal(t, http.StatusCreated, create(ctrl, "bob", "globex", "10").Code)
+		assert.Len(t, m, 2)
+	})
+
+	t.Run("POST request larger than the maximum size must not create an upload", func(t *testing.T) {
+		m := map[string]FileMetadata{}
+		ctrl := newController(t, newFakeStore(m), WithMaxSize(5))
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, create(ctrl, "alice", "", "10").Code)
+		assert.Empty(t, m)
+	})
+}
+
+func TestTenancy(t *testing.T) {
+	m := map[string]FileMetadata{
+		"a": {ID: "a", Owner: "alice", Tenant: "acme", TotalSize: 10},
+	}
+	ctrl := newController(t, newFakeStore(m))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.GetOffset()).Methods(http.MethodHead)
+	router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+
+	t.Run("HEAD request for the upload of another tenant must not be found", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
+		w := httptest.NewRecorder()
+		withPrincipal(router, auth.Principal{Subject: "alice"}, "globex").ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Empty(t, w.Header().Get(UploadOffsetHeader))
+	})
+
+	t.Run("PATCH request for the upload of another tenant must not be found", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString("hello"))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		withPrincipal(router, auth.Principal{Subject: "alice"}, "globex").ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, int64(0), m["a"].UploadedSize)
+	})
+
+	t.Run("HEAD request of the owner in its tenant must report the offset", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/api/v1/files/a", nil)
+		w := httptest.NewRecorder()
+		withPrincipal(router, auth.Principal{Subject: "alice"}, "acme").ServeHTTP(w, req)
+
+		assert.Equal(t, "0", w.Header().Get(UploadOffsetHeader))
+	})
+}
+
+func TestDownload(t *testing.T) {
+	newRouter := func(ctrl Controller) *mux.Router {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.Download()).Methods(http.MethodGet)
+		return router
+	}
+	download := func(router http.Handler, p auth.Principal, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/a", nil)
+		w := httptest.NewRecorder()
+		withPrincipal(router, p, tenant).ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("completed upload must be served to its owner", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", Owner: "alice", Tenant: "acme", TotalSize: 5, ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		router := newRouter(newController(t, newFakeStore(m)))
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString("hello"))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		withPrincipal(router, auth.Principal{Subject: "alice"}, "acme").ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		w = download(router, auth.Principal{Subject: "alice"}, "acme")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello", w.Body.String())
+		assert.NotEmpty(t, m["a"].ETag)
+	})
+
+	t.Run("upload of another owner must be forbidden unless the principal is a viewer", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", Owner: "alice", TotalSize: 0},
+		}
+		router := newRouter(newController(t, newFakeStore(m)))
+
+		assert.Equal(t, http.StatusForbidden, download(router, auth.Principal{Subject: "bob"}, "").Code)
+		assert.Equal(t, http.StatusOK, download(router, auth.Principal{Subject: "bob", Roles: []auth.Role{auth.RoleViewer}}, "").Code)
+	})
+
+	t.Run("upload of another tenant must not be found", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", Owner: "alice", Tenant: "acme", TotalSize: 0},
+		}
+		router := newRouter(newController(t, newFakeStore(m)))
+
+		assert.Equal(t, http.StatusNotFound, download(router, auth.Principal{Subject: "alice"}, "globex").Code)
+	})
+
+	t.Run("incomplete upload must not be served", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", Owner: "alice", TotalSize: 5, UploadedSize: 3},
+		}
+		router := newRouter(newController(t, newFakeStore(m)))
+
+		assert.Equal(t, http.StatusConflict, download(router, auth.Principal{Subject: "alice"}, "").Code)
+	})
+
+	t.Run("upload not post-processed must not be served", func(t *testing.T) {
+		step := func(status pipeline.Status) []pipeline.Step {
+			return []pipeline.Step{{Name: "scan", Status: status}}
+		}
+		for _, tt := range []struct {
+			name string
+			fm   FileMetadata
+			code int
+		}{
+			{"processing", FileMetadata{Processing: step(pipeline.StatusRunning)}, http.StatusLocked},
+			{"failed", FileMetadata{Processing: step(pipeline.StatusFailed)}, http.StatusConflict},
+			{"quarantined", FileMetadata{Processing: step(pipeline.StatusSucceeded), Quarantined: true}, http.StatusForbidden},
+		} {
+			tt.fm.ID, tt.fm.Owner = "a", "alice"
+			m := map[string]FileMetadata{"a": tt.fm}
+			router := newRouter(newController(t, newFakeStore(m)))
+
+			assert.Equal(t, tt.code, download(router, auth.Principal{Subject: "alice"}, "").Code, tt.name)
+		}
+	})
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	policy := &sniff.Policy{Deny: []string{"text/html"}, Mismatch: sniff.MismatchReject}
+	patch := func(ctrl Controller, body string) *httptest.ResponseRecorder {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v1/files/{file_id}", ctrl.ResumeUpload()).Methods(http.MethodPatch)
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/a", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("first chunk shorter than the bytes sniffed must be rejected", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", TotalSize: 600, ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		ctrl := newController(t, newFakeStore(m), WithContentTypePolicy(policy))
+
+		w := patch(ctrl, "hello")
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, int64(0), m["a"].UploadedSize)
+	})
+
+	t.Run("first chunk holding the whole upload must be sniffed", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", TotalSize: 5, Metadata: "content-type dGV4dC9wbGFpbg==", ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		ctrl := newController(t, newFakeStore(m), WithContentTypePolicy(policy))
+
+		w := patch(ctrl, "hello")
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "text/plain", m["a"].SniffedContentType)
+	})
+
+	t.Run("content of a denied type must be rejected", func(t *testing.T) {
+		m := map[string]FileMetadata{
+			"a": {ID: "a", TotalSize: 13, Metadata: "content-type dGV4dC9odG1s", ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		ctrl := newController(t, newFakeStore(m), WithContentTypePolicy(policy))
+
+		w := patch(ctrl, "<html></html>")
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		assert.Equal(t, int64(0), m["a"].UploadedSize)
+	})
+}
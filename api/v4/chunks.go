@@ -0,0 +1,191 @@
+package v3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/imrenagi/go-http-upload/compose"
+	"google.golang.org/api/iterator"
+)
+
+// chunk is an object holding the data sent by a single PATCH request,
+// starting at offset in the upload.
+type chunk struct {
+	name   string
+	offset int64
+	size   int64
+	crc32c uint32
+}
+
+// listChunks returns the chunks of the upload sorted by offset together with
+// the time the last one was written.
+func (c *Controller) listChunks(ctx context.Context, fm FileMetadata) ([]chunk, time.Time, error) {
+	prefix := chunkPrefix(fm)
+	it := c.bucketFor(fm.Tenant).Objects(ctx, &storage.Query{Prefix: prefix})
+	var chunks []chunk
+	var updated time.Time
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		offset, err := strconv.ParseInt(strings.TrimPrefix(attrs.Name, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, chunk{name: attrs.Name, offset: offset, size: attrs.Size, crc32c: attrs.CRC32C})
+		if attrs.Updated.After(updated) {
+			updated = attrs.Updated
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].offset < chunks[j].offset
+	})
+
+	var next int64
+	contiguous := chunks[:0]
+	for _, ch := range chunks {
+		if ch.offset+ch.size <= next {
+			// a chunk composed but not deleted holds data of the composed
+			// object.
+			continue
+		}
+		if ch.offset != next {
+			return nil, time.Time{}, fmt.Errorf("missing data at offset %d", next)
+		}
+		next += ch.size
+		contiguous = append(contiguous, ch)
+	}
+	return contiguous, updated, nil
+}
+
+// composeChunks composes the chunks of the upload into the object of the
+// first one, and returns it as the only chunk of the upload.
+func (c *Controller) composeChunks(ctx context.Context, fm FileMetadata, chunks []chunk) ([]chunk, error) {
+	if len(chunks) < 2 {
+		return chunks, nil
+	}
+	srcs := make([]compose.Source, len(chunks))
+	for i, ch := range chunks {
+		srcs[i] = compose.Source{Name: ch.name, Offset: ch.offset, Size: ch.size, CRC32C: ch.crc32c}
+	}
+	attrs, err := compose.Compose(ctx, c.bucketFor(fm.Tenant), chunks[0].name, srcs)
+	if errors.Is(err, compose.ErrNotDeleted) {
+		// the chunks left are skipped by listChunks, and deleted with the
+		// upload.
+		c.logger(ctx).Warn().Err(err).Msg("unable to delete the composed chunks")
+	} else if err != nil {
+		return nil, err
+	}
+	return []chunk{{name: attrs.Name, size: attrs.Size, crc32c: attrs.CRC32C}}, nil
+}
+
+// chunksETag returns a strong entity tag derived from the checksums GCS
+// computed for every chunk, so the content doesn't have to be read back.
+func chunksETag(chunks []chunk) string {
+	h := sha256.New()
+	for _, ch := range chunks {
+		fmt.Fprintf(h, "%d:%d:%08x\n", ch.offset, ch.size, ch.crc32c)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// chunkReader presents the chunks of an upload as a single seekable stream
+// so that http.ServeContent can serve range requests from them. Only the
+// chunks overlapping the requested ranges are read.
+type chunkReader struct {
+	ctx    context.Context
+	bucket *storage.BucketHandle
+	chunks []chunk
+	size   int64
+
+	pos int64
+	cur io.ReadCloser
+}
+
+func newChunkReader(ctx context.Context, bkt *storage.BucketHandle, chunks []chunk) *chunkReader {
+	var size int64
+	for _, ch := range chunks {
+		size += ch.size
+	}
+	return &chunkReader{
+		ctx:    ctx,
+		bucket: bkt,
+		chunks: chunks,
+		size:   size,
+	}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.pos >= r.size {
+			return 0, io.EOF
+		}
+		if r.cur == nil {
+			i := sort.Search(len(r.chunks), func(i int) bool {
+				return r.chunks[i].offset+r.chunks[i].size > r.pos
+			})
+			ch := r.chunks[i]
+			rd, err := r.bucket.Object(ch.name).NewRangeReader(r.ctx, r.pos-ch.offset, -1)
+			if err != nil {
+				return 0, err
+			}
+			r.cur = rd
+		}
+
+		n, err := r.cur.Read(p)
+		r.pos += int64(n)
+		if errors.Is(err, io.EOF) {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	if pos != r.pos {
+		r.Close()
+		r.pos = pos
+	}
+	return pos, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
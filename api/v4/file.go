@@ -1,7 +1,14 @@
 package v3
 
 import (
+	"encoding/base64"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/imrenagi/go-http-upload/finalize"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/pipeline"
 )
 
 type FileMetadata struct {
@@ -10,5 +17,82 @@ type FileMetadata struct {
 	UploadedSize int64
 	Metadata     string
 	ExpiresAt    time.Time
+	CreatedAt    time.Time
 	Path         string
+	Owner        string
+	Tenant       string
+	// ETag identifies the content of the upload once it is complete.
+	ETag string
+	// Thumbnails are the sizes of the thumbnails generated for the upload.
+	Thumbnails []int
+	// CDNURL is a CDN signed URL of the completed upload, valid until
+	// CDNURLExpiresAt.
+	CDNURL          string
+	CDNURLExpiresAt time.Time
+	// Processing is the status of the post-processing steps of the
+	// completed upload.
+	Processing []pipeline.Step
+	// Quarantined is set when post-processing found the upload harmful. It
+	// is then never served.
+	Quarantined bool
+	// SniffedContentType is the content type detected from the first bytes
+	// of the upload, when a content type policy is enforced.
+	// ContentTypeMismatch flags when it contradicts the declared one.
+	SniffedContentType  string
+	ContentTypeMismatch bool
+	// Completion records the outcome of the upload once it is complete.
+	Completion *hooks.Completion
+	// Finalization is the status of the finalization of an upload
+	// finalized in the background.
+	Finalization finalize.Status
+}
+
+// decodeMetadata returns the key-value pairs of an Upload-Metadata header.
+// Malformed pairs are skipped.
+func decodeMetadata(m string) map[string]string {
+	md := make(map[string]string)
+	for _, kv := range strings.Split(m, ",") {
+		parts := strings.Fields(kv)
+		switch len(parts) {
+		case 1:
+			md[parts[0]] = ""
+		case 2:
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			md[parts[0]] = string(decoded)
+		}
+	}
+	return md
+}
+
+func (f FileMetadata) hookUpload() hooks.Upload {
+	return hooks.Upload{
+		ID:         f.ID,
+		Tenant:     f.Tenant,
+		Owner:      f.Owner,
+		Size:       f.TotalSize,
+		Offset:     uint64(f.UploadedSize),
+		Metadata:   decodeMetadata(f.Metadata),
+		ExpiresAt:  f.ExpiresAt,
+		Completion: f.Completion,
+	}
+}
+
+// completion returns the completion record of the upload, completed now.
+// The chunks aren't read back, so it holds no checksums.
+func (f FileMetadata) completion(bucket string) *hooks.Completion {
+	now := time.Now().UTC()
+	c := &hooks.Completion{
+		Size:        f.TotalSize,
+		Metadata:    decodeMetadata(f.Metadata),
+		StorageURI:  fmt.Sprintf("gs://%s/%s", bucket, chunkPrefix(f)),
+		CompletedAt: now,
+	}
+	if !f.CreatedAt.IsZero() {
+		c.StartedAt = f.CreatedAt.UTC()
+		c.Duration = now.Sub(f.CreatedAt)
+	}
+	return c
 }
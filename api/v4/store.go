@@ -1,6 +1,22 @@
 package v3
 
-import "sync"
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by Store.Update when the upload doesn't
+	// exist, e.g. it was terminated.
+	ErrNotFound = errors.New("upload not found")
+	// ErrTenantQuotaExceeded is returned by Store.Create when the uploads of
+	// the tenant would take more than its quota.
+	ErrTenantQuotaExceeded = errors.New("tenant storage quota exceeded")
+	// ErrUserQuotaExceeded is returned by Store.Create when the uploads of
+	// the owner would take more than its quota.
+	ErrUserQuotaExceeded = errors.New("user storage quota exceeded")
+)
 
 
 
@@ -28,3 +44,93 @@ func (s *Store) Save(id string, metadata FileMetadata) {
 	s.files[id] = metadata
 }
 
+func (s *Store) Update(id string, fn func(fm *FileMetadata) error) (FileMetadata, error) {
+	s.Lock()
+	defer s.Unlock()
+	fm, exists := s.files[id]
+	if !exists {
+		return FileMetadata{}, ErrNotFound
+	}
+	if err := fn(&fm); err != nil {
+		return FileMetadata{}, err
+	}
+	s.files[id] = fm
+	return fm, nil
+}
+
+func (s *Store) Create(fm FileMetadata, tenantQuota, userQuota uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	var tenantUsage, ownerUsage uint64
+	for _, f := range s.files {
+		if f.Tenant == fm.Tenant {
+			tenantUsage += f.TotalSize
+		}
+		if f.Owner == fm.Owner {
+			ownerUsage += f.TotalSize
+		}
+	}
+	if tenantQuota > 0 && tenantUsage+fm.TotalSize > tenantQuota {
+		return ErrTenantQuotaExceeded
+	}
+	if userQuota > 0 && fm.Owner != "" && ownerUsage+fm.TotalSize > userQuota {
+		return ErrUserQuotaExceeded
+	}
+	s.files[fm.ID] = fm
+	return nil
+}
+
+func (s *Store) Delete(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.files, id)
+}
+
+func (s *Store) Usage(tenant string) uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	var total uint64
+	for _, f := range s.files {
+		if f.Tenant == tenant {
+			total += f.TotalSize
+		}
+	}
+	return total
+}
+
+func (s *Store) OwnerUsage(owner string) uint64 {
+	s.RLock()
+	defer s.RUnlock()
+	var total uint64
+	for _, f := range s.files {
+		if f.Owner == owner {
+			total += f.TotalSize
+		}
+	}
+	return total
+}
+
+func (s *Store) FindByOwner(owner string) []FileMetadata {
+	s.RLock()
+	defer s.RUnlock()
+	var files []FileMetadata
+	for _, f := range s.files {
+		if f.Owner == owner {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// OpenUploads returns the number of uploads neither complete nor expired.
+func (s *Store) OpenUploads() int {
+	s.RLock()
+	defer s.RUnlock()
+	var n int
+	for _, f := range s.files {
+		if f.UploadedSize < int64(f.TotalSize) && time.Now().Before(f.ExpiresAt) {
+			n++
+		}
+	}
+	return n
+}
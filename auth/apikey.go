@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const APIKeyHeader = "X-Api-Key"
+
+// APIKey is a credential issued to a client together with the limits
+// applied to the requests made with it. A zero limit means unlimited.
+type APIKey struct {
+	Key     string `json:"key"`
+	Subject string `json:"subject"`
+	Tenant  string `json:"tenant"`
+	Roles   []Role `json:"roles"`
+	// MaxUploadSize is the largest upload, in bytes, the key may create.
+	MaxUploadSize uint64 `json:"max_upload_size"`
+	// RequestsPerSecond and Burst configure a token bucket shared by every
+	// request made with the key.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	// DailyQuota is the number of bytes the key may send per UTC day.
+	DailyQuota uint64 `json:"daily_quota"`
+}
+
+type KeyStore interface {
+	Find(key string) (APIKey, bool, error)
+}
+
+type MemoryKeyStore struct {
+	sync.RWMutex
+	keys map[string]APIKey
+}
+
+func NewMemoryKeyStore(keys ...APIKey) *MemoryKeyStore {
+	s := &MemoryKeyStore{
+		keys: make(map[string]APIKey),
+	}
+	for _, k := range keys {
+		s.keys[k.Key] = k
+	}
+	return s
+}
+
+// NewFileKeyStore loads the keys from a JSON file containing an array of
+// APIKey.
+func NewFileKeyStore(path string) (*MemoryKeyStore, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("invalid api key file %s: %w", path, err)
+	}
+	return NewMemoryKeyStore(keys...), nil
+}
+
+func (s *MemoryKeyStore) Find(key string) (APIKey, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	k, ok := s.keys[key]
+	return k, ok, nil
+}
+
+func (s *MemoryKeyStore) Save(k APIKey) {
+	s.Lock()
+	defer s.Unlock()
+	s.keys[k.Key] = k
+}
+
+// NewAPIKeyAuthenticator returns an Authenticator accepting the keys found
+// in store. Since it runs before the handlers read the request body, it also
+// enforces the limits of the key using the sizes declared in the headers.
+func NewAPIKeyAuthenticator(store KeyStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{
+		store:    store,
+		limiters: make(map[string]*rate.Limiter),
+		usage:    make(map[string]*dailyUsage),
+	}
+}
+
+type APIKeyAuthenticator struct {
+	store KeyStore
+
+	sync.Mutex
+	limiters map[string]*rate.Limiter
+	usage    map[string]*dailyUsage
+}
+
+type dailyUsage struct {
+	day   string
+	bytes uint64
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	value := r.Header.Get(APIKeyHeader)
+	if value == "" {
+		return Principal{}, fmt.Errorf("%w: missing %s header", ErrUnauthenticated, APIKeyHeader)
+	}
+	key, ok, err := a.store.Find(value)
+	if err != nil {
+		return Principal{}, err
+	}
+	if !ok {
+		return Principal{}, fmt.Errorf("%w: unknown api key", ErrUnauthenticated)
+	}
+
+	if err := checkUploadSize(r, key.MaxUploadSize); err != nil {
+		return Principal{}, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if key.RequestsPerSecond > 0 {
+		l, ok := a.limiters[key.Key]
+		if !ok {
+			burst := key.Burst
+			if burst <= 0 {
+				burst = 1
+			}
+			l = rate.NewLimiter(rate.Limit(key.RequestsPerSecond), burst)
+			a.limiters[key.Key] = l
+		}
+		if !l.Allow() {
+			return Principal{}, ErrRateLimited
+		}
+	}
+
+	p := Principal{
+		Subject:       key.Subject,
+		Tenant:        key.Tenant,
+		Roles:         key.Roles,
+		MaxUploadSize: key.MaxUploadSize,
+	}
+	if key.DailyQuota > 0 {
+		p.Meter = keyMeter{a: a, key: key}
+		if r.Method != http.MethodHead {
+			if r.ContentLength < 0 {
+				return Principal{}, ErrLengthRequired
+			}
+			if err := a.charge(key, uint64(r.ContentLength)); err != nil {
+				return Principal{}, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// charge records n more bytes sent today with key. a must be locked.
+func (a *APIKeyAuthenticator) charge(key APIKey, n uint64) error {
+	today := time.Now().UTC().Format(time.DateOnly)
+	u, ok := a.usage[key.Key]
+	if !ok || u.day != today {
+		u = &dailyUsage{day: today}
+		a.usage[key.Key] = u
+	}
+	if u.bytes+n > key.DailyQuota {
+		return ErrQuotaExceeded
+	}
+	u.bytes += n
+	return nil
+}
+
+// keyMeter charges the daily quota of an API key.
+type keyMeter struct {
+	a   *APIKeyAuthenticator
+	key APIKey
+}
+
+func (m keyMeter) Charge(n uint64) error {
+	m.a.Lock()
+	defer m.a.Unlock()
+	return m.a.charge(m.key, n)
+}
+
+// checkUploadSize rejects the requests declaring an upload larger than
+// maxSize, unless it is zero. Creations deferring their length are rejected
+// too, since their size can't be checked: the controllers bound the chunks
+// by the length of their upload.
+func checkUploadSize(r *http.Request, maxSize uint64) error {
+	if maxSize == 0 {
+		return nil
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		return fmt.Errorf("%w: the upload length can't be deferred", ErrLengthRequired)
+	}
+	if declaredUploadSize(r) > maxSize {
+		return ErrUploadTooLarge
+	}
+	return nil
+}
+
+// declaredUploadSize returns the largest size the request claims the upload
+// will reach, either through Upload-Length on creation or through the
+// offset and length of the chunk being sent.
+func declaredUploadSize(r *http.Request) uint64 {
+	var size uint64
+	if r.ContentLength > 0 {
+		size = uint64(r.ContentLength)
+	}
+	if v, err := strconv.ParseUint(r.Header.Get("Upload-Length"), 10, 64); err == nil && v > size {
+		size = v
+	}
+	if v, err := strconv.ParseUint(r.Header.Get("Upload-Offset"), 10, 64); err == nil && r.ContentLength > 0 {
+		if end := v + uint64(r.ContentLength); end > size {
+			size = end
+		}
+	}
+	return size
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrUnauthenticated is returned by an Authenticator when the request
+	// doesn't carry valid credentials.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden is returned when an authenticated principal tries to
+	// operate on an upload it doesn't own.
+	ErrForbidden = errors.New("forbidden")
+	// ErrUnavailable is returned by an Authenticator unable to check the
+	// credentials, e.g. when the keys of an identity provider can't be
+	// fetched. The request may be sent again.
+	ErrUnavailable = errors.New("authentication is unavailable")
+
+	// The errors below are returned by authenticators which also enforce
+	// limits attached to the credentials, like API keys.
+	ErrRateLimited    = errors.New("rate limit exceeded")
+	ErrQuotaExceeded  = errors.New("daily upload quota exceeded")
+	ErrUploadTooLarge = errors.New("upload exceeds the maximum size allowed")
+	ErrLengthRequired = errors.New("content-length is required")
+)
+
+// Principal is the identity of the caller once its request has been
+// accepted by an Authenticator.
+type Principal struct {
+	Subject string
+	// Tenant isolates the uploads of the principal from other tenants. It is
+	// empty for single tenant deployments.
+	Tenant string
+	// Roles are the roles granted to the principal, see HasRole.
+	Roles []Role
+	// MaxUploadSize, unless zero, is the largest upload the credentials of
+	// the principal allow, e.g. the maximum size of an upload token.
+	MaxUploadSize uint64
+	// ContentType, unless empty, is the only content type the credentials
+	// of the principal allow uploading.
+	ContentType string
+	// Meter, unless nil, is charged with the bytes the principal sends
+	// which the authenticator couldn't charge from the headers of the
+	// request, e.g. the data fetched by an import.
+	Meter Meter
+}
+
+// Meter charges the bytes sent by a principal to the quota of its
+// credentials.
+type Meter interface {
+	// Charge records n more bytes, failing with ErrQuotaExceeded once the
+	// quota is exhausted.
+	Charge(n uint64) error
+}
+
+// Authenticator verifies the credentials carried by a request and returns
+// the principal making it. Implementations should return an error wrapping
+// ErrUnauthenticated when the credentials are missing or invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// AuthenticatorFunc allows an ordinary function to be used as Authenticator.
+type AuthenticatorFunc func(r *http.Request) (Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Principal, error) {
+	return f(r)
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying the principal.
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal stored in ctx, if any.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Chain returns an Authenticator trying each of authenticators in order
+// and accepting the request as soon as one of them does. Errors other than
+// ErrUnauthenticated stop the chain.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		err := fmt.Errorf("%w: no credentials", ErrUnauthenticated)
+		for _, a := range authenticators {
+			var p Principal
+			p, err = a.Authenticate(r)
+			if err == nil {
+				return p, nil
+			}
+			if !errors.Is(err, ErrUnauthenticated) {
+				return Principal{}, err
+			}
+		}
+		return Principal{}, err
+	})
+}
+
+// CanAccess reports whether the principal carried by ctx may operate on an
+// upload owned by owner. Uploads created without authentication have no
+// owner and stay accessible to every caller.
+func CanAccess(ctx context.Context, owner string) bool {
+	if owner == "" {
+		return true
+	}
+	p, ok := FromContext(ctx)
+	return ok && p.Subject == owner
+}
+
+// Middleware authenticates every request with a and stores the resulting
+// principal in the request context. OPTIONS requests are passed through
+// since tus clients use them for discovery before they have credentials.
+func Middleware(a Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p, err := a.Authenticate(r)
+			if err != nil {
+				code := statusCode(err)
+				if code >= http.StatusInternalServerError {
+					log.Error().Err(err).Msg("unable to authenticate request")
+					writeError(w, code, errors.New("unable to authenticate request"))
+					return
+				}
+				log.Debug().Err(err).Msg("request is not authenticated")
+				writeError(w, code, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+		})
+	}
+}
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrUploadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrLengthRequired):
+		return http.StatusLengthRequired
+	case errors.Is(err, ErrContentTypeNotAllowed):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type cError struct {
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	b, _ := json.Marshal(cError{Message: err.Error()})
+	w.Write(b)
+}
@@ -0,0 +1,896 @@
+package auth_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	. "github.com/imrenagi/go-http-upload/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Run("The authenticated principal must be stored in the request context", func(t *testing.T) {
+		a := AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+			return Principal{Subject: "alice"}, nil
+		})
+
+		var got Principal
+		h := Middleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = FromContext(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		req := httptest.NewRequest(http.MethodHead, "/api/v3/files/a", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "alice", got.Subject)
+	})
+
+	t.Run("Return 401 and must not process the request when the authenticator rejects it", func(t *testing.T) {
+		a := AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+			return Principal{}, ErrUnauthenticated
+		})
+
+		called := false
+		h := Middleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, `{"message":"unauthenticated"}`, w.Body.String())
+		assert.False(t, called)
+	})
+
+	t.Run("Return 500 when the authenticator fails for reasons other than invalid credentials", func(t *testing.T) {
+		a := AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+			return Principal{}, errors.New("backend unavailable")
+		})
+
+		h := Middleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		req := httptest.NewRequest(http.MethodPatch, "/api/v3/files/a", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+
+	t.Run("OPTIONS requests must not require authentication", func(t *testing.T) {
+		a := AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+			return Principal{}, ErrUnauthenticated
+		})
+
+		h := Middleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		req := httptest.NewRequest(http.MethodOptions, "/api/v3/files", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	})
+}
+
+func newJWKSServer(t *testing.T, kid string, key *rsa.PublicKey) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kid": kid,
+					"kty": "RSA",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func signToken(t *testing.T, kid string, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	srv := newJWKSServer(t, "k1", &key.PublicKey)
+
+	a := NewJWTAuthenticator(srv.URL,
+		WithIssuer("https://issuer.example.com"),
+		WithAudience("uploader"))
+
+	t.Run("The token subject must become the principal", func(t *testing.T) {
+		token := signToken(t, "k1", key, jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://issuer.example.com",
+			"aud": "uploader",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		p, err := a.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", p.Subject)
+	})
+
+	t.Run("The tenant claim must become the tenant of the principal", func(t *testing.T) {
+		a := NewJWTAuthenticator(srv.URL, WithTenantClaim("org"))
+		token := signToken(t, "k1", key, jwt.MapClaims{
+			"sub": "alice",
+			"org": "acme",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		p, err := a.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "acme", p.Tenant)
+	})
+
+	t.Run("Requests without bearer token must be unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+
+		_, err := a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Tokens from another issuer must be unauthenticated", func(t *testing.T) {
+		token := signToken(t, "k1", key, jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://evil.example.com",
+			"aud": "uploader",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		_, err := a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Expired tokens must be unauthenticated", func(t *testing.T) {
+		token := signToken(t, "k1", key, jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://issuer.example.com",
+			"aud": "uploader",
+			"exp": time.Now().Add(-time.Hour).Unix(),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		_, err := a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Tokens signed by an unknown key must be unauthenticated", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		token := signToken(t, "k1", other, jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://issuer.example.com",
+			"aud": "uploader",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		_, err = a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Tokens must be unavailable, not unauthenticated, while the key set can't be fetched", func(t *testing.T) {
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer down.Close()
+		a := NewJWTAuthenticator(down.URL)
+		token := signToken(t, "k1", key, jwt.MapClaims{
+			"sub": "alice",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		_, err := a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnavailable)
+		assert.NotErrorIs(t, err, ErrUnauthenticated)
+
+		h := Middleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("Failed fetches of the key set must not be retried before the refresh interval", func(t *testing.T) {
+		var fetches atomic.Int32
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer down.Close()
+		a := NewJWTAuthenticator(down.URL)
+		token := signToken(t, "k1", key, jwt.MapClaims{
+			"sub": "alice",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+
+		for range 3 {
+			req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			_, err := a.Authenticate(req)
+			assert.ErrorIs(t, err, ErrUnavailable)
+		}
+		assert.Equal(t, int32(1), fetches.Load())
+	})
+
+	t.Run("Concurrent requests must share a single fetch of the key set", func(t *testing.T) {
+		var fetches atomic.Int32
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			srv.Config.Handler.ServeHTTP(w, r)
+		}))
+		defer slow.Close()
+		a := NewJWTAuthenticator(slow.URL)
+		token := signToken(t, "k1", key, jwt.MapClaims{
+			"sub": "alice",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				p, err := a.Authenticate(req)
+				assert.NoError(t, err)
+				assert.Equal(t, "alice", p.Subject)
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), fetches.Load())
+	})
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	t.Run("The subject of the key must become the principal", func(t *testing.T) {
+		a := NewAPIKeyAuthenticator(NewMemoryKeyStore(APIKey{Key: "k1", Subject: "alice"}))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set(APIKeyHeader, "k1")
+
+		p, err := a.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", p.Subject)
+	})
+
+	t.Run("Unknown keys must be unauthenticated", func(t *testing.T) {
+		a := NewAPIKeyAuthenticator(NewMemoryKeyStore(APIKey{Key: "k1", Subject: "alice"}))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set(APIKeyHeader, "k2")
+
+		_, err := a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Creation with Upload-Length above the key maximum must be rejected with 413", func(t *testing.T) {
+		a := NewAPIKeyAuthenticator(NewMemoryKeyStore(APIKey{Key: "k1", Subject: "alice", MaxUploadSize: 100}))
+		h := Middleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+		req.Header.Set(APIKeyHeader, "k1")
+		req.Header.Set("Upload-Length", "101")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("Requests above the key rate must be rejected with 429", func(t *testing.T) {
+		a := NewAPIKeyAuthenticator(NewMemoryKeyStore(APIKey{Key: "k1", Subject: "alice", RequestsPerSecond: 0.001, Burst: 1}))
+		h := Middleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		for _, want := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+			req := httptest.NewRequest(http.MethodHead, "/api/v3/files/a", nil)
+			req.Header.Set(APIKeyHeader, "k1")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			assert.Equal(t, want, w.Code)
+		}
+	})
+
+	t.Run("Chunks exceeding the daily quota must be rejected before the body is read", func(t *testing.T) {
+		a := NewAPIKeyAuthenticator(NewMemoryKeyStore(APIKey{Key: "k1", Subject: "alice", DailyQuota: 5}))
+
+		req := httptest.NewRequest(http.MethodPatch, "/api/v3/files/a", bytes.NewBufferString("abc"))
+		req.Header.Set(APIKeyHeader, "k1")
+		_, err := a.Authenticate(req)
+		assert.NoError(t, err)
+
+		req = httptest.NewRequest(http.MethodPatch, "/api/v3/files/a", bytes.NewBufferString("abc"))
+		req.Header.Set(APIKeyHeader, "k1")
+		_, err = a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+	})
+
+	t.Run("The principal must carry the limits of the key", func(t *testing.T) {
+		a := NewAPIKeyAuthenticator(NewMemoryKeyStore(APIKey{Key: "k1", Subject: "alice", MaxUploadSize: 100, DailyQuota: 5}))
+
+		req := httptest.NewRequest(http.MethodHead, "/api/v3/files/a", nil)
+		req.Header.Set(APIKeyHeader, "k1")
+		p, err := a.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(100), p.MaxUploadSize)
+
+		assert.NoError(t, p.Meter.Charge(3))
+		assert.ErrorIs(t, p.Meter.Charge(3), ErrQuotaExceeded)
+
+		req = httptest.NewRequest(http.MethodPatch, "/api/v3/files/a", bytes.NewBufferString("abc"))
+		req.Header.Set(APIKeyHeader, "k1")
+		_, err = a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+	})
+}
+
+func TestURLSigner(t *testing.T) {
+	signer := NewURLSigner([]byte("secret"))
+	signed, err := signer.Sign("http://localhost:8080/api/v3/files", SignedURLClaims{
+		Subject:   "alice",
+		Methods:   []string{http.MethodPost, http.MethodPatch},
+		MaxSize:   100,
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+	assert.NoError(t, err)
+
+	t.Run("A signed URL must authorize creation on behalf of its subject", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, signed, nil)
+		req.Header.Set("Upload-Length", "100")
+
+		p, err := signer.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", p.Subject)
+	})
+
+	t.Run("The same signature must authorize PATCH requests on uploads under the signed path", func(t *testing.T) {
+		u, _ := url.Parse(signed)
+		u.Path += "/a"
+		req := httptest.NewRequest(http.MethodPatch, u.String(), bytes.NewBufferString("abc"))
+		req.Header.Set("Upload-Offset", "0")
+
+		_, err := signer.Authenticate(req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Methods which were not signed must be unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, signed, nil)
+
+		_, err := signer.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Tampered claims must be unauthenticated", func(t *testing.T) {
+		u, _ := url.Parse(signed)
+		q := u.Query()
+		q.Set(SignedMaxSizeParam, "1000")
+		u.RawQuery = q.Encode()
+		req := httptest.NewRequest(http.MethodPost, u.String(), nil)
+
+		_, err := signer.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Creation larger than the signed max size must be rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, signed, nil)
+		req.Header.Set("Upload-Length", "101")
+
+		_, err := signer.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUploadTooLarge)
+	})
+
+	t.Run("Expired URLs must be unauthenticated", func(t *testing.T) {
+		expired, err := signer.Sign("http://localhost:8080/api/v3/files", SignedURLClaims{
+			Subject:   "alice",
+			Methods:   []string{http.MethodPost},
+			ExpiresAt: time.Now().Add(-time.Minute),
+		})
+		assert.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, expired, nil)
+
+		_, err = signer.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+}
+
+func TestCertificateAuthenticator(t *testing.T) {
+	withCertificate := func(req *http.Request, cn string) *http.Request {
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{
+				{{Subject: pkix.Name{CommonName: cn}}},
+			},
+		}
+		return req
+	}
+
+	t.Run("The common name of the verified certificate must become the principal", func(t *testing.T) {
+		a := NewCertificateAuthenticator()
+		req := withCertificate(httptest.NewRequest(http.MethodPost, "/api/v3/files", nil), "ingest-1")
+
+		p, err := a.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "ingest-1", p.Subject)
+	})
+
+	t.Run("Requests without a verified certificate must be unauthenticated", func(t *testing.T) {
+		a := NewCertificateAuthenticator()
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files", nil)
+
+		_, err := a.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Certificate subjects must be mapped to principals when a mapping is configured", func(t *testing.T) {
+		a := NewCertificateAuthenticator(WithCertificateSubjects(map[string]string{
+			"ingest-1": "lab-a",
+		}))
+
+		p, err := a.Authenticate(withCertificate(httptest.NewRequest(http.MethodPost, "/api/v3/files", nil), "ingest-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "lab-a", p.Subject)
+
+		_, err = a.Authenticate(withCertificate(httptest.NewRequest(http.MethodPost, "/api/v3/files", nil), "ingest-2"))
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+}
+
+func TestTenantMiddleware(t *testing.T) {
+	serve := func(h func(http.Handler) http.Handler, req *http.Request) (string, *httptest.ResponseRecorder) {
+		var got string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = TenantFromContext(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		})
+		w := httptest.NewRecorder()
+		h(next).ServeHTTP(w, req)
+		return got, w
+	}
+
+	t.Run("The tenant of the principal must be stored in the request context", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/api/v3/files/a", nil)
+		req = req.WithContext(NewContext(req.Context(), Principal{Subject: "alice", Tenant: "acme"}))
+		req.Header.Set(TenantHeader, "globex")
+
+		got, w := serve(TenantMiddleware(TenantHeader), req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "acme", got)
+	})
+
+	t.Run("The header must be used when the request is not authenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/api/v3/files/a", nil)
+		req.Header.Set(TenantHeader, "globex")
+
+		got, w := serve(TenantMiddleware(TenantHeader), req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "globex", got)
+	})
+
+	t.Run("The header must be ignored when the principal has no tenant", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/api/v3/files/a", nil)
+		req = req.WithContext(NewContext(req.Context(), Principal{Subject: "alice"}))
+		req.Header.Set(TenantHeader, "globex")
+
+		got, w := serve(TenantMiddleware(TenantHeader), req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, got)
+	})
+
+	t.Run("The header must be ignored when header based resolution is disabled", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/api/v3/files/a", nil)
+		req.Header.Set(TenantHeader, "globex")
+
+		got, w := serve(TenantMiddleware(""), req)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, got)
+	})
+
+	t.Run("Tenants which are not safe to use as a path must be rejected with 400", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/api/v3/files/a", nil)
+		req.Header.Set(TenantHeader, "../etc")
+
+		_, w := serve(TenantMiddleware(TenantHeader), req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, `{"message":"invalid tenant"}`, w.Body.String())
+	})
+}
+
+func TestUploadTokens(t *testing.T) {
+	newRequest := func(method, target, token string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set(UploadTokenHeader, token)
+		return req
+	}
+	pdf := "filename ZmlsZS5wZGY=,content-type YXBwbGljYXRpb24vcGRm"
+
+	t.Run("A token must authorize a single creation and the requests made to the created upload", func(t *testing.T) {
+		tokens := NewUploadTokens()
+		token, err := tokens.Issue(UploadTokenClaims{ExpiresAt: time.Now().Add(time.Minute)})
+		assert.NoError(t, err)
+
+		_, err = tokens.Authenticate(newRequest(http.MethodPatch, "/api/v3/files/a", token))
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+
+		created, err := tokens.Authenticate(newRequest(http.MethodPost, "/api/v3/files", token))
+		assert.NoError(t, err)
+		assert.NotEmpty(t, created.Subject)
+
+		p, err := tokens.Authenticate(newRequest(http.MethodPatch, "/api/v3/files/a", token))
+		assert.NoError(t, err)
+		assert.Equal(t, created.Subject, p.Subject)
+
+		_, err = tokens.Authenticate(newRequest(http.MethodPost, "/api/v3/files", token))
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Creation deferring its length must be rejected when the token has a maximum size", func(t *testing.T) {
+		tokens := NewUploadTokens()
+		token, err := tokens.Issue(UploadTokenClaims{MaxSize: 100, ExpiresAt: time.Now().Add(time.Minute)})
+		assert.NoError(t, err)
+
+		req := newRequest(http.MethodPost, "/api/v3/files", token)
+		req.Header.Set("Upload-Defer-Length", "1")
+		_, err = tokens.Authenticate(req)
+		assert.ErrorIs(t, err, ErrLengthRequired)
+
+		req = newRequest(http.MethodPost, "/api/v3/files", token)
+		req.Header.Set("Upload-Length", "100")
+		p, err := tokens.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(100), p.MaxUploadSize)
+	})
+
+	t.Run("Expired tokens must be unauthenticated", func(t *testing.T) {
+		tokens := NewUploadTokens()
+		token, err := tokens.Issue(UploadTokenClaims{ExpiresAt: time.Now().Add(-time.Minute)})
+		assert.NoError(t, err)
+
+		_, err = tokens.Authenticate(newRequest(http.MethodPost, "/api/v3/files", token))
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Creation with another content type must be rejected without consuming the token", func(t *testing.T) {
+		tokens := NewUploadTokens()
+		token, err := tokens.Issue(UploadTokenClaims{ContentType: "image/png", ExpiresAt: time.Now().Add(time.Minute)})
+		assert.NoError(t, err)
+
+		req := newRequest(http.MethodPost, "/api/v3/files", token)
+		req.Header.Set("Upload-Metadata", pdf)
+		_, err = tokens.Authenticate(req)
+		assert.ErrorIs(t, err, ErrContentTypeNotAllowed)
+
+		req = newRequest(http.MethodPost, "/api/v3/files", token)
+		req.Header.Set("Upload-Metadata", "content-type aW1hZ2UvcG5n")
+		_, err = tokens.Authenticate(req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Creation larger than the token max size must be rejected", func(t *testing.T) {
+		tokens := NewUploadTokens()
+		token, err := tokens.Issue(UploadTokenClaims{MaxSize: 10, ExpiresAt: time.Now().Add(time.Minute)})
+		assert.NoError(t, err)
+
+		req := newRequest(http.MethodPost, "/api/v3/files", token)
+		req.Header.Set("Upload-Length", "11")
+		_, err = tokens.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUploadTooLarge)
+	})
+}
+
+func TestRequireRole(t *testing.T) {
+	serve := func(role Role, p *Principal) *httptest.ResponseRecorder {
+		h := RequireRole(role)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/api/v3/files/a", nil)
+		if p != nil {
+			req = req.WithContext(NewContext(req.Context(), *p))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Principals without roles must be uploaders only", func(t *testing.T) {
+		p := &Principal{Subject: "alice"}
+		assert.Equal(t, http.StatusNoContent, serve(RoleUploader, p).Code)
+		assert.Equal(t, http.StatusForbidden, serve(RoleViewer, p).Code)
+		assert.Equal(t, http.StatusForbidden, serve(RoleAdmin, p).Code)
+	})
+
+	t.Run("Viewers must not be allowed to upload", func(t *testing.T) {
+		p := &Principal{Subject: "alice", Roles: []Role{RoleViewer}}
+		assert.Equal(t, http.StatusNoContent, serve(RoleViewer, p).Code)
+		assert.Equal(t, http.StatusForbidden, serve(RoleUploader, p).Code)
+	})
+
+	t.Run("Admins must have every role", func(t *testing.T) {
+		p := &Principal{Subject: "alice", Roles: []Role{RoleAdmin}}
+		assert.Equal(t, http.StatusNoContent, serve(RoleUploader, p).Code)
+		assert.Equal(t, http.StatusNoContent, serve(RoleViewer, p).Code)
+	})
+
+	t.Run("Return 401 when the request has no principal", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve(RoleUploader, nil).Code)
+	})
+
+	t.Run("GrantAdmin must give the admin role to the listed subjects only", func(t *testing.T) {
+		a := GrantAdmin(AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+			return Principal{Subject: r.Header.Get("X-Subject")}, nil
+		}), "dpo")
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Subject", "dpo")
+		p, err := a.Authenticate(req)
+		assert.NoError(t, err)
+		assert.True(t, p.HasRole(RoleAdmin))
+
+		req.Header.Set("X-Subject", "alice")
+		p, err = a.Authenticate(req)
+		assert.NoError(t, err)
+		assert.False(t, p.HasRole(RoleAdmin))
+	})
+}
+
+func TestSessions(t *testing.T) {
+	alice := AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		if r.Header.Get("Authorization") != "Bearer alice" {
+			return Principal{}, ErrUnauthenticated
+		}
+		return Principal{Subject: "alice", Tenant: "acme"}, nil
+	})
+	login := func(sessions *Sessions) *http.Cookie {
+		req := httptest.NewRequest(http.MethodPost, "/api/sessions", nil)
+		req.Header.Set("Authorization", "Bearer alice")
+		w := httptest.NewRecorder()
+		Middleware(alice)(sessions.Login()).ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		cookies := w.Result().Cookies()
+		assert.Len(t, cookies, 1)
+		return cookies[0]
+	}
+
+	t.Run("A session must authenticate the principal that logged in", func(t *testing.T) {
+		sessions := NewSessions(0)
+		cookie := login(sessions)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v3/files", nil)
+		req.AddCookie(cookie)
+		p, err := sessions.Authenticate(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, Principal{Subject: "alice", Tenant: "acme"}, p)
+	})
+
+	t.Run("Login without credentials must be rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/sessions", nil)
+		w := httptest.NewRecorder()
+
+		Middleware(alice)(NewSessions(0).Login()).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Empty(t, w.Result().Cookies())
+	})
+
+	t.Run("Unknown, expired and ended sessions must be unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v3/files", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: "unknown"})
+		_, err := NewSessions(0).Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+
+		sessions := NewSessions(time.Nanosecond)
+		req = httptest.NewRequest(http.MethodGet, "/api/v3/files", nil)
+		req.AddCookie(login(sessions))
+		time.Sleep(time.Millisecond)
+		_, err = sessions.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+
+		sessions = NewSessions(0)
+		cookie := login(sessions)
+		logout := httptest.NewRequest(http.MethodDelete, "/api/sessions", nil)
+		logout.AddCookie(cookie)
+		sessions.Logout().ServeHTTP(httptest.NewRecorder(), logout)
+		req = httptest.NewRequest(http.MethodGet, "/api/v3/files", nil)
+		req.AddCookie(cookie)
+		_, err = sessions.Authenticate(req)
+		assert.ErrorIs(t, err, ErrUnauthenticated)
+	})
+
+	t.Run("Cross-origin requests changing state must be forbidden", func(t *testing.T) {
+		sessions := NewSessions(0)
+		req := httptest.NewRequest(http.MethodDelete, "http://uploader.test/api/v3/files/a", nil)
+		req.Header.Set("Origin", "https://attacker.test")
+		req.AddCookie(login(sessions))
+
+		_, err := sessions.Authenticate(req)
+
+		assert.ErrorIs(t, err, ErrForbidden)
+	})
+
+	t.Run("Pages must redirect to the login page without a session", func(t *testing.T) {
+		sessions := NewSessions(0)
+		page := sessions.RequireSession("/login")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/uploads?status=completed", nil)
+		w := httptest.NewRecorder()
+		page.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/login?next=%2Fuploads%3Fstatus%3Dcompleted", w.Header().Get("Location"))
+
+		req = httptest.NewRequest(http.MethodGet, "/uploads", nil)
+		req.AddCookie(login(sessions))
+		w = httptest.NewRecorder()
+		page.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	alice := AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		switch r.Header.Get(APIKeyHeader) {
+		case "alice":
+			return Principal{Subject: "alice"}, nil
+		case "viewer":
+			return Principal{Subject: "bob", Roles: []Role{RoleViewer}}, nil
+		}
+		return Principal{}, ErrUnauthenticated
+	})
+	info := &grpc.UnaryServerInfo{FullMethod: "/upload.v2.UploadService/CreateUpload"}
+	call := func(md metadata.MD) (context.Context, error) {
+		var got context.Context
+		_, err := UnaryServerInterceptor(alice, RoleUploader, TenantHeader)(
+			metadata.NewIncomingContext(context.Background(), md), nil, info,
+			func(ctx context.Context, req any) (any, error) {
+				got = ctx
+				return nil, nil
+			})
+		return got, err
+	}
+
+	t.Run("The principal authenticated by the metadata must be stored in the context", func(t *testing.T) {
+		ctx, err := call(metadata.Pairs("x-api-key", "alice"))
+
+		assert.NoError(t, err)
+		p, ok := FromContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "alice", p.Subject)
+	})
+
+	t.Run("The tenant metadata must be ignored for authenticated calls", func(t *testing.T) {
+		ctx, err := call(metadata.Pairs("x-api-key", "alice", "x-tenant-id", "acme"))
+
+		assert.NoError(t, err)
+		assert.Empty(t, TenantFromContext(ctx))
+	})
+
+	t.Run("The tenant metadata must be used for unauthenticated calls", func(t *testing.T) {
+		var got context.Context
+		_, err := UnaryServerInterceptor(nil, RoleUploader, TenantHeader)(
+			metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant-id", "acme")), nil, info,
+			func(ctx context.Context, req any) (any, error) {
+				got = ctx
+				return nil, nil
+			})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "acme", TenantFromContext(got))
+	})
+
+	t.Run("Call without credentials must be unauthenticated", func(t *testing.T) {
+		_, err := call(metadata.MD{})
+
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("Call of a principal without the role must be denied", func(t *testing.T) {
+		_, err := call(metadata.Pairs("x-api-key", "viewer"))
+
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("Invalid tenant must be rejected", func(t *testing.T) {
+		_, err := UnaryServerInterceptor(nil, RoleUploader, TenantHeader)(
+			metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant-id", "../acme")), nil, info,
+			func(ctx context.Context, req any) (any, error) {
+				return nil, nil
+			})
+
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("The calls must be described with the method of their tus request", func(t *testing.T) {
+		var methods []string
+		a := AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+			methods = append(methods, r.Method)
+			return Principal{Subject: "alice"}, nil
+		})
+		for _, rpc := range []string{"CreateUpload", "UploadChunk", "GetUpload", "CancelUpload"} {
+			info := &grpc.UnaryServerInfo{FullMethod: "/upload.v2.UploadService/" + rpc}
+			_, err := UnaryServerInterceptor(a, RoleUploader, "")(context.Background(), nil, info,
+				func(ctx context.Context, req any) (any, error) { return nil, nil })
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, []string{http.MethodPost, http.MethodPatch, http.MethodHead, http.MethodDelete}, methods)
+	})
+
+	t.Run("Chunks of an upload token must be accepted after its creation", func(t *testing.T) {
+		tokens := NewUploadTokens()
+		token, err := tokens.Issue(UploadTokenClaims{MaxSize: 10, ExpiresAt: time.Now().Add(time.Minute)})
+		assert.NoError(t, err)
+		md := metadata.Pairs(UploadTokenHeader, token)
+		rpc := func(name string) error {
+			info := &grpc.UnaryServerInfo{FullMethod: "/upload.v2.UploadService/" + name}
+			_, err := UnaryServerInterceptor(tokens, RoleUploader, "")(metadata.NewIncomingContext(context.Background(), md), nil, info,
+				func(ctx context.Context, req any) (any, error) { return nil, nil })
+			return err
+		}
+
+		assert.NoError(t, rpc("CreateUpload"))
+		assert.NoError(t, rpc("UploadChunk"))
+		assert.NoError(t, rpc("GetUpload"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(rpc("CreateUpload")))
+	})
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor is the gRPC counterpart of Middleware, RequireRole
+// and TenantMiddleware: it authenticates every call with a, requires its
+// principal to have role and resolves its tenant, falling back to the
+// tenantHeader metadata. A nil a only resolves the tenant.
+func UnaryServerInterceptor(a Authenticator, role Role, tenantHeader string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticateCall(ctx, info.FullMethod, a, role, tenantHeader)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of
+// UnaryServerInterceptor.
+func StreamServerInterceptor(a Authenticator, role Role, tenantHeader string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateCall(ss.Context(), info.FullMethod, a, role, tenantHeader)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateCall returns a copy of ctx carrying the principal and the
+// tenant of the call to method.
+func authenticateCall(ctx context.Context, method string, a Authenticator, role Role, tenantHeader string) (context.Context, error) {
+	r := callRequest(ctx, method)
+	if a != nil {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			code := grpcCode(err)
+			if code == codes.Internal {
+				log.Error().Err(err).Msg("unable to authenticate call")
+				return nil, status.Error(code, "unable to authenticate call")
+			}
+			log.Debug().Err(err).Msg("call is not authenticated")
+			return nil, status.Error(code, err.Error())
+		}
+		if !p.HasRole(role) {
+			log.Debug().Str("subject", p.Subject).Str("role", string(role)).Msg("principal doesn't have the required role")
+			return nil, status.Error(codes.PermissionDenied, fmt.Errorf("%w: %s role is required", ErrForbidden, role).Error())
+		}
+		ctx = NewContext(ctx, p)
+	}
+
+	tenant := resolveTenant(r.WithContext(ctx), tenantHeader)
+	if tenant == "" {
+		return ctx, nil
+	}
+	if !tenantPattern.MatchString(tenant) {
+		log.Debug().Str("tenant", tenant).Msg("invalid tenant")
+		return nil, status.Error(codes.InvalidArgument, "invalid tenant")
+	}
+	return NewTenantContext(ctx, tenant), nil
+}
+
+// callMethods are the HTTP methods of the RPCs, as the authenticators
+// expect them from the tus requests they stand for: a creation, a chunk, a
+// status and a termination. Other RPCs are described as POST requests.
+var callMethods = map[string]string{
+	"CreateUpload": http.MethodPost,
+	"UploadChunk":  http.MethodPatch,
+	"GetUpload":    http.MethodHead,
+	"CancelUpload": http.MethodDelete,
+}
+
+// callRequest describes the call to method as an HTTP request, for the
+// authenticators: its method is the one of the RPC, its headers are the
+// metadata of the call, and its TLS connection state the one of the peer,
+// if any. Its body is empty: the handlers of the RPCs check the bytes they
+// receive against the limits of the principal.
+func callRequest(ctx context.Context, method string) *http.Request {
+	m, ok := callMethods[path.Base(method)]
+	if !ok {
+		m = http.MethodPost
+	}
+	r := &http.Request{
+		Method: m,
+		URL:    &url.URL{Path: method},
+		Header: make(http.Header),
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, values := range md {
+		if k == ":authority" {
+			r.Host = strings.Join(values, "")
+			continue
+		}
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		for _, v := range values {
+			r.Header.Add(textproto.CanonicalMIMEHeaderKey(k), v)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+func grpcCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return codes.Unauthenticated
+	case errors.Is(err, ErrForbidden):
+		return codes.PermissionDenied
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrQuotaExceeded):
+		return codes.ResourceExhausted
+	case errors.Is(err, ErrUploadTooLarge), errors.Is(err, ErrContentTypeNotAllowed):
+		return codes.InvalidArgument
+	case errors.Is(err, ErrLengthRequired):
+		return codes.FailedPrecondition
+	case errors.Is(err, ErrUnavailable):
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,355 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	defaultJWKSRefreshInterval = 5 * time.Minute
+	defaultJWTValidMethods     = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+)
+
+type JWTOptions struct {
+	Issuer          string
+	Audience        string
+	TenantClaim     string
+	RolesClaim      string
+	RefreshInterval time.Duration
+	HTTPClient      *http.Client
+}
+
+type JWTOption func(*JWTOptions)
+
+// WithIssuer rejects tokens whose iss claim doesn't match issuer.
+func WithIssuer(issuer string) JWTOption {
+	return func(o *JWTOptions) {
+		o.Issuer = issuer
+	}
+}
+
+// WithAudience rejects tokens whose aud claim doesn't contain audience.
+func WithAudience(audience string) JWTOption {
+	return func(o *JWTOptions) {
+		o.Audience = audience
+	}
+}
+
+// WithTenantClaim reads the tenant of the principal from the given claim.
+func WithTenantClaim(claim string) JWTOption {
+	return func(o *JWTOptions) {
+		o.TenantClaim = claim
+	}
+}
+
+// WithRolesClaim reads the roles of the principal from the given claim,
+// which may hold either an array of strings or a space separated string.
+func WithRolesClaim(claim string) JWTOption {
+	return func(o *JWTOptions) {
+		o.RolesClaim = claim
+	}
+}
+
+// WithJWKSRefreshInterval sets how often the key set may be fetched again
+// when a token is signed with an unknown key id.
+func WithJWKSRefreshInterval(d time.Duration) JWTOption {
+	return func(o *JWTOptions) {
+		o.RefreshInterval = d
+	}
+}
+
+func WithJWKSHTTPClient(c *http.Client) JWTOption {
+	return func(o *JWTOptions) {
+		o.HTTPClient = c
+	}
+}
+
+// NewJWTAuthenticator returns an Authenticator accepting bearer tokens
+// signed by one of the keys published at jwksURL. The token subject
+// becomes the principal.
+func NewJWTAuthenticator(jwksURL string, opts ...JWTOption) *JWTAuthenticator {
+	o := JWTOptions{
+		RefreshInterval: defaultJWKSRefreshInterval,
+		HTTPClient:      &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(defaultJWTValidMethods),
+		jwt.WithExpirationRequired(),
+	}
+	if o.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(o.Issuer))
+	}
+	if o.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(o.Audience))
+	}
+
+	return &JWTAuthenticator{
+		parser:      jwt.NewParser(parserOpts...),
+		tenantClaim: o.TenantClaim,
+		rolesClaim:  o.RolesClaim,
+		keys: &jwks{
+			url:             jwksURL,
+			client:          o.HTTPClient,
+			refreshInterval: o.RefreshInterval,
+			keys:            make(map[string]crypto.PublicKey),
+		},
+	}
+}
+
+type JWTAuthenticator struct {
+	parser      *jwt.Parser
+	tenantClaim string
+	rolesClaim  string
+	keys        *jwks
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	header := r.Header.Get("Authorization")
+	scheme, tokenString, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || tokenString == "" {
+		return Principal{}, fmt.Errorf("%w: missing bearer token", ErrUnauthenticated)
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := a.parser.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.find(r.Context(), kid)
+	})
+	if errors.Is(err, ErrUnavailable) {
+		// the token may be valid, it can't be checked.
+		return Principal{}, err
+	}
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+
+	sub, err := token.Claims.GetSubject()
+	if err != nil || sub == "" {
+		return Principal{}, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+	p := Principal{Subject: sub}
+	if a.tenantClaim != "" {
+		p.Tenant, _ = claims[a.tenantClaim].(string)
+	}
+	if a.rolesClaim != "" {
+		p.Roles = rolesFromClaim(claims[a.rolesClaim])
+	}
+	return p, nil
+}
+
+func rolesFromClaim(v interface{}) []Role {
+	var roles []Role
+	switch v := v.(type) {
+	case string:
+		for _, r := range strings.Fields(v) {
+			roles = append(roles, Role(r))
+		}
+	case []interface{}:
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				roles = append(roles, Role(s))
+			}
+		}
+	}
+	return roles
+}
+
+// jwks caches the public keys published by an identity provider. The set
+// is fetched lazily and fetched again when a token refers to an unknown
+// key id, at most once per refreshInterval whether the fetch succeeded or
+// not, and by a single request at a time.
+type jwks struct {
+	sync.RWMutex
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+	keys            map[string]crypto.PublicKey
+	// fetchedAt is the time of the last fetch and fetchErr its error, kept
+	// so that an unavailable provider isn't asked again for every token.
+	fetchedAt time.Time
+	fetchErr  error
+	// fetching is closed once the fetch in progress, if any, is done.
+	fetching chan struct{}
+}
+
+func (k *jwks) find(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.RLock()
+	key, ok := k.keys[kid]
+	stale := time.Since(k.fetchedAt) > k.refreshInterval
+	fetchErr := k.fetchErr
+	k.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if !stale && fetchErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, fetchErr)
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	if err := k.refresh(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	k.RLock()
+	defer k.RUnlock()
+	key, ok = k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the key set, unless it was fetched since it was found
+// stale, or waits for the fetch in progress. The fetch isn't cancelled with
+// ctx, since other requests may be waiting for it.
+func (k *jwks) refresh(ctx context.Context) error {
+	k.Lock()
+	if fetching := k.fetching; fetching != nil {
+		k.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		k.RLock()
+		defer k.RUnlock()
+		return k.fetchErr
+	}
+	if time.Since(k.fetchedAt) <= k.refreshInterval {
+		defer k.Unlock()
+		return k.fetchErr
+	}
+	fetching := make(chan struct{})
+	k.fetching = fetching
+	k.Unlock()
+
+	keys, err := k.fetch(context.WithoutCancel(ctx))
+	if err != nil {
+		log.Error().Err(err).Str("jwks_url", k.url).Msg("unable to fetch json web key set")
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	if err == nil {
+		k.keys = keys
+	}
+	k.fetchedAt = time.Now()
+	k.fetchErr = err
+	k.fetching = nil
+	close(fetching)
+	return err
+}
+
+func (k *jwks) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, k.url)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Warn().Err(err).Str("kid", jwk.Kid).Msg("skipping json web key")
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.New("unsupported key type " + k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
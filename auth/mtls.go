@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+type CertificateOptions struct {
+	Subjects map[string]string
+}
+
+type CertificateOption func(*CertificateOptions)
+
+// WithCertificateSubjects maps certificate subject names to principal
+// subjects. Once set, certificates whose name isn't in the map are rejected
+// even though they were signed by a trusted CA.
+func WithCertificateSubjects(subjects map[string]string) CertificateOption {
+	return func(o *CertificateOptions) {
+		o.Subjects = subjects
+	}
+}
+
+// NewCertificateAuthenticator returns an Authenticator accepting requests
+// made with a client certificate verified by the TLS listener. The server
+// must be configured with the CA used to sign client certificates, see
+// server.Opts.ClientCAFile.
+func NewCertificateAuthenticator(opts ...CertificateOption) *CertificateAuthenticator {
+	o := CertificateOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &CertificateAuthenticator{
+		subjects: o.Subjects,
+	}
+}
+
+type CertificateAuthenticator struct {
+	subjects map[string]string
+}
+
+func (a *CertificateAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Principal{}, fmt.Errorf("%w: missing verified client certificate", ErrUnauthenticated)
+	}
+
+	name := certificateName(r.TLS.VerifiedChains[0][0])
+	if name == "" {
+		return Principal{}, fmt.Errorf("%w: client certificate has no subject", ErrUnauthenticated)
+	}
+	if a.subjects == nil {
+		return Principal{Subject: name}, nil
+	}
+	subject, ok := a.subjects[name]
+	if !ok {
+		return Principal{}, fmt.Errorf("%w: client certificate %q is not allowed", ErrUnauthenticated, name)
+	}
+	return Principal{Subject: subject}, nil
+}
+
+// certificateName returns the common name of the certificate, falling back
+// to its first URI (e.g. a SPIFFE ID) or DNS subject alternative name.
+func certificateName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SignedSubjectParam   = "X-Upload-Subject"
+	SignedTenantParam    = "X-Upload-Tenant"
+	SignedExpiresParam   = "X-Upload-Expires"
+	SignedMaxSizeParam   = "X-Upload-Max-Size"
+	SignedMethodsParam   = "X-Upload-Methods"
+	SignedPrefixParam    = "X-Upload-Prefix"
+	SignedSignatureParam = "X-Upload-Signature"
+
+	defaultSignedURLTTL = 15 * time.Minute
+	maxSignedURLTTL     = 24 * time.Hour
+)
+
+// URLSigner issues and verifies URLs signed with a shared HMAC key. A
+// signed URL authorizes its bearer to call the listed methods on every path
+// under a prefix until it expires, which lets a trusted backend hand a
+// browser the right to create and then PATCH a single upload without
+// giving it long-lived credentials.
+//
+// The signature travels in the query string, so clients must send the same
+// query parameters with the creation request and every request made to the
+// returned upload URL.
+type URLSigner struct {
+	key []byte
+}
+
+func NewURLSigner(key []byte) *URLSigner {
+	return &URLSigner{key: key}
+}
+
+// SignedURLClaims are the conditions encoded in a signed URL.
+type SignedURLClaims struct {
+	Subject   string
+	Tenant    string
+	Prefix    string
+	Methods   []string
+	MaxSize   uint64
+	ExpiresAt time.Time
+}
+
+// Sign returns rawURL with the query parameters granting claims. The prefix
+// defaults to the path of rawURL.
+func (s *URLSigner) Sign(rawURL string, claims SignedURLClaims) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if claims.Prefix == "" {
+		claims.Prefix = u.Path
+	}
+	if claims.Subject == "" {
+		return "", errors.New("signed url requires a subject")
+	}
+	if len(claims.Methods) == 0 {
+		return "", errors.New("signed url requires at least one method")
+	}
+
+	q := u.Query()
+	q.Set(SignedSubjectParam, claims.Subject)
+	if claims.Tenant != "" {
+		q.Set(SignedTenantParam, claims.Tenant)
+	}
+	q.Set(SignedPrefixParam, claims.Prefix)
+	q.Set(SignedMethodsParam, strings.ToUpper(strings.Join(claims.Methods, ",")))
+	q.Set(SignedMaxSizeParam, strconv.FormatUint(claims.MaxSize, 10))
+	q.Set(SignedExpiresParam, strconv.FormatInt(claims.ExpiresAt.Unix(), 10))
+	q.Set(SignedSignatureParam, s.signature(q))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (s *URLSigner) signature(q url.Values) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(strings.Join([]string{
+		q.Get(SignedSubjectParam),
+		q.Get(SignedTenantParam),
+		q.Get(SignedPrefixParam),
+		q.Get(SignedMethodsParam),
+		q.Get(SignedMaxSizeParam),
+		q.Get(SignedExpiresParam),
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate accepts requests carrying a valid signature for their method
+// and path, and rejects those declaring an upload larger than the signed
+// maximum size.
+func (s *URLSigner) Authenticate(r *http.Request) (Principal, error) {
+	q := r.URL.Query()
+	sig := q.Get(SignedSignatureParam)
+	if sig == "" {
+		return Principal{}, fmt.Errorf("%w: missing signature", ErrUnauthenticated)
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.signature(q))) {
+		return Principal{}, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+	}
+
+	expires, err := strconv.ParseInt(q.Get(SignedExpiresParam), 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return Principal{}, fmt.Errorf("%w: signed url expired", ErrUnauthenticated)
+	}
+	prefix := q.Get(SignedPrefixParam)
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, strings.TrimSuffix(prefix, "/")+"/") {
+		return Principal{}, fmt.Errorf("%w: signed url is not valid for this path", ErrUnauthenticated)
+	}
+	allowed := false
+	for _, m := range strings.Split(q.Get(SignedMethodsParam), ",") {
+		if m == r.Method {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return Principal{}, fmt.Errorf("%w: signed url is not valid for %s", ErrUnauthenticated, r.Method)
+	}
+
+	maxSize, err := strconv.ParseUint(q.Get(SignedMaxSizeParam), 10, 64)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: invalid max size", ErrUnauthenticated)
+	}
+	if err := checkUploadSize(r, maxSize); err != nil {
+		return Principal{}, err
+	}
+
+	return Principal{
+		Subject:       q.Get(SignedSubjectParam),
+		Tenant:        q.Get(SignedTenantParam),
+		MaxUploadSize: maxSize,
+	}, nil
+}
+
+type signURLRequest struct {
+	URL       string   `json:"url"`
+	Methods   []string `json:"methods"`
+	MaxSize   uint64   `json:"max_size"`
+	ExpiresIn int64    `json:"expires_in"`
+}
+
+type signURLResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssueURL returns a handler signing URLs on behalf of the principal of the
+// request. It must be mounted behind Middleware so that only trusted callers
+// can obtain signed URLs.
+func (s *URLSigner) IssueURL() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := FromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, ErrUnauthenticated)
+			return
+		}
+
+		var req signURLRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+		if req.URL == "" {
+			writeError(w, http.StatusBadRequest, errors.New("url is required"))
+			return
+		}
+		if len(req.Methods) == 0 {
+			req.Methods = []string{http.MethodPost, http.MethodHead, http.MethodPatch}
+		}
+		ttl := defaultSignedURLTTL
+		if req.ExpiresIn > 0 {
+			ttl = time.Duration(req.ExpiresIn) * time.Second
+		}
+		if ttl > maxSignedURLTTL {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("expires_in must not exceed %d seconds", int64(maxSignedURLTTL.Seconds())))
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		signed, err := s.Sign(req.URL, SignedURLClaims{
+			Subject:   p.Subject,
+			Tenant:    p.Tenant,
+			Methods:   req.Methods,
+			MaxSize:   req.MaxSize,
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			log.Debug().Err(err).Msg("unable to sign url")
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(signURLResponse{URL: signed, ExpiresAt: expiresAt.UTC()})
+	}
+}
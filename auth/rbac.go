@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Role grants a principal a set of operations independently of the uploads
+// it owns.
+type Role string
+
+const (
+	// RoleUploader may create uploads and operate on its own uploads.
+	RoleUploader Role = "uploader"
+	// RoleViewer may download and inspect uploads.
+	RoleViewer Role = "viewer"
+	// RoleAdmin may perform every operation, including those on uploads
+	// owned by other principals.
+	RoleAdmin Role = "admin"
+)
+
+// HasRole reports whether the principal was granted role. Admins have
+// every role, and principals without any role are uploaders so that
+// credentials issued before roles existed keep working.
+func (p Principal) HasRole(role Role) bool {
+	if len(p.Roles) == 0 {
+		return role == RoleUploader
+	}
+	return slices.Contains(p.Roles, role) || slices.Contains(p.Roles, RoleAdmin)
+}
+
+// RequireRole rejects requests whose principal doesn't have role with 403.
+// It must be used after Middleware. OPTIONS requests are passed through
+// like Middleware does.
+func RequireRole(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p, ok := FromContext(r.Context())
+			if !ok {
+				writeError(w, http.StatusUnauthorized, ErrUnauthenticated)
+				return
+			}
+			if !p.HasRole(role) {
+				log.Debug().Str("subject", p.Subject).Str("role", string(role)).Msg("principal doesn't have the required role")
+				writeError(w, http.StatusForbidden, fmt.Errorf("%w: %s role is required", ErrForbidden, role))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// GrantAdmin returns an Authenticator giving the admin role to the given
+// subjects once a accepted their request. It lets operators appoint admins
+// authenticated by a mechanism which can't carry roles, e.g. client
+// certificates.
+func GrantAdmin(a Authenticator, subjects ...string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			return p, err
+		}
+		if slices.Contains(subjects, p.Subject) && !slices.Contains(p.Roles, RoleAdmin) {
+			p.Roles = append(slices.Clone(p.Roles), RoleAdmin)
+		}
+		return p, nil
+	})
+}
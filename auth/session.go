@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// SessionCookie names the cookie carrying the session of a browser.
+	SessionCookie = "upload_session"
+
+	defaultSessionTTL = 12 * time.Hour
+)
+
+type session struct {
+	principal Principal
+	expiresAt time.Time
+}
+
+// Sessions lets browsers, which can't attach the credentials accepted by
+// an Authenticator to every request, log in once and be authenticated by a
+// session cookie afterwards. The login request carries the credentials of
+// the Authenticator, e.g. a bearer token or an API key; the principal it
+// resolves to is the one of every request made with the session.
+//
+// The cookie is SameSite=Strict, and requests changing state are also
+// rejected when their Origin is another site, so that pages of other
+// origins can't act with the session of a browser.
+//
+// Sessions are kept in memory, so they don't survive a restart and aren't
+// shared between replicas.
+type Sessions struct {
+	sync.Mutex
+	sessions map[string]*session
+	ttl      time.Duration
+}
+
+// NewSessions returns sessions lasting ttl, 12 hours when zero.
+func NewSessions(ttl time.Duration) *Sessions {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	return &Sessions{
+		sessions: make(map[string]*session),
+		ttl:      ttl,
+	}
+}
+
+// Create returns the ID of a new session of p, and when it expires.
+func (s *Sessions) Create(p Principal) (string, time.Time, error) {
+	id, err := randomHex(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for k, v := range s.sessions {
+		if now.After(v.expiresAt) {
+			delete(s.sessions, k)
+		}
+	}
+	expiresAt := now.Add(s.ttl)
+	s.sessions[id] = &session{principal: p, expiresAt: expiresAt}
+	return id, expiresAt, nil
+}
+
+func (s *Sessions) find(r *http.Request) (Principal, bool) {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return Principal{}, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	sess, ok := s.sessions[c.Value]
+	if !ok || time.Now().After(sess.expiresAt) {
+		return Principal{}, false
+	}
+	return sess.principal, true
+}
+
+func (s *Sessions) Authenticate(r *http.Request) (Principal, error) {
+	p, ok := s.find(r)
+	if !ok {
+		return Principal{}, fmt.Errorf("%w: missing or expired session", ErrUnauthenticated)
+	}
+	if !sameOrigin(r) {
+		return Principal{}, fmt.Errorf("%w: cross-origin request", ErrForbidden)
+	}
+	return p, nil
+}
+
+// sameOrigin reports whether r, when it changes state, comes from a page of
+// the server. Browsers send the Origin of such requests.
+func sameOrigin(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// Login returns a handler starting a session of the principal authenticated
+// by the request, which it sets as a cookie. It must be mounted behind
+// Middleware with the Authenticator whose credentials the browser logs in
+// with.
+func (s *Sessions) Login() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := FromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, ErrUnauthenticated)
+			return
+		}
+		if !sameOrigin(r) {
+			writeError(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+
+		id, expiresAt, err := s.Create(p)
+		if err != nil {
+			log.Error().Err(err).Msg("unable to create session")
+			writeError(w, http.StatusInternalServerError, errors.New("unable to create session"))
+			return
+		}
+
+		log.Debug().Str("subject", p.Subject).Time("expires_at", expiresAt).Msg("session created")
+		http.SetCookie(w, &http.Cookie{
+			Name:     SessionCookie,
+			Value:    id,
+			Path:     "/",
+			Expires:  expiresAt,
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Logout returns a handler ending the session of the request, if any.
+func (s *Sessions) Logout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			writeError(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+		if c, err := r.Cookie(SessionCookie); err == nil {
+			s.Lock()
+			delete(s.sessions, c.Value)
+			s.Unlock()
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     SessionCookie,
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RequireSession redirects the requests without a session to loginPath,
+// passing the path they were made to in the next query parameter. It
+// protects pages, which browsers navigate to rather than call.
+func (s *Sessions) RequireSession(loginPath string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := s.find(r)
+			if !ok {
+				target := loginPath + "?next=" + url.QueryEscape(r.URL.RequestURI())
+				http.Redirect(w, r, target, http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+		})
+	}
+}
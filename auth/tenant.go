@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+)
+
+const TenantHeader = "X-Tenant-Id"
+
+// tenantPattern restricts tenant names to values which are safe to use as
+// a directory name or an object key prefix.
+var tenantPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+type tenantKey struct{}
+
+// NewTenantContext returns a copy of ctx carrying the tenant.
+func NewTenantContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant the request belongs to, or an empty
+// string for single tenant deployments.
+func TenantFromContext(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+// TenantMiddleware resolves the tenant of every request and stores it in
+// the request context. The tenant of an authenticated request is the one of
+// its principal, so that callers can't pick the tenant of others; the value
+// of header is only used for unauthenticated requests, e.g. when a trusted
+// gateway in front of the server authenticates the callers and sets it. An
+// empty header disables header based resolution.
+func TenantMiddleware(header string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := resolveTenant(r, header)
+			if tenant == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !tenantPattern.MatchString(tenant) {
+				log.Debug().Str("tenant", tenant).Msg("invalid tenant")
+				writeError(w, http.StatusBadRequest, errors.New("invalid tenant"))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewTenantContext(r.Context(), tenant)))
+		})
+	}
+}
+
+// resolveTenant returns the tenant of the principal of r, or the value of
+// header when r isn't authenticated.
+func resolveTenant(r *http.Request, header string) string {
+	if p, ok := FromContext(r.Context()); ok {
+		return p.Tenant
+	}
+	if header == "" {
+		return ""
+	}
+	return r.Header.Get(header)
+}
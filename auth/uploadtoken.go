@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const UploadTokenHeader = "X-Upload-Token"
+
+// ErrContentTypeNotAllowed is returned when an upload declares a content
+// type other than the one its credentials were issued for.
+var ErrContentTypeNotAllowed = errors.New("content type is not allowed")
+
+// UploadTokenClaims are the conditions an upload token is bound to. A zero
+// MaxSize or an empty ContentType means unrestricted.
+type UploadTokenClaims struct {
+	Tenant      string
+	MaxSize     uint64
+	ContentType string
+	ExpiresAt   time.Time
+}
+
+type uploadToken struct {
+	id     string
+	claims UploadTokenClaims
+	used   bool
+}
+
+// UploadTokens mints opaque tokens letting anonymous clients, e.g. the
+// browser of someone asked to "send me a file", create exactly one upload.
+// The token is consumed by the creation request; the same token then keeps
+// authorizing the HEAD, PATCH and DELETE requests made to that upload until
+// it expires, since the upload is owned by the token.
+//
+// Tokens are kept in memory, so they don't survive a restart and aren't
+// shared between replicas.
+type UploadTokens struct {
+	sync.Mutex
+	tokens map[string]*uploadToken
+}
+
+func NewUploadTokens() *UploadTokens {
+	return &UploadTokens{
+		tokens: make(map[string]*uploadToken),
+	}
+}
+
+// Issue returns a new token granting claims.
+func (t *UploadTokens) Issue(claims UploadTokenClaims) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for k, v := range t.tokens {
+		if now.After(v.claims.ExpiresAt) {
+			delete(t.tokens, k)
+		}
+	}
+	t.tokens[token] = &uploadToken{id: id, claims: claims}
+	return token, nil
+}
+
+func (t *UploadTokens) Authenticate(r *http.Request) (Principal, error) {
+	value := r.Header.Get(UploadTokenHeader)
+	if value == "" {
+		return Principal{}, fmt.Errorf("%w: missing %s header", ErrUnauthenticated, UploadTokenHeader)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	token, ok := t.tokens[value]
+	if !ok || time.Now().After(token.claims.ExpiresAt) {
+		return Principal{}, fmt.Errorf("%w: unknown or expired upload token", ErrUnauthenticated)
+	}
+
+	if err := checkUploadSize(r, token.claims.MaxSize); err != nil {
+		return Principal{}, err
+	}
+
+	if r.Method == http.MethodPost {
+		if token.used {
+			return Principal{}, fmt.Errorf("%w: upload token has already been used", ErrUnauthenticated)
+		}
+		if token.claims.ContentType != "" && uploadContentType(r) != token.claims.ContentType {
+			return Principal{}, ErrContentTypeNotAllowed
+		}
+		token.used = true
+	} else if !token.used {
+		return Principal{}, fmt.Errorf("%w: upload token has not been used to create an upload", ErrUnauthenticated)
+	}
+
+	return Principal{
+		Subject:       "upload-token:" + token.id,
+		Tenant:        token.claims.Tenant,
+		MaxUploadSize: token.claims.MaxSize,
+		ContentType:   token.claims.ContentType,
+	}, nil
+}
+
+// uploadContentType returns the content-type entry of the Upload-Metadata
+// header of a creation request.
+func uploadContentType(r *http.Request) string {
+	for _, kv := range strings.Split(r.Header.Get("Upload-Metadata"), ",") {
+		parts := strings.Fields(kv)
+		if len(parts) != 2 || parts[0] != "content-type" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+	return ""
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type issueTokenRequest struct {
+	MaxSize     uint64 `json:"max_size"`
+	ContentType string `json:"content_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type issueTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssueToken returns a handler minting upload tokens. It must be mounted
+// behind Middleware so that only trusted callers can hand out tokens.
+func (t *UploadTokens) IssueToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := FromContext(r.Context())
+		if !ok {
+			writeError(w, http.StatusUnauthorized, ErrUnauthenticated)
+			return
+		}
+
+		var req issueTokenRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+		ttl := defaultSignedURLTTL
+		if req.ExpiresIn > 0 {
+			ttl = time.Duration(req.ExpiresIn) * time.Second
+		}
+		if ttl > maxSignedURLTTL {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("expires_in must not exceed %d seconds", int64(maxSignedURLTTL.Seconds())))
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		token, err := t.Issue(UploadTokenClaims{
+			Tenant:      p.Tenant,
+			MaxSize:     req.MaxSize,
+			ContentType: req.ContentType,
+			ExpiresAt:   expiresAt,
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("unable to issue upload token")
+			writeError(w, http.StatusInternalServerError, errors.New("unable to issue upload token"))
+			return
+		}
+
+		log.Debug().Str("issuer", p.Subject).Time("expires_at", expiresAt).Msg("upload token issued")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(issueTokenResponse{Token: token, ExpiresAt: expiresAt.UTC()})
+	}
+}
@@ -0,0 +1,65 @@
+// Package bufpool pools the buffers used to copy the bodies of the uploads
+// to the storage, so that many concurrent chunk uploads don't allocate a
+// buffer each and put pressure on the garbage collector.
+package bufpool
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultSize is the size of the buffers of io.Copy.
+const DefaultSize = 32 << 10
+
+// Default is the pool used by the upload handlers. The server replaces it
+// on start when a buffer size is configured.
+var Default = New(DefaultSize)
+
+// Pool is a pool of buffers of the same size, safe for concurrent use.
+type Pool struct {
+	size int
+	pool sync.Pool
+}
+
+// New returns a pool of buffers of size bytes, DefaultSize when size isn't
+// positive.
+func New(size int) *Pool {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	p := &Pool{size: size}
+	p.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// Size returns the size of the buffers of the pool.
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// Get returns a buffer of the pool, to give back with Put once it isn't
+// used anymore.
+func (p *Pool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *Pool) Put(b *[]byte) {
+	p.pool.Put(b)
+}
+
+// Copy copies src to dst like io.Copy, through a buffer of the pool. The
+// io.ReaderFrom of dst is bypassed: an *os.File would otherwise allocate a
+// buffer of its own to copy from a request body.
+func (p *Pool) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	b := p.Get()
+	defer p.Put(b)
+	return io.CopyBuffer(writerOnly{dst}, src, *b)
+}
+
+// writerOnly hides every method of a writer but Write.
+type writerOnly struct {
+	io.Writer
+}
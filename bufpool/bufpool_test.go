@@ -0,0 +1,104 @@
+package bufpool_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/bufpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	t.Run("copy must write every byte of the source", func(t *testing.T) {
+		p := bufpool.New(16)
+		data := strings.Repeat("0123456789", 100)
+		var dst bytes.Buffer
+
+		n, err := p.Copy(&dst, strings.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		assert.Equal(t, data, dst.String())
+	})
+
+	t.Run("pool must hand out buffers of its size", func(t *testing.T) {
+		assert.Equal(t, bufpool.DefaultSize, bufpool.New(0).Size())
+
+		p := bufpool.New(1 << 20)
+		b := p.Get()
+		assert.Len(t, *b, 1<<20)
+		p.Put(b)
+	})
+}
+
+// chunk is read by the benchmarks through a plain io.Reader, like a request
+// body.
+type chunk struct {
+	r io.Reader
+}
+
+func (c *chunk) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func benchmarkCopy(b *testing.B, copyFn func(io.Writer, io.Reader) (int64, error)) {
+	data := bytes.Repeat([]byte{'a'}, 4<<20)
+	f, err := os.Create(filepath.Join(b.TempDir(), "chunk"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := copyFn(f, &chunk{r: bytes.NewReader(data)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	b.Run("io.Copy", func(b *testing.B) {
+		benchmarkCopy(b, io.Copy)
+	})
+	b.Run("pool", func(b *testing.B) {
+		benchmarkCopy(b, bufpool.New(bufpool.DefaultSize).Copy)
+	})
+	b.Run("pool 256KiB", func(b *testing.B) {
+		benchmarkCopy(b, bufpool.New(256<<10).Copy)
+	})
+}
+
+func BenchmarkCopyParallel(b *testing.B) {
+	data := bytes.Repeat([]byte{'a'}, 1<<20)
+	run := func(b *testing.B, copyFn func(io.Writer, io.Reader) (int64, error)) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := copyFn(io.Discard, &chunk{r: bytes.NewReader(data)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("io.Copy", func(b *testing.B) {
+		run(b, func(w io.Writer, r io.Reader) (int64, error) {
+			// hide the io.ReaderFrom of io.Discard, which reads with a
+			// pooled buffer of its own.
+			return io.Copy(struct{ io.Writer }{w}, r)
+		})
+	})
+	b.Run("pool", func(b *testing.B) {
+		run(b, bufpool.New(bufpool.DefaultSize).Copy)
+	})
+}
@@ -0,0 +1,132 @@
+// Package cdn signs URLs of finalized uploads for the CDN caching the
+// storage backend, so that downloads are served from edge caches instead of
+// the uploader.
+package cdn
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signer returns a URL granting access to the object at path, relative to
+// the origin of the CDN, until expiresAt.
+type Signer interface {
+	Sign(path string, expiresAt time.Time) (string, error)
+}
+
+// objectURL joins the base URL of the CDN with the escaped object path.
+func objectURL(baseURL, path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.Join(segments, "/")
+}
+
+// CloudCDNSigner signs URLs for Google Cloud CDN with a signed request key.
+// See https://cloud.google.com/cdn/docs/using-signed-urls.
+type CloudCDNSigner struct {
+	baseURL string
+	keyName string
+	key     []byte
+}
+
+// NewCloudCDNSigner returns a signer for the CDN serving baseURL. key is the
+// base64url encoded value of the key named keyName, as created with gcloud.
+func NewCloudCDNSigner(baseURL, keyName, key string) (*CloudCDNSigner, error) {
+	k, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cloud cdn key: %w", err)
+	}
+	return &CloudCDNSigner{baseURL: baseURL, keyName: keyName, key: k}, nil
+}
+
+func (s *CloudCDNSigner) Sign(path string, expiresAt time.Time) (string, error) {
+	u := fmt.Sprintf("%s?Expires=%d&KeyName=%s",
+		objectURL(s.baseURL, path), expiresAt.Unix(), url.QueryEscape(s.keyName))
+	mac := hmac.New(sha1.New, s.key)
+	mac.Write([]byte(u))
+	return u + "&Signature=" + base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// CloudFrontSigner signs URLs for Amazon CloudFront with a canned policy.
+// See https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/private-content-creating-signed-url-canned-policy.html.
+type CloudFrontSigner struct {
+	baseURL   string
+	keyPairID string
+	key       *rsa.PrivateKey
+}
+
+// NewCloudFrontSigner returns a signer for the distribution serving
+// baseURL. privateKey is the PEM encoded RSA key of the public key
+// keyPairID registered in CloudFront.
+func NewCloudFrontSigner(baseURL, keyPairID string, privateKey []byte) (*CloudFrontSigner, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, errors.New("invalid cloudfront private key: no PEM data")
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else {
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cloudfront private key: %w", err)
+		}
+		rk, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("invalid cloudfront private key: not an RSA key")
+		}
+		key = rk
+	}
+	return &CloudFrontSigner{baseURL: baseURL, keyPairID: keyPairID, key: key}, nil
+}
+
+type cannedPolicy struct {
+	Statement []cannedStatement `json:"Statement"`
+}
+
+type cannedStatement struct {
+	Resource  string `json:"Resource"`
+	Condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		} `json:"DateLessThan"`
+	} `json:"Condition"`
+}
+
+// cloudFrontEncoding is the base64 variant CloudFront expects in query
+// strings.
+var cloudFrontEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+func (s *CloudFrontSigner) Sign(path string, expiresAt time.Time) (string, error) {
+	u := objectURL(s.baseURL, path)
+	stmt := cannedStatement{Resource: u}
+	stmt.Condition.DateLessThan.EpochTime = expiresAt.Unix()
+	policy, err := json.Marshal(cannedPolicy{Statement: []cannedStatement{stmt}})
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha1.Sum(policy)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return u + "?Expires=" + strconv.FormatInt(expiresAt.Unix(), 10) +
+		"&Signature=" + cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(sig)) +
+		"&Key-Pair-Id=" + url.QueryEscape(s.keyPairID), nil
+}
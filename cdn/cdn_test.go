@@ -0,0 +1,78 @@
+package cdn_test
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/cdn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudCDNSigner(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	signer, err := cdn.NewCloudCDNSigner("https://cdn.example.com/", "upload-key", base64.URLEncoding.EncodeToString(key))
+	assert.NoError(t, err)
+	expiresAt := time.Unix(1700000000, 0)
+
+	t.Run("signed url must carry a valid signature of the url", func(t *testing.T) {
+		u, err := signer.Sign("acme/file upload", expiresAt)
+		assert.NoError(t, err)
+
+		unsigned, sig, ok := strings.Cut(u, "&Signature=")
+		assert.True(t, ok)
+		assert.Equal(t, "https://cdn.example.com/acme/file%20upload?Expires=1700000000&KeyName=upload-key", unsigned)
+
+		mac := hmac.New(sha1.New, key)
+		mac.Write([]byte(unsigned))
+		assert.Equal(t, base64.URLEncoding.EncodeToString(mac.Sum(nil)), sig)
+	})
+
+	t.Run("key which isn't base64url encoded must be rejected", func(t *testing.T) {
+		_, err := cdn.NewCloudCDNSigner("https://cdn.example.com", "upload-key", "not a key!")
+		assert.Error(t, err)
+	})
+}
+
+func TestCloudFrontSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	signer, err := cdn.NewCloudFrontSigner("https://d111111abcdef8.cloudfront.net", "K2JCJMDEHXQW5F", pemKey)
+	assert.NoError(t, err)
+	expiresAt := time.Unix(1700000000, 0)
+
+	t.Run("signed url must carry a signature of the canned policy", func(t *testing.T) {
+		u, err := signer.Sign("/acme/file-upload-a", expiresAt)
+		assert.NoError(t, err)
+
+		parsed, err := url.Parse(u)
+		assert.NoError(t, err)
+		q := parsed.Query()
+		assert.Equal(t, "1700000000", q.Get("Expires"))
+		assert.Equal(t, "K2JCJMDEHXQW5F", q.Get("Key-Pair-Id"))
+
+		resource := "https://d111111abcdef8.cloudfront.net/acme/file-upload-a"
+		assert.True(t, strings.HasPrefix(u, resource+"?"))
+		policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`, resource)
+		digest := sha1.Sum([]byte(policy))
+		sig, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(q.Get("Signature")))
+		assert.NoError(t, err)
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], sig))
+	})
+
+	t.Run("key which isn't PEM encoded must be rejected", func(t *testing.T) {
+		_, err := cdn.NewCloudFrontSigner("https://d111111abcdef8.cloudfront.net", "K2JCJMDEHXQW5F", []byte("not a key"))
+		assert.Error(t, err)
+	})
+}
@@ -1,37 +1,71 @@
+// Command composer composes the objects of a bucket named a prefix
+// followed by their offset, such as the chunks of a v4 upload, into a
+// single object, and deletes them.
 package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"cloud.google.com/go/storage"
+	"github.com/imrenagi/go-http-upload/compose"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
-	ctx := context.Background()
+	bucket := flag.String("bucket", os.Getenv("GCS_BUCKET"), "bucket holding the objects, or GCS_BUCKET")
+	prefix := flag.String("prefix", "", "prefix of the objects composed, followed by their offset, e.g. the id of an upload and a dash")
+	dst := flag.String("dest", "", "object written, the prefix without its trailing dash by default")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -bucket bucket -prefix prefix [-dest object]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+
+	if *bucket == "" || *prefix == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *dst == "" {
+		*dst = strings.TrimSuffix(*prefix, "-")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create storage client")
 	}
 	defer client.Close()
+	bkt := client.Bucket(*bucket)
 
-	bucket := "imrenagi-upload-test"
-
-	src1 := client.Bucket(bucket).Object("abdba280-4dc3-40df-a9dc-2dbc0fb47f75-0")
-	src2 := client.Bucket(bucket).Object("abdba280-4dc3-40df-a9dc-2dbc0fb47f75-1")
-	src3 := client.Bucket(bucket).Object("abdba280-4dc3-40df-a9dc-2dbc0fb47f75-2")
-	src4 := client.Bucket(bucket).Object("abdba280-4dc3-40df-a9dc-2dbc0fb47f75-3")
-	dst := client.Bucket(bucket).Object("abdba280-4dc3-40df-a9dc-2dbc0fb47f75")
-
-	// ComposerFrom takes varargs, so you can put as many objects here
-	// as you want.
-	_, err = dst.ComposerFrom(src1, src2, src3, src4).Run(ctx)
+	srcs, err := compose.List(ctx, bkt, *prefix)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to compose objects")
+		log.Fatal().Err(err).Msg("failed to list the objects")
+	}
+	if len(srcs) == 0 {
+		log.Fatal().Str("prefix", *prefix).Msg("no object to compose")
 	}
+	log.Info().Int("objects", len(srcs)).Str("dest", *dst).Msg("Composing objects")
 
-	src1.Delete(ctx)
-	src2.Delete(ctx)
-	src3.Delete(ctx)
-	src4.Delete(ctx)
+	attrs, err := compose.Compose(ctx, bkt, *dst, srcs)
+	if attrs == nil {
+		log.Fatal().Err(err).Msg("failed to compose objects")
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Objects composed, but not all of them deleted")
+		os.Exit(1)
+	}
+	log.Info().
+		Str("object", fmt.Sprintf("gs://%s/%s", attrs.Bucket, attrs.Name)).
+		Int64("size", attrs.Size).
+		Str("crc32c", fmt.Sprintf("%08x", attrs.CRC32C)).
+		Msg("Objects composed")
 }
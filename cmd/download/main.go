@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/imrenagi/go-http-upload/tusclient/progressbar"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", env("TUS_ENDPOINT", "http://localhost:8080/api/v3/files"), "URL the uploads are served under, or TUS_ENDPOINT")
+	dir := flag.String("dir", ".", "directory the files are written to, named after their ID")
+	retries := flag.Int("retries", math.MaxInt, "number of times a failed download is resumed in a row")
+	progress := flag.Bool("progress", isTerminal(os.Stderr), "draw the progress of the downloads on stderr, by default when it is a terminal")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] id...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	stdOut := zerolog.ConsoleWriter{Out: os.Stdout}
+	writers := []io.Writer{stdOut}
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	multi := zerolog.MultiLevelWriter(writers...)
+	log.Logger = zerolog.New(multi).With().Timestamp().Logger()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	endpointURL := strings.TrimSuffix(*endpoint, "/")
+	client := tusclient.New(endpointURL, tusclient.WithRetries(*retries, time.Second))
+
+	failed := false
+	for _, id := range flag.Args() {
+		path := filepath.Join(*dir, id)
+		var opts []tusclient.Option
+		var bar *progressbar.Bar
+		if *progress {
+			bar = progressbar.New(os.Stderr, id)
+			opts = append(opts, tusclient.WithProgress(bar.Report))
+		}
+		size, err := client.Download(ctx, endpointURL+"/"+id, path, opts...)
+		if bar != nil {
+			bar.End()
+		}
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Error downloading file")
+			failed = true
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		log.Info().Str("id", id).Str("file", path).Int64("size", size).Msg("File download complete")
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// isTerminal reports whether f is a character device, such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "http://localhost:8080/api/v3/files", "URL the uploads are created at")
+	concurrency := flag.Int("concurrency", 10, "number of uploads sent at once")
+	uploads := flag.Int("uploads", 0, "number of uploads sent in total, until -duration when 0")
+	duration := flag.Duration("duration", 30*time.Second, "duration of the run, the uploads in progress at its end are cancelled")
+	size := flag.Int64("size", 10<<20, "size in bytes of every upload")
+	chunkSize := flag.Int64("chunk-size", 0, "size in bytes of the PATCH requests, the whole upload when 0")
+	think := flag.Duration("think", 0, "pause of every worker between two uploads")
+	header := flag.String("header", "", "header sent with every request, e.g. \"Authorization: Bearer token\"")
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger().Level(zerolog.InfoLevel)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	s := newStats()
+	transport, err := tusclient.NewTransport(tusclient.TransportOptions{MaxIdleConnsPerHost: *concurrency})
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid transport configuration")
+	}
+	opts := []tusclient.Option{
+		tusclient.WithHTTPClient(&http.Client{Transport: &recordingTransport{next: transport, stats: s}}),
+		tusclient.WithChunkSize(*chunkSize),
+		// a failed upload is an error of the run, not resumed.
+		tusclient.WithRetries(0, 0),
+		tusclient.WithMetadata("content-type", "application/octet-stream"),
+		// not a sha256, so that the server doesn't deduplicate the uploads.
+		tusclient.WithMetadata("checksum", "none"),
+	}
+	if *header != "" {
+		k, v, ok := cutHeader(*header)
+		if !ok {
+			log.Fatal().Str("header", *header).Msg("invalid header, expected \"Key: value\"")
+		}
+		opts = append(opts, tusclient.WithHeader(k, v))
+	}
+	client := tusclient.New(*endpoint, opts...)
+
+	log.Info().
+		Int("concurrency", *concurrency).
+		Int64("size", *size).
+		Int64("chunk_size", *chunkSize).
+		Dur("duration", *duration).
+		Msg("Load test started")
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := sent.Add(1)
+				if *uploads > 0 && n > int64(*uploads) {
+					return
+				}
+				r := &syntheticReader{size: *size, seed: byte(n)}
+				began := time.Now()
+				_, err := client.Upload(ctx, r, tusclient.WithMetadata("filename", fmt.Sprintf("loadtest-%d-%d.bin", w, n)))
+				if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+					s.cancel()
+					return
+				}
+				s.upload(*size, time.Since(began), err)
+				if *think > 0 {
+					select {
+					case <-ctx.Done():
+					case <-time.After(*think):
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	s.report(os.Stdout, time.Since(start))
+}
+
+// cutHeader parses a "Key: value" header.
+func cutHeader(h string) (string, string, bool) {
+	k, v, ok := strings.Cut(h, ":")
+	return strings.TrimSpace(k), strings.TrimSpace(v), ok && strings.TrimSpace(k) != ""
+}
+
+// syntheticReader generates size bytes derived from seed, without holding
+// them in memory.
+type syntheticReader struct {
+	size   int64
+	seed   byte
+	offset int64
+}
+
+func (r *syntheticReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), r.size-r.offset)]
+	for i := range p {
+		p[i] = byte(r.offset+int64(i)) ^ r.seed
+	}
+	r.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (r *syntheticReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
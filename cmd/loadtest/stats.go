@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stats records the outcome of the uploads and the requests of a run.
+type stats struct {
+	mu        sync.Mutex
+	uploads   []time.Duration
+	failures  map[string]int
+	cancelled int
+	bytes     int64
+	requests  map[string][]time.Duration
+	statuses  map[int]int
+}
+
+func newStats() *stats {
+	return &stats{
+		failures: map[string]int{},
+		requests: map[string][]time.Duration{},
+		statuses: map[int]int{},
+	}
+}
+
+// upload records an upload of size bytes which took d, failed when err
+// isn't nil.
+func (s *stats) upload(size int64, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failures[err.Error()]++
+		return
+	}
+	s.uploads = append(s.uploads, d)
+	s.bytes += size
+}
+
+func (s *stats) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelled++
+}
+
+// request records a request of method answered with status after d, 0 when
+// it got no response.
+func (s *stats) request(method string, status int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[method] = append(s.requests[method], d)
+	s.statuses[status]++
+}
+
+// report writes the throughput, latency percentiles and error rate of the
+// run, which lasted elapsed.
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed := 0
+	for _, n := range s.failures {
+		failed += n
+	}
+	total := len(s.uploads) + failed
+	fmt.Fprintf(w, "duration:     %s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "uploads:      %d completed, %d failed, %d cancelled at the end\n", len(s.uploads), failed, s.cancelled)
+	if total > 0 {
+		fmt.Fprintf(w, "error rate:   %.2f%%\n", float64(failed)*100/float64(total))
+	}
+	fmt.Fprintf(w, "throughput:   %.2f MiB/s, %.2f uploads/s\n",
+		float64(s.bytes)/(1<<20)/elapsed.Seconds(), float64(len(s.uploads))/elapsed.Seconds())
+	fmt.Fprintf(w, "upload:       %s\n", percentiles(s.uploads))
+	methods := make([]string, 0, len(s.requests))
+	for m := range s.requests {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		fmt.Fprintf(w, "%-13s %s\n", m+":", percentiles(s.requests[m]))
+	}
+	statuses := make([]int, 0, len(s.statuses))
+	for status := range s.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		name := "no response"
+		if status != 0 {
+			name = fmt.Sprintf("%d %s", status, http.StatusText(status))
+		}
+		fmt.Fprintf(w, "status:       %s x%d\n", name, s.statuses[status])
+	}
+	for err, n := range s.failures {
+		fmt.Fprintf(w, "error:        %s x%d\n", err, n)
+	}
+}
+
+// percentiles formats the count, p50, p90, p99 and max of ds.
+func percentiles(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "n=0"
+	}
+	sorted := slices.Clone(ds)
+	slices.Sort(sorted)
+	p := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("n=%d p50=%s p90=%s p99=%s max=%s", len(sorted), p(0.5), p(0.9), p(0.99), sorted[len(sorted)-1].Round(time.Microsecond))
+}
+
+// recordingTransport records the latency and status of every request.
+type recordingTransport struct {
+	next  http.RoundTripper
+	stats *stats
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	t.stats.request(r.Method, status, time.Since(start))
+	return resp, err
+}
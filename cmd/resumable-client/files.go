@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/imrenagi/go-http-upload/tusclient/progressbar"
+	"github.com/rs/zerolog/log"
+)
+
+// result is the outcome of the upload of a file.
+type result struct {
+	path string
+	url  string
+	err  error
+}
+
+// files returns the files of args, and the regular files of the
+// directories of args, recursively.
+func files(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// uploadAll uploads the files at paths with the metadata meta, at most
+// workers at once, and returns their results in the order of paths.
+func uploadAll(ctx context.Context, client *tusclient.Client, paths []string, meta map[string]string, mmap bool, workers int, progress bool) []result {
+	results := make([]result, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, len(paths)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				path := paths[i]
+				if ctx.Err() != nil {
+					// the file isn't started, it is sent by the next run.
+					results[i] = result{path: path, err: &tusclient.CancelledError{Err: ctx.Err()}}
+					continue
+				}
+				var bar *progressbar.Bar
+				if progress {
+					bar = progressbar.New(os.Stderr, filepath.Base(path))
+				}
+				url, err := upload(ctx, client, path, meta, mmap, bar)
+				if bar != nil {
+					bar.End()
+				}
+				results[i] = result{path: path, url: url, err: err}
+				if err == nil {
+					log.Info().Str("file", path).Str("url", url).Msg("File upload complete")
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
@@ -2,19 +2,64 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/imrenagi/go-http-upload/tusclient/progressbar"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
+	endpoint := flag.String("endpoint", env("TUS_ENDPOINT", "http://localhost:8080/api/v3/files"), "URL the uploads are created at, or TUS_ENDPOINT")
+	chunkSize := flag.Int64("chunk-size", envInt("TUS_CHUNK_SIZE", 0), "size in bytes of the PATCH requests, the whole file when 0, or TUS_CHUNK_SIZE")
+	rateLimit := flag.Int64("rate-limit", envInt("TUS_RATE_LIMIT", 0), "bytes per second the files are sent at most, unlimited when 0, or TUS_RATE_LIMIT")
+	parallel := flag.Int("parallel", int(envInt("TUS_PARALLEL", 1)), "number of partial uploads every file is split in and sent concurrently, which the server concatenates, or TUS_PARALLEL")
+	checksum := flag.String("checksum", env("TUS_CHECKSUM", ""), "algorithm of the checksum sent with every chunk, md5 or sha1, when the server supports it, or TUS_CHECKSUM")
+	tusVersion := flag.String("tus-version", env("TUS_VERSION", tusclient.TusVersion), "version sent in the Tus-Resumable header, or TUS_VERSION")
+	state := flag.String("state", env("TUS_STATE_FILE", defaultStateFile()), "file recording the uploads not complete yet, so that another run resumes them, none when empty, or TUS_STATE_FILE")
+	workers := flag.Int("workers", int(envInt("TUS_WORKERS", 1)), "number of files uploaded concurrently, or TUS_WORKERS")
+	meta := map[string]string{}
+	flag.Func("meta", "metadata key=value sent with every file, overriding the filename, content-type and mtime of the file, may be repeated", func(kv string) error {
+		k, v, err := tusclient.ParseMetadata(kv)
+		meta[k] = v
+		return err
+	})
+	terminate := flag.Bool("terminate-on-cancel", false, "delete the upload in progress from the server when interrupted, instead of keeping it to be resumed")
+	draft := flag.Bool("ietf-draft", false, "speak the IETF resumable uploads draft to the servers advertising it, tus 1.0 to the others")
+	verify := flag.Bool("verify", false, "check the length and sha256 the server reports once every file is uploaded, a mismatch failing the file")
+	caFile := flag.String("ca-file", env("TUS_CA_FILE", ""), "PEM bundle of the CAs trusted in addition to the system ones, or TUS_CA_FILE")
+	certFile := flag.String("cert", env("TUS_CERT_FILE", ""), "PEM client certificate presented to the server, or TUS_CERT_FILE")
+	keyFile := flag.String("key", env("TUS_KEY_FILE", ""), "PEM key of the client certificate, or TUS_KEY_FILE")
+	insecure := flag.Bool("insecure", false, "accept any certificate of the server, only for tests")
+	proxy := flag.String("proxy", env("TUS_PROXY", ""), "http, https or socks5 proxy URL, HTTP_PROXY, HTTPS_PROXY and NO_PROXY when empty, or TUS_PROXY")
+	noKeepAlive := flag.Bool("no-keep-alive", false, "open a connection per request instead of reusing them between the chunks")
+	noHTTP2 := flag.Bool("no-http2", false, "speak HTTP/1.1 even to the servers supporting HTTP/2")
+	maxConns := flag.Int("max-conns", int(envInt("TUS_MAX_CONNS", 0)), "number of connections opened to the server at most, unlimited when 0, or TUS_MAX_CONNS")
+	responseTimeout := flag.Duration("response-timeout", 0, "time the response to a chunk is waited for once it is sent, unlimited when 0")
+	mmap := flag.Bool("mmap", false, "read the files from a memory mapping of their content, saving a system call per read on large files")
+	watch := flag.Bool("watch", false, "watch the directories given, and upload the files appearing in them until interrupted")
+	watchInterval := flag.Duration("watch-interval", 2*time.Second, "interval between the scans of the watched directories, a file is uploaded once unchanged for one interval")
+	doneDir := flag.String("done-dir", "", "directory the watched files are moved to once uploaded, instead of being marked with a "+uploadedSuffix+" file")
+	progress := flag.Bool("progress", isTerminal(os.Stderr), "draw the progress of the uploads on stderr, by default when it is a terminal and a single file is uploaded at once")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file|directory...\n       %s -watch [flags] directory...\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
 	stdOut := zerolog.ConsoleWriter{Out: os.Stdout}
 	writers := []io.Writer{stdOut}
@@ -22,131 +67,164 @@ func main() {
 	multi := zerolog.MultiLevelWriter(writers...)
 	log.Logger = zerolog.New(multi).With().Timestamp().Logger()
 
-	f, err := os.Open("testfile")
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error opening file")
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
 	}
-	defer f.Close()
 
-	fi, err := f.Stat()
+	transport, err := tusclient.NewTransport(tusclient.TransportOptions{
+		CAFile:             *caFile,
+		CertFile:           *certFile,
+		KeyFile:            *keyFile,
+		InsecureSkipVerify: *insecure,
+		Proxy:              *proxy,
+
+		DisableKeepAlives:     *noKeepAlive,
+		DisableHTTP2:          *noHTTP2,
+		MaxConnsPerHost:       *maxConns,
+		ResponseHeaderTimeout: *responseTimeout,
+	})
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error getting file info")
+		log.Fatal().Err(err).Msg("invalid transport configuration")
+	}
+	httpClient := &http.Client{Transport: transport}
+	opts := []tusclient.Option{
+		tusclient.WithHTTPClient(httpClient),
+		tusclient.WithChunkSize(*chunkSize),
+		tusclient.WithTusVersion(*tusVersion),
+		tusclient.WithRateLimit(*rateLimit),
+		tusclient.WithParallel(*parallel),
+		tusclient.WithChecksum(*checksum),
+		tusclient.WithTerminateOnCancel(*terminate),
+		tusclient.WithVerify(*verify),
+		tusclient.WithIETFDraft(*draft),
+		// every file is resumed until it is received entirely.
+		tusclient.WithRetries(math.MaxInt, time.Second),
+	}
+	if *state != "" {
+		opts = append(opts, tusclient.WithStore(tusclient.NewFileStore(*state)))
+	}
+	client := tusclient.New(*endpoint, opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *watch {
+		w := &watcher{
+			client:   client,
+			dirs:     flag.Args(),
+			doneDir:  *doneDir,
+			interval: *watchInterval,
+			meta:     meta,
+			mmap:     *mmap,
+			workers:  max(*workers, 1),
+		}
+		log.Info().Strs("dirs", w.dirs).Msg("Watching directories")
+		w.run(ctx)
+		return
 	}
-	fileSize := fi.Size()
-	log.Debug().Int64("size", fileSize).Msg("File size in bytes")
 
-	req, err := http.NewRequest("POST", "http://localhost:8080/api/v3/files", nil)
+	paths, err := files(flag.Args())
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error creating request")
+		log.Fatal().Err(err).Msg("unable to list the files to upload")
+	}
+	// the progress bars of concurrent uploads would overwrite each other.
+	results := uploadAll(ctx, client, paths, meta, *mmap, max(*workers, 1), *progress && *workers <= 1)
+
+	failed := 0
+	for _, r := range results {
+		var cancelled *tusclient.CancelledError
+		switch {
+		case r.err == nil:
+			continue
+		case errors.As(r.err, &cancelled) && cancelled.Resumable():
+			log.Warn().Str("file", r.path).Int64("offset", cancelled.Offset).Msg("Upload interrupted, run again to resume it")
+		default:
+			log.Error().Err(r.err).Str("file", r.path).Msg("Error uploading file")
+		}
+		failed++
+	}
+	log.Info().Int("uploaded", len(results)-failed).Int("failed", failed).Msg("Uploads finished")
+	if failed > 0 {
+		os.Exit(1)
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Header.Set("Upload-Length", fmt.Sprint(fileSize))
-	req.Header.Set("Tus-Resumable", "1.0.0")
+}
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-		},
+func upload(ctx context.Context, client *tusclient.Client, path string, meta map[string]string, mmap bool, bar *progressbar.Bar) (string, error) {
+	f, err := open(path, mmap)
+	if err != nil {
+		return "", err
 	}
-	resp, err := httpClient.Do(req)
+	defer f.Close()
+	fingerprint, err := tusclient.Fingerprint(path)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error sending request")
+		return "", err
+	}
+	// the server deduplicates the uploads by their sha256.
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
-	d, err := io.ReadAll(resp.Body)
+	md, err := tusclient.FileMetadata(path)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error reading response")
+		return "", err
 	}
-	log.Debug().Msg(string(d))
-	log.Debug().Str("location", resp.Header.Get("Location")).
-		Int("status", resp.StatusCode).
-		Msg("Check file creation response")
-
-	location := resp.Header.Get("Location")
-	id := location[strings.LastIndex(location, "/")+1:]
-	log.Debug().Str("id", id).Msg("Extracted file ID")
-
-	for {
-
-		req, err := http.NewRequest("HEAD", "http://localhost:8080/api/v3/files/"+id, nil)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error creating request")
-		}
-		req.Header.Set("Tus-Resumable", "1.0.0")
-
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error sending request")
-		}
-
-		d, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error reading response")
-		}
-		resp.Body.Close()
-
-		log.Debug().Msg(string(d))
-
-		uploadOffset := resp.Header.Get("Upload-Offset")
-		offset, err := strconv.ParseInt(uploadOffset, 10, 64)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error parsing upload offset")
-		}
-		log.Debug().Str("Upload-Offset", uploadOffset).Msg("Check file upload offset ---")
-
-		if offset >= fileSize {
-			log.Debug().
-				Str("Upload-Offset", uploadOffset).
-				Str("fileSize", fmt.Sprint(fileSize)).
-				Msg("File upload complete")
-			break
-		}
-
-		f, err := os.Open("testfile")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error opening file")
-		}
-		defer f.Close()
-
-		start, err := f.Seek(offset, io.SeekStart)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error seeking to offset")
-		}
-		log.Debug().Int64("start", start).Msg("Seek to offset")
-
-		ctx := context.Background()
-		// ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
-		// defer cancel()
-		req, err = http.NewRequestWithContext(ctx, "PATCH", "http://localhost:8080/api/v3/files/"+id, f)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error creating request")
-		}
-		req.Header.Set("Content-Type", "application/offset+octet-stream")
-		req.Header.Set("Tus-Resumable", "1.0.0")
-		req.Header.Set("Upload-Offset", fmt.Sprint(offset))
-
-		log.Debug().Msg("Sending file data")
+	opts := []tusclient.Option{
+		tusclient.WithFingerprint(fingerprint),
+		tusclient.WithMetadataMap(md),
+		tusclient.WithMetadata("checksum", "sha256 "+hex.EncodeToString(sum.Sum(nil))),
+		tusclient.WithMetadataMap(meta),
+	}
+	if bar != nil {
+		opts = append(opts, tusclient.WithProgress(bar.Report))
+	}
+	return client.Upload(ctx, f, opts...)
+}
 
-		resp, err = httpClient.Do(req)
-		if err != nil {
-			log.Warn().Err(err).Msg("Error sending request")
-		}
-		if resp == nil {
-			log.Debug().Msg("patch response is nil")
-			continue
+// open opens the file at path, mapped in memory when mmap is set and the
+// platform supports it.
+func open(path string, mmap bool) (io.ReadSeekCloser, error) {
+	if mmap {
+		m, err := tusclient.OpenMapped(path)
+		if !errors.Is(err, tusclient.ErrMmapUnsupported) {
+			return m, err
 		}
+		log.Debug().Err(err).Str("file", path).Msg("reading the file without mapping it")
+	}
+	return os.Open(path)
+}
 
-		d, err = io.ReadAll(resp.Body)
-		if err != nil {
-			log.Warn().Err(err).Msg("Error reading response")
-		}
-		resp.Body.Close()
+// isTerminal reports whether f is a character device, such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
-		log.Debug().Msg(string(d))
-		log.Debug().Int("status", resp.StatusCode).
-			Str("Upload-Offset", resp.Header.Get("Upload-Offset")).
-			Msg("Check file upload response")
+// defaultStateFile returns the file recording the uploads in the cache
+// directory of the user, none when there isn't any.
+func defaultStateFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-http-upload", "uploads.json")
+}
 
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return fallback
+}
 
+func envInt(key string, fallback int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		log.Fatal().Str(key, v).Msg("invalid " + key + ", expected a non-negative number")
+	}
+	return n
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/rs/zerolog/log"
+)
+
+// uploadedSuffix marks the files uploaded in a watched directory when they
+// aren't moved elsewhere.
+const uploadedSuffix = ".uploaded"
+
+// watcher uploads the files appearing in directories.
+//
+// The directories are scanned every interval rather than notified by the
+// file system, which also works on network mounts, and a file is uploaded
+// once its size and modification time didn't change between two scans, so
+// that the files still being written aren't sent. Once uploaded, a file is
+// moved under doneDir, or marked with a file of the uploadedSuffix next to
+// it. Hidden files are ignored, since they are usually temporary.
+type watcher struct {
+	client   *tusclient.Client
+	dirs     []string
+	doneDir  string
+	interval time.Duration
+	meta     map[string]string
+	mmap     bool
+	workers  int
+
+	// seen is the size and modification time of the files at the last
+	// scan.
+	seen map[string]fs.FileInfo
+}
+
+// run watches the directories until ctx is done.
+func (w *watcher) run(ctx context.Context) {
+	w.seen = map[string]fs.FileInfo{}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		ready := w.scan()
+		if len(ready) > 0 {
+			for _, r := range uploadAll(ctx, w.client, ready, w.meta, w.mmap, w.workers, false) {
+				if r.err != nil {
+					log.Error().Err(r.err).Str("file", r.path).Msg("Error uploading file, retrying at the next scan")
+					continue
+				}
+				w.done(r.path, r.url)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan returns the files not uploaded yet which didn't change since the
+// last scan.
+func (w *watcher) scan() []string {
+	var ready []string
+	current := map[string]fs.FileInfo{}
+	for _, dir := range w.dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() && w.doneDir != "" && sameFile(path, w.doneDir) {
+				return filepath.SkipDir
+			}
+			if !d.Type().IsRegular() || strings.HasSuffix(path, uploadedSuffix) {
+				return nil
+			}
+			if _, err := os.Stat(path + uploadedSuffix); err == nil {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			current[path] = fi
+			if prev, ok := w.seen[path]; ok && prev.Size() == fi.Size() && prev.ModTime().Equal(fi.ModTime()) {
+				ready = append(ready, path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Warn().Err(err).Str("dir", dir).Msg("unable to scan the watched directory")
+		}
+	}
+	w.seen = current
+	return ready
+}
+
+// done moves the file uploaded at url under the done directory, or marks
+// it as uploaded.
+func (w *watcher) done(path, url string) {
+	log := log.With().Str("file", path).Str("url", url).Logger()
+	delete(w.seen, path)
+	if w.doneDir == "" {
+		if err := os.WriteFile(path+uploadedSuffix, []byte(url+"\n"), 0644); err != nil {
+			log.Error().Err(err).Msg("unable to mark the file as uploaded")
+		}
+		return
+	}
+	dest := filepath.Join(w.doneDir, w.relative(path))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		log.Error().Err(err).Msg("unable to create the done directory")
+		return
+	}
+	if err := os.Rename(path, dest); err != nil {
+		log.Error().Err(err).Msg("unable to move the uploaded file")
+	}
+}
+
+// relative returns path relative to the watched directory it is in.
+func (w *watcher) relative(path string) string {
+	for _, dir := range w.dirs {
+		if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return filepath.Base(path)
+}
+
+// sameFile reports whether the paths a and b are the same directory.
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
@@ -2,18 +2,468 @@ package main
 
 import (
 	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	gcppubsub "cloud.google.com/go/pubsub"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awssns "github.com/aws/aws-sdk-go-v2/service/sns"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/cdn"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/hooks/script"
+	"github.com/imrenagi/go-http-upload/pipeline"
+	"github.com/imrenagi/go-http-upload/pipeline/clamav"
 	"github.com/imrenagi/go-http-upload/server"
+	"github.com/imrenagi/go-http-upload/sinks/kafka"
+	"github.com/imrenagi/go-http-upload/sinks/nats"
+	"github.com/imrenagi/go-http-upload/sinks/pubsub"
+	"github.com/imrenagi/go-http-upload/sinks/sns"
+	"github.com/imrenagi/go-http-upload/sinks/sqs"
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/imrenagi/go-http-upload/webhook"
+	natsgo "github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 )
 
+// version and commit label the build info metric. They are set at build time
+// with -ldflags "-X main.version=<version> -X main.commit=<commit>".
+var (
+	version = "dev"
+	commit  string
+)
+
 func main() {
 	ctx := context.Background()
 	// Initialize the logger
-	_ = server.InitializeLogger("debug")
+	logConfig := server.LogConfig{
+		Level: os.Getenv("LOG_LEVEL"),
+		JSON:  os.Getenv("LOG_FORMAT") == "json",
+		File:  os.Getenv("LOG_FILE"),
+	}
+	for env, v := range map[string]*int{
+		"LOG_FILE_MAX_SIZE_MB":  &logConfig.MaxSizeMB,
+		"LOG_FILE_MAX_BACKUPS":  &logConfig.MaxBackups,
+		"LOG_FILE_MAX_AGE_DAYS": &logConfig.MaxAgeDays,
+	} {
+		if value := os.Getenv(env); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				log.Fatal().Str(env, value).Msg("invalid " + env)
+			}
+			*v = n
+		}
+	}
+	closeLog := server.InitializeLogger(logConfig)
+	defer closeLog()
+
+	opts := server.Opts{
+		Version:      version,
+		Commit:       commit,
+		TLSCertFile:  os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:   os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+		GRPCAddr:     os.Getenv("GRPC_ADDR"),
+		TenantHeader: os.Getenv("TENANT_HEADER"),
+		Dedup:        os.Getenv("DEDUP") == "true",
+		URLImport:    os.Getenv("URL_IMPORT_ENABLED") == "true",
+		Tracing:      os.Getenv("TRACING_ENABLED") == "true",
+		OTLPEndpoint: os.Getenv("OTLP_ENDPOINT"),
+		OTLPInsecure: os.Getenv("OTLP_INSECURE") == "true",
+		OTLPHeaders:  headers(os.Getenv("OTLP_HEADERS")),
+		UploadDir:    os.Getenv("UPLOAD_DIR"),
+		V1UploadDir:  os.Getenv("V1_UPLOAD_DIR"),
+		V1Bucket:     os.Getenv("V1_BUCKET"),
+
+		DiskUsageRejectCreates: os.Getenv("DISK_USAGE_REJECT_CREATES") == "true",
+		SparseUploads:          os.Getenv("SPARSE_UPLOADS_ENABLED") == "true",
+		Multipart:              os.Getenv("MULTIPART_ENABLED") == "true",
+		WebSocketUploads:       os.Getenv("WEBSOCKET_UPLOADS_ENABLED") == "true",
+		DirectIO:               os.Getenv("DIRECT_IO_ENABLED") == "true",
+		ComposeChunks:          os.Getenv("COMPOSE_CHUNKS_ENABLED") == "true",
+	}
 
-	server := server.New(server.Opts{})
+	var authenticators []auth.Authenticator
+	if opts.ClientCAFile != "" {
+		authenticators = append(authenticators, auth.NewCertificateAuthenticator())
+	}
+	if jwksURL := os.Getenv("JWT_JWKS_URL"); jwksURL != "" {
+		authenticators = append(authenticators, auth.NewJWTAuthenticator(jwksURL,
+			auth.WithIssuer(os.Getenv("JWT_ISSUER")),
+			auth.WithAudience(os.Getenv("JWT_AUDIENCE")),
+			auth.WithTenantClaim(os.Getenv("JWT_TENANT_CLAIM")),
+			auth.WithRolesClaim(os.Getenv("JWT_ROLES_CLAIM"))))
+	}
+	if keysFile := os.Getenv("API_KEYS_FILE"); keysFile != "" {
+		store, err := auth.NewFileKeyStore(keysFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load api keys")
+		}
+		authenticators = append(authenticators, auth.NewAPIKeyAuthenticator(store))
+	}
+	switch len(authenticators) {
+	case 0:
+	case 1:
+		opts.Authenticator = authenticators[0]
+	default:
+		opts.Authenticator = auth.Chain(authenticators...)
+	}
+	if key := os.Getenv("URL_SIGNING_KEY"); key != "" {
+		opts.URLSigningKey = []byte(key)
+	}
+	if admins := os.Getenv("ADMIN_SUBJECTS"); admins != "" {
+		opts.Admins = strings.Split(admins, ",")
+	}
+	if origins := os.Getenv("WEBSOCKET_ORIGINS"); origins != "" {
+		opts.WebSocketOrigins = strings.Split(origins, ",")
+	}
+	opts.UploadTokens = os.Getenv("UPLOAD_TOKENS_ENABLED") == "true"
+	if quota := os.Getenv("TENANT_QUOTA_BYTES"); quota != "" {
+		v, err := strconv.ParseUint(quota, 10, 64)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid TENANT_QUOTA_BYTES")
+		}
+		opts.TenantQuota = v
+	}
+	if quota := os.Getenv("USER_QUOTA_BYTES"); quota != "" {
+		v, err := strconv.ParseUint(quota, 10, 64)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid USER_QUOTA_BYTES")
+		}
+		opts.UserQuota = v
+	}
+	if sizes := os.Getenv("THUMBNAIL_SIZES"); sizes != "" {
+		for _, size := range strings.Split(sizes, ",") {
+			v, err := strconv.Atoi(strings.TrimSpace(size))
+			if err != nil || v <= 0 {
+				log.Fatal().Str("size", size).Msg("invalid THUMBNAIL_SIZES")
+			}
+			opts.ThumbnailSizes = append(opts.ThumbnailSizes, v)
+		}
+	}
+	switch os.Getenv("CDN_PROVIDER") {
+	case "":
+	case "cloudcdn":
+		signer, err := cdn.NewCloudCDNSigner(os.Getenv("CDN_BASE_URL"), os.Getenv("CDN_KEY_NAME"), os.Getenv("CDN_KEY"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create cloud cdn signer")
+		}
+		opts.CDN = signer
+	case "cloudfront":
+		key, err := os.ReadFile(os.Getenv("CDN_PRIVATE_KEY_FILE"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read cloudfront private key")
+		}
+		signer, err := cdn.NewCloudFrontSigner(os.Getenv("CDN_BASE_URL"), os.Getenv("CDN_KEY_PAIR_ID"), key)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create cloudfront signer")
+		}
+		opts.CDN = signer
+	default:
+		log.Fatal().Str("provider", os.Getenv("CDN_PROVIDER")).Msg("unknown CDN_PROVIDER")
+	}
+	if ttl := os.Getenv("CDN_URL_TTL"); ttl != "" {
+		v, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid CDN_URL_TTL")
+		}
+		opts.CDNURLTTL = v
+	}
+	if ratio := os.Getenv("TRACE_SAMPLE_RATIO"); ratio != "" {
+		v, err := strconv.ParseFloat(ratio, 64)
+		// tracing is disabled with TRACING_ENABLED rather than a zero ratio.
+		if err != nil || v <= 0 || v > 1 {
+			log.Fatal().Str("ratio", ratio).Msg("invalid TRACE_SAMPLE_RATIO, expected a number in (0, 1]")
+		}
+		opts.TraceSampleRatio = v
+	}
+	if timeout := os.Getenv("DOWNLOAD_TIMEOUT"); timeout != "" {
+		v, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid DOWNLOAD_TIMEOUT")
+		}
+		opts.DownloadTimeout = v
+	}
+	if size := os.Getenv("URL_IMPORT_MAX_SIZE"); size != "" {
+		v, err := strconv.ParseUint(size, 10, 64)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid URL_IMPORT_MAX_SIZE")
+		}
+		opts.URLImportMaxSize = v
+	}
+	if timeout := os.Getenv("URL_IMPORT_TIMEOUT"); timeout != "" {
+		v, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid URL_IMPORT_TIMEOUT")
+		}
+		opts.URLImportTimeout = v
+	}
+	if ttl := os.Getenv("SESSION_TTL"); ttl != "" {
+		v, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid SESSION_TTL")
+		}
+		opts.SessionTTL = v
+	}
+	if accessLog := os.Getenv("ACCESS_LOG"); accessLog != "" {
+		format, err := server.ParseAccessLogFormat(os.Getenv("ACCESS_LOG_FORMAT"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid ACCESS_LOG_FORMAT")
+		}
+		opts.AccessLogFormat = format
+		switch accessLog {
+		case "stdout":
+			opts.AccessLog = os.Stdout
+		case "stderr":
+			opts.AccessLog = os.Stderr
+		default:
+			file, err := os.OpenFile(accessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatal().Err(err).Msg("unable to open the access log")
+			}
+			defer file.Close()
+			opts.AccessLog = file
+		}
+	}
+	if size := os.Getenv("COPY_BUFFER_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			log.Fatal().Str("size", size).Msg("invalid COPY_BUFFER_SIZE, expected a number of bytes")
+		}
+		opts.CopyBufferSize = n
+	}
+	for env, limit := range map[string]*int64{
+		"V1_MAX_SIZE":         &opts.V1MaxSize,
+		"V1_MAX_MEMORY":       &opts.V1MaxMemory,
+		"V1_MAX_DECODED_SIZE": &opts.V1MaxDecodedSize,
+		"V2_MAX_SIZE":         &opts.V2MaxSize,
+	} {
+		if size := os.Getenv(env); size != "" {
+			n, err := strconv.ParseInt(size, 10, 64)
+			if err != nil || n <= 0 {
+				log.Fatal().Str("size", size).Msgf("invalid %s, expected a number of bytes", env)
+			}
+			*limit = n
+		}
+	}
+	if files := os.Getenv("V1_MAX_FILES"); files != "" {
+		n, err := strconv.Atoi(files)
+		if err != nil || n < 0 {
+			log.Fatal().Str("files", files).Msg("invalid V1_MAX_FILES, expected a number of files")
+		}
+		opts.V1MaxFiles = n
+	}
+	if size := os.Getenv("ASYNC_FINALIZE_MIN_SIZE"); size != "" {
+		n, err := strconv.ParseUint(size, 10, 64)
+		if err != nil {
+			log.Fatal().Str("size", size).Msg("invalid ASYNC_FINALIZE_MIN_SIZE, expected a number of bytes")
+		}
+		opts.AsyncFinalizeMinSize = n
+	}
+	if rate := os.Getenv("MIN_TRANSFER_RATE"); rate != "" {
+		n, err := strconv.ParseUint(rate, 10, 64)
+		if err != nil {
+			log.Fatal().Str("rate", rate).Msg("invalid MIN_TRANSFER_RATE, expected a number of bytes per second")
+		}
+		opts.MinTransferRate = n
+	}
+	if window := os.Getenv("MIN_TRANSFER_RATE_WINDOW"); window != "" {
+		v, err := time.ParseDuration(window)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid MIN_TRANSFER_RATE_WINDOW")
+		}
+		opts.MinTransferRateWindow = v
+	}
+	if threshold := os.Getenv("DISK_USAGE_THRESHOLD"); threshold != "" {
+		v, err := strconv.ParseFloat(threshold, 64)
+		if err != nil || v <= 0 || v > 1 {
+			log.Fatal().Str("threshold", threshold).Msg("invalid DISK_USAGE_THRESHOLD, expected a number in (0, 1]")
+		}
+		opts.DiskUsageThreshold = v
+	}
+	if interval := os.Getenv("DISK_USAGE_INTERVAL"); interval != "" {
+		v, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid DISK_USAGE_INTERVAL")
+		}
+		opts.DiskUsageInterval = v
+	}
+	for _, step := range strings.Split(os.Getenv("PIPELINE_STEPS"), ",") {
+		switch step = strings.TrimSpace(step); step {
+		case "":
+		case "checksum":
+			opts.Processors = append(opts.Processors, pipeline.Checksum())
+		case "clamav":
+			address := os.Getenv("CLAMAV_ADDRESS")
+			if address == "" {
+				address = "tcp://localhost:3310"
+			}
+			opts.Processors = append(opts.Processors, clamav.NewScanner(address))
+		default:
+			log.Fatal().Str("step", step).Msg("unknown PIPELINE_STEPS step")
+		}
+	}
+	extAllow, extDeny := os.Getenv("FILE_EXTENSION_ALLOW"), os.Getenv("FILE_EXTENSION_DENY")
+	if allow, deny := os.Getenv("CONTENT_TYPE_ALLOW"), os.Getenv("CONTENT_TYPE_DENY"); allow != "" || deny != "" || extAllow != "" || extDeny != "" || os.Getenv("CONTENT_TYPE_MISMATCH") != "" {
+		policy := &sniff.Policy{
+			Allow:           list(allow),
+			Deny:            list(deny),
+			AllowExtensions: list(extAllow),
+			DenyExtensions:  list(extDeny),
+		}
+		switch v := os.Getenv("CONTENT_TYPE_MISMATCH"); v {
+		case "", "ignore":
+		case "flag":
+			policy.Mismatch = sniff.MismatchFlag
+		case "reject":
+			policy.Mismatch = sniff.MismatchReject
+		default:
+			log.Fatal().Str("value", v).Msg("invalid CONTENT_TYPE_MISMATCH, expected ignore, flag or reject")
+		}
+		opts.ContentTypePolicy = policy
+	}
+	var sinks []hooks.EventSink
+	if urls := os.Getenv("WEBHOOK_URLS"); urls != "" {
+		webhookOpts := []webhook.Option{}
+		if path := os.Getenv("WEBHOOK_DEAD_LETTER_FILE"); path != "" {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to open the webhook dead-letter file")
+			}
+			defer f.Close()
+			webhookOpts = append(webhookOpts, webhook.WithDeadLetter(f))
+		}
+		notifier := webhook.NewNotifier(strings.Split(urls, ","), []byte(os.Getenv("WEBHOOK_SECRET")), webhookOpts...)
+		go notifier.Run(ctx)
+		sinks = append(sinks, hooks.FilterEvents(notifier, eventTypes(os.Getenv("WEBHOOK_EVENTS"))...))
+	}
+	if brokers := os.Getenv("KAFKA_BROKERS"); brokers != "" {
+		topic := os.Getenv("KAFKA_TOPIC")
+		if topic == "" {
+			topic = "uploads"
+		}
+		publisher := kafka.NewPublisher(strings.Split(brokers, ","), topic)
+		defer publisher.Close()
+		sinks = append(sinks, hooks.FilterEvents(publisher, eventTypes(os.Getenv("KAFKA_EVENTS"))...))
+	}
+	if url := os.Getenv("NATS_URL"); url != "" {
+		nc, err := natsgo.Connect(url)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to connect to nats")
+		}
+		defer nc.Drain()
+		natsOpts := []nats.Option{}
+		if subject := os.Getenv("NATS_SUBJECT"); subject != "" {
+			natsOpts = append(natsOpts, nats.WithSubject(subject))
+		}
+		if v := os.Getenv("NATS_TENANT_SUBJECTS"); v != "" {
+			subjects := make(map[string]string)
+			for _, kv := range strings.Split(v, ",") {
+				tenant, subject, ok := strings.Cut(kv, "=")
+				if !ok {
+					log.Fatal().Str("value", kv).Msg("invalid NATS_TENANT_SUBJECTS, expected tenant=subject")
+				}
+				subjects[tenant] = subject
+			}
+			natsOpts = append(natsOpts, nats.WithTenantSubjects(subjects))
+		}
+		publisher, err := nats.NewPublisher(nc, natsOpts...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create the nats publisher")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := publisher.Close(ctx); err != nil {
+				log.Error().Err(err).Msg("pending upload events were not published to nats")
+			}
+		}()
+		sinks = append(sinks, hooks.FilterEvents(publisher, eventTypes(os.Getenv("NATS_EVENTS"))...))
+	}
+	if topic := os.Getenv("PUBSUB_TOPIC"); topic != "" {
+		client, err := gcppubsub.NewClient(ctx, os.Getenv("PUBSUB_PROJECT_ID"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create the pubsub client")
+		}
+		defer client.Close()
+		publisher := pubsub.NewPublisher(client, topic)
+		defer publisher.Close()
+		sinks = append(sinks, hooks.FilterEvents(publisher, eventTypes(os.Getenv("PUBSUB_EVENTS"))...))
+	}
+	if queueURL, topicARN := os.Getenv("SQS_QUEUE_URL"), os.Getenv("SNS_TOPIC_ARN"); queueURL != "" || topicARN != "" {
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load the aws configuration")
+		}
+		if queueURL != "" {
+			publisher := sqs.NewPublisher(awssqs.NewFromConfig(cfg), queueURL)
+			defer publisher.Close()
+			sinks = append(sinks, hooks.FilterEvents(publisher, eventTypes(os.Getenv("SQS_EVENTS"))...))
+		}
+		if topicARN != "" {
+			publisher := sns.NewPublisher(awssns.NewFromConfig(cfg), topicARN)
+			defer publisher.Close()
+			sinks = append(sinks, hooks.FilterEvents(publisher, eventTypes(os.Getenv("SNS_EVENTS"))...))
+		}
+	}
+	var hs []hooks.Hooks
+	if dir := os.Getenv("HOOKS_DIR"); dir != "" {
+		scriptOpts := []script.Option{}
+		if timeout := os.Getenv("HOOKS_TIMEOUT"); timeout != "" {
+			v, err := time.ParseDuration(timeout)
+			if err != nil {
+				log.Fatal().Err(err).Msg("invalid HOOKS_TIMEOUT")
+			}
+			scriptOpts = append(scriptOpts, script.WithTimeout(v))
+		}
+		scripts := script.New(dir, scriptOpts...)
+		go scripts.Run(ctx)
+		hs = append(hs, scripts)
+	}
+	if len(sinks) > 0 {
+		hs = append(hs, hooks.SinkHooks(sinks...))
+	}
+	if len(hs) > 0 {
+		opts.Hooks = hooks.Multi(hs...)
+	}
+
+	server := server.New(opts)
 	if err := server.Run(ctx); err != nil {
 		log.Fatal().Err(err).Msg("failed to run the server")
 	}
 }
+
+// list parses a comma separated list.
+func list(v string) []string {
+	var values []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			values = append(values, e)
+		}
+	}
+	return values
+}
+
+// headers parses a comma separated list of key=value headers.
+func headers(v string) map[string]string {
+	h := make(map[string]string)
+	for _, kv := range list(v) {
+		key, value, _ := strings.Cut(kv, "=")
+		h[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return h
+}
+
+// eventTypes parses a comma separated list of event types.
+func eventTypes(v string) []hooks.EventType {
+	var types []hooks.EventType
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			types = append(types, hooks.EventType(e))
+		}
+	}
+	return types
+}
@@ -0,0 +1,217 @@
+// Package compose concatenates the objects of a GCS bucket named after
+// their offset, such as the chunks of an upload of the v4 API, into a
+// single object.
+//
+// GCS composes at most MaxSources objects at once, so larger sets are
+// composed in rounds of intermediate objects. The CRC32C of the result is
+// verified against the one of the sources before they are deleted.
+package compose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// MaxSources is the number of objects GCS composes in a single request.
+const MaxSources = 32
+
+var (
+	// ErrMissingData is returned by List when the objects found leave a
+	// gap in the content.
+	ErrMissingData = errors.New("missing data")
+	// ErrChecksumMismatch is returned by Compose when the CRC32C of the
+	// composed object isn't the one of its sources.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrNotDeleted is returned by Compose, together with the composed
+	// object, when some sources couldn't be deleted.
+	ErrNotDeleted = errors.New("sources not deleted")
+)
+
+// Source is an object holding the content starting at Offset.
+type Source struct {
+	Name   string
+	Offset int64
+	Size   int64
+	CRC32C uint32
+}
+
+// List returns the objects of bkt named prefix followed by their offset,
+// sorted by offset. The objects whose name doesn't end with an offset are
+// skipped.
+func List(ctx context.Context, bkt *storage.BucketHandle, prefix string) ([]Source, error) {
+	it := bkt.Objects(ctx, &storage.Query{Prefix: prefix})
+	var srcs []Source
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseInt(strings.TrimPrefix(attrs.Name, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		srcs = append(srcs, Source{Name: attrs.Name, Offset: offset, Size: attrs.Size, CRC32C: attrs.CRC32C})
+	}
+	sort.Slice(srcs, func(i, j int) bool {
+		return srcs[i].Offset < srcs[j].Offset
+	})
+
+	var next int64
+	for _, src := range srcs {
+		if src.Offset != next {
+			return nil, fmt.Errorf("%w at offset %d", ErrMissingData, next)
+		}
+		next += src.Size
+	}
+	return srcs, nil
+}
+
+// Compose writes the concatenation of srcs, sorted by offset as List
+// returns them, to the object dst of bkt, verifies its CRC32C, and deletes
+// the sources. dst may be one of the sources, e.g. the first one, which is
+// then kept.
+func Compose(ctx context.Context, bkt *storage.BucketHandle, dst string, srcs []Source) (*storage.ObjectAttrs, error) {
+	if len(srcs) == 0 {
+		return nil, errors.New("no source to compose")
+	}
+	var temps []string
+	defer func() {
+		// the intermediate objects are deleted whatever the outcome.
+		for _, name := range temps {
+			bkt.Object(name).Delete(context.WithoutCancel(ctx))
+		}
+	}()
+
+	level := srcs
+	for round := 0; len(level) > MaxSources; round++ {
+		var next []Source
+		for i := 0; i < len(level); i += MaxSources {
+			name := fmt.Sprintf("%s.compose-%d-%d", dst, round, i/MaxSources)
+			temps = append(temps, name)
+			attrs, err := composeGroup(ctx, bkt, name, level[i:min(i+MaxSources, len(level))])
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, Source{Name: name, Offset: level[i].Offset, Size: attrs.Size, CRC32C: attrs.CRC32C})
+		}
+		level = next
+	}
+	attrs, err := composeGroup(ctx, bkt, dst, level)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, src := range srcs {
+		if src.Name == dst {
+			continue
+		}
+		if err := bkt.Object(src.Name).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return attrs, fmt.Errorf("%w: %w", ErrNotDeleted, errors.Join(errs...))
+	}
+	return attrs, nil
+}
+
+// composeGroup writes the concatenation of at most MaxSources srcs to the
+// object dst, and verifies its size and CRC32C.
+func composeGroup(ctx context.Context, bkt *storage.BucketHandle, dst string, srcs []Source) (*storage.ObjectAttrs, error) {
+	objs := make([]*storage.ObjectHandle, len(srcs))
+	var size int64
+	for i, src := range srcs {
+		objs[i] = bkt.Object(src.Name)
+		size += src.Size
+	}
+	attrs, err := bkt.Object(dst).ComposerFrom(objs...).Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("composing %s: %w", dst, err)
+	}
+	if want := CRC32C(srcs); attrs.Size != size || attrs.CRC32C != want {
+		return nil, fmt.Errorf("%w: %s has %d bytes of crc32c %08x, expected %d bytes of crc32c %08x",
+			ErrChecksumMismatch, dst, attrs.Size, attrs.CRC32C, size, want)
+	}
+	return attrs, nil
+}
+
+// castagnoli is the reversed polynomial of CRC32C.
+const castagnoli = 0x82f63b78
+
+// CRC32C returns the CRC32C of the concatenation of srcs, computed from
+// their own.
+func CRC32C(srcs []Source) uint32 {
+	var crc uint32
+	for _, src := range srcs {
+		crc = combine(crc, src.CRC32C, src.Size)
+	}
+	return crc
+}
+
+// combine returns the CRC32C of the concatenation of a content of CRC32C
+// crc1 and another one of CRC32C crc2 and size2 bytes, as zlib's
+// crc32_combine does.
+func combine(crc1, crc2 uint32, size2 int64) uint32 {
+	if size2 <= 0 {
+		return crc1
+	}
+	// odd starts as the operator appending a single zero bit to a CRC,
+	// squared until it appends a zero byte.
+	var even, odd [32]uint32
+	odd[0] = castagnoli
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	square(&even, &odd)
+	square(&odd, &even)
+
+	// append size2 zero bytes to crc1, one bit of size2 at a time.
+	for {
+		square(&even, &odd)
+		if size2&1 != 0 {
+			crc1 = times(&even, crc1)
+		}
+		size2 >>= 1
+		if size2 == 0 {
+			break
+		}
+		square(&odd, &even)
+		if size2&1 != 0 {
+			crc1 = times(&odd, crc1)
+		}
+		size2 >>= 1
+		if size2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func times(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func square(dst, mat *[32]uint32) {
+	for n := range dst {
+		dst[n] = times(mat, mat[n])
+	}
+}
@@ -0,0 +1,36 @@
+package compose_test
+
+import (
+	"hash/crc32"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/compose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRC32C(t *testing.T) {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	data := make([]byte, 100<<10)
+	for i := range data {
+		data[i] = byte(i * 7 % 253)
+	}
+
+	t.Run("crc32c of the sources must be the one of their concatenation", func(t *testing.T) {
+		var srcs []compose.Source
+		for _, bounds := range [][2]int{{0, 1}, {1, 4096}, {4096, 70000}, {70000, len(data)}} {
+			part := data[bounds[0]:bounds[1]]
+			srcs = append(srcs, compose.Source{Offset: int64(bounds[0]), Size: int64(len(part)), CRC32C: crc32.Checksum(part, table)})
+		}
+
+		assert.Equal(t, crc32.Checksum(data, table), compose.CRC32C(srcs))
+	})
+
+	t.Run("empty sources must not change the crc32c", func(t *testing.T) {
+		srcs := []compose.Source{
+			{Size: int64(len(data)), CRC32C: crc32.Checksum(data, table)},
+			{Offset: int64(len(data))},
+		}
+
+		assert.Equal(t, crc32.Checksum(data, table), compose.CRC32C(srcs))
+	})
+}
@@ -0,0 +1,11 @@
+package directio
+
+import (
+	"os"
+	"syscall"
+)
+
+func openDirect(path string) (*os.File, error) {
+	// file systems without direct I/O, e.g. tmpfs, fail with EINVAL.
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_DIRECT, 0)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package directio
+
+import "os"
+
+func openDirect(path string) (*os.File, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,128 @@
+// Package directio writes files bypassing the page cache, so that ingesting
+// large uploads doesn't evict the data other processes of the host cache.
+//
+// Direct I/O requires the buffers, offsets and lengths of the writes to be
+// aligned on BlockSize. The writers of this package buffer the data in an
+// aligned buffer, write the aligned blocks directly and the unaligned tail
+// through the page cache. They fall back to buffered writes when the
+// platform or the file system doesn't support direct I/O, or when they
+// start at an unaligned offset.
+package directio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	// BlockSize is the alignment of the direct writes.
+	BlockSize = 4096
+	// bufferSize is the size of the direct writes, except the last ones.
+	bufferSize = 1 << 20
+)
+
+// ErrUnsupported is returned when the platform doesn't support direct I/O.
+var ErrUnsupported = errors.New("direct I/O is not supported")
+
+// Writer appends to a file, bypassing the page cache when possible.
+type Writer struct {
+	f      *os.File
+	direct *os.File
+	offset int64
+	buf    []byte
+	n      int
+}
+
+// NewWriter returns a writer appending to f, opened with O_APPEND, whose
+// size is offset. The blocks written are written directly to the file when
+// possible; otherwise the writer writes to f. Close must be called for the
+// data to be written entirely, it doesn't close f.
+func NewWriter(f *os.File, offset int64) *Writer {
+	w := &Writer{f: f, offset: offset}
+	if offset%BlockSize != 0 {
+		return w
+	}
+	direct, err := openDirect(f.Name())
+	if err != nil {
+		return w
+	}
+	w.direct = direct
+	w.buf = alignedBuffer(bufferSize)
+	return w
+}
+
+// Direct reports whether the writer bypasses the page cache.
+func (w *Writer) Direct() bool {
+	return w.direct != nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.direct == nil {
+		return w.f.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		written += n
+		p = p[n:]
+		if w.n == len(w.buf) {
+			if err := w.flush(w.n); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the first n bytes of the buffer, a multiple of BlockSize,
+// directly at the end of the file.
+func (w *Writer) flush(n int) error {
+	if n == 0 {
+		return nil
+	}
+	m, err := w.direct.WriteAt(w.buf[:n], w.offset)
+	w.offset += int64(m)
+	if err == nil && m < n {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return err
+	}
+	w.n = copy(w.buf, w.buf[n:w.n])
+	return nil
+}
+
+// Close writes the aligned blocks left in the buffer directly, and the
+// unaligned tail through the page cache.
+func (w *Writer) Close() error {
+	if w.direct == nil {
+		return nil
+	}
+	defer w.direct.Close()
+	if err := w.flush(w.n - w.n%BlockSize); err != nil {
+		return err
+	}
+	if w.n > 0 {
+		// the direct writes extended the file, the tail is appended after
+		// them.
+		if _, err := w.f.Write(w.buf[:w.n]); err != nil {
+			return err
+		}
+		w.n = 0
+	}
+	return nil
+}
+
+// alignedBuffer returns a buffer of size bytes whose address is aligned on
+// BlockSize.
+func alignedBuffer(size int) []byte {
+	b := make([]byte, size+BlockSize)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) % BlockSize); rem != 0 {
+		shift = BlockSize - rem
+	}
+	return b[shift : shift+size : shift+size]
+}
@@ -0,0 +1,59 @@
+package directio_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/directio"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	data := make([]byte, 3<<20+123)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	write := func(t *testing.T, path string, chunk []byte) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		assert.NoError(t, err)
+		defer f.Close()
+		st, err := f.Stat()
+		assert.NoError(t, err)
+
+		w := directio.NewWriter(f, st.Size())
+		// written in small pieces, as io.Copy does.
+		for len(chunk) > 0 {
+			n := min(32<<10+7, len(chunk))
+			m, err := w.Write(chunk[:n])
+			assert.NoError(t, err)
+			assert.Equal(t, n, m)
+			chunk = chunk[n:]
+		}
+		assert.NoError(t, w.Close())
+	}
+
+	t.Run("chunks must be appended whatever their alignment", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "file")
+
+		write(t, path, data[:2<<20])
+		write(t, path, data[2<<20:3<<20+100])
+		write(t, path, data[3<<20+100:])
+
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, data, content)
+	})
+
+	t.Run("writer starting at an unaligned offset must write through the page cache", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "file")
+		assert.NoError(t, os.WriteFile(path, data[:10], 0644))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		assert.NoError(t, err)
+		defer f.Close()
+
+		w := directio.NewWriter(f, 10)
+
+		assert.False(t, w.Direct())
+	})
+}
@@ -0,0 +1,231 @@
+// Package diskusage periodically measures the file system of the upload
+// directory, so that operators are warned before it fills up.
+//
+// The used and free bytes of the file system, and the bytes of the uploads
+// which aren't complete yet, are exported as the uploader_disk_used_bytes,
+// uploader_disk_free_bytes and uploader_disk_partial_bytes gauges.
+package diskusage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+const instrumentationName = "github.com/imrenagi/go-http-upload/diskusage"
+
+// ErrInsufficientStorage is returned when the used ratio of the file system
+// is past the threshold and the creation of uploads is stopped.
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// Usage is a measure of the file system of a directory.
+type Usage struct {
+	Total uint64
+	Used  uint64
+	Free  uint64
+	// Partial is the number of bytes written by the uploads which aren't
+	// complete yet.
+	Partial uint64
+}
+
+// UsedRatio returns the ratio of the file system in use, between 0 and 1.
+func (u Usage) UsedRatio() float64 {
+	if u.Total == 0 {
+		return 0
+	}
+	return float64(u.Used) / float64(u.Total)
+}
+
+type Options struct {
+	Interval      time.Duration
+	Threshold     float64
+	RejectCreates bool
+	Partial       func() uint64
+	MeterProvider metric.MeterProvider
+	Logger        *zerolog.Logger
+}
+
+type Option func(*Options)
+
+// WithInterval measures the directory every d, every minute by default.
+func WithInterval(d time.Duration) Option {
+	return func(o *Options) {
+		if d > 0 {
+			o.Interval = d
+		}
+	}
+}
+
+// WithThreshold logs a warning every time the used ratio of the file system
+// is measured past ratio. When reject is set, the monitor reports that the
+// creation of uploads must be refused until the ratio falls back below it.
+// A zero ratio disables the threshold.
+func WithThreshold(ratio float64, reject bool) Option {
+	return func(o *Options) {
+		o.Threshold = ratio
+		o.RejectCreates = reject
+	}
+}
+
+// WithPartial measures the bytes of the uploads not complete yet with fn.
+func WithPartial(fn func() uint64) Option {
+	return func(o *Options) {
+		o.Partial = fn
+	}
+}
+
+// WithMeterProvider creates the gauges with mp instead of a no-op meter
+// provider.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(o *Options) {
+		if mp != nil {
+			o.MeterProvider = mp
+		}
+	}
+}
+
+func WithLogger(l *zerolog.Logger) Option {
+	return func(o *Options) {
+		if l != nil {
+			o.Logger = l
+		}
+	}
+}
+
+// Monitor measures the usage of a directory until its Run context is done.
+type Monitor struct {
+	dir           string
+	interval      time.Duration
+	threshold     float64
+	rejectCreates bool
+	partial       func() uint64
+	log           *zerolog.Logger
+
+	mu    sync.RWMutex
+	usage Usage
+}
+
+// NewMonitor returns a monitor of the file system of dir. Its gauges are
+// registered right away, they report zero until the first measure.
+func NewMonitor(dir string, opts ...Option) (*Monitor, error) {
+	o := Options{
+		Interval:      time.Minute,
+		MeterProvider: noop.NewMeterProvider(),
+		Logger:        &log.Logger,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	m := &Monitor{
+		dir:           dir,
+		interval:      o.Interval,
+		threshold:     o.Threshold,
+		rejectCreates: o.RejectCreates,
+		partial:       o.Partial,
+		log:           o.Logger,
+	}
+	if err := m.register(o.MeterProvider.Meter(instrumentationName)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Monitor) register(meter metric.Meter) error {
+	used, err := meter.Int64ObservableGauge("uploader_disk_used_bytes",
+		metric.WithDescription("Number of bytes used on the file system of the upload directory."))
+	if err != nil {
+		return err
+	}
+	free, err := meter.Int64ObservableGauge("uploader_disk_free_bytes",
+		metric.WithDescription("Number of bytes available on the file system of the upload directory."))
+	if err != nil {
+		return err
+	}
+	partial, err := meter.Int64ObservableGauge("uploader_disk_partial_bytes",
+		metric.WithDescription("Number of bytes written by the uploads not complete yet."))
+	if err != nil {
+		return err
+	}
+	attrs := metric.WithAttributes(attribute.String("dir", m.dir))
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		u := m.Usage()
+		o.ObserveInt64(used, int64(u.Used), attrs)
+		o.ObserveInt64(free, int64(u.Free), attrs)
+		o.ObserveInt64(partial, int64(u.Partial), attrs)
+		return nil
+	}, used, free, partial)
+	return err
+}
+
+// Run measures the directory right away, then every interval until ctx is
+// done.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		if err := m.Measure(); err != nil {
+			m.log.Error().Err(err).Str("dir", m.dir).Msg("unable to measure the disk usage")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Measure measures the directory once, and logs a warning when its used
+// ratio is past the threshold.
+func (m *Monitor) Measure() error {
+	u, err := statfs(m.dir)
+	if err != nil {
+		return err
+	}
+	if m.partial != nil {
+		u.Partial = m.partial()
+	}
+	m.mu.Lock()
+	m.usage = u
+	m.mu.Unlock()
+
+	if m.exceeded(u) {
+		m.log.Warn().
+			Str("dir", m.dir).
+			Uint64("used_bytes", u.Used).
+			Uint64("free_bytes", u.Free).
+			Uint64("partial_bytes", u.Partial).
+			Float64("used_ratio", u.UsedRatio()).
+			Float64("threshold", m.threshold).
+			Bool("rejecting_creates", m.rejectCreates).
+			Msg("disk usage is past the threshold")
+	}
+	return nil
+}
+
+// Usage returns the last measure of the directory.
+func (m *Monitor) Usage() Usage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.usage
+}
+
+// CheckCreate returns ErrInsufficientStorage when the creation of uploads
+// must be refused, because the last measure is past the threshold and the
+// monitor rejects creates.
+func (m *Monitor) CheckCreate() error {
+	if m == nil || !m.rejectCreates || !m.exceeded(m.Usage()) {
+		return nil
+	}
+	return ErrInsufficientStorage
+}
+
+func (m *Monitor) exceeded(u Usage) bool {
+	return m.threshold > 0 && u.UsedRatio() >= m.threshold
+}
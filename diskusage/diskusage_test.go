@@ -0,0 +1,70 @@
+package diskusage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/diskusage"
+	"github.com/stretchr/testify/assert"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestMonitor(t *testing.T) {
+	t.Run("measure must report the usage of the file system and the partial uploads", func(t *testing.T) {
+		reader := sdkmetric.NewManualReader()
+		mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+		m, err := diskusage.NewMonitor(t.TempDir(),
+			diskusage.WithPartial(func() uint64 { return 42 }),
+			diskusage.WithMeterProvider(mp))
+		assert.NoError(t, err)
+
+		assert.NoError(t, m.Measure())
+
+		u := m.Usage()
+		assert.NotZero(t, u.Total)
+		assert.Equal(t, u.Total, u.Used+u.Free)
+		assert.Equal(t, uint64(42), u.Partial)
+
+		var rm metricdata.ResourceMetrics
+		assert.NoError(t, reader.Collect(context.Background(), &rm))
+		gauges := map[string]int64{}
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				for _, dp := range metric.Data.(metricdata.Gauge[int64]).DataPoints {
+					gauges[metric.Name] = dp.Value
+				}
+			}
+		}
+		assert.Equal(t, map[string]int64{
+			"uploader_disk_used_bytes":    int64(u.Used),
+			"uploader_disk_free_bytes":    int64(u.Free),
+			"uploader_disk_partial_bytes": 42,
+		}, gauges)
+	})
+
+	t.Run("measure of a missing directory must fail", func(t *testing.T) {
+		m, err := diskusage.NewMonitor(t.TempDir() + "/missing")
+		assert.NoError(t, err)
+
+		assert.Error(t, m.Measure())
+	})
+
+	t.Run("creates must be rejected past the threshold only when the monitor rejects them", func(t *testing.T) {
+		rejecting, err := diskusage.NewMonitor(t.TempDir(), diskusage.WithThreshold(1e-12, true))
+		assert.NoError(t, err)
+		assert.NoError(t, rejecting.CheckCreate(), "nothing was measured yet")
+		assert.NoError(t, rejecting.Measure())
+		assert.ErrorIs(t, rejecting.CheckCreate(), diskusage.ErrInsufficientStorage)
+
+		warning, err := diskusage.NewMonitor(t.TempDir(), diskusage.WithThreshold(1e-12, false))
+		assert.NoError(t, err)
+		assert.NoError(t, warning.Measure())
+		assert.NoError(t, warning.CheckCreate())
+
+		below, err := diskusage.NewMonitor(t.TempDir(), diskusage.WithThreshold(1, true))
+		assert.NoError(t, err)
+		assert.NoError(t, below.Measure())
+		assert.NoError(t, below.CheckCreate())
+	})
+}
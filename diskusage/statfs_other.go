@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package diskusage
+
+import "errors"
+
+func statfs(dir string) (Usage, error) {
+	return Usage{}, errors.New("disk usage isn't supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package diskusage
+
+import "syscall"
+
+func statfs(dir string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return Usage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	// the blocks reserved to the super user are neither used nor available
+	// to the server.
+	free := uint64(st.Bavail) * bsize
+	used := (uint64(st.Blocks) - uint64(st.Bfree)) * bsize
+	return Usage{Total: used + free, Used: used, Free: free}, nil
+}
@@ -0,0 +1,48 @@
+// Package finalize finalizes the completed uploads in the background, e.g.
+// computing the checksums of their whole content, so that the last PATCH of
+// a large upload is answered as soon as its data is stored.
+//
+// The controllers record the status of the finalization of every upload,
+// reported to the clients by HEAD and metadata requests.
+package finalize
+
+import (
+	"context"
+	"errors"
+
+	"github.com/imrenagi/go-http-upload/workerpool"
+)
+
+// ErrQueueFull is returned by Enqueue when the worker is saturated. The
+// upload should then be finalized on the request path.
+var ErrQueueFull = errors.New("finalization queue is full")
+
+// Status of the finalization of an upload.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// Job finalizes the upload ID.
+type Job struct {
+	ID       string
+	Finalize func(ctx context.Context)
+}
+
+// Worker runs the finalization jobs queued by the upload handlers with a
+// bounded concurrency.
+type Worker struct {
+	*workerpool.Pool[Job]
+}
+
+func NewWorker(concurrency, queueSize int) *Worker {
+	return &Worker{
+		Pool: workerpool.New(concurrency, queueSize, ErrQueueFull, func(ctx context.Context, job Job) {
+			job.Finalize(ctx)
+		}),
+	}
+}
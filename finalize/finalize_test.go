@@ -0,0 +1,45 @@
+package finalize_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/finalize"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorker(t *testing.T) {
+	t.Run("queued jobs must be run", func(t *testing.T) {
+		w := finalize.NewWorker(2, 10)
+		var mu sync.Mutex
+		var done []string
+		for _, id := range []string{"a", "b", "c"} {
+			assert.NoError(t, w.Enqueue(finalize.Job{ID: id, Finalize: func(context.Context) {
+				mu.Lock()
+				defer mu.Unlock()
+				done = append(done, id)
+			}}))
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go w.Run(ctx)
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(done) == 3
+		}, time.Second, 10*time.Millisecond)
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, done)
+	})
+
+	t.Run("jobs queued past the queue size must be rejected", func(t *testing.T) {
+		w := finalize.NewWorker(1, 1)
+		job := finalize.Job{ID: "a", Finalize: func(context.Context) {}}
+
+		assert.NoError(t, w.Enqueue(job))
+		assert.ErrorIs(t, w.Enqueue(job), finalize.ErrQueueFull)
+	})
+}
@@ -0,0 +1,83 @@
+package hooks
+
+import (
+	"context"
+	_ "embed"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventType names a step of the lifecycle of an upload.
+type EventType string
+
+const (
+	EventCreated    EventType = "upload.created"
+	EventProgressed EventType = "upload.progressed"
+	EventCompleted  EventType = "upload.completed"
+	EventTerminated EventType = "upload.terminated"
+	EventExpired    EventType = "upload.expired"
+)
+
+// JSONSchema and AvroSchema describe the encoding of Event published by the
+// event sinks.
+var (
+	//go:embed schema/event.schema.json
+	JSONSchema string
+	//go:embed schema/event.avsc
+	AvroSchema string
+)
+
+// Event is the notification published to external systems for every step
+// of the lifecycle of an upload. Its JSON encoding is the payload delivered
+// by the event sinks.
+type Event struct {
+	// ID is unique to every event, so that consumers can discard the
+	// duplicates caused by retried deliveries.
+	ID     string    `json:"id"`
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	Upload Upload    `json:"upload"`
+}
+
+// NewEvent returns an event of the given type about u, happening now.
+func NewEvent(t EventType, u Upload) Event {
+	return Event{
+		ID:     uuid.New().String(),
+		Type:   t,
+		Time:   time.Now().UTC(),
+		Upload: u,
+	}
+}
+
+// Events returns hooks turning every step of the lifecycle of the uploads
+// into an event handed to publish. publish is called while the request is
+// handled, so it should only queue the event.
+func Events(publish func(ctx context.Context, e Event)) Hooks {
+	return events{publish: publish}
+}
+
+type events struct {
+	Nop
+	publish func(ctx context.Context, e Event)
+}
+
+func (h events) PostCreate(ctx context.Context, u Upload) {
+	h.publish(ctx, NewEvent(EventCreated, u))
+}
+
+func (h events) PostReceiveChunk(ctx context.Context, u Upload) {
+	h.publish(ctx, NewEvent(EventProgressed, u))
+}
+
+func (h events) PostFinish(ctx context.Context, u Upload) {
+	h.publish(ctx, NewEvent(EventCompleted, u))
+}
+
+func (h events) PostTerminate(ctx context.Context, u Upload) {
+	h.publish(ctx, NewEvent(EventTerminated, u))
+}
+
+func (h events) PostExpire(ctx context.Context, u Upload) {
+	h.publish(ctx, NewEvent(EventExpired, u))
+}
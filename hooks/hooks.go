@@ -0,0 +1,161 @@
+// Package hooks lets embedders of the upload controllers run their own code
+// at every step of the lifecycle of an upload, e.g. to validate metadata,
+// enforce business rules or start processing completed uploads, without
+// modifying the handlers.
+package hooks
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Upload describes an upload to the hooks, independently of the storage
+// backend holding it.
+type Upload struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	// Size is the declared length of the upload, unknown while
+	// IsDeferLength is set.
+	Size          uint64 `json:"size"`
+	IsDeferLength bool   `json:"is_defer_length,omitempty"`
+	// Offset is the number of bytes received so far.
+	Offset    uint64            `json:"offset"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	// Completion is set once the upload is complete.
+	Completion *Completion `json:"completion,omitempty"`
+}
+
+// Completion records the outcome of a completed upload, for consumers
+// which need more than its id to process it.
+type Completion struct {
+	// Size is the final length of the upload.
+	Size uint64 `json:"size"`
+	// Checksums are the base64 encoded digests of the stored data, keyed by
+	// algorithm, computed by the server once every byte was received.
+	// Backends which can't read the data back cheaply leave it empty.
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// Metadata is the decoded Upload-Metadata of the upload.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// StorageURI locates the data in the storage backend: a path on disk
+	// or a gs:// URI.
+	StorageURI string `json:"storage_uri"`
+	// StartedAt is the time the upload was created, and Duration the time
+	// it took to complete it.
+	StartedAt   time.Time     `json:"started_at"`
+	CompletedAt time.Time     `json:"completed_at"`
+	Duration    time.Duration `json:"duration_ns"`
+}
+
+// IsComplete reports whether every byte of the upload was received.
+func (u Upload) IsComplete() bool {
+	return !u.IsDeferLength && u.Offset == u.Size
+}
+
+// Hooks are called synchronously by the controllers, while the request is
+// being handled, so they should hand slow work off to a background worker.
+// Only PreCreate can affect the request: the other hooks run once the
+// change is stored and can't undo it.
+type Hooks interface {
+	// PreCreate is called before an upload is created. Returning an error
+	// rejects the creation, with the status of a RejectError or 400.
+	PreCreate(ctx context.Context, u Upload) error
+	// PostCreate is called once an upload was created.
+	PostCreate(ctx context.Context, u Upload)
+	// PostReceiveChunk is called every time data was appended to an upload.
+	PostReceiveChunk(ctx context.Context, u Upload)
+	// PostFinish is called once every byte of an upload was received.
+	PostFinish(ctx context.Context, u Upload)
+	// PostTerminate is called once an upload was deleted.
+	PostTerminate(ctx context.Context, u Upload)
+	// PostExpire is called when a request is refused because the upload
+	// expired. Expired uploads aren't swept, so it is called again every
+	// time the client retries.
+	PostExpire(ctx context.Context, u Upload)
+}
+
+// Nop implements every hook as a no-op. Embed it to implement only some of
+// them.
+type Nop struct{}
+
+func (Nop) PreCreate(ctx context.Context, u Upload) error  { return nil }
+func (Nop) PostCreate(ctx context.Context, u Upload)       {}
+func (Nop) PostReceiveChunk(ctx context.Context, u Upload) {}
+func (Nop) PostFinish(ctx context.Context, u Upload)       {}
+func (Nop) PostTerminate(ctx context.Context, u Upload)    {}
+func (Nop) PostExpire(ctx context.Context, u Upload)       {}
+
+// RejectError is returned by PreCreate to reject an upload with a specific
+// status code.
+type RejectError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RejectError) Error() string {
+	return e.Message
+}
+
+// Reject returns a RejectError.
+func Reject(statusCode int, message string) error {
+	return &RejectError{StatusCode: statusCode, Message: message}
+}
+
+// StatusCode returns the status a request rejected by err is answered with.
+func StatusCode(err error) int {
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		return rejectErr.StatusCode
+	}
+	return http.StatusBadRequest
+}
+
+// Multi returns hooks calling every hs in order. PreCreate stops at the
+// first error.
+func Multi(hs ...Hooks) Hooks {
+	return multi(hs)
+}
+
+type multi []Hooks
+
+func (m multi) PreCreate(ctx context.Context, u Upload) error {
+	for _, h := range m {
+		if err := h.PreCreate(ctx, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multi) PostCreate(ctx context.Context, u Upload) {
+	for _, h := range m {
+		h.PostCreate(ctx, u)
+	}
+}
+
+func (m multi) PostReceiveChunk(ctx context.Context, u Upload) {
+	for _, h := range m {
+		h.PostReceiveChunk(ctx, u)
+	}
+}
+
+func (m multi) PostFinish(ctx context.Context, u Upload) {
+	for _, h := range m {
+		h.PostFinish(ctx, u)
+	}
+}
+
+func (m multi) PostTerminate(ctx context.Context, u Upload) {
+	for _, h := range m {
+		h.PostTerminate(ctx, u)
+	}
+}
+
+func (m multi) PostExpire(ctx context.Context, u Upload) {
+	for _, h := range m {
+		h.PostExpire(ctx, u)
+	}
+}
@@ -0,0 +1,282 @@
+package hooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents(t *testing.T) {
+	var published []hooks.Event
+	h := hooks.Events(func(ctx context.Context, e hooks.Event) {
+		published = append(published, e)
+	})
+	u := hooks.Upload{ID: "a", Size: 5}
+
+	assert.NoError(t, h.PreCreate(context.Background(), u))
+	h.PostCreate(context.Background(), u)
+	h.PostReceiveChunk(context.Background(), u)
+	h.PostFinish(context.Background(), u)
+	h.PostExpire(context.Background(), u)
+	h.PostTerminate(context.Background(), u)
+
+	var types []hooks.EventType
+	for _, e := range published {
+		assert.NotEmpty(t, e.ID)
+		assert.Equal(t, u, e.Upload)
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []hooks.EventType{
+		hooks.EventCreated,
+		hooks.EventProgressed,
+		hooks.EventCompleted,
+		hooks.EventExpired,
+		hooks.EventTerminated,
+	}, types)
+}
+
+func TestStatusCode(t *testing.T) {
+	assert.Equal(t, http.StatusForbidden, hooks.StatusCode(hooks.Reject(http.StatusForbidden, "forbidden")))
+	assert.Equal(t, http.StatusBadRequest, hooks.StatusCode(assert.AnError))
+}
+
+func TestSchemas(t *testing.T) {
+	e := hooks.NewEvent(hooks.EventCompleted, hooks.Upload{
+		ID:            "a",
+		Tenant:        "acme",
+		Owner:         "alice",
+		Size:          5,
+		IsDeferLength: true,
+		Offset:        5,
+		Metadata:      map[string]string{"filename": "a.txt"},
+		ExpiresAt:     time.Now(),
+		Completion: &hooks.Completion{
+			Size:        5,
+			Checksums:   map[string]string{"sha256": "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="},
+			Metadata:    map[string]string{"filename": "a.txt"},
+			StorageURI:  "file:///tmp/a",
+			StartedAt:   time.Now(),
+			CompletedAt: time.Now(),
+			Duration:    time.Second,
+		},
+	})
+	b, err := json.Marshal(e)
+	assert.NoError(t, err)
+	var encoded map[string]any
+	assert.NoError(t, json.Unmarshal(b, &encoded))
+
+	keys := func(m map[string]any) []string {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	t.Run("JSON schema must describe every field of the event", func(t *testing.T) {
+		var schema struct {
+			Properties map[string]any `json:"properties"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(hooks.JSONSchema), &schema))
+		assert.Equal(t, keys(encoded), keys(schema.Properties))
+
+		upload := schema.Properties["upload"].(map[string]any)["properties"].(map[string]any)
+		assert.Equal(t, keys(encoded["upload"].(map[string]any)), keys(upload))
+
+		completion := upload["completion"].(map[string]any)["properties"].(map[string]any)
+		assert.Equal(t, keys(encoded["upload"].(map[string]any)["completion"].(map[string]any)), keys(completion))
+	})
+
+	t.Run("Avro schema must describe every field of the event", func(t *testing.T) {
+		type field struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		}
+		var schema struct {
+			Fields []field `json:"fields"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(hooks.AvroSchema), &schema))
+		names := func(fields []field) map[string]any {
+			m := make(map[string]any)
+			for _, f := range fields {
+				m[f.Name] = f
+			}
+			return m
+		}
+		assert.Equal(t, keys(encoded), keys(names(schema.Fields)))
+
+		var upload struct {
+			Fields []field `json:"fields"`
+		}
+		for _, f := range schema.Fields {
+			if f.Name == "upload" {
+				assert.NoError(t, json.Unmarshal(f.Type, &upload))
+			}
+		}
+		assert.Equal(t, keys(encoded["upload"].(map[string]any)), keys(names(upload.Fields)))
+
+		var completion []json.RawMessage
+		var record struct {
+			Fields []field `json:"fields"`
+		}
+		for _, f := range upload.Fields {
+			if f.Name == "completion" {
+				assert.NoError(t, json.Unmarshal(f.Type, &completion))
+				assert.NoError(t, json.Unmarshal(completion[1], &record))
+			}
+		}
+		assert.Equal(t, keys(encoded["upload"].(map[string]any)["completion"].(map[string]any)), keys(names(record.Fields)))
+	})
+}
+
+func TestMulti(t *testing.T) {
+	var calls []string
+	record := func(name string) hooks.Hooks {
+		return hooks.Events(func(ctx context.Context, e hooks.Event) {
+			calls = append(calls, name+" "+string(e.Type))
+		})
+	}
+	h := hooks.Multi(record("a"), record("b"))
+
+	h.PostFinish(context.Background(), hooks.Upload{ID: "a"})
+
+	assert.Equal(t, []string{"a upload.completed", "b upload.completed"}, calls)
+}
+
+type recordingSink struct {
+	events []hooks.Event
+}
+
+func (s *recordingSink) Publish(ctx context.Context, e hooks.Event) {
+	s.events = append(s.events, e)
+}
+
+func TestSinkHooks(t *testing.T) {
+	t.Run("event must be published to every sink", func(t *testing.T) {
+		a, b := &recordingSink{}, &recordingSink{}
+		h := hooks.SinkHooks(a, b)
+
+		h.PostFinish(context.Background(), hooks.Upload{ID: "a"})
+
+		assert.Len(t, a.events, 1)
+		assert.Len(t, b.events, 1)
+		assert.Equal(t, a.events[0].ID, b.events[0].ID)
+	})
+
+	t.Run("events of other types must not be published", func(t *testing.T) {
+		s := &recordingSink{}
+		h := hooks.SinkHooks(hooks.FilterEvents(s, hooks.EventCompleted))
+
+		h.PostReceiveChunk(context.Background(), hooks.Upload{ID: "a"})
+		h.PostFinish(context.Background(), hooks.Upload{ID: "a"})
+
+		assert.Len(t, s.events, 1)
+		assert.Equal(t, hooks.EventCompleted, s.events[0].Type)
+	})
+
+	t.Run("every event must be published without types", func(t *testing.T) {
+		s := &recordingSink{}
+		h := hooks.SinkHooks(hooks.FilterEvents(s))
+
+		h.PostReceiveChunk(context.Background(), hooks.Upload{ID: "a"})
+		h.PostFinish(context.Background(), hooks.Upload{ID: "a"})
+
+		assert.Len(t, s.events, 2)
+	})
+}
+
+func TestAsyncPublisher(t *testing.T) {
+	t.Run("event must be sent in the background and outlive the request", func(t *testing.T) {
+		sent := make(chan error, 1)
+		p := hooks.NewAsyncPublisher("test", func(ctx context.Context, e hooks.Event) error {
+			sent <- ctx.Err()
+			return nil
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+
+		p.Publish(ctx, hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: "a"}))
+		cancel()
+		p.Close()
+
+		assert.NoError(t, <-sent)
+	})
+
+	t.Run("send must be bounded by the timeout", func(t *testing.T) {
+		p := hooks.NewAsyncPublisher("test", func(ctx context.Context, e hooks.Event) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, hooks.WithTimeout(10*time.Millisecond))
+
+		p.Publish(context.Background(), hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: "a"}))
+		done := make(chan struct{})
+		go func() {
+			p.Close()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the send was not cancelled by the timeout")
+		}
+	})
+
+	t.Run("events of an upload must be sent in order", func(t *testing.T) {
+		var mu sync.Mutex
+		sent := map[string][]hooks.EventType{}
+		p := hooks.NewAsyncPublisher("test", func(ctx context.Context, e hooks.Event) error {
+			if e.Type == hooks.EventCreated {
+				// the later events must wait for the slow first one.
+				time.Sleep(20 * time.Millisecond)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			sent[e.Upload.ID] = append(sent[e.Upload.ID], e.Type)
+			return nil
+		})
+		types := []hooks.EventType{hooks.EventCreated, hooks.EventProgressed, hooks.EventCompleted}
+
+		for _, id := range []string{"a", "b"} {
+			for _, typ := range types {
+				p.Publish(context.Background(), hooks.NewEvent(typ, hooks.Upload{ID: id}))
+			}
+		}
+		p.Close()
+
+		assert.Equal(t, types, sent["a"])
+		assert.Equal(t, types, sent["b"])
+	})
+
+	t.Run("events must be dropped rather than block when the queue is full", func(t *testing.T) {
+		entered := make(chan struct{}, 3)
+		release := make(chan struct{})
+		var mu sync.Mutex
+		var sent []string
+		p := hooks.NewAsyncPublisher("test", func(ctx context.Context, e hooks.Event) error {
+			entered <- struct{}{}
+			<-release
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, e.Upload.ID)
+			return nil
+		}, hooks.WithConcurrency(1), hooks.WithQueueSize(1))
+
+		p.Publish(context.Background(), hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: "a"}))
+		<-entered
+		for _, id := range []string{"b", "c"} {
+			p.Publish(context.Background(), hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: id}))
+		}
+		close(release)
+		p.Close()
+
+		assert.Equal(t, []string{"a", "b"}, sent)
+	})
+}
@@ -0,0 +1,221 @@
+// Package script runs executables of a directory as hooks, like the file
+// hooks of tusd, for operators gluing the uploads to other systems with
+// shell scripts.
+//
+// The executable named after a hook (pre-create, post-create, post-receive,
+// post-finish, post-terminate or post-expire) is run every time the hook is
+// called; missing executables are skipped, so that only the hooks of
+// interest need a script. The upload is written to the standard input of the
+// script as JSON, {"hook": "post-finish", "upload": {...}}, and its main
+// fields are set in the UPLOAD_ID, UPLOAD_TENANT, UPLOAD_OWNER, UPLOAD_SIZE,
+// UPLOAD_OFFSET and UPLOAD_HOOK environment variables.
+//
+// pre-create runs while the creation request waits: a non-zero exit code
+// rejects the upload with a 403, and the standard error of the script as
+// message. The other hooks run in the background and can't affect the
+// requests: they are queued and run by Run, and dropped when the queue is
+// full.
+package script
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	PreCreate     = "pre-create"
+	PostCreate    = "post-create"
+	PostReceive   = "post-receive"
+	PostFinish    = "post-finish"
+	PostTerminate = "post-terminate"
+	PostExpire    = "post-expire"
+)
+
+type Options struct {
+	Timeout     time.Duration
+	Concurrency int
+	QueueSize   int
+}
+
+type Option func(*Options)
+
+// WithTimeout kills the scripts running longer than d. A pre-create script
+// which is killed rejects the upload.
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = d
+	}
+}
+
+// WithConcurrency runs up to n background scripts at the same time.
+func WithConcurrency(n int) Option {
+	return func(o *Options) {
+		o.Concurrency = n
+	}
+}
+
+// WithQueueSize queues up to n background scripts waiting to run.
+func WithQueueSize(n int) Option {
+	return func(o *Options) {
+		o.QueueSize = n
+	}
+}
+
+// input is written to the standard input of the scripts.
+type input struct {
+	Hook   string       `json:"hook"`
+	Upload hooks.Upload `json:"upload"`
+}
+
+// job is a background script waiting to run.
+type job struct {
+	ctx    context.Context
+	hook   string
+	upload hooks.Upload
+}
+
+// Hooks runs the scripts of a directory.
+type Hooks struct {
+	dir         string
+	timeout     time.Duration
+	concurrency int
+	queue       chan job
+}
+
+func New(dir string, opts ...Option) *Hooks {
+	o := Options{
+		Timeout:     30 * time.Second,
+		Concurrency: 4,
+		QueueSize:   1000,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Hooks{
+		dir:         dir,
+		timeout:     o.Timeout,
+		concurrency: max(1, o.Concurrency),
+		queue:       make(chan job, o.QueueSize),
+	}
+}
+
+// Run runs the queued background scripts until ctx is canceled.
+func (h *Hooks) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < h.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-h.queue:
+					if stderr, err := h.run(j.ctx, j.hook, j.upload); err != nil {
+						log.Error().Err(err).Str("hook", j.hook).Str("upload_id", j.upload.ID).Str("stderr", stderr).Msg("hook script failed")
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (h *Hooks) PreCreate(ctx context.Context, u hooks.Upload) error {
+	stderr, err := h.run(ctx, PreCreate, u)
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		log.Error().Err(err).Str("hook", PreCreate).Msg("unable to run the hook script")
+		return hooks.Reject(http.StatusInternalServerError, "unable to run the pre-create hook")
+	}
+	message := strings.TrimSpace(stderr)
+	if message == "" {
+		message = "upload rejected by the pre-create hook"
+	}
+	return hooks.Reject(http.StatusForbidden, message)
+}
+
+func (h *Hooks) PostCreate(ctx context.Context, u hooks.Upload) {
+	h.runAsync(ctx, PostCreate, u)
+}
+
+func (h *Hooks) PostReceiveChunk(ctx context.Context, u hooks.Upload) {
+	h.runAsync(ctx, PostReceive, u)
+}
+
+func (h *Hooks) PostFinish(ctx context.Context, u hooks.Upload) {
+	h.runAsync(ctx, PostFinish, u)
+}
+
+func (h *Hooks) PostTerminate(ctx context.Context, u hooks.Upload) {
+	h.runAsync(ctx, PostTerminate, u)
+}
+
+func (h *Hooks) PostExpire(ctx context.Context, u hooks.Upload) {
+	h.runAsync(ctx, PostExpire, u)
+}
+
+// runAsync queues the script of hook without blocking.
+func (h *Hooks) runAsync(ctx context.Context, hook string, u hooks.Upload) {
+	// the script must outlive the request.
+	j := job{ctx: context.WithoutCancel(ctx), hook: hook, upload: u}
+	select {
+	case h.queue <- j:
+	default:
+		log.Error().Str("hook", hook).Str("upload_id", u.ID).Msg("hook script queue is full, dropping the hook")
+	}
+}
+
+// run runs the script of hook, if there is one, and returns its standard
+// error.
+func (h *Hooks) run(ctx context.Context, hook string, u hooks.Upload) (string, error) {
+	path := filepath.Join(h.dir, hook)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	stdin, err := json.Marshal(input{Hook: hook, Upload: u})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	// children of a killed script may keep its output open.
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		"UPLOAD_HOOK="+hook,
+		"UPLOAD_ID="+u.ID,
+		"UPLOAD_TENANT="+u.Tenant,
+		"UPLOAD_OWNER="+u.Owner,
+		"UPLOAD_SIZE="+strconv.FormatUint(u.Size, 10),
+		"UPLOAD_OFFSET="+strconv.FormatUint(u.Offset, 10),
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stderr.String(), fmt.Errorf("%s: %w", hook, err)
+	}
+	log.Debug().Str("hook", hook).Str("upload_id", u.ID).Str("stdout", stdout.String()).Msg("hook script succeeded")
+	return stderr.String(), nil
+}
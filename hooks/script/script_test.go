@@ -0,0 +1,109 @@
+package script_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/hooks/script"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeScript(t *testing.T, dir, name, content string) {
+	t.Helper()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+content), 0755))
+}
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook scripts are shell scripts")
+	}
+	upload := hooks.Upload{ID: "a", Tenant: "acme", Size: 5, Offset: 5}
+
+	t.Run("upload must be created without a pre-create script", func(t *testing.T) {
+		h := script.New(t.TempDir())
+
+		assert.NoError(t, h.PreCreate(context.Background(), upload))
+	})
+
+	t.Run("upload must be created when pre-create exits with 0", func(t *testing.T) {
+		dir := t.TempDir()
+		writeScript(t, dir, script.PreCreate, "exit 0\n")
+		h := script.New(dir)
+
+		assert.NoError(t, h.PreCreate(context.Background(), upload))
+	})
+
+	t.Run("upload must be rejected when pre-create exits with non-zero", func(t *testing.T) {
+		dir := t.TempDir()
+		writeScript(t, dir, script.PreCreate, "echo \"tenant $UPLOAD_TENANT is over quota\" >&2\nexit 1\n")
+		h := script.New(dir)
+
+		err := h.PreCreate(context.Background(), upload)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, hooks.StatusCode(err))
+		assert.Equal(t, "tenant acme is over quota", err.Error())
+	})
+
+	t.Run("upload must be rejected when pre-create times out", func(t *testing.T) {
+		dir := t.TempDir()
+		writeScript(t, dir, script.PreCreate, "sleep 5\n")
+		h := script.New(dir, script.WithTimeout(10*time.Millisecond))
+
+		assert.Error(t, h.PreCreate(context.Background(), upload))
+	})
+
+	t.Run("post-finish must receive the upload on its standard input", func(t *testing.T) {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out.json")
+		writeScript(t, dir, script.PostFinish, "cat > "+out+".tmp && mv "+out+".tmp "+out+"\n")
+		h := script.New(dir)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go h.Run(ctx)
+
+		h.PostFinish(context.Background(), upload)
+
+		var b []byte
+		assert.Eventually(t, func() bool {
+			var err error
+			b, err = os.ReadFile(out)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		var in struct {
+			Hook   string       `json:"hook"`
+			Upload hooks.Upload `json:"upload"`
+		}
+		assert.NoError(t, json.Unmarshal(b, &in))
+		assert.Equal(t, script.PostFinish, in.Hook)
+		assert.Equal(t, upload.ID, in.Upload.ID)
+	})
+
+	t.Run("post hooks must be dropped rather than block when the queue is full", func(t *testing.T) {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out")
+		writeScript(t, dir, script.PostFinish, "echo $UPLOAD_ID >> "+out+"\n")
+		h := script.New(dir, script.WithQueueSize(1))
+
+		for range 3 {
+			h.PostFinish(context.Background(), upload)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go h.Run(ctx)
+
+		assert.Eventually(t, func() bool {
+			b, _ := os.ReadFile(out)
+			return string(b) == "a\n"
+		}, 5*time.Second, 10*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		b, _ := os.ReadFile(out)
+		assert.Equal(t, "a\n", string(b))
+	})
+}
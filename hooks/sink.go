@@ -0,0 +1,186 @@
+package hooks
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EventSink publishes upload lifecycle events to a notification transport,
+// e.g. webhooks, a Kafka topic or the messaging service of the cloud the
+// uploads are stored in. Publish must not block the upload requests: sinks
+// queue or publish asynchronously and log the events they fail to deliver.
+type EventSink interface {
+	Publish(ctx context.Context, e Event)
+}
+
+// SinkHooks returns the hooks publishing the events of the controllers to
+// every sink.
+func SinkHooks(sinks ...EventSink) Hooks {
+	return Events(func(ctx context.Context, e Event) {
+		for _, s := range sinks {
+			s.Publish(ctx, e)
+		}
+	})
+}
+
+// FilterEvents only publishes events of the given types to s. Every event
+// is published when no type is given.
+func FilterEvents(s EventSink, types ...EventType) EventSink {
+	if len(types) == 0 {
+		return s
+	}
+	return filter{sink: s, types: types}
+}
+
+type filter struct {
+	sink  EventSink
+	types []EventType
+}
+
+func (f filter) Publish(ctx context.Context, e Event) {
+	if slices.Contains(f.types, e.Type) {
+		f.sink.Publish(ctx, e)
+	}
+}
+
+type AsyncOptions struct {
+	Timeout     time.Duration
+	Concurrency int
+	QueueSize   int
+}
+
+type AsyncOption func(*AsyncOptions)
+
+// WithTimeout bounds the time spent sending an event, retries included.
+func WithTimeout(d time.Duration) AsyncOption {
+	return func(o *AsyncOptions) {
+		o.Timeout = d
+	}
+}
+
+// WithConcurrency sends up to n events at the same time.
+func WithConcurrency(n int) AsyncOption {
+	return func(o *AsyncOptions) {
+		o.Concurrency = n
+	}
+}
+
+// WithQueueSize queues up to n events waiting to be sent.
+func WithQueueSize(n int) AsyncOption {
+	return func(o *AsyncOptions) {
+		o.QueueSize = n
+	}
+}
+
+// AsyncPublisher is the EventSink of the message brokers: it sends the
+// events in the background so that publishing never delays the upload
+// requests, and logs the events it fails to send. The events are queued,
+// and dropped when the queue is full. The events of an upload are sent one
+// after the other, in the order they are published, so that the brokers
+// keyed by upload receive them in order.
+type AsyncPublisher struct {
+	name    string
+	send    func(ctx context.Context, e Event) error
+	timeout time.Duration
+	queue   chan pending
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	// last holds, by upload, the channel closed once the last event
+	// published for the upload is sent.
+	last map[string]chan struct{}
+}
+
+// pending is an event queued by Publish. It is sent once prev, if not nil,
+// is closed, and closes done once sent.
+type pending struct {
+	ctx   context.Context
+	event Event
+	prev  chan struct{}
+	done  chan struct{}
+}
+
+// NewAsyncPublisher publishes the events with send, named after the broker
+// in the logs.
+func NewAsyncPublisher(name string, send func(ctx context.Context, e Event) error, opts ...AsyncOption) *AsyncPublisher {
+	o := AsyncOptions{
+		Timeout:     30 * time.Second,
+		Concurrency: 4,
+		QueueSize:   1000,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	p := &AsyncPublisher{
+		name:    name,
+		send:    send,
+		timeout: o.Timeout,
+		queue:   make(chan pending, o.QueueSize),
+		last:    make(map[string]chan struct{}),
+	}
+	for i := 0; i < max(1, o.Concurrency); i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for ev := range p.queue {
+				p.sendPending(ev)
+			}
+		}()
+	}
+	return p
+}
+
+// Publish queues e without blocking. It is sent once the events previously
+// published for its upload are sent.
+func (p *AsyncPublisher) Publish(ctx context.Context, e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		log.Error().Str("event_id", e.ID).Str("sink", p.name).Msg("upload event published after the sink was closed, dropping it")
+		return
+	}
+	// the send must outlive the request.
+	ev := pending{ctx: context.WithoutCancel(ctx), event: e, prev: p.last[e.Upload.ID], done: make(chan struct{})}
+	select {
+	case p.queue <- ev:
+		p.last[e.Upload.ID] = ev.done
+	default:
+		log.Error().Str("event_id", e.ID).Str("sink", p.name).Msg("upload event queue is full, dropping the event")
+	}
+}
+
+func (p *AsyncPublisher) sendPending(ev pending) {
+	defer func() {
+		p.mu.Lock()
+		if p.last[ev.event.Upload.ID] == ev.done {
+			delete(p.last, ev.event.Upload.ID)
+		}
+		p.mu.Unlock()
+		close(ev.done)
+	}()
+	if ev.prev != nil {
+		<-ev.prev
+	}
+	ctx, cancel := context.WithTimeout(ev.ctx, p.timeout)
+	defer cancel()
+	if err := p.send(ctx, ev.event); err != nil {
+		log.Error().Err(err).Str("event_id", ev.event.ID).Str("sink", p.name).Msg("unable to publish upload event")
+	}
+}
+
+// Close sends the queued events and waits for them. Events published
+// afterwards are dropped.
+func (p *AsyncPublisher) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
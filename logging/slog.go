@@ -0,0 +1,63 @@
+// Package logging lets embedders hand their own logger to the controllers
+// and the server, which log with zerolog.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/rs/zerolog"
+)
+
+// FromSlog returns a zerolog logger writing every event to l, so that the
+// controllers and the server can be given a *slog.Logger. The fields of the
+// events become the attributes of the records.
+func FromSlog(l *slog.Logger) *zerolog.Logger {
+	logger := zerolog.New(slogWriter{l: l})
+	return &logger
+}
+
+var slogLevels = map[zerolog.Level]slog.Level{
+	zerolog.TraceLevel: slog.LevelDebug - 4,
+	zerolog.DebugLevel: slog.LevelDebug,
+	zerolog.InfoLevel:  slog.LevelInfo,
+	zerolog.WarnLevel:  slog.LevelWarn,
+	zerolog.ErrorLevel: slog.LevelError,
+	zerolog.FatalLevel: slog.LevelError + 4,
+	zerolog.PanicLevel: slog.LevelError + 8,
+}
+
+// slogWriter decodes the JSON events written by zerolog into slog records.
+type slogWriter struct {
+	l *slog.Logger
+}
+
+func (w slogWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w slogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	lvl, ok := slogLevels[level]
+	if !ok {
+		lvl = slog.LevelInfo
+	}
+	ctx := context.Background()
+	if !w.l.Enabled(ctx, lvl) {
+		return len(p), nil
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return 0, err
+	}
+	msg, _ := fields[zerolog.MessageFieldName].(string)
+	delete(fields, zerolog.MessageFieldName)
+	delete(fields, zerolog.LevelFieldName)
+	attrs := make([]slog.Attr, 0, len(fields))
+	for k, v := range fields {
+		attrs = append(attrs, slog.Any(k, v))
+	}
+	w.l.LogAttrs(ctx, lvl, msg, attrs...)
+	return len(p), nil
+}
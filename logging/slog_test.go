@@ -0,0 +1,26 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromSlog(t *testing.T) {
+	var buf bytes.Buffer
+	l := logging.FromSlog(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	l.Debug().Msg("dropped")
+	l.Warn().Str("file_id", "a").Int("size", 5).Msg("upload expired")
+
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "upload expired", record["msg"])
+	assert.Equal(t, "a", record["file_id"])
+	assert.Equal(t, float64(5), record["size"])
+}
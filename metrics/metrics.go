@@ -0,0 +1,189 @@
+// Package metrics counts the upload traffic handled by the controllers, so
+// that operators can graph the ingest volume. The counters are exported by
+// the Prometheus exporter of the server as uploader_bytes_received_total,
+// uploader_uploads_created_total and uploader_uploads_completed_total,
+// labeled with the api_version and the backend of the controller.
+//
+// The duration, size and throughput of every chunk and of every completed
+// upload are recorded in histograms too, so that slow storage backends and
+// slow clients show up in their high percentiles.
+//
+// The uploader_inflight_patch_requests and uploader_open_uploads gauges
+// measure the load of the server, to drive autoscaling and capacity alerts.
+// Failed requests are counted by uploader_failures_total, labeled by the
+// reason they failed for.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const instrumentationName = "github.com/imrenagi/go-http-upload/metrics"
+
+// Reason classifies the failures of the requests.
+type Reason string
+
+const (
+	// ReasonOffsetConflict is an Upload-Offset not matching the offset of
+	// the upload.
+	ReasonOffsetConflict Reason = "offset_conflict"
+	// ReasonChecksumMismatch is a chunk not matching its Upload-Checksum.
+	ReasonChecksumMismatch Reason = "checksum_mismatch"
+	// ReasonExpired is a request for an expired upload.
+	ReasonExpired Reason = "expired"
+	// ReasonTimeout is a client too slow to send its chunk.
+	ReasonTimeout Reason = "timeout"
+	// ReasonStorageError is a failure to read or write the storage backend.
+	ReasonStorageError Reason = "storage_error"
+)
+
+var (
+	// durationBuckets span from a fast chunk to an upload of a large file
+	// over a slow link.
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+	// sizeBuckets span from 1KiB to 1GiB.
+	sizeBuckets = []float64{1 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+	// throughputBuckets span from 1KiB/s to 1GiB/s.
+	throughputBuckets = []float64{1 << 10, 16 << 10, 128 << 10, 512 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+)
+
+// Recorder records the traffic of a controller.
+type Recorder struct {
+	bytesReceived    metric.Int64Counter
+	uploadsCreated   metric.Int64Counter
+	uploadsCompleted metric.Int64Counter
+
+	chunkDuration    metric.Float64Histogram
+	chunkSize        metric.Int64Histogram
+	chunkThroughput  metric.Float64Histogram
+	uploadDuration   metric.Float64Histogram
+	uploadThroughput metric.Float64Histogram
+
+	inflight metric.Int64UpDownCounter
+	failures metric.Int64Counter
+
+	meter metric.Meter
+	attrs metric.MeasurementOption
+	// addOpts and recordOpts hold attrs, so that the measures don't
+	// allocate the slice of their variadic options.
+	addOpts    []metric.AddOption
+	recordOpts []metric.RecordOption
+	labels     []attribute.KeyValue
+}
+
+// New returns a recorder of the traffic of the controller of apiVersion,
+// storing the uploads in backend, whose counters are created by mp.
+func New(mp metric.MeterProvider, apiVersion, backend string) *Recorder {
+	meter := mp.Meter(instrumentationName)
+	labels := []attribute.KeyValue{
+		attribute.String("api_version", apiVersion),
+		attribute.String("backend", backend),
+	}
+	// the instruments only fail to be created with invalid names, they
+	// are no-ops then.
+	bytesReceived, _ := meter.Int64Counter("uploader_bytes_received",
+		metric.WithDescription("Number of bytes of upload data received."))
+	uploadsCreated, _ := meter.Int64Counter("uploader_uploads_created",
+		metric.WithDescription("Number of uploads created."))
+	uploadsCompleted, _ := meter.Int64Counter("uploader_uploads_completed",
+		metric.WithDescription("Number of uploads whose every byte was received."))
+	chunkDuration, _ := meter.Float64Histogram("uploader_chunk_duration_seconds",
+		metric.WithDescription("Time taken to receive and store a chunk."),
+		metric.WithExplicitBucketBoundaries(durationBuckets...))
+	chunkSize, _ := meter.Int64Histogram("uploader_chunk_size_bytes",
+		metric.WithDescription("Size of the chunks received."),
+		metric.WithExplicitBucketBoundaries(sizeBuckets...))
+	chunkThroughput, _ := meter.Float64Histogram("uploader_chunk_throughput_bytes_per_second",
+		metric.WithDescription("Rate at which the chunks were received and stored."),
+		metric.WithExplicitBucketBoundaries(throughputBuckets...))
+	uploadDuration, _ := meter.Float64Histogram("uploader_upload_duration_seconds",
+		metric.WithDescription("Time between the creation and the completion of an upload."),
+		metric.WithExplicitBucketBoundaries(durationBuckets...))
+	uploadThroughput, _ := meter.Float64Histogram("uploader_upload_throughput_bytes_per_second",
+		metric.WithDescription("Size of a completed upload divided by the time taken to complete it."),
+		metric.WithExplicitBucketBoundaries(throughputBuckets...))
+	inflight, _ := meter.Int64UpDownCounter("uploader_inflight_patch_requests",
+		metric.WithDescription("Number of PATCH requests being handled."))
+	failures, _ := meter.Int64Counter("uploader_failures",
+		metric.WithDescription("Number of requests failed, by reason."))
+	r := &Recorder{
+		bytesReceived:    bytesReceived,
+		uploadsCreated:   uploadsCreated,
+		uploadsCompleted: uploadsCompleted,
+		chunkDuration:    chunkDuration,
+		chunkSize:        chunkSize,
+		chunkThroughput:  chunkThroughput,
+		uploadDuration:   uploadDuration,
+		uploadThroughput: uploadThroughput,
+		inflight:         inflight,
+		failures:         failures,
+		meter:            meter,
+		labels:           labels,
+	}
+	r.attrs = metric.WithAttributeSet(attribute.NewSet(labels...))
+	r.addOpts = []metric.AddOption{r.attrs}
+	r.recordOpts = []metric.RecordOption{r.attrs}
+	return r
+}
+
+// Received records that n bytes of upload data were stored.
+func (r *Recorder) Received(ctx context.Context, n int64) {
+	if n > 0 {
+		r.bytesReceived.Add(ctx, n, r.addOpts...)
+	}
+}
+
+// Created records the creation of an upload.
+func (r *Recorder) Created(ctx context.Context) {
+	r.uploadsCreated.Add(ctx, 1, r.addOpts...)
+}
+
+// Chunk records a chunk of n bytes, received and stored in d.
+func (r *Recorder) Chunk(ctx context.Context, n int64, d time.Duration) {
+	r.chunkDuration.Record(ctx, d.Seconds(), r.recordOpts...)
+	r.chunkSize.Record(ctx, n, r.recordOpts...)
+	if d > 0 {
+		r.chunkThroughput.Record(ctx, float64(n)/d.Seconds(), r.recordOpts...)
+	}
+}
+
+// Completed records the completion of an upload of size bytes, d after it
+// was created.
+func (r *Recorder) Completed(ctx context.Context, size uint64, d time.Duration) {
+	r.uploadsCompleted.Add(ctx, 1, r.addOpts...)
+	r.uploadDuration.Record(ctx, d.Seconds(), r.recordOpts...)
+	if d > 0 {
+		r.uploadThroughput.Record(ctx, float64(size)/d.Seconds(), r.recordOpts...)
+	}
+}
+
+// InFlight records the start of a PATCH request. The returned function must
+// be called once it is handled.
+func (r *Recorder) InFlight(ctx context.Context) (done func()) {
+	r.inflight.Add(ctx, 1, r.addOpts...)
+	return func() {
+		r.inflight.Add(ctx, -1, r.addOpts...)
+	}
+}
+
+// ObserveOpen exposes the number of uploads neither complete nor expired,
+// counted by count every time the metrics are collected.
+func (r *Recorder) ObserveOpen(count func() int) error {
+	_, err := r.meter.Int64ObservableGauge("uploader_open_uploads",
+		metric.WithDescription("Number of uploads neither complete nor expired."),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(count()), r.attrs)
+			return nil
+		}))
+	return err
+}
+
+// Failed records a request failed for reason.
+func (r *Recorder) Failed(ctx context.Context, reason Reason) {
+	attrs := append(r.labels[:len(r.labels):len(r.labels)], attribute.String("reason", string(reason)))
+	r.failures.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
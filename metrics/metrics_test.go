@@ -0,0 +1,132 @@
+package metrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/metrics"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestRecorder(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	ctx := context.Background()
+
+	v3 := metrics.New(mp, "v3", "disk")
+	v3.Created(ctx)
+	v3.Received(ctx, 5)
+	v3.Received(ctx, 0)
+	v3.Received(ctx, 5)
+	v3.Completed(ctx, 10, 2*time.Second)
+	v4 := metrics.New(mp, "v4", "gcs")
+	v4.Created(ctx)
+	v4.Received(ctx, 3)
+
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(ctx, &rm))
+	sums := map[string]map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if !ok {
+				continue
+			}
+			sums[m.Name] = map[string]int64{}
+			for _, dp := range sum.DataPoints {
+				version, _ := dp.Attributes.Value(attribute.Key("api_version"))
+				backend, _ := dp.Attributes.Value(attribute.Key("backend"))
+				sums[m.Name][version.AsString()+"/"+backend.AsString()] = dp.Value
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]map[string]int64{
+		"uploader_bytes_received":    {"v3/disk": 10, "v4/gcs": 3},
+		"uploader_uploads_created":   {"v3/disk": 1, "v4/gcs": 1},
+		"uploader_uploads_completed": {"v3/disk": 1},
+	}, sums)
+
+	t.Run("chunks and completed uploads must be recorded in histograms", func(t *testing.T) {
+		reader := sdkmetric.NewManualReader()
+		r := metrics.New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), "v3", "disk")
+		r.Chunk(ctx, 1<<20, 500*time.Millisecond)
+		r.Chunk(ctx, 1<<20, 0)
+		r.Completed(ctx, 2<<20, 2*time.Second)
+
+		var rm metricdata.ResourceMetrics
+		assert.NoError(t, reader.Collect(ctx, &rm))
+		points := map[string]metricdata.HistogramDataPoint[float64]{}
+		var chunkSize metricdata.HistogramDataPoint[int64]
+		for _, m := range rm.ScopeMetrics[0].Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Histogram[float64]:
+				points[m.Name] = data.DataPoints[0]
+			case metricdata.Histogram[int64]:
+				chunkSize = data.DataPoints[0]
+			}
+		}
+
+		assert.Equal(t, uint64(2), points["uploader_chunk_duration_seconds"].Count)
+		assert.Equal(t, 0.5, points["uploader_chunk_duration_seconds"].Sum)
+		assert.Equal(t, uint64(2), chunkSize.Count)
+		assert.Equal(t, int64(2<<20), chunkSize.Sum)
+		// chunks received instantly have no throughput.
+		assert.Equal(t, uint64(1), points["uploader_chunk_throughput_bytes_per_second"].Count)
+		assert.Equal(t, float64(2<<20), points["uploader_chunk_throughput_bytes_per_second"].Sum)
+		assert.Equal(t, 2.0, points["uploader_upload_duration_seconds"].Sum)
+		assert.Equal(t, float64(1<<20), points["uploader_upload_throughput_bytes_per_second"].Sum)
+	})
+
+	t.Run("gauges must measure the in-flight requests and the open uploads", func(t *testing.T) {
+		reader := sdkmetric.NewManualReader()
+		r := metrics.New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), "v3", "disk")
+		assert.NoError(t, r.ObserveOpen(func() int { return 3 }))
+		done := r.InFlight(ctx)
+		r.InFlight(ctx)
+		done()
+
+		var rm metricdata.ResourceMetrics
+		assert.NoError(t, reader.Collect(ctx, &rm))
+		values := map[string]int64{}
+		for _, m := range rm.ScopeMetrics[0].Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				values[m.Name] = data.DataPoints[0].Value
+			case metricdata.Gauge[int64]:
+				values[m.Name] = data.DataPoints[0].Value
+			}
+		}
+
+		assert.Equal(t, map[string]int64{
+			"uploader_inflight_patch_requests": 1,
+			"uploader_open_uploads":            3,
+		}, values)
+	})
+
+	t.Run("failures must be counted by reason", func(t *testing.T) {
+		reader := sdkmetric.NewManualReader()
+		r := metrics.New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), "v4", "gcs")
+		r.Failed(ctx, metrics.ReasonOffsetConflict)
+		r.Failed(ctx, metrics.ReasonOffsetConflict)
+		r.Failed(ctx, metrics.ReasonTimeout)
+
+		var rm metricdata.ResourceMetrics
+		assert.NoError(t, reader.Collect(ctx, &rm))
+		failures := map[string]int64{}
+		for _, dp := range rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64]).DataPoints {
+			reason, _ := dp.Attributes.Value(attribute.Key("reason"))
+			version, _ := dp.Attributes.Value(attribute.Key("api_version"))
+			failures[version.AsString()+"/"+reason.AsString()] = dp.Value
+		}
+
+		assert.Equal(t, map[string]int64{
+			"v4/offset_conflict": 2,
+			"v4/timeout":         1,
+		}, failures)
+	})
+}
@@ -0,0 +1,92 @@
+// Package minrate aborts the transfers whose rate falls below a floor, so
+// that stalled clients don't hold server resources until the timeouts of
+// the server expire.
+package minrate
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTooSlow is returned by the reads of a Reader once its rate was measured
+// below the floor. It is a timeout, as reported by net.Error.
+var ErrTooSlow net.Error = tooSlowError{}
+
+type tooSlowError struct{}
+
+func (tooSlowError) Error() string   { return "transfer rate below the minimum" }
+func (tooSlowError) Timeout() bool   { return true }
+func (tooSlowError) Temporary() bool { return true }
+
+// Reader measures the bytes read from an io.Reader every window, and fails
+// once fewer than rate bytes per second were read during a window.
+type Reader struct {
+	r      io.Reader
+	n      atomic.Int64
+	slow   atomic.Bool
+	stopCh chan struct{}
+}
+
+// NewReader returns a Reader of r enforcing rate bytes per second over
+// window. abort is called once when the rate falls below the floor, so that
+// a read blocked on a client sending nothing at all can be interrupted,
+// e.g. by expiring the read deadline of the connection.
+//
+// The reader measures its rate until Close is called.
+func NewReader(r io.Reader, rate int64, window time.Duration, abort func()) *Reader {
+	mr := &Reader{r: r, stopCh: make(chan struct{})}
+	go mr.watch(rate*int64(window)/int64(time.Second), window, abort)
+	return mr
+}
+
+func (mr *Reader) watch(floor int64, window time.Duration, abort func()) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	var last int64
+	for {
+		select {
+		case <-mr.stopCh:
+			return
+		case <-ticker.C:
+		}
+		n := mr.n.Load()
+		if n-last < floor {
+			mr.slow.Store(true)
+			if abort != nil {
+				abort()
+			}
+			return
+		}
+		last = n
+	}
+}
+
+func (mr *Reader) Read(p []byte) (int, error) {
+	if mr.slow.Load() {
+		return 0, ErrTooSlow
+	}
+	n, err := mr.r.Read(p)
+	mr.n.Add(int64(n))
+	if err != nil && err != io.EOF && mr.slow.Load() {
+		// the read was interrupted by abort.
+		return n, ErrTooSlow
+	}
+	return n, err
+}
+
+// TooSlow reports whether the rate was measured below the floor.
+func (mr *Reader) TooSlow() bool {
+	return mr.slow.Load()
+}
+
+// Close stops measuring the rate. It doesn't close the underlying reader.
+func (mr *Reader) Close() error {
+	select {
+	case <-mr.stopCh:
+	default:
+		close(mr.stopCh)
+	}
+	return nil
+}
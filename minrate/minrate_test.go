@@ -0,0 +1,62 @@
+package minrate_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/minrate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader(t *testing.T) {
+	t.Run("reader above the rate must read everything", func(t *testing.T) {
+		data := bytes.Repeat([]byte("a"), 1<<20)
+		r := minrate.NewReader(bytes.NewReader(data), 1024, 10*time.Millisecond, nil)
+		defer r.Close()
+
+		got, err := io.ReadAll(r)
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+		assert.False(t, r.TooSlow())
+	})
+
+	t.Run("trickling reader must fail with ErrTooSlow", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		go func() {
+			for {
+				if _, err := pw.Write([]byte("a")); err != nil {
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+		defer pr.Close()
+		r := minrate.NewReader(pr, 1<<20, 20*time.Millisecond, nil)
+		defer r.Close()
+
+		_, err := io.Copy(io.Discard, r)
+
+		assert.ErrorIs(t, err, minrate.ErrTooSlow)
+		var netErr net.Error
+		assert.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	})
+
+	t.Run("stalled reader must be interrupted by abort", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		r := minrate.NewReader(pr, 1024, 20*time.Millisecond, func() {
+			pr.CloseWithError(errors.New("deadline exceeded"))
+		})
+		defer r.Close()
+
+		_, err := io.Copy(io.Discard, r)
+
+		assert.ErrorIs(t, err, minrate.ErrTooSlow)
+		assert.True(t, r.TooSlow())
+	})
+}
@@ -0,0 +1,101 @@
+// Package netguard builds HTTP clients for fetching URLs given by users,
+// which must not let them reach the private network of the server (SSRF).
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a URL resolves to an address which
+// isn't public.
+var ErrForbiddenAddress = errors.New("address is not public")
+
+const maxRedirects = 5
+
+// NewClient returns a client which only connects to public addresses. The
+// check is made on the resolved address of every connection, redirects
+// included, so that DNS records pointing to private addresses are caught.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !Public(ap.Addr()) {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, ap.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			return CheckRedirect(req)
+		},
+	}
+}
+
+// CheckHost returns ErrForbiddenAddress unless every address host resolves
+// to is public. It lets a URL be refused before it is fetched, the
+// connections being checked again as they are made.
+func CheckHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !Public(addr) {
+			return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !Public(addr) {
+			return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+		}
+	}
+	return nil
+}
+
+// CheckRedirect refuses the redirects to another scheme than http and
+// https, or to a host which isn't public.
+func CheckRedirect(req *http.Request) error {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to a %s url", req.URL.Scheme)
+	}
+	return CheckHost(req.Context(), req.URL.Hostname())
+}
+
+// Public reports whether addr is routable on the internet.
+func Public(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified() &&
+		!sharedAddressSpace.Contains(addr)
+}
+
+// sharedAddressSpace is used by carrier-grade NATs and some cloud
+// metadata services.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
@@ -0,0 +1,49 @@
+package netguard_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/netguard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublic(t *testing.T) {
+	for _, addr := range []string{"8.8.8.8", "2606:4700:4700::1111"} {
+		assert.True(t, netguard.Public(netip.MustParseAddr(addr)), addr)
+	}
+	for _, addr := range []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.100.100.200", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1",
+	} {
+		assert.False(t, netguard.Public(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	_, err := netguard.NewClient(time.Second).Get(srv.URL)
+	assert.ErrorIs(t, err, netguard.ErrForbiddenAddress)
+}
+
+func TestCheckHost(t *testing.T) {
+	assert.NoError(t, netguard.CheckHost(context.Background(), "8.8.8.8"))
+	assert.ErrorIs(t, netguard.CheckHost(context.Background(), "169.254.169.254"), netguard.ErrForbiddenAddress)
+	assert.ErrorIs(t, netguard.CheckHost(context.Background(), "localhost"), netguard.ErrForbiddenAddress)
+}
+
+func TestCheckRedirect(t *testing.T) {
+	for _, target := range []string{"http://127.0.0.1/", "https://[::1]/", "http://10.0.0.1:8080/"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		assert.ErrorIs(t, netguard.CheckRedirect(req), netguard.ErrForbiddenAddress, target)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://8.8.8.8/", nil)
+	req.URL.Scheme = "file"
+	assert.Error(t, netguard.CheckRedirect(req))
+}
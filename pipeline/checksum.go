@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Checksum returns a processor verifying the content of an upload against
+// the checksum metadata, given as the algorithm and the base64 encoded
+// digest separated by a space, like the Upload-Checksum header. md5, sha1
+// and sha256 are supported. Uploads without a checksum of this form pass.
+func Checksum() Processor {
+	return Func("checksum", func(ctx context.Context, job Job) error {
+		algorithm, digest, ok := strings.Cut(job.Upload.Metadata["checksum"], " ")
+		if !ok {
+			return nil
+		}
+		var h hash.Hash
+		switch algorithm {
+		case "md5":
+			h = md5.New()
+		case "sha1":
+			h = sha1.New()
+		case "sha256":
+			h = sha256.New()
+		default:
+			return nil
+		}
+
+		r, err := job.Open(ctx)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+		if sum := base64.StdEncoding.EncodeToString(h.Sum(nil)); sum != digest {
+			return Permanent(fmt.Errorf("%s checksum mismatch: expected %s, got %s", algorithm, digest, sum))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,163 @@
+// Package clamav scans completed uploads with clamd, the ClamAV daemon.
+//
+// The content is streamed with the INSTREAM command, so clamd doesn't need
+// access to the storage of the uploads. Infected uploads are quarantined.
+// clamd refuses streams larger than its StreamMaxLength, which must be at
+// least the maximum size of the uploads.
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/pipeline"
+)
+
+const defaultChunkSize = 64 << 10
+
+type Options struct {
+	Timeout   time.Duration
+	ChunkSize int
+}
+
+type Option func(*Options)
+
+// WithTimeout bounds the time spent scanning an upload.
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = d
+	}
+}
+
+// WithChunkSize sets the size of the chunks the content is streamed in.
+func WithChunkSize(n int) Option {
+	return func(o *Options) {
+		o.ChunkSize = n
+	}
+}
+
+// Scanner is a pipeline processor sending the uploads to clamd.
+type Scanner struct {
+	network   string
+	address   string
+	timeout   time.Duration
+	chunkSize int
+}
+
+// NewScanner scans with the clamd listening at address, either
+// tcp://host:port, unix:///path/to/clamd.sock or host:port.
+func NewScanner(address string, opts ...Option) *Scanner {
+	o := Options{
+		Timeout:   5 * time.Minute,
+		ChunkSize: defaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		network, address = "unix", path
+	} else {
+		address = strings.TrimPrefix(address, "tcp://")
+	}
+	return &Scanner{
+		network:   network,
+		address:   address,
+		timeout:   o.Timeout,
+		chunkSize: max(1, o.ChunkSize),
+	}
+}
+
+func (s *Scanner) Name() string {
+	return "clamav"
+}
+
+// Process scans the upload and quarantines it when clamd finds a
+// signature.
+func (s *Scanner) Process(ctx context.Context, job pipeline.Job) error {
+	r, err := job.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	result, err := s.Scan(ctx, r)
+	if err != nil {
+		return err
+	}
+	if result != "" {
+		return pipeline.Quarantine(result)
+	}
+	return nil
+}
+
+// Scan streams r to clamd and returns the signature it found, empty when
+// the content is clean.
+func (s *Scanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", fmt.Errorf("unable to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriterSize(conn, s.chunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, s.chunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			w.Write(size)
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return "", werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	// a zero length chunk ends the stream.
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("unable to read the reply of clamd: %w", err)
+	}
+	return parseReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseReply parses replies of the form "stream: OK",
+// "stream: <signature> FOUND" or "<message> ERROR".
+func parseReply(reply string) (string, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
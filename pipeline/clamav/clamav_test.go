@@ -0,0 +1,91 @@
+package clamav_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/pipeline"
+	"github.com/imrenagi/go-http-upload/pipeline/clamav"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClamd answers INSTREAM commands, finding a signature in the streams
+// containing "EICAR".
+func fakeClamd(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var content bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					io.CopyN(&content, r, int64(size))
+				}
+				if strings.Contains(content.String(), "EICAR") {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}()
+		}
+	}()
+	return "tcp://" + l.Addr().String()
+}
+
+func TestScanner(t *testing.T) {
+	s := clamav.NewScanner(fakeClamd(t), clamav.WithChunkSize(4))
+	job := func(content string) pipeline.Job {
+		return pipeline.Job{
+			Open: func(ctx context.Context) (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(content)), nil
+			},
+		}
+	}
+
+	t.Run("clean upload must pass", func(t *testing.T) {
+		assert.NoError(t, s.Process(context.Background(), job("hello world")))
+	})
+
+	t.Run("infected upload must be quarantined", func(t *testing.T) {
+		err := s.Process(context.Background(), job("X5O!P%@AP EICAR test file"))
+
+		var quarantineErr *pipeline.QuarantineError
+		assert.ErrorAs(t, err, &quarantineErr)
+		assert.Equal(t, "Eicar-Signature", quarantineErr.Reason)
+	})
+
+	t.Run("unreachable clamd must fail", func(t *testing.T) {
+		s := clamav.NewScanner("127.0.0.1:1")
+
+		err := s.Process(context.Background(), job("hello"))
+		assert.Error(t, err)
+		var quarantineErr *pipeline.QuarantineError
+		assert.False(t, errors.As(err, &quarantineErr))
+	})
+}
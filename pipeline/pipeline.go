@@ -0,0 +1,264 @@
+// Package pipeline runs an ordered chain of processors, e.g. checksum
+// verification, malware scanning or transcoding, on completed uploads in the
+// background.
+//
+// The status of every step is reported to the job as it changes, so that the
+// controllers record it in the metadata of the upload. A failing step is
+// retried with an exponential backoff; once its attempts are exhausted the
+// following steps are not run.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/workerpool"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrQueueFull is returned by Enqueue when the worker is saturated.
+var ErrQueueFull = errors.New("pipeline queue is full")
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	// StatusQuarantined is the status of a step which found the upload
+	// harmful.
+	StatusQuarantined Status = "quarantined"
+)
+
+// Step is the status of a processor for an upload.
+type Step struct {
+	Name      string    `json:"name"`
+	Status    Status    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Quarantined reports whether a step quarantined the upload.
+func Quarantined(steps []Step) bool {
+	for _, s := range steps {
+		if s.Status == StatusQuarantined {
+			return true
+		}
+	}
+	return false
+}
+
+// Succeeded reports whether every step succeeded. The uploads must not be
+// served before.
+func Succeeded(steps []Step) bool {
+	for _, s := range steps {
+		if s.Status != StatusSucceeded {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed reports whether a step failed once its attempts were exhausted,
+// e.g. the scanner was unreachable.
+func Failed(steps []Step) bool {
+	for _, s := range steps {
+		if s.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Job describes a completed upload and where its content is read from.
+// Update is called with the status of every step each time one changes, and
+// Done, when set, once the pipeline stopped.
+type Job struct {
+	Upload hooks.Upload
+	Open   func(ctx context.Context) (io.ReadCloser, error)
+	Update func(steps []Step)
+	Done   func(steps []Step)
+}
+
+// Processor is a step of the pipeline. Process is called again when it
+// fails, unless the error is Permanent, so it must be idempotent.
+type Processor interface {
+	Name() string
+	Process(ctx context.Context, job Job) error
+}
+
+// Func returns a processor calling fn.
+func Func(name string, fn func(ctx context.Context, job Job) error) Processor {
+	return processorFunc{name: name, fn: fn}
+}
+
+type processorFunc struct {
+	name string
+	fn   func(ctx context.Context, job Job) error
+}
+
+func (p processorFunc) Name() string {
+	return p.name
+}
+
+func (p processorFunc) Process(ctx context.Context, job Job) error {
+	return p.fn(ctx, job)
+}
+
+// Permanent marks err as a failure which retrying won't fix, e.g. invalid
+// content.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Quarantine returns the error of a processor which found the upload
+// harmful, e.g. infected. It is not retried and stops the pipeline.
+func Quarantine(reason string) error {
+	return &QuarantineError{Reason: reason}
+}
+
+type QuarantineError struct {
+	Reason string
+}
+
+func (e *QuarantineError) Error() string {
+	return "quarantined: " + e.Reason
+}
+
+type Options struct {
+	Concurrency int
+	QueueSize   int
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+type Option func(*Options)
+
+func WithConcurrency(n int) Option {
+	return func(o *Options) {
+		o.Concurrency = n
+	}
+}
+
+func WithQueueSize(n int) Option {
+	return func(o *Options) {
+		o.QueueSize = n
+	}
+}
+
+// WithRetries makes up to attempts runs of every step, waiting backoff after
+// the first failure and doubling the wait after every other.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(o *Options) {
+		o.MaxAttempts = attempts
+		o.Backoff = backoff
+	}
+}
+
+// Worker runs the processors on the jobs queued by the upload handlers, so
+// that completing an upload doesn't wait for them.
+type Worker struct {
+	*workerpool.Pool[Job]
+	processors  []Processor
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func NewWorker(processors []Processor, opts ...Option) *Worker {
+	o := Options{
+		Concurrency: 1,
+		QueueSize:   100,
+		MaxAttempts: 3,
+		Backoff:     time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	w := &Worker{
+		processors:  processors,
+		maxAttempts: max(1, o.MaxAttempts),
+		backoff:     o.Backoff,
+	}
+	w.Pool = workerpool.New(o.Concurrency, o.QueueSize, ErrQueueFull, w.process)
+	return w
+}
+
+// Steps returns the status of the steps of a job which wasn't run yet.
+func (w *Worker) Steps() []Step {
+	steps := make([]Step, len(w.processors))
+	for i, p := range w.processors {
+		steps[i] = Step{Name: p.Name(), Status: StatusPending}
+	}
+	return steps
+}
+
+func (w *Worker) process(ctx context.Context, job Job) {
+	steps := w.Steps()
+	if job.Done != nil {
+		defer func() {
+			if ctx.Err() == nil {
+				job.Done(append([]Step(nil), steps...))
+			}
+		}()
+	}
+	update := func(i int, status Status, err error) {
+		steps[i].Status = status
+		steps[i].Error = ""
+		if err != nil {
+			steps[i].Error = err.Error()
+		}
+		steps[i].UpdatedAt = time.Now().UTC()
+		job.Update(append([]Step(nil), steps...))
+	}
+
+	for i, p := range w.processors {
+		backoff := w.backoff
+		for {
+			steps[i].Attempts++
+			update(i, StatusRunning, nil)
+			err := p.Process(ctx, job)
+			if err == nil {
+				update(i, StatusSucceeded, nil)
+				break
+			}
+			var quarantineErr *QuarantineError
+			if errors.As(err, &quarantineErr) {
+				log.Warn().Str("file_id", job.Upload.ID).Str("step", p.Name()).Str("reason", quarantineErr.Reason).Msg("upload quarantined")
+				update(i, StatusQuarantined, err)
+				return
+			}
+			log.Warn().Err(err).Str("file_id", job.Upload.ID).Str("step", p.Name()).Int("attempt", steps[i].Attempts).Msg("post-processing step failed")
+			var permanentErr *permanentError
+			if steps[i].Attempts == w.maxAttempts || errors.As(err, &permanentErr) {
+				update(i, StatusFailed, err)
+				return
+			}
+			update(i, StatusPending, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+	log.Debug().Str("file_id", job.Upload.ID).Msg("upload post-processed")
+}
@@ -0,0 +1,197 @@
+package pipeline_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+// run processes job with w and returns the last status of its steps.
+func run(t *testing.T, w *pipeline.Worker, job pipeline.Job) []pipeline.Step {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go w.Run(ctx)
+
+	updates := make(chan []pipeline.Step, 100)
+	job.Update = func(steps []pipeline.Step) {
+		updates <- steps
+	}
+	assert.NoError(t, w.Enqueue(job))
+
+	var last []pipeline.Step
+	for {
+		select {
+		case steps := <-updates:
+			last = steps
+		case <-time.After(100 * time.Millisecond):
+			return last
+		}
+	}
+}
+
+func open(content string) func(ctx context.Context) (io.ReadCloser, error) {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content)), nil
+	}
+}
+
+func TestWorker(t *testing.T) {
+	t.Run("steps must run in order", func(t *testing.T) {
+		var order []string
+		step := func(name string) pipeline.Processor {
+			return pipeline.Func(name, func(ctx context.Context, job pipeline.Job) error {
+				order = append(order, name)
+				return nil
+			})
+		}
+		w := pipeline.NewWorker([]pipeline.Processor{step("scan"), step("transcode")})
+
+		steps := run(t, w, pipeline.Job{Upload: hooks.Upload{ID: "a"}, Open: open("hello")})
+
+		assert.Equal(t, []string{"scan", "transcode"}, order)
+		assert.Len(t, steps, 2)
+		for _, s := range steps {
+			assert.Equal(t, pipeline.StatusSucceeded, s.Status)
+			assert.Equal(t, 1, s.Attempts)
+		}
+	})
+
+	t.Run("failed step must be retried", func(t *testing.T) {
+		var calls atomic.Int32
+		flaky := pipeline.Func("scan", func(ctx context.Context, job pipeline.Job) error {
+			if calls.Add(1) < 3 {
+				return errors.New("scanner unavailable")
+			}
+			return nil
+		})
+		w := pipeline.NewWorker([]pipeline.Processor{flaky}, pipeline.WithRetries(3, time.Millisecond))
+
+		steps := run(t, w, pipeline.Job{Upload: hooks.Upload{ID: "a"}, Open: open("hello")})
+
+		assert.Equal(t, pipeline.StatusSucceeded, steps[0].Status)
+		assert.Equal(t, 3, steps[0].Attempts)
+		assert.Empty(t, steps[0].Error)
+	})
+
+	t.Run("steps after a failed step must not run", func(t *testing.T) {
+		failing := pipeline.Func("scan", func(ctx context.Context, job pipeline.Job) error {
+			return errors.New("scanner unavailable")
+		})
+		var ran bool
+		next := pipeline.Func("transcode", func(ctx context.Context, job pipeline.Job) error {
+			ran = true
+			return nil
+		})
+		w := pipeline.NewWorker([]pipeline.Processor{failing, next}, pipeline.WithRetries(2, time.Millisecond))
+
+		steps := run(t, w, pipeline.Job{Upload: hooks.Upload{ID: "a"}, Open: open("hello")})
+
+		assert.False(t, ran)
+		assert.Equal(t, pipeline.StatusFailed, steps[0].Status)
+		assert.Equal(t, 2, steps[0].Attempts)
+		assert.Equal(t, "scanner unavailable", steps[0].Error)
+		assert.Equal(t, pipeline.StatusPending, steps[1].Status)
+		assert.True(t, pipeline.Failed(steps))
+		assert.False(t, pipeline.Succeeded(steps))
+	})
+
+	t.Run("permanent failure must not be retried", func(t *testing.T) {
+		var calls atomic.Int32
+		failing := pipeline.Func("scan", func(ctx context.Context, job pipeline.Job) error {
+			calls.Add(1)
+			return pipeline.Permanent(errors.New("infected"))
+		})
+		w := pipeline.NewWorker([]pipeline.Processor{failing}, pipeline.WithRetries(3, time.Millisecond))
+
+		steps := run(t, w, pipeline.Job{Upload: hooks.Upload{ID: "a"}, Open: open("hello")})
+
+		assert.EqualValues(t, 1, calls.Load())
+		assert.Equal(t, pipeline.StatusFailed, steps[0].Status)
+	})
+
+	t.Run("quarantined upload must stop the pipeline", func(t *testing.T) {
+		var calls atomic.Int32
+		scan := pipeline.Func("scan", func(ctx context.Context, job pipeline.Job) error {
+			calls.Add(1)
+			return pipeline.Quarantine("Eicar-Signature")
+		})
+		var ran bool
+		next := pipeline.Func("transcode", func(ctx context.Context, job pipeline.Job) error {
+			ran = true
+			return nil
+		})
+		w := pipeline.NewWorker([]pipeline.Processor{scan, next}, pipeline.WithRetries(3, time.Millisecond))
+
+		steps := run(t, w, pipeline.Job{Upload: hooks.Upload{ID: "a"}, Open: open("hello")})
+
+		assert.EqualValues(t, 1, calls.Load())
+		assert.False(t, ran)
+		assert.Equal(t, pipeline.StatusQuarantined, steps[0].Status)
+		assert.True(t, pipeline.Quarantined(steps))
+	})
+
+	t.Run("done must be called once the pipeline stopped", func(t *testing.T) {
+		w := pipeline.NewWorker([]pipeline.Processor{
+			pipeline.Func("scan", func(ctx context.Context, job pipeline.Job) error { return nil }),
+		})
+		done := make(chan []pipeline.Step, 1)
+
+		run(t, w, pipeline.Job{
+			Upload: hooks.Upload{ID: "a"},
+			Open:   open("hello"),
+			Done: func(steps []pipeline.Step) {
+				done <- steps
+			},
+		})
+
+		select {
+		case steps := <-done:
+			assert.Equal(t, pipeline.StatusSucceeded, steps[0].Status)
+			assert.False(t, pipeline.Quarantined(steps))
+			assert.True(t, pipeline.Succeeded(steps))
+		case <-time.After(5 * time.Second):
+			t.Fatal("done was not called")
+		}
+	})
+
+	t.Run("job must not be queued when the queue is full", func(t *testing.T) {
+		w := pipeline.NewWorker(nil, pipeline.WithQueueSize(1))
+
+		assert.NoError(t, w.Enqueue(pipeline.Job{}))
+		assert.ErrorIs(t, w.Enqueue(pipeline.Job{}), pipeline.ErrQueueFull)
+	})
+}
+
+func TestChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	checksum := "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+	job := func(checksum, content string) pipeline.Job {
+		return pipeline.Job{
+			Upload: hooks.Upload{ID: "a", Metadata: map[string]string{"checksum": checksum}},
+			Open:   open(content),
+		}
+	}
+
+	t.Run("matching content must pass", func(t *testing.T) {
+		assert.NoError(t, pipeline.Checksum().Process(context.Background(), job(checksum, "hello")))
+	})
+
+	t.Run("mismatching content must fail permanently", func(t *testing.T) {
+		err := pipeline.Checksum().Process(context.Background(), job(checksum, "hullo"))
+		assert.ErrorContains(t, err, "checksum mismatch")
+	})
+
+	t.Run("upload without a checksum must pass", func(t *testing.T) {
+		assert.NoError(t, pipeline.Checksum().Process(context.Background(), job("", "hello")))
+	})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the lines of the access log.
+type AccessLogFormat string
+
+const (
+	// AccessLogCommon is the Common Log Format of the web servers.
+	AccessLogCommon AccessLogFormat = "common"
+	// AccessLogJSON writes one JSON object per line.
+	AccessLogJSON AccessLogFormat = "json"
+)
+
+// ParseAccessLogFormat returns the access log format named s, common when
+// empty.
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch f := AccessLogFormat(s); f {
+	case "":
+		return AccessLogCommon, nil
+	case AccessLogCommon, AccessLogJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown access log format %q", s)
+	}
+}
+
+// accessLogEntry is a line of the access log in the JSON format.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Remote     string    `json:"remote"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	BytesRead  int64     `json:"bytes_read"`
+	DurationMS float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// AccessLog writes a line to w in format for every request once it is
+// handled, independently of the level of the logger. Lines are never
+// interleaved, w doesn't need to be safe for concurrent use.
+func AccessLog(w io.Writer, format AccessLogFormat) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	write := func(e accessLogEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+		if format == AccessLogJSON {
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+		fmt.Fprintf(w, "%s - %s [%s] %q %d %d\n",
+			e.Remote, dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method+" "+e.URI+" "+e.Proto, e.Status, e.Bytes)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := &responseRecorder{ResponseWriter: w}
+			body := &countingReader{ReadCloser: r.Body}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = body
+			}
+			next.ServeHTTP(rw, r)
+
+			user, _, _ := r.BasicAuth()
+			uri := r.RequestURI
+			if uri == "" {
+				uri = r.URL.RequestURI()
+			}
+			write(accessLogEntry{
+				Time:       start,
+				Remote:     remoteHost(r.RemoteAddr),
+				User:       user,
+				Method:     r.Method,
+				URI:        uri,
+				Proto:      r.Proto,
+				Status:     rw.status(),
+				Bytes:      rw.n,
+				BytesRead:  body.n,
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+				Referer:    r.Referer(),
+				UserAgent:  r.UserAgent(),
+			})
+		})
+	}
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/v3/files?tag=a", strings.NewReader("hello"))
+		req.RemoteAddr = "10.0.0.1:4321"
+		req.Header.Set("User-Agent", "tus-client")
+		return req
+	}
+
+	t.Run("common format must log a line per request", func(t *testing.T) {
+		var buf bytes.Buffer
+		h := server.AccessLog(&buf, server.AccessLogCommon)(handler)
+		h.ServeHTTP(httptest.NewRecorder(), newRequest())
+
+		assert.Regexp(t,
+			regexp.MustCompile(`^10\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /api/v3/files\?tag=a HTTP/1\.1" 201 7\n$`),
+			buf.String())
+	})
+
+	t.Run("json format must log an object per line", func(t *testing.T) {
+		var buf bytes.Buffer
+		h := server.AccessLog(&buf, server.AccessLogJSON)(handler)
+		h.ServeHTTP(httptest.NewRecorder(), newRequest())
+		h.ServeHTTP(httptest.NewRecorder(), newRequest())
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Len(t, lines, 2)
+		var entry map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal(t, "10.0.0.1", entry["remote"])
+		assert.Equal(t, "POST", entry["method"])
+		assert.Equal(t, "/api/v3/files?tag=a", entry["uri"])
+		assert.Equal(t, float64(http.StatusCreated), entry["status"])
+		assert.Equal(t, float64(7), entry["bytes"])
+		assert.Equal(t, float64(5), entry["bytes_read"])
+		assert.Equal(t, "tus-client", entry["user_agent"])
+		assert.Contains(t, entry, "duration_ms")
+	})
+
+	t.Run("unknown format must be rejected", func(t *testing.T) {
+		_, err := server.ParseAccessLogFormat("combined")
+		assert.Error(t, err)
+
+		format, err := server.ParseAccessLogFormat("")
+		assert.NoError(t, err)
+		assert.Equal(t, server.AccessLogCommon, format)
+	})
+}
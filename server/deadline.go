@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultDownloadTimeout bounds the writing of the downloads when
+// Opts.DownloadTimeout is zero.
+const defaultDownloadTimeout = time.Hour
+
+// WriteTimeout lets the responses be written for d instead of the
+// WriteTimeout of the http server, which would cut off large downloads.
+// Zero lifts the deadline.
+func WriteTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var deadline time.Time
+			if d > 0 {
+				deadline = time.Now().Add(d)
+			}
+			if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+				log.Ctx(r.Context()).Warn().Err(err).Msg("unable to extend the write deadline of the response")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/server"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+func TestWriteTimeout(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello "))
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("world"))
+	})
+	get := func(t *testing.T, h http.Handler) (string, error) {
+		srv := httptest.NewUnstartedServer(h)
+		srv.Config.WriteTimeout = 100 * time.Millisecond
+		srv.Start()
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	t.Run("the response must be cut off by the write timeout of the server", func(t *testing.T) {
+		body, err := get(t, slow)
+		assert.False(t, err == nil && body == "hello world")
+	})
+
+	t.Run("the response must be written within the timeout of the handler, behind otelhttp", func(t *testing.T) {
+		h := otelhttp.NewHandler(server.WriteTimeout(time.Minute)(slow), "/")
+
+		body, err := get(t, h)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", body)
+	})
+}
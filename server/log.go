@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bufio"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"time"
@@ -9,31 +11,83 @@ import (
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func InitializeLogger(lvl string) func() {
+// LogConfig selects the level, the format and the destinations of the
+// logs.
+type LogConfig struct {
+	// Level is the minimum level logged, debug by default.
+	Level string
+	// JSON writes one JSON object per line, for log shippers, instead of
+	// the human readable console format.
+	JSON bool
+	// File, when set, receives the logs too. It is rotated once it grows
+	// over MaxSizeMB megabytes, 100 by default, keeping MaxBackups rotated
+	// files at most MaxAgeDays days. Zero keeps them all.
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+// InitializeLogger sets up the global logger. The returned function closes
+// the log file.
+func InitializeLogger(cfg LogConfig) func() {
+	lvl := cfg.Level
+	if lvl == "" {
+		lvl = "debug"
+	}
 	level, err := zerolog.ParseLevel(lvl)
 	if err != nil {
 		log.Fatal().Err(err).Msg("unable to parse log level")
 	}
 	zerolog.SetGlobalLevel(level)
-
-	// var stdOut io.Writer = os.Stdout
-	stdOut := zerolog.ConsoleWriter{Out: os.Stdout}
-
-	writers := []io.Writer{stdOut}
 	zerolog.TimeFieldFormat = time.RFC3339Nano
 
+	format := func(w io.Writer, color bool) io.Writer {
+		if cfg.JSON {
+			return w
+		}
+		return zerolog.ConsoleWriter{Out: w, NoColor: !color}
+	}
+	writers := []io.Writer{format(os.Stdout, true)}
+	closeFn := func() {}
+	if cfg.File != "" {
+		file := &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+		}
+		writers = append(writers, format(file, false))
+		closeFn = func() { file.Close() }
+	}
+
 	multi := zerolog.MultiLevelWriter(writers...)
 	log.Logger = zerolog.New(multi).With().Timestamp().Logger()
 
-	return func() {}
+	return closeFn
 }
 
+// LogInterceptor logs the start of every request, and once it is handled
+// its status, the number of bytes read from its body and written in the
+// response, and how long it took.
 func LogInterceptor(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return NewLogInterceptor(&log.Logger)(next)
+}
 
-		log := log.With().Str("request_id", uuid.New().String()).Logger()
+// NewLogInterceptor returns a LogInterceptor logging with l.
+func NewLogInterceptor(l *zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return logRequests(l, next)
+	}
+}
+
+func logRequests(l *zerolog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		log := l.With().Str("request_id", uuid.New().String()).Logger()
 
 		log.Debug().
 			Str("method", r.Method).
@@ -41,6 +95,83 @@ func LogInterceptor(next http.Handler) http.Handler {
 			Str("remote", r.RemoteAddr).
 			Msg("request started")
 
-		next.ServeHTTP(w, r.WithContext(log.WithContext(r.Context())))
+		rw := &responseRecorder{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		next.ServeHTTP(rw, r.WithContext(log.WithContext(r.Context())))
+
+		log.Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status", rw.status()).
+			Int64("bytes_read", body.n).
+			Int64("bytes_written", rw.n).
+			Dur("duration", time.Since(start)).
+			Msg("request finished")
 	})
 }
+
+// responseRecorder records the status and the size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the features of the underlying
+// writer, e.g. to extend the deadlines of long uploads.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack lets the WebSocket uploads take over the connection.
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.code == 0 {
+		w.code = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (w *responseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseRecorder) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
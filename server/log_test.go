@@ -0,0 +1,64 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/server"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogInterceptor(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = logger }()
+
+	h := server.LogInterceptor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/files", strings.NewReader("hello")))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var finished map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &finished))
+	assert.Equal(t, "request finished", finished["message"])
+	assert.Equal(t, float64(http.StatusCreated), finished["status"])
+	assert.Equal(t, float64(5), finished["bytes_read"])
+	assert.Equal(t, float64(7), finished["bytes_written"])
+	assert.Contains(t, finished, "duration")
+}
+
+func TestInitializeLogger(t *testing.T) {
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	defer func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	}()
+
+	file := filepath.Join(t.TempDir(), "uploader.log")
+	closeLog := server.InitializeLogger(server.LogConfig{Level: "info", JSON: true, File: file})
+	log.Debug().Msg("dropped")
+	log.Info().Str("file_id", "a").Msg("upload completed")
+	closeLog()
+
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 1)
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "upload completed", entry["message"])
+	assert.Equal(t, "a", entry["file_id"])
+}
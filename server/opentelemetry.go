@@ -2,7 +2,11 @@ package server
 
 import (
 	"context"
+	"runtime"
+	"runtime/debug"
 
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
@@ -12,7 +16,7 @@ import (
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 type ShutdownFn func(context.Context) error
@@ -26,11 +30,14 @@ func InitMeterProvider(ctx context.Context, name string, reader metric.Reader) S
 	return meterProvider.Shutdown
 }
 
-func InitTraceProvider(ctx context.Context, name string, spanExporter trace.SpanExporter) ShutdownFn {
+// InitTraceProvider samples sampleRatio of the traces started by the
+// server. Requests carrying a trace context follow the sampling decision of
+// their parent.
+func InitTraceProvider(ctx context.Context, name string, spanExporter trace.SpanExporter, sampleRatio float64) ShutdownFn {
 	res := telemetryResource(ctx, name)
 	bsp := trace.NewBatchSpanProcessor(spanExporter)
 	tracerProvider := trace.NewTracerProvider(
-		trace.WithSampler(trace.TraceIDRatioBased(1)),
+		trace.WithSampler(trace.ParentBased(trace.TraceIDRatioBased(sampleRatio))),
 		trace.WithResource(res),
 		trace.WithSpanProcessor(bsp),
 	)
@@ -55,19 +62,72 @@ func telemetryResource(ctx context.Context, serviceName string) *resource.Resour
 	return res
 }
 
-func NewPrometheusExporter(ctx context.Context) *prometheus.Exporter {
-	exporter, err := prometheus.New()
+// NewPrometheusExporter exports the metrics of the meter provider to the
+// registerer.
+func NewPrometheusExporter(ctx context.Context, registerer prom.Registerer) *prometheus.Exporter {
+	exporter, err := prometheus.New(prometheus.WithRegisterer(registerer))
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to initialize prometheus exporter")
 	}
 	return exporter
 }
 
-func NewOTLPTraceExporter(ctx context.Context, otlpEndpoint string) *otlptrace.Exporter {
-	traceClient := otlptracegrpc.NewClient(
-		otlptracegrpc.WithInsecure(),
+// NewPrometheusRegistry returns a registry with the Go runtime and process
+// collectors and the uploader_build_info gauge, whose version and commit
+// labels identify the running build. An empty commit is read from the VCS
+// information stamped in the binary, if any.
+func NewPrometheusRegistry(version, commit string) *prom.Registry {
+	if commit == "" {
+		commit = vcsRevision()
+	}
+	buildInfo := prom.NewGauge(prom.GaugeOpts{
+		Name: "uploader_build_info",
+		Help: "A metric with a constant '1' value labeled by the version and commit of the uploader.",
+		ConstLabels: prom.Labels{
+			"version":    version,
+			"commit":     commit,
+			"go_version": runtime.Version(),
+		},
+	})
+	buildInfo.Set(1)
+
+	registry := prom.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		buildInfo,
+	)
+	return registry
+}
+
+func vcsRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
+
+// NewOTLPTraceExporter exports the spans to the gRPC OTLP collector at
+// otlpEndpoint, over TLS unless insecure is set, sending headers with every
+// export. The connection is made lazily, so an unreachable collector
+// doesn't hold the server up.
+func NewOTLPTraceExporter(ctx context.Context, otlpEndpoint string, insecure bool, headers map[string]string) *otlptrace.Exporter {
+	opts := []otlptracegrpc.Option{
 		otlptracegrpc.WithEndpoint(otlpEndpoint),
-		otlptracegrpc.WithDialOption(grpc.WithBlock()))
+		otlptracegrpc.WithHeaders(headers),
+	}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")))
+	}
+	traceClient := otlptracegrpc.NewClient(opts...)
 	traceExp, err := otlptrace.New(ctx, traceClient)
 	if err != nil {
 		log.Fatal().Err(err).Msgf("Failed to create the collector trace exporter")
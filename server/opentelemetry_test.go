@@ -0,0 +1,33 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPrometheusRegistry(t *testing.T) {
+	registry := server.NewPrometheusRegistry("v1.2.3", "abc123")
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+		if family.GetName() != "uploader_build_info" {
+			continue
+		}
+		assert.Len(t, family.GetMetric(), 1)
+		labels := map[string]string{}
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		assert.Equal(t, "v1.2.3", labels["version"])
+		assert.Equal(t, "abc123", labels["commit"])
+		assert.Equal(t, 1.0, family.GetMetric()[0].GetGauge().GetValue())
+	}
+	assert.True(t, names["uploader_build_info"])
+	assert.True(t, names["go_goroutines"])
+	assert.True(t, names["go_memstats_alloc_bytes"])
+}
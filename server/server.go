@@ -2,47 +2,280 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"runtime"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"github.com/gorilla/mux"
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	v1 "github.com/imrenagi/go-http-upload/api/v1"
+	v2 "github.com/imrenagi/go-http-upload/api/v2"
+	"github.com/imrenagi/go-http-upload/api/v2/uploadpb"
 	v3 "github.com/imrenagi/go-http-upload/api/v3"
 	v4 "github.com/imrenagi/go-http-upload/api/v4"
+	"github.com/imrenagi/go-http-upload/auth"
+	"github.com/imrenagi/go-http-upload/bufpool"
+	"github.com/imrenagi/go-http-upload/cdn"
+	"github.com/imrenagi/go-http-upload/diskusage"
+	"github.com/imrenagi/go-http-upload/finalize"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/netguard"
+	"github.com/imrenagi/go-http-upload/pipeline"
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/imrenagi/go-http-upload/thumbnail"
+	"github.com/imrenagi/go-http-upload/web"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
-var meter = otel.Meter("github.com/imrenagi/go-http-upload/server")
-
 type Opts struct {
+	// Authenticator, when set, is required to accept every upload request
+	// before it reaches the v3 and v4 handlers.
+	Authenticator auth.Authenticator
+	// URLSigningKey enables HMAC signed upload URLs. Signed URLs are issued
+	// at /api/signed-urls to callers accepted by Authenticator. The key also
+	// signs the download URLs issued at /files/{file_id}/download-url.
+	URLSigningKey []byte
+	// UploadTokens enables single-use upload tokens for anonymous clients.
+	// Tokens are issued at /api/upload-tokens to callers accepted by
+	// Authenticator, so it has no effect without one.
+	UploadTokens bool
+	// TenantHeader names the request header carrying the tenant of the
+	// unauthenticated callers, e.g. when set by a trusted gateway. It is
+	// ignored for authenticated principals, whose tenant is their own.
+	TenantHeader string
+	// TenantQuota limits the bytes every tenant may keep stored at the same
+	// time. Zero means unlimited.
+	TenantQuota uint64
+	// UserQuota limits the bytes every authenticated principal may keep
+	// stored at the same time. Zero means unlimited.
+	UserQuota uint64
+	// Admins are subjects granted the admin role in addition to the roles
+	// given by Authenticator.
+	Admins []string
+	// SessionTTL is the lifetime of the sessions browsers start at
+	// /api/sessions with the credentials accepted by Authenticator to use
+	// the web pages, which require one when Authenticator is set. 12 hours
+	// by default.
+	SessionTTL time.Duration
+	// ThumbnailSizes are the sizes, in pixels of the longest side, of the
+	// thumbnails generated for completed image uploads. Thumbnails are only
+	// generated when set.
+	ThumbnailSizes []int
+	// CDN, when set, signs a URL of every completed upload for the CDN
+	// serving the storage backend. The URLs are valid for CDNURLTTL, an
+	// hour by default.
+	CDN       cdn.Signer
+	CDNURLTTL time.Duration
+	// Hooks are called at every step of the lifecycle of the uploads.
+	Hooks hooks.Hooks
+	// Processors post-process every completed upload, in order.
+	Processors []pipeline.Processor
+	// ContentTypePolicy, when set, restricts the declared and detected
+	// content types of the uploads, and the extensions of the v1 files.
+	ContentTypePolicy *sniff.Policy
+	// Dedup answers the creation of an upload whose sha256 checksum matches
+	// a completed upload of the same owner with that upload. Only the v3
+	// uploads, whose etag is their sha256, are deduplicated.
+	Dedup bool
+	// URLImport lets the clients create v3 uploads whose data the server
+	// fetches from a public URL. Every import must be done within
+	// URLImportTimeout, an hour by default, and is limited to
+	// URLImportMaxSize bytes, 1GiB by default.
+	URLImport        bool
+	URLImportTimeout time.Duration
+	URLImportMaxSize uint64
+	// DownloadTimeout bounds the writing of a download, which the
+	// WriteTimeout of the other responses would cut off. An hour by
+	// default.
+	DownloadTimeout time.Duration
+
+	// SparseUploads lets the clients send the chunks of v3 uploads in any
+	// order, with PUT requests to /api/v3/files/{file_id}/chunks.
+	SparseUploads bool
+	// Multipart enables the multipart upload API of v3 under
+	// /api/v3/multipart, whose parts are sent concurrently then assembled.
+	Multipart bool
+	// WebSocketUploads lets the clients send the chunks of v3 uploads over
+	// a WebSocket at /api/v3/files/{file_id}/ws, for browsers behind
+	// proxies mishandling PATCH requests or long request bodies.
+	WebSocketUploads bool
+	// WebSocketOrigins are the origins of the pages allowed to upload over
+	// a WebSocket besides the pages of the host of the server.
+	WebSocketOrigins []string
+	// AsyncFinalizeMinSize, unless zero, is the size from which the uploads
+	// are finalized in the background once their last chunk is stored,
+	// e.g. computing the checksums of their whole content.
+	AsyncFinalizeMinSize uint64
+	// MinTransferRate, unless zero, aborts with a 408 the PATCH requests
+	// whose body is received slower than this many bytes per second over
+	// MinTransferRateWindow, 10 seconds by default.
+	MinTransferRate       uint64
+	MinTransferRateWindow time.Duration
+	// DirectIO writes the chunks of the v3 uploads bypassing the page cache
+	// of the host, where the file system supports it.
+	DirectIO bool
+	// ComposeChunks composes the chunks of every completed v4 upload into
+	// a single object of the bucket.
+	ComposeChunks bool
+
+	// UploadDir is the directory the v3 uploads are written to, /tmp by
+	// default. Its file system is measured every DiskUsageInterval, a
+	// minute by default, and a warning is logged when its used ratio is
+	// past DiskUsageThreshold, unless zero. DiskUsageRejectCreates refuses
+	// the creation of v3 uploads past the threshold.
+	UploadDir              string
+	DiskUsageInterval      time.Duration
+	DiskUsageThreshold     float64
+	DiskUsageRejectCreates bool
+	// V1UploadDir is the directory the v1 uploads are kept in, and
+	// V1Bucket the GCS bucket they are kept in instead when set. They are
+	// discarded once received when neither is set.
+	V1UploadDir string
+	V1Bucket    string
+	// V1MaxSize, V1MaxMemory and V1MaxFiles limit the size of the v1
+	// requests, 10MB by default, the memory used to parse a form, 5MB by
+	// default, and the number of its files, unlimited by default.
+	// V1MaxDecodedSize limits the size of the compressed binary uploads
+	// once decompressed, V1MaxSize by default.
+	V1MaxSize        int64
+	V1MaxMemory      int64
+	V1MaxFiles       int
+	V1MaxDecodedSize int64
+	// V2MaxSize limits the size of the v2 uploads, 5GiB by default, which
+	// also bounds the uploads of unknown length.
+	V2MaxSize int64
+
+	// Tracing exports the spans of the requests to the OTLP collector
+	// listening on the gRPC OTLPEndpoint, localhost:4317 by default, over
+	// TLS unless OTLPInsecure is set. OTLPHeaders are sent with every
+	// export, e.g. to authenticate to the collector.
+	Tracing      bool
+	OTLPEndpoint string
+	OTLPInsecure bool
+	OTLPHeaders  map[string]string
+	// TraceSampleRatio is the ratio of the traces sampled, every trace when
+	// zero.
+	TraceSampleRatio float64
+
+	// TLSCertFile and TLSKeyFile make the server listen with TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ClientCAFile requires every client to present a certificate signed by
+	// one of the CAs in the file. Use it with auth.CertificateAuthenticator
+	// to turn certificate subjects into principals.
+	ClientCAFile string
+
+	// GRPCAddr, when set, is the address the gRPC upload service of v2
+	// listens on, with the TLS configuration of the http server. Its
+	// methods are also mapped to REST endpoints under /api/v2/uploads by a
+	// gateway calling the service, unless ClientCAFile is set since the
+	// gateway has no client certificate.
+	GRPCAddr string
+
+	// Version and Commit label the uploader_build_info metric. Commit
+	// defaults to the VCS revision stamped in the binary.
+	Version string
+	Commit  string
+
+	// AccessLog, when set, receives a line per request in AccessLogFormat,
+	// the Common Log Format by default.
+	AccessLog       io.Writer
+	AccessLogFormat AccessLogFormat
+
+	// CopyBufferSize is the size of the pooled buffers the bodies of the
+	// uploads are copied to the storage with, 32KiB by default.
+	CopyBufferSize int
+
+	// Logger, when set, replaces the global logger for the server and the
+	// controllers. Use logging.FromSlog to log with a *slog.Logger.
+	Logger *zerolog.Logger
 }
 
 func New(opts Opts) Server {
 	s := Server{
-		opts: opts,
+		opts:     opts,
+		log:      opts.Logger,
+		registry: NewPrometheusRegistry(opts.Version, opts.Commit),
+	}
+	if s.log == nil {
+		s.log = &log.Logger
 	}
 	return s
 }
 
 type Server struct {
-	opts Opts
+	opts     Opts
+	log      *zerolog.Logger
+	registry *prometheus.Registry
 }
 
-// Run runs the gRPC-Gateway, dialing the provided address.
+// Run runs the http server, and the gRPC server when Opts.GRPCAddr is set,
+// until ctx is done.
 func (s *Server) Run(ctx context.Context) error {
-	log.Info().Msg("starting server")
+	s.log.Info().Msg("starting server")
 
 	serviceName := "go-http-uploader"
 
-	prometheusExporter := NewPrometheusExporter(ctx)
+	if s.opts.ClientCAFile != "" && s.opts.TLSCertFile == "" {
+		return errors.New("client certificate authentication requires TLS")
+	}
+	tlsConfig, err := newTLSConfig(s.opts)
+	if err != nil {
+		return err
+	}
+
+	var grpcCreds credentials.TransportCredentials
+	if s.opts.GRPCAddr != "" && s.opts.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.opts.TLSCertFile, s.opts.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load the tls certificate: %w", err)
+		}
+		cfg := tlsConfig.Clone()
+		cfg.Certificates = []tls.Certificate{cert}
+		grpcCreds = credentials.NewTLS(cfg)
+	}
+
+	if s.opts.CopyBufferSize > 0 {
+		bufpool.Default = bufpool.New(s.opts.CopyBufferSize)
+	}
+
+	prometheusExporter := NewPrometheusExporter(ctx, s.registry)
 	meterShutdownFn := InitMeterProvider(ctx, serviceName, prometheusExporter)
+	traceShutdownFn := func(context.Context) error { return nil }
+	if s.opts.Tracing {
+		endpoint := s.opts.OTLPEndpoint
+		if endpoint == "" {
+			endpoint = "localhost:4317"
+		}
+		ratio := s.opts.TraceSampleRatio
+		if ratio == 0 {
+			ratio = 1
+		}
+		exporter := NewOTLPTraceExporter(ctx, endpoint, s.opts.OTLPInsecure, s.opts.OTLPHeaders)
+		traceShutdownFn = InitTraceProvider(ctx, serviceName, exporter, ratio)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	}
 
+	handler, grpcServer := s.newHandlers(ctx, grpcCreds)
 	httpServer := &http.Server{
 		Addr:    ":8080",
-		Handler: s.newHTTPHandler(),
+		Handler: handler,
 		// ReadTimeout is the maximum duration for reading the entire request, including the body.
 		// This prevents slowloris attacks.
 		// This is useful for handling request from slow client so that it won't hold the connection for too long.
@@ -55,62 +288,389 @@ func (s *Server) Run(ctx context.Context) error {
 		ReadHeaderTimeout: 5 * time.Second,
 		// IdleTimeout is the maximum amount of time to wait for the next request when keep-alives are enabled.
 		IdleTimeout: 5 * time.Second,
+		TLSConfig:   tlsConfig,
+	}
+
+	if grpcServer != nil {
+		lis, err := net.Listen("tcp", s.opts.GRPCAddr)
+		if err != nil {
+			return fmt.Errorf("unable to listen on %s: %w", s.opts.GRPCAddr, err)
+		}
+		go func() {
+			s.log.Info().Msgf("Starting grpc server on %s", s.opts.GRPCAddr)
+			if err := grpcServer.Serve(lis); err != nil {
+				s.log.Fatal().Err(err).Msgf("grpc serve:%+s\n", err)
+			}
+		}()
 	}
 
 	go func() {
-		log.Info().Msgf("Starting http server on :8080")
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal().Err(err).Msgf("listen:%+s\n", err)
+		var err error
+		if s.opts.TLSCertFile != "" {
+			s.log.Info().Msgf("Starting https server on :8080")
+			err = httpServer.ListenAndServeTLS(s.opts.TLSCertFile, s.opts.TLSKeyFile)
+		} else {
+			s.log.Info().Msgf("Starting http server on :8080")
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.log.Fatal().Err(err).Msgf("listen:%+s\n", err)
 		}
 	}()
 
 	<-ctx.Done()
 
 	gracefulShutdownPeriod := 30 * time.Second
-	log.Warn().Msg("shutting down http server")
+	s.log.Warn().Msg("shutting down http server")
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracefulShutdownPeriod)
 	defer cancel()
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
-		log.Error().Err(err).Msg("failed to shutdown http server gracefully")
+		s.log.Error().Err(err).Msg("failed to shutdown http server gracefully")
+	}
+	s.log.Warn().Msg("http server gracefully stopped")
+
+	if grpcServer != nil {
+		// streams still open when the graceful shutdown period is over are
+		// cancelled; their clients resume them from the offset received.
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcServer.Stop()
+		}
+		s.log.Warn().Msg("grpc server stopped")
 	}
-	log.Warn().Msg("http server gracefully stopped")
 
 	if err := meterShutdownFn(ctx); err != nil {
-		log.Error().Err(err).Msg("failed to shutdown meter provider")
+		s.log.Error().Err(err).Msg("failed to shutdown meter provider")
+	}
+	// ctx is done, the pending spans are flushed within the graceful
+	// shutdown period.
+	if err := traceShutdownFn(shutdownCtx); err != nil {
+		s.log.Error().Err(err).Msg("failed to shutdown trace provider")
 	}
 	return nil
 }
 
-func (s *Server) newHTTPHandler() http.Handler {
+// newHandlers returns the handler of the http server, and the gRPC server
+// when Opts.GRPCAddr is set, which serves with creds unless nil.
+func (s *Server) newHandlers(ctx context.Context, creds credentials.TransportCredentials) (http.Handler, *grpc.Server) {
 	mux := mux.NewRouter()
-	mux.Use(
-		otelhttp.NewMiddleware("uploader"),
-		LogInterceptor)
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Use(otelhttp.NewMiddleware("uploader"))
+	if s.opts.AccessLog != nil {
+		mux.Use(AccessLog(s.opts.AccessLog, s.opts.AccessLogFormat))
+	}
+	mux.Use(NewLogInterceptor(s.log))
+	mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	downloadTimeout := s.opts.DownloadTimeout
+	if downloadTimeout == 0 {
+		downloadTimeout = defaultDownloadTimeout
+	}
+	download := WriteTimeout(downloadTimeout)
+	mux.PathPrefix("/static/").Handler(otelhttp.WithRouteTag("/static/", http.StripPrefix("/static/", web.Handler()))).Methods(http.MethodGet, http.MethodHead)
 	apiRouter := mux.PathPrefix("/api").Subrouter()
 
+	progress := v1.NewProgress()
+	v1Opts := []v1.Option{
+		v1.WithDir(s.opts.V1UploadDir),
+		v1.WithMaxSize(s.opts.V1MaxSize),
+		v1.WithMaxMemory(s.opts.V1MaxMemory),
+		v1.WithMaxFiles(s.opts.V1MaxFiles),
+		v1.WithMaxDecodedSize(s.opts.V1MaxDecodedSize),
+		v1.WithContentTypePolicy(s.opts.ContentTypePolicy),
+		v1.WithProgress(progress),
+	}
+	if s.opts.V1Bucket != "" {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			s.log.Fatal().Err(err).Msg("error creating storage client")
+		}
+		v1Opts = append(v1Opts, v1.WithBucket(client.Bucket(s.opts.V1Bucket)))
+	}
+
+	issuer := s.opts.Authenticator
+	if issuer != nil && len(s.opts.Admins) > 0 {
+		issuer = auth.GrantAdmin(issuer, s.opts.Admins...)
+	}
+	// callers of the issuing endpoints hand out the right to upload, so they
+	// must be uploaders themselves.
+	issuing := func(h http.Handler) http.Handler {
+		return auth.Middleware(issuer)(auth.RequireRole(auth.RoleUploader)(h))
+	}
+
+	var signer *auth.URLSigner
+	var authenticators []auth.Authenticator
+	if len(s.opts.URLSigningKey) > 0 {
+		signer = auth.NewURLSigner(s.opts.URLSigningKey)
+		authenticators = append(authenticators, signer)
+		if issuer != nil {
+			apiRouter.Handle("/signed-urls", issuing(
+				otelhttp.WithRouteTag("/api/signed-urls", http.HandlerFunc(signer.IssueURL())))).Methods(http.MethodPost)
+		}
+	}
+	if s.opts.UploadTokens && issuer != nil {
+		tokens := auth.NewUploadTokens()
+		authenticators = append(authenticators, tokens)
+		apiRouter.Handle("/upload-tokens", issuing(
+			otelhttp.WithRouteTag("/api/upload-tokens", http.HandlerFunc(tokens.IssueToken())))).Methods(http.MethodPost)
+	}
+	// browsers log in to the pages with the credentials accepted by the
+	// issuer, and are authenticated by their session afterwards.
+	page := func(h http.Handler) http.Handler { return h }
+	if issuer != nil {
+		sessions := auth.NewSessions(s.opts.SessionTTL)
+		authenticators = append(authenticators, sessions)
+		apiRouter.Handle("/sessions", auth.Middleware(issuer)(
+			otelhttp.WithRouteTag("/api/sessions", sessions.Login()))).Methods(http.MethodPost)
+		apiRouter.Handle("/sessions", otelhttp.WithRouteTag("/api/sessions", sessions.Logout())).Methods(http.MethodDelete)
+		page = sessions.RequireSession("/login")
+	}
+	mux.Handle("/login", otelhttp.WithRouteTag("/login", web.Page("login/index.html"))).Methods(http.MethodGet)
+	mux.Handle("/v1", otelhttp.WithRouteTag("/v1", page(web.Page("v1/index.html")))).Methods(http.MethodGet)
+	mux.Handle("/v3", otelhttp.WithRouteTag("/v3", page(web.Page("v3/index.html")))).Methods(http.MethodGet)
+	mux.Handle("/uploads", otelhttp.WithRouteTag("/uploads", page(web.Page("uploads/index.html")))).Methods(http.MethodGet)
+	mux.Handle("/files", otelhttp.WithRouteTag("/files", page(web.Page("files/index.html")))).Methods(http.MethodGet)
+
+	if issuer != nil {
+		authenticators = append(authenticators, issuer)
+	}
+
+	var authenticator auth.Authenticator
+	switch len(authenticators) {
+	case 0:
+	case 1:
+		authenticator = authenticators[0]
+	default:
+		authenticator = auth.Chain(authenticators...)
+	}
+
+	var thumbnails *thumbnail.Worker
+	if len(s.opts.ThumbnailSizes) > 0 {
+		thumbnails = thumbnail.NewWorker(s.opts.ThumbnailSizes, runtime.NumCPU(), 100)
+		go thumbnails.Run(ctx)
+	}
+	var processing *pipeline.Worker
+	if len(s.opts.Processors) > 0 {
+		processing = pipeline.NewWorker(s.opts.Processors, pipeline.WithConcurrency(runtime.NumCPU()))
+		go processing.Run(ctx)
+	}
+
+	var finalizer *finalize.Worker
+	if s.opts.AsyncFinalizeMinSize > 0 {
+		finalizer = finalize.NewWorker(runtime.NumCPU(), 100)
+		go finalizer.Run(ctx)
+	}
+
+	// listing, download, thumbnail, archive, metadata, usage and erasure
+	// endpoints aren't part of the tus protocol, so they are mounted outside
+	// of the tus subrouters and only require authentication. Handlers check
+	// the roles they need themselves.
+	authenticated := func(h http.Handler) http.Handler {
+		h = auth.TenantMiddleware(s.opts.TenantHeader)(h)
+		if authenticator == nil {
+			return h
+		}
+		return auth.Middleware(authenticator)(h)
+	}
+
 	apiV1Router := apiRouter.PathPrefix("/v1").Subrouter()
-	apiV1Router.Handle("/form", otelhttp.WithRouteTag("/api/v1/form", http.HandlerFunc(v1.FormUpload())))
-	apiV1Router.Handle("/binary", otelhttp.WithRouteTag("/api/v1/binary", http.HandlerFunc(v1.BinaryUpload())))
-	mux.Handle("/v1", otelhttp.WithRouteTag("/v1", http.HandlerFunc(v1.Web()))).Methods(http.MethodGet)
+	apiV1Router.Handle("/form", authenticated(otelhttp.WithRouteTag("/api/v1/form", http.HandlerFunc(v1.FormUpload(v1Opts...)))))
+	apiV1Router.Handle("/binary", authenticated(otelhttp.WithRouteTag("/api/v1/binary", http.HandlerFunc(v1.BinaryUpload(v1Opts...)))))
+	apiV1Router.Handle("/files/{file_id}", authenticated(download(otelhttp.WithRouteTag("/api/v1/files/{file_id}", http.HandlerFunc(v1.Download(v1Opts...)))))).Methods(http.MethodGet, http.MethodHead)
+	apiV1Router.Handle("/progress/{upload_id}", authenticated(otelhttp.WithRouteTag("/api/v1/progress/{upload_id}", progress.Status()))).Methods(http.MethodGet)
+
+	var importer *http.Client
+	importMaxSize := s.opts.URLImportMaxSize
+	if s.opts.URLImport {
+		timeout := s.opts.URLImportTimeout
+		if timeout == 0 {
+			timeout = time.Hour
+		}
+		importer = netguard.NewClient(timeout)
+		if importMaxSize == 0 {
+			importMaxSize = 1 << 30
+		}
+	}
 
-	v3Controller := v3.NewController(v3.NewStore())
+	uploadDir := s.opts.UploadDir
+	if uploadDir == "" {
+		uploadDir = "/tmp"
+	}
+	v3Store := v3.NewStore()
+	disk, err := diskusage.NewMonitor(uploadDir,
+		diskusage.WithInterval(s.opts.DiskUsageInterval),
+		diskusage.WithThreshold(s.opts.DiskUsageThreshold, s.opts.DiskUsageRejectCreates),
+		diskusage.WithPartial(v3Store.PartialBytes),
+		diskusage.WithMeterProvider(otel.GetMeterProvider()),
+		diskusage.WithLogger(s.log))
+	if err != nil {
+		s.log.Warn().Err(err).Msg("unable to observe the disk usage")
+	} else {
+		go disk.Run(ctx)
+	}
+
+	v3Controller := v3.NewController(v3Store,
+		v3.WithUploadDir(uploadDir),
+		v3.WithDiskMonitor(disk),
+		v3.WithFinalizer(finalizer, s.opts.AsyncFinalizeMinSize),
+		v3.WithSparseUploads(s.opts.SparseUploads),
+		v3.WithMultipart(v3.DefaultMinPartSize, s.opts.Multipart),
+		v3.WithWebSocket(s.opts.WebSocketUploads),
+		v3.WithWebSocketOrigins(s.opts.WebSocketOrigins...),
+		v3.WithMinTransferRate(s.opts.MinTransferRate, s.opts.MinTransferRateWindow),
+		v3.WithDirectIO(s.opts.DirectIO),
+		v3.WithTenantQuota(s.opts.TenantQuota),
+		v3.WithUserQuota(s.opts.UserQuota),
+		v3.WithURLSigner(signer),
+		v3.WithThumbnails(thumbnails),
+		v3.WithCDN(s.opts.CDN, s.opts.CDNURLTTL),
+		v3.WithHooks(s.opts.Hooks),
+		v3.WithLogger(s.opts.Logger),
+		v3.WithPipeline(processing),
+		v3.WithContentTypePolicy(s.opts.ContentTypePolicy),
+		v3.WithDedup(s.opts.Dedup),
+		v3.WithURLImport(importer, importMaxSize))
+	apiRouter.Handle("/v3/files/{file_id}/download-url", authenticated(otelhttp.WithRouteTag("/api/v3/files/{file_id}/download-url", http.HandlerFunc(v3Controller.IssueDownloadURL())))).Methods(http.MethodPost)
+	apiRouter.Handle("/v3/files/{file_id}/thumbnail", authenticated(otelhttp.WithRouteTag("/api/v3/files/{file_id}/thumbnail", http.HandlerFunc(v3Controller.GetThumbnail())))).Methods(http.MethodGet)
+	apiRouter.Handle("/v3/imports", authenticated(otelhttp.WithRouteTag("/api/v3/imports", http.HandlerFunc(v3Controller.ImportUpload())))).Methods(http.MethodPost)
+	apiRouter.Handle("/v3/multipart", authenticated(otelhttp.WithRouteTag("/api/v3/multipart", http.HandlerFunc(v3Controller.InitiateMultipart())))).Methods(http.MethodPost)
+	apiRouter.Handle("/v3/multipart/{file_id}/parts/{part_number}", authenticated(otelhttp.WithRouteTag("/api/v3/multipart/{file_id}/parts/{part_number}", http.HandlerFunc(v3Controller.UploadPart())))).Methods(http.MethodPut)
+	apiRouter.Handle("/v3/files/{file_id}/ws", authenticated(otelhttp.WithRouteTag("/api/v3/files/{file_id}/ws", http.HandlerFunc(v3Controller.UploadWebSocket())))).Methods(http.MethodGet)
+	apiRouter.Handle("/v3/multipart/{file_id}/complete", authenticated(otelhttp.WithRouteTag("/api/v3/multipart/{file_id}/complete", http.HandlerFunc(v3Controller.CompleteMultipart())))).Methods(http.MethodPost)
+	apiRouter.Handle("/v3/files", authenticated(otelhttp.WithRouteTag("/api/v3/files", http.HandlerFunc(v3Controller.ListUploads())))).Methods(http.MethodGet)
+	apiRouter.Handle("/v3/archive", authenticated(download(otelhttp.WithRouteTag("/api/v3/archive", http.HandlerFunc(v3Controller.DownloadArchive()))))).Methods(http.MethodGet)
+	apiRouter.Handle("/v3/files/{file_id}/meta", authenticated(otelhttp.WithRouteTag("/api/v3/files/{file_id}/meta", http.HandlerFunc(v3Controller.GetMetadata())))).Methods(http.MethodGet)
+	apiRouter.Handle("/v3/usage", authenticated(otelhttp.WithRouteTag("/api/v3/usage", http.HandlerFunc(v3Controller.GetUsage())))).Methods(http.MethodGet)
+	apiRouter.Handle("/v3/owners/{owner}", authenticated(otelhttp.WithRouteTag("/api/v3/owners/{owner}", http.HandlerFunc(v3Controller.EraseOwner())))).Methods(http.MethodDelete)
+	apiRouter.Handle("/v3/files/{file_id}", authenticated(download(otelhttp.WithRouteTag("/api/v3/files/{file_id}", http.HandlerFunc(v3Controller.Download()))))).Methods(http.MethodGet)
 	apiV3Router := apiRouter.PathPrefix("/v3").Subrouter()
 	apiV3Router.Use(v3.TusResumableHeaderCheck, v3.TusResumableHeaderInjections)
+	if authenticator != nil {
+		apiV3Router.Use(auth.Middleware(authenticator), auth.RequireRole(auth.RoleUploader))
+	}
+	apiV3Router.Use(auth.TenantMiddleware(s.opts.TenantHeader))
 	apiV3Router.Handle("/files", otelhttp.WithRouteTag("/api/v3/files", http.HandlerFunc(v3Controller.GetConfig()))).Methods(http.MethodOptions)
 	apiV3Router.Handle("/files", otelhttp.WithRouteTag("/api/v3/files", http.HandlerFunc(v3Controller.CreateUpload()))).Methods(http.MethodPost)
 	apiV3Router.Handle("/files/{file_id}", otelhttp.WithRouteTag("/api/v3/files/{file_id}", http.HandlerFunc(v3Controller.GetOffset()))).Methods(http.MethodHead)
 	apiV3Router.Handle("/files/{file_id}", otelhttp.WithRouteTag("/api/v3/files/{file_id}", http.HandlerFunc(v3Controller.ResumeUpload()))).Methods(http.MethodPatch)
+	apiV3Router.Handle("/files/{file_id}", otelhttp.WithRouteTag("/api/v3/files/{file_id}", http.HandlerFunc(v3Controller.Terminate()))).Methods(http.MethodDelete)
+	apiV3Router.Handle("/files/{file_id}/chunks", otelhttp.WithRouteTag("/api/v3/files/{file_id}/chunks", http.HandlerFunc(v3Controller.UploadChunk()))).Methods(http.MethodPut)
 
 	apiV3Router.HandleFunc("/files/{file_id}/upload", v3Controller.CreateUpload()).Methods(http.MethodPost)
 
-	v4Controller := v4.NewController(v4.NewStore())
+	v2MaxSize := s.opts.V2MaxSize
+	if v2MaxSize == 0 {
+		v2MaxSize = 5 << 30
+	}
+	v2Controller := v2.NewController(v2.NewStore(),
+		v2.WithUploadDir(uploadDir),
+		v2.WithMaxSize(v2MaxSize),
+		v2.WithTenantQuota(s.opts.TenantQuota),
+		v2.WithUserQuota(s.opts.UserQuota),
+		v2.WithContentTypePolicy(s.opts.ContentTypePolicy),
+		v2.WithHooks(s.opts.Hooks),
+		v2.WithLogger(s.opts.Logger))
+	go v2Controller.Sweep(ctx, time.Hour)
+	apiV2Router := apiRouter.PathPrefix("/v2").Subrouter()
+	if authenticator != nil {
+		apiV2Router.Use(auth.Middleware(authenticator), auth.RequireRole(auth.RoleUploader))
+	}
+	apiV2Router.Use(auth.TenantMiddleware(s.opts.TenantHeader))
+	apiV2Router.Handle("/files", otelhttp.WithRouteTag("/api/v2/files", http.HandlerFunc(v2Controller.CreateUpload()))).Methods(http.MethodPost)
+	apiV2Router.Handle("/files/{upload_id}", otelhttp.WithRouteTag("/api/v2/files/{upload_id}", http.HandlerFunc(v2Controller.ResumeUpload()))).Methods(http.MethodPut)
+	apiV2Router.Handle("/files/{upload_id}", otelhttp.WithRouteTag("/api/v2/files/{upload_id}", http.HandlerFunc(v2Controller.CancelUpload()))).Methods(http.MethodDelete)
+
+	var grpcServer *grpc.Server
+	if s.opts.GRPCAddr != "" {
+		grpcOpts := []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(auth.UnaryServerInterceptor(authenticator, auth.RoleUploader, s.opts.TenantHeader)),
+			grpc.ChainStreamInterceptor(auth.StreamServerInterceptor(authenticator, auth.RoleUploader, s.opts.TenantHeader)),
+		}
+		if creds != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(creds))
+		}
+		grpcServer = grpc.NewServer(grpcOpts...)
+		uploadpb.RegisterUploadServiceServer(grpcServer, v2.NewGRPCServer(v2Controller))
+
+		if s.opts.ClientCAFile == "" {
+			gateway, err := s.newGateway(ctx, creds != nil)
+			if err != nil {
+				s.log.Fatal().Err(err).Msg("error registering the grpc gateway")
+			}
+			// the gateway is authenticated by the interceptors of the gRPC
+			// server, so it isn't mounted on the v2 router.
+			apiRouter.PathPrefix("/v2/uploads").Handler(otelhttp.WithRouteTag("/api/v2/uploads", gateway))
+		}
+	}
+
+	v4Controller := v4.NewController(v4.NewStore(),
+		v4.WithTenantQuota(s.opts.TenantQuota),
+		v4.WithUserQuota(s.opts.UserQuota),
+		v4.WithURLSigner(signer),
+		v4.WithThumbnails(thumbnails),
+		v4.WithCDN(s.opts.CDN, s.opts.CDNURLTTL),
+		v4.WithHooks(s.opts.Hooks),
+		v4.WithLogger(s.opts.Logger),
+		v4.WithPipeline(processing),
+		v4.WithContentTypePolicy(s.opts.ContentTypePolicy),
+		v4.WithFinalizer(finalizer, s.opts.AsyncFinalizeMinSize),
+		v4.WithMinTransferRate(s.opts.MinTransferRate, s.opts.MinTransferRateWindow),
+		v4.WithComposeChunks(s.opts.ComposeChunks))
+	apiRouter.Handle("/v4/files/{file_id}/download-url", authenticated(otelhttp.WithRouteTag("/api/v4/files/{file_id}/download-url", http.HandlerFunc(v4Controller.IssueDownloadURL())))).Methods(http.MethodPost)
+	apiRouter.Handle("/v4/files/{file_id}/thumbnail", authenticated(otelhttp.WithRouteTag("/api/v4/files/{file_id}/thumbnail", http.HandlerFunc(v4Controller.GetThumbnail())))).Methods(http.MethodGet)
+	apiRouter.Handle("/v4/usage", authenticated(otelhttp.WithRouteTag("/api/v4/usage", http.HandlerFunc(v4Controller.GetUsage())))).Methods(http.MethodGet)
+	apiRouter.Handle("/v4/owners/{owner}", authenticated(otelhttp.WithRouteTag("/api/v4/owners/{owner}", http.HandlerFunc(v4Controller.EraseOwner())))).Methods(http.MethodDelete)
+	apiRouter.Handle("/v4/files/{file_id}", authenticated(download(otelhttp.WithRouteTag("/api/v4/files/{file_id}", http.HandlerFunc(v4Controller.Download()))))).Methods(http.MethodGet)
 	apiV4Router := apiRouter.PathPrefix("/v4").Subrouter()
 	apiV4Router.Use(v4.TusResumableHeaderCheck, v4.TusResumableHeaderInjections)
+	if authenticator != nil {
+		apiV4Router.Use(auth.Middleware(authenticator), auth.RequireRole(auth.RoleUploader))
+	}
+	apiV4Router.Use(auth.TenantMiddleware(s.opts.TenantHeader))
 	apiV4Router.Handle("/files", otelhttp.WithRouteTag("/api/v4/files", http.HandlerFunc(v4Controller.GetConfig()))).Methods(http.MethodOptions)
 	apiV4Router.Handle("/files", otelhttp.WithRouteTag("/api/v4/files", http.HandlerFunc(v4Controller.CreateUpload()))).Methods(http.MethodPost)
 	apiV4Router.Handle("/files/{file_id}", otelhttp.WithRouteTag("/api/v4/files/{file_id}", http.HandlerFunc(v4Controller.GetOffset()))).Methods(http.MethodHead)
 	apiV4Router.Handle("/files/{file_id}", otelhttp.WithRouteTag("/api/v4/files/{file_id}", http.HandlerFunc(v4Controller.ResumeUpload()))).Methods(http.MethodPatch)
+	apiV4Router.Handle("/files/{file_id}", otelhttp.WithRouteTag("/api/v4/files/{file_id}", http.HandlerFunc(v4Controller.Terminate()))).Methods(http.MethodDelete)
+
+	return otelhttp.NewHandler(mux, "/"), grpcServer
+}
+
+// newGateway returns the REST gateway of the gRPC upload service, calling
+// the gRPC server of Opts.GRPCAddr over loopback. The credentials of the
+// http requests are forwarded as metadata of the calls.
+func (s *Server) newGateway(ctx context.Context, useTLS bool) (http.Handler, error) {
+	forwarded := []string{auth.APIKeyHeader, auth.UploadTokenHeader}
+	if s.opts.TenantHeader != "" {
+		forwarded = append(forwarded, s.opts.TenantHeader)
+	}
+	gateway := gwruntime.NewServeMux(gwruntime.WithIncomingHeaderMatcher(func(key string) (string, bool) {
+		for _, h := range forwarded {
+			if strings.EqualFold(key, h) {
+				return key, true
+			}
+		}
+		return gwruntime.DefaultHeaderMatcher(key)
+	}))
 
-	return otelhttp.NewHandler(mux, "/")
+	host, port, err := net.SplitHostPort(s.opts.GRPCAddr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	creds := insecure.NewCredentials()
+	if useTLS {
+		// the gateway calls the server itself, whose certificate may not
+		// be valid for the loopback address.
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	}
+	err = uploadpb.RegisterUploadServiceHandlerFromEndpoint(ctx, gateway, net.JoinHostPort(host, port),
+		[]grpc.DialOption{grpc.WithTransportCredentials(creds)})
+	return gateway, err
 }
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// newTLSConfig returns the TLS configuration of the listener. When a client
+// CA is given, every connection must present a certificate signed by it.
+func newTLSConfig(opts Opts) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(opts.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client ca file doesn't contain any certificate")
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
@@ -0,0 +1,101 @@
+// Package kafka publishes upload lifecycle events to a Kafka topic, for
+// pipelines processing more uploads than webhooks comfortably deliver.
+//
+// Every event is a message keyed by the upload id, so that the events of an
+// upload land in the same partition and are consumed in order. The value is
+// the JSON encoding of hooks.Event, described by the schemas in the hooks
+// package.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+type Options struct {
+	BatchTimeout time.Duration
+	Transport    kafkago.RoundTripper
+}
+
+type Option func(*Options)
+
+// WithBatchTimeout bounds the time events are buffered before being sent.
+func WithBatchTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.BatchTimeout = d
+	}
+}
+
+// WithTransport configures how the brokers are reached, e.g. with TLS or
+// SASL.
+func WithTransport(t kafkago.RoundTripper) Option {
+	return func(o *Options) {
+		o.Transport = t
+	}
+}
+
+// Publisher writes events in the background so that publishing never
+// delays the upload requests. Failed writes are retried by the Kafka client
+// and logged once they give up.
+type Publisher struct {
+	*hooks.AsyncPublisher
+
+	writer *kafkago.Writer
+}
+
+func NewPublisher(brokers []string, topic string, opts ...Option) *Publisher {
+	o := Options{
+		BatchTimeout: 100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	p := &Publisher{
+		writer: &kafkago.Writer{
+			Addr:         kafkago.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafkago.Hash{},
+			BatchTimeout: o.BatchTimeout,
+			RequiredAcks: kafkago.RequireAll,
+			Transport:    o.Transport,
+		},
+	}
+	p.AsyncPublisher = hooks.NewAsyncPublisher("kafka", p.send)
+	return p
+}
+
+// send writes e to the topic. The concurrent writes are batched by the
+// writer.
+func (p *Publisher) send(ctx context.Context, e hooks.Event) error {
+	msg, err := p.message(e)
+	if err != nil {
+		return err
+	}
+	return p.writer.WriteMessages(ctx, msg)
+}
+
+func (p *Publisher) message(e hooks.Event) (kafkago.Message, error) {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return kafkago.Message{}, err
+	}
+	return kafkago.Message{
+		Key:   []byte(e.Upload.ID),
+		Value: value,
+		Time:  e.Time,
+		Headers: []kafkago.Header{
+			{Key: "event-type", Value: []byte(e.Type)},
+			{Key: "content-type", Value: []byte("application/json")},
+		},
+	}, nil
+}
+
+// Close waits for the pending writes and closes the writer.
+func (p *Publisher) Close() error {
+	p.AsyncPublisher.Close()
+	return p.writer.Close()
+}
@@ -0,0 +1,30 @@
+package kafka
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	e := hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: "a", Size: 5, Offset: 5})
+
+	t.Run("message must be keyed by the upload id", func(t *testing.T) {
+		p := NewPublisher([]string{"localhost:9092"}, "uploads")
+		defer p.Close()
+
+		msg, err := p.message(e)
+		assert.NoError(t, err)
+		assert.Equal(t, "a", string(msg.Key))
+		assert.Equal(t, e.Time, msg.Time)
+
+		var decoded hooks.Event
+		assert.NoError(t, json.Unmarshal(msg.Value, &decoded))
+		assert.Equal(t, e.ID, decoded.ID)
+		assert.Equal(t, hooks.EventCompleted, decoded.Type)
+		assert.Contains(t, msg.Headers, kafkago.Header{Key: "event-type", Value: []byte("upload.completed")})
+	})
+}
@@ -0,0 +1,144 @@
+// Package nats publishes upload lifecycle events to NATS JetStream, for
+// deployments fanning out notifications without running Kafka.
+//
+// Every event is published with its id as the JetStream message id, so that
+// the stream discards duplicates within its deduplication window. The
+// payload is the JSON encoding of hooks.Event, described by the schemas in
+// the hooks package. A stream capturing the subjects must exist.
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// DefaultSubject publishes the events of every tenant under its own
+	// subject, e.g. uploads.acme.completed.
+	DefaultSubject = "uploads.{tenant}.{event}"
+
+	// defaultTenant replaces the tenant of uploads which have none.
+	defaultTenant = "default"
+)
+
+type Options struct {
+	Subject        string
+	TenantSubjects map[string]string
+}
+
+type Option func(*Options)
+
+// WithSubject sets the template of the subjects. {tenant} is replaced by
+// the tenant of the upload and {event} by the type of the event without its
+// upload. prefix.
+func WithSubject(template string) Option {
+	return func(o *Options) {
+		o.Subject = template
+	}
+}
+
+// WithTenantSubjects overrides the subject template of the given tenants.
+func WithTenantSubjects(templates map[string]string) Option {
+	return func(o *Options) {
+		o.TenantSubjects = templates
+	}
+}
+
+// Publisher publishes events in the background so that publishing never
+// delays the upload requests. Publications which aren't acknowledged are
+// logged.
+type Publisher struct {
+	*hooks.AsyncPublisher
+
+	js             jetstream.JetStream
+	subject        string
+	tenantSubjects map[string]string
+}
+
+// NewPublisher publishes on the JetStream of nc, which stays owned by the
+// caller.
+func NewPublisher(nc *natsgo.Conn, opts ...Option) (*Publisher, error) {
+	o := Options{
+		Subject: DefaultSubject,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	p := &Publisher{
+		js:             js,
+		subject:        o.Subject,
+		tenantSubjects: o.TenantSubjects,
+	}
+	p.AsyncPublisher = hooks.NewAsyncPublisher("nats", p.send)
+	return p, nil
+}
+
+// send publishes e and waits for the stream to acknowledge it.
+func (p *Publisher) send(ctx context.Context, e hooks.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	msg := &natsgo.Msg{
+		Subject: p.subjectOf(e),
+		Data:    data,
+		Header:  natsgo.Header{},
+	}
+	msg.Header.Set("Event-Type", string(e.Type))
+	msg.Header.Set("Content-Type", "application/json")
+	_, err = p.js.PublishMsg(ctx, msg, jetstream.WithMsgID(e.ID))
+	return err
+}
+
+// subjectOf returns the subject e is published on.
+func (p *Publisher) subjectOf(e hooks.Event) string {
+	tenant := e.Upload.Tenant
+	template, ok := p.tenantSubjects[tenant]
+	if !ok {
+		template = p.subject
+	}
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	return strings.NewReplacer(
+		"{tenant}", subjectToken(tenant),
+		"{event}", subjectToken(strings.TrimPrefix(string(e.Type), "upload.")),
+	).Replace(template)
+}
+
+// subjectToken replaces the characters which aren't allowed in a token of a
+// subject.
+func subjectToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Close waits for the pending publications to be acknowledged, at most
+// until ctx is done.
+func (p *Publisher) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.AsyncPublisher.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,37 @@
+package nats
+
+import (
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubjectOf(t *testing.T) {
+	event := func(tenant string) hooks.Event {
+		return hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: "a", Tenant: tenant})
+	}
+
+	t.Run("subject must include the tenant and the event", func(t *testing.T) {
+		p := &Publisher{subject: DefaultSubject}
+
+		assert.Equal(t, "uploads.acme.completed", p.subjectOf(event("acme")))
+		assert.Equal(t, "uploads.default.completed", p.subjectOf(event("")))
+	})
+
+	t.Run("tenant must not add tokens or wildcards to the subject", func(t *testing.T) {
+		p := &Publisher{subject: DefaultSubject}
+
+		assert.Equal(t, "uploads.acme_corp__.completed", p.subjectOf(event("acme.corp >")))
+	})
+
+	t.Run("tenant subject must override the template", func(t *testing.T) {
+		p := &Publisher{
+			subject:        DefaultSubject,
+			tenantSubjects: map[string]string{"acme": "acme.uploads.{event}"},
+		}
+
+		assert.Equal(t, "acme.uploads.completed", p.subjectOf(event("acme")))
+		assert.Equal(t, "uploads.globex.completed", p.subjectOf(event("globex")))
+	})
+}
@@ -0,0 +1,102 @@
+// Package pubsub publishes upload lifecycle events to a Google Cloud Pub/Sub
+// topic, for the deployments storing their uploads in GCS.
+//
+// Every event is published with the upload id as its ordering key, so that
+// subscriptions with message ordering enabled receive the events of an
+// upload in order. The data is the JSON encoding of hooks.Event, described by
+// the schemas in the hooks package, and the attributes allow subscriptions
+// to filter on the event type or the tenant.
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+
+	gcppubsub "cloud.google.com/go/pubsub"
+	"github.com/imrenagi/go-http-upload/hooks"
+)
+
+type Options struct {
+	Ordering bool
+}
+
+type Option func(*Options)
+
+// WithOrdering sets whether the events of an upload are published in order.
+// Ordering is enabled by default.
+func WithOrdering(enabled bool) Option {
+	return func(o *Options) {
+		o.Ordering = enabled
+	}
+}
+
+// Publisher publishes events in the background so that publishing never
+// delays the upload requests. Failed publications are retried by the
+// Pub/Sub client and logged once they give up.
+type Publisher struct {
+	*hooks.AsyncPublisher
+
+	topic    *gcppubsub.Topic
+	ordering bool
+}
+
+// NewPublisher publishes on the topic of client, which stays owned by the
+// caller.
+func NewPublisher(client *gcppubsub.Client, topicID string, opts ...Option) *Publisher {
+	o := Options{
+		Ordering: true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	topic := client.Topic(topicID)
+	topic.EnableMessageOrdering = o.Ordering
+	p := &Publisher{topic: topic, ordering: o.Ordering}
+	p.AsyncPublisher = hooks.NewAsyncPublisher("pubsub", p.send)
+	return p
+}
+
+// send publishes e to the topic.
+func (p *Publisher) send(ctx context.Context, e hooks.Event) error {
+	msg, err := p.message(e)
+	if err != nil {
+		return err
+	}
+	if _, err := p.topic.Publish(ctx, msg).Get(ctx); err != nil {
+		if msg.OrderingKey != "" {
+			// a failure pauses the ordering key until it is resumed.
+			p.topic.ResumePublish(msg.OrderingKey)
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *Publisher) message(e hooks.Event) (*gcppubsub.Message, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	msg := &gcppubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"event_id":     e.ID,
+			"event_type":   string(e.Type),
+			"upload_id":    e.Upload.ID,
+			"content_type": "application/json",
+		},
+	}
+	if e.Upload.Tenant != "" {
+		msg.Attributes["tenant"] = e.Upload.Tenant
+	}
+	if p.ordering {
+		msg.OrderingKey = e.Upload.ID
+	}
+	return msg, nil
+}
+
+// Close waits for the pending publications and stops the topic.
+func (p *Publisher) Close() {
+	p.AsyncPublisher.Close()
+	p.topic.Stop()
+}
@@ -0,0 +1,57 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	gcppubsub "cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client, err := gcppubsub.NewClient(ctx, "project", option.WithGRPCConn(conn))
+	assert.NoError(t, err)
+	defer client.Close()
+	_, err = client.CreateTopic(ctx, "uploads")
+	assert.NoError(t, err)
+
+	t.Run("event must be published with the upload id as ordering key", func(t *testing.T) {
+		p := NewPublisher(client, "uploads")
+		e := hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: "a", Tenant: "acme", Size: 5, Offset: 5})
+
+		p.Publish(ctx, e)
+		p.Close()
+
+		assert.Eventually(t, func() bool { return len(srv.Messages()) == 1 }, 5*time.Second, time.Millisecond)
+		msg := srv.Messages()[0]
+		assert.Equal(t, "a", msg.OrderingKey)
+		assert.Equal(t, "upload.completed", msg.Attributes["event_type"])
+		assert.Equal(t, "acme", msg.Attributes["tenant"])
+
+		var decoded hooks.Event
+		assert.NoError(t, json.Unmarshal(msg.Data, &decoded))
+		assert.Equal(t, e.ID, decoded.ID)
+	})
+
+	t.Run("event must not have an ordering key without ordering", func(t *testing.T) {
+		p := NewPublisher(client, "uploads", WithOrdering(false))
+
+		msg, err := p.message(hooks.NewEvent(hooks.EventCreated, hooks.Upload{ID: "a"}))
+		assert.NoError(t, err)
+		assert.Empty(t, msg.OrderingKey)
+		assert.NotContains(t, msg.Attributes, "tenant")
+	})
+}
@@ -0,0 +1,80 @@
+// Package sns publishes upload lifecycle events to an Amazon SNS topic, for
+// the deployments storing their uploads in S3 and fanning the events out to
+// several queues or functions.
+//
+// The message is the JSON encoding of hooks.Event, described by the schemas
+// in the hooks package, and the attributes allow subscription filter
+// policies on the event type or the tenant. On FIFO topics the upload id is
+// the message group and the event id deduplicates the retried publications.
+package sns
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssns "github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/imrenagi/go-http-upload/hooks"
+)
+
+// API is the part of the SNS client used by the publisher, implemented by
+// *sns.Client.
+type API interface {
+	Publish(ctx context.Context, params *awssns.PublishInput, optFns ...func(*awssns.Options)) (*awssns.PublishOutput, error)
+}
+
+// Publisher publishes events in the background so that publishing never
+// delays the upload requests. Failed publications are retried by the AWS
+// client and logged once they give up.
+type Publisher struct {
+	*hooks.AsyncPublisher
+
+	client   API
+	topicARN string
+	fifo     bool
+}
+
+func NewPublisher(client API, topicARN string, opts ...hooks.AsyncOption) *Publisher {
+	p := &Publisher{
+		client:   client,
+		topicARN: topicARN,
+		fifo:     strings.HasSuffix(topicARN, ".fifo"),
+	}
+	p.AsyncPublisher = hooks.NewAsyncPublisher("sns", p.send, opts...)
+	return p
+}
+
+// send publishes e to the topic.
+func (p *Publisher) send(ctx context.Context, e hooks.Event) error {
+	input, err := p.input(e)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.Publish(ctx, input)
+	return err
+}
+
+func (p *Publisher) input(e hooks.Event) (*awssns.PublishInput, error) {
+	message, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	input := &awssns.PublishInput{
+		TopicArn: aws.String(p.topicARN),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"event_type": {DataType: aws.String("String"), StringValue: aws.String(string(e.Type))},
+			"upload_id":  {DataType: aws.String("String"), StringValue: aws.String(e.Upload.ID)},
+		},
+	}
+	if e.Upload.Tenant != "" {
+		input.MessageAttributes["tenant"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(e.Upload.Tenant)}
+	}
+	if p.fifo {
+		input.MessageGroupId = aws.String(e.Upload.ID)
+		input.MessageDeduplicationId = aws.String(e.ID)
+	}
+	return input, nil
+}
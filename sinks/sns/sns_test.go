@@ -0,0 +1,51 @@
+package sns
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssns "github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSNS struct {
+	inputs []*awssns.PublishInput
+}
+
+func (f *fakeSNS) Publish(ctx context.Context, params *awssns.PublishInput, optFns ...func(*awssns.Options)) (*awssns.PublishOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &awssns.PublishOutput{}, nil
+}
+
+func TestPublish(t *testing.T) {
+	e := hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: "a", Tenant: "acme", Size: 5, Offset: 5})
+
+	t.Run("event must be published to the topic", func(t *testing.T) {
+		client := &fakeSNS{}
+		p := NewPublisher(client, "arn:aws:sns:eu-west-1:123456789012:uploads")
+
+		assert.NoError(t, p.send(context.Background(), e))
+
+		assert.Len(t, client.inputs, 1)
+		input := client.inputs[0]
+		assert.Equal(t, "upload.completed", aws.ToString(input.MessageAttributes["event_type"].StringValue))
+		assert.Equal(t, "acme", aws.ToString(input.MessageAttributes["tenant"].StringValue))
+		assert.Nil(t, input.MessageGroupId)
+
+		var decoded hooks.Event
+		assert.NoError(t, json.Unmarshal([]byte(aws.ToString(input.Message)), &decoded))
+		assert.Equal(t, e.ID, decoded.ID)
+	})
+
+	t.Run("event must be grouped by upload on a FIFO topic", func(t *testing.T) {
+		p := NewPublisher(&fakeSNS{}, "arn:aws:sns:eu-west-1:123456789012:uploads.fifo")
+
+		input, err := p.input(e)
+		assert.NoError(t, err)
+		assert.Equal(t, "a", aws.ToString(input.MessageGroupId))
+		assert.Equal(t, e.ID, aws.ToString(input.MessageDeduplicationId))
+	})
+}
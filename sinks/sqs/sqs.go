@@ -0,0 +1,79 @@
+// Package sqs sends upload lifecycle events to an Amazon SQS queue, for the
+// deployments storing their uploads in S3.
+//
+// The body of every message is the JSON encoding of hooks.Event, described
+// by the schemas in the hooks package. On FIFO queues the upload id is the
+// message group, so that the events of an upload are received in order, and
+// the event id deduplicates the retried sends.
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/imrenagi/go-http-upload/hooks"
+)
+
+// API is the part of the SQS client used by the publisher, implemented by
+// *sqs.Client.
+type API interface {
+	SendMessage(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error)
+}
+
+// Publisher sends events in the background so that publishing never delays
+// the upload requests. Failed sends are retried by the AWS client and logged
+// once they give up.
+type Publisher struct {
+	*hooks.AsyncPublisher
+
+	client   API
+	queueURL string
+	fifo     bool
+}
+
+func NewPublisher(client API, queueURL string, opts ...hooks.AsyncOption) *Publisher {
+	p := &Publisher{
+		client:   client,
+		queueURL: queueURL,
+		fifo:     strings.HasSuffix(queueURL, ".fifo"),
+	}
+	p.AsyncPublisher = hooks.NewAsyncPublisher("sqs", p.send, opts...)
+	return p
+}
+
+// send sends e to the queue.
+func (p *Publisher) send(ctx context.Context, e hooks.Event) error {
+	input, err := p.input(e)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.SendMessage(ctx, input)
+	return err
+}
+
+func (p *Publisher) input(e hooks.Event) (*awssqs.SendMessageInput, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	input := &awssqs.SendMessageInput{
+		QueueUrl:    aws.String(p.queueURL),
+		MessageBody: aws.String(string(body)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"event_type": {DataType: aws.String("String"), StringValue: aws.String(string(e.Type))},
+			"upload_id":  {DataType: aws.String("String"), StringValue: aws.String(e.Upload.ID)},
+		},
+	}
+	if e.Upload.Tenant != "" {
+		input.MessageAttributes["tenant"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(e.Upload.Tenant)}
+	}
+	if p.fifo {
+		input.MessageGroupId = aws.String(e.Upload.ID)
+		input.MessageDeduplicationId = aws.String(e.ID)
+	}
+	return input, nil
+}
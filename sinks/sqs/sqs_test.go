@@ -0,0 +1,51 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSQS struct {
+	inputs []*awssqs.SendMessageInput
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &awssqs.SendMessageOutput{}, nil
+}
+
+func TestPublish(t *testing.T) {
+	e := hooks.NewEvent(hooks.EventCompleted, hooks.Upload{ID: "a", Tenant: "acme", Size: 5, Offset: 5})
+
+	t.Run("event must be sent to the queue", func(t *testing.T) {
+		client := &fakeSQS{}
+		p := NewPublisher(client, "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads")
+
+		assert.NoError(t, p.send(context.Background(), e))
+
+		assert.Len(t, client.inputs, 1)
+		input := client.inputs[0]
+		assert.Equal(t, "upload.completed", aws.ToString(input.MessageAttributes["event_type"].StringValue))
+		assert.Equal(t, "acme", aws.ToString(input.MessageAttributes["tenant"].StringValue))
+		assert.Nil(t, input.MessageGroupId)
+
+		var decoded hooks.Event
+		assert.NoError(t, json.Unmarshal([]byte(aws.ToString(input.MessageBody)), &decoded))
+		assert.Equal(t, e.ID, decoded.ID)
+	})
+
+	t.Run("event must be grouped by upload on a FIFO queue", func(t *testing.T) {
+		p := NewPublisher(&fakeSQS{}, "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads.fifo")
+
+		input, err := p.input(e)
+		assert.NoError(t, err)
+		assert.Equal(t, "a", aws.ToString(input.MessageGroupId))
+		assert.Equal(t, e.ID, aws.ToString(input.MessageDeduplicationId))
+	})
+}
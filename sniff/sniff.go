@@ -0,0 +1,166 @@
+// Package sniff detects the content type of uploads from their first bytes
+// and enforces which content types a deployment accepts, so that a file
+// declared as an image but holding an executable is caught before it is
+// stored.
+package sniff
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Len is the number of leading bytes the detection looks at.
+const Len = 512
+
+var (
+	ErrNotAllowed          = errors.New("content type is not allowed")
+	ErrMismatch            = errors.New("content does not match the declared content type")
+	ErrExtensionNotAllowed = errors.New("file extension is not allowed")
+)
+
+// MismatchAction is what a Policy does with uploads whose content doesn't
+// match their declared content type.
+type MismatchAction int
+
+const (
+	MismatchIgnore MismatchAction = iota
+	// MismatchFlag accepts the upload but records the mismatch.
+	MismatchFlag
+	MismatchReject
+)
+
+// Policy lists the content types a deployment accepts. Entries are media
+// types, e.g. image/png, or wildcards of a type, e.g. image/*. A content type
+// is allowed when it isn't denied and, if Allow isn't empty, is allowed.
+//
+// The detection of net/http only knows a few dozen formats: unknown binary
+// content is application/octet-stream and unknown text is text/plain, which
+// an allowlist must include to accept them.
+//
+// AllowExtensions and DenyExtensions restrict the extensions of the file
+// names the same way, e.g. .pdf, case insensitively. They are only enforced
+// by the v1 API, whose files are named by the request.
+type Policy struct {
+	Allow    []string
+	Deny     []string
+	Mismatch MismatchAction
+
+	AllowExtensions []string
+	DenyExtensions  []string
+}
+
+// Detect returns the media type of content starting with head.
+func Detect(head []byte) string {
+	return mediaType(http.DetectContentType(head))
+}
+
+// Allowed reports whether the policy accepts contentType.
+func (p Policy) Allowed(contentType string) bool {
+	t := mediaType(contentType)
+	if matchAny(p.Deny, t) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchAny(p.Allow, t)
+}
+
+// ExtensionAllowed reports whether the policy accepts the extension of the
+// file name. Names without extension are only accepted without allowlist.
+func (p Policy) ExtensionAllowed(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if matchExtension(p.DenyExtensions, ext) {
+		return false
+	}
+	return len(p.AllowExtensions) == 0 || matchExtension(p.AllowExtensions, ext)
+}
+
+func matchExtension(exts []string, ext string) bool {
+	if ext == "" {
+		return false
+	}
+	for _, e := range exts {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Check validates the sniffed content type of an upload declared as
+// declared. It returns whether the mismatch must be flagged, or an error
+// when the upload must be rejected.
+func (p Policy) Check(declared, sniffed string) (bool, error) {
+	if !p.Allowed(sniffed) {
+		return false, fmt.Errorf("%w: %s", ErrNotAllowed, mediaType(sniffed))
+	}
+	if p.Mismatch == MismatchIgnore || !Mismatch(declared, sniffed) {
+		return false, nil
+	}
+	if p.Mismatch == MismatchReject {
+		return false, fmt.Errorf("%w: declared %s, detected %s", ErrMismatch, mediaType(declared), mediaType(sniffed))
+	}
+	return true, nil
+}
+
+// Mismatch reports whether content detected as sniffed contradicts the
+// declared content type. Generic detections, like text/plain, only
+// contradict declarations of another family.
+func Mismatch(declared, sniffed string) bool {
+	d, s := mediaType(declared), mediaType(sniffed)
+	if d == "" || d == s {
+		return false
+	}
+	switch s {
+	case "application/octet-stream":
+		return false
+	case "text/plain":
+		return !isText(d)
+	case "application/zip":
+		// office documents, jars and epubs are zip archives.
+		return !strings.Contains(d, "zip") && !strings.Contains(d, "openxmlformats") &&
+			!strings.Contains(d, "opendocument") && d != "application/java-archive"
+	}
+	return true
+}
+
+func isText(t string) bool {
+	if strings.HasPrefix(t, "text/") {
+		return true
+	}
+	switch t {
+	case "application/json", "application/xml", "application/javascript", "application/x-yaml", "application/yaml":
+		return true
+	}
+	return strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml")
+}
+
+func matchAny(patterns []string, t string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if prefix, ok := strings.CutSuffix(p, "/*"); ok {
+			if strings.HasPrefix(t, prefix+"/") {
+				return true
+			}
+		} else if p == t || p == "*/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType returns the lower cased media type of a content type, without
+// its parameters.
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t, _, _ = strings.Cut(contentType, ";")
+	}
+	return strings.ToLower(strings.TrimSpace(t))
+}
@@ -0,0 +1,93 @@
+package sniff_test
+
+import (
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/sniff"
+	"github.com/stretchr/testify/assert"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestDetect(t *testing.T) {
+	assert.Equal(t, "image/png", sniff.Detect(pngHeader))
+	assert.Equal(t, "text/plain", sniff.Detect([]byte("hello")))
+	assert.Equal(t, "application/octet-stream", sniff.Detect([]byte{0x00, 0x01, 0x02}))
+}
+
+func TestPolicy(t *testing.T) {
+	t.Run("every content type must be allowed by an empty policy", func(t *testing.T) {
+		assert.True(t, sniff.Policy{}.Allowed("application/x-msdownload"))
+	})
+
+	t.Run("content type must match the allowlist", func(t *testing.T) {
+		p := sniff.Policy{Allow: []string{"image/*", "application/pdf"}}
+
+		assert.True(t, p.Allowed("image/png"))
+		assert.True(t, p.Allowed("application/pdf"))
+		assert.False(t, p.Allowed("text/html; charset=utf-8"))
+	})
+
+	t.Run("denied content type must not be allowed", func(t *testing.T) {
+		p := sniff.Policy{Allow: []string{"image/*"}, Deny: []string{"image/svg+xml"}}
+
+		assert.True(t, p.Allowed("image/png"))
+		assert.False(t, p.Allowed("image/svg+xml"))
+	})
+
+	t.Run("mismatch must be flagged", func(t *testing.T) {
+		p := sniff.Policy{Mismatch: sniff.MismatchFlag}
+
+		flagged, err := p.Check("image/jpeg", "image/png")
+		assert.NoError(t, err)
+		assert.True(t, flagged)
+	})
+
+	t.Run("mismatch must be rejected", func(t *testing.T) {
+		p := sniff.Policy{Mismatch: sniff.MismatchReject}
+
+		_, err := p.Check("image/jpeg", "text/html; charset=utf-8")
+		assert.ErrorIs(t, err, sniff.ErrMismatch)
+	})
+
+	t.Run("disallowed content must be rejected", func(t *testing.T) {
+		p := sniff.Policy{Deny: []string{"text/html"}}
+
+		_, err := p.Check("image/png", "text/html; charset=utf-8")
+		assert.ErrorIs(t, err, sniff.ErrNotAllowed)
+	})
+}
+
+func TestExtensionAllowed(t *testing.T) {
+	t.Run("every extension must be allowed by an empty policy", func(t *testing.T) {
+		assert.True(t, sniff.Policy{}.ExtensionAllowed("setup.exe"))
+		assert.True(t, sniff.Policy{}.ExtensionAllowed("README"))
+	})
+
+	t.Run("extension must match the allowlist", func(t *testing.T) {
+		p := sniff.Policy{AllowExtensions: []string{".pdf", "PNG"}}
+
+		assert.True(t, p.ExtensionAllowed("report.PDF"))
+		assert.True(t, p.ExtensionAllowed("photo.png"))
+		assert.False(t, p.ExtensionAllowed("photo.png.exe"))
+		assert.False(t, p.ExtensionAllowed("README"))
+	})
+
+	t.Run("denied extension must not be allowed", func(t *testing.T) {
+		p := sniff.Policy{DenyExtensions: []string{".exe", ".sh"}}
+
+		assert.True(t, p.ExtensionAllowed("report.pdf"))
+		assert.False(t, p.ExtensionAllowed("setup.EXE"))
+		assert.True(t, p.ExtensionAllowed("README"))
+	})
+}
+
+func TestMismatch(t *testing.T) {
+	assert.False(t, sniff.Mismatch("image/png", "image/png"))
+	assert.False(t, sniff.Mismatch("application/json", "text/plain; charset=utf-8"))
+	assert.False(t, sniff.Mismatch("application/x-custom", "application/octet-stream"))
+	assert.False(t, sniff.Mismatch("application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip"))
+	assert.False(t, sniff.Mismatch("", "image/png"))
+	assert.True(t, sniff.Mismatch("image/png", "text/plain; charset=utf-8"))
+	assert.True(t, sniff.Mismatch("image/png", "application/pdf"))
+}
@@ -0,0 +1,154 @@
+// Package thumbnail generates thumbnails of uploaded images in the
+// background, once their upload is complete.
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/imrenagi/go-http-upload/workerpool"
+	"github.com/rs/zerolog/log"
+)
+
+// ContentType is the content type of the generated thumbnails.
+const ContentType = "image/jpeg"
+
+// ErrQueueFull is returned by Worker.Enqueue when the queue has no room for
+// another job.
+var ErrQueueFull = errors.New("thumbnail queue is full")
+
+// Supported reports whether thumbnails can be generated from files of the
+// given content type.
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Generate decodes the image read from r and writes a JPEG thumbnail of it
+// to w, scaled so that its longest side is size pixels. Images smaller than
+// size are not enlarged.
+func Generate(r io.Reader, w io.Writer, size int) error {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+
+	// JPEG has no transparency, so transparent areas become white.
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	scale(dst, src)
+	return jpeg.Encode(w, dst, &jpeg.Options{Quality: 85})
+}
+
+// scale draws src over dst, averaging the source pixels covered by every
+// destination pixel.
+func scale(dst *image.RGBA, src image.Image) {
+	sb := src.Bounds()
+	db := dst.Bounds()
+	for y := 0; y < db.Dy(); y++ {
+		y0 := sb.Min.Y + y*sb.Dy()/db.Dy()
+		y1 := max(y0+1, sb.Min.Y+(y+1)*sb.Dy()/db.Dy())
+		for x := 0; x < db.Dx(); x++ {
+			x0 := sb.Min.X + x*sb.Dx()/db.Dx()
+			x1 := max(x0+1, sb.Min.X+(x+1)*sb.Dx()/db.Dx())
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// blend the premultiplied average over the white background.
+			r, g, b, a = r/n, g/n, b/n, a/n
+			inv := 0xffff - a
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r + inv) >> 8),
+				G: uint8((g + inv) >> 8),
+				B: uint8((b + inv) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+}
+
+// Job describes where the image of an upload is read from and where each of
+// its thumbnails is written to. Done is called once every thumbnail was
+// written, or with the first error.
+type Job struct {
+	ID     string
+	Open   func(ctx context.Context) (io.ReadCloser, error)
+	Create func(ctx context.Context, size int) (io.WriteCloser, error)
+	Done   func(sizes []int, err error)
+}
+
+// Worker generates thumbnails of the configured sizes for the jobs queued
+// by the upload handlers, so that completing an upload doesn't wait for
+// image processing.
+type Worker struct {
+	*workerpool.Pool[Job]
+	sizes []int
+}
+
+func NewWorker(sizes []int, concurrency, queueSize int) *Worker {
+	w := &Worker{sizes: sizes}
+	w.Pool = workerpool.New(concurrency, queueSize, ErrQueueFull, func(ctx context.Context, job Job) {
+		job.Done(w.process(ctx, job))
+	})
+	return w
+}
+
+// Sizes returns the sizes of the thumbnails generated for every job.
+func (w *Worker) Sizes() []int {
+	return w.sizes
+}
+
+func (w *Worker) process(ctx context.Context, job Job) ([]int, error) {
+	var done []int
+	for _, size := range w.sizes {
+		if err := w.generate(ctx, job, size); err != nil {
+			log.Warn().Err(err).Str("file_id", job.ID).Int("size", size).Msg("unable to generate thumbnail")
+			return done, err
+		}
+		done = append(done, size)
+	}
+	log.Debug().Str("file_id", job.ID).Ints("sizes", done).Msg("thumbnails generated")
+	return done, nil
+}
+
+func (w *Worker) generate(ctx context.Context, job Job, size int) error {
+	src, err := job.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := job.Create(ctx, size)
+	if err != nil {
+		return err
+	}
+	if err := Generate(src, dst, size); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,131 @@
+package thumbnail_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/thumbnail"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPNG(t *testing.T, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: 0xff, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestGenerate(t *testing.T) {
+	t.Run("thumbnail must keep the aspect ratio of the image", func(t *testing.T) {
+		var out bytes.Buffer
+		err := thumbnail.Generate(bytes.NewReader(newPNG(t, 300, 600)), &out, 100)
+		assert.NoError(t, err)
+
+		img, err := jpeg.Decode(&out)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 50, 100), img.Bounds())
+		r, g, b, _ := img.At(25, 50).RGBA()
+		assert.Greater(t, r>>8, uint32(0xf0))
+		assert.Less(t, g>>8, uint32(0x10))
+		assert.Less(t, b>>8, uint32(0x10))
+	})
+
+	t.Run("images smaller than the thumbnail must not be enlarged", func(t *testing.T) {
+		var out bytes.Buffer
+		err := thumbnail.Generate(bytes.NewReader(newPNG(t, 20, 10)), &out, 100)
+		assert.NoError(t, err)
+
+		img, err := jpeg.Decode(&out)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 20, 10), img.Bounds())
+	})
+
+	t.Run("content which isn't an image must return an error", func(t *testing.T) {
+		var out bytes.Buffer
+		err := thumbnail.Generate(bytes.NewBufferString("hello"), &out, 100)
+		assert.ErrorIs(t, err, image.ErrFormat)
+	})
+}
+
+func TestWorker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := thumbnail.NewWorker([]int{16, 32}, 2, 1)
+	go w.Run(ctx)
+
+	t.Run("job must be done once every thumbnail is written", func(t *testing.T) {
+		img := newPNG(t, 64, 64)
+		outputs := make(map[int]*bytes.Buffer)
+		done := make(chan []int, 1)
+		err := w.Enqueue(thumbnail.Job{
+			ID: "a",
+			Open: func(ctx context.Context) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(img)), nil
+			},
+			Create: func(ctx context.Context, size int) (io.WriteCloser, error) {
+				outputs[size] = &bytes.Buffer{}
+				return nopWriteCloser{outputs[size]}, nil
+			},
+			Done: func(sizes []int, err error) {
+				assert.NoError(t, err)
+				done <- sizes
+			},
+		})
+		assert.NoError(t, err)
+
+		select {
+		case sizes := <-done:
+			assert.Equal(t, []int{16, 32}, sizes)
+			assert.Len(t, outputs, 2)
+		case <-time.After(5 * time.Second):
+			t.Fatal("job was not processed")
+		}
+	})
+
+	t.Run("job must report the error of the source", func(t *testing.T) {
+		done := make(chan error, 1)
+		err := w.Enqueue(thumbnail.Job{
+			ID: "b",
+			Open: func(ctx context.Context) (io.ReadCloser, error) {
+				return nil, errors.New("boom")
+			},
+			Done: func(sizes []int, err error) {
+				assert.Empty(t, sizes)
+				done <- err
+			},
+		})
+		assert.NoError(t, err)
+
+		select {
+		case err := <-done:
+			assert.EqualError(t, err, "boom")
+		case <-time.After(5 * time.Second):
+			t.Fatal("job was not processed")
+		}
+	})
+
+	t.Run("enqueue must fail when the queue is full", func(t *testing.T) {
+		w := thumbnail.NewWorker([]int{16}, 1, 1)
+		assert.NoError(t, w.Enqueue(thumbnail.Job{ID: "a"}))
+		assert.ErrorIs(t, w.Enqueue(thumbnail.Job{ID: "b"}), thumbnail.ErrQueueFull)
+	})
+}
@@ -0,0 +1,200 @@
+package tusclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errPartFailed cancels the partial uploads of an upload when one of them
+// failed, which mustn't terminate them.
+var errPartFailed = errors.New("partial upload failed")
+
+// uploadParallel sends r in o.Parallel partial uploads over concurrent
+// connections, and returns the URL of their concatenation.
+func (c *Client) uploadParallel(ctx context.Context, r io.ReaderAt, size int64, o Options) (string, error) {
+	n := min(int64(o.Parallel), size)
+	partSize := (size + n - 1) / n
+	partCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	pp := &parallelProgress{fn: o.Progress, size: size, offsets: make([]int64, n), started: make([]bool, n)}
+	urls := make([]string, n)
+	errs := make([]error, n)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := range n {
+		po := o
+		po.Progress = pp.part(int(i))
+		if o.Fingerprint != "" {
+			po.Fingerprint = partFingerprint(o.Fingerprint, int(i))
+		}
+		start := i * partSize
+		u := &upload{
+			client:  c,
+			opts:    po,
+			r:       io.NewSectionReader(r, start, min(partSize, size-start)),
+			size:    min(partSize, size-start),
+			partial: true,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			url, err := u.run(partCtx)
+			if err != nil {
+				errs[i] = err
+				// the other parts can't be concatenated anymore.
+				once.Do(func() {
+					firstErr = fmt.Errorf("partial upload %d: %w", i, err)
+					cancel(errPartFailed)
+				})
+				return
+			}
+			urls[i] = url
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		if ctx.Err() != nil {
+			return "", c.cancelledParts(ctx, o, urls, errs, size, partSize)
+		}
+		return "", firstErr
+	}
+
+	u := &upload{client: c, opts: o, size: size}
+	url, err := u.concat(ctx, urls)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the parts are complete, and stay recorded to be concatenated
+			// by another call.
+			return "", &CancelledError{Offset: size, Err: ctx.Err()}
+		}
+		return "", err
+	}
+	if o.Fingerprint != "" {
+		for i := range n {
+			if err := o.Store.Delete(partFingerprint(o.Fingerprint, int(i))); err != nil {
+				o.Logger.Warn().Err(err).Msg("unable to forget the completed partial upload")
+			}
+		}
+	}
+	pp.complete(url)
+	return url, nil
+}
+
+// cancelledParts aborts the partial uploads complete before ctx was
+// cancelled, the others being aborted by themselves, and returns the
+// cancellation of the whole upload.
+func (c *Client) cancelledParts(ctx context.Context, o Options, urls []string, errs []error, size, partSize int64) error {
+	e := &CancelledError{Terminated: true, Err: ctx.Err()}
+	for i, url := range urls {
+		if url != "" {
+			u := &upload{client: c, opts: o}
+			if o.Fingerprint != "" {
+				u.opts.Fingerprint = partFingerprint(o.Fingerprint, i)
+			}
+			e.Offset += min(partSize, size-int64(i)*partSize)
+			e.Terminated = u.abort(ctx, url) && e.Terminated
+			continue
+		}
+		var pe *CancelledError
+		if errors.As(errs[i], &pe) {
+			e.Offset += pe.Offset
+			e.Terminated = pe.Terminated && e.Terminated
+		} else {
+			e.Terminated = false
+		}
+	}
+	if e.Terminated {
+		e.Offset = 0
+	}
+	return e
+}
+
+// concat creates the final upload concatenating the partial uploads at
+// urls, and returns its URL.
+func (u *upload) concat(ctx context.Context, urls []string) (string, error) {
+	req, err := u.request(ctx, http.MethodPost, u.client.endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Upload-Concat", "final;"+strings.Join(urls, " "))
+	if len(u.opts.Metadata) > 0 {
+		md, err := EncodeMetadata(u.opts.Metadata)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Upload-Metadata", md)
+	}
+	resp, err := u.opts.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", statusError(resp)
+	}
+	return u.client.location(resp)
+}
+
+// partFingerprint identifies the i-th partial upload of the upload of
+// fingerprint in the store.
+func partFingerprint(fingerprint string, i int) string {
+	return fmt.Sprintf("%s#part-%d", fingerprint, i)
+}
+
+// parallelProgress reports the sum of the progress of partial uploads.
+// Their completion isn't reported, the one of the final upload is.
+type parallelProgress struct {
+	mu          sync.Mutex
+	fn          func(Progress)
+	size        int64
+	offsets     []int64
+	started     []bool
+	startOffset int64
+	startedAt   time.Time
+}
+
+// part returns the progress callback of the i-th partial upload.
+func (p *parallelProgress) part(i int) func(Progress) {
+	if p.fn == nil {
+		return nil
+	}
+	return func(pr Progress) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.startedAt.IsZero() {
+			p.startedAt = time.Now()
+		}
+		if !p.started[i] {
+			p.started[i] = true
+			p.startOffset += pr.Offset
+		}
+		p.offsets[i] = pr.Offset
+		var offset int64
+		for _, o := range p.offsets {
+			offset += o
+		}
+		if offset < p.size {
+			p.fn(newProgress("", offset, p.size, p.startOffset, p.startedAt))
+		}
+	}
+}
+
+// complete reports the completion of the final upload at url.
+func (p *parallelProgress) complete(url string) {
+	if p.fn == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fn(newProgress(url, p.size, p.size, p.startOffset, p.startedAt))
+}
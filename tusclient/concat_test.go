@@ -0,0 +1,203 @@
+package tusclient_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// concatServer is a tus server of the creation and concatenation
+// extensions, keeping the uploads in memory. It advertises the extensions
+// in its response to OPTIONS.
+type concatServer struct {
+	extensions string
+
+	mu      sync.Mutex
+	uploads map[string]*bytes.Buffer
+	sizes   map[string]int64
+	next    atomic.Int32
+	patches atomic.Int32
+}
+
+func newConcatServer(t *testing.T, extensions ...string) (*httptest.Server, *concatServer) {
+	s := &concatServer{
+		extensions: strings.Join(extensions, ","),
+		uploads:    map[string]*bytes.Buffer{},
+		sizes:      map[string]int64{},
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv, s
+}
+
+func (s *concatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := path.Base(r.URL.Path)
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Tus-Extension", s.extensions)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		id = fmt.Sprint(s.next.Add(1))
+		concat := r.Header.Get("Upload-Concat")
+		if parts, ok := strings.CutPrefix(concat, "final;"); ok {
+			final := &bytes.Buffer{}
+			for _, url := range strings.Split(parts, " ") {
+				part := s.uploads[path.Base(url)]
+				if part == nil || int64(part.Len()) != s.sizes[path.Base(url)] {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				final.Write(part.Bytes())
+			}
+			s.uploads[id], s.sizes[id] = final, int64(final.Len())
+		} else {
+			size, _ := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+			s.uploads[id], s.sizes[id] = &bytes.Buffer{}, size
+			if r.Header.Get("Content-Type") == "application/offset+octet-stream" {
+				s.uploads[id].ReadFrom(r.Body)
+			}
+		}
+		w.Header().Set("Location", "/files/"+id)
+		w.Header().Set("Upload-Offset", strconv.Itoa(s.uploads[id].Len()))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.Itoa(s.uploads[id].Len()))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		s.patches.Add(1)
+		b := s.uploads[id]
+		if r.Header.Get("Upload-Offset") != strconv.Itoa(b.Len()) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		b.ReadFrom(r.Body)
+		w.Header().Set("Upload-Offset", strconv.Itoa(b.Len()))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestUploadParallel(t *testing.T) {
+	data := content(1<<20 + 100)
+
+	t.Run("partial uploads must be concatenated in order", func(t *testing.T) {
+		srv, s := newConcatServer(t, "creation", "concatenation")
+		var last tusclient.Progress
+		client := tusclient.New(srv.URL+"/files",
+			tusclient.WithParallel(4),
+			tusclient.WithProgress(func(p tusclient.Progress) { last = p }))
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(4), s.patches.Load())
+		assert.Equal(t, data, s.uploads[path.Base(url)].Bytes())
+		assert.Equal(t, url, last.URL)
+		assert.Equal(t, int64(len(data)), last.Offset)
+	})
+
+	t.Run("completed partial uploads must be forgotten once concatenated", func(t *testing.T) {
+		srv, _ := newConcatServer(t, "creation", "concatenation")
+		store := tusclient.NewMemoryStore()
+		client := tusclient.New(srv.URL+"/files",
+			tusclient.WithParallel(3),
+			tusclient.WithStore(store),
+			tusclient.WithFingerprint("data.bin"))
+
+		_, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		for i := range 3 {
+			_, ok, err := store.Get(fmt.Sprintf("data.bin#part-%d", i))
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		}
+	})
+
+	t.Run("upload smaller than the number of parts must be split in single bytes", func(t *testing.T) {
+		srv, s := newConcatServer(t, "creation", "concatenation")
+		client := tusclient.New(srv.URL+"/files", tusclient.WithParallel(8))
+
+		url, err := client.Upload(context.Background(), bytes.NewReader([]byte("abc")))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", s.uploads[path.Base(url)].String())
+	})
+}
+
+func TestCreationWithUpload(t *testing.T) {
+	data := content(1<<20 + 100)
+
+	t.Run("first chunk must be sent with the creation when the server supports it", func(t *testing.T) {
+		srv, s := newConcatServer(t, "creation", tusclient.CreationWithUploadExtension)
+		client := tusclient.New(srv.URL+"/files", tusclient.WithChunkSize(512<<10))
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(2), s.patches.Load())
+		assert.Equal(t, data, s.uploads[path.Base(url)].Bytes())
+	})
+
+	t.Run("upload must be created empty when the server doesn't support it", func(t *testing.T) {
+		srv, s := newConcatServer(t, "creation")
+		client := tusclient.New(srv.URL+"/files", tusclient.WithChunkSize(512<<10))
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(3), s.patches.Load())
+		assert.Equal(t, data, s.uploads[path.Base(url)].Bytes())
+	})
+}
+
+func TestNegotiate(t *testing.T) {
+	data := content(1 << 10)
+
+	t.Run("upload must fail fast when the server doesn't speak the tus version", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Tus-Version", "0.2.0")
+			w.Header().Set("Tus-Extension", "creation")
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		_, err := tusclient.New(srv.URL+"/files").Upload(context.Background(), bytes.NewReader(data))
+
+		assert.ErrorIs(t, err, tusclient.ErrUnsupported)
+	})
+
+	t.Run("upload must fail fast when it is larger than the max size", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Tus-Extension", "creation")
+			w.Header().Set("Tus-Max-Size", "100")
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		_, err := tusclient.New(srv.URL+"/files").Upload(context.Background(), bytes.NewReader(data))
+
+		assert.ErrorIs(t, err, tusclient.ErrUnsupported)
+	})
+
+	t.Run("parallel upload must fail fast without the concatenation extension", func(t *testing.T) {
+		srv, s := newConcatServer(t, "creation")
+
+		_, err := tusclient.New(srv.URL+"/files", tusclient.WithParallel(2)).Upload(context.Background(), bytes.NewReader(data))
+
+		assert.ErrorIs(t, err, tusclient.ErrUnsupported)
+		assert.Empty(t, s.uploads)
+	})
+}
@@ -0,0 +1,149 @@
+package tusclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The extensions of the protocol the client relies on.
+const (
+	CreationExtension      = "creation"
+	ConcatenationExtension = "concatenation"
+	ChecksumExtension      = "checksum"
+	// CreationWithUploadExtension is the extension of the servers
+	// accepting the first chunk of an upload in the body of its creation
+	// request.
+	CreationWithUploadExtension = "creation-with-upload"
+)
+
+// ErrUnsupported is returned before sending an upload the server
+// advertises it can't receive.
+var ErrUnsupported = errors.New("unsupported by the server")
+
+// Capabilities are what the server advertises in its response to OPTIONS.
+type Capabilities struct {
+	Versions   []string
+	Extensions []string
+	// MaxSize is the size of the largest upload the server accepts, zero
+	// when it has no limit.
+	MaxSize            int64
+	ChecksumAlgorithms []string
+	// DraftVersions are the interop versions of the IETF resumable uploads
+	// draft the server speaks.
+	DraftVersions []string
+}
+
+// Supports reports whether the server advertises the extension ext.
+func (c Capabilities) Supports(ext string) bool {
+	return slices.Contains(c.Extensions, ext)
+}
+
+// Capabilities asks the server its capabilities with an OPTIONS request,
+// once per client.
+func (c *Client) Capabilities(ctx context.Context) (Capabilities, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.caps != nil {
+		return *c.caps, nil
+	}
+	u := &upload{client: c, opts: c.opts}
+	req, err := u.request(ctx, http.MethodOptions, c.endpoint, nil)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return Capabilities{}, statusError(resp)
+	}
+	caps := Capabilities{
+		Versions:           splitList(resp.Header.Get("Tus-Version")),
+		Extensions:         splitList(resp.Header.Get("Tus-Extension")),
+		ChecksumAlgorithms: splitList(resp.Header.Get("Tus-Checksum-Algorithm")),
+		DraftVersions:      splitList(resp.Header.Get("Upload-Draft-Interop-Version")),
+	}
+	if v := resp.Header.Get("Tus-Max-Size"); v != "" {
+		if caps.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return Capabilities{}, fmt.Errorf("invalid Tus-Max-Size header: %w", err)
+		}
+	}
+	c.caps = &caps
+	return caps, nil
+}
+
+// capabilities returns the capabilities of the server, none when it
+// doesn't answer OPTIONS, so that the upload falls back to the core
+// protocol.
+func (u *upload) capabilities(ctx context.Context) Capabilities {
+	caps, err := u.client.Capabilities(ctx)
+	if err != nil {
+		u.opts.Logger.Debug().Err(err).Msg("unable to discover the capabilities of the server")
+	}
+	return caps
+}
+
+// negotiate adapts o to what the server advertises for an upload of size,
+// and fails when the server can't receive it. Nothing is checked when the
+// server doesn't answer OPTIONS, as the core protocol doesn't require it.
+func (c *Client) negotiate(ctx context.Context, o Options, size int64) (Options, error) {
+	caps, err := c.Capabilities(ctx)
+	if err != nil {
+		o.Logger.Debug().Err(err).Msg("unable to discover the capabilities of the server")
+		o.Checksum = ""
+		o.IETFDraft = false
+		return o, nil
+	}
+	if o.IETFDraft {
+		if o.Parallel <= 1 && slices.Contains(caps.DraftVersions, DraftInteropVersion) {
+			return negotiateDraft(o, caps, size)
+		}
+		o.Logger.Debug().Strs("draft_versions", caps.DraftVersions).Msg("the upload can't be sent with the resumable uploads draft, falling back to tus")
+		o.IETFDraft = false
+	}
+	if len(caps.Versions) > 0 && !slices.Contains(caps.Versions, o.TusVersion) {
+		return o, fmt.Errorf("%w: tus version %s, the server speaks %s", ErrUnsupported, o.TusVersion, strings.Join(caps.Versions, ", "))
+	}
+	if !caps.Supports(CreationExtension) {
+		return o, fmt.Errorf("%w: the server doesn't support the %s extension", ErrUnsupported, CreationExtension)
+	}
+	if caps.MaxSize > 0 && size > caps.MaxSize {
+		return o, fmt.Errorf("%w: the upload is %d bytes, the server accepts at most %d", ErrUnsupported, size, caps.MaxSize)
+	}
+	if o.Parallel > 1 && !caps.Supports(ConcatenationExtension) {
+		return o, fmt.Errorf("%w: parallel uploads need the %s extension", ErrUnsupported, ConcatenationExtension)
+	}
+	if o.Checksum != "" && (!caps.Supports(ChecksumExtension) || !slices.Contains(caps.ChecksumAlgorithms, o.Checksum)) {
+		o.Logger.Debug().Str("algorithm", o.Checksum).Msg("the server doesn't verify the checksum algorithm, the chunks are sent without checksum")
+		o.Checksum = ""
+	}
+	return o, nil
+}
+
+// negotiateDraft adapts o to an upload of size sent with the IETF
+// resumable uploads draft, which has no checksum.
+func negotiateDraft(o Options, caps Capabilities, size int64) (Options, error) {
+	if caps.MaxSize > 0 && size > caps.MaxSize {
+		return o, fmt.Errorf("%w: the upload is %d bytes, the server accepts at most %d", ErrUnsupported, size, caps.MaxSize)
+	}
+	o.Checksum = ""
+	return o, nil
+}
+
+// splitList splits the comma separated values of a header.
+func splitList(v string) []string {
+	var values []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
@@ -0,0 +1,242 @@
+package tusclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrChecksumMismatch is returned when the content downloaded doesn't
+// match the checksum the server reports.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// partSuffix is the suffix of the file a download is written to until it
+// is complete and verified.
+const partSuffix = ".part"
+
+// Download fetches the completed upload at url, e.g. the URL returned by
+// Upload, into the file at path, and returns its size.
+//
+// The content is written to path.part until it is complete, so that an
+// interrupted download, even by the end of the process, is resumed with a
+// Range request. Once complete, the content is verified against the
+// sha256 the server reports in its ETag before being renamed to path.
+func (c *Client) Download(ctx context.Context, url, path string, opts ...Option) (int64, error) {
+	o := c.opts
+	for _, opt := range opts {
+		opt(&o)
+	}
+	d := &download{client: c, opts: o, url: url, part: path + partSuffix, startedAt: time.Now()}
+	log := o.Logger.With().Str("download_url", url).Str("file", path).Logger()
+
+	failures := 0
+	for {
+		done, err := d.fetch(ctx)
+		if err == nil && done {
+			break
+		}
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		var se *StatusError
+		if errors.As(err, &se) && se.Status < http.StatusInternalServerError {
+			return 0, err
+		}
+		failures++
+		if failures > o.Retries {
+			return 0, fmt.Errorf("download failed: %w", err)
+		}
+		log.Warn().Err(err).Int("attempt", failures).Msg("download failed, resuming it")
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(o.RetryDelay):
+		}
+	}
+
+	if err := d.verify(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(d.part, path); err != nil {
+		return 0, err
+	}
+	return d.size, nil
+}
+
+// download is the state of a call to Download.
+type download struct {
+	client *Client
+	opts   Options
+	url    string
+	part   string
+
+	// size and etag are known once the server answered.
+	size int64
+	etag string
+
+	startOffset int64
+	startedAt   time.Time
+}
+
+// fetch requests the content from the end of the part file on, and
+// appends it. It returns true once the content is complete.
+func (d *download) fetch(ctx context.Context) (bool, error) {
+	f, err := os.OpenFile(d.part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	u := &upload{client: d.client, opts: d.opts}
+	req, err := u.request(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return false, err
+	}
+	// the Tus-Resumable header is only meant for the tus requests.
+	req.Header.Del("Tus-Resumable")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if d.etag != "" {
+			// a content changed since is sent whole.
+			req.Header.Set("If-Range", d.etag)
+		}
+	}
+	resp, err := d.opts.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the server ignored the range, the content is written again.
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		d.size = resp.ContentLength
+	case http.StatusPartialContent:
+		if d.size, err = contentRangeSize(resp.Header.Get("Content-Range")); err != nil {
+			return false, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+		if err == nil && size == offset {
+			// the part file is already complete.
+			d.size, d.etag = size, resp.Header.Get("ETag")
+			return true, nil
+		}
+		// the part file isn't a prefix of the content.
+		return false, f.Truncate(0)
+	default:
+		return false, statusError(resp)
+	}
+	d.etag = resp.Header.Get("ETag")
+	if d.startOffset == 0 {
+		d.startOffset = offset
+	}
+
+	var body io.Reader = resp.Body
+	if d.opts.Limiter != nil {
+		body = &limitedReader{ctx: ctx, r: body, limiter: d.opts.Limiter}
+	}
+	w := &progressWriter{w: f, offset: offset, report: d.progress}
+	d.progress(offset)
+	if _, err := io.Copy(w, body); err != nil {
+		return false, err
+	}
+	if d.size < 0 {
+		// the length of the content was unknown until its end.
+		d.size = w.offset
+	}
+	return w.offset >= d.size, nil
+}
+
+func (d *download) progress(offset int64) {
+	if d.opts.Progress != nil {
+		d.opts.Progress(newProgress(d.url, offset, d.size, d.startOffset, d.startedAt))
+	}
+}
+
+// verify checks the content of the part file against the sha256 of the
+// ETag, when the server sets one.
+func (d *download) verify() error {
+	want, ok := etagSHA256(d.etag)
+	if !ok {
+		d.opts.Logger.Debug().Str("etag", d.etag).Msg("the server reports no sha256, the download isn't verified")
+		return nil
+	}
+	f, err := os.Open(d.part)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		// the part file can't be resumed.
+		os.Remove(d.part)
+		return fmt.Errorf("%w: sha256 %s, the server reports %s", ErrChecksumMismatch, got, want)
+	}
+	return nil
+}
+
+// progressWriter reports the offset reached after every write.
+type progressWriter struct {
+	w      io.Writer
+	offset int64
+	report func(int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	p.report(p.offset)
+	return n, err
+}
+
+// contentRangeSize returns the complete length of a Content-Range header,
+// e.g. 1000 for bytes 200-999/1000.
+func contentRangeSize(v string) (int64, error) {
+	_, size, ok := strings.Cut(v, "/")
+	if !ok || size == "*" {
+		return 0, fmt.Errorf("invalid Content-Range header %q", v)
+	}
+	return strconv.ParseInt(size, 10, 64)
+}
+
+// etagSHA256 returns the hex encoded sha256 of a strong entity tag made of
+// it, as the uploader sets it.
+func etagSHA256(etag string) (string, bool) {
+	v, ok := strings.CutPrefix(etag, `"`)
+	if !ok {
+		return "", false
+	}
+	v, ok = strings.CutSuffix(v, `"`)
+	if !ok || len(v) != 2*sha256.Size {
+		return "", false
+	}
+	if _, err := hex.DecodeString(v); err != nil {
+		return "", false
+	}
+	return strings.ToLower(v), true
+}
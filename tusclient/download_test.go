@@ -0,0 +1,89 @@
+package tusclient_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// newDownloadServer serves data with the sha256 ETag of the uploader.
+func newDownloadServer(t *testing.T, data []byte, etag string) (*httptest.Server, *[]string) {
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &ranges
+}
+
+func sha256ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestDownload(t *testing.T) {
+	data := content(1<<20 + 100)
+
+	t.Run("content must be downloaded and verified", func(t *testing.T) {
+		srv, _ := newDownloadServer(t, data, sha256ETag(data))
+		path := filepath.Join(t.TempDir(), "data.bin")
+
+		n, err := tusclient.New(srv.URL).Download(context.Background(), srv.URL+"/files/a", path)
+
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		b, _ := os.ReadFile(path)
+		assert.Equal(t, data, b)
+		assert.NoFileExists(t, path+".part")
+	})
+
+	t.Run("interrupted download must be resumed with a range request", func(t *testing.T) {
+		srv, ranges := newDownloadServer(t, data, sha256ETag(data))
+		path := filepath.Join(t.TempDir(), "data.bin")
+		assert.NoError(t, os.WriteFile(path+".part", data[:1000], 0644))
+
+		_, err := tusclient.New(srv.URL).Download(context.Background(), srv.URL+"/files/a", path)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"bytes=1000-"}, *ranges)
+		b, _ := os.ReadFile(path)
+		assert.Equal(t, data, b)
+	})
+
+	t.Run("content not matching the ETag must be rejected", func(t *testing.T) {
+		srv, _ := newDownloadServer(t, data, `"`+strings.Repeat("0", 64)+`"`)
+		path := filepath.Join(t.TempDir(), "data.bin")
+
+		_, err := tusclient.New(srv.URL).Download(context.Background(), srv.URL+"/files/a", path)
+
+		assert.ErrorIs(t, err, tusclient.ErrChecksumMismatch)
+		assert.NoFileExists(t, path)
+		assert.NoFileExists(t, path+".part")
+	})
+
+	t.Run("upload not complete must fail without retries", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+		}))
+		defer srv.Close()
+
+		_, err := tusclient.New(srv.URL).Download(context.Background(), srv.URL+"/files/a", filepath.Join(t.TempDir(), "data.bin"))
+
+		var se *tusclient.StatusError
+		assert.ErrorAs(t, err, &se)
+		assert.Equal(t, http.StatusConflict, se.Status)
+	})
+}
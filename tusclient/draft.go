@@ -0,0 +1,132 @@
+package tusclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+)
+
+// DraftInteropVersion is the interop version of the IETF resumable uploads
+// draft the client speaks WithIETFDraft.
+const DraftInteropVersion = "6"
+
+// statusUploadResumptionSupported is the interim response announcing the
+// URL of an upload of the draft before its creation request completes.
+const statusUploadResumptionSupported = 104
+
+// partialUploadType is the content type of the PATCH requests of the draft.
+const partialUploadType = "application/partial-upload"
+
+// createDraft creates the upload with the draft protocol, sending its
+// first chunk in the creation request, and returns its URL and offset.
+//
+// The server announces the URL in a 104 response before receiving the
+// chunk, so that an interrupted creation is resumed from the offset the
+// server reached instead of being sent again.
+func (u *upload) createDraft(ctx context.Context) (string, int64, error) {
+	c, err := u.chunk(ctx, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	var announced string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			location := http.Header(header).Get("Location")
+			if code != statusUploadResumptionSupported || location == "" {
+				return nil
+			}
+			announced = u.client.uploadURL(location)
+			if err := u.record(announced, 0); err != nil {
+				u.opts.Logger.Warn().Err(err).Msg("unable to record the announced upload")
+			}
+			return nil
+		},
+	}
+	req, err := u.request(httptrace.WithClientTrace(ctx, trace), http.MethodPost, u.client.endpoint, c.body)
+	if err != nil {
+		return "", 0, err
+	}
+	req.ContentLength = c.size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Upload-Complete", structuredBool(c.size == u.size))
+	req.Header.Set("Upload-Length", strconv.FormatInt(u.size, 10))
+	if key := u.idempotencyKey(); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := u.opts.HTTPClient.Do(req)
+	if err != nil {
+		if announced == "" || ctx.Err() != nil {
+			return "", 0, err
+		}
+		u.opts.Logger.Warn().Err(err).Str("upload_url", announced).Msg("creation interrupted, resuming the announced upload")
+		offset, oerr := u.offset(ctx, announced)
+		if oerr != nil {
+			return "", 0, err
+		}
+		return announced, offset, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", 0, statusError(resp)
+	}
+	url := announced
+	if url == "" {
+		if url, err = u.client.location(resp); err != nil {
+			return "", 0, err
+		}
+	}
+	offset, err := draftOffset(resp, c.size)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := u.record(url, offset); err != nil {
+		return "", 0, err
+	}
+	return url, offset, nil
+}
+
+// patchDraft appends the chunk starting at offset with the draft protocol,
+// and returns the offset the server reached.
+func (u *upload) patchDraft(ctx context.Context, url string, offset int64) (int64, error) {
+	c, err := u.chunk(ctx, offset)
+	if err != nil {
+		return 0, err
+	}
+	req, err := u.request(ctx, http.MethodPatch, url, c.body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = c.size
+	req.Header.Set("Content-Type", partialUploadType)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Upload-Complete", structuredBool(offset+c.size == u.size))
+	resp, err := u.opts.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, statusError(resp)
+	}
+	return draftOffset(resp, offset+c.size)
+}
+
+// draftOffset returns the offset of the response of the draft, which may
+// only tell that the request was received entirely, up to sent.
+func draftOffset(resp *http.Response, sent int64) (int64, error) {
+	v := resp.Header.Get("Upload-Offset")
+	if v == "" {
+		return sent, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// structuredBool returns b as a structured field boolean.
+func structuredBool(b bool) string {
+	if b {
+		return "?1"
+	}
+	return "?0"
+}
@@ -0,0 +1,148 @@
+package tusclient_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// draftServer is a server of the IETF resumable uploads draft, keeping the
+// uploads in memory. The creation requests are aborted after cut bytes
+// when it isn't zero.
+type draftServer struct {
+	cut int64
+
+	mu       sync.Mutex
+	uploads  map[string]*bytes.Buffer
+	complete map[string]bool
+	requests []*http.Request
+}
+
+func newDraftServer(t *testing.T, cut int64) (*httptest.Server, *draftServer) {
+	s := &draftServer{cut: cut, uploads: map[string]*bytes.Buffer{}, complete: map[string]bool{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv, s
+}
+
+func (s *draftServer) upload(id string) *bytes.Buffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads[id]
+}
+
+func (s *draftServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	s.mu.Unlock()
+	if r.Method != http.MethodOptions && r.Header.Get("Upload-Draft-Interop-Version") != tusclient.DraftInteropVersion {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id := path.Base(r.URL.Path)
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Upload-Draft-Interop-Version", tusclient.DraftInteropVersion)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		s.mu.Lock()
+		id = fmt.Sprint(len(s.uploads) + 1)
+		b := &bytes.Buffer{}
+		s.uploads[id] = b
+		s.mu.Unlock()
+		w.Header().Set("Location", "/files/"+id)
+		w.WriteHeader(104)
+		if s.cut > 0 {
+			io.CopyN(b, r.Body, s.cut)
+			panic(http.ErrAbortHandler)
+		}
+		s.append(w, r, id, 0)
+	case http.MethodHead:
+		b := s.upload(id)
+		w.Header().Set("Upload-Offset", strconv.Itoa(b.Len()))
+		w.Header().Set("Upload-Complete", map[bool]string{true: "?1", false: "?0"}[s.complete[id]])
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		offset, _ := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if r.Header.Get("Content-Type") != "application/partial-upload" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		s.append(w, r, id, offset)
+	}
+}
+
+func (s *draftServer) append(w http.ResponseWriter, r *http.Request, id string, offset int64) {
+	b := s.upload(id)
+	if int64(b.Len()) != offset {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	b.ReadFrom(r.Body)
+	s.mu.Lock()
+	s.complete[id] = r.Header.Get("Upload-Complete") == "?1"
+	s.mu.Unlock()
+	w.Header().Set("Upload-Offset", strconv.Itoa(b.Len()))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestIETFDraft(t *testing.T) {
+	data := content(1<<20 + 100)
+
+	t.Run("upload must speak the draft when the server advertises it", func(t *testing.T) {
+		srv, s := newDraftServer(t, 0)
+		client := tusclient.New(srv.URL+"/files",
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithIETFDraft(true))
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, s.upload(path.Base(url)).Bytes())
+		assert.True(t, s.complete[path.Base(url)])
+		// OPTIONS, the creation with the first chunk, then two PATCH.
+		assert.Len(t, s.requests, 4)
+		for _, r := range s.requests[1:] {
+			assert.Empty(t, r.Header.Get("Tus-Resumable"))
+		}
+	})
+
+	t.Run("interrupted creation must be resumed at the location of the interim response", func(t *testing.T) {
+		srv, s := newDraftServer(t, 100<<10)
+		states := tusclient.NewMemoryStore()
+		client := tusclient.New(srv.URL+"/files",
+			tusclient.WithStore(states),
+			tusclient.WithFingerprint("data.bin"),
+			tusclient.WithIETFDraft(true))
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, srv.URL+"/files/1", url)
+		assert.Equal(t, data, s.upload("1").Bytes())
+		_, ok, _ := states.Get("data.bin")
+		assert.False(t, ok)
+	})
+
+	t.Run("upload must fall back to tus when the server doesn't advertise the draft", func(t *testing.T) {
+		srv, store := newServer(t, nil)
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithIETFDraft(true))...)
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, uploaded(t, store, url))
+	})
+}
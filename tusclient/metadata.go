@@ -0,0 +1,65 @@
+package tusclient
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidMetadata is returned for metadata which can't be sent in the
+// Upload-Metadata header.
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// EncodeMetadata formats md as the value of an Upload-Metadata header,
+// sorted by key. The values are base64 encoded, and the keys of empty
+// values are sent alone, as the protocol allows it.
+func EncodeMetadata(md map[string]string) (string, error) {
+	kvs := make([]string, 0, len(md))
+	for k, v := range md {
+		if k == "" || strings.ContainsAny(k, " ,") {
+			return "", fmt.Errorf("%w: key %q must be non empty, without spaces and commas", ErrInvalidMetadata, k)
+		}
+		if v == "" {
+			kvs = append(kvs, k)
+			continue
+		}
+		kvs = append(kvs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ","), nil
+}
+
+// FileMetadata returns the filename, content type, guessed from the
+// extension, and modification time of the file at path, under the keys the
+// uploader expects.
+func FileMetadata(path string) (map[string]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return map[string]string{
+		"filename":     fi.Name(),
+		"content-type": contentType,
+		"mtime":        fi.ModTime().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// ParseMetadata parses key=value, e.g. the value of a command line flag, as
+// a metadata key and value.
+func ParseMetadata(kv string) (string, string, error) {
+	k, v, ok := strings.Cut(kv, "=")
+	if !ok || k == "" || strings.ContainsAny(k, " ,") {
+		return "", "", fmt.Errorf("%w: %q, expected key=value", ErrInvalidMetadata, kv)
+	}
+	return k, v, nil
+}
@@ -0,0 +1,56 @@
+package tusclient_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeMetadata(t *testing.T) {
+	t.Run("values must be base64 encoded and sorted by key", func(t *testing.T) {
+		md, err := tusclient.EncodeMetadata(map[string]string{"filename": "a b.txt", "content-type": "text/plain"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "content-type dGV4dC9wbGFpbg==,filename YSBiLnR4dA==", md)
+	})
+
+	t.Run("key of an empty value must be sent alone", func(t *testing.T) {
+		md, err := tusclient.EncodeMetadata(map[string]string{"is_confidential": ""})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "is_confidential", md)
+	})
+
+	t.Run("key with a space or a comma must be rejected", func(t *testing.T) {
+		for _, k := range []string{"file name", "a,b", ""} {
+			_, err := tusclient.EncodeMetadata(map[string]string{k: "v"})
+
+			assert.ErrorIs(t, err, tusclient.ErrInvalidMetadata, k)
+		}
+	})
+}
+
+func TestParseMetadata(t *testing.T) {
+	k, v, err := tusclient.ParseMetadata("tag=a=b")
+	assert.NoError(t, err)
+	assert.Equal(t, "tag", k)
+	assert.Equal(t, "a=b", v)
+
+	_, _, err = tusclient.ParseMetadata("tag")
+	assert.ErrorIs(t, err, tusclient.ErrInvalidMetadata)
+}
+
+func TestFileMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	assert.NoError(t, os.WriteFile(path, []byte("{}"), 0600))
+
+	md, err := tusclient.FileMetadata(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "report.json", md["filename"])
+	assert.Equal(t, "application/json", md["content-type"])
+	assert.NotEmpty(t, md["mtime"])
+}
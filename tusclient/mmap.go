@@ -0,0 +1,60 @@
+package tusclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrMmapUnsupported is returned by OpenMapped on the platforms without
+// memory mapping.
+var ErrMmapUnsupported = errors.New("memory mapping is not supported")
+
+// MappedFile is a file read from a memory mapping of its content. The
+// chunks of an upload are read from the mapping, without a system call per
+// read or seek, and concurrently by parallel uploads.
+//
+// The file mustn't be truncated while it is mapped: reading the pages past
+// its new end crashes the process.
+type MappedFile struct {
+	*bytes.Reader
+	data []byte
+}
+
+// OpenMapped maps the content of the file at path in memory, to be passed
+// to Upload and closed once it returns.
+func OpenMapped(path string) (*MappedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// the mapping outlives the descriptor.
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return &MappedFile{Reader: bytes.NewReader(nil)}, nil
+	}
+	if int64(int(fi.Size())) != fi.Size() {
+		return nil, fmt.Errorf("%s is too large to be mapped", path)
+	}
+	data, err := mmap(f, int(fi.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to map %s: %w", path, err)
+	}
+	return &MappedFile{Reader: bytes.NewReader(data), data: data}, nil
+}
+
+// Close unmaps the file. It mustn't be read anymore.
+func (m *MappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	m.Reader = bytes.NewReader(nil)
+	return munmap(data)
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package tusclient
+
+import "os"
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package tusclient_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenMapped(t *testing.T) {
+	open := func(t *testing.T, data []byte) *tusclient.MappedFile {
+		path := filepath.Join(t.TempDir(), "data.bin")
+		assert.NoError(t, os.WriteFile(path, data, 0600))
+		m, err := tusclient.OpenMapped(path)
+		if errors.Is(err, tusclient.ErrMmapUnsupported) {
+			t.Skip(err)
+		}
+		assert.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+		return m
+	}
+
+	t.Run("mapped file must be read and seeked as the file", func(t *testing.T) {
+		data := content(100 << 10)
+		m := open(t, data)
+
+		_, err := m.Seek(4096, io.SeekStart)
+		assert.NoError(t, err)
+		b, err := io.ReadAll(io.LimitReader(m, 10))
+		assert.NoError(t, err)
+		assert.Equal(t, data[4096:4106], b)
+
+		b = make([]byte, 10)
+		_, err = m.ReadAt(b, int64(len(data)-10))
+		assert.NoError(t, err)
+		assert.Equal(t, data[len(data)-10:], b)
+	})
+
+	t.Run("mapped file must be uploaded in parallel", func(t *testing.T) {
+		data := content(1<<20 + 100)
+		m := open(t, data)
+		srv, s := newConcatServer(t, "creation", "concatenation")
+		client := tusclient.New(srv.URL+"/files",
+			tusclient.WithChunkSize(128<<10),
+			tusclient.WithParallel(3))
+
+		url, err := client.Upload(context.Background(), m)
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, s.uploads[filepath.Base(url)].Bytes())
+	})
+
+	t.Run("empty file must be mapped", func(t *testing.T) {
+		m := open(t, nil)
+
+		b, err := io.ReadAll(m)
+
+		assert.NoError(t, err)
+		assert.Empty(t, b)
+		assert.NoError(t, m.Close())
+	})
+}
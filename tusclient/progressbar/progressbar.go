@@ -0,0 +1,68 @@
+// Package progressbar draws the progress of the transfers of tusclient on
+// a terminal.
+package progressbar
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+)
+
+const barWidth = 30
+
+// Bar draws the progress of a transfer on a single line of a terminal,
+// redrawn on every report.
+type Bar struct {
+	w    io.Writer
+	name string
+	open bool
+}
+
+// New returns a bar of the transfer of name, drawn on w.
+func New(w io.Writer, name string) *Bar {
+	return &Bar{w: w, name: name}
+}
+
+// Report redraws the bar at p, e.g. as the callback of
+// tusclient.WithProgress.
+func (b *Bar) Report(p tusclient.Progress) {
+	done := int(p.Percent() * barWidth / 100)
+	eta := "--"
+	if p.ETA > 0 {
+		eta = p.ETA.Round(time.Second).String()
+	}
+	fmt.Fprintf(b.w, "\r%s [%s%s] %s/%s %5.1f%% %s/s ETA %s\033[K",
+		b.name,
+		strings.Repeat("=", done), strings.Repeat(" ", barWidth-done),
+		bytes(p.Offset), bytes(p.Size), p.Percent(), bytes(int64(p.Rate)), eta)
+	b.open = true
+	if p.Offset == p.Size {
+		b.End()
+	}
+}
+
+// End moves to the next line, e.g. before logging that the transfer
+// failed.
+func (b *Bar) End() {
+	if b.open {
+		fmt.Fprintln(b.w)
+		b.open = false
+	}
+}
+
+// bytes formats n in binary units, e.g. 1.5MiB.
+func bytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
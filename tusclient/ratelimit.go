@@ -0,0 +1,41 @@
+package tusclient
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// maxBurst bounds the bytes read at once from a rate limited upload, so
+// that the bandwidth stays smooth instead of being spent by bursts.
+const maxBurst = 32 << 10
+
+// newLimiter returns a limiter of bytesPerSecond, nil when it is not
+// positive.
+func newLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxBurst)))
+}
+
+// limitedReader reads from r no faster than its limiter allows.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.limiter.Burst() {
+		p = p[:l.limiter.Burst()]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.limiter.WaitN(l.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,154 @@
+package tusclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// State is what is recorded of an upload not complete yet.
+type State struct {
+	URL string `json:"url"`
+	// Offset is the last offset the server reported. The offset the
+	// upload is resumed from is asked to the server again.
+	Offset    int64     `json:"offset"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store records the state of the uploads not complete yet by fingerprint,
+// so that they can be resumed.
+type Store interface {
+	// Get returns the state recorded for fingerprint, false when there is
+	// none.
+	Get(fingerprint string) (State, bool, error)
+	Set(fingerprint string, s State) error
+	Delete(fingerprint string) error
+}
+
+// Fingerprint identifies the file at path by its absolute path, size and
+// modification time, so that a modified file isn't resumed.
+func Fingerprint(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%d", abs, fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// MemoryStore keeps the states for the lifetime of the process.
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: map[string]State{}}
+}
+
+func (s *MemoryStore) Get(fingerprint string) (State, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.states[fingerprint]
+	return st, ok, nil
+}
+
+func (s *MemoryStore) Set(fingerprint string, st State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[fingerprint] = st
+	return nil
+}
+
+func (s *MemoryStore) Delete(fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, fingerprint)
+	return nil
+}
+
+// FileStore keeps the states in a JSON file, so that the uploads can be
+// resumed by another process.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileStore returns a store of the states in the file at path, created
+// with its directory on the first upload.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Get(fingerprint string) (State, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return State{}, false, err
+	}
+	st, ok := states[fingerprint]
+	return st, ok, nil
+}
+
+func (s *FileStore) Set(fingerprint string, st State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	states[fingerprint] = st
+	return s.write(states)
+}
+
+func (s *FileStore) Delete(fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	delete(states, fingerprint)
+	return s.write(states)
+}
+
+func (s *FileStore) read() (map[string]State, error) {
+	states := map[string]State{}
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// write replaces the file atomically, so that a crash doesn't lose the
+// states recorded before.
+func (s *FileStore) write(states map[string]State) error {
+	b, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,141 @@
+package tusclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// The defaults of the transports of NewTransport, tuned for uploads sent
+// in successive chunks over long lived connections.
+const (
+	defaultMaxIdleConnsPerHost = 16
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultWriteBufferSize     = 64 << 10
+)
+
+// TransportOptions configure the connections of NewTransport to servers
+// behind a private CA, requiring client certificates or reached through a
+// proxy, and how they are pooled.
+type TransportOptions struct {
+	// CAFile is a PEM bundle of the CAs trusted in addition to the ones of
+	// the system, e.g. the CA of a TLS intercepting proxy.
+	CAFile string
+	// CertFile and KeyFile are the PEM certificate and key presented to
+	// the servers requiring client certificates.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify accepts any certificate of the server. Only for
+	// tests.
+	InsecureSkipVerify bool
+	// Proxy is the URL of the http, https or socks5 proxy the requests go
+	// through. The proxy of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables is used when empty.
+	Proxy string
+
+	// DisableKeepAlives opens a connection per request, paying a TCP and
+	// TLS handshake for every chunk. The connections are reused by default.
+	DisableKeepAlives bool
+	// DisableHTTP2 speaks HTTP/1.1 even to the servers negotiating HTTP/2,
+	// whose uploads then share a single connection.
+	DisableHTTP2 bool
+	// MaxIdleConnsPerHost is the number of connections kept open to the
+	// server between requests, 16 by default so that parallel uploads
+	// reuse theirs. MaxConnsPerHost limits the connections to the server,
+	// unless zero.
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	// DialTimeout, TLSHandshakeTimeout and IdleConnTimeout default to 30,
+	// 10 and 90 seconds.
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	IdleConnTimeout     time.Duration
+	// ResponseHeaderTimeout bounds the wait for the response once a chunk
+	// is sent, e.g. while the server stores it. It is unbounded when zero.
+	ResponseHeaderTimeout time.Duration
+	// WriteBufferSize is the size of the buffer the chunks are written to
+	// the connections through, 64KiB by default.
+	WriteBufferSize int
+}
+
+// NewTransport returns a transport of the options, to be set in the
+// http.Client of WithHTTPClient.
+func NewTransport(o TransportOptions) (*http.Transport, error) {
+	if o.MaxIdleConnsPerHost == 0 {
+		o.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = defaultDialTimeout
+	}
+	if o.TLSHandshakeTimeout == 0 {
+		o.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	if o.IdleConnTimeout == 0 {
+		o.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if o.WriteBufferSize == 0 {
+		o.WriteBufferSize = defaultWriteBufferSize
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	t.DialContext = (&net.Dialer{
+		Timeout:   o.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.DisableKeepAlives = o.DisableKeepAlives
+	if o.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = o.MaxConnsPerHost
+	t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	t.IdleConnTimeout = o.IdleConnTimeout
+	t.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	t.WriteBufferSize = o.WriteBufferSize
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("ca file doesn't contain any certificate")
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate: %w", err)
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("invalid proxy: unsupported scheme %q", u.Scheme)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	return t, nil
+}
@@ -0,0 +1,140 @@
+package tusclient_test
+
+import (
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	get := func(tr *http.Transport) error {
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	t.Run("server signed by an unknown CA must be rejected", func(t *testing.T) {
+		tr, err := tusclient.NewTransport(tusclient.TransportOptions{})
+
+		assert.NoError(t, err)
+		assert.Error(t, get(tr))
+	})
+
+	t.Run("server signed by the CA of the bundle must be trusted", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+		assert.NoError(t, os.WriteFile(caFile, b, 0600))
+
+		tr, err := tusclient.NewTransport(tusclient.TransportOptions{CAFile: caFile})
+
+		assert.NoError(t, err)
+		assert.NoError(t, get(tr))
+	})
+
+	t.Run("server certificate must be accepted when skipping the verification", func(t *testing.T) {
+		tr, err := tusclient.NewTransport(tusclient.TransportOptions{InsecureSkipVerify: true})
+
+		assert.NoError(t, err)
+		assert.NoError(t, get(tr))
+	})
+
+	t.Run("CA file without certificate must be rejected", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		assert.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+
+		_, err := tusclient.NewTransport(tusclient.TransportOptions{CAFile: caFile})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("requests must go through the proxy", func(t *testing.T) {
+		tr, err := tusclient.NewTransport(tusclient.TransportOptions{Proxy: "socks5://proxy.internal:1080"})
+		assert.NoError(t, err)
+
+		req, _ := http.NewRequest(http.MethodGet, "https://uploads.example.com", nil)
+		proxy, err := tr.Proxy(req)
+
+		assert.NoError(t, err)
+		assert.Equal(t, &url.URL{Scheme: "socks5", Host: "proxy.internal:1080"}, proxy)
+	})
+
+	t.Run("connections must be reused between requests by default", func(t *testing.T) {
+		tr, err := tusclient.NewTransport(tusclient.TransportOptions{InsecureSkipVerify: true})
+		assert.NoError(t, err)
+
+		assert.Equal(t, int32(1), dials(t, tr, 3))
+	})
+
+	t.Run("connections must be opened per request when keep-alives are disabled", func(t *testing.T) {
+		tr, err := tusclient.NewTransport(tusclient.TransportOptions{InsecureSkipVerify: true, DisableKeepAlives: true})
+		assert.NoError(t, err)
+
+		assert.Equal(t, int32(3), dials(t, tr, 3))
+	})
+
+	t.Run("HTTP/2 must be spoken unless disabled", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		defer srv.Close()
+		proto := func(o tusclient.TransportOptions) int {
+			tr, err := tusclient.NewTransport(o)
+			assert.NoError(t, err)
+			resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			return resp.ProtoMajor
+		}
+
+		assert.Equal(t, 2, proto(tusclient.TransportOptions{InsecureSkipVerify: true}))
+		assert.Equal(t, 1, proto(tusclient.TransportOptions{InsecureSkipVerify: true, DisableHTTP2: true}))
+	})
+
+	t.Run("proxy of an unsupported scheme must be rejected", func(t *testing.T) {
+		_, err := tusclient.NewTransport(tusclient.TransportOptions{Proxy: "ftp://proxy.internal"})
+
+		assert.Error(t, err)
+	})
+}
+
+// dials sends n requests with tr, and returns the number of connections
+// the server accepted.
+func dials(t *testing.T, tr *http.Transport, n int) int32 {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	for range n {
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return conns.Load()
+}
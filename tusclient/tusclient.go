@@ -0,0 +1,819 @@
+// Package tusclient uploads files to a tus server, such as the v3 API of
+// the uploader, resuming them after failures.
+//
+// The URL and last known offset of every upload are recorded in a Store
+// under its fingerprint, so that an interrupted upload, even by the end of
+// the process with a FileStore, is resumed from the offset the server
+// reports instead of being created again.
+package tusclient
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// TusVersion is the version of the protocol spoken by the client by
+// default.
+const TusVersion = "1.0.0"
+
+// terminateTimeout bounds the termination of a cancelled upload.
+const terminateTimeout = 10 * time.Second
+
+// ErrUploadFailed is returned when the server keeps refusing the chunks of
+// an upload after the retries.
+var ErrUploadFailed = errors.New("upload failed")
+
+// StatusError is a response of the server with an unexpected status.
+type StatusError struct {
+	Method string
+	Status int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d: %s", e.Method, e.Status, e.Body)
+}
+
+// CancelledError is returned when the context of an upload is done before
+// the upload completes, as opposed to ErrUploadFailed. It wraps the error
+// of the context.
+type CancelledError struct {
+	// URL is the upload cancelled, empty when it wasn't created yet.
+	URL string
+	// Offset is the offset the server acknowledged last, which the upload
+	// is resumed from by another call to Upload with the same fingerprint.
+	Offset int64
+	// Terminated reports whether the upload was deleted from the server,
+	// see WithTerminateOnCancel.
+	Terminated bool
+	Err        error
+}
+
+func (e *CancelledError) Error() string {
+	if e.Terminated {
+		return fmt.Sprintf("upload cancelled and terminated: %v", e.Err)
+	}
+	return fmt.Sprintf("upload cancelled at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *CancelledError) Unwrap() error { return e.Err }
+
+// Resumable reports whether the upload can be resumed.
+func (e *CancelledError) Resumable() bool { return !e.Terminated }
+
+type Options struct {
+	HTTPClient        *http.Client
+	ChunkSize         int64
+	Header            http.Header
+	Metadata          map[string]string
+	Store             Store
+	Fingerprint       string
+	Retries           int
+	RetryDelay        time.Duration
+	TusVersion        string
+	Progress          func(Progress)
+	Limiter           *rate.Limiter
+	Parallel          int
+	Checksum          string
+	TerminateOnCancel bool
+	Verify            bool
+	IETFDraft         bool
+	Logger            *zerolog.Logger
+}
+
+// Option configures a Client, or a single upload when passed to Upload.
+type Option func(*Options)
+
+// WithHTTPClient sends the requests with c instead of http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *Options) {
+		if c != nil {
+			o.HTTPClient = c
+		}
+	}
+}
+
+// WithChunkSize sends the uploads in PATCH requests of at most size bytes.
+// The rest of an upload is sent in a single request when zero, the
+// default.
+func WithChunkSize(size int64) Option {
+	return func(o *Options) {
+		o.ChunkSize = size
+	}
+}
+
+// WithHeader adds a header to every request, e.g. to authenticate them.
+func WithHeader(key, value string) Option {
+	return func(o *Options) {
+		o.Header = o.Header.Clone()
+		if o.Header == nil {
+			o.Header = http.Header{}
+		}
+		o.Header.Add(key, value)
+	}
+}
+
+// WithMetadata sends the key and value in the Upload-Metadata header of the
+// creation request.
+func WithMetadata(key, value string) Option {
+	return WithMetadataMap(map[string]string{key: value})
+}
+
+// WithMetadataMap sends the keys and values of md in the Upload-Metadata
+// header of the creation request, e.g. the FileMetadata of the file sent.
+func WithMetadataMap(md map[string]string) Option {
+	return func(o *Options) {
+		merged := make(map[string]string, len(o.Metadata)+len(md))
+		for k, v := range o.Metadata {
+			merged[k] = v
+		}
+		for k, v := range md {
+			merged[k] = v
+		}
+		o.Metadata = merged
+	}
+}
+
+// WithStore records the state of the uploads in s, so that they can be
+// resumed. They are kept in memory by default.
+func WithStore(s Store) Option {
+	return func(o *Options) {
+		if s != nil {
+			o.Store = s
+		}
+	}
+}
+
+// WithFingerprint identifies an upload in the store, e.g. with the
+// Fingerprint of the file sent. Uploads without fingerprint aren't
+// recorded, and always start from scratch.
+func WithFingerprint(fingerprint string) Option {
+	return func(o *Options) {
+		o.Fingerprint = fingerprint
+	}
+}
+
+// WithRetries resumes an upload up to n times in a row after a failed
+// chunk, waiting delay before every attempt. The uploads are retried 3
+// times every second by default.
+func WithRetries(n int, delay time.Duration) Option {
+	return func(o *Options) {
+		o.Retries = n
+		o.RetryDelay = delay
+	}
+}
+
+// WithTusVersion sends version in the Tus-Resumable header of the
+// requests instead of TusVersion.
+func WithTusVersion(version string) Option {
+	return func(o *Options) {
+		if version != "" {
+			o.TusVersion = version
+		}
+	}
+}
+
+// WithProgress calls fn once the offset of an upload is known, after every
+// chunk and on completion. The calls are never concurrent, even for the
+// partial uploads of WithParallel.
+func WithProgress(fn func(Progress)) Option {
+	return func(o *Options) {
+		o.Progress = fn
+	}
+}
+
+// WithRateLimit sends the chunks no faster than bytesPerSecond, e.g. so
+// that a backup job doesn't saturate the uplink. Passed to New, the limit
+// is shared by all the uploads of the client. The bandwidth isn't limited
+// when bytesPerSecond is zero, the default.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(o *Options) {
+		o.Limiter = newLimiter(bytesPerSecond)
+	}
+}
+
+// WithParallel splits the uploads in n partial uploads sent over concurrent
+// connections, and concatenates them once they are complete. It requires
+// the concatenation extension of the server, and readers implementing
+// io.ReaderAt, such as *os.File. The uploads are sent in one piece by
+// default.
+func WithParallel(n int) Option {
+	return func(o *Options) {
+		o.Parallel = n
+	}
+}
+
+// WithChecksum sends the checksum of every chunk with algorithm, md5 or
+// sha1, so that the server rejects the chunks corrupted on the way. The
+// chunks are sent without checksum when the server doesn't advertise the
+// algorithm.
+func WithChecksum(algorithm string) Option {
+	return func(o *Options) {
+		o.Checksum = algorithm
+	}
+}
+
+// WithTerminateOnCancel terminates an upload whose context is cancelled,
+// e.g. when the user aborts it, so that the server frees its data at once
+// instead of when it expires. The cancelled uploads are kept to be resumed
+// by default.
+func WithTerminateOnCancel(terminate bool) Option {
+	return func(o *Options) {
+		o.TerminateOnCancel = terminate
+	}
+}
+
+// WithVerify checks the upload against the server once it is complete:
+// Upload fails with ErrVerificationFailed when the server reports another
+// length, or another sha256 in the ETag of the upload.
+func WithVerify(verify bool) Option {
+	return func(o *Options) {
+		o.Verify = verify
+	}
+}
+
+// WithIETFDraft speaks the IETF resumable uploads draft, the successor of
+// tus 1.0, to the servers advertising DraftInteropVersion in their response
+// to OPTIONS. The uploads fall back to tus 1.0 with the other servers, and
+// when they are sent in parallel, which the draft can't concatenate.
+func WithIETFDraft(draft bool) Option {
+	return func(o *Options) {
+		o.IETFDraft = draft
+	}
+}
+
+func WithLogger(l *zerolog.Logger) Option {
+	return func(o *Options) {
+		if l != nil {
+			o.Logger = l
+		}
+	}
+}
+
+// Client uploads files to the tus endpoint of a server.
+type Client struct {
+	endpoint string
+	opts     Options
+
+	mu   sync.Mutex
+	caps *Capabilities
+}
+
+// New returns a client creating its uploads at endpoint, e.g.
+// http://localhost:8080/api/v3/files.
+func New(endpoint string, opts ...Option) *Client {
+	o := Options{
+		HTTPClient: http.DefaultClient,
+		Store:      NewMemoryStore(),
+		Retries:    3,
+		RetryDelay: time.Second,
+		TusVersion: TusVersion,
+		Logger:     &log.Logger,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Client{endpoint: strings.TrimSuffix(endpoint, "/"), opts: o}
+}
+
+// Upload sends the content of r, from its start to its end, and returns the
+// URL of the upload once the server received all of it. An upload of the
+// same fingerprint recorded in the store is resumed. opts override the
+// options of the client for this upload.
+func (c *Client) Upload(ctx context.Context, r io.ReadSeeker, opts ...Option) (string, error) {
+	o := c.opts
+	for _, opt := range opts {
+		opt(&o)
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", fmt.Errorf("unable to measure the upload: %w", err)
+	}
+	if o, err = c.negotiate(ctx, o, size); err != nil {
+		return "", err
+	}
+	var url string
+	if ra, ok := r.(io.ReaderAt); ok && o.Parallel > 1 && size > 1 {
+		url, err = c.uploadParallel(ctx, ra, size, o)
+	} else {
+		u := &upload{client: c, opts: o, r: r, size: size}
+		url, err = u.run(ctx)
+	}
+	if err != nil || !o.Verify {
+		return url, err
+	}
+	if err := c.verify(ctx, url, r, size, o); err != nil {
+		return url, err
+	}
+	return url, nil
+}
+
+// run sends the upload from the offset the server has, creating it first
+// when it isn't recorded in the store, and returns its URL.
+func (u *upload) run(ctx context.Context) (_ string, err error) {
+	o, size := u.opts, u.size
+	u.startedAt = time.Now()
+	// acked is the offset the server acknowledged last, which a cancelled
+	// upload is resumed from.
+	var (
+		url    string
+		acked  int64
+		offset int64
+	)
+	defer func() {
+		if err != nil && ctx.Err() != nil && !errors.Is(context.Cause(ctx), errPartFailed) {
+			err = u.cancelled(ctx, url, acked)
+		}
+	}()
+	if url, offset, err = u.resume(ctx); err != nil {
+		return "", err
+	}
+	from := offset
+	if url == "" {
+		if url, offset, err = u.createRetrying(ctx); err != nil {
+			return "", err
+		}
+		// the first chunk may have been sent with the creation request.
+		from = 0
+	}
+	acked = offset
+	log := o.Logger.With().Str("upload_url", url).Int64("size", size).Logger()
+	u.start(url, from, offset)
+
+	failures := 0
+	for offset < size {
+		next, err := u.patch(ctx, url, offset)
+		if err == nil {
+			failures = 0
+			offset, acked = next, next
+			log.Debug().Int64("offset", offset).Msg("chunk uploaded")
+			u.progress(offset)
+			if offset < size {
+				if err := u.record(url, offset); err != nil {
+					log.Warn().Err(err).Msg("unable to record the offset of the upload")
+				}
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		failures++
+		if failures > o.Retries {
+			return "", fmt.Errorf("%w: %w", ErrUploadFailed, err)
+		}
+		log.Warn().Err(err).Int("attempt", failures).Msg("chunk failed, resuming the upload")
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(o.RetryDelay):
+		}
+		// the server may have stored a part of the chunk.
+		if offset, err = u.offset(ctx, url); err != nil {
+			return "", err
+		}
+		acked = offset
+		u.progress(offset)
+	}
+
+	if o.Fingerprint != "" && !u.partial {
+		if err := o.Store.Delete(o.Fingerprint); err != nil {
+			log.Warn().Err(err).Msg("unable to forget the completed upload")
+		}
+	}
+	return url, nil
+}
+
+// upload is the state of a call to Upload.
+type upload struct {
+	client *Client
+	opts   Options
+	r      io.ReadSeeker
+	size   int64
+	// partial uploads are concatenated once they are all complete, and
+	// stay recorded until then.
+	partial bool
+
+	// url, startOffset and startedAt measure the progress of the upload
+	// from where this call started it.
+	url         string
+	startOffset int64
+	startedAt   time.Time
+}
+
+// Progress is the state of an upload reported to the WithProgress
+// callback.
+type Progress struct {
+	URL    string
+	Offset int64
+	Size   int64
+	// Rate is the number of bytes sent per second since the call to
+	// Upload, zero until a chunk is sent.
+	Rate float64
+	// ETA estimates the time left at Rate, zero when it is unknown or the
+	// upload is complete.
+	ETA time.Duration
+}
+
+// Percent returns the share of the upload the server received, from 0 to
+// 100.
+func (p Progress) Percent() float64 {
+	if p.Size == 0 {
+		return 100
+	}
+	return float64(p.Offset) * 100 / float64(p.Size)
+}
+
+// start reports that the upload at url, sent by this call from the offset
+// from, reached offset.
+func (u *upload) start(url string, from, offset int64) {
+	u.url = url
+	u.startOffset = from
+	u.progress(offset)
+}
+
+// progress reports that the server reached offset.
+func (u *upload) progress(offset int64) {
+	if u.opts.Progress == nil {
+		return
+	}
+	u.opts.Progress(newProgress(u.url, offset, u.size, u.startOffset, u.startedAt))
+}
+
+// newProgress returns the progress of an upload at offset, which was at
+// startOffset at startedAt.
+func newProgress(url string, offset, size, startOffset int64, startedAt time.Time) Progress {
+	p := Progress{URL: url, Offset: offset, Size: size}
+	if elapsed := time.Since(startedAt).Seconds(); offset > startOffset && elapsed > 0 {
+		p.Rate = float64(offset-startOffset) / elapsed
+		p.ETA = time.Duration(float64(size-offset) / p.Rate * float64(time.Second))
+	}
+	return p
+}
+
+// resume returns the URL and offset of the upload recorded in the store,
+// an empty URL when there is none or the server doesn't know it anymore.
+func (u *upload) resume(ctx context.Context) (string, int64, error) {
+	if u.opts.Fingerprint == "" {
+		return "", 0, nil
+	}
+	st, ok, err := u.opts.Store.Get(u.opts.Fingerprint)
+	if err != nil || !ok {
+		return "", 0, err
+	}
+	if st.Size != u.size {
+		// the content changed since, it is sent again.
+		return "", 0, u.opts.Store.Delete(u.opts.Fingerprint)
+	}
+	offset, err := u.offset(ctx, st.URL)
+	var se *StatusError
+	if errors.As(err, &se) && (se.Status == http.StatusNotFound || se.Status == http.StatusGone || se.Status == http.StatusForbidden) {
+		// the upload expired or was terminated, it is sent again.
+		return "", 0, u.opts.Store.Delete(u.opts.Fingerprint)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	u.opts.Logger.Debug().
+		Str("upload_url", st.URL).
+		Int64("offset", offset).
+		Int64("recorded_offset", st.Offset).
+		Msg("resuming the upload")
+	return st.URL, offset, nil
+}
+
+// record records that the upload at url reached offset, when it has a
+// fingerprint.
+func (u *upload) record(url string, offset int64) error {
+	if u.opts.Fingerprint == "" {
+		return nil
+	}
+	return u.opts.Store.Set(u.opts.Fingerprint, State{
+		URL:       url,
+		Offset:    offset,
+		Size:      u.size,
+		UpdatedAt: time.Now().UTC(),
+	})
+}
+
+// createRetrying creates the upload, retrying the creations which may have
+// been received when the upload has an idempotency key, which prevents the
+// server from creating it twice.
+func (u *upload) createRetrying(ctx context.Context) (string, int64, error) {
+	for failures := 0; ; failures++ {
+		url, offset, err := u.create(ctx)
+		var se *StatusError
+		switch {
+		case err == nil:
+			return url, offset, nil
+		case ctx.Err() != nil, u.idempotencyKey() == "", failures >= u.opts.Retries:
+			return "", 0, err
+		case errors.As(err, &se) && se.Status < http.StatusInternalServerError:
+			// the server refused the upload, it would refuse it again.
+			return "", 0, err
+		}
+		u.opts.Logger.Warn().Err(err).Int("attempt", failures+1).Msg("creation failed, retrying")
+		select {
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		case <-time.After(u.opts.RetryDelay):
+		}
+	}
+}
+
+// idempotencyKey returns the Idempotency-Key of the creation of the
+// upload, derived from its fingerprint so that it is the same for every
+// attempt, even by another process. Uploads without fingerprint have none.
+func (u *upload) idempotencyKey() string {
+	if u.opts.Fingerprint == "" {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d", u.opts.Fingerprint, u.size)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// create creates the upload, and returns its URL and offset, the whole
+// upload when the server already has its content.
+func (u *upload) create(ctx context.Context) (string, int64, error) {
+	if u.opts.IETFDraft {
+		return u.createDraft(ctx)
+	}
+	var first *chunk
+	if u.size > 0 && u.capabilities(ctx).Supports(CreationWithUploadExtension) {
+		// the first chunk is sent with the creation, saving a round trip.
+		c, err := u.chunk(ctx, 0)
+		if err != nil {
+			return "", 0, err
+		}
+		first = &c
+	}
+	var body io.Reader
+	if first != nil {
+		body = first.body
+	}
+	req, err := u.request(ctx, http.MethodPost, u.client.endpoint, body)
+	if err != nil {
+		return "", 0, err
+	}
+	if first != nil {
+		first.set(req)
+	}
+	req.Header.Set("Upload-Length", strconv.FormatInt(u.size, 10))
+	if key := u.idempotencyKey(); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if u.partial {
+		// the metadata is sent with the final upload.
+		req.Header.Set("Upload-Concat", "partial")
+	} else if len(u.opts.Metadata) > 0 {
+		md, err := EncodeMetadata(u.opts.Metadata)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Upload-Metadata", md)
+	}
+	resp, err := u.opts.HTTPClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", 0, statusError(resp)
+	}
+	url, err := u.client.location(resp)
+	if err != nil {
+		return "", 0, err
+	}
+	var offset int64
+	if v := resp.Header.Get("Upload-Offset"); v != "" {
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return "", 0, err
+		}
+	}
+	if err := u.record(url, offset); err != nil {
+		return "", 0, err
+	}
+	return url, offset, nil
+}
+
+// cancelled aborts the upload at url cancelled by ctx, or records the
+// offset the server acknowledged last so that it is resumed from there.
+func (u *upload) cancelled(ctx context.Context, url string, offset int64) error {
+	e := &CancelledError{URL: url, Offset: offset, Err: ctx.Err()}
+	if url == "" {
+		return e
+	}
+	if e.Terminated = u.abort(ctx, url); !e.Terminated {
+		if err := u.record(url, offset); err != nil {
+			u.opts.Logger.Warn().Err(err).Str("upload_url", url).Msg("unable to record the offset of the cancelled upload")
+		}
+	}
+	return e
+}
+
+// abort terminates the upload at url cancelled by ctx, when the options
+// ask for it, and forgets it. It reports whether the upload was
+// terminated.
+func (u *upload) abort(ctx context.Context, url string) bool {
+	if !u.opts.TerminateOnCancel || errors.Is(context.Cause(ctx), errPartFailed) {
+		return false
+	}
+	// ctx is done, the termination gets a moment of its own.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), terminateTimeout)
+	defer cancel()
+	log := u.opts.Logger.With().Str("upload_url", url).Logger()
+	if err := u.client.Terminate(ctx, url); err != nil {
+		log.Warn().Err(err).Msg("unable to terminate the cancelled upload")
+		return false
+	}
+	log.Debug().Msg("cancelled upload terminated")
+	if u.opts.Fingerprint != "" {
+		if err := u.opts.Store.Delete(u.opts.Fingerprint); err != nil {
+			log.Warn().Err(err).Msg("unable to forget the terminated upload")
+		}
+	}
+	return true
+}
+
+// Terminate deletes the upload at url on the server, which frees its
+// data. An upload the server doesn't know anymore is already terminated.
+func (c *Client) Terminate(ctx context.Context, url string) error {
+	u := &upload{client: c, opts: c.opts}
+	req, err := u.request(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotFound, http.StatusGone:
+		return nil
+	default:
+		return statusError(resp)
+	}
+}
+
+// location returns the URL of the upload created by resp.
+func (c *Client) location(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("the creation response has no Location header")
+	}
+	return c.uploadURL(location), nil
+}
+
+// uploadURL returns the URL of the upload at location. The upload is
+// addressed under the endpoint, whatever the host of the location the
+// server advertises.
+func (c *Client) uploadURL(location string) string {
+	return c.endpoint + "/" + location[strings.LastIndex(location, "/")+1:]
+}
+
+// offset asks the server the offset of the upload at url.
+func (u *upload) offset(ctx context.Context, url string) (int64, error) {
+	req, err := u.request(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := u.opts.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return 0, statusError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// patch sends the chunk starting at offset, and returns the offset the
+// server reached.
+func (u *upload) patch(ctx context.Context, url string, offset int64) (int64, error) {
+	if u.opts.IETFDraft {
+		return u.patchDraft(ctx, url, offset)
+	}
+	c, err := u.chunk(ctx, offset)
+	if err != nil {
+		return 0, err
+	}
+	req, err := u.request(ctx, http.MethodPatch, url, c.body)
+	if err != nil {
+		return 0, err
+	}
+	c.set(req)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	resp, err := u.opts.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, statusError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// chunk is the body of a request sending a part of an upload.
+type chunk struct {
+	body io.Reader
+	size int64
+	// checksum is the value of the Upload-Checksum header, none when
+	// empty.
+	checksum string
+}
+
+// set sends c as the body of req.
+func (c chunk) set(req *http.Request) {
+	req.ContentLength = c.size
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	if c.checksum != "" {
+		req.Header.Set("Upload-Checksum", c.checksum)
+	}
+}
+
+// chunk returns the chunk starting at offset.
+func (u *upload) chunk(ctx context.Context, offset int64) (chunk, error) {
+	n := u.size - offset
+	if u.opts.ChunkSize > 0 {
+		n = min(n, u.opts.ChunkSize)
+	}
+	var checksum string
+	if u.opts.Checksum != "" {
+		sum, err := u.sum(offset, n)
+		if err != nil {
+			return chunk{}, err
+		}
+		checksum = u.opts.Checksum + " " + sum
+	}
+	if _, err := u.r.Seek(offset, io.SeekStart); err != nil {
+		return chunk{}, err
+	}
+	var body io.Reader = io.LimitReader(u.r, n)
+	if u.opts.Limiter != nil {
+		body = &limitedReader{ctx: ctx, r: body, limiter: u.opts.Limiter}
+	}
+	// the transport mustn't close the file being uploaded.
+	return chunk{body: io.NopCloser(body), size: n, checksum: checksum}, nil
+}
+
+// sum returns the hex encoded checksum of the n bytes at offset, as the
+// uploader expects it.
+func (u *upload) sum(offset, n int64) (string, error) {
+	var h hash.Hash
+	switch u.opts.Checksum {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %q", u.opts.Checksum)
+	}
+	if _, err := u.r.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := io.CopyN(h, u.r, n); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (u *upload) request(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range u.opts.Header {
+		req.Header[k] = v
+	}
+	if u.opts.IETFDraft {
+		req.Header.Set("Upload-Draft-Interop-Version", DraftInteropVersion)
+	} else {
+		req.Header.Set("Tus-Resumable", u.opts.TusVersion)
+	}
+	return req, nil
+}
+
+func statusError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	return &StatusError{Method: resp.Request.Method, Status: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+}
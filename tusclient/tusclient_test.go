@@ -0,0 +1,398 @@
+package tusclient_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	v3 "github.com/imrenagi/go-http-upload/api/v3"
+	"github.com/imrenagi/go-http-upload/tusclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// newServer serves the v3 API, failing the PATCH requests for which fail
+// returns true.
+func newServer(t *testing.T, fail func(r *http.Request) bool) (*httptest.Server, *v3.Store) {
+	store := v3.NewStore()
+	ctrl := v3.NewController(store, v3.WithMaxSize(1<<30), v3.WithUploadDir(t.TempDir()))
+	router := mux.NewRouter()
+	router.Use(v3.TusResumableHeaderCheck)
+	router.HandleFunc("/api/v3/files", ctrl.GetConfig()).Methods(http.MethodOptions)
+	router.HandleFunc("/api/v3/files", ctrl.CreateUpload()).Methods(http.MethodPost)
+	router.HandleFunc("/api/v3/files/{file_id}", ctrl.GetOffset()).Methods(http.MethodHead)
+	patch := ctrl.ResumeUpload()
+	router.HandleFunc("/api/v3/files/{file_id}", func(w http.ResponseWriter, r *http.Request) {
+		if fail != nil && fail(r) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		patch(w, r)
+	}).Methods(http.MethodPatch)
+	router.HandleFunc("/api/v3/files/{file_id}", ctrl.Terminate()).Methods(http.MethodDelete)
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv, store
+}
+
+func content(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+var metadata = []tusclient.Option{
+	tusclient.WithMetadata("filename", "data.bin"),
+	tusclient.WithMetadata("content-type", "application/octet-stream"),
+	tusclient.WithMetadata("checksum", "none"),
+}
+
+func uploaded(t *testing.T, store *v3.Store, url string) []byte {
+	fm, ok, _ := store.Find(filepath.Base(url))
+	assert.True(t, ok)
+	assert.True(t, fm.IsComplete())
+	b, err := os.ReadFile(fm.FilePath())
+	assert.NoError(t, err)
+	return b
+}
+
+func TestUpload(t *testing.T) {
+	data := content(1<<20 + 100)
+
+	t.Run("upload must be sent in chunks of the chunk size", func(t *testing.T) {
+		var patches atomic.Int32
+		srv, store := newServer(t, func(r *http.Request) bool {
+			patches.Add(1)
+			return false
+		})
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata, tusclient.WithChunkSize(256<<10))...)
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, int32(5), patches.Load())
+		assert.Equal(t, data, uploaded(t, store, url))
+	})
+
+	t.Run("failed chunks must be resumed from the offset of the server", func(t *testing.T) {
+		var patches atomic.Int32
+		srv, store := newServer(t, func(r *http.Request) bool {
+			return patches.Add(1) == 2
+		})
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithRetries(1, time.Millisecond))...)
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, uploaded(t, store, url))
+	})
+
+	t.Run("upload must fail once the retries are exhausted", func(t *testing.T) {
+		srv, _ := newServer(t, func(r *http.Request) bool { return true })
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata, tusclient.WithRetries(2, time.Millisecond))...)
+
+		_, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.ErrorIs(t, err, tusclient.ErrUploadFailed)
+	})
+
+	t.Run("upload recorded in the store must be resumed by another client", func(t *testing.T) {
+		var failing atomic.Bool
+		failing.Store(true)
+		var patches atomic.Int32
+		srv, store := newServer(t, func(r *http.Request) bool {
+			return patches.Add(1) > 1 && failing.Load()
+		})
+		statePath := filepath.Join(t.TempDir(), "uploads.json")
+		opts := append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithStore(tusclient.NewFileStore(statePath)),
+			tusclient.WithFingerprint("data.bin"),
+			tusclient.WithRetries(0, 0))
+
+		_, err := tusclient.New(srv.URL+"/api/v3/files", opts...).Upload(context.Background(), bytes.NewReader(data))
+		assert.ErrorIs(t, err, tusclient.ErrUploadFailed)
+
+		failing.Store(false)
+		url, err := tusclient.New(srv.URL+"/api/v3/files", opts...).Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, uploaded(t, store, url))
+		// the first chunk wasn't sent again.
+		assert.Equal(t, int32(4), patches.Load())
+		_, ok, err := tusclient.NewFileStore(statePath).Get("data.bin")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("offset reached must be recorded in the store", func(t *testing.T) {
+		var patches atomic.Int32
+		srv, _ := newServer(t, func(r *http.Request) bool {
+			return patches.Add(1) > 1
+		})
+		store := tusclient.NewMemoryStore()
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithStore(store),
+			tusclient.WithFingerprint("data.bin"),
+			tusclient.WithRetries(0, 0))...)
+
+		_, err := client.Upload(context.Background(), bytes.NewReader(data))
+		assert.ErrorIs(t, err, tusclient.ErrUploadFailed)
+
+		st, ok, err := store.Get("data.bin")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(512<<10), st.Offset)
+		assert.Equal(t, int64(len(data)), st.Size)
+		assert.NotEmpty(t, st.URL)
+	})
+
+	t.Run("upload recorded with another size must be created again", func(t *testing.T) {
+		srv, store := newServer(t, nil)
+		states := tusclient.NewMemoryStore()
+		assert.NoError(t, states.Set("data.bin", tusclient.State{URL: srv.URL + "/api/v3/files/unknown", Size: 10}))
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithStore(states),
+			tusclient.WithFingerprint("data.bin"))...)
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.NotEqual(t, srv.URL+"/api/v3/files/unknown", url)
+		assert.Equal(t, data, uploaded(t, store, url))
+	})
+
+	t.Run("progress must be reported after every chunk", func(t *testing.T) {
+		srv, _ := newServer(t, nil)
+		var offsets []int64
+		var last tusclient.Progress
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithProgress(func(p tusclient.Progress) {
+				offsets = append(offsets, p.Offset)
+				last = p
+			}))...)
+
+		_, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{0, 512 << 10, 1 << 20, int64(len(data))}, offsets)
+		assert.Equal(t, float64(100), last.Percent())
+		assert.Greater(t, last.Rate, float64(0))
+		assert.Zero(t, last.ETA)
+	})
+
+	t.Run("chunks must be sent no faster than the rate limit", func(t *testing.T) {
+		srv, store := newServer(t, nil)
+		small := content(96 << 10)
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata, tusclient.WithRateLimit(64<<10))...)
+
+		start := time.Now()
+		url, err := client.Upload(context.Background(), bytes.NewReader(small))
+
+		assert.NoError(t, err)
+		// the first 32KiB are sent at once, the rest in a second.
+		assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+		assert.Equal(t, small, uploaded(t, store, url))
+	})
+
+	t.Run("chunks must be sent with the checksum the server supports", func(t *testing.T) {
+		var checksums []string
+		srv, store := newServer(t, func(r *http.Request) bool {
+			checksums = append(checksums, r.Header.Get("Upload-Checksum"))
+			return false
+		})
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithChecksum("sha1"))...)
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Len(t, checksums, 3)
+		assert.Regexp(t, `^sha1 [0-9a-f]{40}$`, checksums[0])
+		assert.Equal(t, data, uploaded(t, store, url))
+	})
+
+	t.Run("cancelled upload must be terminated when asked to", func(t *testing.T) {
+		srv, store := newServer(t, nil)
+		states := tusclient.NewMemoryStore()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var url string
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithStore(states),
+			tusclient.WithFingerprint("data.bin"),
+			tusclient.WithTerminateOnCancel(true),
+			tusclient.WithProgress(func(p tusclient.Progress) {
+				url = p.URL
+				if p.Offset > 0 {
+					cancel()
+				}
+			}))...)
+
+		_, err := client.Upload(ctx, bytes.NewReader(data))
+
+		assert.ErrorIs(t, err, context.Canceled)
+		var cancelled *tusclient.CancelledError
+		assert.ErrorAs(t, err, &cancelled)
+		assert.False(t, cancelled.Resumable())
+		_, ok, _ := store.Find(filepath.Base(url))
+		assert.False(t, ok)
+		_, ok, _ = states.Get("data.bin")
+		assert.False(t, ok)
+	})
+
+	t.Run("cancelled upload must be kept to be resumed by default", func(t *testing.T) {
+		srv, store := newServer(t, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var url string
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithProgress(func(p tusclient.Progress) {
+				url = p.URL
+				if p.Offset > 0 {
+					cancel()
+				}
+			}))...)
+
+		_, err := client.Upload(ctx, bytes.NewReader(data))
+
+		assert.ErrorIs(t, err, context.Canceled)
+		var cancelled *tusclient.CancelledError
+		assert.ErrorAs(t, err, &cancelled)
+		assert.True(t, cancelled.Resumable())
+		assert.Equal(t, url, cancelled.URL)
+		_, ok, _ := store.Find(filepath.Base(url))
+		assert.True(t, ok)
+	})
+
+	t.Run("upload past its deadline must stop mid-chunk and record the acknowledged offset", func(t *testing.T) {
+		srv, store := newServer(t, nil)
+		states := tusclient.NewMemoryStore()
+		opts := append(metadata,
+			tusclient.WithChunkSize(64<<10),
+			tusclient.WithStore(states),
+			tusclient.WithFingerprint("data.bin"))
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+
+		_, err := tusclient.New(srv.URL+"/api/v3/files", append(opts, tusclient.WithRateLimit(128<<10))...).
+			Upload(ctx, bytes.NewReader(data))
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.NotErrorIs(t, err, tusclient.ErrUploadFailed)
+		var cancelled *tusclient.CancelledError
+		assert.ErrorAs(t, err, &cancelled)
+		assert.True(t, cancelled.Resumable())
+		assert.Greater(t, cancelled.Offset, int64(0))
+		assert.Less(t, cancelled.Offset, int64(len(data)))
+		st, ok, _ := states.Get("data.bin")
+		assert.True(t, ok)
+		assert.Equal(t, cancelled.Offset, st.Offset)
+
+		url, err := tusclient.New(srv.URL+"/api/v3/files", opts...).Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, cancelled.URL, url)
+		assert.Equal(t, data, uploaded(t, store, url))
+	})
+
+	t.Run("headers must be sent with every request", func(t *testing.T) {
+		srv, _ := newServer(t, func(r *http.Request) bool {
+			return r.Header.Get("Authorization") != "Bearer token"
+		})
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithHeader("Authorization", "Bearer token"),
+			tusclient.WithRetries(0, 0))...)
+
+		_, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("verified upload must match the sha256 of the server", func(t *testing.T) {
+		srv, store := newServer(t, nil)
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithChunkSize(512<<10),
+			tusclient.WithVerify(true))...)
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, uploaded(t, store, url))
+	})
+
+	t.Run("verified upload must fail when the server reports another sha256", func(t *testing.T) {
+		srv, _ := newServer(t, nil)
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithHTTPClient(&http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+				resp, err := http.DefaultTransport.RoundTrip(r)
+				if err == nil && r.Method == http.MethodHead {
+					resp.Header.Set("ETag", `"`+strings.Repeat("0", 64)+`"`)
+				}
+				return resp, err
+			})}),
+			tusclient.WithVerify(true))...)
+
+		_, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.ErrorIs(t, err, tusclient.ErrVerificationFailed)
+	})
+
+	t.Run("creation whose response is lost must be retried without creating another upload", func(t *testing.T) {
+		srv, store := newServer(t, nil)
+		var lost atomic.Bool
+		client := tusclient.New(srv.URL+"/api/v3/files", append(metadata,
+			tusclient.WithFingerprint("data.bin"),
+			tusclient.WithRetries(1, time.Millisecond),
+			tusclient.WithHTTPClient(&http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+				resp, err := http.DefaultTransport.RoundTrip(r)
+				if err == nil && r.Method == http.MethodPost && !lost.Swap(true) {
+					resp.Body.Close()
+					return nil, errors.New("connection reset")
+				}
+				return resp, err
+			})}))...)
+
+		url, err := client.Upload(context.Background(), bytes.NewReader(data))
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, uploaded(t, store, url))
+		files, _, err := store.List(v3.ListQuery{})
+		assert.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestFingerprint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	assert.NoError(t, os.WriteFile(path, []byte("data"), 0600))
+	before, err := tusclient.Fingerprint(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte("modified"), 0600))
+	after, err := tusclient.Fingerprint(path)
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, before, after)
+}
@@ -0,0 +1,61 @@
+package tusclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ErrVerificationFailed is returned by an upload made WithVerify when the
+// server doesn't hold the content sent.
+var ErrVerificationFailed = errors.New("upload verification failed")
+
+// verify compares the length, offset and ETag the server reports for the
+// completed upload at url with the size and sha256 of r.
+func (c *Client) verify(ctx context.Context, url string, r io.ReadSeeker, size int64, o Options) error {
+	u := &upload{client: c, opts: o}
+	req, err := u.request(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return statusError(resp)
+	}
+	for _, h := range []string{"Upload-Offset", "Upload-Length"} {
+		v := resp.Header.Get(h)
+		if v == "" && h == "Upload-Length" {
+			continue
+		}
+		if n, err := strconv.ParseInt(v, 10, 64); err != nil || n != size {
+			return fmt.Errorf("%w: %s is %q, %d bytes were sent", ErrVerificationFailed, h, v, size)
+		}
+	}
+
+	etag := resp.Header.Get("ETag")
+	want, ok := etagSHA256(etag)
+	if !ok {
+		o.Logger.Debug().Str("upload_url", url).Str("etag", etag).Msg("the server reports no sha256, only the length of the upload is verified")
+		return nil
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("unable to hash the upload: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%w: sha256 %s, the server reports %s", ErrVerificationFailed, got, want)
+	}
+	return nil
+}
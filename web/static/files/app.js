@@ -0,0 +1,112 @@
+let cursor = '';
+
+function formatBytes(n) {
+    const units = ['B', 'KB', 'MB', 'GB'];
+    let i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+        n /= 1024;
+        i++;
+    }
+    return n.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+
+function showMessage(text, error) {
+    const message = document.getElementById('message');
+    message.textContent = text;
+    message.className = error ? 'error' : '';
+}
+
+async function errorMessage(response) {
+    try {
+        const body = await response.json();
+        return body.message || response.statusText;
+    } catch {
+        return response.statusText;
+    }
+}
+
+async function loadMore() {
+    const params = new URLSearchParams({status: 'completed', limit: '50'});
+    if (cursor) {
+        params.set('cursor', cursor);
+    }
+
+    const response = await fetch('/api/v3/files?' + params);
+    if (response.status === 401) {
+        window.location.assign('/login?next=' + encodeURIComponent(window.location.pathname));
+        return;
+    }
+    if (!response.ok) {
+        showMessage('Listing failed: ' + await errorMessage(response), true);
+        return;
+    }
+    const body = await response.json();
+    for (const file of body.files) {
+        // quarantined files can't be downloaded.
+        if (!file.quarantined) {
+            document.getElementById('files').append(card(file));
+        }
+    }
+    cursor = body.next_cursor || '';
+    document.getElementById('moreButton').hidden = !cursor;
+}
+
+function card(file) {
+    const name = (file.metadata && file.metadata.filename) || file.id;
+    const contentType = (file.metadata && file.metadata['content-type']) || '';
+
+    const div = document.createElement('div');
+    div.className = 'file';
+
+    const preview = document.createElement('div');
+    preview.className = 'preview';
+    const label = name.includes('.') ? name.split('.').pop().toUpperCase() : 'FILE';
+    if (contentType.startsWith('image/')) {
+        // thumbnails are only generated when the server is configured to,
+        // so the label is shown when there is none.
+        const img = document.createElement('img');
+        img.alt = name;
+        img.loading = 'lazy';
+        img.src = '/api/v3/files/' + file.id + '/thumbnail';
+        img.onerror = () => preview.replaceChildren(label);
+        preview.append(img);
+    } else {
+        preview.textContent = label;
+    }
+
+    const title = document.createElement('div');
+    title.textContent = name;
+    const size = document.createElement('div');
+    size.className = 'size';
+    size.textContent = formatBytes(file.offset);
+
+    const download = document.createElement('a');
+    download.href = file.cdn_url || '/api/v3/files/' + file.id;
+    download.textContent = 'Download';
+    const share = document.createElement('button');
+    share.type = 'button';
+    share.textContent = 'Copy signed link';
+    share.onclick = () => copySignedLink(file, share);
+
+    div.append(preview, title, size, download, ' ', share);
+    return div;
+}
+
+async function copySignedLink(file, button) {
+    const response = await fetch('/api/v3/files/' + file.id + '/download-url', {method: 'POST'});
+    if (response.status === 501) {
+        button.hidden = true;
+        showMessage('The server does not sign download links', true);
+        return;
+    }
+    if (!response.ok) {
+        showMessage('Signing the link failed: ' + await errorMessage(response), true);
+        return;
+    }
+    const body = await response.json();
+    await navigator.clipboard.writeText(body.url);
+    showMessage('Copied a link to ' + ((file.metadata && file.metadata.filename) || file.id) +
+        ' valid until ' + new Date(body.expires_at).toLocaleString());
+}
+
+loadMore();
@@ -0,0 +1,45 @@
+function showMessage(text, error) {
+    const message = document.getElementById('message');
+    message.textContent = text;
+    message.className = error ? 'error' : '';
+}
+
+// next returns the page to go back to once logged in, which must be a page
+// of the server.
+function next() {
+    const target = new URLSearchParams(window.location.search).get('next') || '/uploads';
+    if (!target.startsWith('/') || target.startsWith('//') || target.startsWith('/\\')) {
+        return '/uploads';
+    }
+    return target;
+}
+
+async function logIn(event) {
+    event.preventDefault();
+
+    const credential = document.getElementById('credentialInput').value.trim();
+    const headers = {};
+    if (document.getElementById('kindInput').value === 'apikey') {
+        headers['X-Api-Key'] = credential;
+    } else {
+        headers['Authorization'] = 'Bearer ' + credential;
+    }
+
+    const response = await fetch('/api/sessions', {method: 'POST', headers});
+    if (!response.ok) {
+        let message = response.statusText;
+        try {
+            message = (await response.json()).message || message;
+        } catch {
+        }
+        showMessage('Login failed: ' + message, true);
+        return;
+    }
+    window.location.assign(next());
+}
+
+async function logOut() {
+    await fetch('/api/sessions', {method: 'DELETE'});
+    document.getElementById('loginForm').reset();
+    showMessage('Logged out');
+}
@@ -0,0 +1,140 @@
+let cursor = '';
+
+function formatBytes(n) {
+    const units = ['B', 'KB', 'MB', 'GB'];
+    let i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+        n /= 1024;
+        i++;
+    }
+    return n.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+
+function formatTime(t) {
+    return t ? new Date(t).toLocaleString() : '';
+}
+
+function showMessage(text, error) {
+    const message = document.getElementById('message');
+    message.textContent = text;
+    message.className = error ? 'error' : '';
+}
+
+async function errorMessage(response) {
+    try {
+        const body = await response.json();
+        return body.message || response.statusText;
+    } catch {
+        return response.statusText;
+    }
+}
+
+function reload(event) {
+    if (event) {
+        event.preventDefault();
+    }
+    cursor = '';
+    document.getElementById('uploads').replaceChildren();
+    loadMore();
+}
+
+async function loadMore() {
+    const params = new URLSearchParams({limit: '50'});
+    const status = document.getElementById('statusFilter').value;
+    const owner = document.getElementById('ownerFilter').value.trim();
+    if (status) {
+        params.set('status', status);
+    }
+    if (owner) {
+        params.set('owner', owner);
+    }
+    if (cursor) {
+        params.set('cursor', cursor);
+    }
+
+    const response = await fetch('/api/v3/files?' + params);
+    if (response.status === 401) {
+        window.location.assign('/login?next=' + encodeURIComponent(window.location.pathname));
+        return;
+    }
+    if (!response.ok) {
+        showMessage('Listing failed: ' + await errorMessage(response), true);
+        return;
+    }
+    const body = await response.json();
+    showMessage('');
+    for (const file of body.files) {
+        document.getElementById('uploads').append(row(file));
+    }
+    cursor = body.next_cursor || '';
+    document.getElementById('moreButton').hidden = !cursor;
+}
+
+function row(file) {
+    const tr = document.createElement('tr');
+    const size = file.total_size !== undefined
+        ? formatBytes(file.offset) + ' / ' + formatBytes(file.total_size)
+        : formatBytes(file.offset) + ' / ?';
+    const cells = [
+        (file.metadata && file.metadata.filename) || file.id,
+        file.status,
+        size,
+        file.owner || '',
+        formatTime(file.created_at),
+        formatTime(file.expires_at)
+    ];
+    for (const text of cells) {
+        const td = document.createElement('td');
+        td.textContent = text;
+        tr.append(td);
+    }
+
+    const actions = document.createElement('td');
+    if (file.status === 'completed') {
+        const copy = document.createElement('button');
+        copy.type = 'button';
+        copy.textContent = 'Copy link';
+        copy.onclick = () => copyLink(file);
+        actions.append(copy, ' ');
+    }
+    const terminate = document.createElement('button');
+    terminate.type = 'button';
+    terminate.textContent = 'Terminate';
+    terminate.onclick = () => terminateUpload(file, tr);
+    actions.append(terminate);
+    tr.append(actions);
+    return tr;
+}
+
+// copyLink copies a signed download url of the upload, or its plain url
+// when the server doesn't sign urls.
+async function copyLink(file) {
+    let url = window.location.origin + '/api/v3/files/' + file.id;
+    const response = await fetch('/api/v3/files/' + file.id + '/download-url', {method: 'POST'});
+    if (response.ok) {
+        url = (await response.json()).url;
+    } else if (response.status !== 501) {
+        showMessage('Copying the link failed: ' + await errorMessage(response), true);
+        return;
+    }
+    await navigator.clipboard.writeText(url);
+    showMessage('Copied the link of ' + file.id);
+}
+
+async function terminateUpload(file, tr) {
+    if (!confirm('Terminate ' + ((file.metadata && file.metadata.filename) || file.id) + '?')) {
+        return;
+    }
+    const response = await fetch('/api/v3/files/' + file.id, {
+        method: 'DELETE',
+        headers: {'Tus-Resumable': '1.0.0'}
+    });
+    if (!response.ok) {
+        showMessage('Terminating failed: ' + await errorMessage(response), true);
+        return;
+    }
+    tr.remove();
+    showMessage('Terminated ' + file.id);
+}
+
+reload();
@@ -0,0 +1,105 @@
+const queue = [];
+let uploading = false;
+
+const dropZone = document.getElementById('dropZone');
+dropZone.addEventListener('dragover', event => {
+    event.preventDefault();
+    dropZone.classList.add('over');
+});
+dropZone.addEventListener('dragleave', () => dropZone.classList.remove('over'));
+dropZone.addEventListener('drop', event => {
+    event.preventDefault();
+    dropZone.classList.remove('over');
+    addFiles(event.dataTransfer.files);
+});
+document.getElementById('fileInput').addEventListener('change', event => {
+    addFiles(event.target.files);
+    event.target.value = '';
+});
+
+function formatBytes(n) {
+    const units = ['B', 'KB', 'MB', 'GB'];
+    let i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+        n /= 1024;
+        i++;
+    }
+    return n.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+
+function addFiles(files) {
+    for (const file of files) {
+        const row = document.createElement('div');
+        row.className = 'file';
+        const name = document.createElement('span');
+        name.textContent = file.name + ' ';
+        const bar = document.createElement('progress');
+        bar.max = file.size || 1;
+        bar.value = 0;
+        const status = document.createElement('span');
+        status.textContent = ' queued';
+        row.append(name, bar, status);
+        document.getElementById('files').append(row);
+        queue.push({file, row, bar, status});
+    }
+    next();
+}
+
+// files are uploaded one after the other, so that each gets the whole
+// bandwidth and its speed is meaningful.
+function next() {
+    if (uploading || queue.length === 0) {
+        return;
+    }
+    uploading = true;
+    upload(queue.shift()).finally(() => {
+        uploading = false;
+        next();
+    });
+}
+
+function upload({file, row, bar, status}) {
+    return new Promise(resolve => {
+        const xhr = new XMLHttpRequest();
+        const started = performance.now();
+        xhr.open('POST', '/api/v1/binary');
+        xhr.setRequestHeader('X-Api-File-Name', file.name);
+        xhr.responseType = 'json';
+        xhr.upload.onprogress = event => {
+            bar.value = event.loaded;
+            const seconds = (performance.now() - started) / 1000;
+            const speed = seconds > 0 ? formatBytes(event.loaded / seconds) + '/s' : '';
+            status.textContent = ' ' + formatBytes(event.loaded) + ' / ' + formatBytes(event.total) + ' ' + speed;
+        };
+        xhr.onload = () => {
+            const body = xhr.response || {};
+            if (xhr.status !== 200) {
+                fail(status, body.message || xhr.statusText);
+                resolve();
+                return;
+            }
+            bar.value = bar.max;
+            status.textContent = ' ' + formatBytes(body.size) + ', sha256 ' + body.checksum + ' ';
+            if (body.url) {
+                const link = document.createElement('a');
+                link.href = body.url;
+                link.textContent = 'Download';
+                status.append(link);
+            }
+            resolve();
+        };
+        xhr.onerror = () => {
+            fail(status, 'network error');
+            resolve();
+        };
+        xhr.send(file);
+    });
+}
+
+function fail(status, message) {
+    status.textContent = ' ';
+    const error = document.createElement('span');
+    error.className = 'error';
+    error.textContent = 'Upload failed: ' + message;
+    status.append(error);
+}
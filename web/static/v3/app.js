@@ -0,0 +1,84 @@
+// the server announces its uploads at a fixed address, which is
+// rewritten to the one of the page.
+const announced = 'http://127.0.0.1:8080/files/';
+
+class PageHttpStack extends tus.DefaultHttpStack {
+    createRequest(method, url) {
+        if (url.startsWith(announced)) {
+            url = window.location.origin + '/api/v3/files/' + url.slice(announced.length);
+        }
+        return super.createRequest(method, url);
+    }
+}
+
+let upload = null;
+
+function setButtons(state) {
+    document.getElementById('startButton').disabled = state === 'uploading' || state === 'paused' || state === 'failed';
+    document.getElementById('pauseButton').disabled = state !== 'uploading';
+    document.getElementById('resumeButton').disabled = state !== 'paused';
+    document.getElementById('retryButton').disabled = state !== 'failed';
+}
+
+function startUpload(event) {
+    event.preventDefault();
+
+    const file = document.getElementById('fileInput').files[0];
+    if (!file) {
+        alert('Please select a file first');
+        return;
+    }
+    document.getElementById('result').textContent = '';
+
+    upload = new tus.Upload(file, {
+        endpoint: '/api/v3/files',
+        httpStack: new PageHttpStack(),
+        chunkSize: 5 * 1024 * 1024,
+        retryDelays: [0, 1000, 3000, 5000],
+        metadata: {
+            filename: file.name,
+            filetype: file.type || 'application/octet-stream'
+        },
+        onProgress: (sent, total) => {
+            document.getElementById('progressBar').value = total ? sent / total * 100 : 0;
+            document.getElementById('progressText').textContent = sent + ' / ' + total + ' bytes';
+        },
+        onError: error => {
+            console.error('Error:', error);
+            document.getElementById('progressText').textContent = 'Upload failed: ' + error.message;
+            setButtons('failed');
+        },
+        onSuccess: () => {
+            const id = upload.url.split('/').pop();
+            const result = document.getElementById('result');
+            result.textContent = 'Uploaded ' + file.name + ' (' + file.size + ' bytes) ';
+            const link = document.createElement('a');
+            link.href = '/api/v3/files/' + id;
+            link.textContent = 'Download';
+            result.append(link);
+            setButtons('done');
+            document.getElementById('uploadForm').reset();
+        }
+    });
+
+    // an upload of the same file interrupted earlier, even by closing
+    // the page, is resumed rather than started over.
+    upload.findPreviousUploads().then(previous => {
+        if (previous.length > 0) {
+            upload.resumeFromPreviousUpload(previous[0]);
+        }
+        upload.start();
+        setButtons('uploading');
+    });
+}
+
+function pauseUpload() {
+    upload.abort();
+    document.getElementById('progressText').textContent += ' (paused)';
+    setButtons('paused');
+}
+
+function resumeUpload() {
+    upload.start();
+    setButtons('uploading');
+}
@@ -0,0 +1,77 @@
+// Package web serves the pages of the upload UI and their assets, which are
+// embedded in the binary from the static directory.
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var static embed.FS
+
+// asset is an embedded file and the ETag of its content.
+type asset struct {
+	data []byte
+	etag string
+}
+
+// assets are the embedded files by their path relative to static.
+var assets = loadAssets()
+
+func loadAssets() map[string]asset {
+	assets := make(map[string]asset)
+	err := fs.WalkDir(static, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := static.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		assets[strings.TrimPrefix(name, "static/")] = asset{
+			data: data,
+			etag: `"` + hex.EncodeToString(sum[:16]) + `"`,
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return assets
+}
+
+// Handler serves the assets by their path relative to the static directory,
+// the prefix of the route being stripped beforehand. The embedded files have
+// no modification time, so they are revalidated by their ETag.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, path.Clean(strings.TrimPrefix(r.URL.Path, "/")))
+	})
+}
+
+// Page serves the asset name, such as a page served at a route of its own.
+func Page(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, name)
+	}
+}
+
+func serve(w http.ResponseWriter, r *http.Request, name string) {
+	a, ok := assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", a.etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(a.data))
+}
@@ -0,0 +1,65 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/imrenagi/go-http-upload/web"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	handler := http.StripPrefix("/static/", web.Handler())
+
+	t.Run("asset must be served with its content type and ETag", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/static/v1/app.js", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "javascript")
+		assert.NotEmpty(t, w.Header().Get("ETag"))
+		assert.NotEmpty(t, w.Body.String())
+	})
+
+	t.Run("asset matching the ETag must not be modified", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/static/v1/style.css", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		req = httptest.NewRequest(http.MethodGet, "/static/v1/style.css", nil)
+		req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotModified, w.Code)
+	})
+
+	t.Run("unknown asset must not be found", func(t *testing.T) {
+		for _, p := range []string{"/static/v1/missing.js", "/static/../web.go", "/static/v1"} {
+			req := httptest.NewRequest(http.MethodGet, p, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusNotFound, w.Code, p)
+		}
+	})
+}
+
+func TestPage(t *testing.T) {
+	for _, page := range []string{"v1", "v3", "uploads", "files", "login"} {
+		t.Run(page+" page must link its script", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+page, nil)
+			w := httptest.NewRecorder()
+
+			web.Page(page+"/index.html").ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+			assert.Contains(t, w.Body.String(), "/static/"+page+"/app.js")
+		})
+	}
+}
@@ -0,0 +1,260 @@
+// Package webhook delivers upload lifecycle events to HTTP endpoints.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+	EventIDHeader   = "X-Webhook-Id"
+
+	defaultMaxAttempts = 5
+	defaultBackoff     = time.Second
+	maxBackoff         = 5 * time.Minute
+)
+
+// Signature returns the value of the SignatureHeader of a delivery. It
+// covers the timestamp so that receivers can reject replayed deliveries.
+func Signature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is a valid SignatureHeader of a delivery.
+func Verify(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Signature(secret, timestamp, body)), []byte(signature))
+}
+
+type Options struct {
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+	Concurrency int
+	QueueSize   int
+	DeadLetter  io.Writer
+}
+
+type Option func(*Options)
+
+func WithClient(client *http.Client) Option {
+	return func(o *Options) {
+		o.Client = client
+	}
+}
+
+// WithRetries makes up to attempts deliveries of every event, waiting
+// backoff after the first failure and doubling the wait after every other.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(o *Options) {
+		o.MaxAttempts = attempts
+		o.Backoff = backoff
+	}
+}
+
+// WithDeadLetter writes the events which couldn't be delivered to w, one
+// JSON record per line, so that they can be replayed.
+func WithDeadLetter(w io.Writer) Option {
+	return func(o *Options) {
+		o.DeadLetter = w
+	}
+}
+
+func WithConcurrency(n int) Option {
+	return func(o *Options) {
+		o.Concurrency = n
+	}
+}
+
+func WithQueueSize(n int) Option {
+	return func(o *Options) {
+		o.QueueSize = n
+	}
+}
+
+type delivery struct {
+	endpoint string
+	event    hooks.Event
+	body     []byte
+}
+
+// deadLetter is a record of the dead-letter log.
+type deadLetter struct {
+	Time     time.Time       `json:"time"`
+	Endpoint string          `json:"endpoint"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Event    json.RawMessage `json:"event"`
+}
+
+// Notifier posts every event to the configured endpoints in the background.
+// Deliveries failing with a network error, a 408, a 429 or a 5xx response
+// are retried with an exponential backoff; the ones which still fail are
+// written to the dead-letter log.
+type Notifier struct {
+	endpoints   []string
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	concurrency int
+	queue       chan delivery
+
+	mu         sync.Mutex
+	deadLetter io.Writer
+}
+
+func NewNotifier(endpoints []string, secret []byte, opts ...Option) *Notifier {
+	o := Options{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: defaultMaxAttempts,
+		Backoff:     defaultBackoff,
+		Concurrency: 4,
+		QueueSize:   1000,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Notifier{
+		endpoints:   endpoints,
+		secret:      secret,
+		client:      o.Client,
+		maxAttempts: max(1, o.MaxAttempts),
+		backoff:     o.Backoff,
+		concurrency: max(1, o.Concurrency),
+		queue:       make(chan delivery, o.QueueSize),
+		deadLetter:  o.DeadLetter,
+	}
+}
+
+// Publish queues the delivery of e to every endpoint without blocking.
+func (n *Notifier) Publish(ctx context.Context, e hooks.Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Str("event_id", e.ID).Msg("unable to encode the webhook event")
+		return
+	}
+	for _, endpoint := range n.endpoints {
+		d := delivery{endpoint: endpoint, event: e, body: body}
+		select {
+		case n.queue <- d:
+		default:
+			n.dead(d, 0, errors.New("webhook queue is full"))
+		}
+	}
+}
+
+// Run delivers the queued events until ctx is canceled.
+func (n *Notifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < n.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-n.queue:
+					n.deliver(ctx, d)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (n *Notifier) deliver(ctx context.Context, d delivery) {
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(ctx, d)
+		if err == nil {
+			log.Debug().Str("event_id", d.event.ID).Str("endpoint", d.endpoint).Int("attempt", attempt).Msg("webhook delivered")
+			return
+		}
+		log.Warn().Err(err).Str("event_id", d.event.ID).Str("endpoint", d.endpoint).Int("attempt", attempt).Msg("webhook delivery failed")
+		if !retry || attempt == n.maxAttempts {
+			n.dead(d, attempt, err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			n.dead(d, attempt, err)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// post makes a single delivery and reports whether a failure is worth
+// retrying.
+func (n *Notifier) post(ctx context.Context, d delivery) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, d.event.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Signature(n.secret, timestamp, d.body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	}
+}
+
+func (n *Notifier) dead(d delivery, attempts int, err error) {
+	log.Error().Err(err).Str("event_id", d.event.ID).Str("endpoint", d.endpoint).Msg("webhook dead-lettered")
+	if n.deadLetter == nil {
+		return
+	}
+	b, _ := json.Marshal(deadLetter{
+		Time:     time.Now().UTC(),
+		Endpoint: d.endpoint,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Event:    d.body,
+	})
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, err := n.deadLetter.Write(append(b, '\n')); err != nil {
+		log.Error().Err(err).Msg("unable to write the webhook dead-letter log")
+	}
+}
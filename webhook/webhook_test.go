@@ -0,0 +1,154 @@
+package webhook_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/hooks"
+	"github.com/imrenagi/go-http-upload/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a dead-letter log safe to read while the notifier writes.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestNotifier(t *testing.T) {
+	secret := []byte("secret")
+	upload := hooks.Upload{ID: "a", Size: 5, Offset: 5}
+
+	run := func(t *testing.T, n *webhook.Notifier) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go n.Run(ctx)
+	}
+
+	t.Run("event must be delivered with a valid signature", func(t *testing.T) {
+		received := make(chan hooks.Event, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			assert.True(t, webhook.Verify(secret, r.Header.Get(webhook.TimestampHeader), body, r.Header.Get(webhook.SignatureHeader)))
+			var e hooks.Event
+			assert.NoError(t, json.Unmarshal(body, &e))
+			assert.Equal(t, e.ID, r.Header.Get(webhook.EventIDHeader))
+			received <- e
+		}))
+		defer srv.Close()
+		n := webhook.NewNotifier([]string{srv.URL}, secret)
+		run(t, n)
+
+		hooks.SinkHooks(n).PostFinish(context.Background(), upload)
+
+		select {
+		case e := <-received:
+			assert.Equal(t, hooks.EventCompleted, e.Type)
+			assert.Equal(t, upload.ID, e.Upload.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("event was not delivered")
+		}
+	})
+
+	t.Run("failed delivery must be retried", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+		dead := &syncBuffer{}
+		n := webhook.NewNotifier([]string{srv.URL}, secret, webhook.WithRetries(5, time.Millisecond), webhook.WithDeadLetter(dead))
+		run(t, n)
+
+		n.Publish(context.Background(), hooks.NewEvent(hooks.EventCompleted, upload))
+
+		assert.Eventually(t, func() bool { return calls.Load() == 3 }, 5*time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		assert.EqualValues(t, 3, calls.Load())
+		assert.Empty(t, dead.String())
+	})
+
+	t.Run("event must be dead-lettered once every attempt failed", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer srv.Close()
+		dead := &syncBuffer{}
+		n := webhook.NewNotifier([]string{srv.URL}, secret, webhook.WithRetries(3, time.Millisecond), webhook.WithDeadLetter(dead))
+		run(t, n)
+
+		e := hooks.NewEvent(hooks.EventCompleted, upload)
+		n.Publish(context.Background(), e)
+
+		assert.Eventually(t, func() bool { return dead.String() != "" }, 5*time.Second, time.Millisecond)
+		assert.EqualValues(t, 3, calls.Load())
+		var record struct {
+			Endpoint string      `json:"endpoint"`
+			Attempts int         `json:"attempts"`
+			Event    hooks.Event `json:"event"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(dead.String()), &record))
+		assert.Equal(t, srv.URL, record.Endpoint)
+		assert.Equal(t, 3, record.Attempts)
+		assert.Equal(t, e.ID, record.Event.ID)
+	})
+
+	t.Run("delivery rejected by the endpoint must not be retried", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+		dead := &syncBuffer{}
+		n := webhook.NewNotifier([]string{srv.URL}, secret, webhook.WithRetries(3, time.Millisecond), webhook.WithDeadLetter(dead))
+		run(t, n)
+
+		n.Publish(context.Background(), hooks.NewEvent(hooks.EventCompleted, upload))
+
+		assert.Eventually(t, func() bool { return dead.String() != "" }, 5*time.Second, time.Millisecond)
+		assert.EqualValues(t, 1, calls.Load())
+	})
+
+	t.Run("events of other types must not be delivered", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+		defer srv.Close()
+		n := webhook.NewNotifier([]string{srv.URL}, secret)
+		run(t, n)
+		h := hooks.SinkHooks(hooks.FilterEvents(n, hooks.EventCompleted))
+
+		h.PostReceiveChunk(context.Background(), upload)
+		h.PostFinish(context.Background(), upload)
+
+		assert.Eventually(t, func() bool { return calls.Load() == 1 }, 5*time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		assert.EqualValues(t, 1, calls.Load())
+	})
+}
@@ -0,0 +1,59 @@
+// Package workerpool runs the jobs queued by the upload handlers in the
+// background with a bounded concurrency, so that completing an upload
+// doesn't wait for them. It backs the thumbnail, pipeline and finalize
+// workers.
+package workerpool
+
+import (
+	"context"
+	"sync"
+)
+
+// Pool runs every queued job with a function given to New.
+type Pool[J any] struct {
+	concurrency int
+	jobs        chan J
+	run         func(ctx context.Context, job J)
+	errFull     error
+	wg          sync.WaitGroup
+}
+
+// New returns a pool running run on the jobs queued, up to concurrency at
+// the same time. Enqueue returns errFull once queueSize jobs are waiting.
+func New[J any](concurrency, queueSize int, errFull error, run func(ctx context.Context, job J)) *Pool[J] {
+	return &Pool[J]{
+		concurrency: max(1, concurrency),
+		jobs:        make(chan J, queueSize),
+		run:         run,
+		errFull:     errFull,
+	}
+}
+
+// Enqueue schedules the job without blocking.
+func (p *Pool[J]) Enqueue(job J) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		return p.errFull
+	}
+}
+
+// Run processes the queued jobs until ctx is canceled.
+func (p *Pool[J]) Run(ctx context.Context) {
+	for i := 0; i < p.concurrency; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-p.jobs:
+					p.run(ctx, job)
+				}
+			}
+		}()
+	}
+	p.wg.Wait()
+}
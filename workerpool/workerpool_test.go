@@ -0,0 +1,65 @@
+package workerpool_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imrenagi/go-http-upload/workerpool"
+	"github.com/stretchr/testify/assert"
+)
+
+var errFull = errors.New("queue is full")
+
+func TestPool(t *testing.T) {
+	t.Run("queued jobs must be run", func(t *testing.T) {
+		var mu sync.Mutex
+		var done []string
+		p := workerpool.New(2, 10, errFull, func(ctx context.Context, id string) {
+			mu.Lock()
+			defer mu.Unlock()
+			done = append(done, id)
+		})
+		for _, id := range []string{"a", "b", "c"} {
+			assert.NoError(t, p.Enqueue(id))
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go p.Run(ctx)
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(done) == 3
+		}, time.Second, 10*time.Millisecond)
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, done)
+	})
+
+	t.Run("jobs queued past the queue size must be rejected", func(t *testing.T) {
+		p := workerpool.New(1, 1, errFull, func(context.Context, string) {})
+
+		assert.NoError(t, p.Enqueue("a"))
+		assert.ErrorIs(t, p.Enqueue("b"), errFull)
+	})
+
+	t.Run("run must return once the context is canceled", func(t *testing.T) {
+		p := workerpool.New(3, 1, errFull, func(context.Context, string) {})
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			p.Run(ctx)
+			close(stopped)
+		}()
+
+		cancel()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("pool still running")
+		}
+	})
+}